@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	flag "github.com/spf13/pflag"
+
+	"sehlabs.com/db/internal/migrate"
+)
+
+// isServerURL reports whether the given operand of the diff command identifies a live server
+// rather than a file.
+func isServerURL(operand string) bool {
+	return strings.HasPrefix(operand, "http://") || strings.HasPrefix(operand, "https://")
+}
+
+// exportSource returns a source of the records in the CSV dump stored in the file at the given
+// path, or of the records of the live server whose administrative listener has the given URL.
+func exportSource(ctx context.Context, operand string) migrate.RecordSource {
+	return func(consume migrate.RecordConsumer) error {
+		var r io.ReadCloser
+		if isServerURL(operand) {
+			res, err := requestExport(ctx, operand, url.Values{"format": {"csv"}})
+			if err != nil {
+				return err
+			}
+			r = res.Body
+		} else {
+			f, err := os.Open(operand)
+			if err != nil {
+				return err
+			}
+			r = f
+		}
+		defer r.Close()
+		if _, err := migrate.ReadExportCSV(r, consume); err != nil {
+			return fmt.Errorf("reading records from %s: %w", operand, err)
+		}
+		return nil
+	}
+}
+
+// displayKey renders the given key for display on its own line, quoting it if it contains
+// characters that wouldn't display legibly.
+func displayKey(k []byte) string {
+	s := string(k)
+	if !utf8.ValidString(s) || strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// runDiff writes a line to the given writer for each record that differs between two sets of
+// records, each either a CSV dump written by the export command or a live server, marking records
+// added with "+", removed with "-", and changed with "~".
+func runDiff(ctx context.Context, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("diff requires exactly two dump file paths or server URLs, got %d arguments", flags.NArg())
+	}
+	c, err := migrate.CompareRecords(exportSource(ctx, flags.Arg(0)), exportSource(ctx, flags.Arg(1)))
+	if err != nil {
+		return err
+	}
+	counts := make(map[migrate.DifferenceKind]int, 3)
+	for _, d := range c.Differences {
+		var mark byte
+		switch d.Kind {
+		case migrate.Added:
+			mark = '+'
+		case migrate.Removed:
+			mark = '-'
+		default:
+			mark = '~'
+		}
+		if _, err := fmt.Fprintf(w, "%c %s\n", mark, displayKey(d.Key)); err != nil {
+			return err
+		}
+		counts[d.Kind]++
+	}
+	fmt.Fprintf(os.Stderr, "%d added, %d removed, %d changed, %d unchanged\n",
+		counts[migrate.Added], counts[migrate.Removed], counts[migrate.Changed], c.Unchanged)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	flag "github.com/spf13/pflag"
+
+	"sehlabs.com/db/internal/migrate"
+)
+
+// batchEntry is a mutation within a JSON-encoded batch submitted to the server.
+type batchEntry struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Op          string  `json:"op"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+// textOrBase64 returns the given bytes as text if they're valid UTF-8, or as base64-encoded text
+// otherwise, with the returned pointers indicating which.
+func textOrBase64(b []byte) (text, encoded *string) {
+	s := string(b)
+	if utf8.ValidString(s) {
+		return &s, nil
+	}
+	s = base64.StdEncoding.EncodeToString(b)
+	return nil, &s
+}
+
+// batchUploader accumulates records into batches of upsert operations, submitting each batch to
+// the server once it's full.
+type batchUploader struct {
+	ctx       context.Context
+	url       string
+	batchSize int
+	entries   []batchEntry
+}
+
+func (u *batchUploader) add(key, value []byte) error {
+	var e batchEntry
+	e.Op = "upsert"
+	e.Key, e.KeyBase64 = textOrBase64(key)
+	e.Value, e.ValueBase64 = textOrBase64(value)
+	u.entries = append(u.entries, e)
+	if len(u.entries) < u.batchSize {
+		return nil
+	}
+	return u.flush()
+}
+
+func (u *batchUploader) flush() error {
+	if len(u.entries) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(u.entries)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(u.ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("server responded with status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	u.entries = u.entries[:0]
+	return nil
+}
+
+// runImport loads the records from a file written by another database, submitting them to the
+// server in batches.
+func runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "",
+		`Format of the file from which to read records: "rdb" (Redis) or "etcd"`)
+	redisDatabase := flags.Int("redis-db", 0,
+		`Number of the Redis logical database from which to read records,
+for the "rdb" format`)
+	batchSize := flags.Int("batch-size", 500,
+		`Number of records to write within each transaction`)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("import requires exactly one file path")
+	}
+	if *batchSize < 1 {
+		return errors.New("--batch-size must be positive")
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	u := batchUploader{
+		ctx:       ctx,
+		url:       strings.TrimSuffix(serverURL, "/") + "/records/batch",
+		batchSize: *batchSize,
+	}
+	var summary migrate.Summary
+	switch *format {
+	case "rdb":
+		summary, err = migrate.ReadRedisRDB(f, *redisDatabase, time.Now(), u.add)
+	case "etcd":
+		summary, err = migrate.ReadEtcdSnapshot(f, u.add)
+	default:
+		return fmt.Errorf(`--format must be "rdb" or "etcd", not %q`, *format)
+	}
+	if err == nil {
+		err = u.flush()
+	}
+	if err != nil {
+		return fmt.Errorf("import failed after reading %d records: %w", summary.Records, err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d records, skipping %d entries\n", summary.Records, summary.Skipped)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	flag "github.com/spf13/pflag"
+)
+
+func fatal(code int, m string) {
+	fmt.Fprintln(os.Stderr, m)
+	os.Exit(code)
+}
+
+func fatalf(code int, format string, a ...interface{}) {
+	w := os.Stderr
+	if _, err := fmt.Fprintf(w, format, a...); err == nil {
+		fmt.Fprintln(w)
+	}
+	os.Exit(code)
+}
+
+// TODO(seh): Extract the requests that this tool issues into a Go client package. Once the
+// server replicates its records, that package should offer hedged reads: issue a read to one
+// replica, then to others in turn if it hasn't responded within a short delay, returning the
+// first successful response and canceling the rest, to bound tail latency.
+var (
+	serverURL      string
+	adminServerURL string
+)
+
+func init() {
+	flag.CommandLine.SetInterspersed(false)
+	flag.StringVar(&serverURL, "server", "http://localhost:8080",
+		`Base URL of the database server's client listener`)
+	flag.StringVar(&adminServerURL, "admin-server", "http://localhost:8081",
+		`Base URL of the database server's administrative listener`)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [flags] command [command flags]
+
+Commands:
+  diff      Report the records added, removed, or changed between two
+            dumps written by export, or between a dump and a live server
+  export    Write a consistent dump of all records to standard output
+  import    Load records from a file written by another database
+  migrate   Copy all records from one server to another, then apply
+            the changes committed on the source until cutover
+  query     Run a read-only SQL query against the records, such as
+            "SELECT key, value FROM records WHERE key LIKE 'users/%%'"
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+// requestExport requests a dump of the records of the server whose administrative listener has
+// the given base URL, returning the successful response, whose body the caller must close.
+func requestExport(ctx context.Context, baseURL string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(baseURL, "/")+"/admin/export?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("server responded with status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	return res, nil
+}
+
+// runExport streams a dump of the server's records in the requested format to the given writer.
+func runExport(ctx context.Context, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "csv",
+		`Format in which to write the records: "csv" or "sql"`)
+	table := flags.String("table", "records",
+		`Name of the SQL table into which to insert the records, for the "sql" format`)
+	filter := flags.String("filter", "",
+		`Expression selecting the records to export, such as "key=users/* size<1024"`)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	query := url.Values{"format": {*format}}
+	if *format == "sql" {
+		query.Set("table", *table)
+	}
+	if len(*filter) > 0 {
+		query.Set("filter", *filter)
+	}
+	res, err := requestExport(ctx, adminServerURL, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("export ended prematurely: %w", err)
+	}
+	return nil
+}
+
+// runQuery writes the rows selected by a read-only SQL query, given as the sole argument, in the
+// requested format to the given writer.
+func runQuery(ctx context.Context, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	format := flags.String("format", "csv",
+		`Format in which to write the selected rows: "csv" or "json"`)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one query, got %d arguments", flags.NArg())
+	}
+	query := url.Values{
+		"q":      {flags.Arg(0)},
+		"format": {*format},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(serverURL, "/")+"/query?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("server responded with status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		fatal(2, "A command is required")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
+	case "diff":
+		err = runDiff(ctx, args, os.Stdout)
+	case "export":
+		err = runExport(ctx, args, os.Stdout)
+	case "import":
+		err = runImport(ctx, args)
+	case "migrate":
+		err = runMigrate(ctx, args)
+	case "query":
+		err = runQuery(ctx, args, os.Stdout)
+	default:
+		fatalf(2, "Unknown command %q", command)
+	}
+	if err != nil {
+		fatalf(1, "%v", err)
+	}
+}
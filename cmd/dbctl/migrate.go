@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"sehlabs.com/db/internal/migrate"
+)
+
+// changeFeedEvent is an event read from a server's change feed (see the "/admin/changes"
+// administrative request).
+type changeFeedEvent struct {
+	name string
+	data []byte
+}
+
+// changeFeed reads the server-sent events of a server's change feed.
+type changeFeed struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+}
+
+// openChangeFeed starts watching the changes committed to the records of the server whose
+// administrative listener has the given base URL, returning once the server reports that it's
+// watching.
+func openChangeFeed(ctx context.Context, baseURL string) (*changeFeed, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(baseURL, "/")+"/admin/changes", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("server responded with status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	f := &changeFeed{
+		body: res.Body,
+		r:    bufio.NewReader(res.Body),
+	}
+	e, err := f.next()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if e.name != "ready" {
+		f.Close()
+		return nil, fmt.Errorf("change feed began with unexpected event %q", e.name)
+	}
+	return f, nil
+}
+
+// next reads the next event from the feed, failing if the server reports an error.
+func (f *changeFeed) next() (changeFeedEvent, error) {
+	var e changeFeedEvent
+	for {
+		line, err := f.r.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("change feed ended prematurely")
+			}
+			return e, err
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+		if len(line) == 0 {
+			if len(e.name) == 0 && e.data == nil {
+				continue
+			}
+			if e.name == "error" {
+				return e, fmt.Errorf("change feed failed: %s", e.data)
+			}
+			return e, nil
+		}
+		field, value, _ := bytes.Cut(line, []byte{':'})
+		value = bytes.TrimPrefix(value, []byte{' '})
+		switch string(field) {
+		case "event":
+			e.name = string(value)
+		case "data":
+			if e.data != nil {
+				e.data = append(e.data, '\n')
+			}
+			e.data = append(e.data, value...)
+		}
+	}
+}
+
+func (f *changeFeed) Close() error {
+	return f.body.Close()
+}
+
+// feedTransaction is a transaction reported by a server's change feed, describing the current
+// state of each record that it changed.
+type feedTransaction struct {
+	ID      uint64 `json:"id"`
+	Changes []struct {
+		Key         *string `json:"key"`
+		KeyBase64   *string `json:"key_base64"`
+		Value       *string `json:"value"`
+		ValueBase64 *string `json:"value_base64"`
+		Deleted     bool    `json:"deleted"`
+	} `json:"changes"`
+}
+
+// migrationProgress tracks how much of a migration has completed, reporting it periodically.
+type migrationProgress struct {
+	interval     time.Duration
+	lastReported time.Time
+	copied       int
+	transactions int
+	changes      int
+	// latest is the ID of the transaction applied most recently. Since the source's transactions
+	// may commit in a different order than their IDs, earlier ones may bear greater IDs.
+	latest uint64
+	// unreported indicates whether the migration has progressed since the last report.
+	unreported bool
+}
+
+// report writes a summary of the migration's progress, if the migration has progressed and it's
+// been at least the reporting interval since the last one, or if the caller insists.
+func (p *migrationProgress) report(force bool) {
+	now := time.Now()
+	if !force && (!p.unreported || now.Sub(p.lastReported) < p.interval) {
+		return
+	}
+	p.lastReported = now
+	p.unreported = false
+	if p.transactions == 0 {
+		fmt.Fprintf(os.Stderr, "Copied %d records from snapshot\n", p.copied)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d records from snapshot, then applied %d changes from %d transactions, most recently transaction %d\n",
+		p.copied, p.changes, p.transactions, p.latest)
+}
+
+// copySnapshot copies the records of the server whose administrative listener has the given base
+// URL via the given uploader.
+func copySnapshot(ctx context.Context, from string, u *batchUploader, p *migrationProgress) error {
+	res, err := requestExport(ctx, from, url.Values{"format": {"csv"}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if _, err := migrate.ReadExportCSV(res.Body, func(key, value []byte) error {
+		if err := u.add(key, value); err != nil {
+			return err
+		}
+		p.copied++
+		p.unreported = true
+		p.report(false)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return u.flush()
+}
+
+// applyChanges applies the changes that the given transaction made to the source server to the
+// target via the given uploader, within a single transaction.
+func applyChanges(tx *feedTransaction, u *batchUploader) error {
+	for _, c := range tx.Changes {
+		e := batchEntry{
+			Key:       c.Key,
+			KeyBase64: c.KeyBase64,
+		}
+		if c.Deleted {
+			e.Op = "delete"
+		} else {
+			e.Op = "upsert"
+			e.Value, e.ValueBase64 = c.Value, c.ValueBase64
+		}
+		u.entries = append(u.entries, e)
+	}
+	return u.flush()
+}
+
+// runMigrate copies the records of one server to another while the source continues to serve
+// clients: it watches the source for changes, copies a consistent snapshot of its records, and
+// then applies each change committed on the source to the target until interrupted or, if
+// requested, until the source has been idle for a while, at which point clients can switch to the
+// target.
+func runMigrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "",
+		`Base URL of the source server's administrative listener`)
+	to := flags.String("to", "",
+		`Base URL of the target server's client listener`)
+	batchSize := flags.Int("batch-size", 500,
+		`Number of records from the snapshot to write within each transaction`)
+	progressInterval := flags.Duration("progress-interval", 5*time.Second,
+		`Interval at which to report progress`)
+	stopWhenIdle := flags.Duration("stop-when-idle", 0,
+		`Duration after which to stop once the source commits no changes,
+such as once its clients stop writing at cutover (default: stop only
+when interrupted)`)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if len(*from) == 0 || len(*to) == 0 {
+		return errors.New("migrate requires both --from and --to")
+	}
+	if *batchSize < 1 {
+		return errors.New("--batch-size must be positive")
+	}
+	if *progressInterval <= 0 {
+		return errors.New("--progress-interval must be positive")
+	}
+	if *stopWhenIdle < 0 {
+		return errors.New("--stop-when-idle must be nonnegative")
+	}
+	// Watch for changes before taking the snapshot, so that none escape both. Applying changes
+	// that the snapshot already reflects may briefly regress the target's records, but since the
+	// feed reports each record's value as read after the change committed, the target converges
+	// on the source's state once it applies the latest change to each record.
+	feed, err := openChangeFeed(ctx, *from)
+	if err != nil {
+		return fmt.Errorf("watching source for changes: %w", err)
+	}
+	defer feed.Close()
+	batchURL := strings.TrimSuffix(*to, "/") + "/records/batch"
+	p := migrationProgress{
+		interval:     *progressInterval,
+		lastReported: time.Now(),
+	}
+	if err := copySnapshot(ctx, *from, &batchUploader{
+		ctx:       ctx,
+		url:       batchURL,
+		batchSize: *batchSize,
+	}, &p); err != nil {
+		return fmt.Errorf("migration failed after copying %d records: %w", p.copied, err)
+	}
+	p.report(true)
+
+	type received struct {
+		tx  feedTransaction
+		err error
+	}
+	events := make(chan received)
+	go func() {
+		defer close(events)
+		for {
+			var r received
+			e, err := feed.next()
+			if err == nil && e.name == "transaction" {
+				err = json.Unmarshal(e.data, &r.tx)
+			} else if err == nil {
+				continue
+			}
+			r.err = err
+			select {
+			case events <- r:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// Let the transaction in progress complete upon interruption, so that the target reflects
+	// a prefix of the source's transactions in the order that they committed, which may differ
+	// from the order of their IDs, so don't skip transactions by comparing IDs.
+	u := batchUploader{
+		ctx:       context.WithoutCancel(ctx),
+		url:       batchURL,
+		batchSize: math.MaxInt,
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if *stopWhenIdle > 0 {
+		idleTimer = time.NewTimer(*stopWhenIdle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	progress := time.NewTicker(p.interval)
+	defer progress.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.report(true)
+			fmt.Fprintln(os.Stderr, "Stopped applying changes upon interruption")
+			return nil
+		case <-idle:
+			p.report(true)
+			fmt.Fprintf(os.Stderr, "Stopped applying changes after the source was idle for %v\n", *stopWhenIdle)
+			return nil
+		case <-progress.C:
+			p.report(false)
+		case r, ok := <-events:
+			if !ok {
+				// The feed stopped upon interruption.
+				events = nil
+				continue
+			}
+			if r.err != nil {
+				return fmt.Errorf("migration failed after applying %d transactions: %w", p.transactions, r.err)
+			}
+			if len(r.tx.Changes) == 0 {
+				continue
+			}
+			if err := applyChanges(&r.tx, &u); err != nil {
+				return fmt.Errorf("migration failed applying transaction %d: %w", r.tx.ID, err)
+			}
+			p.transactions++
+			p.changes += len(r.tx.Changes)
+			p.latest = r.tx.ID
+			p.unreported = true
+			if idleTimer != nil {
+				idleTimer.Reset(*stopWhenIdle)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readyEvent is the event with which a server's change feed begins.
+const readyEvent = "event: ready\ndata: {}\n\n"
+
+// transactionEvent returns a change feed event reporting a transaction with the given ID and
+// changes, given as a JSON array.
+func transactionEvent(id uint64, changes string) string {
+	return fmt.Sprintf("id: %d\nevent: transaction\ndata: {\"id\":%d,\"changes\":%s}\n\n", id, id, changes)
+}
+
+// fakeSource serves the administrative requests that migrate issues to its source server.
+type fakeSource struct {
+	// records are the keys and values of the records in the snapshot.
+	records [][2]string
+	// exportStatus, if nonzero, is the status with which to reject requests for a snapshot.
+	exportStatus int
+	// feedStatus, if nonzero, is the status with which to reject requests to watch for changes.
+	feedStatus int
+	// feed holds the events to send to clients watching for changes.
+	feed []string
+	// endFeed indicates whether to end the change feed after sending its events, rather than
+	// waiting for the client to disconnect.
+	endFeed bool
+}
+
+func (s *fakeSource) start(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/export", func(w http.ResponseWriter, req *http.Request) {
+		if s.exportStatus != 0 {
+			http.Error(w, "export unavailable", s.exportStatus)
+			return
+		}
+		if format := req.FormValue("format"); format != "csv" {
+			http.Error(w, fmt.Sprintf("unexpected format %q", format), http.StatusBadRequest)
+			return
+		}
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "version", "content_type", "value"})
+		for i, r := range s.records {
+			cw.Write([]string{r[0], fmt.Sprint(i + 1), "", r[1]})
+		}
+		cw.Flush()
+	})
+	mux.HandleFunc("/admin/changes", func(w http.ResponseWriter, req *http.Request) {
+		if s.feedStatus != 0 {
+			http.Error(w, "change feed unavailable", s.feedStatus)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range s.feed {
+			fmt.Fprint(w, e)
+		}
+		w.(http.Flusher).Flush()
+		if !s.endFeed {
+			<-req.Context().Done()
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeTarget applies the batches that migrate submits to its target server.
+type fakeTarget struct {
+	// rejectBatch, if positive, is the ordinal of the batch to reject, counting from one.
+	rejectBatch int
+
+	mu      sync.Mutex
+	records map[string]string
+	// batchSizes holds the number of entries within each batch applied.
+	batchSizes []int
+}
+
+func (tg *fakeTarget) start(t *testing.T) *httptest.Server {
+	t.Helper()
+	tg.records = make(map[string]string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/records/batch", func(w http.ResponseWriter, req *http.Request) {
+		var entries []batchEntry
+		if err := json.NewDecoder(req.Body).Decode(&entries); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tg.mu.Lock()
+		defer tg.mu.Unlock()
+		if len(tg.batchSizes)+1 == tg.rejectBatch {
+			http.Error(w, "batch rejected", http.StatusConflict)
+			return
+		}
+		decode := func(text, encoded *string) string {
+			if text != nil {
+				return *text
+			}
+			b, err := base64.StdEncoding.DecodeString(*encoded)
+			if err != nil {
+				t.Errorf("invalid base64-encoded text %q: %v", *encoded, err)
+			}
+			return string(b)
+		}
+		for _, e := range entries {
+			k := decode(e.Key, e.KeyBase64)
+			switch e.Op {
+			case "upsert":
+				tg.records[k] = decode(e.Value, e.ValueBase64)
+			case "delete":
+				delete(tg.records, k)
+			default:
+				t.Errorf("unexpected operation %q on record %q", e.Op, k)
+			}
+		}
+		tg.batchSizes = append(tg.batchSizes, len(entries))
+		w.Write([]byte(`{"committed":true}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMigrateCopiesSnapshotThenChanges(t *testing.T) {
+	source := fakeSource{
+		records: [][2]string{
+			{"a", "1"},
+			{"b", "2"},
+			{"c", "3"},
+			{"\xff", "binary\x00key"},
+			{"e", "5"},
+		},
+		feed: []string{
+			readyEvent,
+			transactionEvent(8, `[{"key":"b","value":"20"},{"key":"c","deleted":true}]`),
+			// Transactions changing no records are skipped.
+			transactionEvent(9, `[]`),
+			// Changes already reflected by the snapshot are applied again harmlessly.
+			transactionEvent(7, `[{"key_base64":"/w==","value_base64":"AAE="},{"key":"e","value":"5"}]`),
+			": comments and other events are ignored\n\n",
+			"event: heartbeat\ndata: {}\n\n",
+			transactionEvent(10, `[{"key":"f","value":"6"}]`),
+		},
+	}
+	target := fakeTarget{}
+	from, to := source.start(t), target.start(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := runMigrate(ctx, []string{
+		"--from", from.URL,
+		"--to", to.URL + "/",
+		"--batch-size", "2",
+		"--stop-when-idle", "200ms",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a":    "1",
+		"b":    "20",
+		"\xff": "\x00\x01",
+		"e":    "5",
+		"f":    "6",
+	}
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if !maps.Equal(want, target.records) {
+		t.Errorf("want records %q, got %q", want, target.records)
+	}
+	// The snapshot arrives in batches of the requested size, followed by one batch for each
+	// transaction that changed records.
+	wantBatchSizes := []int{2, 2, 1, 2, 2, 1}
+	if fmt.Sprint(wantBatchSizes) != fmt.Sprint(target.batchSizes) {
+		t.Errorf("want batches of sizes %v, got %v", wantBatchSizes, target.batchSizes)
+	}
+}
+
+func TestMigrateFailures(t *testing.T) {
+	snapshot := [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		source fakeSource
+		// rejectBatch, if positive, is the ordinal of the batch that the target rejects.
+		rejectBatch int
+		wantMessage string
+	}{
+		{
+			name:        "missing source",
+			args:        []string{"--from="},
+			wantMessage: "requires both --from and --to",
+		},
+		{
+			name:        "missing target",
+			args:        []string{"--to="},
+			wantMessage: "requires both --from and --to",
+		},
+		{
+			name:        "unexpected argument",
+			args:        []string{"extra"},
+			wantMessage: "unexpected arguments: extra",
+		},
+		{
+			name:        "empty batches",
+			args:        []string{"--batch-size=0"},
+			wantMessage: "--batch-size must be positive",
+		},
+		{
+			name:        "no progress reports",
+			args:        []string{"--progress-interval=0s"},
+			wantMessage: "--progress-interval must be positive",
+		},
+		{
+			name:        "negative idle duration",
+			args:        []string{"--stop-when-idle=-1s"},
+			wantMessage: "--stop-when-idle must be nonnegative",
+		},
+		{
+			name:        "change feed unavailable",
+			source:      fakeSource{feedStatus: http.StatusServiceUnavailable},
+			wantMessage: "watching source for changes: server responded with status \"503 Service Unavailable\": change feed unavailable",
+		},
+		{
+			name:        "change feed not ready",
+			source:      fakeSource{feed: []string{transactionEvent(1, `[]`)}},
+			wantMessage: `watching source for changes: change feed began with unexpected event "transaction"`,
+		},
+		{
+			name:        "snapshot unavailable",
+			source:      fakeSource{exportStatus: http.StatusInternalServerError, feed: []string{readyEvent}},
+			wantMessage: "migration failed after copying 0 records: server responded with status \"500 Internal Server Error\"",
+		},
+		{
+			name:        "snapshot rejected",
+			args:        []string{"--batch-size=2"},
+			source:      fakeSource{records: snapshot, feed: []string{readyEvent}},
+			rejectBatch: 2,
+			wantMessage: "migration failed after copying 3 records: server responded with status \"409 Conflict\": batch rejected",
+		},
+		{
+			name:        "change feed failed",
+			source:      fakeSource{records: snapshot, feed: []string{readyEvent, transactionEvent(4, `[{"key":"d","value":"4"}]`), "event: error\ndata: store closed\n\n"}},
+			wantMessage: "migration failed after applying 1 transactions: change feed failed: store closed",
+		},
+		{
+			name:        "change feed ended",
+			source:      fakeSource{records: snapshot, feed: []string{readyEvent}, endFeed: true},
+			wantMessage: "migration failed after applying 0 transactions: change feed ended prematurely",
+		},
+		{
+			name:        "malformed transaction",
+			source:      fakeSource{records: snapshot, feed: []string{readyEvent, "event: transaction\ndata: {\n\n"}},
+			wantMessage: "migration failed after applying 0 transactions: unexpected end of JSON input",
+		},
+		{
+			name:        "transaction rejected",
+			source:      fakeSource{records: snapshot, feed: []string{readyEvent, transactionEvent(4, `[{"key":"d","value":"4"}]`)}},
+			rejectBatch: 2,
+			wantMessage: "migration failed applying transaction 4: server responded with status \"409 Conflict\": batch rejected",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := fakeTarget{rejectBatch: tc.rejectBatch}
+			from, to := tc.source.start(t), target.start(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			args := append([]string{"--from", from.URL, "--to", to.URL, "--stop-when-idle", "10s"}, tc.args...)
+			err := runMigrate(ctx, args)
+			if err == nil {
+				t.Fatal("want error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.wantMessage) {
+				t.Errorf("want error mentioning %q, got %v", tc.wantMessage, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type accessLogFormat uint8
+
+const (
+	// accessLogCommon is the Common Log Format.
+	accessLogCommon accessLogFormat = iota
+	// accessLogCombined is the Common Log Format extended with the request's referrer and user
+	// agent.
+	accessLogCombined
+	// accessLogJSON writes each entry as a line of JSON.
+	accessLogJSON
+)
+
+func parseAccessLogFormat(s string) (accessLogFormat, error) {
+	switch s {
+	case "common":
+		return accessLogCommon, nil
+	case "combined":
+		return accessLogCombined, nil
+	case "json":
+		return accessLogJSON, nil
+	default:
+		return 0, fmt.Errorf(`access log format must be "common", "combined", or "json", not %q`, s)
+	}
+}
+
+// rotatingFile is a file that, upon growing beyond a size limit, is renamed with a numeric
+// suffix, shifting older such files' suffixes and removing the oldest, and replaced with a new,
+// empty file.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	f := rotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Write writes the given bytes to the file, first rotating it if they would take the file beyond
+// its size limit. Callers must not call Write concurrently.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %q: %w", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// accessLogger records the requests that the server handles, logging one of every sampleRate
+// requests, along with every request that takes at least slowThreshold to handle, if positive.
+type accessLogger struct {
+	mu            sync.Mutex
+	out           io.Writer
+	format        accessLogFormat
+	sampleRate    uint64
+	slowThreshold time.Duration
+	requests      atomic.Uint64
+	// buf is reused for each entry, to avoid allocating one per request.
+	buf []byte
+}
+
+// statusRecorder captures the status code and size of the response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type accessLogEntry struct {
+	Time            time.Time `json:"time"`
+	RemoteAddress   string    `json:"remote_addr"`
+	Identity        string    `json:"identity,omitempty"`
+	Method          string    `json:"method"`
+	URI             string    `json:"uri"`
+	Protocol        string    `json:"proto"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Referrer        string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// appendQuotedField appends the given text to b for a field of the Common Log Format, quoted and
+// with embedded quotes and control characters escaped, or a hyphen if the text is empty.
+func appendQuotedField(b []byte, s string) []byte {
+	if len(s) == 0 {
+		return append(b, `"-"`...)
+	}
+	return strconv.AppendQuote(b, s)
+}
+
+func orHyphen(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func (l *accessLogger) log(e *accessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buf[:0]
+	if l.format == accessLogJSON {
+		encoded, err := json.Marshal(e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode access log entry: %v\n", err)
+			return
+		}
+		b = append(b, encoded...)
+	} else {
+		host, _, err := net.SplitHostPort(e.RemoteAddress)
+		if err != nil {
+			host = e.RemoteAddress
+		}
+		b = append(b, orHyphen(host)...)
+		b = append(b, " - "...)
+		b = append(b, orHyphen(e.Identity)...)
+		b = e.Time.AppendFormat(append(b, " ["...), "02/Jan/2006:15:04:05 -0700")
+		b = append(b, "] "...)
+		b = appendQuotedField(b, e.Method+" "+e.URI+" "+e.Protocol)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(e.Status), 10)
+		b = append(b, ' ')
+		if e.Bytes > 0 {
+			b = strconv.AppendInt(b, e.Bytes, 10)
+		} else {
+			b = append(b, '-')
+		}
+		if l.format == accessLogCombined {
+			b = append(b, ' ')
+			b = appendQuotedField(b, e.Referrer)
+			b = append(b, ' ')
+			b = appendQuotedField(b, e.UserAgent)
+		}
+	}
+	b = append(b, '\n')
+	l.buf = b
+	if _, err := l.out.Write(b); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write access log entry: %v\n", err)
+	}
+}
+
+// wrap wraps the given handler to record the requests that it handles.
+func (l *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sampled := (l.requests.Add(1)-1)%l.sampleRate == 0
+		if !sampled && l.slowThreshold <= 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		recorder := statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(&recorder, req)
+		elapsed := time.Since(start)
+		if !sampled && elapsed < l.slowThreshold {
+			return
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l.log(&accessLogEntry{
+			Time:            start,
+			RemoteAddress:   req.RemoteAddr,
+			Identity:        clientCertificateName(req),
+			Method:          req.Method,
+			URI:             req.RequestURI,
+			Protocol:        req.Proto,
+			Status:          status,
+			Bytes:           recorder.bytes,
+			DurationSeconds: elapsed.Seconds(),
+			Referrer:        req.Referer(),
+			UserAgent:       req.UserAgent(),
+		})
+	})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+type administrable interface {
+	CompactShards(ctx context.Context) (int, error)
+	ActiveTransactions() []idb.ActiveTransaction
+	AbortTransaction(id uint64) bool
+	HotConflictKeys(n int) []idb.KeyConflicts
+	NamespaceUsage(ctx context.Context) ([]idb.NamespaceUsage, error)
+	CloneNamespace(ctx context.Context, src, dst string) (int, error)
+	CheckConsistency(ctx context.Context) ([]idb.ConsistencyAnomaly, error)
+}
+
+const pathPrefixAdminTransactions = "/admin/transactions/"
+
+type activeTransaction struct {
+	ID            uint64  `json:"id"`
+	AgeSeconds    float64 `json:"age_seconds"`
+	PendingWrites int     `json:"pending_writes"`
+}
+
+// handleListTransactions describes the database's active transactions.
+func handleListTransactions(w http.ResponseWriter, db administrable) {
+	now := time.Now()
+	active := db.ActiveTransactions()
+	response := make([]activeTransaction, len(active))
+	for i, tx := range active {
+		response[i] = activeTransaction{
+			ID:            tx.ID,
+			AgeSeconds:    now.Sub(tx.Started).Seconds(),
+			PendingWrites: tx.PendingWrites,
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleAbortTransaction forcibly aborts the active transaction identified in the URL path.
+func handleAbortTransaction(w http.ResponseWriter, req *http.Request, db administrable) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, pathPrefixAdminTransactions), 10, 64)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid transaction ID: %v", err)
+		return
+	}
+	if !db.AbortTransaction(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultHotKeyCount is the number of keys to report in response to requests for the keys most
+// frequently involved in transaction conflicts, absent a specified count.
+const defaultHotKeyCount = 10
+
+type hotKey struct {
+	Key       string `json:"key"`
+	Conflicts uint64 `json:"conflicts"`
+}
+
+// handleListHotKeys describes the record keys most frequently involved in transaction conflicts,
+// limited to the number given by the optional "n" query parameter.
+func handleListHotKeys(w http.ResponseWriter, req *http.Request, db administrable) {
+	n := defaultHotKeyCount
+	if s := req.URL.Query().Get("n"); len(s) > 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid key count %q", s)
+			return
+		}
+	}
+	hot := db.HotConflictKeys(n)
+	response := make([]hotKey, len(hot))
+	for i, k := range hot {
+		response[i] = hotKey{
+			Key:       string(k.Key),
+			Conflicts: k.Conflicts,
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+type bucketUsage struct {
+	Bucket       string `json:"bucket"`
+	Reads        uint64 `json:"reads"`
+	Writes       uint64 `json:"writes"`
+	Deletes      uint64 `json:"deletes"`
+	BytesRead    uint64 `json:"bytes_read"`
+	BytesWritten uint64 `json:"bytes_written"`
+	Records      int    `json:"records"`
+	BytesStored  int64  `json:"bytes_stored"`
+}
+
+// handleListUsage meters the database's use by bucket, such as to charge tenants sharing the
+// server.
+func handleListUsage(ctx context.Context, w http.ResponseWriter, db administrable) {
+	usage, err := db.NamespaceUsage(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	response := make([]bucketUsage, len(usage))
+	for i, u := range usage {
+		response[i] = bucketUsage{
+			Bucket:       u.Name,
+			Reads:        u.Reads,
+			Writes:       u.Writes,
+			Deletes:      u.Deletes,
+			BytesRead:    u.BytesRead,
+			BytesWritten: u.BytesWritten,
+			Records:      u.Records,
+			BytesStored:  u.BytesStored,
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+type consistencyAnomaly struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Depth       int     `json:"depth"`
+	Description string  `json:"description"`
+}
+
+// handleCheckConsistency inspects the database's records for versions that violate the invariants
+// governing their histories, logging and describing any such anomalies.
+func handleCheckConsistency(ctx context.Context, w http.ResponseWriter, db administrable) {
+	anomalies, err := db.CheckConsistency(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	response := make([]consistencyAnomaly, len(anomalies))
+	for i, a := range anomalies {
+		fmt.Fprintf(os.Stderr, "consistency check found anomaly in %v\n", a)
+		key, keyBase64 := textOrBase64(a.Key)
+		response[i] = consistencyAnomaly{
+			Key:         key,
+			KeyBase64:   keyBase64,
+			Depth:       a.Depth,
+			Description: a.Description,
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleCloneBucket copies the bucket named by the "source" form value, along with its records, to
+// a new bucket named by the "destination" form value.
+func handleCloneBucket(w http.ResponseWriter, req *http.Request, db administrable) {
+	if !parseForm(w, req) {
+		return
+	}
+	src, dst := req.FormValue("source"), req.FormValue("destination")
+	if len(src) == 0 || len(dst) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, `HTTP form values "source" and "destination" must be nonempty`)
+		return
+	}
+	cloned, err := db.CloneNamespace(req.Context(), src, dst)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	setLocation(w, pathPrefixBucket+dst)
+	respondWithProblem(w, http.StatusCreated, "Cloned %d records", cloned)
+}
+
+// registerAdminHandlers installs the handlers for administrative requests, which operators may
+// wish to expose only to a more restricted set of clients than those reading and writing records.
+// Since aborting a transaction disrupts another client's request, only the clients with the given
+// identities (see isPermittedIdentity) may do so.
+func registerAdminHandlers(mux *http.ServeMux, db administrable, abortingIdentities []string) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/compact-shards", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		rebuilt, err := db.CompactShards(req.Context())
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		speakPlainTextTo(w)
+		fmt.Fprintf(w, "Rebuilt %d shards\n", rebuilt)
+	})
+	mux.HandleFunc("/admin/transactions", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleListTransactions(w, db)
+	})
+	mux.HandleFunc("/admin/hotkeys", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleListHotKeys(w, req, db)
+	})
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleListUsage(req.Context(), w, db)
+	})
+	mux.HandleFunc("/admin/check", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleCheckConsistency(req.Context(), w, db)
+	})
+	mux.HandleFunc("/admin/clone-bucket", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		handleCloneBucket(w, req, db)
+	})
+	mux.Handle(pathPrefixAdminTransactions, withPermittedIdentities(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			rejectMethod(w, req, http.MethodDelete)
+			return
+		}
+		handleAbortTransaction(w, req, db)
+	}), abortingIdentities, "abort transactions"))
+}
+
+type trashKeeper interface {
+	database
+	TrashedRecords() []idb.TrashedRecord
+}
+
+const pathPrefixAdminTrash = "/admin/trash/"
+
+type trashedRecord struct {
+	Key       string    `json:"key"`
+	DeletedBy uint64    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// registerTrashHandlers installs the handlers for requests to list the deleted records that the
+// database retains in its trash, and to restore them.
+func registerTrashHandlers(mux *http.ServeMux, db trashKeeper) {
+	mux.HandleFunc("/admin/trash", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		trashed := db.TrashedRecords()
+		response := make([]trashedRecord, len(trashed))
+		for i, r := range trashed {
+			response[i] = trashedRecord{
+				Key:       string(r.Key),
+				DeletedBy: r.DeletedBy,
+				DeletedAt: r.DeletedAt,
+			}
+		}
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc(pathPrefixAdminTrash, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		key := strings.TrimPrefix(req.URL.Path, pathPrefixAdminTrash)
+		if len(key) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty key")
+			return
+		}
+		var txID uint64
+		if err := db.WithinTransaction(req.Context(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			if err := tx.Undelete(ctx, idb.Key(key)); err != nil {
+				return false, err
+			}
+			txID = tx.ID()
+			return true, nil
+		}); err != nil {
+			respondWithError(w, err)
+			return
+		}
+		setCommittedTransaction(w, txID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type shardOwner interface {
+	Ownership() []idb.ShardOwnership
+}
+
+type hashRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+type shardOwnership struct {
+	Shard  int         `json:"shard"`
+	Share  float64     `json:"share"`
+	Ranges []hashRange `json:"ranges"`
+}
+
+// registerShardOwnershipHandlers installs the handler for requests describing which ranges of
+// key hashes on the consistent hash ring each shard owns.
+func registerShardOwnershipHandlers(mux *http.ServeMux, ring shardOwner) {
+	mux.HandleFunc("/admin/shard-ownership", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		owners := ring.Ownership()
+		response := make([]shardOwnership, len(owners))
+		for i, o := range owners {
+			ranges := make([]hashRange, len(o.Ranges))
+			for j, r := range o.Ranges {
+				ranges[j] = hashRange{
+					First: r.First,
+					Last:  r.Last,
+				}
+			}
+			response[i] = shardOwnership{
+				Shard:  o.Shard,
+				Share:  o.Share,
+				Ranges: ranges,
+			}
+		}
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+type statsReporter interface {
+	Stats() idb.StoreStats
+}
+
+// registerMetricsHandlers installs the handlers for requests from metrics collectors, publishing
+// the database's statistics among the exported variables.
+func registerMetricsHandlers(mux *http.ServeMux, db statsReporter) {
+	expvar.Publish("store", expvar.Func(func() any {
+		return db.Stats()
+	}))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		handleOpenMetrics(w, db)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// serveRequest issues a request with the given method to the given path directly against the
+// given handler, returning the recorded response.
+func serveRequest(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestAdministrativeRequestsStayOffClientListener(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := makeStoreHandler(store)
+	var maintenance maintenanceMode
+	admin := makeAdminHandler(store, nil, &maintenance, client, nil)
+	registerMetricsHandlers(admin, store)
+	for _, tc := range []struct {
+		method string
+		path   string
+		// streams indicates whether the administrative handler streams its response until the
+		// client disconnects, sparing it from being issued against that handler here.
+		streams bool
+	}{
+		{method: http.MethodGet, path: "/debug/pprof/"},
+		{method: http.MethodGet, path: "/debug/pprof/cmdline"},
+		{method: http.MethodGet, path: "/debug/vars"},
+		{method: http.MethodGet, path: "/metrics"},
+		{method: http.MethodGet, path: "/admin/transactions"},
+		{method: http.MethodGet, path: "/admin/export?format=csv"},
+		{method: http.MethodGet, path: "/admin/changes", streams: true},
+		{method: http.MethodPost, path: "/admin/maintenance"},
+		{method: http.MethodPost, path: "/admin/compact-shards"},
+	} {
+		if w := serveRequest(client, tc.method, tc.path); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s on client listener: want status %d, got %d", tc.method, tc.path, http.StatusNotFound, w.Code)
+		}
+		if tc.streams {
+			continue
+		}
+		if w := serveRequest(admin, tc.method, tc.path); w.Code == http.StatusNotFound {
+			t.Errorf("%s %s on administrative listener: want it served, got status %d", tc.method, tc.path, w.Code)
+		}
+	}
+}
+
+func TestAbortingTransactionsRequiresPermittedIdentity(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// httptest.NewRequest attributes each request to this address.
+	const clientAddress = "192.0.2.1"
+	for _, tc := range []struct {
+		name       string
+		permitted  []string
+		wantStatus int
+	}{
+		{name: "no identities permitted", wantStatus: http.StatusForbidden},
+		{name: "other identity permitted", permitted: []string{"192.0.2.2"}, wantStatus: http.StatusForbidden},
+		// The transaction doesn't exist, but the request got past the check.
+		{name: "client permitted", permitted: []string{clientAddress}, wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			registerAdminHandlers(mux, store, tc.permitted)
+			if w := serveRequest(mux, http.MethodDelete, pathPrefixAdminTransactions+"1"); w.Code != tc.wantStatus {
+				t.Errorf("want status %d, got %d (%s)", tc.wantStatus, w.Code, w.Body)
+			}
+			// Listing transactions remains open to every client of the administrative listener.
+			if w := serveRequest(mux, http.MethodGet, "/admin/transactions"); w.Code != http.StatusOK {
+				t.Errorf("want status %d listing transactions, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminUIRequiresPermittedIdentity(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := makeHandler(store, 0, 0, time.Minute)
+	for _, tc := range []struct {
+		name       string
+		permitted  []string
+		wantStatus int
+	}{
+		{name: "no identities permitted", wantStatus: http.StatusForbidden},
+		{name: "other identity permitted", permitted: []string{"192.0.2.2"}, wantStatus: http.StatusForbidden},
+		{name: "client permitted", permitted: []string{"192.0.2.1"}, wantStatus: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			registerAdminUIHandlers(mux, client, store, tc.permitted)
+			for _, path := range []string{pathPrefixAdminUI, pathPrefixAdminUI + "stats", pathPrefixAdminUI + "api/records/tree"} {
+				if w := serveRequest(mux, http.MethodGet, path); w.Code != tc.wantStatus {
+					t.Errorf("GET %s: want status %d, got %d (%s)", path, tc.wantStatus, w.Code, w.Body)
+				}
+			}
+			if tc.wantStatus != http.StatusForbidden {
+				return
+			}
+			// Writing records via the UI is forbidden likewise.
+			if w := serveRequest(mux, http.MethodPost, pathPrefixAdminUI+"api/record/k"); w.Code != http.StatusForbidden {
+				t.Errorf("POST via UI: want status %d, got %d", http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// fileAuditor writes each audit entry as a line of JSON to an append-only file.
+type fileAuditor struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openFileAuditor(path string) (*fileAuditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditor{
+		file:    f,
+		encoder: json.NewEncoder(f),
+	}, nil
+}
+
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	Identity      string    `json:"identity,omitempty"`
+	TransactionID uint64    `json:"tx"`
+	Operation     string    `json:"op"`
+	Key           *string   `json:"key,omitempty"`
+	Value         *string   `json:"value,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (a *fileAuditor) Audit(e db.AuditEntry) {
+	r := auditRecord{
+		Time:          e.Time,
+		Identity:      e.Identity,
+		TransactionID: e.TransactionID,
+		Operation:     e.Operation.String(),
+	}
+	if e.Key != nil {
+		k := string(e.Key)
+		r.Key = &k
+	}
+	if e.Value != nil {
+		v := string(e.Value)
+		r.Value = &v
+	}
+	if e.Err != nil {
+		r.Error = e.Err.Error()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.encoder.Encode(&r); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write audit log entry: %v\n", err)
+	}
+}
+
+func (a *fileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
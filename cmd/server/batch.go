@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// isJSONRequest reports whether the request's body claims to contain JSON.
+func isJSONRequest(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// decodeJSONBody decodes the request's body as JSON into the given destination, responding with an
+// error and returning false if it can't do so.
+func decodeJSONBody(w http.ResponseWriter, req *http.Request, dst any) bool {
+	err := json.NewDecoder(req.Body).Decode(dst)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithProblem(w, http.StatusRequestEntityTooLarge, "HTTP request body exceeds limit of %d bytes", tooLarge.Limit)
+		return false
+	}
+	respondWithProblem(w, http.StatusBadRequest, "Failed to parse JSON request body: %v", err)
+	return false
+}
+
+// batchEntry is a mutation requested within a JSON-encoded batch. Keys and values are either text
+// strings or, for binary data, base64-encoded strings.
+type batchEntry struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Op          string  `json:"op"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+// decodeTextOrBase64 interprets a pair of alternate JSON fields, exactly one of which may be
+// present, returning the decoded content and whether either field was present.
+func decodeTextOrBase64(text, encoded *string, field string) ([]byte, bool, error) {
+	switch {
+	case text != nil && encoded != nil:
+		return nil, false, fmt.Errorf("only one of fields %q and %q may be present", field, field+"_base64")
+	case text != nil:
+		return []byte(*text), true, nil
+	case encoded != nil:
+		b, err := base64.StdEncoding.DecodeString(*encoded)
+		if err != nil {
+			return nil, false, fmt.Errorf("field %q is not valid base64: %w", field+"_base64", err)
+		}
+		return b, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+type batchOperation uint8
+
+const (
+	batchInsert batchOperation = iota
+	batchUpdate
+	batchUpsert
+	batchDelete
+)
+
+type batchMutation struct {
+	key   idb.Key
+	op    batchOperation
+	value idb.Value
+}
+
+func (e *batchEntry) interpret() (batchMutation, error) {
+	var m batchMutation
+	key, ok, err := decodeTextOrBase64(e.Key, e.KeyBase64, "key")
+	if err != nil {
+		return m, err
+	}
+	if !ok || len(key) == 0 {
+		return m, errors.New("key must be nonempty")
+	}
+	m.key = key
+	switch e.Op {
+	case "insert":
+		m.op = batchInsert
+	case "update":
+		m.op = batchUpdate
+	case "upsert":
+		m.op = batchUpsert
+	case "delete":
+		m.op = batchDelete
+	default:
+		return m, fmt.Errorf("unrecognized operation %q", e.Op)
+	}
+	value, ok, err := decodeTextOrBase64(e.Value, e.ValueBase64, "value")
+	if err != nil {
+		return m, err
+	}
+	if m.op == batchDelete {
+		if ok {
+			return m, errors.New("delete operation does not accept a value")
+		}
+	} else if !ok {
+		return m, fmt.Errorf("%s operation requires a value", e.Op)
+	}
+	m.value = value
+	return m, nil
+}
+
+// Statuses reported for each entry in a JSON-encoded batch.
+const (
+	batchEntryCommitted    = "committed"
+	batchEntryPrepared     = "prepared"
+	batchEntryRolledBack   = "rolled-back"
+	batchEntryFailed       = "failed"
+	batchEntryNotAttempted = "not-attempted"
+)
+
+type batchEntryResult struct {
+	Status string `json:"status"`
+	// Existed indicates whether a record existed for a delete operation.
+	Existed *bool  `json:"existed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Committed bool               `json:"committed"`
+	Results   []batchEntryResult `json:"results"`
+}
+
+// interpretBatchEntries interprets the given batch entries, responding with an error and returning
+// false if any of them are invalid.
+func interpretBatchEntries(w http.ResponseWriter, entries []batchEntry) ([]batchMutation, bool) {
+	mutations := make([]batchMutation, len(entries))
+	for i := range entries {
+		m, err := entries[i].interpret()
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Batch entry %d is invalid: %v", i, err)
+			return nil, false
+		}
+		mutations[i] = m
+	}
+	return mutations, true
+}
+
+// applyBatchMutations applies the given mutations in order within the given transaction, recording
+// the outcome of each in the corresponding result, and stopping at the first that fails, returning
+// its error.
+func applyBatchMutations(ctx context.Context, tx idb.Transaction, mutations []batchMutation, results []batchEntryResult) error {
+	// The transaction may be attempted more than once.
+	for i := range results {
+		results[i] = batchEntryResult{Status: batchEntryNotAttempted}
+	}
+	for i, m := range mutations {
+		var err error
+		switch m.op {
+		case batchInsert:
+			err = tx.Insert(ctx, m.key, m.value)
+		case batchUpdate:
+			err = tx.Update(ctx, m.key, m.value)
+		case batchUpsert:
+			err = tx.Upsert(ctx, m.key, m.value)
+		case batchDelete:
+			var existed bool
+			existed, err = tx.Delete(ctx, m.key)
+			if err == nil {
+				results[i].Existed = &existed
+			}
+		}
+		if err != nil {
+			results[i].Status = batchEntryFailed
+			results[i].Error = err.Error()
+			for j := 0; j < i; j++ {
+				results[j].Status = batchEntryRolledBack
+			}
+			return err
+		}
+		results[i].Status = batchEntryCommitted
+	}
+	return nil
+}
+
+// handleBatchJSON applies a JSON-encoded list of mutations atomically, responding with the outcome
+// for each entry: either all of them commit, or none of them do, in which case the response
+// identifies the entry that caused the batch to abort.
+func handleBatchJSON(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	var entries []batchEntry
+	if !decodeJSONBody(w, req, &entries) {
+		return
+	}
+	mutations, ok := interpretBatchEntries(w, entries)
+	if !ok {
+		return
+	}
+	results := make([]batchEntryResult, len(mutations))
+	var failure error
+	var txID uint64
+	err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		failure = applyBatchMutations(ctx, tx, mutations, results)
+		return failure == nil, failure
+	})
+	statusCode := http.StatusOK
+	if err != nil {
+		if failure == nil {
+			// The transaction failed for reasons other than any particular entry.
+			respondWithError(w, err)
+			return
+		}
+		statusCode = statusCodeForError(err)
+	} else {
+		setCommittedTransaction(w, txID)
+	}
+	speakJSONTo(w)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(batchResponse{
+		Committed: err == nil,
+		Results:   results,
+	})
+}
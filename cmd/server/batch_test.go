@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestBatchHandler(t *testing.T) {
+	server, fake := newTestServer(t)
+	res, body := sendJSON(t, server, "/records/batch",
+		`[{"key":"a","op":"insert","value":"1"},{"key_base64":"Yg==","op":"upsert","value_base64":"Mg=="},{"key":"c","op":"delete"}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	var response batchResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Committed || len(response.Results) != 3 ||
+		response.Results[2].Existed == nil || *response.Results[2].Existed {
+		t.Errorf("want committed batch reporting absent record deleted, got %s", body)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, ok := storedValue(t, fake.Store(), k); !ok || v != want {
+			t.Errorf("want record %q bound to %q, got %q (exists %t)", k, want, v, ok)
+		}
+	}
+
+	// A failed mutation rolls back those preceding it, leaving those following it unattempted.
+	res, body = sendJSON(t, server, "/records/batch",
+		`[{"key":"d","op":"insert","value":"4"},{"key":"a","op":"insert","value":"5"},{"key":"e","op":"insert","value":"6"}]`)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("want status %d, got %d (%s)", http.StatusConflict, res.StatusCode, body)
+	}
+	response = batchResponse{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, r := range response.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []string{batchEntryRolledBack, batchEntryFailed, batchEntryNotAttempted}; response.Committed || !slices.Equal(statuses, want) {
+		t.Errorf("want uncommitted batch with statuses %q, got %s", want, body)
+	}
+	if _, ok := storedValue(t, fake.Store(), "d"); ok {
+		t.Error(`want record "d" to remain absent`)
+	}
+
+	// The form-based variant binds and removes records.
+	if res, body := sendRequest(t, server, http.MethodPost, "/records/batch", url.Values{"bound": {"|a|x"}, "absent": {"b"}}); res.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	if v, _ := storedValue(t, fake.Store(), "a"); v != "x" {
+		t.Errorf(`want record "a" bound to "x", got %q`, v)
+	}
+	if _, ok := storedValue(t, fake.Store(), "b"); ok {
+		t.Error(`want record "b" to be absent`)
+	}
+}
+
+func TestBatchHandlerRejectsMalformedEntries(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, entries := range []string{
+		`[{"op":"insert","value":"1"}]`,
+		`[{"key":"a","op":"replace","value":"1"}]`,
+		`[{"key":"a","op":"insert"}]`,
+		`[{"key":"a","op":"delete","value":"1"}]`,
+		`[{"key":"a","key_base64":"YQ==","op":"delete"}]`,
+		`[{"key_base64":"not base64","op":"delete"}]`,
+		`{"key":"a","op":"delete"}`,
+		`[`,
+	} {
+		if res, body := sendJSON(t, server, "/records/batch", entries); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("entries %s: want status %d, got %d (%s)", entries, http.StatusBadRequest, res.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+const (
+	pathPrefixBucket       = "/bucket/"
+	pathInfixBucketRecord  = "/record/"
+	pathBuckets            = "/buckets"
+	formKeyIfAbsent        = "if-absent"
+	ifAbsentAbort          = "abort"
+	ifAbsentInsert         = "insert"
+	ifAbsentIgnore         = "ignore"
+	bucketRecordPathFormat = pathPrefixBucket + "%s" + pathInfixBucketRecord + "%s"
+)
+
+// getBucketTarget extracts the bucket name and, if the URL path addresses a record within the
+// bucket, the record key from the request's URL path, responding with an error and returning false
+// if the path is malformed.
+func getBucketTarget(w http.ResponseWriter, req *http.Request) (string, idb.Key, bool) {
+	rest, _ := strings.CutPrefix(req.URL.Path, pathPrefixBucket)
+	bucket, key, hasKey := strings.Cut(rest, "/")
+	if len(bucket) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty bucket name")
+		return "", nil, false
+	}
+	if !hasKey {
+		return bucket, nil, true
+	}
+	key, ok := strings.CutPrefix("/"+key, pathInfixBucketRecord)
+	if !ok || len(key) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "URL path must end with %q followed by a nonempty key", pathInfixBucketRecord)
+		return "", nil, false
+	}
+	return bucket, idb.Key(key), true
+}
+
+// withinBucket calls the given function with a view of the named bucket within a new
+// transaction, committing the transaction if the function returns true. It reports the ID of the
+// transaction.
+func withinBucket(ctx context.Context, db database, bucket string, f func(context.Context, *idb.NamespaceTransaction) (bool, error)) (uint64, error) {
+	var txID uint64
+	err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		ns, err := tx.Namespace(ctx, bucket)
+		if err != nil {
+			return false, err
+		}
+		return f(ctx, ns)
+	})
+	return txID, err
+}
+
+func handleBucketGet(ctx context.Context, w http.ResponseWriter, db database, bucket string, key idb.Key) {
+	var recordExists bool
+	var record idb.Record
+	if _, err := withinBucket(ctx, db, bucket, func(ctx context.Context, ns *idb.NamespaceTransaction) (bool, error) {
+		r, err := ns.GetRecord(ctx, key)
+		if errors.Is(err, idb.ErrRecordDoesNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		recordExists = true
+		record = r
+		// The transaction's value may not outlive the transaction.
+		record.Value = nil
+		r.Value.CopyInto(&record.Value)
+		return false, nil
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !recordExists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set(headerRecordVersion, strconv.FormatUint(record.Version, 10))
+	setRecordMetadata(w, record.Metadata)
+	if len(record.Metadata.ContentType) > 0 {
+		w.Write(record.Value)
+		return
+	}
+	speakPlainTextTo(w)
+	if _, err := w.Write(record.Value); err == nil {
+		w.Write([]byte{'\n'})
+	}
+}
+
+func handleBucketPost(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, bucket string, key idb.Key) {
+	if !parseForm(w, req) {
+		return
+	}
+	metadata, ok := getRecordMetadata(w, req)
+	if !ok {
+		return
+	}
+	value := idb.Value(req.FormValue("value"))
+	var recordExisted bool
+	txID, err := withinBucket(ctx, db, bucket, func(ctx context.Context, ns *idb.NamespaceTransaction) (bool, error) {
+		err := ns.InsertWithMetadata(ctx, key, value, metadata)
+		if errors.Is(err, idb.ErrRecordExists) {
+			recordExisted = true
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if recordExisted {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	setCommittedTransaction(w, txID)
+	setLocation(w, fmt.Sprintf(bucketRecordPathFormat, bucket, key))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getIfAbsentPolicy extracts the policy for a record that doesn't exist from the request's
+// "if-absent" form value, which must be one of the given allowed policies, defaulting to "abort".
+// It responds with an error and returns false if the value is not allowed.
+func getIfAbsentPolicy(w http.ResponseWriter, req *http.Request, allowed ...string) (string, bool) {
+	policy := req.FormValue(formKeyIfAbsent)
+	if len(policy) == 0 {
+		return ifAbsentAbort, true
+	}
+	if policy != ifAbsentAbort && !slices.Contains(allowed, policy) {
+		respondWithProblem(w, http.StatusBadRequest, "Unrecognized HTTP form key %q value: %q", formKeyIfAbsent, policy)
+		return "", false
+	}
+	return policy, true
+}
+
+func handleBucketPut(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, bucket string, key idb.Key) {
+	if !parseForm(w, req) {
+		return
+	}
+	metadata, ok := getRecordMetadata(w, req)
+	if !ok {
+		return
+	}
+	policy, ok := getIfAbsentPolicy(w, req, ifAbsentInsert, ifAbsentIgnore)
+	if !ok {
+		return
+	}
+	value := idb.Value(req.FormValue("value"))
+	recordExisted := true
+	txID, err := withinBucket(ctx, db, bucket, func(ctx context.Context, ns *idb.NamespaceTransaction) (bool, error) {
+		if policy == ifAbsentInsert {
+			err := ns.UpsertWithMetadata(ctx, key, value, metadata)
+			return err == nil, err
+		}
+		err := ns.UpdateWithMetadata(ctx, key, value, metadata)
+		if errors.Is(err, idb.ErrRecordDoesNotExist) {
+			recordExisted = false
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if recordExisted {
+		setCommittedTransaction(w, txID)
+	} else if policy == ifAbsentAbort {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func handleBucketDelete(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, bucket string, key idb.Key) {
+	if !parseForm(w, req) {
+		return
+	}
+	policy, ok := getIfAbsentPolicy(w, req, ifAbsentIgnore)
+	if !ok {
+		return
+	}
+	var recordExisted bool
+	txID, err := withinBucket(ctx, db, bucket, func(ctx context.Context, ns *idb.NamespaceTransaction) (bool, error) {
+		deleted, err := ns.Delete(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		recordExisted = deleted
+		return true, nil
+	})
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if recordExisted {
+		setCommittedTransaction(w, txID)
+	} else if policy == ifAbsentAbort {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	respondWithSuccessfulDeletion(w)
+}
+
+// handleCreateBucket creates the named bucket, responding with status code 409 (Conflict) if it
+// exists already.
+func handleCreateBucket(ctx context.Context, w http.ResponseWriter, db database, bucket string) {
+	var txID uint64
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		err := tx.CreateNamespace(ctx, bucket)
+		return err == nil, err
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	setCommittedTransaction(w, txID)
+	setLocation(w, pathPrefixBucket+bucket)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleDeleteBucket deletes the named bucket along with all its records.
+func handleDeleteBucket(ctx context.Context, w http.ResponseWriter, db database, bucket string) {
+	var txID uint64
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		_, err := tx.DeleteNamespace(ctx, bucket)
+		return err == nil, err
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	setCommittedTransaction(w, txID)
+	respondWithSuccessfulDeletion(w)
+}
+
+// handleListBuckets lists the names of the buckets as a JSON array, sorted by name.
+func handleListBuckets(ctx context.Context, w http.ResponseWriter, db database) {
+	var buckets []string
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		buckets = slices.Collect(tx.Namespaces(ctx))
+		return false, nil
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	slices.Sort(buckets)
+	if buckets == nil {
+		buckets = []string{}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// registerBucketHandlers installs the handlers for requests to create, delete, and list buckets,
+// each of which holds records apart from those of other buckets and from the records addressed
+// via the "/record/" path, and to read and write the records within them.
+func registerBucketHandlers(mux *http.ServeMux, db database) {
+	mux.HandleFunc(pathBuckets, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleListBuckets(req.Context(), w, db)
+	})
+	mux.HandleFunc(pathPrefixBucket, func(w http.ResponseWriter, req *http.Request) {
+		bucket, key, ok := getBucketTarget(w, req)
+		if !ok {
+			return
+		}
+		ctx := req.Context()
+		if key == nil {
+			switch req.Method {
+			case http.MethodPut:
+				handleCreateBucket(ctx, w, db, bucket)
+			case http.MethodDelete:
+				handleDeleteBucket(ctx, w, db, bucket)
+			default:
+				rejectMethod(w, req, http.MethodPut, http.MethodDelete)
+			}
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			handleBucketGet(ctx, w, db, bucket, key)
+		case http.MethodPost:
+			handleBucketPost(ctx, w, req, db, bucket, key)
+		case http.MethodPut:
+			handleBucketPut(ctx, w, req, db, bucket, key)
+		case http.MethodDelete:
+			handleBucketDelete(ctx, w, req, db, bucket, key)
+		default:
+			rejectMethod(w, req, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+		}
+	})
+}
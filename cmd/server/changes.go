@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+type changeWatcher interface {
+	database
+	WatchCommittedTransactions(ctx context.Context) iter.Seq[idb.CommittedTransaction]
+	LatestCommittedTransaction() uint64
+}
+
+type changeFeedReady struct {
+	Transaction uint64 `json:"transaction"`
+}
+
+type recordChange struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+	Deleted     bool    `json:"deleted,omitempty"`
+}
+
+type committedTransaction struct {
+	ID      uint64         `json:"id"`
+	Changes []recordChange `json:"changes"`
+}
+
+// readChanges reads the current value of each record with the given keys, noting those that no
+// longer exist as deleted. Since the values are read after the transaction that changed them
+// committed, they may reflect later transactions too, which the feed reports in turn.
+func readChanges(ctx context.Context, db database, keys []idb.Key) ([]recordChange, error) {
+	changes := make([]recordChange, len(keys))
+	err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		for i, k := range keys {
+			c := recordChange{}
+			c.Key, c.KeyBase64 = textOrBase64(k)
+			v, err := tx.Get(ctx, k)
+			switch {
+			case errors.Is(err, idb.ErrRecordDoesNotExist):
+				c.Deleted = true
+			case err != nil:
+				return false, err
+			default:
+				c.Value, c.ValueBase64 = textOrBase64(v)
+			}
+			changes[i] = c
+		}
+		return false, nil
+	})
+	return changes, err
+}
+
+// handleChangeFeed streams a description of each transaction that commits changes to the
+// database's records as server-sent events, until the client disconnects or the request's Context
+// is done. It first sends a "ready" event once it's watching for changes, after which a client may
+// take a snapshot of the records (see handleExport), certain that the subsequent events cover
+// every change that the snapshot misses.
+func handleChangeFeed(w http.ResponseWriter, req *http.Request, db changeWatcher) {
+	ctx := req.Context()
+	committed := db.WatchCommittedTransactions(ctx)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(changeFeedReady{
+		Transaction: db.LatestCommittedTransaction(),
+	})
+	fmt.Fprintf(w, "event: ready\ndata: %s\n\n", data)
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return
+	}
+	for tx := range committed {
+		changes, err := readChanges(ctx, db, tx.Keys)
+		if err != nil {
+			if ctx.Err() == nil {
+				// Having committed to the stream already, report the failure as an event.
+				problem, _ := json.Marshal(problemForError(err))
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", problem)
+				rc.Flush()
+			}
+			return
+		}
+		data, _ := json.Marshal(committedTransaction{
+			ID:      tx.ID,
+			Changes: changes,
+		})
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: transaction\ndata: %s\n\n", tx.ID, data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+	}
+}
+
+// registerChangeFeedHandlers installs the handler for administrative requests to watch the changes
+// committed to the database's records, such as to replicate them to another server.
+func registerChangeFeedHandlers(mux *http.ServeMux, db changeWatcher) {
+	mux.HandleFunc("/admin/changes", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleChangeFeed(w, req, db)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// chaosConfig is the JSON-encoded description of the faults to inject into the database's
+// transactions, for testing how clients cope with them.
+type chaosConfig struct {
+	// MaxLatency is a duration such as "50ms", in the syntax that time.ParseDuration accepts.
+	MaxLatency      string  `json:"max_latency"`
+	LockFailureRate float64 `json:"lock_failure_rate"`
+	CommitAbortRate float64 `json:"commit_abort_rate"`
+}
+
+// readChaosConfig reads the faults to inject from the JSON document in the given file.
+func readChaosConfig(path string) (db.FaultInjection, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return db.FaultInjection{}, err
+	}
+	var config chaosConfig
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return db.FaultInjection{}, fmt.Errorf("failed to decode JSON document: %w", err)
+	}
+	var latency time.Duration
+	if len(config.MaxLatency) > 0 {
+		if latency, err = time.ParseDuration(config.MaxLatency); err != nil {
+			return db.FaultInjection{}, fmt.Errorf("invalid %q value: %w", "max_latency", err)
+		}
+	}
+	return db.FaultInjection{
+		MaxLatency:      latency,
+		LockFailureRate: config.LockFailureRate,
+		CommitAbortRate: config.CommitAbortRate,
+	}, nil
+}
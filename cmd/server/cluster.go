@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"sehlabs.com/db/internal/cluster"
+)
+
+const pathClusterGossip = "/cluster/gossip"
+
+type gossipHeartbeat struct {
+	URL       string `json:"url"`
+	Heartbeat uint64 `json:"heartbeat"`
+}
+
+type gossipMessage struct {
+	Members []gossipHeartbeat `json:"members"`
+}
+
+func makeGossipMessage(heartbeats []cluster.Heartbeat) gossipMessage {
+	members := make([]gossipHeartbeat, len(heartbeats))
+	for i, h := range heartbeats {
+		members[i] = gossipHeartbeat{
+			URL:       h.URL,
+			Heartbeat: h.Counter,
+		}
+	}
+	return gossipMessage{Members: members}
+}
+
+func (m gossipMessage) heartbeats() []cluster.Heartbeat {
+	heartbeats := make([]cluster.Heartbeat, len(m.Members))
+	for i, h := range m.Members {
+		heartbeats[i] = cluster.Heartbeat{
+			URL:     h.URL,
+			Counter: h.Heartbeat,
+		}
+	}
+	return heartbeats
+}
+
+// exchangeHeartbeatsOverHTTP returns a cluster.Exchanger that sends heartbeat counters to a peer
+// in a request to its gossip endpoint, giving up on each exchange after the given duration.
+func exchangeHeartbeatsOverHTTP(client *http.Client, timeout time.Duration) cluster.Exchanger {
+	return func(ctx context.Context, peer string, heartbeats []cluster.Heartbeat) ([]cluster.Heartbeat, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		body, err := json.Marshal(makeGossipMessage(heartbeats))
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+pathClusterGossip, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("peer %s responded to gossip with HTTP status code %d", peer, res.StatusCode)
+		}
+		var m gossipMessage
+		if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+			return nil, err
+		}
+		return m.heartbeats(), nil
+	}
+}
+
+// registerGossipHandlers installs the handler for requests from peers exchanging heartbeat
+// counters, which must be reachable at the URL that this server advertises to its peers.
+func registerGossipHandlers(mux *http.ServeMux, membership *cluster.Membership) {
+	mux.HandleFunc(pathClusterGossip, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		var m gossipMessage
+		if !decodeJSONBody(w, req, &m) {
+			return
+		}
+		membership.Merge(m.heartbeats())
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(makeGossipMessage(membership.Heartbeats()))
+	})
+}
+
+type clusterMember struct {
+	URL       string     `json:"url"`
+	Self      bool       `json:"self,omitempty"`
+	Status    string     `json:"status"`
+	Heartbeat uint64     `json:"heartbeat"`
+	LastHeard *time.Time `json:"last_heard,omitempty"`
+}
+
+// registerClusterHandlers installs the handler for requests describing the members of the cluster
+// as seen by this server.
+func registerClusterHandlers(mux *http.ServeMux, membership *cluster.Membership) {
+	mux.HandleFunc("/admin/cluster", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		members := membership.Members()
+		response := make([]clusterMember, len(members))
+		for i, m := range members {
+			response[i] = clusterMember{
+				URL:       m.URL,
+				Self:      m.Self,
+				Status:    m.Status.String(),
+				Heartbeat: m.Heartbeat,
+			}
+			if !m.LastHeard.IsZero() {
+				response[i].LastHeard = &m.LastHeard
+			}
+		}
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(response)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// headerNextCursor is the HTTP response header conveying the opaque cursor with which to request
+// the next page of a paginated listing, present only if more entries remain.
+const headerNextCursor = "X-Db-Next-Cursor"
+
+// errCursorExpired is the error returned for a cursor whose snapshot the server no longer pins.
+var errCursorExpired = errors.New("cursor has expired")
+
+// listingCursor identifies a position within a paginated listing: the snapshot at which the
+// listing observes the database, and the last key already returned.
+type listingCursor struct {
+	snapshotID uint64
+	after      idb.Key
+}
+
+func (c listingCursor) String() string {
+	b := binary.AppendUvarint(nil, c.snapshotID)
+	return base64.RawURLEncoding.EncodeToString(append(b, c.after...))
+}
+
+func parseListingCursor(s string) (listingCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return listingCursor{}, errors.New("cursor is malformed")
+	}
+	id, n := binary.Uvarint(b)
+	if n <= 0 {
+		return listingCursor{}, errors.New("cursor is malformed")
+	}
+	return listingCursor{
+		snapshotID: id,
+		after:      idb.Key(b[n:]),
+	}, nil
+}
+
+// cursorSnapshots pins the snapshots observed by paginated listings between requests, unpinning
+// each once its listing is exhausted or once no request has used it for a while.
+type cursorSnapshots struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	byID    map[uint64]*pinnedCursorSnapshot // NB: Initialized lazily
+}
+
+type pinnedCursorSnapshot struct {
+	snapshot *idb.Snapshot
+	expiry   *time.Timer
+}
+
+// pin pins the database as it is now for a new listing.
+func (cs *cursorSnapshots) pin(ctx context.Context, db database) (*idb.Snapshot, error) {
+	snapshot, err := db.PinSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := snapshot.ID()
+	p := &pinnedCursorSnapshot{
+		snapshot: snapshot,
+		expiry:   time.AfterFunc(cs.timeout, func() { cs.release(id) }),
+	}
+	cs.mu.Lock()
+	if cs.byID == nil {
+		cs.byID = make(map[uint64]*pinnedCursorSnapshot)
+	}
+	cs.byID[id] = p
+	cs.mu.Unlock()
+	return snapshot, nil
+}
+
+// lookup returns the snapshot with the given ID, postponing its expiry, or returns
+// errCursorExpired if the server no longer pins it.
+func (cs *cursorSnapshots) lookup(id uint64) (*idb.Snapshot, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	p, ok := cs.byID[id]
+	if !ok {
+		return nil, errCursorExpired
+	}
+	p.expiry.Reset(cs.timeout)
+	return p.snapshot, nil
+}
+
+// release unpins the snapshot with the given ID, if the server still pins it.
+func (cs *cursorSnapshots) release(id uint64) {
+	cs.mu.Lock()
+	p, ok := cs.byID[id]
+	delete(cs.byID, id)
+	cs.mu.Unlock()
+	if ok {
+		p.expiry.Stop()
+		p.snapshot.Close()
+	}
+}
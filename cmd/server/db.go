@@ -1,11 +1,7 @@
 package main
 
-import (
-	"context"
+import "sehlabs.com/db/internal/db"
 
-	"sehlabs.com/db/internal/db"
-)
-
-type database interface {
-	WithinTransaction(context.Context, func(context.Context, db.Transaction) (commit bool, err error)) error
-}
+// database is the store on which the client request handlers operate, which tests may replace
+// with a double (see package dbtest).
+type database = db.Database
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+const (
+	exportFormatCSV = "csv"
+	exportFormatSQL = "sql"
+)
+
+// defaultExportTable is the name of the SQL table into which exported records are inserted,
+// absent a specified name.
+const defaultExportTable = "records"
+
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// recordExporter writes records in a particular format, preceded by a prologue identifying the
+// transaction as of which the records were read and followed by an epilogue.
+type recordExporter interface {
+	begin(txID uint64) error
+	write(k idb.Key, r idb.Record) error
+	end() error
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin(uint64) error {
+	return e.w.Write([]string{"key", "version", "content_type", "value"})
+}
+
+func (e *csvExporter) write(k idb.Key, r idb.Record) error {
+	return e.w.Write([]string{
+		string(k),
+		strconv.FormatUint(r.Version, 10),
+		r.Metadata.ContentType,
+		string(r.Value),
+	})
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type sqlExporter struct {
+	w     io.Writer
+	table string
+	// buf is reused for each statement, to avoid allocating one per record.
+	buf []byte
+}
+
+func (e *sqlExporter) begin(txID uint64) error {
+	_, err := fmt.Fprintf(e.w, `-- Records as of transaction %d
+CREATE TABLE IF NOT EXISTS %s (record_key BLOB PRIMARY KEY, version BIGINT NOT NULL, content_type TEXT, value BLOB NOT NULL);
+BEGIN;
+`, txID, e.table)
+	return err
+}
+
+func appendSQLBlob(b []byte, v []byte) []byte {
+	b = append(b, "X'"...)
+	b = hex.AppendEncode(b, v)
+	return append(b, '\'')
+}
+
+func appendSQLString(b []byte, s string) []byte {
+	b = append(b, '\'')
+	for i := range len(s) {
+		if s[i] == '\'' {
+			b = append(b, '\'')
+		}
+		b = append(b, s[i])
+	}
+	return append(b, '\'')
+}
+
+func (e *sqlExporter) write(k idb.Key, r idb.Record) error {
+	b := append(e.buf[:0], "INSERT INTO "...)
+	b = append(b, e.table...)
+	b = append(b, " (record_key, version, content_type, value) VALUES ("...)
+	b = appendSQLBlob(b, k)
+	b = append(b, ", "...)
+	b = strconv.AppendUint(b, r.Version, 10)
+	b = append(b, ", "...)
+	if ct := r.Metadata.ContentType; len(ct) > 0 {
+		b = appendSQLString(b, ct)
+	} else {
+		b = append(b, "NULL"...)
+	}
+	b = append(b, ", "...)
+	b = appendSQLBlob(b, r.Value)
+	b = append(b, ");\n"...)
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *sqlExporter) end() error {
+	_, err := io.WriteString(e.w, "COMMIT;\n")
+	return err
+}
+
+// exportRecords writes all the records in the database that satisfy the given filter, if any, via
+// the given exporter, observing them as of a single point in time. It streams the records as it
+// reads them, rather than collecting them first.
+func exportRecords(ctx context.Context, db database, e recordExporter, filter *recordFilter) error {
+	return db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		if err := e.begin(tx.ID()); err != nil {
+			return false, err
+		}
+		for k, v := range tx.Scan(ctx, filter.keyPrefix()) {
+			if !filter.matches(k, v) {
+				continue
+			}
+			r, err := tx.GetRecord(ctx, k)
+			if err != nil {
+				return false, err
+			}
+			if err := e.write(k, r); err != nil {
+				return false, err
+			}
+		}
+		// Should the scan stop early, this still ends the export, but WithinTransaction returns the
+		// scan's error, whereupon handleExport abandons the response, so the client can't mistake
+		// the truncated dump for a whole one.
+		return false, e.end()
+	})
+}
+
+// handleExport writes all the records in the database, or those that satisfy the filter given by
+// the "filter" query parameter, in the format named by the "format" query parameter, suitable for
+// loading into other systems, such as for analytics.
+func handleExport(w http.ResponseWriter, req *http.Request, db database) {
+	query := req.URL.Query()
+	filter, ok := parseFilterQuery(w, query)
+	if !ok {
+		return
+	}
+	var e recordExporter
+	switch format := query.Get("format"); format {
+	case exportFormatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		e = &csvExporter{csv.NewWriter(w)}
+	case exportFormatSQL:
+		table := defaultExportTable
+		if query.Has("table") {
+			table = query.Get("table")
+			if !sqlIdentifierPattern.MatchString(table) {
+				respondWithProblem(w, http.StatusBadRequest, "Invalid SQL table name: %q", table)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/sql")
+		e = &sqlExporter{
+			w:     w,
+			table: table,
+		}
+	default:
+		respondWithProblem(w, http.StatusBadRequest, "Unsupported export format %q; must be %q or %q", format, exportFormatCSV, exportFormatSQL)
+		return
+	}
+	if err := exportRecords(req.Context(), db, e, filter); err != nil {
+		// We've likely already started writing the response, so all we can do is abandon it and
+		// let the client detect the truncation.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// registerExportHandlers installs the handler for administrative requests to export the
+// database's records.
+func registerExportHandlers(mux *http.ServeMux, db database) {
+	mux.HandleFunc("/admin/export", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		handleExport(w, req, db)
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+	"sehlabs.com/db/internal/db/dbtest"
+)
+
+// exportedRecord is a record as it should appear in an export.
+type exportedRecord struct {
+	key, contentType, value string
+	version                 uint64
+}
+
+// newExportServer starts a server handling requests to export the records of a new Fake,
+// populated with the given records, returning the server, the Fake, and the records along with
+// their versions.
+func newExportServer(t *testing.T, records []exportedRecord) (*httptest.Server, *dbtest.Fake, []exportedRecord) {
+	t.Helper()
+	fake, err := dbtest.NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	records = slices.Clone(records)
+	for _, r := range records {
+		if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.InsertWithMetadata(ctx, idb.Key(r.key), idb.Value(r.value), idb.Metadata{ContentType: r.contentType})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Records acquire their versions as their transactions commit.
+	if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		for i, r := range records {
+			stored, err := tx.GetRecord(ctx, idb.Key(r.key))
+			if err != nil {
+				return false, err
+			}
+			records[i].version = stored.Version
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerExportHandlers(mux, fake)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, fake, records
+}
+
+// readCSVExport parses the given CSV dump, returning its records sorted by key.
+func readCSVExport(t *testing.T, dump string) []exportedRecord {
+	t.Helper()
+	rows, err := csv.NewReader(strings.NewReader(dump)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || !slices.Equal(rows[0], []string{"key", "version", "content_type", "value"}) {
+		t.Fatalf("want CSV dump beginning with header row, got %q", dump)
+	}
+	var records []exportedRecord
+	for _, row := range rows[1:] {
+		version, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, exportedRecord{key: row[0], version: version, contentType: row[2], value: row[3]})
+	}
+	slices.SortFunc(records, func(a, b exportedRecord) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return records
+}
+
+// sqlInsertStatement returns the statement with which an SQL dump inserts the given record into
+// the given table.
+func sqlInsertStatement(table string, r exportedRecord) string {
+	contentType := "NULL"
+	if len(r.contentType) > 0 {
+		contentType = "'" + strings.ReplaceAll(r.contentType, "'", "''") + "'"
+	}
+	return fmt.Sprintf("INSERT INTO %s (record_key, version, content_type, value) VALUES (X'%s', %d, %s, X'%s');",
+		table, hex.EncodeToString([]byte(r.key)), r.version, contentType, hex.EncodeToString([]byte(r.value)))
+}
+
+var sqlExportProloguePattern = regexp.MustCompile(`^-- Records as of transaction \d+$`)
+
+func TestExport(t *testing.T) {
+	server, _, records := newExportServer(t, []exportedRecord{
+		{key: "logs/1", value: "a line, with \"quotes\"\nand another"},
+		{key: "users/alice", contentType: "application/json", value: `{"name":"Alice"}`},
+		{key: "users/o'brien", contentType: "text/plain; note='quoted'", value: "\x00\xff"},
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		res, body := sendRequest(t, server, http.MethodGet, "/admin/export?format=csv", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+		}
+		if got := res.Header.Get("Content-Type"); got != "text/csv" {
+			t.Errorf("want content type %q, got %q", "text/csv", got)
+		}
+		if got := readCSVExport(t, body); !slices.Equal(records, got) {
+			t.Errorf("want records %q, got %q", records, got)
+		}
+
+		res, body = sendRequest(t, server, http.MethodGet, "/admin/export?format=csv&filter=key%3Dusers/*", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("filtered: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+		}
+		if got := readCSVExport(t, body); !slices.Equal(records[1:], got) {
+			t.Errorf("filtered: want records %q, got %q", records[1:], got)
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		for _, tc := range []struct {
+			query string
+			table string
+		}{
+			{query: "format=sql", table: defaultExportTable},
+			{query: "format=sql&table=backup_2", table: "backup_2"},
+		} {
+			res, body := sendRequest(t, server, http.MethodGet, "/admin/export?"+tc.query, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("%s: want status %d, got %d (%s)", tc.query, http.StatusOK, res.StatusCode, body)
+			}
+			if got := res.Header.Get("Content-Type"); got != "application/sql" {
+				t.Errorf("%s: want content type %q, got %q", tc.query, "application/sql", got)
+			}
+			lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			if len(lines) != 4+len(records) {
+				t.Fatalf("%s: want %d lines, got %q", tc.query, 4+len(records), body)
+			}
+			if !sqlExportProloguePattern.MatchString(lines[0]) {
+				t.Errorf("%s: want prologue naming the transaction, got %q", tc.query, lines[0])
+			}
+			if want := "CREATE TABLE IF NOT EXISTS " + tc.table + " ("; !strings.HasPrefix(lines[1], want) {
+				t.Errorf("%s: want line beginning with %q, got %q", tc.query, want, lines[1])
+			}
+			if lines[2] != "BEGIN;" || lines[len(lines)-1] != "COMMIT;" {
+				t.Errorf("%s: want inserts enclosed within a transaction, got %q", tc.query, body)
+			}
+			var want []string
+			for _, r := range records {
+				want = append(want, sqlInsertStatement(tc.table, r))
+			}
+			got := slices.Sorted(slices.Values(lines[3 : len(lines)-1]))
+			if !slices.Equal(want, got) {
+				t.Errorf("%s: want statements\n%s\ngot\n%s", tc.query, strings.Join(want, "\n"), strings.Join(got, "\n"))
+			}
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		for _, tc := range []struct {
+			method string
+			query  string
+		}{
+			{method: http.MethodGet, query: ""},
+			{method: http.MethodGet, query: "format=xml"},
+			{method: http.MethodGet, query: "format=sql&table=bad-name"},
+			{method: http.MethodGet, query: "format=sql&table="},
+			{method: http.MethodGet, query: "format=csv&filter=color%3Dred"},
+			{method: http.MethodPost, query: "format=csv"},
+		} {
+			if res, body := sendRequest(t, server, tc.method, "/admin/export?"+tc.query, nil); res.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s %q: want status %d, got %d (%s)", tc.method, tc.query, http.StatusBadRequest, res.StatusCode, body)
+			}
+		}
+	})
+}
+
+func TestExportAbandonsResponseUponScanError(t *testing.T) {
+	// Make the records large enough that the server starts sending the dump before the scan
+	// fails.
+	var records []exportedRecord
+	for i := range 10 {
+		records = append(records, exportedRecord{key: fmt.Sprintf("k%02d", i), value: strings.Repeat(strconv.Itoa(i), 2000)})
+	}
+	server, fake, records := newExportServer(t, records)
+	errInjected := errors.New("injected")
+
+	for _, format := range []string{exportFormatCSV, exportFormatSQL} {
+		t.Run(format, func(t *testing.T) {
+			// The scan yields several records, whichever it visits first, before failing.
+			const yielded = 6
+			fake.Reset()
+			fake.Inject(dbtest.Fault{Operation: dbtest.Scan, Times: yielded})
+			fake.Inject(dbtest.Fault{Operation: dbtest.Scan, Err: errInjected})
+
+			res, err := server.Client().Get(server.URL + "/admin/export?format=" + format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("want status %d, got %d", http.StatusOK, res.StatusCode)
+			}
+			b, err := io.ReadAll(res.Body)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("want response truncated, got error %v after reading %d bytes", err, len(b))
+			}
+			// Whatever arrived is the beginning of a dump that lacks the records not yet scanned.
+			body := string(b)
+			var prologue int
+			switch format {
+			case exportFormatCSV:
+				prologue = 1
+				if !strings.HasPrefix(body, "key,version,content_type,value\n") {
+					t.Errorf("want CSV dump beginning with header row, got %q", body[:min(len(body), 40)])
+				}
+			case exportFormatSQL:
+				prologue = 3
+				if !sqlExportProloguePattern.MatchString(body[:strings.IndexByte(body, '\n')]) {
+					t.Errorf("want SQL dump beginning with prologue, got %q", body[:min(len(body), 40)])
+				}
+				if strings.Contains(body, "COMMIT;") {
+					t.Error("want truncated SQL dump to lack its closing statement")
+				}
+			}
+			if complete := strings.Count(body, "\n") - prologue; complete < 1 || complete > yielded {
+				t.Errorf("want between 1 and %d complete records in truncated dump, got %d", yielded, complete)
+			}
+		})
+	}
+
+	t.Run("before responding", func(t *testing.T) {
+		fake.Reset()
+		fake.Inject(dbtest.Fault{Operation: dbtest.Scan, Err: errInjected})
+		// The server closes the connection without responding at all.
+		if res, err := server.Client().Get(server.URL + "/admin/export?format=csv"); err == nil {
+			res.Body.Close()
+			t.Errorf("want request to fail, got status %d", res.StatusCode)
+		}
+	})
+
+	fake.Reset()
+	if res, body := sendRequest(t, server, http.MethodGet, "/admin/export?format=csv", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("after faults cleared: want status %d, got %d", http.StatusOK, res.StatusCode)
+	} else if got := readCSVExport(t, body); !slices.Equal(records, got) {
+		t.Errorf("after faults cleared: want all %d records, got %d", len(records), len(got))
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// recordFilter selects records by their keys and values, per an expression that is a sequence of
+// whitespace-separated terms, all of which a record must satisfy:
+//
+//   - key=GLOB matches keys against a pattern in which "*" matches any sequence of bytes, "?"
+//     matches any single byte, and "\" escapes the byte that follows it.
+//   - value*=TEXT matches values containing the given text.
+//   - value~=REGEXP matches values containing a match for the given regular expression.
+//   - size<N, size<=N, size=N, size>=N, and size>N match values by their length in bytes.
+//
+// Operands may be written as double-quoted Go string literals, such as to include whitespace.
+type recordFilter struct {
+	keyPatterns   [][]byte
+	valueContains [][]byte
+	valuePatterns []*regexp.Regexp
+	minSize       int
+	maxSize       int // NB: Negative means unbounded.
+}
+
+func parseRecordFilter(s string) (*recordFilter, error) {
+	f := recordFilter{maxSize: -1}
+	rest := strings.TrimSpace(s)
+	for len(rest) > 0 {
+		i := strings.IndexAny(rest, "*~<>=")
+		if i < 1 {
+			return nil, fmt.Errorf("term %q lacks a field name", firstWord(rest))
+		}
+		field := rest[:i]
+		rest = rest[i:]
+		var op string
+		for _, candidate := range []string{"*=", "~=", "<=", ">=", "=", "<", ">"} {
+			if strings.HasPrefix(rest, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if len(op) == 0 {
+			return nil, fmt.Errorf("term for field %q lacks a valid operator", field)
+		}
+		rest = rest[len(op):]
+		var operand string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("term for field %q has a malformed quoted operand: %w", field, err)
+			}
+			operand, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			operand = firstWord(rest)
+			rest = rest[len(operand):]
+		}
+		if len(rest) > 0 && !unicode.IsSpace(rune(rest[0])) {
+			return nil, fmt.Errorf("term for field %q must be followed by whitespace", field)
+		}
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if err := f.addTerm(field, op, operand); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+func firstWord(s string) string {
+	if i := strings.IndexFunc(s, unicode.IsSpace); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func (f *recordFilter) addTerm(field, op, operand string) error {
+	switch {
+	case field == "key" && op == "=":
+		f.keyPatterns = append(f.keyPatterns, []byte(operand))
+	case field == "value" && op == "*=":
+		f.valueContains = append(f.valueContains, []byte(operand))
+	case field == "value" && op == "~=":
+		re, err := regexp.Compile(operand)
+		if err != nil {
+			return fmt.Errorf("term for field %q has an invalid regular expression: %w", field, err)
+		}
+		f.valuePatterns = append(f.valuePatterns, re)
+	case field == "size" && op != "*=" && op != "~=":
+		n, err := strconv.Atoi(operand)
+		if err != nil || n < 0 {
+			return fmt.Errorf("term for field %q has an invalid size %q", field, operand)
+		}
+		switch op {
+		case "<":
+			if n == 0 {
+				// No value is shorter than zero bytes.
+				f.minSize, f.maxSize = 1, 0
+			} else {
+				f.limitMaxSize(n - 1)
+			}
+		case "<=":
+			f.limitMaxSize(n)
+		case "=":
+			f.minSize = max(f.minSize, n)
+			f.limitMaxSize(n)
+		case ">=":
+			f.minSize = max(f.minSize, n)
+		case ">":
+			f.minSize = max(f.minSize, n+1)
+		}
+	case field == "key" || field == "value" || field == "size":
+		return fmt.Errorf("field %q does not support operator %q", field, op)
+	default:
+		return fmt.Errorf("unknown field %q; must be \"key\", \"value\", or \"size\"", field)
+	}
+	return nil
+}
+
+func (f *recordFilter) limitMaxSize(n int) {
+	if f.maxSize < 0 || n < f.maxSize {
+		f.maxSize = n
+	}
+}
+
+// keyPrefix returns the longest prefix shared by all the keys that the filter could match, with
+// which to narrow a scan.
+func (f *recordFilter) keyPrefix() idb.Key {
+	if f == nil {
+		return nil
+	}
+	var longest []byte
+	for _, pattern := range f.keyPatterns {
+		var literal []byte
+	scan:
+		for i := 0; i < len(pattern); i++ {
+			switch pattern[i] {
+			case '*', '?':
+				break scan
+			case '\\':
+				if i++; i == len(pattern) {
+					break scan
+				}
+			}
+			literal = append(literal, pattern[i])
+		}
+		// Every key must match every pattern, so the longest literal prefix applies.
+		if len(literal) > len(longest) {
+			longest = literal
+		}
+	}
+	return idb.Key(longest)
+}
+
+// matches reports whether the record with the given key and value satisfies the filter. A nil
+// filter matches every record.
+func (f *recordFilter) matches(k idb.Key, v idb.Value) bool {
+	if f == nil {
+		return true
+	}
+	if len(v) < f.minSize || (f.maxSize >= 0 && len(v) > f.maxSize) {
+		return false
+	}
+	for _, pattern := range f.keyPatterns {
+		if !globMatch(pattern, k) {
+			return false
+		}
+	}
+	for _, text := range f.valueContains {
+		if !bytes.Contains(v, text) {
+			return false
+		}
+	}
+	for _, re := range f.valuePatterns {
+		if !re.Match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch reports whether the given glob pattern matches all of s.
+func globMatch(pattern, s []byte) bool {
+	// Upon a mismatch, resume from just after the most recent star, having it consume one more
+	// byte of s.
+	starPattern, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				starPattern, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		starS++
+		p, i = starPattern+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// scannedRecord describes a record in the response to a scan, rendering its key and value as text
+// when they're valid UTF-8, or otherwise encoded as base64.
+type scannedRecord struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Version     uint64  `json:"version"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+func textOrBase64(b []byte) (text, encoded *string) {
+	s := string(b)
+	if utf8.ValidString(s) {
+		return &s, nil
+	}
+	s = base64.StdEncoding.EncodeToString(b)
+	return nil, &s
+}
+
+// parseFilterQuery parses the record filter in the request's "filter" query parameter, if any,
+// responding with an error and returning false if it can't do so.
+func parseFilterQuery(w http.ResponseWriter, query url.Values) (*recordFilter, bool) {
+	if !query.Has("filter") {
+		return nil, true
+	}
+	f, err := parseRecordFilter(query.Get("filter"))
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid record filter: %v", err)
+		return nil, false
+	}
+	return f, true
+}
+
+// handleScan describes the records with keys starting with the prefix given by the "prefix" query
+// parameter that satisfy the filter given by the "filter" query parameter, observing them all as
+// of a single point in time.
+func handleScan(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	query := req.URL.Query()
+	filter, ok := parseFilterQuery(w, query)
+	if !ok {
+		return
+	}
+	prefix := idb.Key(query.Get("prefix"))
+	if fp := filter.keyPrefix(); len(fp) > len(prefix) && bytes.HasPrefix(fp, prefix) {
+		prefix = fp
+	}
+	type keyedRecord struct {
+		key    string
+		record scannedRecord
+	}
+	var found []keyedRecord
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		found = found[:0]
+		for k, v := range tx.Scan(ctx, prefix) {
+			if !filter.matches(k, v) {
+				continue
+			}
+			_, version, err := tx.GetVersioned(ctx, k)
+			if err != nil {
+				return false, err
+			}
+			r := scannedRecord{Version: version}
+			r.Key, r.KeyBase64 = textOrBase64(k)
+			r.Value, r.ValueBase64 = textOrBase64(v)
+			found = append(found, keyedRecord{string(k), r})
+		}
+		// Should the scan stop early, WithinTransaction returns its error in place of this nil (see
+		// idb.Transaction.Scan), so we never respond with a partial list.
+		return false, nil
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	// Present the records in key order, since the scan visits them in no particular order.
+	slices.SortFunc(found, func(a, b keyedRecord) int {
+		return strings.Compare(a.key, b.key)
+	})
+	records := make([]scannedRecord, len(found))
+	for i, kr := range found {
+		records[i] = kr.record
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+func TestParseRecordFilterRejectsMalformedFilters(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		// wantMessage is a fragment of the expected error's message.
+		wantMessage string
+	}{
+		{filter: "=users/*", wantMessage: "lacks a field name"},
+		{filter: "key", wantMessage: "lacks a field name"},
+		{filter: "key=a size", wantMessage: `term "size" lacks a field name`},
+		{filter: "key*a", wantMessage: `term for field "key" lacks a valid operator`},
+		{filter: `value*="abc`, wantMessage: "malformed quoted operand"},
+		{filter: `key="a"b`, wantMessage: "must be followed by whitespace"},
+		{filter: "value~=(", wantMessage: "invalid regular expression"},
+		{filter: "size=-1", wantMessage: `invalid size "-1"`},
+		{filter: "size<=big", wantMessage: `invalid size "big"`},
+		{filter: "key*=a", wantMessage: `field "key" does not support operator "*="`},
+		{filter: "value=a", wantMessage: `field "value" does not support operator "="`},
+		{filter: "size~=1", wantMessage: `field "size" does not support operator "~="`},
+		{filter: "color=red", wantMessage: `unknown field "color"`},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			_, err := parseRecordFilter(tc.filter)
+			if err == nil {
+				t.Fatal("want error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.wantMessage) {
+				t.Errorf("want error mentioning %q, got %v", tc.wantMessage, err)
+			}
+		})
+	}
+}
+
+func TestRecordFilterMatches(t *testing.T) {
+	records := [][2]string{
+		{"logs/1", "x\x00y"},
+		{"users/alice", "admin,active"},
+		{"users/b?b", ""},
+		{"users/bob", "guest"},
+	}
+	for _, tc := range []struct {
+		filter   string
+		wantKeys []string
+	}{
+		{filter: "", wantKeys: []string{"logs/1", "users/alice", "users/b?b", "users/bob"}},
+		{filter: "  ", wantKeys: []string{"logs/1", "users/alice", "users/b?b", "users/bob"}},
+		{filter: "key=users/*", wantKeys: []string{"users/alice", "users/b?b", "users/bob"}},
+		{filter: "key=users/b?b", wantKeys: []string{"users/b?b", "users/bob"}},
+		{filter: `key=users/b\?b`, wantKeys: []string{"users/b?b"}},
+		{filter: "key=*/a*", wantKeys: []string{"users/alice"}},
+		{filter: "key=users/* key=*b", wantKeys: []string{"users/b?b", "users/bob"}},
+		{filter: "key=users", wantKeys: nil},
+		{filter: "value*=active", wantKeys: []string{"users/alice"}},
+		{filter: `value*="min,act"`, wantKeys: []string{"users/alice"}},
+		{filter: `value*="\x00"`, wantKeys: []string{"logs/1"}},
+		{filter: "value~=^g", wantKeys: []string{"users/bob"}},
+		{filter: "value~=a.*e value~=^a", wantKeys: []string{"users/alice"}},
+		{filter: "size=0", wantKeys: []string{"users/b?b"}},
+		{filter: "size<1", wantKeys: []string{"users/b?b"}},
+		{filter: "size<0", wantKeys: nil},
+		{filter: "size>5", wantKeys: []string{"users/alice"}},
+		{filter: "size>=5", wantKeys: []string{"users/alice", "users/bob"}},
+		{filter: "size>=3 size<=5", wantKeys: []string{"logs/1", "users/bob"}},
+		{filter: "size<=5 size<4", wantKeys: []string{"logs/1", "users/b?b"}},
+		{filter: "key=users/*\tsize>0\nvalue*=e", wantKeys: []string{"users/alice", "users/bob"}},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := parseRecordFilter(tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, r := range records {
+				if f.matches(idb.Key(r[0]), idb.Value(r[1])) {
+					keys = append(keys, r[0])
+				}
+			}
+			if !slices.Equal(tc.wantKeys, keys) {
+				t.Errorf("want keys %q, got %q", tc.wantKeys, keys)
+			}
+		})
+	}
+	var nilFilter *recordFilter
+	if !nilFilter.matches(idb.Key("k"), nil) {
+		t.Error("want nil filter to match every record")
+	}
+}
+
+func TestRecordFilterKeyPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   string
+	}{
+		{filter: "", want: ""},
+		{filter: "value*=x", want: ""},
+		{filter: "key=*", want: ""},
+		{filter: "key=users/*", want: "users/"},
+		{filter: "key=users/b?b", want: "users/b"},
+		{filter: `key=a\*b*`, want: "a*b"},
+		{filter: `key=a\`, want: "a"},
+		{filter: "key=ab* key=abc?", want: "abc"},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := parseRecordFilter(tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(f.keyPrefix()); got != tc.want {
+				t.Errorf("want prefix %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{pattern: "", s: "", want: true},
+		{pattern: "", s: "a", want: false},
+		{pattern: "*", s: "", want: true},
+		{pattern: "*", s: "anything", want: true},
+		{pattern: "a*", s: "a", want: true},
+		{pattern: "a*b", s: "ab", want: true},
+		{pattern: "a*b", s: "aXbYb", want: true},
+		{pattern: "a*b", s: "aXbY", want: false},
+		{pattern: "a*b*c", s: "aXbYc", want: true},
+		{pattern: "a?c", s: "abc", want: true},
+		{pattern: "a?c", s: "ac", want: false},
+		{pattern: `a\*`, s: "a*", want: true},
+		{pattern: `a\*`, s: "ab", want: false},
+		{pattern: `a\?`, s: "a?", want: true},
+		{pattern: `a\\`, s: `a\`, want: true},
+		{pattern: `a\`, s: `a\`, want: false},
+		{pattern: "**a", s: "ba", want: true},
+	} {
+		if got := globMatch([]byte(tc.pattern), []byte(tc.s)); got != tc.want {
+			t.Errorf("globMatch(%q, %q): want %t, got %t", tc.pattern, tc.s, tc.want, got)
+		}
+	}
+}
+
+func TestScanHandlerFilters(t *testing.T) {
+	server, fake := newTestServer(t)
+	ctx := context.Background()
+	for k, v := range map[string]string{"users/alice": "admin", "users/bob": "guest", "logs/1": "\xff"} {
+		if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.Insert(ctx, idb.Key(k), idb.Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		query      url.Values
+		wantStatus int
+		wantKeys   []string
+	}{
+		{query: url.Values{}, wantStatus: http.StatusOK, wantKeys: []string{"logs/1", "users/alice", "users/bob"}},
+		{query: url.Values{"filter": {"key=users/*"}}, wantStatus: http.StatusOK, wantKeys: []string{"users/alice", "users/bob"}},
+		{query: url.Values{"prefix": {"users/"}, "filter": {"value*=guest"}}, wantStatus: http.StatusOK, wantKeys: []string{"users/bob"}},
+		{query: url.Values{"prefix": {"logs/"}, "filter": {"key=users/*"}}, wantStatus: http.StatusOK},
+		{query: url.Values{"filter": {"size=1"}}, wantStatus: http.StatusOK, wantKeys: []string{"logs/1"}},
+		{query: url.Values{"filter": {"color=red"}}, wantStatus: http.StatusBadRequest},
+		{query: url.Values{"filter": {"value~=["}}, wantStatus: http.StatusBadRequest},
+		{query: url.Values{"filter": {"key"}}, wantStatus: http.StatusBadRequest},
+	} {
+		res, body := sendRequest(t, server, http.MethodGet, "/records/scan?"+tc.query.Encode(), nil)
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s: want status %d, got %d (%s)", tc.query.Encode(), tc.wantStatus, res.StatusCode, body)
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			continue
+		}
+		var records []scannedRecord
+		if err := json.Unmarshal([]byte(body), &records); err != nil {
+			t.Fatalf("%s: %v", tc.query.Encode(), err)
+		}
+		var keys []string
+		for _, r := range records {
+			if r.Key != nil {
+				keys = append(keys, *r.Key)
+			}
+		}
+		if !slices.Equal(tc.wantKeys, keys) {
+			t.Errorf("%s: want keys %q, got %q", tc.query.Encode(), tc.wantKeys, keys)
+		}
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	idb "sehlabs.com/db/internal/db"
 )
@@ -14,42 +20,279 @@ func speakPlainTextTo(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "text/plain")
 }
 
-// func speakJSONTo(w http.ResponseWriter) {
-// 	w.Header().Add("Content-Type", "application/json")
-// }
+func speakJSONTo(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+}
+
+// rejectMethod responds to a request that uses an HTTP method other than the given allowed ones.
+// With strict HTTP semantics, it responds with status code 405 (Method Not Allowed) and lists the
+// allowed methods in the "Allow" header, as RFC 9110 requires; otherwise, for compatibility with
+// existing clients, it responds with status code 400 (Bad Request).
+func rejectMethod(w http.ResponseWriter, req *http.Request, allowed ...string) {
+	status := http.StatusBadRequest
+	if strictHTTPSemantics {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		status = http.StatusMethodNotAllowed
+	}
+	respondWithProblem(w, status, "Request uses disallowed HTTP method %q", req.Method)
+}
+
+// respondWithSuccessfulDeletion responds to a request that deleted a resource, or ensured that it
+// doesn't exist. With strict HTTP semantics, it responds with status code 204 (No Content), as the
+// response has no body; otherwise it responds with status code 200 (OK).
+func respondWithSuccessfulDeletion(w http.ResponseWriter) {
+	if strictHTTPSemantics {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-func respondWithError(w http.ResponseWriter, err error) {
-	statusCode := http.StatusInternalServerError
-	if errors.Is(err, idb.ErrTransactionInConflict) {
-		statusCode = http.StatusConflict
+// setLocation identifies the resource that a request created via the "Location" header.
+func setLocation(w http.ResponseWriter, path string) {
+	w.Header().Set("Location", (&url.URL{Path: path}).EscapedPath())
+}
+
+// parseForm parses the request's HTTP form, responding with an error and returning false if it
+// can't do so.
+func parseForm(w http.ResponseWriter, req *http.Request) bool {
+	err := req.ParseForm()
+	if err == nil {
+		return true
 	}
-	speakPlainTextTo(w)
-	w.WriteHeader(statusCode)
-	fmt.Fprintln(w, err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithProblem(w, http.StatusRequestEntityTooLarge, "HTTP request body exceeds limit of %d bytes", tooLarge.Limit)
+		return false
+	}
+	respondWithProblem(w, http.StatusBadRequest, "Failed to parse HTTP form: %v", err)
+	return false
 }
 
 const pathPrefixSingleRecord = "/record/"
 
+// headerRecordVersion is the HTTP response header reporting the version of the record retrieved:
+// the ID of the transaction that committed that version.
+const headerRecordVersion = "X-Db-Record-Version"
+
+// headerRecordReads, headerRecordWrites, and headerRecordLastAccess are the HTTP response headers
+// reporting how transactions have used the record retrieved, if the database tracks that: the
+// number of reads, the number of committed writes, and the ID of a transaction that most recently
+// accessed the record.
+const (
+	headerRecordReads      = "X-Db-Record-Reads"
+	headerRecordWrites     = "X-Db-Record-Writes"
+	headerRecordLastAccess = "X-Db-Record-Last-Access-Tx"
+)
+
+// headerContentType is the HTTP request header specifying the media type of the value written to
+// a record, stored as the record's metadata. Reads report the stored media type in the
+// Content-Type response header.
+const headerContentType = "X-Db-Content-Type"
+
+// headerRecordTags is the HTTP header conveying the user-defined tags stored as a record's
+// metadata, encoded like a URL query string (e.g. "owner=alice&tier=gold").
+const headerRecordTags = "X-Db-Tags"
+
+// getRecordMetadata extracts the metadata to store along with a record's value from the request's
+// headers, responding with an error and returning false if it can't do so.
+func getRecordMetadata(w http.ResponseWriter, req *http.Request) (idb.Metadata, bool) {
+	m := idb.Metadata{
+		ContentType: req.Header.Get(headerContentType),
+	}
+	if header := req.Header.Get(headerRecordTags); len(header) > 0 {
+		tags, err := url.ParseQuery(header)
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid HTTP header %q value: %v", headerRecordTags, err)
+			return idb.Metadata{}, false
+		}
+		m.Tags = make(map[string]string, len(tags))
+		for name, values := range tags {
+			m.Tags[name] = values[len(values)-1]
+		}
+	}
+	return m, true
+}
+
+// setRecordMetadata reports the metadata stored along with a record's value in the response's
+// headers.
+func setRecordMetadata(w http.ResponseWriter, m idb.Metadata) {
+	if len(m.ContentType) > 0 {
+		w.Header().Set("Content-Type", m.ContentType)
+	}
+	if len(m.Tags) > 0 {
+		tags := make(url.Values, len(m.Tags))
+		for name, value := range m.Tags {
+			tags.Set(name, value)
+		}
+		w.Header().Set(headerRecordTags, tags.Encode())
+	}
+}
+
+// setRecordAccessStats reports how transactions have used a record in the response's headers, if
+// the database tracks that, in which case retrieving the record counts as at least one read.
+func setRecordAccessStats(w http.ResponseWriter, stats idb.RecordAccessStats) {
+	if stats.Reads == 0 {
+		return
+	}
+	h := w.Header()
+	h.Set(headerRecordReads, strconv.FormatUint(stats.Reads, 10))
+	h.Set(headerRecordWrites, strconv.FormatUint(stats.Writes, 10))
+	h.Set(headerRecordLastAccess, strconv.FormatUint(stats.LastAccess, 10))
+}
+
+// headerCommittedTransaction is the HTTP response header reporting the ID of the transaction that
+// committed a request's changes.
+const headerCommittedTransaction = "X-Db-Committed-Tx"
+
+// headerMinimumTransaction is the HTTP request header demanding that a read observe the changes
+// committed by at least the transaction with the given ID.
+const headerMinimumTransaction = "X-Db-Min-Tx"
+
+// awaitMinimumTransaction waits up to the given duration for the database to have committed the
+// transaction demanded by the request's headers, if any, responding with an error and returning
+// false if it can't do so.
+func awaitMinimumTransaction(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, timeout time.Duration) bool {
+	header := req.Header.Get(headerMinimumTransaction)
+	if len(header) == 0 {
+		return true
+	}
+	id, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid HTTP header %q value: %q", headerMinimumTransaction, header)
+		return false
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := db.WaitForCommittedTransaction(ctx, id); err != nil {
+		respondWithProblem(w, http.StatusServiceUnavailable, "Database has not yet committed transaction %d: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// Read consistency levels that a read request may demand via its "consistency" query parameter.
+const (
+	// readConsistencyStrong demands that a read observe every change committed before the request
+	// arrived.
+	readConsistencyStrong = "strong"
+	// readConsistencyEventual permits a read to observe a state that lags behind the latest
+	// committed changes.
+	readConsistencyEventual = "eventual"
+)
+
+// checkReadConsistency validates the consistency level that the request demands via its
+// "consistency" query parameter, if any, responding with an error and returning false if it's
+// not one that the server recognizes.
+//
+// TODO(seh): Once followers replicate the leader's records, forward strongly consistent reads to
+// the leader and serve eventually consistent reads from the local replica. Until then, every
+// server is its own leader, so reads at either level observe the latest committed changes.
+func checkReadConsistency(w http.ResponseWriter, query url.Values) bool {
+	const consistencyKey = "consistency"
+	if !query.Has(consistencyKey) {
+		return true
+	}
+	switch level := query.Get(consistencyKey); level {
+	case readConsistencyStrong, readConsistencyEventual:
+		return true
+	default:
+		respondWithProblem(w, http.StatusBadRequest, "Invalid URL query parameter %q value: %q", consistencyKey, level)
+		return false
+	}
+}
+
+// setCommittedTransaction reports the ID of the transaction that committed a request's changes, so
+// that the client can demand to observe them in later reads (see awaitMinimumTransaction).
+func setCommittedTransaction(w http.ResponseWriter, id uint64) {
+	w.Header().Set(headerCommittedTransaction, strconv.FormatUint(id, 10))
+}
+
+// getTargetKey extracts the record key from the request's URL path, after decoding any
+// percent-encoded characters. Note that this means that a percent-encoded slash ("%2F") and a
+// literal slash ("/") within the key are equivalent.
 func getTargetKey(w http.ResponseWriter, req *http.Request) (idb.Key, bool) {
 	key, ok := strings.CutPrefix(req.URL.Path, pathPrefixSingleRecord)
 	if ok && len(key) > 0 {
 		return idb.Key(key), true
 	}
-	speakPlainTextTo(w)
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintln(w, "URL path must contain a nonempty key")
+	respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty key")
 	return nil, false
 }
 
-func handleGet(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+// awaitRecordChange waits for the record with the given key to change since the transaction
+// identified in the request's "since-tx" query parameter, if the request's "wait" query parameter
+// demands it, for up to the given positive duration. It responds and returns false if the request
+// is malformed or the record doesn't change in time, responding in the latter case with no content,
+// as the request bore no validator that would justify responding that the record is not modified.
+func awaitRecordChange(ctx context.Context, w http.ResponseWriter, query url.Values, key idb.Key, db database, timeout time.Duration) bool {
+	const waitKey, sinceKey = "wait", "since-tx"
+	if !query.Has(waitKey) {
+		return true
+	}
+	wait, err := strconv.ParseBool(query.Get(waitKey))
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid URL query parameter %q value: %q", waitKey, query.Get(waitKey))
+		return false
+	}
+	if !wait {
+		return true
+	}
+	var since uint64
+	if query.Has(sinceKey) {
+		if since, err = strconv.ParseUint(query.Get(sinceKey), 10, 64); err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid URL query parameter %q value: %q", sinceKey, query.Get(sinceKey))
+			return false
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := db.WaitForRecordChange(ctx, key, since); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			respondWithError(w, err)
+		}
+		return false
+	}
+	return true
+}
+
+func handleGet(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, minTxWait, maxPollWait time.Duration) {
 	key, ok := getTargetKey(w, req)
 	if !ok {
 		return
 	}
+	query := req.URL.Query()
+	if !checkReadConsistency(w, query) {
+		return
+	}
+	if !awaitMinimumTransaction(ctx, w, req, db, minTxWait) {
+		return
+	}
+	if !awaitRecordChange(ctx, w, query, key, db, maxPollWait) {
+		return
+	}
+	pointer, hasPointer := query.Get("pointer"), query.Has("pointer")
+	if query.Has("versions") {
+		s := query.Get("versions")
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid version count %q", s)
+			return
+		}
+		if hasPointer {
+			respondWithProblem(w, http.StatusBadRequest, `Query parameters "versions" and "pointer" are mutually exclusive`)
+			return
+		}
+		respondWithRecordVersions(ctx, w, db, key, n)
+		return
+	}
 	var recordExists bool
-	var value idb.Value
+	var record idb.Record
 	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
-		v, err := tx.Get(ctx, key)
+		r, err := tx.GetRecord(ctx, key)
 		if errors.Is(err, idb.ErrRecordDoesNotExist) {
 			return false, nil
 		}
@@ -57,7 +300,10 @@ func handleGet(ctx context.Context, w http.ResponseWriter, req *http.Request, db
 			return false, err
 		}
 		recordExists = true
-		v.CopyInto(&value)
+		record = r
+		// The transaction's value may not outlive the transaction.
+		record.Value = nil
+		r.Value.CopyInto(&record.Value)
 		return false, nil
 	}); err != nil {
 		respondWithError(w, err)
@@ -66,52 +312,134 @@ func handleGet(ctx context.Context, w http.ResponseWriter, req *http.Request, db
 	if !recordExists {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
+		w.Header().Set(headerRecordVersion, strconv.FormatUint(record.Version, 10))
+		setRecordAccessStats(w, record.Access)
+		if hasPointer {
+			setRecordMetadata(w, idb.Metadata{Tags: record.Metadata.Tags})
+			respondWithJSONFragment(w, record.Value, pointer)
+			return
+		}
+		setRecordMetadata(w, record.Metadata)
+		if len(record.Metadata.ContentType) > 0 {
+			// Deliver the value verbatim in its declared media type.
+			w.Write(record.Value)
+			return
+		}
 		speakPlainTextTo(w)
-		if _, err := w.Write(value); err == nil {
+		if _, err := w.Write(record.Value); err == nil {
 			w.Write([]byte{'\n'})
 		}
 	}
 }
 
+type recordVersion struct {
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+	ValidAsOf   uint64  `json:"valid_as_of"`
+	ValidBefore uint64  `json:"valid_before,omitempty"`
+}
+
+// respondWithRecordVersions responds with up to the given number of the retained committed
+// versions of the record with the given key, from newest to oldest, along with the period for
+// which each was valid, or with status code 404 (Not Found) if no such versions remain.
+func respondWithRecordVersions(ctx context.Context, w http.ResponseWriter, db database, key idb.Key, n int) {
+	var versions []recordVersion
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		versions = nil
+		for v := range tx.Versions(ctx, key) {
+			// The transaction's values may not outlive the transaction, but converting them to
+			// strings copies them.
+			value, valueBase64 := textOrBase64(v.Value)
+			versions = append(versions, recordVersion{
+				Value:       value,
+				ValueBase64: valueBase64,
+				ValidAsOf:   v.ValidAsOf,
+				ValidBefore: v.ValidBefore,
+			})
+			if len(versions) == n {
+				break
+			}
+		}
+		return false, nil
+	}); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if len(versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(versions)
+}
+
 func handlePost(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
-	if err := req.ParseForm(); err != nil {
-		speakPlainTextTo(w)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to parse HTTP form: %v\n", err)
+	if !parseForm(w, req) {
 		return
 	}
 	key, ok := getTargetKey(w, req)
 	if !ok {
 		return
 	}
-	value := req.FormValue("value")
+	metadata, ok := getRecordMetadata(w, req)
+	if !ok {
+		return
+	}
+	leaseID, ok := getLease(w, req)
+	if !ok {
+		return
+	}
+	// Converting the form value already copies it, so let the store adopt that copy rather than
+	// copying it again.
+	value := idb.AdoptValueRef(idb.Value(req.FormValue("value")))
 	var recordExisted bool
+	var txID uint64
 	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
-		err := tx.Insert(ctx, key, idb.Value(value))
+		txID = tx.ID()
+		err := tx.InsertValueRef(ctx, key, value, metadata)
 		if errors.Is(err, idb.ErrRecordExists) {
 			recordExisted = true
 			return false, nil
 		}
+		if err == nil {
+			err = attachToLease(ctx, tx, key, leaseID)
+		}
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	}); err != nil {
 		respondWithError(w, err)
+		return
 	}
 	if recordExisted {
 		w.WriteHeader(http.StatusConflict)
 	} else {
+		setCommittedTransaction(w, txID)
+		setLocation(w, pathPrefixSingleRecord+string(key))
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
 func handlePut(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	if !parseForm(w, req) {
+		return
+	}
 	key, ok := getTargetKey(w, req)
 	if !ok {
 		return
 	}
-	value := req.FormValue("value")
+	metadata, ok := getRecordMetadata(w, req)
+	if !ok {
+		return
+	}
+	leaseID, ok := getLease(w, req)
+	if !ok {
+		return
+	}
+	// Converting the form value already copies it, so let the store adopt that copy rather than
+	// copying it again.
+	value := idb.AdoptValueRef(idb.Value(req.FormValue("value")))
 	type updatePolicy uint
 	const (
 		abortIfAbsent updatePolicy = iota
@@ -129,26 +457,35 @@ func handlePut(ctx context.Context, w http.ResponseWriter, req *http.Request, db
 		case "ignore":
 			policy = ignoreIfAbsent
 		default:
-			speakPlainTextTo(w)
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Unrecognized HTTP form key %q value: %q\n", formKey, ifAbsent)
+			respondWithProblem(w, http.StatusBadRequest, "Unrecognized HTTP form key %q value: %q", formKey, ifAbsent)
 			return
 		}
 	}
+	var txID uint64
 	if policy == insertIfAbsent {
 		if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
-			err := tx.Upsert(ctx, key, idb.Value(value))
-			return err != nil, err
+			txID = tx.ID()
+			err := tx.UpsertValueRef(ctx, key, value, metadata)
+			if err == nil {
+				err = attachToLease(ctx, tx, key, leaseID)
+			}
+			return err == nil, err
 		}); err != nil {
 			respondWithError(w, err)
+			return
 		}
+		setCommittedTransaction(w, txID)
 	} else {
 		var recordExisted bool
 		if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
-			err := tx.Update(ctx, key, idb.Value(value))
+			txID = tx.ID()
+			err := tx.UpdateValueRef(ctx, key, value, metadata)
 			if errors.Is(err, idb.ErrRecordDoesNotExist) {
 				return false, nil
 			}
+			if err == nil {
+				err = attachToLease(ctx, tx, key, leaseID)
+			}
 			if err != nil {
 				return false, err
 			}
@@ -156,14 +493,20 @@ func handlePut(ctx context.Context, w http.ResponseWriter, req *http.Request, db
 			return true, nil
 		}); err != nil {
 			respondWithError(w, err)
+			return
 		}
-		if !recordExisted && policy == abortIfAbsent {
+		if recordExisted {
+			setCommittedTransaction(w, txID)
+		} else if policy == abortIfAbsent {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	}
 }
 
 func handleDelete(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	if !parseForm(w, req) {
+		return
+	}
 	key, ok := getTargetKey(w, req)
 	if !ok {
 		return
@@ -184,15 +527,15 @@ func handleDelete(ctx context.Context, w http.ResponseWriter, req *http.Request,
 			// record with the given key does not exist, whether or not this request made it so.
 			policy = ignoreIfAbsent
 		default:
-			speakPlainTextTo(w)
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Unrecognized HTTP form key %q value: %q\n", formKey, ifAbsent)
+			respondWithProblem(w, http.StatusBadRequest, "Unrecognized HTTP form key %q value: %q", formKey, ifAbsent)
 			return
 		}
 	}
 	var recordExisted bool
+	var txID uint64
 	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
-		err, deleted := tx.Delete(ctx, key)
+		txID = tx.ID()
+		deleted, err := tx.Delete(ctx, key)
 		if err != nil {
 			return false, err
 		}
@@ -202,79 +545,385 @@ func handleDelete(ctx context.Context, w http.ResponseWriter, req *http.Request,
 		respondWithError(w, err)
 		return
 	}
-	if !recordExisted && policy == abortIfAbsent {
+	if recordExisted {
+		setCommittedTransaction(w, txID)
+	} else if policy == abortIfAbsent {
 		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	respondWithSuccessfulDeletion(w)
+}
+
+type keyPathEntry struct {
+	Key         string `json:"key"`
+	IsRecord    bool   `json:"record"`
+	HasChildren bool   `json:"children"`
+}
+
+// handleListChildren describes the immediate children of the key path given by the "path" query
+// parameter. Given the optional "limit" query parameter, it describes at most that many children,
+// reporting a cursor in the X-Db-Next-Cursor response header if more remain. Passing that cursor
+// in the "cursor" query parameter of a subsequent request describes the next children, resuming
+// after the last child that the previous page described and observing the database as it was when
+// the listing began.
+func handleListChildren(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, cursors *cursorSnapshots) {
+	query := req.URL.Query()
+	path := req.FormValue("path")
+	var limit int
+	if s := query.Get("limit"); len(s) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid listing limit %q", s)
+			return
+		}
+	}
+	var snapshot *idb.Snapshot
+	var after idb.Key
+	if s := query.Get("cursor"); len(s) > 0 {
+		cursor, err := parseListingCursor(s)
+		if err == nil {
+			snapshot, err = cursors.lookup(cursor.snapshotID)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errCursorExpired) {
+				status = http.StatusGone
+			}
+			respondWithProblem(w, status, "Invalid cursor: %v", err)
+			return
+		}
+		after = cursor.after
+	} else if limit > 0 {
+		var err error
+		if snapshot, err = cursors.pin(ctx, db); err != nil {
+			respondWithError(w, err)
+			return
+		}
+	}
+	// Ask for one more child than the page holds to learn whether more remain.
+	n := limit
+	if n > 0 {
+		n++
+	}
+	var entries []idb.KeyPathEntry
+	listChildren := func(ctx context.Context, tx idb.Transaction) error {
+		var err error
+		entries, err = tx.ListChildrenAfter(ctx, idb.Key(path), after, n)
+		return err
+	}
+	var err error
+	if snapshot != nil {
+		err = snapshot.WithinTransaction(ctx, listChildren)
+	} else {
+		err = db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return false, listChildren(ctx, tx)
+		})
+	}
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if snapshot != nil {
+		if limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+			w.Header().Set(headerNextCursor, listingCursor{
+				snapshotID: snapshot.ID(),
+				after:      entries[limit-1].Key,
+			}.String())
+		} else {
+			cursors.release(snapshot.ID())
+		}
+	}
+	response := make([]keyPathEntry, len(entries))
+	for i, e := range entries {
+		response[i] = keyPathEntry{
+			Key:         string(e.Key),
+			IsRecord:    e.IsRecord,
+			HasChildren: e.HasChildren,
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+// withRequestTimeout wraps the given handler to impose the given positive deadline on each
+// request's Context, bounding how long database operations may wait, such as to acquire locks.
+func withRequestTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// withRequestBodyLimit wraps the given handler to limit each request's body to the given positive
+// number of bytes.
+func withRequestBodyLimit(h http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, limit)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// mayChangeRecords reports whether the given client request uses a method that could change
+// records, other than an administrative request or an exchange of cluster membership heartbeats,
+// neither of which changes records.
+func mayChangeRecords(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return req.URL.Path != pathClusterGossip && !strings.HasPrefix(req.URL.Path, "/admin/")
+	default:
+		return false
+	}
+}
+
+// withReadOnlyAccess wraps the given handler to reject requests whose methods would change records,
+// for a database that refuses to write them, sparing clients from reading their request bodies
+// only to fail.
+func withReadOnlyAccess(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if mayChangeRecords(req) {
+			respondWithProblem(w, http.StatusForbidden, "Method %s is not allowed, as the database is read-only.", req.Method)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// requestIdentity describes the party on whose behalf the server handles the given request: the
+// subject's common name from the client's verified TLS certificate, if any, or otherwise the
+// client's network address.
+func requestIdentity(req *http.Request) string {
+	if cn := clientCertificateName(req); len(cn) > 0 {
+		return cn
+	}
+	return req.RemoteAddr
+}
+
+// clientCertificateName returns the subject's common name from the client's verified TLS
+// certificate, if any.
+func clientCertificateName(req *http.Request) string {
+	if tlsState := req.TLS; tlsState != nil {
+		if chains := tlsState.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			return chains[0][0].Subject.CommonName
+		}
+	}
+	return ""
+}
+
+// withRequestIdentity wraps the given handler to record each request's identity in its Context.
+func withRequestIdentity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(idb.ContextWithIdentity(req.Context(), requestIdentity(req))))
+	})
+}
+
+// isPermittedIdentity reports whether the given request comes from a client with one of the given
+// identities (see requestIdentity), matching a client identified by its network address by its IP
+// address alone, since its port varies from one connection to the next.
+func isPermittedIdentity(req *http.Request, permittedIdentities []string) bool {
+	identity := requestIdentity(req)
+	if slices.Contains(permittedIdentities, identity) {
+		return true
+	}
+	if len(clientCertificateName(req)) > 0 {
+		return false
 	}
+	host, _, err := net.SplitHostPort(identity)
+	return err == nil && slices.Contains(permittedIdentities, host)
 }
 
-func makeHandler(db database) http.Handler {
+// withPermittedIdentities wraps the given handler to reject requests from clients other than those
+// with the given identities (see isPermittedIdentity), naming the action they may not take.
+func withPermittedIdentities(h http.Handler, permittedIdentities []string, action string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isPermittedIdentity(req, permittedIdentities) {
+			respondWithProblem(w, http.StatusForbidden, "Client may not %s", action)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// headerTransactionPriority is the HTTP request header specifying the priority of the transactions
+// run on the request's behalf, as an integer, with higher priorities prevailing in conflicts.
+const headerTransactionPriority = "X-Db-Priority"
+
+// withTransactionPriority wraps the given handler to record each request's transaction priority, if
+// any, in its Context, responding with an error to requests specifying an invalid priority.
+func withTransactionPriority(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if header := req.Header.Get(headerTransactionPriority); len(header) > 0 {
+			priority, err := strconv.Atoi(header)
+			if err != nil {
+				respondWithProblem(w, http.StatusBadRequest, "Invalid HTTP header %q value: %v", headerTransactionPriority, err)
+				return
+			}
+			req = req.WithContext(idb.ContextWithTransactionPriority(req.Context(), priority))
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// queryParamDebug is the HTTP request query parameter with which a client requests diagnostic
+// detail, with the value debugTransactions requesting a journal of the request's transactions.
+const (
+	queryParamDebug   = "debug"
+	debugTransactions = "tx"
+)
+
+// journalingResponseWriter carries the journal of the transactions run on a request's behalf, so
+// that error responses can include it.
+type journalingResponseWriter struct {
+	http.ResponseWriter
+	journal *idb.TransactionJournal
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter.
+func (w *journalingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *journalingResponseWriter) journalEntries() []string {
+	entries := w.journal.Entries()
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = fmt.Sprint(e)
+	}
+	return lines
+}
+
+// withTransactionJournal wraps the given handler to journal the transactions run on behalf of
+// each request that asks for that via the "debug=tx" query parameter, including the journal in
+// error responses. Since journals reveal keys and transaction details beyond the request's own,
+// only the clients with the given identities (see requestIdentity) may request them.
+func withTransactionJournal(h http.Handler, permittedIdentities []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get(queryParamDebug) != debugTransactions {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if !slices.Contains(permittedIdentities, requestIdentity(req)) {
+			respondWithProblem(w, http.StatusForbidden, "Client may not request transaction journals")
+			return
+		}
+		ctx, journal := idb.ContextWithTransactionJournal(req.Context())
+		h.ServeHTTP(&journalingResponseWriter{ResponseWriter: w, journal: journal}, req.WithContext(ctx))
+	})
+}
+
+// parseFormBindings interprets the request's HTTP form as a set of records to ensure are either
+// bound to a value or absent, relating each key to its value, or nil for absent records. It
+// responds with an error and returns false if it can't do so.
+func parseFormBindings(w http.ResponseWriter, req *http.Request) (map[string]*idb.Value, bool) {
+	if !parseForm(w, req) {
+		return nil, false
+	}
+	absentFormEntries := req.Form["absent"]
+	boundFormEntries := req.Form["bound"]
+	bindings := make(map[string]*idb.Value, len(absentFormEntries)+len(boundFormEntries))
+	for _, k := range absentFormEntries {
+		if len(k) == 0 {
+			continue
+		}
+		bindings[k] = nil
+	}
+	for _, v := range boundFormEntries {
+		if len(v) < 3 {
+			continue
+		}
+		delim := v[:1]
+		if before, after, ok := strings.Cut(v[1:], delim); ok && len(before) > 0 {
+			if _, ok := bindings[before]; ok {
+				respondWithProblem(w, http.StatusBadRequest, "HTTP form requests ensuring key %q is both bound and absent", before)
+				return nil, false
+			}
+			value := idb.Value(after)
+			bindings[before] = &value
+		}
+	}
+	return bindings, true
+}
+
+// makeHandler creates the handler for client requests, waiting up to the given duration for reads
+// that demand observing a particular transaction's changes (or indefinitely, if the duration is
+// zero), up to the given positive duration for reads that wait for a record to change, and
+// retaining the snapshots of paginated listings for the given positive duration between requests.
+func makeHandler(db database, minTxWait, maxPollWait, cursorTimeout time.Duration) *http.ServeMux {
 	var mux http.ServeMux
+	cursors := &cursorSnapshots{timeout: cursorTimeout}
 	{
 		mux.Handle(pathPrefixSingleRecord,
 			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				switch req.Method {
 				case http.MethodGet:
-					handleGet(req.Context(), w, req, db)
+					handleGet(req.Context(), w, req, db, minTxWait, maxPollWait)
 				case http.MethodPost:
 					handlePost(req.Context(), w, req, db)
 				case http.MethodPut:
 					handlePut(req.Context(), w, req, db)
 				case http.MethodDelete:
 					handleDelete(req.Context(), w, req, db)
+				case http.MethodPatch:
+					handlePatch(req.Context(), w, req, db)
 				default:
-					speakPlainTextTo(w)
-					w.WriteHeader(http.StatusBadRequest)
-					fmt.Fprintf(w, "Request uses disallowed HTTP method %q\n", req.Method)
+					rejectMethod(w, req, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch)
 					return
 				}
 			}))
-		mux.Handle("/records/batch",
+		mux.Handle("/records/tree",
 			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				if req.Method != http.MethodPost {
-					speakPlainTextTo(w)
-					w.WriteHeader(http.StatusBadRequest)
-					fmt.Fprintf(w, "Request uses disallowed HTTP method %q\n", req.Method)
+				if req.Method != http.MethodGet {
+					rejectMethod(w, req, http.MethodGet)
 					return
 				}
-				if err := req.ParseForm(); err != nil {
-					speakPlainTextTo(w)
-					w.WriteHeader(http.StatusBadRequest)
-					fmt.Fprintf(w, "Failed to parse HTTP form: %v\n", err)
+				handleListChildren(req.Context(), w, req, db, cursors)
+			}))
+		mux.Handle("/records/scan",
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodGet {
+					rejectMethod(w, req, http.MethodGet)
 					return
 				}
-				absentFormEntries := req.Form["absent"]
-				boundFormEntries := req.Form["bound"]
-				bindings := make(map[string]*idb.Value, len(absentFormEntries)+len(boundFormEntries))
-				for _, k := range absentFormEntries {
-					if len(k) == 0 {
-						continue
-					}
-					bindings[k] = nil
+				handleScan(req.Context(), w, req, db)
+			}))
+		mux.Handle("/query",
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodGet {
+					rejectMethod(w, req, http.MethodGet)
+					return
 				}
-				for _, v := range boundFormEntries {
-					if len(v) < 3 {
-						continue
-					}
-					delim := v[:1]
-					if before, after, ok := strings.Cut(v[1:], delim); ok && len(before) > 0 {
-						if _, ok := bindings[before]; ok {
-							speakPlainTextTo(w)
-							w.WriteHeader(http.StatusBadRequest)
-							fmt.Fprintf(w, "HTTP form requests ensuring key %q is both bound and absent\n", before)
-							return
-						}
-						value := idb.Value(after)
-						bindings[before] = &value
-					}
+				handleQuery(req.Context(), w, req, db)
+			}))
+		mux.Handle("/records/txn",
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost {
+					rejectMethod(w, req, http.MethodPost)
+					return
 				}
-				if len(bindings) == 0 {
+				handleTxn(req.Context(), w, req, db)
+			}))
+		mux.Handle("/records/batch",
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost {
+					rejectMethod(w, req, http.MethodPost)
+					return
+				}
+				if isJSONRequest(req) {
+					handleBatchJSON(req.Context(), w, req, db)
 					return
 				}
+				bindings, ok := parseFormBindings(w, req)
+				if !ok || len(bindings) == 0 {
+					return
+				}
+				var txID uint64
 				if err := db.WithinTransaction(req.Context(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+					txID = tx.ID()
 					for key, value := range bindings {
 						var err error
 						if value == nil {
-							err, _ = tx.Delete(ctx, idb.Key(key))
+							_, err = tx.Delete(ctx, idb.Key(key))
 						} else {
 							err = tx.Upsert(ctx, idb.Key(key), *value)
 						}
@@ -285,7 +934,9 @@ func makeHandler(db database) http.Handler {
 					return true, nil
 				}); err != nil {
 					respondWithError(w, err)
+					return
 				}
+				setCommittedTransaction(w, txID)
 			}))
 	}
 	return &mux
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+	"sehlabs.com/db/internal/db/dbtest"
+)
+
+// newTestServer serves the client request handlers atop a fresh dbtest.Fake.
+func newTestServer(t *testing.T) (*httptest.Server, *dbtest.Fake) {
+	t.Helper()
+	fake, err := dbtest.NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(makeHandler(fake, 0, 0, time.Minute))
+	t.Cleanup(server.Close)
+	return server, fake
+}
+
+// sendRequest issues a request with the given method to the given path, carrying the given form
+// values, if any, in its body, returning the response with its body read.
+func sendRequest(t *testing.T, server *httptest.Server, method, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+// sendJSON issues a POST request to the given path carrying the given JSON document in its body,
+// returning the response with its body read.
+func sendJSON(t *testing.T, server *httptest.Server, path, body string) (*http.Response, string) {
+	t.Helper()
+	res, err := server.Client().Post(server.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+// storedValue reads the value of the record with the given key directly from the given store,
+// reporting whether the record exists.
+func storedValue(t *testing.T, store *idb.ShardedStore, k string) (string, bool) {
+	t.Helper()
+	var v idb.Value
+	err := store.WithinTransaction(context.Background(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		var err error
+		v, err = tx.Get(ctx, idb.Key(k))
+		return false, err
+	})
+	if errors.Is(err, idb.ErrRecordDoesNotExist) {
+		return "", false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(v), true
+}
+
+func TestRecordHandlers(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, step := range []struct {
+		method     string
+		path       string
+		form       url.Values
+		wantStatus int
+		wantBody   string
+		// wantCommit indicates whether the response should report a committed transaction.
+		wantCommit bool
+	}{
+		{method: http.MethodGet, path: "/record/k", wantStatus: http.StatusNotFound},
+		{method: http.MethodPut, path: "/record/k", form: url.Values{"value": {"v0"}}, wantStatus: http.StatusNotFound},
+		{method: http.MethodPost, path: "/record/k", form: url.Values{"value": {"v1"}}, wantStatus: http.StatusCreated, wantCommit: true},
+		{method: http.MethodPost, path: "/record/k", form: url.Values{"value": {"v2"}}, wantStatus: http.StatusConflict},
+		{method: http.MethodGet, path: "/record/k", wantStatus: http.StatusOK, wantBody: "v1\n"},
+		{method: http.MethodPut, path: "/record/k", form: url.Values{"value": {"v3"}}, wantStatus: http.StatusOK, wantCommit: true},
+		{method: http.MethodGet, path: "/record/k", wantStatus: http.StatusOK, wantBody: "v3\n"},
+		{method: http.MethodPut, path: "/record/j", form: url.Values{"value": {"v4"}, "if-absent": {"insert"}}, wantStatus: http.StatusOK, wantCommit: true},
+		{method: http.MethodGet, path: "/record/j", wantStatus: http.StatusOK, wantBody: "v4\n"},
+		{method: http.MethodDelete, path: "/record/k", wantStatus: http.StatusOK, wantCommit: true},
+		{method: http.MethodGet, path: "/record/k", wantStatus: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/record/k", wantStatus: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/record/k?if-absent=ignore", wantStatus: http.StatusOK},
+	} {
+		res, body := sendRequest(t, server, step.method, step.path, step.form)
+		if res.StatusCode != step.wantStatus {
+			t.Errorf("%s %s: want status %d, got %d (%s)", step.method, step.path, step.wantStatus, res.StatusCode, body)
+			continue
+		}
+		if len(step.wantBody) > 0 && body != step.wantBody {
+			t.Errorf("%s %s: want body %q, got %q", step.method, step.path, step.wantBody, body)
+		}
+		if got := len(res.Header.Get(headerCommittedTransaction)) > 0; got != step.wantCommit {
+			t.Errorf("%s %s: want committed transaction reported %t, got %t", step.method, step.path, step.wantCommit, got)
+		}
+	}
+}
+
+func TestRecordHandlersReportFaults(t *testing.T) {
+	server, fake := newTestServer(t)
+	if res, body := sendRequest(t, server, http.MethodPost, "/record/k", url.Values{"value": {"v"}}); res.StatusCode != http.StatusCreated {
+		t.Fatalf("want status %d creating record, got %d (%s)", http.StatusCreated, res.StatusCode, body)
+	}
+	for _, tc := range []struct {
+		name       string
+		fault      dbtest.Fault
+		method     string
+		form       url.Values
+		wantStatus int
+	}{
+		{
+			name:       "failed read",
+			fault:      dbtest.Fault{Operation: dbtest.Read, Key: idb.Key("k"), Err: errors.New("injected")},
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "conflicting write",
+			fault:      dbtest.Fault{Operation: dbtest.Write, Err: idb.ErrTransactionInConflict},
+			method:     http.MethodPut,
+			form:       url.Values{"value": {"w"}},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "failed commit",
+			fault:      dbtest.Fault{Operation: dbtest.Commit, Err: errors.New("injected")},
+			method:     http.MethodDelete,
+			wantStatus: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.Reset()
+			fake.Inject(tc.fault)
+			res, body := sendRequest(t, server, tc.method, "/record/k", tc.form)
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("want status %d, got %d (%s)", tc.wantStatus, res.StatusCode, body)
+			}
+		})
+	}
+	// The failed operations left the record intact.
+	fake.Reset()
+	if res, body := sendRequest(t, server, http.MethodGet, "/record/k", nil); body != "v\n" {
+		t.Errorf("want record to retain value %q, got status %d with body %q", "v", res.StatusCode, body)
+	}
+}
+
+func TestListChildrenPagination(t *testing.T) {
+	server, fake := newTestServer(t)
+	for _, k := range []string{"p/a", "p/b/x", "p/c", "p/d", "p/e"} {
+		if res, body := sendRequest(t, server, http.MethodPost, "/record/"+k, url.Values{"value": {"v"}}); res.StatusCode != http.StatusCreated {
+			t.Fatalf("want status %d creating record %q, got %d (%s)", http.StatusCreated, k, res.StatusCode, body)
+		}
+	}
+	var pages []string
+	path := "/records/tree?path=p&limit=2"
+	for {
+		res, body := sendRequest(t, server, http.MethodGet, path, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+		}
+		pages = append(pages, strings.TrimSpace(body))
+		cursor := res.Header.Get(headerNextCursor)
+		if len(cursor) == 0 {
+			break
+		}
+		if len(pages) == 1 {
+			// Later pages observe the records as they were when the listing began.
+			if err := fake.Store().WithinTransaction(context.Background(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+				return true, tx.Insert(ctx, idb.Key("p/bb"), idb.Value("v"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path = "/records/tree?path=p&limit=2&cursor=" + url.QueryEscape(cursor)
+	}
+	want := []string{
+		`[{"key":"p/a","record":true,"children":false},{"key":"p/b","record":false,"children":true}]`,
+		`[{"key":"p/c","record":true,"children":false},{"key":"p/d","record":true,"children":false}]`,
+		`[{"key":"p/e","record":true,"children":false}]`,
+	}
+	if !slices.Equal(pages, want) {
+		t.Errorf("want pages %q, got %q", want, pages)
+	}
+}
+
+func TestBatchHandlersReportCommittedTransaction(t *testing.T) {
+	server, _ := newTestServer(t)
+	res, body := sendRequest(t, server, http.MethodPost, "/records/batch", url.Values{"bound": {":a:1", ":b:2"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("form batch: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	formTx := res.Header.Get(headerCommittedTransaction)
+	if len(formTx) == 0 {
+		t.Fatal("form batch: want committed transaction reported")
+	}
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{path: "/records/batch", body: `[{"key":"c","op":"insert","value":"3"}]`},
+		{path: "/records/txn", body: `{"guards":[{"key":"a","equals":"1"}],"then":[{"key":"a","op":"update","value":"4"}]}`},
+	} {
+		res, body := sendJSON(t, server, tc.path, tc.body)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: want status %d, got %d (%s)", tc.path, http.StatusOK, res.StatusCode, body)
+			continue
+		}
+		if tx := res.Header.Get(headerCommittedTransaction); len(tx) == 0 || tx == formTx {
+			t.Errorf("%s: want a newly committed transaction reported, got %q", tc.path, tx)
+		}
+	}
+	// A read demanding the form batch's transaction observes its changes.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/record/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerMinimumTransaction, formTx)
+	res, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if b, _ := io.ReadAll(res.Body); res.StatusCode != http.StatusOK || string(b) != "2\n" {
+		t.Errorf("want record %q bound to %q, got status %d with body %q", "b", "2", res.StatusCode, b)
+	}
+}
+
+func TestAwaitRecordChange(t *testing.T) {
+	fake, err := dbtest.NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const maxPollWait = 50 * time.Millisecond
+	server := httptest.NewServer(makeHandler(fake, 0, maxPollWait, time.Minute))
+	t.Cleanup(server.Close)
+	res, body := sendRequest(t, server, http.MethodPost, "/record/k", url.Values{"value": {"v1"}})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("want status %d creating record, got %d (%s)", http.StatusCreated, res.StatusCode, body)
+	}
+	version := res.Header.Get(headerCommittedTransaction)
+
+	start := time.Now()
+	res, body = sendRequest(t, server, http.MethodGet, "/record/k?wait=true&since-tx="+version, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unchanged record: want status %d, got %d (%s)", http.StatusNoContent, res.StatusCode, body)
+	}
+	if len(body) > 0 {
+		t.Errorf("unchanged record: want empty body, got %q", body)
+	}
+	if elapsed := time.Since(start); elapsed < maxPollWait {
+		t.Errorf("unchanged record: want response after waiting at least %v, got one after %v", maxPollWait, elapsed)
+	}
+
+	if res, body := sendRequest(t, server, http.MethodPut, "/record/k", url.Values{"value": {"v2"}}); res.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d updating record, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	res, body = sendRequest(t, server, http.MethodGet, "/record/k?wait=true&since-tx="+version, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("changed record: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	if want := "v2\n"; body != want {
+		t.Errorf("changed record: want body %q, got %q", want, body)
+	}
+
+	for _, query := range []string{"wait=maybe", "wait=true&since-tx=-1"} {
+		if res, body := sendRequest(t, server, http.MethodGet, "/record/k?"+query, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: want status %d, got %d (%s)", query, http.StatusBadRequest, res.StatusCode, body)
+		}
+	}
+}
+
+// setStrictHTTPSemantics sets the value of the --strict-http-semantics flag until the test ends.
+func setStrictHTTPSemantics(t *testing.T, strict bool) {
+	t.Helper()
+	previous := strictHTTPSemantics
+	strictHTTPSemantics = strict
+	t.Cleanup(func() {
+		strictHTTPSemantics = previous
+	})
+}
+
+func TestStrictHTTPSemantics(t *testing.T) {
+	for _, tc := range []struct {
+		strict           bool
+		wantDeleteStatus int
+		wantRejectStatus int
+	}{
+		{strict: false, wantDeleteStatus: http.StatusOK, wantRejectStatus: http.StatusBadRequest},
+		{strict: true, wantDeleteStatus: http.StatusNoContent, wantRejectStatus: http.StatusMethodNotAllowed},
+	} {
+		t.Run(fmt.Sprintf("strict=%t", tc.strict), func(t *testing.T) {
+			setStrictHTTPSemantics(t, tc.strict)
+			store, err := idb.MakeShardedStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := makeHandler(store, 0, 0, time.Minute)
+			registerBucketHandlers(mux, store)
+			server := httptest.NewServer(mux)
+			t.Cleanup(server.Close)
+
+			bucketRecord := fmt.Sprintf(bucketRecordPathFormat, "b", "k")
+			for _, step := range []struct {
+				method string
+				path   string
+				form   url.Values
+				// deletes indicates whether the request should succeed in deleting a resource.
+				deletes bool
+			}{
+				{method: http.MethodPost, path: "/record/k", form: url.Values{"value": {"v"}}},
+				{method: http.MethodDelete, path: "/record/k", deletes: true},
+				{method: http.MethodDelete, path: "/record/k?if-absent=ignore", deletes: true},
+				{method: http.MethodPut, path: "/bucket/b"},
+				{method: http.MethodPost, path: bucketRecord, form: url.Values{"value": {"v"}}},
+				{method: http.MethodDelete, path: bucketRecord, deletes: true},
+				{method: http.MethodDelete, path: "/bucket/b", deletes: true},
+			} {
+				res, body := sendRequest(t, server, step.method, step.path, step.form)
+				if !step.deletes {
+					if res.StatusCode >= http.StatusMultipleChoices {
+						t.Fatalf("%s %s: want success, got status %d (%s)", step.method, step.path, res.StatusCode, body)
+					}
+					continue
+				}
+				if res.StatusCode != tc.wantDeleteStatus {
+					t.Errorf("%s %s: want status %d, got %d (%s)", step.method, step.path, tc.wantDeleteStatus, res.StatusCode, body)
+				}
+				if len(body) > 0 {
+					t.Errorf("%s %s: want empty body, got %q", step.method, step.path, body)
+				}
+			}
+			// Deleting a missing record still fails regardless.
+			if res, body := sendRequest(t, server, http.MethodDelete, "/record/k", nil); res.StatusCode != http.StatusNotFound {
+				t.Errorf("deleting missing record: want status %d, got %d (%s)", http.StatusNotFound, res.StatusCode, body)
+			}
+
+			for _, step := range []struct {
+				method    string
+				path      string
+				wantAllow string
+			}{
+				{method: http.MethodOptions, path: "/record/k", wantAllow: "GET, POST, PUT, DELETE, PATCH"},
+				{method: http.MethodPatch, path: "/records/scan", wantAllow: "GET"},
+				{method: http.MethodGet, path: "/records/batch", wantAllow: "POST"},
+				{method: http.MethodPost, path: "/bucket/b", wantAllow: "PUT, DELETE"},
+				{method: http.MethodPost, path: "/buckets", wantAllow: "GET"},
+			} {
+				res, body := sendRequest(t, server, step.method, step.path, nil)
+				if res.StatusCode != tc.wantRejectStatus {
+					t.Errorf("%s %s: want status %d, got %d (%s)", step.method, step.path, tc.wantRejectStatus, res.StatusCode, body)
+				}
+				wantAllow := step.wantAllow
+				if !tc.strict {
+					wantAllow = ""
+				}
+				if got := res.Header.Get("Allow"); got != wantAllow {
+					t.Errorf("%s %s: want Allow header %q, got %q", step.method, step.path, wantAllow, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+const pathPrefixLease = "/leases/"
+
+// headerLease is the HTTP request header identifying the lease to which to attach a record being
+// written.
+const headerLease = "X-Db-Lease"
+
+type leaser interface {
+	GrantLease(ttl time.Duration) (uint64, error)
+	KeepLeaseAlive(id uint64) error
+	RevokeLease(ctx context.Context, id uint64) error
+}
+
+type leaseResponse struct {
+	ID         uint64  `json:"id"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+}
+
+// getLease extracts the ID of the lease to which to attach a record being written from the
+// request's headers, responding with an error and returning false if it can't do so.
+func getLease(w http.ResponseWriter, req *http.Request) (id uint64, ok bool) {
+	header := req.Header.Get(headerLease)
+	if len(header) == 0 {
+		return 0, true
+	}
+	id, err := strconv.ParseUint(header, 10, 64)
+	if err != nil || id == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid HTTP header %q value: %q", headerLease, header)
+		return 0, false
+	}
+	return id, true
+}
+
+// attachToLease attaches the record with the given key to the lease with the given ID, if
+// nonzero.
+func attachToLease(ctx context.Context, tx idb.Transaction, k idb.Key, leaseID uint64) error {
+	if leaseID == 0 {
+		return nil
+	}
+	return tx.AttachToLease(ctx, k, leaseID)
+}
+
+func handleGrantLease(w http.ResponseWriter, req *http.Request, db leaser) {
+	if !parseForm(w, req) {
+		return
+	}
+	const formKey = "ttl"
+	ttl, err := time.ParseDuration(req.FormValue(formKey))
+	if err != nil || ttl <= 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must be a positive duration", formKey)
+		return
+	}
+	id, err := db.GrantLease(ttl)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	speakJSONTo(w)
+	setLocation(w, pathPrefixLease+strconv.FormatUint(id, 10))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(leaseResponse{
+		ID:         id,
+		TTLSeconds: ttl.Seconds(),
+	})
+}
+
+// handleLease keeps alive or revokes the lease identified in the URL path.
+func handleLease(w http.ResponseWriter, req *http.Request, db leaser) {
+	rest := strings.TrimPrefix(req.URL.Path, pathPrefixLease)
+	rest, keepAlive := strings.CutSuffix(rest, "/keepalive")
+	id, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid lease ID: %v", err)
+		return
+	}
+	switch {
+	case keepAlive && req.Method == http.MethodPost:
+		err = db.KeepLeaseAlive(id)
+	case !keepAlive && req.Method == http.MethodDelete:
+		err = db.RevokeLease(req.Context(), id)
+	case keepAlive:
+		rejectMethod(w, req, http.MethodPost)
+		return
+	default:
+		rejectMethod(w, req, http.MethodDelete)
+		return
+	}
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerLeaseHandlers installs the handlers for requests to grant, keep alive, and revoke
+// leases, to which clients may attach the records they write.
+func registerLeaseHandlers(mux *http.ServeMux, db leaser) {
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		handleGrantLease(w, req, db)
+	})
+	mux.HandleFunc(pathPrefixLease, func(w http.ResponseWriter, req *http.Request) {
+		handleLease(w, req, db)
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const pathPrefixLock = "/locks/"
+
+type locker interface {
+	AcquireLock(ctx context.Context, name, holder string, leaseID uint64) (bool, string, error)
+	ReleaseLock(ctx context.Context, name, holder string) (bool, error)
+	LockHolder(ctx context.Context, name string) (string, bool, error)
+}
+
+type lockResponse struct {
+	Acquired bool   `json:"acquired"`
+	Holder   string `json:"holder"`
+}
+
+// getLockHolder extracts the nonempty name of the party acquiring or releasing a lock from the
+// request's form, responding with an error and returning false if it can't do so.
+func getLockHolder(w http.ResponseWriter, req *http.Request) (string, bool) {
+	const formKey = "holder"
+	holder := req.FormValue(formKey)
+	if len(holder) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must be nonempty", formKey)
+		return "", false
+	}
+	return holder, true
+}
+
+func handleAcquireLock(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db locker) {
+	if !parseForm(w, req) {
+		return
+	}
+	holder, ok := getLockHolder(w, req)
+	if !ok {
+		return
+	}
+	const formKey = "lease"
+	leaseID, err := strconv.ParseUint(req.FormValue(formKey), 10, 64)
+	if err != nil || leaseID == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must identify a lease", formKey)
+		return
+	}
+	acquired, currentHolder, err := db.AcquireLock(ctx, name, holder, leaseID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	speakJSONTo(w)
+	if !acquired {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(lockResponse{
+		Acquired: acquired,
+		Holder:   currentHolder,
+	})
+}
+
+func handleReleaseLock(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db locker) {
+	if !parseForm(w, req) {
+		return
+	}
+	holder, ok := getLockHolder(w, req)
+	if !ok {
+		return
+	}
+	released, err := db.ReleaseLock(ctx, name, holder)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !released {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetLockHolder(ctx context.Context, w http.ResponseWriter, name string, db locker) {
+	holder, held, err := db.LockHolder(ctx, name)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !held {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(lockResponse{
+		Holder: holder,
+	})
+}
+
+// registerLockHandlers installs the handlers for requests to acquire, release, and inspect named
+// locks, with which application clusters can coordinate, such as by electing a leader.
+func registerLockHandlers(mux *http.ServeMux, db locker) {
+	mux.HandleFunc(pathPrefixLock, func(w http.ResponseWriter, req *http.Request) {
+		rest := strings.TrimPrefix(req.URL.Path, pathPrefixLock)
+		name, action, _ := strings.Cut(rest, "/")
+		if len(name) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty lock name")
+			return
+		}
+		switch action {
+		case "acquire":
+			if req.Method != http.MethodPost {
+				rejectMethod(w, req, http.MethodPost)
+				return
+			}
+			handleAcquireLock(req.Context(), w, req, name, db)
+		case "release":
+			if req.Method != http.MethodPost {
+				rejectMethod(w, req, http.MethodPost)
+				return
+			}
+			handleReleaseLock(req.Context(), w, req, name, db)
+		case "":
+			if req.Method != http.MethodGet {
+				rejectMethod(w, req, http.MethodGet)
+				return
+			}
+			handleGetLockHolder(req.Context(), w, name, db)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
+	"sehlabs.com/db/internal/cluster"
 	"sehlabs.com/db/internal/db"
 )
 
@@ -21,10 +25,80 @@ func fatal(code int, m string) {
 }
 
 var (
-	serverAddress      net.IP
-	serverPort         string
-	tlsCertificateFile string
-	tlsPrivateKeyFile  string
+	serverAddress             net.IP
+	serverPort                string
+	tlsCertificateFile        string
+	tlsPrivateKeyFile         string
+	adminServerAddress        net.IP
+	adminServerPort           string
+	adminTLSCertificateFile   string
+	adminTLSPrivateKeyFile    string
+	metricsServerAddress      net.IP
+	metricsServerPort         string
+	metricsTLSCertificateFile string
+	metricsTLSPrivateKeyFile  string
+	postgresServerAddress     net.IP
+	postgresServerPort        string
+	serveAdminUI              bool
+	auditLogFile              string
+	auditLogIncludesValues    bool
+	accessLogFile             string
+	accessLogFormatName       string
+	accessLogSampleRate       int
+	accessLogSlowThreshold    time.Duration
+	accessLogMaxBytes         int64
+	accessLogMaxBackups       int
+	valueSealingKeyFile       string
+	internValues              bool
+	trackRecordAccess         bool
+	evictionMaxRecords        int
+	evictionMaxBytes          int64
+	keysMustBeUTF8            bool
+	keyForbiddenCharacters    string
+	keyMaxDepth               int
+	keySeparator              string
+	jsonValuePrefixes         []string
+	finalizationStallLimit    time.Duration
+	abandonStalledFinalizing  bool
+	strictHTTPSemantics       bool
+	maxTransactionAttempts    int
+	conflictPolicyName        string
+	maxConflictWait           time.Duration
+	maxPendingWrites          int
+	maxValueSize              int
+	conflictSampleRate        int
+	sequenceBatchSize         int
+	topicRetention            int
+	trashRetention            time.Duration
+	maxVersionsPerRecord      int
+	asynchronousFinalization  bool
+	cancellationPolicyName    string
+	cancellationGracePeriod   time.Duration
+	perKeyWriteRate           float64
+	perKeyWriteBurst          int
+	delayExcessWrites         bool
+	chaosConfigFile           string
+	seedFile                  string
+	readOnly                  bool
+	consistentHashShards      int
+	consistentHashNodes       int
+	mode                      string
+	backends                  []string
+	preparedBatchTimeout      time.Duration
+	clusterAdvertiseURL       string
+	clusterPeers              []string
+	clusterGossipInterval     time.Duration
+	clusterSuspicionTimeout   time.Duration
+	clusterFailureTimeout     time.Duration
+	requestTimeout            time.Duration
+	maxRequestBytes           int64
+	minTxWait                 time.Duration
+	maxPollWait               time.Duration
+	cursorTimeout             time.Duration
+	debugTxIdentities         []string
+	adminIdentities           []string
+	allowScripts              bool
+	scriptMaxSteps            int
 )
 
 func fatalf(code int, format string, a ...interface{}) {
@@ -46,6 +120,249 @@ containing certificates for this server, any intermediate CAs, and the CA`)
 	flag.StringVar(&tlsPrivateKeyFile, "tls-private-key-file", "",
 		`File containing the X.509 private key for the first X.509 certificate
 in --tls-cert-file`)
+	flag.IPVar(&adminServerAddress, "admin-server-address", nil,
+		`IP address on which to serve administrative HTTP requests`)
+	flag.StringVar(&adminServerPort, "admin-server-port", "",
+		`Port on which to serve administrative HTTP requests, which the
+server never serves alongside client requests (default: don't serve them)`)
+	flag.StringVar(&adminTLSCertificateFile, "admin-tls-cert-file", "",
+		`File containing the X.509 certificates with which to serve
+administrative requests over HTTPS`)
+	flag.StringVar(&adminTLSPrivateKeyFile, "admin-tls-private-key-file", "",
+		`File containing the X.509 private key for the first X.509 certificate
+in --admin-tls-cert-file`)
+	flag.IPVar(&metricsServerAddress, "metrics-server-address", nil,
+		`IP address on which to serve metrics requests`)
+	flag.StringVar(&metricsServerPort, "metrics-server-port", "",
+		`Port on which to serve metrics requests separately
+(default: serve them alongside administrative requests, if any)`)
+	flag.StringVar(&metricsTLSCertificateFile, "metrics-tls-cert-file", "",
+		`File containing the X.509 certificates with which to serve
+metrics requests over HTTPS`)
+	flag.StringVar(&metricsTLSPrivateKeyFile, "metrics-tls-private-key-file", "",
+		`File containing the X.509 private key for the first X.509 certificate
+in --metrics-tls-cert-file`)
+	flag.BoolVar(&serveAdminUI, "admin-ui", false,
+		`Whether to serve a web UI for browsing and editing records at /ui
+among administrative requests`)
+	flag.IPVar(&postgresServerAddress, "postgres-server-address", nil,
+		`IP address on which to serve read-only queries from PostgreSQL
+clients`)
+	flag.StringVar(&postgresServerPort, "postgres-server-port", "",
+		`Port on which to serve read-only queries from PostgreSQL clients
+(default: don't serve them)`)
+	flag.StringVar(&auditLogFile, "audit-log-file", "",
+		`File to which to append a record of every attempt to mutate the database`)
+	flag.BoolVar(&auditLogIncludesValues, "audit-log-include-values", false,
+		`Whether to include proposed record values in the audit log`)
+	flag.StringVar(&accessLogFile, "access-log-file", "",
+		`File to which to append a record of client requests, or "-" to write
+them to standard output (default: don't record requests)`)
+	flag.StringVar(&accessLogFormatName, "access-log-format", "combined",
+		`Format of the access log: "common", "combined", or "json"`)
+	flag.IntVar(&accessLogSampleRate, "access-log-sample-rate", 1,
+		`Record one of every this many client requests in the access log`)
+	flag.DurationVar(&accessLogSlowThreshold, "access-log-slow-threshold", 0,
+		`Record every client request that takes at least this long to handle
+in the access log, regardless of sampling (0 disables)`)
+	flag.Int64Var(&accessLogMaxBytes, "access-log-max-bytes", 0,
+		`Size in bytes beyond which to rotate the access log file
+(0 means unlimited)`)
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 5,
+		`Number of rotated access log files to retain`)
+	flag.StringVar(&valueSealingKeyFile, "value-sealing-key-file", "",
+		`File containing a hex-encoded AES key (16, 24, or 32 bytes long)
+with which to encrypt record values held in memory`)
+	flag.BoolVar(&internValues, "intern-values", false,
+		`Whether to share memory among records holding identical values
+(incompatible with --value-sealing-key-file)`)
+	flag.BoolVar(&trackRecordAccess, "track-record-access", false,
+		`Whether to count each record's reads and writes, reporting them
+when reading the record`)
+	flag.IntVar(&evictionMaxRecords, "eviction-max-records", 0,
+		`Number of records beyond which to evict the least recently used
+records, acting as a cache (0 means unlimited)`)
+	flag.Int64Var(&evictionMaxBytes, "eviction-max-bytes", 0,
+		`Approximate size in bytes of record keys and values beyond which to
+evict the least recently used records, acting as a cache (0 means
+unlimited)`)
+	flag.BoolVar(&keysMustBeUTF8, "key-require-utf8", false,
+		`Whether to reject writing records with keys that are not valid UTF-8`)
+	flag.StringVar(&keyForbiddenCharacters, "key-forbidden-characters", "",
+		`Characters that must not appear in the keys of records being written`)
+	flag.IntVar(&keyMaxDepth, "key-max-depth", 0,
+		`Maximum number of segments delimited by --key-separator allowed in
+the keys of records being written (0 means unlimited)`)
+	flag.StringVar(&keySeparator, "key-separator", db.DefaultKeySeparator,
+		`Separator between segments of hierarchical keys`)
+	flag.StringSliceVar(&jsonValuePrefixes, "value-require-json-prefix", nil,
+		`Key prefixes of records whose values must be well-formed JSON
+documents, rejecting writes of other values (an empty prefix matches
+every key)`)
+	flag.DurationVar(&finalizationStallLimit, "finalization-stall-threshold", 0,
+		`Duration after which to report a transaction stalled finalizing its
+changes (0 means never)`)
+	flag.BoolVar(&abandonStalledFinalizing, "abandon-stalled-finalization", false,
+		`Whether to give up on finalizing stalled transactions, failing the
+database as a result (requires --finalization-stall-threshold)`)
+	flag.BoolVar(&strictHTTPSemantics, "strict-http-semantics", false,
+		`Whether to respond with the HTTP status codes and headers that RFC 9110
+prescribes, such as 405 for disallowed methods and 204 for deletions,
+rather than those that earlier versions of the server used`)
+	flag.IntVar(&maxTransactionAttempts, "max-transaction-attempts", 1,
+		`Maximum number of times to attempt each transaction that conflicts
+with other transactions`)
+	flag.StringVar(&conflictPolicyName, "conflict-policy", "preempt",
+		`How a transaction proceeds upon conflicting with another over a record:
+"preempt", "first-writer-wins", "wound-wait", or "wait-die"`)
+	flag.DurationVar(&maxConflictWait, "max-conflict-wait", 100*time.Millisecond,
+		`Maximum duration for which a write may wait for a conflicting
+transaction to conclude under the "wound-wait" and "wait-die"
+conflict policies`)
+	flag.IntVar(&maxPendingWrites, "max-pending-writes-per-transaction", 0,
+		`Maximum number of distinct records that each transaction may write
+(0 means unlimited)`)
+	flag.IntVar(&maxValueSize, "max-value-size", 0,
+		`Maximum number of bytes in each record's value (0 means unlimited)`)
+	flag.IntVar(&conflictSampleRate, "conflict-sample-rate", 0,
+		`Track the record keys most often involved in transaction conflicts,
+sampling one of every this many conflicts (0 disables tracking)`)
+	flag.IntVar(&sequenceBatchSize, "sequence-batch-size", 100,
+		`Number of values to reserve at once for each sequence`)
+	flag.IntVar(&topicRetention, "topic-retention", 1000,
+		`Number of the most recent messages that each topic retains for
+its subscribers`)
+	flag.IntVar(&maxVersionsPerRecord, "max-versions-per-record", 0,
+		`Maximum number of versions to retain for each record once no
+transaction can still observe the older versions, or zero to retain
+them all`)
+	flag.BoolVar(&asynchronousFinalization, "asynchronous-finalization", false,
+		`Respond to writes once their changes are visible, concluding the
+bookkeeping for each committed transaction in the background`)
+	flag.StringVar(&cancellationPolicyName, "cancellation-policy", "finish",
+		`Whether a transaction commits its changes when its request is cancelled
+by the time it asks to commit them: "finish", "abort", or "grace"`)
+	flag.DurationVar(&cancellationGracePeriod, "cancellation-grace-period", time.Second,
+		`Duration for which a transaction may keep committing its changes after
+its request is cancelled under the "grace" cancellation policy`)
+	flag.DurationVar(&trashRetention, "trash-retention", 0,
+		`Duration for which to retain deleted records in the trash, from which
+administrators may restore them (0 disables the trash)`)
+	flag.Float64Var(&perKeyWriteRate, "per-key-write-rate", 0,
+		`Average number of writes per second to allow to each record, protecting
+against hot keys (0 means unlimited)`)
+	flag.IntVar(&perKeyWriteBurst, "per-key-write-burst", 10,
+		`Number of writes to allow to each record in a burst beyond
+--per-key-write-rate`)
+	flag.BoolVar(&delayExcessWrites, "delay-excess-writes", false,
+		`Whether to delay writes exceeding --per-key-write-rate until the rate
+allows them, rather than rejecting them`)
+	flag.StringVar(&seedFile, "seed-file", "",
+		`File containing a JSON document describing records to insert at
+startup if the database is empty`)
+	flag.BoolVar(&readOnly, "read-only", false,
+		`Whether to refuse all writes to the database, rejecting client
+requests to change records with status 403 (Forbidden), such as for a
+replica, maintenance window, or forensic snapshot, after applying any
+--seed-file`)
+	flag.StringVar(&chaosConfigFile, "chaos-config", "",
+		`File containing a JSON document describing faults to inject into
+transactions, for testing how clients cope with them (never use this
+in production)`)
+	flag.IntVar(&consistentHashShards, "consistent-hash-shards", 0,
+		`Number of shards among which to distribute records by consistent
+hashing (0 uses the default projection across all shards)`)
+	flag.IntVar(&consistentHashNodes, "consistent-hash-virtual-nodes", 100,
+		`Number of virtual nodes to place on the consistent hash ring for
+each shard, or for each backend in router mode`)
+	flag.StringVar(&mode, "mode", "server",
+		`Whether to hold records ("server") or to forward requests to the
+backends that hold them ("router")`)
+	flag.StringSliceVar(&backends, "backends", nil,
+		`Base URLs of the servers among which to partition records in router
+mode, listed in the same order for every router`)
+	flag.DurationVar(&preparedBatchTimeout, "prepared-batch-timeout", 30*time.Second,
+		`Maximum duration for which to hold a prepared batch open awaiting
+its router's decision to commit or abort it`)
+	flag.StringVar(&clusterAdvertiseURL, "cluster-advertise-url", "",
+		`Base URL at which peers in the cluster can reach this server, enabling
+cluster membership tracking (default: don't track membership)`)
+	flag.StringSliceVar(&clusterPeers, "cluster-peers", nil,
+		`Base URLs of other servers in the cluster known at startup`)
+	flag.DurationVar(&clusterGossipInterval, "cluster-gossip-interval", 0,
+		`Interval at which to exchange heartbeats with a peer in the cluster,
+discovering other peers and detecting their failure (0 disables gossip)`)
+	flag.DurationVar(&clusterSuspicionTimeout, "cluster-suspicion-timeout", 5*time.Second,
+		`Duration without news of a peer's heartbeat after which to suspect
+that the peer has failed`)
+	flag.DurationVar(&clusterFailureTimeout, "cluster-failure-timeout", 30*time.Second,
+		`Duration without news of a peer's heartbeat after which to conclude
+that the peer has failed`)
+	flag.DurationVar(&requestTimeout, "request-timeout", 0,
+		`Maximum duration to spend on the database operations for each client
+request (0 means unlimited)`)
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", 0,
+		`Maximum size in bytes of each client request's body (0 means
+unlimited)`)
+	flag.DurationVar(&minTxWait, "min-tx-wait", time.Second,
+		`Maximum duration to wait for the database to commit the transaction
+demanded by a read request's X-Db-Min-Tx header (0 means unlimited)`)
+	flag.DurationVar(&maxPollWait, "max-poll-wait", 30*time.Second,
+		`Maximum duration to wait for a record to change for a read request
+that asks to wait for such a change`)
+	flag.DurationVar(&cursorTimeout, "cursor-timeout", 5*time.Minute,
+		`Duration for which to retain the snapshot observed by a paginated
+listing after the last request for one of its pages`)
+	flag.StringSliceVar(&debugTxIdentities, "debug-tx-identities", nil,
+		`Identities of clients permitted to request transaction journals via
+the "debug=tx" query parameter`)
+	flag.StringSliceVar(&adminIdentities, "admin-identities", nil,
+		`Identities or IP addresses of clients permitted to abort transactions
+and use the admin web UI via the administrative listener`)
+	flag.BoolVar(&allowScripts, "allow-scripts", false,
+		`Whether to accept scripts from clients to run within transactions`)
+	flag.IntVar(&scriptMaxSteps, "script-max-steps", 10000,
+		`Maximum number of expressions each client script may evaluate`)
+}
+
+func parseConflictPolicy(s string) (db.ConflictPolicy, error) {
+	switch s {
+	case "preempt":
+		return db.PreemptConflicting, nil
+	case "first-writer-wins":
+		return db.FirstWriterWins, nil
+	case "wound-wait":
+		return db.WoundWait, nil
+	case "wait-die":
+		return db.WaitDie, nil
+	default:
+		return 0, fmt.Errorf(`conflict policy must be "preempt", "first-writer-wins", "wound-wait", or "wait-die", not %q`, s)
+	}
+}
+
+func parseCancellationPolicy(s string) (db.CancellationPolicy, error) {
+	switch s {
+	case "finish":
+		return db.FinishCommitting, nil
+	case "abort":
+		return db.AbortCancelled, nil
+	case "grace":
+		return db.FinishWithinGracePeriod, nil
+	default:
+		return 0, fmt.Errorf(`cancellation policy must be "finish", "abort", or "grace", not %q`, s)
+	}
+}
+
+func readValueSealingKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hex-encoded key: %w", err)
+	}
+	return key, nil
 }
 
 type tlsConfig struct {
@@ -62,6 +379,33 @@ func joinIPAddressAndPort(address net.IP, port string) string {
 	return net.JoinHostPort(host, port)
 }
 
+// makeTLSConfig interprets the pair of file paths supplied via the named command-line flags,
+// requiring that either both or neither be specified.
+func makeTLSConfig(certificateFile, privateKeyFile, certificateFlag, privateKeyFlag string) *tlsConfig {
+	if len(certificateFile) > 0 {
+		if len(privateKeyFile) == 0 {
+			fatalf(2, "--%s must be nonempty when --%s is specified", privateKeyFlag, certificateFlag)
+		}
+		return &tlsConfig{
+			certificateFilePath: certificateFile,
+			privateKeyFilePath:  privateKeyFile,
+		}
+	} else if len(privateKeyFile) > 0 {
+		fatalf(2, "--%s must be nonempty when --%s is specified", certificateFlag, privateKeyFlag)
+	}
+	return nil
+}
+
+// listenerConfig describes a network endpoint on which to serve HTTP requests in a particular
+// role, such as serving client requests or administrative requests.
+type listenerConfig struct {
+	role    string
+	address net.IP
+	port    string
+	tls     *tlsConfig
+	handler http.Handler
+}
+
 func runHTTPServer(address net.IP, port string, tlsConf *tlsConfig, handler http.Handler, stop <-chan struct{}) error {
 	server := &http.Server{
 		Addr:    joinIPAddressAndPort(address, port),
@@ -90,23 +434,96 @@ func runHTTPServer(address net.IP, port string, tlsConf *tlsConfig, handler http
 	return nil
 }
 
+// runHTTPServers serves HTTP requests on each of the given listeners until either the stop channel
+// closes or any of the servers fails, in which case it stops the others as well.
+func runHTTPServers(listeners []listenerConfig, stop <-chan struct{}) error {
+	stopAll := make(chan struct{})
+	var stopOnce sync.Once
+	errs := make(chan error, len(listeners))
+	var wg sync.WaitGroup
+	wg.Add(len(listeners))
+	for _, l := range listeners {
+		go func(l listenerConfig) {
+			defer wg.Done()
+			if err := runHTTPServer(l.address, l.port, l.tls, withRequestIdentity(l.handler), stopAll); err != nil {
+				errs <- fmt.Errorf("%s HTTP server failed: %w", l.role, err)
+				stopOnce.Do(func() { close(stopAll) })
+			}
+		}(l)
+	}
+	go func() {
+		select {
+		case <-stop:
+			stopOnce.Do(func() { close(stopAll) })
+		case <-stopAll:
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// makeStoreHandler assembles the handlers for client requests against the given store.
+func makeStoreHandler(store *db.ShardedStore) *http.ServeMux {
+	mux := makeHandler(store, minTxWait, maxPollWait, cursorTimeout)
+	registerProcedureHandlers(mux, store)
+	registerLeaseHandlers(mux, store)
+	registerLockHandlers(mux, store)
+	registerSequenceHandlers(mux, store)
+	registerQueueHandlers(mux, store)
+	registerTopicHandlers(mux, store)
+	registerBucketHandlers(mux, store)
+	registerPreparedBatchHandlers(mux, store, preparedBatchTimeout)
+	if allowScripts {
+		registerScriptHandlers(mux, store, scriptMaxSteps)
+	}
+	return mux
+}
+
+// makeAdminHandler assembles the handlers for administrative requests, covering the given store,
+// if any (being nil in router mode), along with its consistent hash ring and cluster membership,
+// if any, with the admin web UI reaching the given handler for client requests.
+func makeAdminHandler(store *db.ShardedStore, ring *db.ConsistentHashRing, maintenance *maintenanceMode, clientHandler http.Handler, membership *cluster.Membership) *http.ServeMux {
+	mux := http.NewServeMux()
+	registerMaintenanceHandlers(mux, maintenance)
+	if store != nil {
+		registerAdminHandlers(mux, store, adminIdentities)
+		registerExportHandlers(mux, store)
+		registerChangeFeedHandlers(mux, store)
+		if trashRetention > 0 {
+			registerTrashHandlers(mux, store)
+		}
+		if ring != nil {
+			registerShardOwnershipHandlers(mux, ring)
+		}
+		if serveAdminUI {
+			registerAdminUIHandlers(mux, clientHandler, store, adminIdentities)
+		}
+	}
+	if membership != nil {
+		registerClusterHandlers(mux, membership)
+	}
+	return mux
+}
+
 func main() {
 	flag.Parse()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	var serverTLSConfig *tlsConfig
-	if len(tlsCertificateFile) > 0 {
-		if len(tlsPrivateKeyFile) == 0 {
-			fatal(2, "--tls-private-key-file must be nonempty when --tls-cert-file is specified")
+	serverTLSConfig := makeTLSConfig(tlsCertificateFile, tlsPrivateKeyFile, "tls-cert-file", "tls-private-key-file")
+	adminTLSConfig := makeTLSConfig(adminTLSCertificateFile, adminTLSPrivateKeyFile, "admin-tls-cert-file", "admin-tls-private-key-file")
+	metricsTLSConfig := makeTLSConfig(metricsTLSCertificateFile, metricsTLSPrivateKeyFile, "metrics-tls-cert-file", "metrics-tls-private-key-file")
+	if len(adminServerPort) == 0 {
+		if adminServerAddress != nil || adminTLSConfig != nil {
+			fatal(2, "--admin-server-port must be nonempty when serving administrative requests separately")
 		}
-		serverTLSConfig = &tlsConfig{
-			certificateFilePath: tlsCertificateFile,
-			privateKeyFilePath:  tlsPrivateKeyFile,
+	}
+	if len(metricsServerPort) == 0 {
+		if metricsServerAddress != nil || metricsTLSConfig != nil {
+			fatal(2, "--metrics-server-port must be nonempty when serving metrics requests separately")
 		}
-	} else if len(tlsPrivateKeyFile) > 0 {
-		fatal(2, "--tls-cert-file must be nonempty when --tls-private-key-file is specified")
 	}
 
 	if len(serverPort) == 0 {
@@ -116,13 +533,349 @@ func main() {
 			serverPort = "80"
 		}
 	}
-	// TODO(seh): Wrap with OpenTelemetry instrumentation.
-	store, err := db.MakeShardedStore()
-	if err != nil {
-		fatalf(1, "Failed to create database: %v", err)
+	var store *db.ShardedStore
+	var ring *db.ConsistentHashRing
+	var clientMux *http.ServeMux
+	switch mode {
+	case "router":
+		r, err := newRouter(backends, consistentHashNodes)
+		if err != nil {
+			fatalf(2, "Invalid router configuration: %v", err)
+		}
+		clientMux = makeRouterHandler(r)
+	case "server":
+		if len(backends) > 0 {
+			fatal(2, "--backends requires --mode=router")
+		}
+		// TODO(seh): Wrap with OpenTelemetry instrumentation.
+		var storeOptions []db.ShardedStoreOption
+		if len(auditLogFile) > 0 {
+			auditor, err := openFileAuditor(auditLogFile)
+			if err != nil {
+				fatalf(1, "Failed to open audit log file: %v", err)
+			}
+			defer auditor.Close()
+			storeOptions = append(storeOptions, db.WithAuditor(auditor, !auditLogIncludesValues))
+		}
+		if len(valueSealingKeyFile) > 0 {
+			key, err := readValueSealingKey(valueSealingKeyFile)
+			if err != nil {
+				fatalf(1, "Failed to read value sealing key: %v", err)
+			}
+			storeOptions = append(storeOptions, db.WithValueSealing(key))
+			if internValues {
+				fatal(2, "--intern-values is incompatible with --value-sealing-key-file")
+			}
+		}
+		if internValues {
+			storeOptions = append(storeOptions, db.WithValueInterning())
+		}
+		if trackRecordAccess {
+			storeOptions = append(storeOptions, db.WithRecordAccessStats())
+		}
+		if evictionMaxRecords < 0 {
+			fatal(2, "--eviction-max-records must be nonnegative")
+		}
+		if evictionMaxBytes < 0 {
+			fatal(2, "--eviction-max-bytes must be nonnegative")
+		}
+		if evictionMaxRecords > 0 || evictionMaxBytes > 0 {
+			storeOptions = append(storeOptions, db.WithEviction(db.LRU, db.EvictionLimits{
+				MaxRecords: evictionMaxRecords,
+				MaxBytes:   evictionMaxBytes,
+			}))
+		}
+		if len(keySeparator) == 0 {
+			fatal(2, "--key-separator must be nonempty")
+		}
+		storeOptions = append(storeOptions, db.WithKeySeparator(keySeparator))
+		if keysMustBeUTF8 {
+			storeOptions = append(storeOptions, db.WithKeyValidator(db.KeyMustBeUTF8))
+		}
+		if len(keyForbiddenCharacters) > 0 {
+			storeOptions = append(storeOptions, db.WithKeyValidator(db.KeyMustNotContain(keyForbiddenCharacters)))
+		}
+		if keyMaxDepth < 0 {
+			fatal(2, "--key-max-depth must be nonnegative")
+		} else if keyMaxDepth > 0 {
+			storeOptions = append(storeOptions, db.WithKeyValidator(db.KeyMaxDepth(keySeparator, keyMaxDepth)))
+		}
+		for _, prefix := range jsonValuePrefixes {
+			storeOptions = append(storeOptions, db.WithValueValidator(db.Key(prefix), db.ValueMustBeJSON))
+		}
+		if finalizationStallLimit < 0 {
+			fatal(2, "--finalization-stall-threshold must be nonnegative")
+		} else if finalizationStallLimit > 0 {
+			storeOptions = append(storeOptions, db.WithFinalizationWatchdog(finalizationStallLimit,
+				func(stall db.FinalizationStall) {
+					fmt.Fprintf(os.Stderr, "transaction %d stalled for %v finalizing record with key %q in shard %d (abandoned: %t)\n",
+						stall.TransactionID, stall.Waited, stall.Key, stall.Shard, stall.Abandoned)
+				},
+				abandonStalledFinalizing))
+		} else if abandonStalledFinalizing {
+			fatal(2, "--abandon-stalled-finalization requires --finalization-stall-threshold")
+		}
+		if maxTransactionAttempts < 1 {
+			fatal(2, "--max-transaction-attempts must be positive")
+		}
+		storeOptions = append(storeOptions, db.WithMaxTransactionAttempts(maxTransactionAttempts))
+		if conflictPolicy, err := parseConflictPolicy(conflictPolicyName); err != nil {
+			fatalf(2, "--conflict-policy: %v", err)
+		} else {
+			storeOptions = append(storeOptions, db.WithConflictPolicy(conflictPolicy))
+		}
+		if maxConflictWait <= 0 {
+			fatal(2, "--max-conflict-wait must be positive")
+		}
+		storeOptions = append(storeOptions, db.WithMaxConflictWait(maxConflictWait))
+		if maxPendingWrites < 0 {
+			fatal(2, "--max-pending-writes-per-transaction must be nonnegative")
+		} else if maxPendingWrites > 0 {
+			storeOptions = append(storeOptions, db.WithMaxPendingWritesPerTransaction(maxPendingWrites))
+		}
+		if maxValueSize < 0 {
+			fatal(2, "--max-value-size must be nonnegative")
+		} else if maxValueSize > 0 {
+			storeOptions = append(storeOptions, db.WithMaxValueSize(maxValueSize))
+		}
+		if conflictSampleRate < 0 {
+			fatal(2, "--conflict-sample-rate must be nonnegative")
+		} else if conflictSampleRate > 0 {
+			storeOptions = append(storeOptions, db.WithConflictTracking(conflictSampleRate))
+		}
+		if sequenceBatchSize < 1 {
+			fatal(2, "--sequence-batch-size must be positive")
+		}
+		storeOptions = append(storeOptions, db.WithSequenceBatchSize(sequenceBatchSize))
+		if topicRetention < 1 {
+			fatal(2, "--topic-retention must be positive")
+		}
+		storeOptions = append(storeOptions, db.WithTopicRetention(topicRetention))
+		if maxVersionsPerRecord < 0 {
+			fatal(2, "--max-versions-per-record must be nonnegative")
+		} else if maxVersionsPerRecord > 0 {
+			storeOptions = append(storeOptions, db.WithMaxVersionsPerRecord(maxVersionsPerRecord))
+		}
+		if asynchronousFinalization {
+			storeOptions = append(storeOptions, db.WithAsynchronousFinalization())
+		}
+		if cancellationPolicy, err := parseCancellationPolicy(cancellationPolicyName); err != nil {
+			fatalf(2, "--cancellation-policy: %v", err)
+		} else {
+			storeOptions = append(storeOptions, db.WithCancellationPolicy(cancellationPolicy))
+		}
+		if cancellationGracePeriod <= 0 {
+			fatal(2, "--cancellation-grace-period must be positive")
+		}
+		storeOptions = append(storeOptions, db.WithCancellationGracePeriod(cancellationGracePeriod))
+		if trashRetention < 0 {
+			fatal(2, "--trash-retention must be nonnegative")
+		} else if trashRetention > 0 {
+			storeOptions = append(storeOptions, db.WithTrashRetention(trashRetention))
+		}
+		if perKeyWriteRate < 0 {
+			fatal(2, "--per-key-write-rate must be nonnegative")
+		} else if perKeyWriteRate > 0 {
+			if perKeyWriteBurst < 1 {
+				fatal(2, "--per-key-write-burst must be positive")
+			}
+			storeOptions = append(storeOptions, db.WithPerKeyWriteRate(perKeyWriteRate, perKeyWriteBurst))
+			if delayExcessWrites {
+				storeOptions = append(storeOptions, db.WithWriteRateLimitPolicy(db.DelayExcessWrites))
+			}
+		} else if delayExcessWrites {
+			fatal(2, "--delay-excess-writes requires --per-key-write-rate")
+		}
+		if len(chaosConfigFile) > 0 {
+			faults, err := readChaosConfig(chaosConfigFile)
+			if err != nil {
+				fatalf(2, "Invalid --chaos-config: %v", err)
+			}
+			fmt.Fprintln(os.Stderr, "Injecting faults into transactions as directed by --chaos-config")
+			storeOptions = append(storeOptions, db.WithFaultInjection(faults))
+		}
+		if consistentHashShards < 0 {
+			fatal(2, "--consistent-hash-shards must be nonnegative")
+		} else if consistentHashShards > 0 {
+			var err error
+			if ring, err = db.NewConsistentHashRing(consistentHashShards, consistentHashNodes); err != nil {
+				fatalf(2, "Invalid consistent hash ring: %v", err)
+			}
+			storeOptions = append(storeOptions, db.WithKeyShardProjection(ring.Project))
+		}
+		var err error
+		store, err = db.MakeShardedStore(storeOptions...)
+		if err != nil {
+			fatalf(1, "Failed to create database: %v", err)
+		}
+		if len(seedFile) > 0 {
+			records, err := readSeedFile(seedFile)
+			if err != nil {
+				fatalf(2, "Failed to read seed file: %v", err)
+			}
+			if _, err := seedStore(ctx, store, records); err != nil {
+				fatalf(1, "Failed to seed database: %v", err)
+			}
+		}
+		store.SetReadOnly(readOnly)
+		if minTxWait < 0 {
+			fatal(2, "--min-tx-wait must be nonnegative")
+		}
+		if maxPollWait <= 0 {
+			fatal(2, "--max-poll-wait must be positive")
+		}
+		if preparedBatchTimeout <= 0 {
+			fatal(2, "--prepared-batch-timeout must be positive")
+		}
+		if cursorTimeout <= 0 {
+			fatal(2, "--cursor-timeout must be positive")
+		}
+		if allowScripts && scriptMaxSteps < 1 {
+			fatal(2, "--script-max-steps must be positive")
+		}
+		clientMux = makeStoreHandler(store)
+	default:
+		fatalf(2, `--mode must be "server" or "router", not %q`, mode)
+	}
+	var membership *cluster.Membership
+	if len(clusterAdvertiseURL) > 0 {
+		var err error
+		membership, err = cluster.NewMembership(clusterAdvertiseURL, clusterPeers,
+			cluster.WithSuspicionTimeout(clusterSuspicionTimeout),
+			cluster.WithFailureTimeout(clusterFailureTimeout))
+		if err != nil {
+			fatalf(2, "Invalid cluster membership: %v", err)
+		}
+		registerGossipHandlers(clientMux, membership)
+		if clusterGossipInterval < 0 {
+			fatal(2, "--cluster-gossip-interval must be nonnegative")
+		} else if clusterGossipInterval > 0 {
+			// Don't let an unresponsive peer hold up the next round.
+			go membership.Gossip(ctx, clusterGossipInterval, exchangeHeartbeatsOverHTTP(http.DefaultClient, clusterGossipInterval))
+		}
+	} else if len(clusterPeers) > 0 || clusterGossipInterval != 0 {
+		fatal(2, "--cluster-advertise-url must be nonempty when tracking cluster membership")
+	}
+	var clientHandler http.Handler = clientMux
+	if requestTimeout < 0 {
+		fatal(2, "--request-timeout must be nonnegative")
+	} else if requestTimeout > 0 {
+		clientHandler = withRequestTimeout(clientHandler, requestTimeout)
+	}
+	if maxRequestBytes < 0 {
+		fatal(2, "--max-request-bytes must be nonnegative")
+	} else if maxRequestBytes > 0 {
+		clientHandler = withRequestBodyLimit(clientHandler, maxRequestBytes)
+	}
+	if readOnly {
+		if store == nil {
+			fatal(2, "--read-only is not supported in router mode")
+		}
+		clientHandler = withReadOnlyAccess(clientHandler)
+	}
+	var maintenance maintenanceMode
+	clientHandler = maintenance.wrap(clientHandler)
+	clientHandler = withTransactionPriority(clientHandler)
+	clientHandler = withTransactionJournal(clientHandler, debugTxIdentities)
+	if len(accessLogFile) > 0 {
+		format, err := parseAccessLogFormat(accessLogFormatName)
+		if err != nil {
+			fatalf(2, "--access-log-format: %v", err)
+		}
+		if accessLogSampleRate < 1 {
+			fatal(2, "--access-log-sample-rate must be positive")
+		}
+		if accessLogSlowThreshold < 0 {
+			fatal(2, "--access-log-slow-threshold must be nonnegative")
+		}
+		if accessLogMaxBytes < 0 {
+			fatal(2, "--access-log-max-bytes must be nonnegative")
+		}
+		if accessLogMaxBackups < 0 {
+			fatal(2, "--access-log-max-backups must be nonnegative")
+		}
+		logger := accessLogger{
+			format:        format,
+			sampleRate:    uint64(accessLogSampleRate),
+			slowThreshold: accessLogSlowThreshold,
+		}
+		if accessLogFile == "-" {
+			logger.out = os.Stdout
+		} else {
+			f, err := openRotatingFile(accessLogFile, accessLogMaxBytes, accessLogMaxBackups)
+			if err != nil {
+				fatalf(1, "Failed to open access log file: %v", err)
+			}
+			defer f.Close()
+			logger.out = f
+		}
+		clientHandler = logger.wrap(clientHandler)
+	}
+	listeners := []listenerConfig{{
+		role:    "client",
+		address: serverAddress,
+		port:    serverPort,
+		tls:     serverTLSConfig,
+		handler: clientHandler,
+	}}
+	if serveAdminUI {
+		if store == nil {
+			fatal(2, "--admin-ui is not supported in router mode")
+		}
+		if len(adminServerPort) == 0 {
+			fatal(2, "--admin-ui requires --admin-server-port")
+		}
+	}
+	// Serve administrative requests only on a listener of their own, never alongside client
+	// requests, since they reveal every record and the server's internals. Absent a separate
+	// listener for metrics requests, serve them alongside administrative requests.
+	var metricsMux *http.ServeMux
+	if len(adminServerPort) > 0 {
+		adminMux := makeAdminHandler(store, ring, &maintenance, clientHandler, membership)
+		listeners = append(listeners, listenerConfig{
+			role:    "admin",
+			address: adminServerAddress,
+			port:    adminServerPort,
+			tls:     adminTLSConfig,
+			handler: adminMux,
+		})
+		metricsMux = adminMux
+	}
+	if len(metricsServerPort) > 0 {
+		metricsMux = http.NewServeMux()
+		listeners = append(listeners, listenerConfig{
+			role:    "metrics",
+			address: metricsServerAddress,
+			port:    metricsServerPort,
+			tls:     metricsTLSConfig,
+			handler: metricsMux,
+		})
+	}
+	if store != nil && metricsMux != nil {
+		registerMetricsHandlers(metricsMux, store)
+	}
+	if len(postgresServerPort) > 0 {
+		if store == nil {
+			fatal(2, "--postgres-server-port is not supported in router mode")
+		}
+		l, err := net.Listen("tcp", joinIPAddressAndPort(postgresServerAddress, postgresServerPort))
+		if err != nil {
+			fatalf(1, "Failed to listen for PostgreSQL clients: %v", err)
+		}
+		go func() {
+			if err := servePostgres(ctx, l, store); err != nil {
+				fmt.Fprintf(os.Stderr, "PostgreSQL server failed: %v\n", err)
+				cancel()
+			}
+		}()
+	} else if postgresServerAddress != nil {
+		fatal(2, "--postgres-server-port must be nonempty when serving PostgreSQL clients")
+	}
+	if err := runHTTPServers(listeners, ctx.Done()); err != nil {
+		fatalf(1, "%v", err)
 	}
-	handler := makeHandler(store)
-	if err := runHTTPServer(serverAddress, serverPort, serverTLSConfig, handler, ctx.Done()); err != nil {
-		fatalf(1, "HTTP server failed: %v", err)
+	if store != nil {
+		// Let the store conclude committing any transactions that it's finalizing in the background.
+		store.Close(context.Background())
 	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenanceRetryAfter is the duration after which clients should retry writes rejected
+// during maintenance, absent a duration specified when maintenance began.
+const defaultMaintenanceRetryAfter = time.Minute
+
+// maintenanceState describes a period of maintenance.
+type maintenanceState struct {
+	began      time.Time
+	retryAfter time.Duration
+}
+
+// maintenanceMode tracks whether the server is undergoing maintenance, during which it rejects
+// client requests to change records, while still accepting administrative requests, such as to
+// export the database or compact its shards.
+type maintenanceMode struct {
+	state atomic.Pointer[maintenanceState]
+}
+
+// wrap wraps the given handler to reject client requests whose methods would change records while
+// the server is undergoing maintenance, telling clients when to retry them.
+func (m *maintenanceMode) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s := m.state.Load(); s != nil && mayChangeRecords(req) {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(s.retryAfter.Seconds())), 10))
+			respondWithProblem(w, http.StatusServiceUnavailable, "Method %s is not allowed during maintenance; retry after %v.", req.Method, s.retryAfter)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+type maintenanceStatus struct {
+	Enabled           bool       `json:"enabled"`
+	Began             *time.Time `json:"began,omitempty"`
+	RetryAfterSeconds float64    `json:"retry_after_seconds,omitempty"`
+}
+
+func (m *maintenanceMode) respondWithStatus(w http.ResponseWriter) {
+	var status maintenanceStatus
+	if s := m.state.Load(); s != nil {
+		status = maintenanceStatus{
+			Enabled:           true,
+			Began:             &s.began,
+			RetryAfterSeconds: s.retryAfter.Seconds(),
+		}
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSetMaintenance begins or ends maintenance as directed by the request's "enabled" form
+// value, with clients told to retry rejected writes after the duration given by its optional
+// "retry_after" form value.
+func (m *maintenanceMode) handleSetMaintenance(w http.ResponseWriter, req *http.Request) {
+	if !parseForm(w, req) {
+		return
+	}
+	enabled, err := strconv.ParseBool(req.Form.Get("enabled"))
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid %q form value: %v", "enabled", err)
+		return
+	}
+	retryAfter := defaultMaintenanceRetryAfter
+	if s := req.Form.Get("retry_after"); len(s) > 0 {
+		if retryAfter, err = time.ParseDuration(s); err != nil || retryAfter <= 0 {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid %q form value %q: must be a positive duration", "retry_after", s)
+			return
+		}
+	}
+	if enabled {
+		m.state.Store(&maintenanceState{
+			began:      time.Now(),
+			retryAfter: retryAfter,
+		})
+	} else {
+		m.state.Store(nil)
+	}
+	m.respondWithStatus(w)
+}
+
+// registerMaintenanceHandlers installs the handler for administrative requests to begin or end
+// maintenance, or to report whether the server is undergoing it.
+func registerMaintenanceHandlers(mux *http.ServeMux, m *maintenanceMode) {
+	mux.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			m.respondWithStatus(w)
+		case http.MethodPost:
+			m.handleSetMaintenance(w, req)
+		default:
+			rejectMethod(w, req, http.MethodGet, http.MethodPost)
+		}
+	})
+}
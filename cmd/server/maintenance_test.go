@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+func TestMaintenanceModeRejectsWrites(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var maintenance maintenanceMode
+	clientHandler := maintenance.wrap(makeStoreHandler(store))
+	client := httptest.NewServer(clientHandler)
+	t.Cleanup(client.Close)
+	admin := httptest.NewServer(makeAdminHandler(store, nil, &maintenance, clientHandler, nil))
+	t.Cleanup(admin.Close)
+
+	setMaintenance := func(form url.Values) maintenanceStatus {
+		t.Helper()
+		res, body := sendRequest(t, admin, http.MethodPost, "/admin/maintenance", form)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("setting maintenance with %s: want status %d, got %d (%s)", form.Encode(), http.StatusOK, res.StatusCode, body)
+		}
+		var status maintenanceStatus
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	getMaintenance := func() maintenanceStatus {
+		t.Helper()
+		res, body := sendRequest(t, admin, http.MethodGet, "/admin/maintenance", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("reading maintenance status: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+		}
+		var status maintenanceStatus
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	put := func(v string) (*http.Response, string) {
+		t.Helper()
+		return sendRequest(t, client, http.MethodPut, "/record/k", url.Values{"value": {v}})
+	}
+
+	if status := getMaintenance(); status.Enabled {
+		t.Fatalf("want maintenance initially disabled, got %+v", status)
+	}
+	if res, body := sendRequest(t, client, http.MethodPost, "/record/k", url.Values{"value": {"1"}}); res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating record: want status %d, got %d (%s)", http.StatusCreated, res.StatusCode, body)
+	}
+
+	status := setMaintenance(url.Values{"enabled": {"true"}, "retry_after": {"90s"}})
+	if !status.Enabled || status.Began == nil || status.RetryAfterSeconds != 90 {
+		t.Errorf("beginning maintenance: want it enabled with retry after 90 seconds, got %+v", status)
+	}
+	if status := getMaintenance(); !status.Enabled {
+		t.Errorf("during maintenance: want it reported as enabled, got %+v", status)
+	}
+	if res, body := put("2"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("PUT during maintenance: want status %d, got %d (%s)", http.StatusServiceUnavailable, res.StatusCode, body)
+	} else if got := res.Header.Get("Retry-After"); got != "90" {
+		t.Errorf("PUT during maintenance: want Retry-After %q, got %q", "90", got)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		if res, body := sendRequest(t, client, method, "/record/other", url.Values{"value": {"v"}}); res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s during maintenance: want status %d, got %d (%s)", method, http.StatusServiceUnavailable, res.StatusCode, body)
+		}
+	}
+	if got, ok := storedValue(t, store, "k"); !ok || got != "1" {
+		t.Errorf("after rejected PUT: want value %q, got %q (present: %t)", "1", got, ok)
+	}
+	if _, ok := storedValue(t, store, "other"); ok {
+		t.Error("after rejected POST: want record absent")
+	}
+	// Reads and administrative requests proceed as usual.
+	if res, body := sendRequest(t, client, http.MethodGet, "/record/k", nil); res.StatusCode != http.StatusOK || body != "1\n" {
+		t.Errorf("GET during maintenance: want status %d and value %q, got %d and %q", http.StatusOK, "1", res.StatusCode, body)
+	}
+	if res, body := sendRequest(t, client, http.MethodGet, "/records/scan", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("scan during maintenance: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodGet, path: "/admin/export?format=csv"},
+		{method: http.MethodGet, path: "/admin/transactions"},
+		{method: http.MethodPost, path: "/admin/compact-shards"},
+	} {
+		if res, body := sendRequest(t, admin, tc.method, tc.path, nil); res.StatusCode != http.StatusOK {
+			t.Errorf("%s %s during maintenance: want status %d, got %d (%s)", tc.method, tc.path, http.StatusOK, res.StatusCode, body)
+		}
+	}
+
+	// Clients are told to wait at least as long as directed, in whole seconds.
+	setMaintenance(url.Values{"enabled": {"true"}, "retry_after": {"1500ms"}})
+	if res, _ := put("2"); res.Header.Get("Retry-After") != "2" {
+		t.Errorf("want Retry-After %q, got %q", "2", res.Header.Get("Retry-After"))
+	}
+	setMaintenance(url.Values{"enabled": {"1"}})
+	if res, _ := put("2"); res.Header.Get("Retry-After") != "60" {
+		t.Errorf("absent retry_after: want Retry-After %q, got %q", "60", res.Header.Get("Retry-After"))
+	}
+
+	// Malformed requests leave maintenance as it was.
+	for _, form := range []url.Values{
+		{},
+		{"enabled": {"maybe"}},
+		{"enabled": {"false"}, "retry_after": {"soon"}},
+		{"enabled": {"false"}, "retry_after": {"0s"}},
+		{"enabled": {"false"}, "retry_after": {"-1m"}},
+	} {
+		if res, body := sendRequest(t, admin, http.MethodPost, "/admin/maintenance", form); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("setting maintenance with %q: want status %d, got %d (%s)", form.Encode(), http.StatusBadRequest, res.StatusCode, body)
+		}
+	}
+	if status := getMaintenance(); !status.Enabled {
+		t.Errorf("after malformed requests: want maintenance still enabled, got %+v", status)
+	}
+
+	if status := setMaintenance(url.Values{"enabled": {"false"}}); status.Enabled || status.Began != nil {
+		t.Errorf("ending maintenance: want it disabled, got %+v", status)
+	}
+	if res, body := put("2"); res.StatusCode != http.StatusOK {
+		t.Errorf("PUT after maintenance: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	if got, _ := storedValue(t, store, "k"); got != "2" {
+		t.Errorf("after maintenance: want value %q, got %q", "2", got)
+	}
+}
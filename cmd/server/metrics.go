@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// handleOpenMetrics writes the database's statistics in the OpenMetrics text exposition format.
+func handleOpenMetrics(w http.ResponseWriter, db statsReporter) {
+	stats := db.Stats()
+	w.Header().Add("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprintln(bw, "# TYPE db_approximate_keys gauge")
+	fmt.Fprintln(bw, "# HELP db_approximate_keys Estimated number of distinct record keys.")
+	fmt.Fprintf(bw, "db_approximate_keys %d\n", stats.ApproximateKeyCount)
+	fmt.Fprintln(bw, "# TYPE db_records gauge")
+	fmt.Fprintln(bw, "# HELP db_records Number of records held, including those deleted but not yet reclaimed.")
+	fmt.Fprintf(bw, "db_records %d\n", stats.Shards.Records)
+	fmt.Fprintln(bw, "# TYPE db_shard_load_factor gauge")
+	fmt.Fprintln(bw, "# HELP db_shard_load_factor Ratio of records held to the most held since shards were last compacted.")
+	fmt.Fprintf(bw, "db_shard_load_factor %g\n", stats.Shards.LoadFactor)
+	fmt.Fprintln(bw, "# TYPE db_evicted_records counter")
+	fmt.Fprintln(bw, "# HELP db_evicted_records Number of records evicted to stay within the store's limits.")
+	fmt.Fprintf(bw, "db_evicted_records_total %d\n", stats.EvictedRecords)
+	fmt.Fprintln(bw, "# TYPE db_consolidated_versions counter")
+	fmt.Fprintln(bw, "# HELP db_consolidated_versions Number of superseded record versions discarded to stay within the limit per record.")
+	fmt.Fprintf(bw, "db_consolidated_versions_total %d\n", stats.ConsolidatedVersions)
+	fmt.Fprintln(bw, "# TYPE db_consistency_anomalies counter")
+	fmt.Fprintln(bw, "# HELP db_consistency_anomalies Number of record versions found violating the store's invariants.")
+	fmt.Fprintf(bw, "db_consistency_anomalies_total %d\n", stats.ConsistencyAnomalies)
+	writeOpenMetricsHistogram(bw, "db_transaction_attempts", "Attempts needed per committed transaction.", stats.TransactionAttempts)
+	fmt.Fprintln(bw, "# EOF")
+}
+
+func writeOpenMetricsHistogram(w *bufio.Writer, name, help string, h idb.Histogram) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	for _, b := range h.Buckets {
+		bound := "+Inf"
+		if b.UpperBound != math.MaxUint64 {
+			bound = strconv.FormatUint(b.UpperBound, 10)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, bound, b.CumulativeCount)
+	}
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %d\n", name, h.Sum)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"slices"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// mediaTypeMergePatch is the media type of request bodies describing a JSON Merge Patch, per RFC
+// 7386.
+const mediaTypeMergePatch = "application/merge-patch+json"
+
+// mediaTypeJSONPatch is the media type of request bodies describing a JSON Patch, per RFC 6902.
+const mediaTypeJSONPatch = "application/json-patch+json"
+
+// errValueNotJSON indicates that a record's value is not a JSON document to which a patch could
+// apply.
+var errValueNotJSON = errors.New("record's value is not a JSON document")
+
+// errPatchTestFailed indicates that a JSON Patch's "test" operation found a value other than the
+// one it expected.
+var errPatchTestFailed = errors.New("JSON patch test operation failed")
+
+// decodeJSON parses the given JSON document, retaining numbers in their original textual form so
+// that re-encoding them doesn't lose precision.
+func decodeJSON(data []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("unexpected content after JSON document")
+	}
+	return v, nil
+}
+
+// mergePatch applies the given JSON Merge Patch to the given target document per RFC 7386,
+// modifying the target in place where possible and returning the patched document.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// jsonPatchOperation is an operation within a JSON Patch, per RFC 6902.
+type jsonPatchOperation struct {
+	op    string
+	path  []string
+	from  []string
+	value any
+}
+
+// parseJSONPatch parses the given JSON Patch document into its operations.
+func parseJSONPatch(body []byte) ([]jsonPatchOperation, error) {
+	var encoded []struct {
+		Op    string          `json:"op"`
+		Path  *string         `json:"path"`
+		From  *string         `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		return nil, err
+	}
+	operations := make([]jsonPatchOperation, len(encoded))
+	for i, e := range encoded {
+		o := &operations[i]
+		o.op = e.Op
+		if e.Path == nil {
+			return nil, fmt.Errorf("operation %d lacks a path", i)
+		}
+		var err error
+		if o.path, err = parseJSONPointer(*e.Path); err != nil {
+			return nil, fmt.Errorf("operation %d has an invalid path: %w", i, err)
+		}
+		switch e.Op {
+		case "add", "replace", "test":
+			if e.Value == nil {
+				return nil, fmt.Errorf("operation %d (%s) lacks a value", i, e.Op)
+			}
+			if o.value, err = decodeJSON(e.Value); err != nil {
+				return nil, fmt.Errorf("operation %d (%s) has an invalid value: %w", i, e.Op, err)
+			}
+		case "move", "copy":
+			if e.From == nil {
+				return nil, fmt.Errorf("operation %d (%s) lacks a source path", i, e.Op)
+			}
+			if o.from, err = parseJSONPointer(*e.From); err != nil {
+				return nil, fmt.Errorf("operation %d (%s) has an invalid source path: %w", i, e.Op, err)
+			}
+			if e.Op == "move" && len(o.from) < len(o.path) && slices.Equal(o.from, o.path[:len(o.from)]) {
+				return nil, fmt.Errorf("operation %d (move) would move a value into one of its own children", i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d has unknown operation %q", i, e.Op)
+		}
+	}
+	return operations, nil
+}
+
+// jsonPatchError describes an operation within a JSON Patch that failed to apply to a document.
+type jsonPatchError struct {
+	index int
+	op    string
+	err   error
+}
+
+func (e *jsonPatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s) failed: %v", e.index, e.op, e.err)
+}
+
+func (e *jsonPatchError) Unwrap() error {
+	return e.err
+}
+
+// applyJSONPatch applies the given JSON Patch operations in order to the given target document
+// per RFC 6902, modifying the target in place where possible and returning the patched document.
+// Should any operation fail, the caller must discard the target. The operations remain intact, so
+// that the caller may apply them again, such as upon retrying a transaction.
+func applyJSONPatch(target any, operations []jsonPatchOperation) (any, error) {
+	for i, o := range operations {
+		var err error
+		switch o.op {
+		case "add":
+			target, err = addJSONValue(target, o.path, cloneJSON(o.value))
+		case "remove":
+			target, _, err = removeJSONValue(target, o.path)
+		case "replace":
+			if len(o.path) == 0 {
+				target = cloneJSON(o.value)
+			} else if target, _, err = removeJSONValue(target, o.path); err == nil {
+				target, err = addJSONValue(target, o.path, cloneJSON(o.value))
+			}
+		case "move":
+			if slices.Equal(o.from, o.path) {
+				_, err = resolveJSONPointer(target, o.from)
+				break
+			}
+			var v any
+			if target, v, err = removeJSONValue(target, o.from); err == nil {
+				target, err = addJSONValue(target, o.path, v)
+			}
+		case "copy":
+			var v any
+			if v, err = resolveJSONPointer(target, o.from); err == nil {
+				target, err = addJSONValue(target, o.path, cloneJSON(v))
+			}
+		case "test":
+			var v any
+			if v, err = resolveJSONPointer(target, o.path); err == nil && !equalJSON(v, o.value) {
+				err = errPatchTestFailed
+			}
+		}
+		if err != nil {
+			return nil, &jsonPatchError{index: i, op: o.op, err: err}
+		}
+	}
+	return target, nil
+}
+
+// updateJSONContainer replaces the value within the given document to which the given reference
+// tokens refer with the result of the given function, returning the updated document.
+func updateJSONContainer(doc any, tokens []string, update func(any) (any, error)) (any, error) {
+	if len(tokens) == 0 {
+		return update(doc)
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		member, ok := v[tokens[0]]
+		if !ok {
+			return nil, errPointerUnresolved
+		}
+		updated, err := updateJSONContainer(member, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		v[tokens[0]] = updated
+		return v, nil
+	case []any:
+		i, ok := jsonArrayIndex(tokens[0], len(v))
+		if !ok || i == len(v) {
+			return nil, errPointerUnresolved
+		}
+		updated, err := updateJSONContainer(v[i], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = updated
+		return v, nil
+	default:
+		return nil, errPointerUnresolved
+	}
+}
+
+// addJSONValue adds the given value to the given document at the location to which the given
+// reference tokens refer, replacing an object's existing member or inserting an array element,
+// and returning the updated document.
+func addJSONValue(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	last := tokens[len(tokens)-1]
+	return updateJSONContainer(doc, tokens[:len(tokens)-1], func(container any) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			c[last] = value
+			return c, nil
+		case []any:
+			if last == "-" {
+				return append(c, value), nil
+			}
+			i, ok := jsonArrayIndex(last, len(c))
+			if !ok {
+				return nil, errPointerUnresolved
+			}
+			return slices.Insert(c, i, value), nil
+		default:
+			return nil, errPointerUnresolved
+		}
+	})
+}
+
+// removeJSONValue removes the value from the given document at the location to which the given
+// reference tokens refer, returning the updated document along with the removed value.
+func removeJSONValue(doc any, tokens []string) (any, any, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	last := tokens[len(tokens)-1]
+	var removed any
+	updated, err := updateJSONContainer(doc, tokens[:len(tokens)-1], func(container any) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			v, ok := c[last]
+			if !ok {
+				return nil, errPointerUnresolved
+			}
+			removed = v
+			delete(c, last)
+			return c, nil
+		case []any:
+			i, ok := jsonArrayIndex(last, len(c))
+			if !ok || i == len(c) {
+				return nil, errPointerUnresolved
+			}
+			removed = c[i]
+			return slices.Delete(c, i, i+1), nil
+		default:
+			return nil, errPointerUnresolved
+		}
+	})
+	return updated, removed, err
+}
+
+// cloneJSON returns a deep copy of the given decoded JSON value.
+func cloneJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for k, member := range v {
+			c[k] = cloneJSON(member)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, element := range v {
+			c[i] = cloneJSON(element)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equalJSON reports whether the given decoded JSON values are equal per RFC 6902, comparing
+// numbers by their numeric values.
+func equalJSON(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, member := range a {
+			other, ok := b[k]
+			if !ok || !equalJSON(member, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, equalJSON)
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okX := new(big.Rat).SetString(a.String())
+		y, okY := new(big.Rat).SetString(b.String())
+		return okX && okY && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
+
+// handlePatch applies either a JSON Merge Patch or a JSON Patch, per the request's media type, to
+// the JSON document stored as an existing record's value.
+func handlePatch(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (mediaType != mediaTypeMergePatch && mediaType != mediaTypeJSONPatch) {
+		w.Header().Set("Accept-Patch", mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+		respondWithProblem(w, http.StatusUnsupportedMediaType, "Request body must be of media type %q or %q", mediaTypeMergePatch, mediaTypeJSONPatch)
+		return
+	}
+	key, ok := getTargetKey(w, req)
+	if !ok {
+		return
+	}
+	var body json.RawMessage
+	if !decodeJSONBody(w, req, &body) {
+		return
+	}
+	var apply func(target any) (any, error)
+	if mediaType == mediaTypeJSONPatch {
+		operations, err := parseJSONPatch(body)
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid JSON patch: %v", err)
+			return
+		}
+		apply = func(target any) (any, error) {
+			return applyJSONPatch(target, operations)
+		}
+	} else {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Failed to parse JSON request body: %v", err)
+			return
+		}
+		apply = func(target any) (any, error) {
+			return mergePatch(target, patch), nil
+		}
+	}
+	var recordExisted bool
+	var txID uint64
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		record, err := tx.GetRecord(ctx, key)
+		if errors.Is(err, idb.ErrRecordDoesNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		recordExisted = true
+		target, err := decodeJSON(record.Value)
+		if err != nil {
+			return false, errValueNotJSON
+		}
+		target, err = apply(target)
+		if err != nil {
+			return false, err
+		}
+		patched, err := json.Marshal(target)
+		if err != nil {
+			return false, err
+		}
+		// Patching the value leaves its metadata intact.
+		err = tx.UpdateWithMetadata(ctx, key, idb.Value(patched), record.Metadata)
+		return err == nil, err
+	}); err != nil {
+		var patchErr *jsonPatchError
+		if errors.Is(err, errValueNotJSON) || errors.As(err, &patchErr) {
+			respondWithProblem(w, http.StatusConflict, "%v", err)
+			return
+		}
+		respondWithError(w, err)
+		return
+	}
+	if !recordExisted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	setCommittedTransaction(w, txID)
+}
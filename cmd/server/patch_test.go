@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// canonicalJSON re-encodes the given JSON document with its object members sorted by name.
+func canonicalJSON(t *testing.T, doc string) string {
+	t.Helper()
+	v, err := decodeJSON([]byte(doc))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", doc, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMergePatch(t *testing.T) {
+	// These cases come from RFC 7386's Appendix A.
+	for _, tc := range []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{target: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{target: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{target: `{"a":["b"]}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"c"}`, patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{target: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{target: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{target: `["a","b"]`, patch: `["c","d"]`, want: `["c","d"]`},
+		{target: `{"a":"b"}`, patch: `["c"]`, want: `["c"]`},
+		{target: `{"a":"foo"}`, patch: `null`, want: `null`},
+		{target: `{"e":null}`, patch: `{"a":1}`, want: `{"a":1,"e":null}`},
+		{target: `[1,2]`, patch: `{"a":"b","c":null}`, want: `{"a":"b"}`},
+		{target: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+	} {
+		target, err := decodeJSON([]byte(tc.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := decodeJSON([]byte(tc.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(mergePatch(target, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := canonicalJSON(t, tc.want); string(got) != want {
+			t.Errorf("patching %s with %s: want %s, got %s", tc.target, tc.patch, want, got)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	const doc = `{"a":1,"list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`
+	for _, tc := range []struct {
+		name  string
+		patch string
+		want  string
+		// wantErr is the error that the patch should fail with, if any.
+		wantErr error
+		// wantFailedOperation is the index of the operation that should fail.
+		wantFailedOperation int
+	}{
+		{
+			name:  "add member",
+			patch: `[{"op":"add","path":"/b","value":{"c":[true,null]}}]`,
+			want:  `{"a":1,"b":{"c":[true,null]},"list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "add leaves operation's value intact",
+			patch: `[{"op":"add","path":"/b","value":{}},{"op":"test","path":"/b","value":{}},{"op":"add","path":"/b/c","value":2}]`,
+			want:  `{"a":1,"b":{"c":2},"list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "add replaces existing member",
+			patch: `[{"op":"add","path":"/a","value":"one"}]`,
+			want:  `{"a":"one","list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "add inserts array element",
+			patch: `[{"op":"add","path":"/list/1","value":1.5}]`,
+			want:  `{"a":1,"list":[1,1.5,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "add appends array elements",
+			patch: `[{"op":"add","path":"/list/-","value":4},{"op":"add","path":"/list/4","value":5}]`,
+			want:  `{"a":1,"list":[1,2,3,4,5],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "add replaces whole document",
+			patch: `[{"op":"add","path":"","value":[]}]`,
+			want:  `[]`,
+		},
+		{
+			name:                "add beyond end of array",
+			patch:               `[{"op":"add","path":"/list/4","value":5}]`,
+			wantErr:             errPointerUnresolved,
+			wantFailedOperation: 0,
+		},
+		{
+			name:    "add with leading zero in array index",
+			patch:   `[{"op":"add","path":"/list/01","value":5}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:    "add to missing parent",
+			patch:   `[{"op":"add","path":"/missing/b","value":5}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:    "add within scalar",
+			patch:   `[{"op":"add","path":"/a/b","value":5}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:  "remove member and array element",
+			patch: `[{"op":"remove","path":"/obj/x"},{"op":"remove","path":"/list/0"}]`,
+			want:  `{"a":1,"list":[2,3],"obj":{},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "remove members with escaped names",
+			patch: `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/m~0n"}]`,
+			want:  `{"a":1,"list":[1,2,3],"obj":{"x":"y"}}`,
+		},
+		{
+			name:                "remove missing member",
+			patch:               `[{"op":"remove","path":"/a"},{"op":"remove","path":"/a"}]`,
+			wantErr:             errPointerUnresolved,
+			wantFailedOperation: 1,
+		},
+		{
+			name:    "remove past end of array",
+			patch:   `[{"op":"remove","path":"/list/3"}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:  "replace member and array element",
+			patch: `[{"op":"replace","path":"/obj/x","value":"z"},{"op":"replace","path":"/list/2","value":[3]}]`,
+			want:  `{"a":1,"list":[1,2,[3]],"obj":{"x":"z"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "replace whole document",
+			patch: `[{"op":"replace","path":"","value":{"fresh":true}}]`,
+			want:  `{"fresh":true}`,
+		},
+		{
+			name:    "replace missing member",
+			patch:   `[{"op":"replace","path":"/missing","value":1}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:  "move member into array",
+			patch: `[{"op":"move","from":"/obj/x","path":"/list/0"}]`,
+			want:  `{"a":1,"list":["y",1,2,3],"obj":{},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "move to same location",
+			patch: `[{"op":"move","from":"/a","path":"/a"}]`,
+			want:  doc,
+		},
+		{
+			name:    "move missing member",
+			patch:   `[{"op":"move","from":"/missing","path":"/b"}]`,
+			wantErr: errPointerUnresolved,
+		},
+		{
+			name:  "copy is independent of its source",
+			patch: `[{"op":"copy","from":"/obj","path":"/copy"},{"op":"add","path":"/copy/w","value":0}]`,
+			want:  `{"a":1,"copy":{"w":0,"x":"y"},"list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "test passes before other operations",
+			patch: `[{"op":"test","path":"/a","value":1.0},{"op":"test","path":"/obj","value":{"x":"y"}},{"op":"test","path":"/list","value":[1,2,3]},{"op":"remove","path":"/a"}]`,
+			want:  `{"list":[1,2,3],"obj":{"x":"y"},"a/b":"slash","m~n":"tilde"}`,
+		},
+		{
+			name:  "test compares numbers by value",
+			patch: `[{"op":"test","path":"/a","value":1e0},{"op":"test","path":"/list/1","value":20E-1}]`,
+			want:  doc,
+		},
+		{
+			name:                "test fails on different value",
+			patch:               `[{"op":"remove","path":"/a"},{"op":"test","path":"/obj/x","value":"z"},{"op":"add","path":"/b","value":2}]`,
+			wantErr:             errPatchTestFailed,
+			wantFailedOperation: 1,
+		},
+		{
+			name:    "test fails on different type",
+			patch:   `[{"op":"test","path":"/a","value":"1"}]`,
+			wantErr: errPatchTestFailed,
+		},
+		{
+			name:    "test fails on extra member",
+			patch:   `[{"op":"test","path":"/obj","value":{"x":"y","z":null}}]`,
+			wantErr: errPatchTestFailed,
+		},
+		{
+			name:    "test fails on missing member",
+			patch:   `[{"op":"test","path":"/missing","value":null}]`,
+			wantErr: errPointerUnresolved,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			operations, err := parseJSONPatch([]byte(tc.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Applying the patch again to a fresh document must yield the same outcome, as it
+			// would upon retrying a transaction.
+			for attempt := range 2 {
+				target, err := decodeJSON([]byte(doc))
+				if err != nil {
+					t.Fatal(err)
+				}
+				patched, err := applyJSONPatch(target, operations)
+				if tc.wantErr != nil {
+					var patchErr *jsonPatchError
+					if !errors.Is(err, tc.wantErr) || !errors.As(err, &patchErr) {
+						t.Fatalf("attempt %d: want patch error wrapping %v, got %v", attempt, tc.wantErr, err)
+					}
+					if patchErr.index != tc.wantFailedOperation {
+						t.Errorf("attempt %d: want operation %d to fail, got operation %d", attempt, tc.wantFailedOperation, patchErr.index)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("attempt %d: %v", attempt, err)
+				}
+				got, err := json.Marshal(patched)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := canonicalJSON(t, tc.want); string(got) != want {
+					t.Errorf("attempt %d: want %s, got %s", attempt, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJSONPatchRejectsMalformedPatches(t *testing.T) {
+	for _, tc := range []struct {
+		patch string
+		// wantMessage is a fragment of the expected error's message.
+		wantMessage string
+	}{
+		{patch: `{"op":"add","path":"/a","value":1}`, wantMessage: "cannot unmarshal"},
+		{patch: `[{"op":"add","value":1}]`, wantMessage: "operation 0 lacks a path"},
+		{patch: `[{"op":"remove","path":"a"}]`, wantMessage: "operation 0 has an invalid path"},
+		{patch: `[{"op":"remove","path":"/a~2"}]`, wantMessage: "invalid escape sequence"},
+		{patch: `[{"op":"remove","path":"/a"},{"op":"merge","path":"/a"}]`, wantMessage: `operation 1 has unknown operation "merge"`},
+		{patch: `[{"path":"/a"}]`, wantMessage: `unknown operation ""`},
+		{patch: `[{"op":"add","path":"/a"}]`, wantMessage: "operation 0 (add) lacks a value"},
+		{patch: `[{"op":"replace","path":"/a"}]`, wantMessage: "operation 0 (replace) lacks a value"},
+		{patch: `[{"op":"test","path":"/a"}]`, wantMessage: "operation 0 (test) lacks a value"},
+		{patch: `[{"op":"move","path":"/a"}]`, wantMessage: "operation 0 (move) lacks a source path"},
+		{patch: `[{"op":"copy","path":"/a","from":"b"}]`, wantMessage: "operation 0 (copy) has an invalid source path"},
+		{patch: `[{"op":"move","path":"/a/b","from":"/a"}]`, wantMessage: "into one of its own children"},
+	} {
+		if _, err := parseJSONPatch([]byte(tc.patch)); err == nil || !strings.Contains(err.Error(), tc.wantMessage) {
+			t.Errorf("%s: want error mentioning %q, got %v", tc.patch, tc.wantMessage, err)
+		}
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	server, fake := newTestServer(t)
+	const doc = `{"a":1,"list":[1,2]}`
+	ctx := context.Background()
+	for k, v := range map[string]string{"doc": doc, "text": "not JSON"} {
+		if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.Insert(ctx, idb.Key(k), idb.Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendPatch := func(t *testing.T, path, mediaType, body string) (*http.Response, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", mediaType)
+		w := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(w, req)
+		return w.Result(), w.Body.String()
+	}
+	for _, step := range []struct {
+		name       string
+		path       string
+		mediaType  string
+		body       string
+		wantStatus int
+		// wantValue is the expected JSON document stored in the "doc" record after the step.
+		wantValue string
+	}{
+		{
+			name:       "merge patch",
+			mediaType:  mediaTypeMergePatch,
+			body:       `{"b":{"c":true},"a":null}`,
+			wantStatus: http.StatusOK,
+			wantValue:  `{"b":{"c":true},"list":[1,2]}`,
+		},
+		{
+			name:       "JSON patch",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"test","path":"/b/c","value":true},{"op":"add","path":"/list/-","value":3},{"op":"replace","path":"/b","value":"x"},{"op":"remove","path":"/list/0"}]`,
+			wantStatus: http.StatusOK,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "JSON patch with failing test",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"remove","path":"/list"},{"op":"test","path":"/b","value":"y"}]`,
+			wantStatus: http.StatusConflict,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "JSON patch referring to missing location",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"replace","path":"/missing","value":1}]`,
+			wantStatus: http.StatusConflict,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "JSON patch removing whole document",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"remove","path":""}]`,
+			wantStatus: http.StatusConflict,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "malformed JSON patch",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"frobnicate","path":"/b"}]`,
+			wantStatus: http.StatusBadRequest,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "malformed merge patch",
+			mediaType:  mediaTypeMergePatch,
+			body:       `{"b":`,
+			wantStatus: http.StatusBadRequest,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "unsupported media type",
+			mediaType:  "application/json",
+			body:       `{"b":null}`,
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantValue:  `{"b":"x","list":[2,3]}`,
+		},
+		{
+			name:       "merge patch of non-JSON value",
+			path:       "/record/text",
+			mediaType:  mediaTypeMergePatch,
+			body:       `{"b":1}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "JSON patch of non-JSON value",
+			path:       "/record/text",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[{"op":"add","path":"/b","value":1}]`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "missing record",
+			path:       "/record/missing",
+			mediaType:  mediaTypeJSONPatch,
+			body:       `[]`,
+			wantStatus: http.StatusNotFound,
+		},
+	} {
+		path := step.path
+		if len(path) == 0 {
+			path = "/record/doc"
+		}
+		res, body := sendPatch(t, path, step.mediaType, step.body)
+		if res.StatusCode != step.wantStatus {
+			t.Errorf("%s: want status %d, got %d (%s)", step.name, step.wantStatus, res.StatusCode, body)
+		}
+		if step.wantStatus == http.StatusUnsupportedMediaType {
+			if got := res.Header.Get("Accept-Patch"); !strings.Contains(got, mediaTypeJSONPatch) || !strings.Contains(got, mediaTypeMergePatch) {
+				t.Errorf("%s: want both patch media types accepted, got %q", step.name, got)
+			}
+		}
+		if committed := len(res.Header.Get(headerCommittedTransaction)) > 0; committed != (step.wantStatus == http.StatusOK) {
+			t.Errorf("%s: want committed transaction reported %t, got %t", step.name, !committed, committed)
+		}
+		if len(step.wantValue) == 0 {
+			continue
+		}
+		res, body = sendRequest(t, server, http.MethodGet, "/record/doc", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: want status %d reading record, got %d (%s)", step.name, http.StatusOK, res.StatusCode, body)
+		}
+		if want, got := canonicalJSON(t, step.wantValue), canonicalJSON(t, body); want != got {
+			t.Errorf("%s: want value %s, got %s", step.name, want, got)
+		}
+	}
+	if res, body := sendRequest(t, server, http.MethodGet, "/record/text", nil); res.StatusCode != http.StatusOK || body != "not JSON\n" {
+		t.Errorf("want non-JSON value left intact, got status %d and %q", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// errPointerUnresolved indicates that a JSON Pointer does not refer to any value within a
+// document.
+var errPointerUnresolved = errors.New("JSON pointer does not refer to a value within the document")
+
+// jsonPointerUnescaper restores the characters escaped within a JSON Pointer's reference tokens.
+var jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parseJSONPointer splits the given JSON Pointer into its unescaped reference tokens, per RFC
+// 6901.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("JSON pointer %q must be empty or start with a slash", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		for j := 0; j < len(t); j++ {
+			if t[j] == '~' && (j == len(t)-1 || (t[j+1] != '0' && t[j+1] != '1')) {
+				return nil, fmt.Errorf("JSON pointer %q contains an invalid escape sequence", pointer)
+			}
+		}
+		tokens[i] = jsonPointerUnescaper.Replace(t)
+	}
+	return tokens, nil
+}
+
+// jsonArrayIndex interprets the given reference token as an index into an array of the given
+// length, reporting whether it's a valid index no greater than the length.
+func jsonArrayIndex(t string, length int) (int, bool) {
+	// Array indices must be decimal numbers without leading zeros.
+	if len(t) == 0 || (len(t) > 1 && t[0] == '0') || strings.IndexFunc(t, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return 0, false
+	}
+	i, err := strconv.Atoi(t)
+	if err != nil || i > length {
+		return 0, false
+	}
+	return i, true
+}
+
+// resolveJSONPointer returns the value within the given document to which the given reference
+// tokens refer.
+func resolveJSONPointer(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch v := doc.(type) {
+		case map[string]any:
+			member, ok := v[t]
+			if !ok {
+				return nil, errPointerUnresolved
+			}
+			doc = member
+		case []any:
+			i, ok := jsonArrayIndex(t, len(v))
+			if !ok || i == len(v) {
+				return nil, errPointerUnresolved
+			}
+			doc = v[i]
+		default:
+			return nil, errPointerUnresolved
+		}
+	}
+	return doc, nil
+}
+
+// respondWithJSONFragment writes the fragment of the JSON document stored as a record's value to
+// which the given JSON Pointer refers.
+func respondWithJSONFragment(w http.ResponseWriter, value idb.Value, pointer string) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		respondWithProblem(w, http.StatusConflict, "%v", errValueNotJSON)
+		return
+	}
+	fragment, err := resolveJSONPointer(doc, tokens)
+	if err != nil {
+		respondWithProblem(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(fragment)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+func TestParseJSONPointer(t *testing.T) {
+	for _, tc := range []struct {
+		pointer string
+		want    []string
+	}{
+		{pointer: "", want: nil},
+		{pointer: "/", want: []string{""}},
+		{pointer: "/a/b/0", want: []string{"a", "b", "0"}},
+		{pointer: "/a//b", want: []string{"a", "", "b"}},
+		{pointer: "/a~1b", want: []string{"a/b"}},
+		{pointer: "/m~0n", want: []string{"m~n"}},
+		// Unescaping "~01" yields "~1" rather than "/", as RFC 6901 requires.
+		{pointer: "/~01", want: []string{"~1"}},
+		{pointer: "/~10", want: []string{"/0"}},
+		{pointer: "/~0~1~0", want: []string{"~/~"}},
+		{pointer: "/ /%25", want: []string{" ", "%25"}},
+	} {
+		got, err := parseJSONPointer(tc.pointer)
+		if err != nil {
+			t.Errorf("%q: %v", tc.pointer, err)
+			continue
+		}
+		if !slices.Equal(tc.want, got) {
+			t.Errorf("%q: want tokens %q, got %q", tc.pointer, tc.want, got)
+		}
+	}
+	for _, pointer := range []string{"a", "a/b", "/a~", "/a~2", "/~a", "/a/~/b"} {
+		if tokens, err := parseJSONPointer(pointer); err == nil {
+			t.Errorf("%q: want error, got tokens %q", pointer, tokens)
+		}
+	}
+}
+
+func TestResolveJSONPointer(t *testing.T) {
+	doc, err := decodeJSON([]byte(`{
+		"foo": ["bar", "baz"],
+		"": 0,
+		"a/b": 1,
+		"m~n": 8,
+		" ": 7,
+		"nested": {"list": [{"x": null}, [10, 11]]},
+		"7": "member named like an index"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		pointer string
+		// want is the expected fragment, encoded as JSON, or empty if the pointer should refer to
+		// no value.
+		want string
+	}{
+		{pointer: "/foo", want: `["bar","baz"]`},
+		{pointer: "/foo/0", want: `"bar"`},
+		{pointer: "/foo/1", want: `"baz"`},
+		{pointer: "/", want: `0`},
+		{pointer: "/a~1b", want: `1`},
+		{pointer: "/m~0n", want: `8`},
+		{pointer: "/ ", want: `7`},
+		{pointer: "/7", want: `"member named like an index"`},
+		{pointer: "/nested/list/0/x", want: `null`},
+		{pointer: "/nested/list/1/1", want: `11`},
+		{pointer: "/foo/2"},
+		{pointer: "/foo/-"},
+		{pointer: "/foo/-1"},
+		{pointer: "/foo/01"},
+		{pointer: "/foo/1e0"},
+		{pointer: "/foo/"},
+		{pointer: "/foo/99999999999999999999"},
+		{pointer: "/missing"},
+		{pointer: "/a/b"},
+		{pointer: "/foo/0/0"},
+		{pointer: "/nested/list/0/x/y"},
+	} {
+		tokens, err := parseJSONPointer(tc.pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragment, err := resolveJSONPointer(doc, tokens)
+		if len(tc.want) == 0 {
+			if !errors.Is(err, errPointerUnresolved) {
+				t.Errorf("%q: want unresolved pointer, got %v (%v)", tc.pointer, err, fragment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.pointer, err)
+			continue
+		}
+		if got, err := json.Marshal(fragment); err != nil {
+			t.Fatal(err)
+		} else if string(got) != tc.want {
+			t.Errorf("%q: want %s, got %s", tc.pointer, tc.want, got)
+		}
+	}
+	// The empty pointer refers to the whole document.
+	if whole, err := resolveJSONPointer(doc, nil); err != nil {
+		t.Error(err)
+	} else if _, ok := whole.(map[string]any); !ok {
+		t.Errorf("empty pointer: want whole document, got %v", whole)
+	}
+}
+
+func TestGetRecordFragment(t *testing.T) {
+	server, fake := newTestServer(t)
+	ctx := context.Background()
+	for k, v := range map[string]string{
+		"doc":  `{"a":{"b":[10,{"c~d":"deep"}]},"e/f":12345678901234567890}`,
+		"text": "not JSON",
+	} {
+		if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.Insert(ctx, idb.Key(k), idb.Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		key        string
+		pointer    string
+		wantStatus int
+		wantBody   string
+	}{
+		{key: "doc", pointer: "/a/b/0", wantStatus: http.StatusOK, wantBody: "10\n"},
+		{key: "doc", pointer: "/a/b/1/c~0d", wantStatus: http.StatusOK, wantBody: `"deep"` + "\n"},
+		{key: "doc", pointer: "/e~1f", wantStatus: http.StatusOK, wantBody: "12345678901234567890\n"},
+		{key: "doc", pointer: "", wantStatus: http.StatusOK},
+		{key: "doc", pointer: "/a/b/2", wantStatus: http.StatusNotFound},
+		{key: "doc", pointer: "/a/x", wantStatus: http.StatusNotFound},
+		{key: "doc", pointer: "a/b", wantStatus: http.StatusBadRequest},
+		{key: "doc", pointer: "/a~2", wantStatus: http.StatusBadRequest},
+		{key: "text", pointer: "/a", wantStatus: http.StatusConflict},
+		{key: "missing", pointer: "/a", wantStatus: http.StatusNotFound},
+	} {
+		path := "/record/" + tc.key + "?" + url.Values{"pointer": {tc.pointer}}.Encode()
+		res, body := sendRequest(t, server, http.MethodGet, path, nil)
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s: want status %d, got %d (%s)", path, tc.wantStatus, res.StatusCode, body)
+			continue
+		}
+		if len(tc.wantBody) > 0 && body != tc.wantBody {
+			t.Errorf("%s: want body %q, got %q", path, tc.wantBody, body)
+		}
+		if res.StatusCode == http.StatusOK && !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("%s: want JSON response, got content type %q", path, res.Header.Get("Content-Type"))
+		}
+	}
+}
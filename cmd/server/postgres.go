@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The PostgreSQL frontend/backend protocol codes that a client sends in its first message, in
+// lieu of a message type.
+const (
+	postgresProtocolVersion3 = 196608
+	postgresSSLRequest       = 80877103
+	postgresGSSENCRequest    = 80877104
+	postgresCancelRequest    = 80877102
+)
+
+// postgresMaxMessageSize bounds the size of the messages that the server accepts from a
+// PostgreSQL client.
+const postgresMaxMessageSize = 1 << 20
+
+// The PostgreSQL type OIDs of the columns of the virtual "records" table.
+const (
+	postgresTypeText = 25
+	postgresTypeInt8 = 20
+)
+
+// postgresConn speaks the PostgreSQL frontend/backend protocol (version 3) with one client,
+// answering queries of the virtual "records" table via the simple query protocol.
+type postgresConn struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (c *postgresConn) readStartupMessage() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 8 || length > postgresMaxMessageSize {
+		return 0, nil, fmt.Errorf("startup message has invalid length %d", length)
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[4:]), body, nil
+}
+
+func (c *postgresConn) readMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > postgresMaxMessageSize {
+		return 0, nil, fmt.Errorf("message of type %q has invalid length %d", header[0], length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// beginMessage starts composing a message of the given type, leaving room for its length.
+func (c *postgresConn) beginMessage(kind byte) {
+	c.buf = append(c.buf[:0], kind, 0, 0, 0, 0)
+}
+
+func (c *postgresConn) appendString(s string) {
+	c.buf = append(append(c.buf, s...), 0)
+}
+
+func (c *postgresConn) appendInt16(n int16) {
+	c.buf = binary.BigEndian.AppendUint16(c.buf, uint16(n))
+}
+
+func (c *postgresConn) appendInt32(n int32) {
+	c.buf = binary.BigEndian.AppendUint32(c.buf, uint32(n))
+}
+
+// sendMessage writes the message composed since the last call to beginMessage.
+func (c *postgresConn) sendMessage() error {
+	binary.BigEndian.PutUint32(c.buf[1:5], uint32(len(c.buf)-1))
+	_, err := c.w.Write(c.buf)
+	return err
+}
+
+func (c *postgresConn) sendParameterStatus(name, value string) error {
+	c.beginMessage('S')
+	c.appendString(name)
+	c.appendString(value)
+	return c.sendMessage()
+}
+
+func (c *postgresConn) sendReadyForQuery() error {
+	c.beginMessage('Z')
+	c.buf = append(c.buf, 'I')
+	if err := c.sendMessage(); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// sendError reports an error with the given SQLSTATE code and message.
+func (c *postgresConn) sendError(code, message string) error {
+	c.beginMessage('E')
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', "ERROR"},
+		{'V', "ERROR"},
+		{'C', code},
+		{'M', message},
+	} {
+		c.buf = append(c.buf, field.kind)
+		c.appendString(field.value)
+	}
+	c.buf = append(c.buf, 0)
+	return c.sendMessage()
+}
+
+func (c *postgresConn) sendCommandComplete(tag string) error {
+	c.beginMessage('C')
+	c.appendString(tag)
+	return c.sendMessage()
+}
+
+// postgresText renders the given bytes as text, or, if they're not valid UTF-8, in the hexadecimal
+// format that PostgreSQL uses for bytea values.
+func postgresText(b []byte) []byte {
+	if utf8.Valid(b) {
+		return b
+	}
+	return append([]byte(`\x`), hex.EncodeToString(b)...)
+}
+
+// postgresSessionCommands are the leading keywords of statements that clients issue to configure
+// their sessions, which the server acknowledges without effect.
+var postgresSessionCommands = []string{"SET", "RESET", "BEGIN", "START", "COMMIT", "ROLLBACK", "END", "DISCARD", "DEALLOCATE"}
+
+// answerQuery runs a query received via the simple query protocol, sending its results.
+func (c *postgresConn) answerQuery(ctx context.Context, db database, query string) error {
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(query) == 0 {
+		c.beginMessage('I')
+		return c.sendMessage()
+	}
+	command := strings.ToUpper(firstWord(query))
+	for _, sc := range postgresSessionCommands {
+		if command == sc {
+			return c.sendCommandComplete(command)
+		}
+	}
+	q, err := parseRecordQuery(query)
+	if err != nil {
+		if command != "SELECT" {
+			return c.sendError("25006", "only queries of the records table are supported, as the database is read-only")
+		}
+		return c.sendError("42601", err.Error())
+	}
+	rows, err := q.run(ctx, db)
+	if err != nil {
+		return c.sendError("XX000", err.Error())
+	}
+	c.beginMessage('T')
+	c.appendInt16(int16(len(q.columns)))
+	for _, column := range q.columns {
+		c.appendString(column)
+		c.appendInt32(0) // Table OID
+		c.appendInt16(0) // Column attribute number
+		if column == queryColumnVersion {
+			c.appendInt32(postgresTypeInt8)
+			c.appendInt16(8)
+		} else {
+			c.appendInt32(postgresTypeText)
+			c.appendInt16(-1)
+		}
+		c.appendInt32(-1) // Type modifier
+		c.appendInt16(0)  // Text format
+	}
+	if err := c.sendMessage(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		c.beginMessage('D')
+		c.appendInt16(int16(len(q.columns)))
+		for _, column := range q.columns {
+			var field []byte
+			switch column {
+			case queryColumnKey:
+				field = postgresText(row.key)
+			case queryColumnValue:
+				field = postgresText(row.value)
+			case queryColumnVersion:
+				field = strconv.AppendUint(nil, row.version, 10)
+			}
+			c.appendInt32(int32(len(field)))
+			c.buf = append(c.buf, field...)
+		}
+		if err := c.sendMessage(); err != nil {
+			return err
+		}
+	}
+	return c.sendCommandComplete(fmt.Sprintf("SELECT %d", len(rows)))
+}
+
+// serve converses with the client until it disconnects or the context is done.
+func (c *postgresConn) serve(ctx context.Context, db database) error {
+	for {
+		code, _, err := c.readStartupMessage()
+		if err != nil {
+			return err
+		}
+		switch code {
+		case postgresSSLRequest, postgresGSSENCRequest:
+			// Decline encryption, after which the client may proceed without it.
+			if err := c.w.WriteByte('N'); err != nil {
+				return err
+			}
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+			continue
+		case postgresCancelRequest:
+			// Queries run to completion before the server reads the next message.
+			return nil
+		case postgresProtocolVersion3:
+		default:
+			c.sendError("08P01", fmt.Sprintf("unsupported protocol version %d", code))
+			return c.w.Flush()
+		}
+		break
+	}
+	// The server trusts every client, so it accepts the startup parameters as given.
+	c.beginMessage('R')
+	c.appendInt32(0) // AuthenticationOk
+	if err := c.sendMessage(); err != nil {
+		return err
+	}
+	for _, p := range [][2]string{
+		{"server_version", "14.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		if err := c.sendParameterStatus(p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	if err := c.sendReadyForQuery(); err != nil {
+		return err
+	}
+	// failedExtendedQuery indicates that the client began using the extended query protocol, to
+	// which the server responded with an error, so it discards messages until the next Sync.
+	var failedExtendedQuery bool
+	for {
+		kind, body, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case 'Q':
+			failedExtendedQuery = false
+			query, _, _ := strings.Cut(string(body), "\x00")
+			if err := c.answerQuery(ctx, db, query); err != nil {
+				return err
+			}
+			if err := c.sendReadyForQuery(); err != nil {
+				return err
+			}
+		case 'S':
+			failedExtendedQuery = false
+			if err := c.sendReadyForQuery(); err != nil {
+				return err
+			}
+		case 'X':
+			return nil
+		case 'P', 'B', 'D', 'E', 'C', 'H', 'F':
+			if failedExtendedQuery {
+				continue
+			}
+			failedExtendedQuery = true
+			if err := c.sendError("0A000", "only the simple query protocol is supported"); err != nil {
+				return err
+			}
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		default:
+			c.sendError("08P01", fmt.Sprintf("unsupported message type %q", kind))
+			return c.w.Flush()
+		}
+	}
+}
+
+// servePostgres accepts connections from PostgreSQL clients on the given listener until the
+// context is done, answering their read-only queries of a virtual "records" table with the
+// columns "key", "value", and "version" (see recordQuery), so that tools like psql can inspect
+// the database directly. The server neither encrypts connections nor authenticates clients.
+func servePostgres(ctx context.Context, l net.Listener, db database) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() {
+				conn.Close()
+			})
+			defer stop()
+			c := postgresConn{
+				r: bufio.NewReader(conn),
+				w: bufio.NewWriter(conn),
+			}
+			c.serve(ctx, db)
+		}()
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// pipeListener is a net.Listener that accepts in-memory connections made via its dial method.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// dial connects to the listener, returning the client's end of the connection.
+func (l *pipeListener) dial(t *testing.T) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-l.closed:
+		t.Fatal("listener closed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// startPostgresServer serves PostgreSQL clients atop the given store until the test ends,
+// returning the listener to which they may connect.
+func startPostgresServer(t *testing.T, store *idb.ShardedStore) *pipeListener {
+	t.Helper()
+	l := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- servePostgres(ctx, l, store)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serving PostgreSQL clients: %v", err)
+		}
+	})
+	return l
+}
+
+// postgresMessage is a message that the server sent to a client.
+type postgresMessage struct {
+	kind byte
+	body []byte
+}
+
+// newPostgresClient speaks the client's side of the protocol over the given connection, reusing
+// the server's message framing.
+func newPostgresClient(conn net.Conn) *postgresConn {
+	return &postgresConn{
+		r: bufio.NewReader(conn),
+		w: bufio.NewWriter(conn),
+	}
+}
+
+// sendStartupMessage sends a message bearing the given protocol code in lieu of a message type,
+// followed by the given body.
+func sendStartupMessage(t *testing.T, c *postgresConn, code uint32, body []byte) {
+	t.Helper()
+	message := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	message = binary.BigEndian.AppendUint32(message, code)
+	if _, err := c.w.Write(append(message, body...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendClientMessage sends a message of the given type whose body consists of the given
+// null-terminated strings.
+func sendClientMessage(t *testing.T, c *postgresConn, kind byte, strings ...string) {
+	t.Helper()
+	c.beginMessage(kind)
+	for _, s := range strings {
+		c.appendString(s)
+	}
+	if err := c.sendMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readUntilReady reads the messages that the server sends up to and including the next
+// ReadyForQuery message.
+func readUntilReady(t *testing.T, c *postgresConn) []postgresMessage {
+	t.Helper()
+	var messages []postgresMessage
+	for {
+		kind, body, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("reading message after %d others: %v", len(messages), err)
+		}
+		messages = append(messages, postgresMessage{kind, body})
+		if kind == 'Z' {
+			return messages
+		}
+	}
+}
+
+// messageKinds returns the type of each of the given messages, in order.
+func messageKinds(messages []postgresMessage) string {
+	kinds := make([]byte, len(messages))
+	for i, m := range messages {
+		kinds[i] = m.kind
+	}
+	return string(kinds)
+}
+
+// connectPostgres connects to the listener and completes the startup exchange, first requesting
+// and being refused encryption.
+func connectPostgres(t *testing.T, l *pipeListener) *postgresConn {
+	t.Helper()
+	c := newPostgresClient(l.dial(t))
+	sendStartupMessage(t, c, postgresSSLRequest, nil)
+	if b, err := c.r.ReadByte(); err != nil {
+		t.Fatal(err)
+	} else if b != 'N' {
+		t.Fatalf("SSL request: want response %q, got %q", 'N', b)
+	}
+	sendStartupMessage(t, c, postgresProtocolVersion3, []byte("user\x00test\x00database\x00db\x00\x00"))
+	messages := readUntilReady(t, c)
+	if len(messages) < 2 || messages[0].kind != 'R' || !bytes.Equal(messages[0].body, []byte{0, 0, 0, 0}) {
+		t.Fatalf("startup: want AuthenticationOk first, got messages %q", messageKinds(messages))
+	}
+	for _, m := range messages[1 : len(messages)-1] {
+		if m.kind != 'S' {
+			t.Errorf("startup: want only parameter status messages before ReadyForQuery, got %q", m.kind)
+		}
+	}
+	if want, got := []byte{'I'}, messages[len(messages)-1].body; !bytes.Equal(want, got) {
+		t.Errorf("startup: want idle transaction status %q, got %q", want, got)
+	}
+	return c
+}
+
+// postgresErrorCode extracts the SQLSTATE code from the body of an ErrorResponse message.
+func postgresErrorCode(body []byte) string {
+	for len(body) > 0 && body[0] != 0 {
+		kind := body[0]
+		value, rest, _ := bytes.Cut(body[1:], []byte{0})
+		if kind == 'C' {
+			return string(value)
+		}
+		body = rest
+	}
+	return ""
+}
+
+// postgresDataRow extracts the fields from the body of a DataRow message.
+func postgresDataRow(t *testing.T, body []byte) []string {
+	t.Helper()
+	if len(body) < 2 {
+		t.Fatalf("data row too short: %q", body)
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	fields := make([]string, n)
+	for i := range fields {
+		if len(body) < 4 {
+			t.Fatalf("data row truncated at field %d", i)
+		}
+		length := int(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if len(body) < length {
+			t.Fatalf("data row truncated at field %d", i)
+		}
+		fields[i] = string(body[:length])
+		body = body[length:]
+	}
+	return fields
+}
+
+func TestServePostgresAnswersQueries(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for k, v := range map[string]string{"a": "1", "b": "2", "c": "\xff"} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.Insert(ctx, idb.Key(k), idb.Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := make(map[string]string)
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		for _, k := range []string{"b", "c"} {
+			_, version, err := tx.GetVersioned(ctx, idb.Key(k))
+			if err != nil {
+				return false, err
+			}
+			versions[k] = strconv.FormatUint(version, 10)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c := connectPostgres(t, startPostgresServer(t, store))
+
+	sendClientMessage(t, c, 'Q', "SELECT key, value, version FROM records WHERE key >= 'b' ORDER BY key DESC;")
+	messages := readUntilReady(t, c)
+	if want, got := "TDDCZ", messageKinds(messages); want != got {
+		t.Fatalf("select: want messages %q, got %q", want, got)
+	}
+	want := [][]string{
+		{"c", `\xff`, versions["c"]},
+		{"b", "2", versions["b"]},
+	}
+	for i, row := range want {
+		if got := postgresDataRow(t, messages[1+i].body); !slices.Equal(row, got) {
+			t.Errorf("select: want row %d to be %q, got %q", i, row, got)
+		}
+	}
+	if want, got := "SELECT 2\x00", string(messages[3].body); want != got {
+		t.Errorf("select: want command tag %q, got %q", want, got)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		query     string
+		wantKinds string
+		wantCode  string
+	}{
+		{name: "empty query", query: " ; ", wantKinds: "IZ"},
+		{name: "session command", query: "SET search_path = public", wantKinds: "CZ"},
+		{name: "unsupported statement", query: "INSERT INTO records VALUES ('k', 'v')", wantKinds: "EZ", wantCode: "25006"},
+		{name: "deletion", query: "DELETE FROM records", wantKinds: "EZ", wantCode: "25006"},
+		{name: "malformed query", query: "SELECT * FROM elsewhere", wantKinds: "EZ", wantCode: "42601"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sendClientMessage(t, c, 'Q', tc.query)
+			messages := readUntilReady(t, c)
+			if got := messageKinds(messages); got != tc.wantKinds {
+				t.Fatalf("want messages %q, got %q", tc.wantKinds, got)
+			}
+			if len(tc.wantCode) > 0 {
+				if got := postgresErrorCode(messages[0].body); got != tc.wantCode {
+					t.Errorf("want error code %q, got %q", tc.wantCode, got)
+				}
+			}
+		})
+	}
+
+	// The server rejects the extended query protocol once, discarding messages until the next Sync.
+	sendClientMessage(t, c, 'P', "", "SELECT * FROM records")
+	if kind, body, err := c.readMessage(); err != nil {
+		t.Fatal(err)
+	} else if kind != 'E' {
+		t.Fatalf("extended query: want error message, got %q", kind)
+	} else if want, got := "0A000", postgresErrorCode(body); want != got {
+		t.Errorf("extended query: want error code %q, got %q", want, got)
+	}
+	sendClientMessage(t, c, 'B', "", "")
+	sendClientMessage(t, c, 'S')
+	if want, got := "Z", messageKinds(readUntilReady(t, c)); want != got {
+		t.Errorf("extended query: want messages %q after Sync, got %q", want, got)
+	}
+
+	sendClientMessage(t, c, 'X')
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("want connection closed after termination")
+	}
+}
+
+func TestServePostgresRejectsMalformedMessages(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := startPostgresServer(t, store)
+	for _, tc := range []struct {
+		name string
+		// send sends the malformed message, after the startup exchange if connected.
+		send      func(t *testing.T, c *postgresConn)
+		connected bool
+		// wantCode is the SQLSTATE code of the error that the server reports before disconnecting,
+		// or empty if it disconnects without reporting one.
+		wantCode string
+	}{
+		{
+			name: "startup message length too short",
+			send: func(t *testing.T, c *postgresConn) {
+				c.w.Write([]byte{0, 0, 0, 4, 0, 3, 0, 0})
+				c.w.Flush()
+			},
+		},
+		{
+			name: "startup message length too long",
+			send: func(t *testing.T, c *postgresConn) {
+				c.w.Write(binary.BigEndian.AppendUint32(nil, postgresMaxMessageSize+1))
+				c.w.Write(binary.BigEndian.AppendUint32(nil, postgresProtocolVersion3))
+				c.w.Flush()
+			},
+		},
+		{
+			name: "unsupported protocol version",
+			send: func(t *testing.T, c *postgresConn) {
+				sendStartupMessage(t, c, 2<<16, nil)
+			},
+			wantCode: "08P01",
+		},
+		{
+			name: "message length too short",
+			send: func(t *testing.T, c *postgresConn) {
+				c.w.Write([]byte{'Q', 0, 0, 0, 3})
+				c.w.Flush()
+			},
+			connected: true,
+		},
+		{
+			name: "message length too long",
+			send: func(t *testing.T, c *postgresConn) {
+				c.w.WriteByte('Q')
+				c.w.Write(binary.BigEndian.AppendUint32(nil, postgresMaxMessageSize+1))
+				c.w.Flush()
+			},
+			connected: true,
+		},
+		{
+			name: "unsupported message type",
+			send: func(t *testing.T, c *postgresConn) {
+				sendClientMessage(t, c, 'W')
+			},
+			connected: true,
+			wantCode:  "08P01",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c *postgresConn
+			if tc.connected {
+				c = connectPostgres(t, l)
+			} else {
+				c = newPostgresClient(l.dial(t))
+			}
+			tc.send(t, c)
+			if len(tc.wantCode) > 0 {
+				kind, body, err := c.readMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if kind != 'E' {
+					t.Fatalf("want error message, got %q", kind)
+				}
+				if got := postgresErrorCode(body); got != tc.wantCode {
+					t.Errorf("want error code %q, got %q", tc.wantCode, got)
+				}
+			}
+			if kind, _, err := c.readMessage(); err == nil {
+				t.Errorf("want connection closed, got message %q", kind)
+			}
+		})
+	}
+	// The server continues accepting other clients.
+	c := connectPostgres(t, l)
+	sendClientMessage(t, c, 'Q', "SELECT key FROM records")
+	if want, got := "TCZ", messageKinds(readUntilReady(t, c)); want != got {
+		t.Errorf("want messages %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// Prepared batches are the participant's half of the two-phase commit protocol with which a
+// router coordinates batches spanning multiple backends: each backend applies its share of the
+// batch within a transaction and holds that transaction open until the router decides whether to
+// commit or abort it.
+
+const pathPrefixPrepared = "/prepared/"
+
+type preparer interface {
+	PrepareTransaction(ctx context.Context, id string, ttl time.Duration, f func(context.Context, idb.Transaction) error) (uint64, error)
+	CommitPrepared(id string) (uint64, error)
+	AbortPrepared(id string) error
+}
+
+// handlePrepare applies a JSON-encoded list of mutations within a transaction, holding that
+// transaction open until a later request commits or aborts it, or until the batch expires.
+func handlePrepare(w http.ResponseWriter, req *http.Request, id string, db preparer, timeout time.Duration) {
+	var entries []batchEntry
+	if !decodeJSONBody(w, req, &entries) {
+		return
+	}
+	mutations, ok := interpretBatchEntries(w, entries)
+	if !ok {
+		return
+	}
+	results := make([]batchEntryResult, len(mutations))
+	var failure error
+	_, err := db.PrepareTransaction(req.Context(), id, timeout, func(ctx context.Context, tx idb.Transaction) error {
+		failure = applyBatchMutations(ctx, tx, mutations, results)
+		return failure
+	})
+	if err != nil {
+		if failure == nil {
+			respondWithError(w, err)
+			return
+		}
+		speakJSONTo(w)
+		w.WriteHeader(statusCodeForError(err))
+		json.NewEncoder(w).Encode(batchResponse{
+			Results: results,
+		})
+		return
+	}
+	for i := range results {
+		results[i].Status = batchEntryPrepared
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(batchResponse{
+		Results: results,
+	})
+}
+
+// registerPreparedBatchHandlers installs the handlers for requests to prepare batches of
+// mutations and then either commit or abort them, abandoning prepared batches that await a
+// decision for longer than the given positive duration.
+func registerPreparedBatchHandlers(mux *http.ServeMux, db preparer, timeout time.Duration) {
+	mux.HandleFunc(pathPrefixPrepared, func(w http.ResponseWriter, req *http.Request) {
+		rest := strings.TrimPrefix(req.URL.Path, pathPrefixPrepared)
+		id, action, _ := strings.Cut(rest, "/")
+		if len(id) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty batch ID")
+			return
+		}
+		switch action {
+		case "commit":
+			if req.Method != http.MethodPost {
+				rejectMethod(w, req, http.MethodPost)
+				return
+			}
+			txID, err := db.CommitPrepared(id)
+			if err != nil {
+				respondWithError(w, err)
+				return
+			}
+			setCommittedTransaction(w, txID)
+			w.WriteHeader(http.StatusNoContent)
+		case "":
+			switch req.Method {
+			case http.MethodPut:
+				handlePrepare(w, req, id, db, timeout)
+			case http.MethodDelete:
+				if err := db.AbortPrepared(id); err != nil {
+					respondWithError(w, err)
+					return
+				}
+				respondWithSuccessfulDeletion(w)
+			default:
+				rejectMethod(w, req, http.MethodPut, http.MethodDelete)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// problemTypePrefix precedes the name of each kind of database failure to form the URI that
+// identifies its problem type.
+const problemTypePrefix = "urn:sehlabs:db:problem:"
+
+// problemDetails describes why a request failed, in the "application/problem+json" format that
+// RFC 9457 prescribes.
+type problemDetails struct {
+	// Type is a URI identifying the kind of failure, which is "about:blank" when the failure has no
+	// meaning beyond its HTTP status code.
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Key is the key of the record to which the failure pertains, if any.
+	Key *string `json:"key,omitempty"`
+	// Journal is the journal of the request's transactions, if the client requested it (see
+	// withTransactionJournal).
+	Journal []string `json:"journal,omitempty"`
+}
+
+// databaseFailure relates an error that the database may return to the HTTP status code and
+// problem type with which to respond to requests that fail due to it.
+type databaseFailure struct {
+	err    error
+	status int
+	name   string
+	title  string
+}
+
+// databaseFailures are the errors that the database may return, in order of precedence, since an
+// error may match several of them.
+var databaseFailures = []databaseFailure{
+	{idb.ErrTransactionInConflict, http.StatusConflict, "transaction-in-conflict", "Transaction conflicts with another transaction"},
+	{idb.ErrRecordExists, http.StatusConflict, "record-exists", "Record exists"},
+	{idb.ErrRecordDoesNotExist, http.StatusNotFound, "record-does-not-exist", "Record does not exist"},
+	{idb.ErrInvalidKey, http.StatusBadRequest, "invalid-key", "Key is invalid"},
+	{idb.ErrInvalidValue, http.StatusBadRequest, "invalid-value", "Value is invalid"},
+	{idb.ErrProcedureNotFound, http.StatusNotFound, "procedure-not-found", "Procedure not found"},
+	{idb.ErrTransactionTooLarge, http.StatusRequestEntityTooLarge, "transaction-too-large", "Transaction writes too many records"},
+	{idb.ErrValueTooLarge, http.StatusRequestEntityTooLarge, "value-too-large", "Value is too large"},
+	{idb.ErrWriteRateExceeded, http.StatusTooManyRequests, "write-rate-exceeded", "Record is written too often"},
+	{idb.ErrQuotaExceeded, http.StatusTooManyRequests, "quota-exceeded", "Quota exceeded"},
+	{idb.ErrTransactionAborted, http.StatusConflict, "transaction-aborted", "Transaction was aborted"},
+	{idb.ErrLeaseNotFound, http.StatusNotFound, "lease-not-found", "Lease not found"},
+	{idb.ErrMessageNotLeased, http.StatusConflict, "message-not-leased", "Queue message is not held under lease"},
+	{idb.ErrPreparedTransactionExists, http.StatusConflict, "prepared-transaction-exists", "Prepared transaction exists"},
+	{idb.ErrPreparedTransactionNotFound, http.StatusNotFound, "prepared-transaction-not-found", "Prepared transaction not found"},
+	{idb.ErrRecordNotInTrash, http.StatusNotFound, "record-not-in-trash", "Record is not in trash"},
+	{idb.ErrAssertionFailed, http.StatusPreconditionFailed, "assertion-failed", "Assertion failed"},
+	{idb.ErrNamespaceNotFound, http.StatusNotFound, "namespace-not-found", "Namespace not found"},
+	{idb.ErrNamespaceExists, http.StatusConflict, "namespace-exists", "Namespace exists"},
+	{idb.ErrReadOnlyTransaction, http.StatusForbidden, "read-only-transaction", "Transaction is read-only"},
+	{idb.ErrStoreFailed, http.StatusServiceUnavailable, "store-failed", "Database failed"},
+	{idb.ErrStoreClosed, http.StatusServiceUnavailable, "store-closed", "Database is closed"},
+	{idb.ErrTransactionCancelled, http.StatusServiceUnavailable, "transaction-cancelled", "Transaction was cancelled"},
+	{idb.ErrTimeout, http.StatusServiceUnavailable, "timeout", "Database operation did not complete in time"},
+	{idb.ErrCancelled, http.StatusServiceUnavailable, "cancelled", "Database operation was cancelled"},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout", "Database operation did not complete in time"},
+}
+
+// classifyError finds the kind of database failure that the given error represents, if any.
+func classifyError(err error) (databaseFailure, bool) {
+	for _, f := range databaseFailures {
+		if errors.Is(err, f.err) {
+			return f, true
+		}
+	}
+	return databaseFailure{}, false
+}
+
+// statusCodeForError determines the HTTP status code with which to respond to a request that
+// failed due to the given error.
+func statusCodeForError(err error) int {
+	if f, ok := classifyError(err); ok {
+		return f.status
+	}
+	return http.StatusInternalServerError
+}
+
+// problemForError describes the given error with which a request failed.
+func problemForError(err error) problemDetails {
+	p := problemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+		Detail: err.Error(),
+	}
+	if f, ok := classifyError(err); ok {
+		p.Type = problemTypePrefix + f.name
+		p.Title = f.title
+		p.Status = f.status
+	}
+	if k, ok := idb.KeyOfError(err); ok {
+		key := string(k)
+		p.Key = &key
+	}
+	return p
+}
+
+// respondWithError responds to a request that failed due to the given error, describing the
+// failure per RFC 9457.
+func respondWithError(w http.ResponseWriter, err error) {
+	respondWithProblemDetails(w, problemForError(err))
+}
+
+// respondWithProblem responds to a request that failed for reasons other than an error from the
+// database, such as the request being malformed, with the given HTTP status code, explaining the
+// failure with the given format and arguments as for fmt.Sprintf.
+func respondWithProblem(w http.ResponseWriter, status int, format string, args ...any) {
+	respondWithProblemDetails(w, problemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func respondWithProblemDetails(w http.ResponseWriter, p problemDetails) {
+	if jw, ok := w.(*journalingResponseWriter); ok {
+		p.Journal = jw.journalEntries()
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const pathPrefixProcedure = "/procedures/"
+
+type procedureCaller interface {
+	CallProcedure(ctx context.Context, name string, args map[string]string) (any, error)
+}
+
+type procedureRequest struct {
+	Args map[string]string `json:"args"`
+}
+
+type procedureResponse struct {
+	Result any `json:"result"`
+}
+
+// registerProcedureHandlers installs the handler for requests to call the stored procedures that
+// the embedding application registered with the database.
+func registerProcedureHandlers(mux *http.ServeMux, db procedureCaller) {
+	mux.HandleFunc(pathPrefixProcedure, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		handleCallProcedure(req.Context(), w, req, db)
+	})
+}
+
+// handleCallProcedure calls the procedure named in the URL path within a transaction, passing it
+// the arguments from the JSON-encoded request body.
+func handleCallProcedure(ctx context.Context, w http.ResponseWriter, req *http.Request, db procedureCaller) {
+	name := strings.TrimPrefix(req.URL.Path, pathPrefixProcedure)
+	if len(name) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "Procedure name must be nonempty")
+		return
+	}
+	var request procedureRequest
+	if !decodeJSONBody(w, req, &request) {
+		return
+	}
+	result, err := db.CallProcedure(ctx, name, request.Args)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(procedureResponse{Result: result})
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// queryTable is the name of the only table that queries may read, holding one row per record.
+const queryTable = "records"
+
+const (
+	queryColumnKey     = "key"
+	queryColumnValue   = "value"
+	queryColumnVersion = "version"
+)
+
+// queryCondition restricts the rows that a query selects by comparing a record's key or value with
+// an operand, bytewise, or its version with a number.
+type queryCondition struct {
+	column  string
+	op      string
+	operand []byte
+	// pattern is the operand of a LIKE condition, translated into a glob pattern (see globMatch).
+	pattern []byte
+	// version is the operand of a condition on the version column.
+	version uint64
+}
+
+func (c *queryCondition) matches(k idb.Key, v idb.Value, version uint64) bool {
+	if c.column == queryColumnVersion {
+		return c.holds(cmp.Compare(version, c.version))
+	}
+	field := []byte(k)
+	if c.column == queryColumnValue {
+		field = v
+	}
+	switch c.op {
+	case "LIKE":
+		return globMatch(c.pattern, field)
+	case "NOT LIKE":
+		return !globMatch(c.pattern, field)
+	}
+	return c.holds(bytes.Compare(field, c.operand))
+}
+
+// holds reports whether the condition's comparison operator holds, given the result of comparing
+// a field with the operand.
+func (c *queryCondition) holds(cmp int) bool {
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default: // ">="
+		return cmp >= 0
+	}
+}
+
+// recordQuery is a parsed read-only SQL query of the form
+//
+//	SELECT columns FROM records [WHERE condition [AND condition]...]
+//	    [ORDER BY key [ASC | DESC]] [LIMIT n]
+//
+// where columns is either "*" or a comma-separated list of "key", "value", and "version", and each
+// condition compares "key" or "value" with a single-quoted string literal via "=", "<>", "!=",
+// "<", "<=", ">", ">=", "LIKE", or "NOT LIKE", or compares "version" with an unsigned integer via
+// any of those operators but "LIKE" and "NOT LIKE". In LIKE patterns, "%" matches any sequence of bytes,
+// "_" matches any single byte, and "\" escapes the byte that follows it. Keywords are
+// case-insensitive.
+type recordQuery struct {
+	columns    []string
+	conditions []queryCondition
+	descending bool
+	limit      int // NB: Negative means unbounded.
+}
+
+type queryTokenKind uint8
+
+const (
+	queryTokenWord queryTokenKind = iota
+	queryTokenString
+	queryTokenNumber
+	queryTokenSymbol
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+func (t queryToken) String() string {
+	if t.kind == queryTokenString {
+		return "'" + strings.ReplaceAll(t.text, "'", "''") + "'"
+	}
+	return t.text
+}
+
+// isKeyword reports whether the token is the given keyword, ignoring case.
+func (t queryToken) isKeyword(keyword string) bool {
+	return t.kind == queryTokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func tokenizeQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '\'':
+			var text []byte
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated string literal")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				text = append(text, s[i])
+			}
+			tokens = append(tokens, queryToken{queryTokenString, string(text)})
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, queryToken{queryTokenNumber, s[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, queryToken{queryTokenWord, s[i:j]})
+			i = j
+		default:
+			symbol := s[i : i+1]
+			for _, candidate := range []string{"<>", "!=", "<=", ">="} {
+				if strings.HasPrefix(s[i:], candidate) {
+					symbol = candidate
+					break
+				}
+			}
+			if len(symbol) == 1 && !strings.Contains("*,=<>;", symbol) {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, queryToken{queryTokenSymbol, symbol})
+			i += len(symbol)
+		}
+	}
+	return tokens, nil
+}
+
+// queryParser consumes the tokens of a query in order.
+type queryParser struct {
+	tokens []queryToken
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if len(p.tokens) == 0 {
+		return queryToken{}, false
+	}
+	return p.tokens[0], true
+}
+
+func (p *queryParser) next(expected string) (queryToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("expected %s, but query ended", expected)
+	}
+	p.tokens = p.tokens[1:]
+	return t, nil
+}
+
+func (p *queryParser) keyword(keyword string) bool {
+	if t, ok := p.peek(); ok && t.isKeyword(keyword) {
+		p.tokens = p.tokens[1:]
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectKeyword(keyword string) error {
+	t, err := p.next(keyword)
+	if err != nil {
+		return err
+	}
+	if !t.isKeyword(keyword) {
+		return fmt.Errorf("expected %s, got %s", keyword, t)
+	}
+	return nil
+}
+
+func (p *queryParser) symbol(symbol string) bool {
+	if t, ok := p.peek(); ok && t.kind == queryTokenSymbol && t.text == symbol {
+		p.tokens = p.tokens[1:]
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) column(allowVersion bool) (string, error) {
+	t, err := p.next("a column name")
+	if err != nil {
+		return "", err
+	}
+	if t.kind == queryTokenWord {
+		switch column := strings.ToLower(t.text); column {
+		case queryColumnKey, queryColumnValue:
+			return column, nil
+		case queryColumnVersion:
+			if allowVersion {
+				return column, nil
+			}
+		}
+	}
+	if allowVersion {
+		return "", fmt.Errorf("expected column %q, %q, or %q, got %s", queryColumnKey, queryColumnValue, queryColumnVersion, t)
+	}
+	return "", fmt.Errorf("expected column %q or %q, got %s", queryColumnKey, queryColumnValue, t)
+}
+
+// likePattern translates a SQL LIKE pattern into a glob pattern.
+func likePattern(s string) []byte {
+	var pattern []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '%':
+			pattern = append(pattern, '*')
+		case '_':
+			pattern = append(pattern, '?')
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				pattern = append(pattern, '\\', s[i])
+			}
+		case '*', '?':
+			pattern = append(pattern, '\\', c)
+		default:
+			pattern = append(pattern, c)
+		}
+	}
+	return pattern
+}
+
+// globLiteral returns a glob pattern matching only the given bytes.
+func globLiteral(b []byte) []byte {
+	var pattern []byte
+	for _, c := range b {
+		if c == '*' || c == '?' || c == '\\' {
+			pattern = append(pattern, '\\')
+		}
+		pattern = append(pattern, c)
+	}
+	return pattern
+}
+
+func (p *queryParser) condition() (queryCondition, error) {
+	column, err := p.column(true)
+	if err != nil {
+		return queryCondition{}, err
+	}
+	c := queryCondition{column: column}
+	t, err := p.next("a comparison operator")
+	if err != nil {
+		return c, err
+	}
+	switch {
+	case t.isKeyword("LIKE"):
+		c.op = "LIKE"
+	case t.isKeyword("NOT"):
+		if err := p.expectKeyword("LIKE"); err != nil {
+			return c, err
+		}
+		c.op = "NOT LIKE"
+	case t.kind == queryTokenSymbol && slices.Contains([]string{"=", "<>", "!=", "<", "<=", ">", ">="}, t.text):
+		c.op = t.text
+		if c.op == "!=" {
+			c.op = "<>"
+		}
+	default:
+		return c, fmt.Errorf("expected a comparison operator, got %s", t)
+	}
+	if column == queryColumnVersion {
+		if strings.HasSuffix(c.op, "LIKE") {
+			return c, fmt.Errorf("column %q may not be compared via %s", queryColumnVersion, c.op)
+		}
+		t, err := p.next("a version number")
+		if err != nil {
+			return c, err
+		}
+		if t.kind == queryTokenNumber {
+			if c.version, err = strconv.ParseUint(t.text, 10, 64); err == nil {
+				return c, nil
+			}
+		}
+		return c, fmt.Errorf("expected a version number, got %s", t)
+	}
+	t, err = p.next("a string literal")
+	if err != nil {
+		return c, err
+	}
+	if t.kind != queryTokenString {
+		return c, fmt.Errorf("expected a string literal, got %s", t)
+	}
+	c.operand = []byte(t.text)
+	if strings.HasSuffix(c.op, "LIKE") {
+		c.pattern = likePattern(t.text)
+	}
+	return c, nil
+}
+
+func parseRecordQuery(s string) (*recordQuery, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := queryParser{tokens}
+	q := recordQuery{limit: -1}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.symbol("*") {
+		q.columns = []string{queryColumnKey, queryColumnValue, queryColumnVersion}
+	} else {
+		for {
+			column, err := p.column(true)
+			if err != nil {
+				return nil, err
+			}
+			q.columns = append(q.columns, column)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if t, err := p.next("a table name"); err != nil {
+		return nil, err
+	} else if !t.isKeyword(queryTable) {
+		return nil, fmt.Errorf("unknown table %s; must be %q", t, queryTable)
+	}
+	if p.keyword("WHERE") {
+		for {
+			c, err := p.condition()
+			if err != nil {
+				return nil, err
+			}
+			q.conditions = append(q.conditions, c)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if column, err := p.column(false); err != nil {
+			return nil, err
+		} else if column != queryColumnKey {
+			return nil, fmt.Errorf("queries may only be ordered by column %q", queryColumnKey)
+		}
+		if p.keyword("DESC") {
+			q.descending = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+	if p.keyword("LIMIT") {
+		t, err := p.next("a row count")
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(t.text)
+		if t.kind != queryTokenNumber || err != nil {
+			return nil, fmt.Errorf("expected a row count, got %s", t)
+		}
+		q.limit = n
+	}
+	p.symbol(";")
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %s after end of query", t)
+	}
+	return &q, nil
+}
+
+// keyPrefix returns the longest prefix shared by all the keys that the query could select, with
+// which to narrow a scan.
+func (q *recordQuery) keyPrefix() idb.Key {
+	var patterns [][]byte
+	for _, c := range q.conditions {
+		if c.column != queryColumnKey {
+			continue
+		}
+		switch c.op {
+		case "=":
+			patterns = append(patterns, globLiteral(c.operand))
+		case "LIKE":
+			patterns = append(patterns, c.pattern)
+		}
+	}
+	return (&recordFilter{keyPatterns: patterns}).keyPrefix()
+}
+
+func (q *recordQuery) matches(k idb.Key, v idb.Value, version uint64) bool {
+	for i := range q.conditions {
+		if !q.conditions[i].matches(k, v, version) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryRow is a record selected by a query.
+type queryRow struct {
+	key     idb.Key
+	value   idb.Value
+	version uint64
+}
+
+// run selects the rows that the query demands, observing the records as of a single point in
+// time.
+func (q *recordQuery) run(ctx context.Context, db database) ([]queryRow, error) {
+	wantsVersion := slices.Contains(q.columns, queryColumnVersion) || slices.ContainsFunc(q.conditions, func(c queryCondition) bool {
+		return c.column == queryColumnVersion
+	})
+	var rows []queryRow
+	if err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		rows = rows[:0]
+		for k, v := range tx.Scan(ctx, q.keyPrefix()) {
+			var version uint64
+			if wantsVersion {
+				var err error
+				if _, version, err = tx.GetVersioned(ctx, k); err != nil {
+					return false, err
+				}
+			}
+			if !q.matches(k, v, version) {
+				continue
+			}
+			row := queryRow{key: k, version: version}
+			v.CopyInto(&row.value)
+			rows = append(rows, row)
+		}
+		// Should the scan stop early, WithinTransaction returns its error in place of this nil, so
+		// we never sort and page through a partial set of rows.
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(rows, func(a, b queryRow) int {
+		if q.descending {
+			return bytes.Compare(b.key, a.key)
+		}
+		return bytes.Compare(a.key, b.key)
+	})
+	if q.limit >= 0 && len(rows) > q.limit {
+		rows = rows[:q.limit]
+	}
+	return rows, nil
+}
+
+// handleQuery answers the read-only SQL query given by the "q" query parameter (see recordQuery)
+// with the selected rows, ordered by key, either as a JSON array of objects or, if the "format"
+// query parameter is "csv", as CSV with a header row naming the columns. In JSON, a key or value
+// that isn't valid UTF-8 appears base64-encoded in a "key_base64" or "value_base64" field instead.
+func handleQuery(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	query := req.URL.Query()
+	format := query.Get("format")
+	if len(format) > 0 && format != "json" && format != exportFormatCSV {
+		respondWithProblem(w, http.StatusBadRequest, "Unsupported query result format %q; must be %q or %q", format, "json", exportFormatCSV)
+		return
+	}
+	q, err := parseRecordQuery(query.Get("q"))
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Invalid query: %v", err)
+		return
+	}
+	rows, err := q.run(ctx, db)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(q.columns)
+		fields := make([]string, len(q.columns))
+		for _, row := range rows {
+			for i, column := range q.columns {
+				switch column {
+				case queryColumnKey:
+					fields[i] = string(row.key)
+				case queryColumnValue:
+					fields[i] = string(row.value)
+				case queryColumnVersion:
+					fields[i] = strconv.FormatUint(row.version, 10)
+				}
+			}
+			cw.Write(fields)
+		}
+		cw.Flush()
+		return
+	}
+	objects := make([]map[string]any, len(rows))
+	for i, row := range rows {
+		object := make(map[string]any, len(q.columns))
+		for _, column := range q.columns {
+			switch column {
+			case queryColumnKey, queryColumnValue:
+				b := []byte(row.key)
+				if column == queryColumnValue {
+					b = row.value
+				}
+				if text, encoded := textOrBase64(b); text != nil {
+					object[column] = *text
+				} else {
+					object[column+"_base64"] = *encoded
+				}
+			case queryColumnVersion:
+				object[column] = row.version
+			}
+		}
+		objects[i] = object
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(objects)
+}
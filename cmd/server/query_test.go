@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+func TestParseRecordQuery(t *testing.T) {
+	allColumns := []string{queryColumnKey, queryColumnValue, queryColumnVersion}
+	for _, tc := range []struct {
+		query string
+		want  recordQuery
+	}{
+		{
+			query: "SELECT * FROM records",
+			want:  recordQuery{columns: allColumns, limit: -1},
+		},
+		{
+			query: "select value, KEY from Records;",
+			want:  recordQuery{columns: []string{queryColumnValue, queryColumnKey}, limit: -1},
+		},
+		{
+			query: "SELECT version FROM records WHERE key = 'it''s' AND value != 'x'",
+			want: recordQuery{
+				columns: []string{queryColumnVersion},
+				conditions: []queryCondition{
+					{column: queryColumnKey, op: "=", operand: []byte("it's")},
+					{column: queryColumnValue, op: "<>", operand: []byte("x")},
+				},
+				limit: -1,
+			},
+		},
+		{
+			query: `SELECT key FROM records WHERE key LIKE '50\%_*' AND value NOT LIKE '%x'`,
+			want: recordQuery{
+				columns: []string{queryColumnKey},
+				conditions: []queryCondition{
+					{column: queryColumnKey, op: "LIKE", operand: []byte(`50\%_*`), pattern: []byte(`50\%?\*`)},
+					{column: queryColumnValue, op: "NOT LIKE", operand: []byte("%x"), pattern: []byte("*x")},
+				},
+				limit: -1,
+			},
+		},
+		{
+			query: "SELECT * FROM records WHERE version >= 12 AND version<>13 AND key<='m'",
+			want: recordQuery{
+				columns: allColumns,
+				conditions: []queryCondition{
+					{column: queryColumnVersion, op: ">=", version: 12},
+					{column: queryColumnVersion, op: "<>", version: 13},
+					{column: queryColumnKey, op: "<=", operand: []byte("m")},
+				},
+				limit: -1,
+			},
+		},
+		{
+			query: "SELECT * FROM records ORDER BY key",
+			want:  recordQuery{columns: allColumns, limit: -1},
+		},
+		{
+			query: "SELECT * FROM records ORDER BY key ASC LIMIT 0",
+			want:  recordQuery{columns: allColumns, limit: 0},
+		},
+		{
+			query: "SELECT * FROM records order by key desc limit 5;",
+			want:  recordQuery{columns: allColumns, descending: true, limit: 5},
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			got, err := parseRecordQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&tc.want, got) {
+				t.Errorf("want %+v, got %+v", tc.want, *got)
+			}
+		})
+	}
+}
+
+func TestParseRecordQueryRejectsSyntaxErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		// wantMessage is a fragment of the expected error's message.
+		wantMessage string
+	}{
+		{query: "", wantMessage: "expected SELECT, but query ended"},
+		{query: "DELETE FROM records", wantMessage: "expected SELECT, got DELETE"},
+		{query: "SELECT FROM records", wantMessage: "expected column"},
+		{query: "SELECT key, FROM records", wantMessage: "expected column"},
+		{query: "SELECT size FROM records", wantMessage: "expected column"},
+		{query: "SELECT * records", wantMessage: "expected FROM, got records"},
+		{query: "SELECT * FROM", wantMessage: "expected a table name, but query ended"},
+		{query: "SELECT * FROM users", wantMessage: "unknown table users"},
+		{query: "SELECT * FROM records WHERE", wantMessage: "expected a column name, but query ended"},
+		{query: "SELECT * FROM records WHERE key", wantMessage: "expected a comparison operator, but query ended"},
+		{query: "SELECT * FROM records WHERE key IS 'a'", wantMessage: "expected a comparison operator, got IS"},
+		{query: "SELECT * FROM records WHERE key NOT = 'a'", wantMessage: "expected LIKE, got ="},
+		{query: "SELECT * FROM records WHERE key ~ 'a'", wantMessage: "unexpected character '~'"},
+		{query: "SELECT * FROM records WHERE key = 1", wantMessage: "expected a string literal, got 1"},
+		{query: "SELECT * FROM records WHERE key =", wantMessage: "expected a string literal, but query ended"},
+		{query: "SELECT * FROM records WHERE key = 'a", wantMessage: "unterminated string literal"},
+		{query: "SELECT * FROM records WHERE key = 'a' AND", wantMessage: "expected a column name, but query ended"},
+		{query: "SELECT * FROM records WHERE key = 'a' OR key = 'b'", wantMessage: "unexpected OR after end of query"},
+		{query: "SELECT * FROM records WHERE version = '1'", wantMessage: "expected a version number, got '1'"},
+		{query: "SELECT * FROM records WHERE version < 18446744073709551616", wantMessage: "expected a version number"},
+		{query: "SELECT * FROM records WHERE version LIKE '1%'", wantMessage: `column "version" may not be compared via LIKE`},
+		{query: "SELECT * FROM records ORDER key", wantMessage: "expected BY, got key"},
+		{query: "SELECT * FROM records ORDER BY value", wantMessage: `ordered by column "key"`},
+		{query: "SELECT * FROM records ORDER BY version", wantMessage: "expected column"},
+		{query: "SELECT * FROM records LIMIT", wantMessage: "expected a row count, but query ended"},
+		{query: "SELECT * FROM records LIMIT all", wantMessage: "expected a row count, got all"},
+		{query: "SELECT * FROM records LIMIT 99999999999999999999", wantMessage: "expected a row count"},
+		{query: "SELECT * FROM records;;", wantMessage: "unexpected ; after end of query"},
+		{query: "SELECT * FROM records LIMIT 1 ORDER BY key", wantMessage: "unexpected ORDER after end of query"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := parseRecordQuery(tc.query)
+			if err == nil {
+				t.Fatalf("want error, got query %+v", *q)
+			}
+			if !strings.Contains(err.Error(), tc.wantMessage) {
+				t.Errorf("want error mentioning %q, got %v", tc.wantMessage, err)
+			}
+		})
+	}
+}
+
+func TestRecordQueryRun(t *testing.T) {
+	store, err := idb.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// Insert the records one at a time, so that each bears its own version.
+	versions := make(map[string]uint64)
+	for _, r := range [][2]string{{"a", "apple"}, {"b", "banana"}, {"c", "cherry"}, {"ab", "avocado"}, {"50%", "half"}} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			return true, tx.Insert(ctx, idb.Key(r[0]), idb.Value(r[1]))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+			_, version, err := tx.GetVersioned(ctx, idb.Key(r[0]))
+			versions[r[0]] = version
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versionB := versions["b"]
+	for _, tc := range []struct {
+		where    string
+		wantKeys []string
+	}{
+		{where: "", wantKeys: []string{"50%", "a", "ab", "b", "c"}},
+		{where: "WHERE key = 'b'", wantKeys: []string{"b"}},
+		{where: "WHERE key <> 'b'", wantKeys: []string{"50%", "a", "ab", "c"}},
+		{where: "WHERE key > 'a' AND key < 'c'", wantKeys: []string{"ab", "b"}},
+		{where: "WHERE key LIKE 'a%'", wantKeys: []string{"a", "ab"}},
+		{where: "WHERE key LIKE 'a_'", wantKeys: []string{"ab"}},
+		{where: "WHERE key NOT LIKE 'a%'", wantKeys: []string{"50%", "b", "c"}},
+		{where: `WHERE key LIKE '50\%'`, wantKeys: []string{"50%"}},
+		{where: "WHERE key = 'z'", wantKeys: nil},
+		{where: "WHERE value = 'banana'", wantKeys: []string{"b"}},
+		{where: "WHERE value LIKE '%an%'", wantKeys: []string{"b"}},
+		{where: "WHERE value >= 'c' AND value < 'd'", wantKeys: []string{"c"}},
+		{where: "WHERE value LIKE 'a%' AND key LIKE 'a%'", wantKeys: []string{"a", "ab"}},
+		{where: fmt.Sprintf("WHERE version = %d", versionB), wantKeys: []string{"b"}},
+		{where: fmt.Sprintf("WHERE version <= %d", versionB), wantKeys: []string{"a", "b"}},
+		{where: fmt.Sprintf("WHERE version > %d", versionB), wantKeys: []string{"50%", "ab", "c"}},
+		{where: fmt.Sprintf("WHERE version != %d AND key LIKE 'a%%'", versions["a"]), wantKeys: []string{"ab"}},
+		{where: fmt.Sprintf("WHERE version > %d AND value LIKE '%%y'", versionB), wantKeys: []string{"c"}},
+		{where: "ORDER BY key DESC LIMIT 2", wantKeys: []string{"c", "b"}},
+		{where: "WHERE key LIKE 'a%' LIMIT 0", wantKeys: nil},
+	} {
+		t.Run(tc.where, func(t *testing.T) {
+			q, err := parseRecordQuery("SELECT key, version FROM records " + tc.where)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := q.run(ctx, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, row := range rows {
+				keys = append(keys, string(row.key))
+				if want, got := versions[string(row.key)], row.version; want != got {
+					t.Errorf("record %q: want version %d, got %d", row.key, want, got)
+				}
+			}
+			if !slices.Equal(tc.wantKeys, keys) {
+				t.Errorf("want keys %q, got %q", tc.wantKeys, keys)
+			}
+		})
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	server, fake := newTestServer(t)
+	ctx := context.Background()
+	if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		return true, tx.Insert(ctx, idb.Key("k"), idb.Value("v"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var version uint64
+	if err := fake.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		var err error
+		_, version, err = tx.GetVersioned(ctx, idb.Key("k"))
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query      url.Values
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			query:      url.Values{"q": {"SELECT key, value FROM records WHERE key = 'k'"}},
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"key":"k","value":"v"}]` + "\n",
+		},
+		{
+			query:      url.Values{"q": {"SELECT * FROM records WHERE version = " + strconv.FormatUint(version, 10)}, "format": {"csv"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "key,value,version\nk,v," + strconv.FormatUint(version, 10) + "\n",
+		},
+		{
+			query:      url.Values{"q": {"SELECT key FROM records WHERE version > " + strconv.FormatUint(version, 10)}},
+			wantStatus: http.StatusOK,
+			wantBody:   "[]\n",
+		},
+		{query: url.Values{"q": {"SELECT * FROM records WHERE"}}, wantStatus: http.StatusBadRequest},
+		{query: url.Values{}, wantStatus: http.StatusBadRequest},
+		{query: url.Values{"q": {"SELECT * FROM records"}, "format": {"xml"}}, wantStatus: http.StatusBadRequest},
+	} {
+		res, body := sendRequest(t, server, http.MethodGet, "/query?"+tc.query.Encode(), nil)
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s: want status %d, got %d (%s)", tc.query.Encode(), tc.wantStatus, res.StatusCode, body)
+			continue
+		}
+		if len(tc.wantBody) > 0 && body != tc.wantBody {
+			t.Errorf("%s: want body %q, got %q", tc.query.Encode(), tc.wantBody, body)
+		}
+	}
+}
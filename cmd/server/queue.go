@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+const pathPrefixQueue = "/queues/"
+
+type queuer interface {
+	Enqueue(ctx context.Context, queue string, body idb.Value) (uint64, error)
+	Dequeue(ctx context.Context, queue string, visibilityTimeout time.Duration) (idb.QueueMessage, bool, error)
+	AcknowledgeMessage(ctx context.Context, queue string, id, leaseID uint64) error
+	ReleaseMessage(ctx context.Context, queue string, id, leaseID uint64) error
+}
+
+type enqueueResponse struct {
+	ID uint64 `json:"id"`
+}
+
+type queueMessage struct {
+	ID          uint64  `json:"id"`
+	Lease       uint64  `json:"lease"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+func handleEnqueue(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db queuer) {
+	if !parseForm(w, req) {
+		return
+	}
+	id, err := db.Enqueue(ctx, name, idb.Value(req.FormValue("value")))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	speakJSONTo(w)
+	setLocation(w, pathPrefixQueue+name+"/"+strconv.FormatUint(id, 10))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(enqueueResponse{
+		ID: id,
+	})
+}
+
+func handleDequeue(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db queuer) {
+	if !parseForm(w, req) {
+		return
+	}
+	const formKey = "timeout"
+	timeout, err := time.ParseDuration(req.FormValue(formKey))
+	if err != nil || timeout <= 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must be a positive duration", formKey)
+		return
+	}
+	m, ok, err := db.Dequeue(ctx, name, timeout)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	value, valueBase64 := textOrBase64(m.Body)
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(queueMessage{
+		ID:          m.ID,
+		Lease:       m.LeaseID,
+		Value:       value,
+		ValueBase64: valueBase64,
+	})
+}
+
+// handleSettleMessage acknowledges or releases the message with the given ID in the named queue,
+// held under the lease identified in the request's form.
+func handleSettleMessage(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, id uint64, settle func(ctx context.Context, queue string, id, leaseID uint64) error) {
+	if !parseForm(w, req) {
+		return
+	}
+	const formKey = "lease"
+	leaseID, err := strconv.ParseUint(req.FormValue(formKey), 10, 64)
+	if err != nil || leaseID == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must identify a lease", formKey)
+		return
+	}
+	if err := settle(ctx, name, id, leaseID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerQueueHandlers installs the handlers for requests to enqueue messages in named queues,
+// and to dequeue, acknowledge, and release them.
+func registerQueueHandlers(mux *http.ServeMux, db queuer) {
+	mux.HandleFunc(pathPrefixQueue, func(w http.ResponseWriter, req *http.Request) {
+		rest := strings.TrimPrefix(req.URL.Path, pathPrefixQueue)
+		name, rest, _ := strings.Cut(rest, "/")
+		if len(name) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty queue name")
+			return
+		}
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		switch rest {
+		case "":
+			handleEnqueue(req.Context(), w, req, name, db)
+			return
+		case "dequeue":
+			handleDequeue(req.Context(), w, req, name, db)
+			return
+		}
+		idText, action, _ := strings.Cut(rest, "/")
+		id, err := strconv.ParseUint(idText, 10, 64)
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Invalid message ID: %v", err)
+			return
+		}
+		switch action {
+		case "ack":
+			handleSettleMessage(req.Context(), w, req, name, id, db.AcknowledgeMessage)
+		case "nack":
+			handleSettleMessage(req.Context(), w, req, name, id, db.ReleaseMessage)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
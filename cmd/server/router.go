@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// router forwards client requests to the backend server processes among which it partitions the
+// records, choosing the backend that owns each record's key by consistent hashing. It coordinates
+// batches that span multiple backends with two-phase commit, using the backends' prepared batches.
+type router struct {
+	backends []*url.URL
+	proxies  []*httputil.ReverseProxy
+	ring     *idb.ConsistentHashRing
+	client   http.Client
+}
+
+func newRouter(backends []string, virtualNodes int) (*router, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+	ring, err := idb.NewConsistentHashRing(len(backends), virtualNodes)
+	if err != nil {
+		return nil, err
+	}
+	r := router{
+		backends: make([]*url.URL, len(backends)),
+		proxies:  make([]*httputil.ReverseProxy, len(backends)),
+		ring:     ring,
+	}
+	for i, b := range backends {
+		u, err := url.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q is not a valid URL: %w", b, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("backend %q must be an absolute HTTP or HTTPS URL", b)
+		}
+		r.backends[i] = u
+		r.proxies[i] = httputil.NewSingleHostReverseProxy(u)
+	}
+	return &r, nil
+}
+
+func (r *router) backendFor(k idb.Key) int {
+	return int(r.ring.Project(k))
+}
+
+// call sends a request with the given JSON-encoded body, if any, to the given backend, decoding
+// a JSON response into dst, if non-nil. It returns the response's status code, along with an
+// error carrying the response's text or problem details if the response indicates failure without
+// JSON.
+func (r *router) call(ctx context.Context, backend int, method, path string, body, dst any) (int, error) {
+	var content io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		content = bytes.NewReader(b)
+	}
+	u := r.backends[backend].JoinPath(path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), content)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if dst != nil && mediaType == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to decode response from backend %s: %w", r.backends[backend].Host, err)
+		}
+		return resp.StatusCode, nil
+	}
+	if mediaType == "application/problem+json" {
+		var p problemDetails
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&p); err == nil {
+			return resp.StatusCode, fmt.Errorf("backend %s responded with status code %d: %s: %s", r.backends[backend].Host, resp.StatusCode, p.Title, p.Detail)
+		}
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, fmt.Errorf("backend %s responded with status code %d: %s", r.backends[backend].Host, resp.StatusCode, strings.TrimSpace(string(text)))
+	}
+	return resp.StatusCode, nil
+}
+
+// participant is a backend's share of a batch.
+type participant struct {
+	backend int
+	entries []batchEntry
+	// indices relate the participant's entries to their positions within the whole batch.
+	indices []int
+	status  int
+	results batchResponse
+	err     error
+}
+
+// prepared reports whether the participant's backend prepared its share of the batch.
+func (p *participant) prepared() bool {
+	return p.err == nil && p.status == http.StatusOK
+}
+
+// forEachParticipant calls the given function for each of the given participants concurrently,
+// waiting for all of the calls to return.
+func forEachParticipant(participants []*participant, f func(*participant)) {
+	var wg sync.WaitGroup
+	wg.Add(len(participants))
+	for _, p := range participants {
+		go func() {
+			defer wg.Done()
+			f(p)
+		}()
+	}
+	wg.Wait()
+}
+
+// statusCodeForBackendFailure determines the HTTP status code with which to respond to a request
+// that failed due to a backend responding with the given status code, or not responding at all.
+func statusCodeForBackendFailure(status int) int {
+	if status == 0 {
+		return http.StatusBadGateway
+	}
+	return status
+}
+
+func newBatchID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// applyBatch applies the given mutations atomically across the backends that own their keys,
+// returning the status code with which to respond, along with either the outcome for each entry
+// or an error that precluded determining those outcomes.
+func (r *router) applyBatch(ctx context.Context, entries []batchEntry, mutations []batchMutation) (int, *batchResponse, error) {
+	byBackend := make(map[int]*participant)
+	for i, m := range mutations {
+		backend := r.backendFor(m.key)
+		p, ok := byBackend[backend]
+		if !ok {
+			p = &participant{backend: backend}
+			byBackend[backend] = p
+		}
+		p.entries = append(p.entries, entries[i])
+		p.indices = append(p.indices, i)
+	}
+	participants := make([]*participant, 0, len(byBackend))
+	for _, p := range byBackend {
+		participants = append(participants, p)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].backend < participants[j].backend
+	})
+	if len(participants) == 1 {
+		// A single backend can apply the whole batch within one transaction by itself.
+		var response batchResponse
+		status, err := r.call(ctx, participants[0].backend, http.MethodPost, "/records/batch", entries, &response)
+		if err != nil {
+			return statusCodeForBackendFailure(status), nil, err
+		}
+		return status, &response, nil
+	}
+	results := make([]batchEntryResult, len(entries))
+	id := newBatchID()
+	forEachParticipant(participants, func(p *participant) {
+		p.status, p.err = r.call(ctx, p.backend, http.MethodPut, pathPrefixPrepared+id, p.entries, &p.results)
+	})
+	// Once the participants have prepared their shares of the batch, deliver the decision even if
+	// the client gives up waiting for it.
+	ctx = context.WithoutCancel(ctx)
+	failed := slices.IndexFunc(participants, func(p *participant) bool {
+		return !p.prepared()
+	})
+	if failed < 0 {
+		var inDoubt error
+		var mu sync.Mutex
+		forEachParticipant(participants, func(p *participant) {
+			if _, err := r.call(ctx, p.backend, http.MethodPost, pathPrefixPrepared+id+"/commit", nil, nil); err != nil {
+				mu.Lock()
+				inDoubt = err
+				mu.Unlock()
+			}
+		})
+		if inDoubt != nil {
+			// TODO(seh): Record the decision durably, so that we can retry delivering it.
+			return http.StatusBadGateway, nil, fmt.Errorf("batch %s may have committed only partially: %w", id, inDoubt)
+		}
+		for _, p := range participants {
+			for i, index := range p.indices {
+				if i < len(p.results.Results) {
+					results[index] = p.results.Results[i]
+				}
+				results[index].Status = batchEntryCommitted
+			}
+		}
+		return http.StatusOK, &batchResponse{
+			Committed: true,
+			Results:   results,
+		}, nil
+	}
+	// Even those participants whose responses we couldn't interpret may have prepared their shares
+	// of the batch. Should aborting fail, the backend abandons the batch once it expires.
+	forEachParticipant(participants, func(p *participant) {
+		r.call(ctx, p.backend, http.MethodDelete, pathPrefixPrepared+id, nil, nil)
+	})
+	culprit := participants[failed]
+	if culprit.err != nil {
+		return statusCodeForBackendFailure(culprit.status), nil, culprit.err
+	}
+	for _, p := range participants {
+		for i, index := range p.indices {
+			switch {
+			case p == culprit && i < len(p.results.Results):
+				results[index] = p.results.Results[i]
+			case p.prepared():
+				results[index] = batchEntryResult{Status: batchEntryRolledBack}
+			default:
+				results[index] = batchEntryResult{Status: batchEntryNotAttempted}
+			}
+		}
+	}
+	return culprit.status, &batchResponse{
+		Results: results,
+	}, nil
+}
+
+// handleRoutedBatch applies a batch of mutations across the backends, responding like a backend
+// would to the same batch.
+func (r *router) handleRoutedBatch(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var entries []batchEntry
+	respondWithJSON := isJSONRequest(req)
+	if respondWithJSON {
+		if !decodeJSONBody(w, req, &entries) {
+			return
+		}
+	} else {
+		bindings, ok := parseFormBindings(w, req)
+		if !ok || len(bindings) == 0 {
+			return
+		}
+		for k, v := range bindings {
+			entry := batchEntry{
+				Key: &k,
+				Op:  "delete",
+			}
+			if v != nil {
+				value := string(*v)
+				entry.Op, entry.Value = "upsert", &value
+			}
+			entries = append(entries, entry)
+		}
+	}
+	mutations, ok := interpretBatchEntries(w, entries)
+	if !ok {
+		return
+	}
+	status, response, err := r.applyBatch(ctx, entries, mutations)
+	if err != nil {
+		respondWithProblem(w, status, "%v", err)
+		return
+	}
+	if respondWithJSON {
+		speakJSONTo(w)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if !response.Committed {
+		var failures []string
+		for _, result := range response.Results {
+			if result.Status == batchEntryFailed {
+				failures = append(failures, result.Error)
+			}
+		}
+		respondWithProblem(w, status, "%s", strings.Join(failures, "; "))
+	}
+}
+
+// handleRoutedTxn forwards a conditional batch to the backend that owns all of its keys. Since
+// evaluating the guards and applying the mutations must occur within one transaction, it rejects
+// conditional batches whose keys span multiple backends.
+func (r *router) handleRoutedTxn(w http.ResponseWriter, req *http.Request) {
+	// Retain the part of the body consumed while decoding it, so as to forward the whole body.
+	original := req.Body
+	var consumed bytes.Buffer
+	req.Body = io.NopCloser(io.TeeReader(original, &consumed))
+	var request txnRequest
+	if !decodeJSONBody(w, req, &request) {
+		return
+	}
+	backend := -1
+	claim := func(k idb.Key) bool {
+		b := r.backendFor(k)
+		if backend >= 0 && b != backend {
+			respondWithProblem(w, http.StatusNotImplemented, "Conditional batches must not involve records owned by different backends")
+			return false
+		}
+		backend = b
+		return true
+	}
+	for i := range request.Guards {
+		g, err := request.Guards[i].interpret()
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Guard %d is invalid: %v", i, err)
+			return
+		}
+		if !claim(g.key) {
+			return
+		}
+	}
+	for _, entries := range [][]batchEntry{request.Then, request.Else} {
+		mutations, ok := interpretBatchEntries(w, entries)
+		if !ok {
+			return
+		}
+		for _, m := range mutations {
+			if !claim(m.key) {
+				return
+			}
+		}
+	}
+	if backend < 0 {
+		backend = 0
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&consumed, original), original}
+	r.proxies[backend].ServeHTTP(w, req)
+}
+
+func rejectInRouterMode(w http.ResponseWriter, req *http.Request) {
+	respondWithProblem(w, http.StatusNotImplemented, "Request is not supported in router mode")
+}
+
+// makeRouterHandler creates the handler for client requests in router mode, forwarding requests
+// involving a single record to the backend that owns it, and coordinating batches across
+// backends.
+func makeRouterHandler(r *router) *http.ServeMux {
+	var mux http.ServeMux
+	mux.HandleFunc(pathPrefixSingleRecord, func(w http.ResponseWriter, req *http.Request) {
+		key, ok := getTargetKey(w, req)
+		if !ok {
+			return
+		}
+		r.proxies[r.backendFor(key)].ServeHTTP(w, req)
+	})
+	mux.HandleFunc("/records/batch", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		r.handleRoutedBatch(req.Context(), w, req)
+	})
+	mux.HandleFunc("/records/txn", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		r.handleRoutedTxn(w, req)
+	})
+	// TODO(seh): Merge listings and scans from all the backends.
+	for _, pattern := range []string{
+		"/records/tree",
+		"/records/scan",
+		"/query",
+		"/leases",
+		pathPrefixLease,
+		pathPrefixLock,
+		pathPrefixSequence,
+		pathPrefixQueue,
+		pathPrefixTopic,
+		pathPrefixProcedure,
+		pathPrefixPrepared,
+		"/scripts/run",
+		"/records/delete-where",
+		pathBuckets,
+		pathPrefixBucket,
+	} {
+		mux.HandleFunc(pattern, rejectInRouterMode)
+	}
+	return &mux
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// routedCluster is a router in front of backends, each serving its own store.
+type routedCluster struct {
+	router   *httptest.Server
+	r        *router
+	backends []*httptest.Server
+	stores   []*idb.ShardedStore
+}
+
+func newRoutedCluster(t *testing.T, backends int) *routedCluster {
+	t.Helper()
+	c := routedCluster{
+		backends: make([]*httptest.Server, backends),
+		stores:   make([]*idb.ShardedStore, backends),
+	}
+	urls := make([]string, backends)
+	for i := range backends {
+		store, err := idb.MakeShardedStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := makeHandler(store, 0, 0, time.Minute)
+		registerPreparedBatchHandlers(mux, store, time.Minute)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		c.backends[i], c.stores[i], urls[i] = server, store, server.URL
+	}
+	r, err := newRouter(urls, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.r = r
+	c.router = httptest.NewServer(makeRouterHandler(r))
+	t.Cleanup(c.router.Close)
+	return &c
+}
+
+// keyOwnedBy returns a key, distinct for each given ordinal, that the given backend owns.
+func (c *routedCluster) keyOwnedBy(t *testing.T, backend, ordinal int) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if c.r.backendFor(idb.Key(k)) != backend {
+			continue
+		}
+		if ordinal == 0 {
+			return k
+		}
+		ordinal--
+	}
+	t.Fatalf("found no key owned by backend %d", backend)
+	return ""
+}
+
+// assertStoredOnlyBy checks that only the given backend holds the record with the given key and
+// value, or, if the backend is negative, that no backend holds it.
+func (c *routedCluster) assertStoredOnlyBy(t *testing.T, backend int, k, v string) {
+	t.Helper()
+	for i, store := range c.stores {
+		got, ok := storedValue(t, store, k)
+		switch {
+		case i == backend && (!ok || got != v):
+			t.Errorf("record %q on backend %d: want value %q, got %q (present: %t)", k, i, v, got, ok)
+		case i != backend && ok:
+			t.Errorf("record %q: want it absent from backend %d, got value %q", k, i, got)
+		}
+	}
+}
+
+func TestRouterForwardsRecordRequestsToOwner(t *testing.T) {
+	c := newRoutedCluster(t, 3)
+	for backend := range c.backends {
+		for ordinal := range 3 {
+			k := c.keyOwnedBy(t, backend, ordinal)
+			v := "v-" + k
+			if res, body := sendRequest(t, c.router, http.MethodPost, "/record/"+k, url.Values{"value": {v}}); res.StatusCode != http.StatusCreated {
+				t.Fatalf("creating record %q: want status %d, got %d (%s)", k, http.StatusCreated, res.StatusCode, body)
+			}
+			c.assertStoredOnlyBy(t, backend, k, v)
+			if res, body := sendRequest(t, c.router, http.MethodGet, "/record/"+k, nil); res.StatusCode != http.StatusOK || body != v+"\n" {
+				t.Errorf("reading record %q: want status %d and value %q, got %d and %q", k, http.StatusOK, v, res.StatusCode, body)
+			}
+		}
+	}
+	if res, body := sendRequest(t, c.router, http.MethodGet, "/record/", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty key: want status %d, got %d (%s)", http.StatusBadRequest, res.StatusCode, body)
+	}
+	if res, body := sendRequest(t, c.router, http.MethodGet, "/records/scan", nil); res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("scan: want status %d, got %d (%s)", http.StatusNotImplemented, res.StatusCode, body)
+	}
+}
+
+func TestRouterAppliesBatchesAcrossBackends(t *testing.T) {
+	c := newRoutedCluster(t, 2)
+	a, b := c.keyOwnedBy(t, 0, 0), c.keyOwnedBy(t, 1, 0)
+
+	batch := fmt.Sprintf(`[{"key":%q,"op":"insert","value":"1"},{"key":%q,"op":"insert","value":"2"}]`, a, b)
+	if res, body := sendJSON(t, c.router, "/records/batch", batch); res.StatusCode != http.StatusOK {
+		t.Fatalf("batch spanning backends: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	} else if !strings.Contains(body, `"committed":true`) {
+		t.Errorf("batch spanning backends: want it committed, got %s", body)
+	}
+	c.assertStoredOnlyBy(t, 0, a, "1")
+	c.assertStoredOnlyBy(t, 1, b, "2")
+
+	// Inserting an existing record fails on one backend, so the other must not apply its share.
+	c2 := c.keyOwnedBy(t, 0, 1)
+	batch = fmt.Sprintf(`[{"key":%q,"op":"insert","value":"3"},{"key":%q,"op":"insert","value":"4"}]`, c2, b)
+	if res, body := sendJSON(t, c.router, "/records/batch", batch); res.StatusCode != http.StatusConflict {
+		t.Fatalf("failing batch: want status %d, got %d (%s)", http.StatusConflict, res.StatusCode, body)
+	} else if !strings.Contains(body, `"rolled-back"`) || !strings.Contains(body, `"failed"`) {
+		t.Errorf("failing batch: want one entry rolled back and one failed, got %s", body)
+	}
+	c.assertStoredOnlyBy(t, -1, c2, "")
+	c.assertStoredOnlyBy(t, 1, b, "2")
+
+	txn := fmt.Sprintf(`{"guards":[{"key":%q,"equals":"1"}],"then":[{"key":%q,"op":"update","value":"5"}]}`, a, a)
+	if res, body := sendJSON(t, c.router, "/records/txn", txn); res.StatusCode != http.StatusOK {
+		t.Fatalf("conditional batch on one backend: want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+	}
+	c.assertStoredOnlyBy(t, 0, a, "5")
+	txn = fmt.Sprintf(`{"guards":[{"key":%q,"equals":"5"}],"then":[{"key":%q,"op":"update","value":"6"}]}`, a, b)
+	if res, body := sendJSON(t, c.router, "/records/txn", txn); res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("conditional batch spanning backends: want status %d, got %d (%s)", http.StatusNotImplemented, res.StatusCode, body)
+	}
+	c.assertStoredOnlyBy(t, 1, b, "2")
+}
+
+func TestRouterReportsUnavailableBackend(t *testing.T) {
+	c := newRoutedCluster(t, 2)
+	up, down := c.keyOwnedBy(t, 0, 0), c.keyOwnedBy(t, 1, 0)
+	c.backends[1].Close()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+	}{
+		{name: "read", method: http.MethodGet, path: "/record/" + down},
+		{name: "write", method: http.MethodPost, path: "/record/" + down, form: url.Values{"value": {"v"}}},
+		{name: "form batch", method: http.MethodPost, path: "/records/batch", form: url.Values{"bound": {":" + up + ":1", ":" + down + ":2"}}},
+	} {
+		if res, body := sendRequest(t, c.router, tc.method, tc.path, tc.form); res.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s: want status %d, got %d (%s)", tc.name, http.StatusBadGateway, res.StatusCode, body)
+		}
+	}
+	batch := fmt.Sprintf(`[{"key":%q,"op":"insert","value":"1"},{"key":%q,"op":"insert","value":"2"}]`, up, down)
+	if res, body := sendJSON(t, c.router, "/records/batch", batch); res.StatusCode != http.StatusBadGateway {
+		t.Errorf("JSON batch: want status %d, got %d (%s)", http.StatusBadGateway, res.StatusCode, body)
+	}
+	// The backend that prepared its share of the failed batches aborted it.
+	c.assertStoredOnlyBy(t, -1, up, "")
+
+	// Records owned by the remaining backend remain available.
+	if res, body := sendRequest(t, c.router, http.MethodPost, "/record/"+up, url.Values{"value": {"v"}}); res.StatusCode != http.StatusCreated {
+		t.Errorf("write to available backend: want status %d, got %d (%s)", http.StatusCreated, res.StatusCode, body)
+	}
+	c.assertStoredOnlyBy(t, 0, up, "v")
+}
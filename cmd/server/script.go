@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	idb "sehlabs.com/db/internal/db"
+	"sehlabs.com/db/internal/script"
+)
+
+type scriptRequest struct {
+	Source string            `json:"source"`
+	Args   map[string]string `json:"args"`
+}
+
+type scriptResponse struct {
+	Result any `json:"result"`
+	Steps  int `json:"steps"`
+}
+
+type deleteWhereRequest struct {
+	Prefix string `json:"prefix"`
+	Where  string `json:"where"`
+}
+
+type deleteWhereResponse struct {
+	Deleted int `json:"deleted"`
+	Steps   int `json:"steps"`
+}
+
+// registerScriptHandlers installs the handlers for requests to run client-supplied scripts, each
+// within its own transaction and limited to evaluating the given number of steps, and for
+// requests to delete the records that such a script selects.
+func registerScriptHandlers(mux *http.ServeMux, db database, maxSteps int) {
+	mux.HandleFunc("/scripts/run", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		handleRunScript(req.Context(), w, req, db, maxSteps)
+	})
+	mux.HandleFunc("/records/delete-where", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		handleDeleteWhere(req.Context(), w, req, db, maxSteps)
+	})
+}
+
+func statusCodeForScriptError(err error) int {
+	if statusCode := statusCodeForError(err); statusCode != http.StatusInternalServerError {
+		return statusCode
+	}
+	var abortErr *script.AbortError
+	var runtimeErr *script.RuntimeError
+	switch {
+	case errors.As(err, &abortErr):
+		return http.StatusConflict
+	case errors.Is(err, script.ErrStepLimitExceeded):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &runtimeErr):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleRunScript runs a script within a transaction, committing the transaction only if the
+// script completes without error.
+func handleRunScript(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, maxSteps int) {
+	var request scriptRequest
+	if !decodeJSONBody(w, req, &request) {
+		return
+	}
+	program, err := script.Parse(request.Source)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Failed to parse script: %v", err)
+		return
+	}
+	var response scriptResponse
+	var txID uint64
+	err = db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		var err error
+		response.Result, response.Steps, err = program.Run(ctx, tx, request.Args, maxSteps)
+		return err == nil, err
+	})
+	if err != nil {
+		respondWithProblem(w, statusCodeForScriptError(err), "%v", err)
+		return
+	}
+	setCommittedTransaction(w, txID)
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleDeleteWhere deletes within one transaction each record with a key starting with the
+// requested prefix for which the requested script yields a true value, evaluating the script once
+// per record with the record's key and value available as the "key" and "value" arguments.
+func handleDeleteWhere(ctx context.Context, w http.ResponseWriter, req *http.Request, db database, maxSteps int) {
+	var request deleteWhereRequest
+	if !decodeJSONBody(w, req, &request) {
+		return
+	}
+	program, err := script.Parse(request.Where)
+	if err != nil {
+		respondWithProblem(w, http.StatusBadRequest, "Failed to parse script: %v", err)
+		return
+	}
+	var response deleteWhereResponse
+	var txID uint64
+	err = db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		response.Steps = 0
+		var scriptErr error
+		deleted, err := tx.DeleteWhere(ctx, idb.Key(request.Prefix), func(k idb.Key, v idb.Value) bool {
+			if scriptErr != nil {
+				return false
+			}
+			result, steps, err := program.Run(ctx, tx, map[string]string{
+				"key":   string(k),
+				"value": string(v),
+			}, maxSteps)
+			response.Steps += steps
+			if err != nil {
+				scriptErr = err
+				return false
+			}
+			// As with the "if" special form, treat every value other than nil and false as true.
+			return result != nil && result != false
+		})
+		if err == nil {
+			err = scriptErr
+		}
+		response.Deleted = deleted
+		return err == nil, err
+	})
+	if err != nil {
+		respondWithProblem(w, statusCodeForScriptError(err), "%v", err)
+		return
+	}
+	setCommittedTransaction(w, txID)
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// seedEntry is the JSON-encoded description of a record with which to seed an empty database.
+type seedEntry struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   *string `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	// TTL is a duration such as "1h", in the syntax that time.ParseDuration accepts, after which
+	// the record expires.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// seedManifest is the JSON-encoded description of the records with which to seed an empty
+// database.
+type seedManifest struct {
+	Records []seedEntry `json:"records"`
+}
+
+type seedRecord struct {
+	key      db.Key
+	value    db.Value
+	metadata db.Metadata
+	ttl      time.Duration
+}
+
+// readSeedFile reads the records with which to seed an empty database from the JSON document in
+// the given file.
+func readSeedFile(path string) ([]seedRecord, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest seedManifest
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON document: %w", err)
+	}
+	records := make([]seedRecord, len(manifest.Records))
+	for i, e := range manifest.Records {
+		key, ok, err := decodeTextOrBase64(e.Key, e.KeyBase64, "key")
+		if err == nil && (!ok || len(key) == 0) {
+			err = errors.New("key must be nonempty")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		value, ok, err := decodeTextOrBase64(e.Value, e.ValueBase64, "value")
+		if err == nil && !ok {
+			err = errors.New(`one of fields "value" and "value_base64" must be present`)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		r := seedRecord{
+			key:      key,
+			value:    value,
+			metadata: db.Metadata{ContentType: e.ContentType},
+		}
+		if len(e.TTL) > 0 {
+			if r.ttl, err = time.ParseDuration(e.TTL); err != nil || r.ttl <= 0 {
+				return nil, fmt.Errorf("record %d: invalid %q value %q: must be a positive duration", i, "ttl", e.TTL)
+			}
+		}
+		records[i] = r
+	}
+	return records, nil
+}
+
+// seedStore inserts the given records into the store within one transaction if the store holds no
+// records yet, attaching each record with a TTL to a lease of that duration, so that it expires
+// unless a client keeps the lease alive. It reports whether it inserted the records.
+func seedStore(ctx context.Context, store *db.ShardedStore, records []seedRecord) (bool, error) {
+	leases := make(map[time.Duration]uint64)
+	revokeLeases := func() {
+		for _, id := range leases {
+			store.RevokeLease(ctx, id)
+		}
+	}
+	for _, r := range records {
+		if r.ttl == 0 || leases[r.ttl] != 0 {
+			continue
+		}
+		id, err := store.GrantLease(r.ttl)
+		if err != nil {
+			revokeLeases()
+			return false, err
+		}
+		leases[r.ttl] = id
+	}
+	var seeded bool
+	err := store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		seeded = false
+		for range tx.Scan(ctx, nil) {
+			return false, nil
+		}
+		for _, r := range records {
+			if err := tx.InsertWithMetadata(ctx, r.key, r.value, r.metadata); err != nil {
+				return false, fmt.Errorf("failed to insert record with key %q: %w", r.key, err)
+			}
+			if r.ttl > 0 {
+				if err := tx.AttachToLease(ctx, r.key, leases[r.ttl]); err != nil {
+					return false, err
+				}
+			}
+		}
+		seeded = true
+		return true, nil
+	})
+	if err != nil || !seeded {
+		revokeLeases()
+	}
+	return seeded, err
+}
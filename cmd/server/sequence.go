@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const pathPrefixSequence = "/sequences/"
+
+type sequencer interface {
+	NextSequence(ctx context.Context, name string) (uint64, error)
+}
+
+type sequenceResponse struct {
+	Value uint64 `json:"value"`
+}
+
+// registerSequenceHandlers installs the handler for requests to draw the next value from a named
+// sequence, with which clients can generate unique identifiers.
+func registerSequenceHandlers(mux *http.ServeMux, db sequencer) {
+	mux.HandleFunc(pathPrefixSequence, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rejectMethod(w, req, http.MethodPost)
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, pathPrefixSequence)
+		if len(name) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty sequence name")
+			return
+		}
+		v, err := db.NextSequence(req.Context(), name)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(sequenceResponse{
+			Value: v,
+		})
+	})
+}
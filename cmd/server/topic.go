@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+const pathPrefixTopic = "/topics/"
+
+// topicReceiveBatchSize is the greatest number of messages to retrieve from a topic at once on
+// behalf of a subscriber.
+const topicReceiveBatchSize = 100
+
+type publisher interface {
+	Publish(ctx context.Context, topic string, body idb.Value) (uint64, error)
+	ReceiveFromTopic(ctx context.Context, topic, subscriber string, limit int) ([]idb.TopicMessage, error)
+	Unsubscribe(ctx context.Context, topic, subscriber string) error
+}
+
+type publishResponse struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+type topicMessage struct {
+	Sequence    uint64  `json:"sequence"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+}
+
+// getSubscriber extracts the nonempty name of the subscriber to a topic from the request's form,
+// responding with an error and returning false if it can't do so.
+func getSubscriber(w http.ResponseWriter, req *http.Request) (string, bool) {
+	const formKey = "subscriber"
+	subscriber := req.FormValue(formKey)
+	if len(subscriber) == 0 {
+		respondWithProblem(w, http.StatusBadRequest, "HTTP form key %q must be nonempty", formKey)
+		return "", false
+	}
+	return subscriber, true
+}
+
+func handlePublish(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db publisher) {
+	if !parseForm(w, req) {
+		return
+	}
+	sequence, err := db.Publish(ctx, name, idb.Value(req.FormValue("value")))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	speakJSONTo(w)
+	json.NewEncoder(w).Encode(publishResponse{
+		Sequence: sequence,
+	})
+}
+
+// handleSubscribe streams the messages published to the named topic to the subscriber named in
+// the request's form as server-sent events, until the client disconnects or the request's
+// Context is done.
+func handleSubscribe(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db publisher) {
+	if !parseForm(w, req) {
+		return
+	}
+	subscriber, ok := getSubscriber(w, req)
+	if !ok {
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		messages, err := db.ReceiveFromTopic(ctx, name, subscriber, topicReceiveBatchSize)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				// Having committed to the stream already, report the failure as an event.
+				problem, _ := json.Marshal(problemForError(err))
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", problem)
+				rc.Flush()
+			}
+			return
+		}
+		for _, m := range messages {
+			value, valueBase64 := textOrBase64(m.Body)
+			data, _ := json.Marshal(topicMessage{
+				Sequence:    m.Sequence,
+				Value:       value,
+				ValueBase64: valueBase64,
+			})
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.Sequence, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+	}
+}
+
+func handleUnsubscribe(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, db publisher) {
+	if !parseForm(w, req) {
+		return
+	}
+	subscriber, ok := getSubscriber(w, req)
+	if !ok {
+		return
+	}
+	if err := db.Unsubscribe(ctx, name, subscriber); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	respondWithSuccessfulDeletion(w)
+}
+
+// registerTopicHandlers installs the handlers for requests to publish messages to named topics,
+// and to subscribe to and unsubscribe from them.
+func registerTopicHandlers(mux *http.ServeMux, db publisher) {
+	mux.HandleFunc(pathPrefixTopic, func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, pathPrefixTopic)
+		if len(name) == 0 {
+			respondWithProblem(w, http.StatusBadRequest, "URL path must contain a nonempty topic name")
+			return
+		}
+		switch req.Method {
+		case http.MethodPost:
+			handlePublish(req.Context(), w, req, name, db)
+		case http.MethodGet:
+			handleSubscribe(req.Context(), w, req, name, db)
+		case http.MethodDelete:
+			handleUnsubscribe(req.Context(), w, req, name, db)
+		default:
+			rejectMethod(w, req, http.MethodPost, http.MethodGet, http.MethodDelete)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	idb "sehlabs.com/db/internal/db"
+)
+
+// txnGuard is a condition on a record's state, evaluated within a conditional batch's
+// transaction. Exactly one of the conditions must be present.
+type txnGuard struct {
+	Key          *string `json:"key,omitempty"`
+	KeyBase64    *string `json:"key_base64,omitempty"`
+	Equals       *string `json:"equals,omitempty"`
+	EqualsBase64 *string `json:"equals_base64,omitempty"`
+	Absent       bool    `json:"absent,omitempty"`
+	Version      *uint64 `json:"version,omitempty"`
+}
+
+type txnCondition uint8
+
+const (
+	txnValueEquals txnCondition = iota
+	txnRecordAbsent
+	txnVersionEquals
+)
+
+type guardCheck struct {
+	key       idb.Key
+	condition txnCondition
+	value     idb.Value
+	version   uint64
+}
+
+func (g *txnGuard) interpret() (guardCheck, error) {
+	var c guardCheck
+	key, ok, err := decodeTextOrBase64(g.Key, g.KeyBase64, "key")
+	if err != nil {
+		return c, err
+	}
+	if !ok || len(key) == 0 {
+		return c, errors.New("key must be nonempty")
+	}
+	c.key = key
+	value, hasValue, err := decodeTextOrBase64(g.Equals, g.EqualsBase64, "equals")
+	if err != nil {
+		return c, err
+	}
+	var conditions int
+	if hasValue {
+		conditions++
+		c.condition = txnValueEquals
+		c.value = value
+	}
+	if g.Absent {
+		conditions++
+		c.condition = txnRecordAbsent
+	}
+	if g.Version != nil {
+		conditions++
+		c.condition = txnVersionEquals
+		c.version = *g.Version
+	}
+	if conditions != 1 {
+		return c, errors.New(`exactly one of the "equals", "absent", and "version" conditions must be present`)
+	}
+	return c, nil
+}
+
+// holds reports whether the guard's condition holds within the given transaction. It asserts that
+// the record remains in the state on which that verdict rests until the transaction commits, so
+// that should another transaction change the record in the meantime, this one fails with
+// idb.ErrAssertionFailed rather than committing the mutations chosen by a stale verdict.
+func (c *guardCheck) holds(ctx context.Context, tx idb.Transaction) (bool, error) {
+	v, version, err := tx.GetVersioned(ctx, c.key)
+	if errors.Is(err, idb.ErrRecordDoesNotExist) {
+		if err := tx.AssertAbsent(ctx, c.key); err != nil {
+			return false, err
+		}
+		return c.condition == txnRecordAbsent, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.condition == txnVersionEquals {
+		err = tx.AssertVersion(ctx, c.key, version)
+	} else {
+		err = tx.AssertValue(ctx, c.key, v)
+	}
+	if err != nil {
+		return false, err
+	}
+	switch c.condition {
+	case txnValueEquals:
+		return bytes.Equal(v, c.value), nil
+	case txnVersionEquals:
+		return version == c.version, nil
+	default:
+		return false, nil
+	}
+}
+
+type txnRequest struct {
+	Guards []txnGuard   `json:"guards"`
+	Then   []batchEntry `json:"then"`
+	Else   []batchEntry `json:"else"`
+}
+
+type txnResponse struct {
+	Succeeded bool               `json:"succeeded"`
+	Committed bool               `json:"committed"`
+	Results   []batchEntryResult `json:"results"`
+}
+
+// handleTxn evaluates a list of guards within a transaction, and applies one of two lists of
+// mutations atomically within that same transaction, depending on whether all the guards held.
+func handleTxn(ctx context.Context, w http.ResponseWriter, req *http.Request, db database) {
+	var request txnRequest
+	if !decodeJSONBody(w, req, &request) {
+		return
+	}
+	guards := make([]guardCheck, len(request.Guards))
+	for i := range request.Guards {
+		g, err := request.Guards[i].interpret()
+		if err != nil {
+			respondWithProblem(w, http.StatusBadRequest, "Guard %d is invalid: %v", i, err)
+			return
+		}
+		guards[i] = g
+	}
+	thenMutations, ok := interpretBatchEntries(w, request.Then)
+	if !ok {
+		return
+	}
+	elseMutations, ok := interpretBatchEntries(w, request.Else)
+	if !ok {
+		return
+	}
+	var succeeded bool
+	var results []batchEntryResult
+	var failure error
+	var txID uint64
+	err := db.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		txID = tx.ID()
+		failure = nil
+		succeeded = true
+		for _, g := range guards {
+			holds, err := g.holds(ctx, tx)
+			if err != nil {
+				return false, err
+			}
+			if !holds {
+				succeeded = false
+				break
+			}
+		}
+		mutations := thenMutations
+		if !succeeded {
+			mutations = elseMutations
+		}
+		results = make([]batchEntryResult, len(mutations))
+		failure = applyBatchMutations(ctx, tx, mutations, results)
+		return failure == nil, failure
+	})
+	statusCode := http.StatusOK
+	if err != nil {
+		if failure == nil {
+			respondWithError(w, err)
+			return
+		}
+		statusCode = statusCodeForError(err)
+	} else {
+		setCommittedTransaction(w, txID)
+	}
+	speakJSONTo(w)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(txnResponse{
+		Succeeded: succeeded,
+		Committed: err == nil,
+		Results:   results,
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	idb "sehlabs.com/db/internal/db"
+	"sehlabs.com/db/internal/db/dbtest"
+)
+
+func TestTxnHandlerChoosesBranch(t *testing.T) {
+	server, fake := newTestServer(t)
+	if err := fake.Store().WithinTransaction(context.Background(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		return true, tx.Insert(ctx, idb.Key("a"), idb.Value("1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var version uint64
+	if err := fake.Store().WithinTransaction(context.Background(), func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		var err error
+		_, version, err = tx.GetVersioned(ctx, idb.Key("a"))
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name          string
+		guards        string
+		wantSucceeded bool
+	}{
+		{name: "value holds", guards: `[{"key":"a","equals":"1"}]`, wantSucceeded: true},
+		{name: "value differs", guards: `[{"key":"a","equals":"2"}]`},
+		{name: "absent holds", guards: `[{"key":"z","absent":true}]`, wantSucceeded: true},
+		{name: "absent fails", guards: `[{"key":"a","absent":true}]`},
+		{name: "version holds", guards: fmt.Sprintf(`[{"key":"a","version":%d}]`, version), wantSucceeded: true},
+		{name: "version differs", guards: fmt.Sprintf(`[{"key":"a","version":%d}]`, version+1)},
+		{name: "missing record", guards: `[{"key":"z","equals":"1"}]`},
+		{name: "one of several fails", guards: `[{"key":"a","equals":"1"},{"key":"z","equals":"1"}]`},
+		{name: "no guards", guards: `[]`, wantSucceeded: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Each branch inserts a record of its own.
+			thenKey, elseKey := "then/"+tc.name, "else/"+tc.name
+			res, body := sendJSON(t, server, "/records/txn", fmt.Sprintf(
+				`{"guards":%s,"then":[{"key":%q,"op":"insert","value":"v"}],"else":[{"key":%q,"op":"insert","value":"v"}]}`,
+				tc.guards, thenKey, elseKey))
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("want status %d, got %d (%s)", http.StatusOK, res.StatusCode, body)
+			}
+			var response txnResponse
+			if err := json.Unmarshal([]byte(body), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Succeeded != tc.wantSucceeded || !response.Committed {
+				t.Errorf("want succeeded %t and committed, got %s", tc.wantSucceeded, body)
+			}
+			if _, ok := storedValue(t, fake.Store(), thenKey); ok != tc.wantSucceeded {
+				t.Errorf("want record %q to exist %t, got %t", thenKey, tc.wantSucceeded, ok)
+			}
+			if _, ok := storedValue(t, fake.Store(), elseKey); ok == tc.wantSucceeded {
+				t.Errorf("want record %q to exist %t, got %t", elseKey, !tc.wantSucceeded, ok)
+			}
+		})
+	}
+	t.Run("failed mutation", func(t *testing.T) {
+		res, body := sendJSON(t, server, "/records/txn",
+			`{"guards":[{"key":"a","equals":"1"}],"then":[{"key":"b","op":"upsert","value":"v"},{"key":"a","op":"insert","value":"v"}]}`)
+		if res.StatusCode != http.StatusConflict {
+			t.Fatalf("want status %d, got %d (%s)", http.StatusConflict, res.StatusCode, body)
+		}
+		var response txnResponse
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatal(err)
+		}
+		if !response.Succeeded || response.Committed || len(response.Results) != 2 ||
+			response.Results[0].Status != batchEntryRolledBack || response.Results[1].Status != batchEntryFailed {
+			t.Errorf("want the guarded mutations to roll back, got %s", body)
+		}
+		if _, ok := storedValue(t, fake.Store(), "b"); ok {
+			t.Error("want record \"b\" to remain absent")
+		}
+	})
+}
+
+func TestTxnHandlerRejectsMalformedGuards(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, guards := range []string{
+		`[{"key":"a"}]`,
+		`[{"key":"a","equals":"1","absent":true}]`,
+		`[{"key":"a","equals":"1","version":1}]`,
+		`[{"key":"a","absent":true,"version":1}]`,
+		`[{"key":"a","equals":"1","equals_base64":"MQ=="}]`,
+		`[{"key":"a","equals_base64":"not base64"}]`,
+		`[{"equals":"1"}]`,
+		`[{"key":"","absent":true}]`,
+		`{"key":"a"}`,
+	} {
+		res, body := sendJSON(t, server, "/records/txn", `{"guards":`+guards+`,"then":[{"key":"b","op":"upsert","value":"v"}]}`)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("guards %s: want status %d, got %d (%s)", guards, http.StatusBadRequest, res.StatusCode, body)
+		}
+	}
+}
+
+// TestTxnHandlerAbortsUponGuardInvalidation confirms that a conditional batch whose guard another
+// transaction invalidates before it commits doesn't apply the mutations chosen by that guard,
+// even when those mutations don't touch the guarded record.
+func TestTxnHandlerAbortsUponGuardInvalidation(t *testing.T) {
+	server, fake := newTestServer(t)
+	store := fake.Store()
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		return true, tx.Insert(ctx, idb.Key("a"), idb.Value("1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Hold the conditional batch's transaction open after it reads the guarded record.
+	fake.Inject(dbtest.Fault{Operation: dbtest.Write, Key: idb.Key("b"), Delay: 500 * time.Millisecond, Times: 1})
+	type result struct {
+		res  *http.Response
+		body string
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, body := sendJSON(t, server, "/records/txn",
+			`{"guards":[{"key":"a","equals":"1"}],"then":[{"key":"b","op":"insert","value":"v"}]}`)
+		results <- result{res, body}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); len(store.ActiveTransactions()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the conditional batch to begin")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx idb.Transaction) (bool, error) {
+		return true, tx.Update(ctx, idb.Key("a"), idb.Value("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-results
+	if r.res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("want status %d, got %d (%s)", http.StatusPreconditionFailed, r.res.StatusCode, r.body)
+	}
+	if _, ok := storedValue(t, store, "b"); ok {
+		t.Error("want record \"b\" to remain absent, since its guard no longer held")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// adminUIPage is the single page of the admin web UI, which browses, edits, and summarizes the
+// database's records via the client API.
+//
+//go:embed ui.html
+var adminUIPage []byte
+
+const pathPrefixAdminUI = "/ui/"
+
+// registerAdminUIHandlers installs the handlers for the admin web UI among the administrative
+// requests: the page itself, the given handler for client requests beneath the page's "api" path,
+// so that the page reaches them from its own origin even when administrative requests arrive on a
+// separate listener, and the database's statistics as JSON. Since the UI can read and write every
+// record, only the clients with the given identities (see isPermittedIdentity) may use it.
+func registerAdminUIHandlers(mux *http.ServeMux, client http.Handler, db statsReporter, permittedIdentities []string) {
+	var ui http.ServeMux
+	ui.HandleFunc(pathPrefixAdminUI, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != pathPrefixAdminUI {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(adminUIPage)
+	})
+	ui.Handle(pathPrefixAdminUI+"api/", http.StripPrefix(pathPrefixAdminUI+"api", client))
+	ui.HandleFunc(pathPrefixAdminUI+"stats", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			rejectMethod(w, req, http.MethodGet)
+			return
+		}
+		speakJSONTo(w)
+		json.NewEncoder(w).Encode(db.Stats())
+	})
+	mux.Handle(pathPrefixAdminUI, withPermittedIdentities(&ui, permittedIdentities, "use the admin web UI"))
+}
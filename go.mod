@@ -1,5 +1,5 @@
 module sehlabs.com/db
 
-go 1.20
+go 1.23
 
 require github.com/spf13/pflag v1.0.5
@@ -0,0 +1,300 @@
+// Package cluster tracks the servers participating in a cluster, so that features such as
+// replication and routing can discover their peers and notice when those peers fail.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status describes what a member knows about another member's health.
+type Status int
+
+const (
+	// StatusUnknown indicates that the member has yet to hear about the other member from any
+	// peer, such as for a peer listed statically that hasn't yet been contacted.
+	StatusUnknown Status = iota
+	// StatusAlive indicates that the other member's heartbeat advanced recently.
+	StatusAlive
+	// StatusSuspect indicates that the other member's heartbeat hasn't advanced for long enough
+	// to doubt that it's still running, though not so long as to conclude that it has failed.
+	StatusSuspect
+	// StatusFailed indicates that the other member's heartbeat hasn't advanced for so long that
+	// it has likely failed or departed from the cluster.
+	StatusFailed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusAlive:
+		return "alive"
+	case StatusSuspect:
+		return "suspect"
+	case StatusFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Heartbeat is the latest heartbeat counter known for a member, identified by the base URL at
+// which it serves requests. Members exchange their heartbeats when gossiping.
+type Heartbeat struct {
+	URL     string
+	Counter uint64
+}
+
+// Member describes a member of the cluster as seen by a particular member.
+type Member struct {
+	URL string
+	// Self indicates whether this is the member doing the observing.
+	Self bool
+	// Heartbeat is the latest heartbeat counter known for the member.
+	Heartbeat uint64
+	Status    Status
+	// LastHeard is when the member's heartbeat last advanced, or the zero value if it never has.
+	LastHeard time.Time
+}
+
+type peer struct {
+	heartbeat uint64
+	lastHeard time.Time
+}
+
+type membershipOptions struct {
+	suspicionTimeout time.Duration
+	failureTimeout   time.Duration
+}
+
+// MembershipOption is a function that configures a Membership.
+type MembershipOption func(*membershipOptions) error
+
+// WithSuspicionTimeout specifies the positive duration for which a peer's heartbeat must fail to
+// advance before suspecting that the peer has failed. By default, this is five seconds.
+func WithSuspicionTimeout(d time.Duration) MembershipOption {
+	return func(o *membershipOptions) error {
+		if d <= 0 {
+			return errors.New("suspicion timeout must be positive")
+		}
+		o.suspicionTimeout = d
+		return nil
+	}
+}
+
+// WithFailureTimeout specifies the positive duration for which a peer's heartbeat must fail to
+// advance before concluding that the peer has failed. This must be greater than the suspicion
+// timeout (see WithSuspicionTimeout). By default, this is thirty seconds.
+func WithFailureTimeout(d time.Duration) MembershipOption {
+	return func(o *membershipOptions) error {
+		if d <= 0 {
+			return errors.New("failure timeout must be positive")
+		}
+		o.failureTimeout = d
+		return nil
+	}
+}
+
+// Membership tracks the members of a cluster as seen by one of them. It starts with a static list
+// of peers and discovers more of them by gossiping with those it knows about (see Gossip),
+// detecting a peer's failure when no member has heard its heartbeat advance for a while.
+type Membership struct {
+	self             string
+	suspicionTimeout time.Duration
+	failureTimeout   time.Duration
+	mu               sync.Mutex
+	heartbeat        uint64
+	peers            map[string]*peer
+	// now returns the current time, and is replaceable for testing.
+	now func() time.Time
+}
+
+// NewMembership creates a Membership for the member serving requests at the given base URL,
+// knowing initially about the peers at the given base URLs.
+func NewMembership(self string, peers []string, opts ...MembershipOption) (*Membership, error) {
+	if len(self) == 0 {
+		return nil, errors.New("member URL must be nonempty")
+	}
+	options := membershipOptions{
+		suspicionTimeout: 5 * time.Second,
+		failureTimeout:   30 * time.Second,
+	}
+	for _, o := range opts {
+		if err := o(&options); err != nil {
+			return nil, err
+		}
+	}
+	if options.failureTimeout <= options.suspicionTimeout {
+		return nil, errors.New("failure timeout must exceed suspicion timeout")
+	}
+	m := Membership{
+		self:             self,
+		suspicionTimeout: options.suspicionTimeout,
+		failureTimeout:   options.failureTimeout,
+		peers:            make(map[string]*peer, len(peers)),
+		now:              time.Now,
+	}
+	for _, url := range peers {
+		if url != self {
+			m.peers[url] = &peer{}
+		}
+	}
+	return &m, nil
+}
+
+// Self returns the base URL at which this member serves requests.
+func (m *Membership) Self() string {
+	return m.self
+}
+
+// Heartbeats returns the latest heartbeat counters known for every member, including this one,
+// for sharing with a peer.
+func (m *Membership) Heartbeats() []Heartbeat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	heartbeats := make([]Heartbeat, 0, len(m.peers)+1)
+	heartbeats = append(heartbeats, Heartbeat{m.self, m.heartbeat})
+	for url, p := range m.peers {
+		heartbeats = append(heartbeats, Heartbeat{url, p.heartbeat})
+	}
+	return heartbeats
+}
+
+// Merge incorporates the heartbeat counters shared by a peer, learning about members not known
+// before, and noting when the known members' heartbeats advanced.
+func (m *Membership) Merge(heartbeats []Heartbeat) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range heartbeats {
+		if h.URL == m.self || len(h.URL) == 0 {
+			continue
+		}
+		p, ok := m.peers[h.URL]
+		if !ok {
+			p = &peer{}
+			m.peers[h.URL] = p
+		}
+		if h.Counter > p.heartbeat {
+			p.heartbeat = h.Counter
+			p.lastHeard = now
+		}
+	}
+	// TODO(seh): Forget peers that have been failed for long enough, so that departed members
+	// don't linger forever.
+}
+
+func (m *Membership) statusOf(p *peer, now time.Time) Status {
+	switch {
+	case p.lastHeard.IsZero():
+		return StatusUnknown
+	case now.Sub(p.lastHeard) >= m.failureTimeout:
+		return StatusFailed
+	case now.Sub(p.lastHeard) >= m.suspicionTimeout:
+		return StatusSuspect
+	default:
+		return StatusAlive
+	}
+}
+
+// Members describes every known member of the cluster, including this one, ordered by URL.
+func (m *Membership) Members() []Member {
+	now := m.now()
+	m.mu.Lock()
+	members := make([]Member, 0, len(m.peers)+1)
+	members = append(members, Member{
+		URL:       m.self,
+		Self:      true,
+		Heartbeat: m.heartbeat,
+		Status:    StatusAlive,
+		LastHeard: now,
+	})
+	for url, p := range m.peers {
+		members = append(members, Member{
+			URL:       url,
+			Heartbeat: p.heartbeat,
+			Status:    m.statusOf(p, now),
+			LastHeard: p.lastHeard,
+		})
+	}
+	m.mu.Unlock()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].URL < members[j].URL
+	})
+	return members
+}
+
+// LivePeers returns the base URLs of the other members not believed to have failed, including
+// those whose status is unknown or suspect, ordered by URL.
+func (m *Membership) LivePeers() []string {
+	now := m.now()
+	m.mu.Lock()
+	urls := make([]string, 0, len(m.peers))
+	for url, p := range m.peers {
+		if m.statusOf(p, now) != StatusFailed {
+			urls = append(urls, url)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(urls)
+	return urls
+}
+
+// An Exchanger sends the given heartbeat counters to the peer at the given base URL, returning
+// the heartbeat counters that the peer knows.
+type Exchanger func(ctx context.Context, peer string, heartbeats []Heartbeat) ([]Heartbeat, error)
+
+// Gossip advances this member's heartbeat at the given positive interval, exchanging heartbeat
+// counters each time with a peer chosen at random via the given Exchanger, until the given
+// Context is done. It prefers peers not believed to have failed, but occasionally tries a failed
+// one too, so that the cluster heals after a partition. Failing to reach a peer doesn't by itself
+// mark it as failed; only the absence of news of its heartbeat from any member does that.
+func (m *Membership) Gossip(ctx context.Context, interval time.Duration, exchange Exchanger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		target, ok := m.advance()
+		if !ok {
+			continue
+		}
+		heartbeats, err := exchange(ctx, target, m.Heartbeats())
+		if err != nil {
+			continue
+		}
+		m.Merge(heartbeats)
+	}
+}
+
+// advance increments this member's heartbeat counter, returning the peer with which to gossip
+// next, or false if there are no known peers.
+func (m *Membership) advance() (string, bool) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeat++
+	if len(m.peers) == 0 {
+		return "", false
+	}
+	var live, failed []string
+	for url, p := range m.peers {
+		if m.statusOf(p, now) == StatusFailed {
+			failed = append(failed, url)
+		} else {
+			live = append(live, url)
+		}
+	}
+	candidates := live
+	// Try a failed peer about one time in every ten, or whenever no other peers remain.
+	if len(failed) > 0 && (len(live) == 0 || rand.IntN(10) == 0) {
+		candidates = failed
+	}
+	return candidates[rand.IntN(len(candidates))], true
+}
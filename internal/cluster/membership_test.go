@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func statusesOf(m *Membership) map[string]Status {
+	statuses := make(map[string]Status)
+	for _, member := range m.Members() {
+		statuses[member.URL] = member.Status
+	}
+	return statuses
+}
+
+func TestFailureDetection(t *testing.T) {
+	m, err := NewMembership("http://a", []string{"http://a", "http://b"},
+		WithSuspicionTimeout(time.Second), WithFailureTimeout(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	m.now = func() time.Time { return now }
+	if got := statusesOf(m); len(got) != 2 || got["http://a"] != StatusAlive || got["http://b"] != StatusUnknown {
+		t.Fatalf("want self alive and static peer unknown, got %v", got)
+	}
+	m.Merge([]Heartbeat{{"http://b", 1}, {"http://c", 4}})
+	if got := statusesOf(m); got["http://b"] != StatusAlive || got["http://c"] != StatusAlive {
+		t.Fatalf("want peers alive after hearing heartbeats, got %v", got)
+	}
+	now = now.Add(2 * time.Second)
+	// A stale heartbeat doesn't count as news.
+	m.Merge([]Heartbeat{{"http://b", 1}, {"http://c", 5}})
+	if got := statusesOf(m); got["http://b"] != StatusSuspect || got["http://c"] != StatusAlive {
+		t.Fatalf("want stale peer suspect, got %v", got)
+	}
+	now = now.Add(2 * time.Second)
+	if got := statusesOf(m); got["http://b"] != StatusFailed || got["http://c"] != StatusSuspect {
+		t.Fatalf("want stale peer failed, got %v", got)
+	}
+	if got := m.LivePeers(); len(got) != 1 || got[0] != "http://c" {
+		t.Errorf("want only live peer %q, got %v", "http://c", got)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	members := make(map[string]*Membership)
+	// Each member knows only about the first one initially.
+	for _, url := range []string{"http://a", "http://b", "http://c"} {
+		m, err := NewMembership(url, []string{"http://a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[url] = m
+	}
+	exchange := func(ctx context.Context, peer string, heartbeats []Heartbeat) ([]Heartbeat, error) {
+		m := members[peer]
+		m.Merge(heartbeats)
+		return m.Heartbeats(), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, m := range members {
+		go m.Gossip(ctx, time.Millisecond, exchange)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		converged := true
+		for _, m := range members {
+			for _, member := range m.Members() {
+				if member.Status != StatusAlive {
+					converged = false
+				}
+			}
+			if len(m.Members()) != len(members) {
+				converged = false
+			}
+		}
+		if converged {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("members did not discover one another")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import "sync/atomic"
+
+// WithRecordAccessStats establishes that the store tracks how often transactions read and write
+// each record, and which transaction accessed it most recently, reporting these via
+// Transaction.GetRecord, such as to inform cache eviction or to audit usage. Tracking costs an
+// allocation per record upon its first access, and updating counters that transactions accessing
+// the same record share.
+func WithRecordAccessStats() ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		o.trackRecordAccess = true
+		return nil
+	}
+}
+
+// RecordAccessStats describes how transactions have used a record, as tracked by a store
+// established with WithRecordAccessStats. Since transactions update these counters concurrently
+// without coordinating, the values are approximate.
+type RecordAccessStats struct {
+	// Reads is the number of times transactions retrieved the record via Get, GetVersioned, or
+	// GetRecord, not counting scans.
+	Reads uint64
+	// Writes is the number of committed transactions that wrote the record.
+	Writes uint64
+	// LastAccess is the ID of a transaction that most recently read or wrote the record.
+	LastAccess uint64
+}
+
+type recordAccessCounters struct {
+	reads      atomic.Uint64
+	writes     atomic.Uint64
+	lastAccess atomic.Uint64
+}
+
+// noteRecordAccess counts an access to the given record by the transaction with the given ID, if
+// the store tracks record access.
+func (s *ShardedStore) noteRecordAccess(record *versionedRecord, id transactionID, write bool) {
+	if !s.trackRecordAccess {
+		return
+	}
+	c := record.access.Load()
+	if c == nil {
+		c = new(recordAccessCounters)
+		if !record.access.CompareAndSwap(nil, c) {
+			c = record.access.Load()
+		}
+	}
+	if write {
+		c.writes.Add(1)
+	} else {
+		c.reads.Add(1)
+	}
+	// Tolerate a concurrent access by an older transaction prevailing here.
+	c.lastAccess.Store(uint64(id))
+}
+
+// accessStatsOf returns the access statistics tracked for the given record.
+func accessStatsOf(record *versionedRecord) RecordAccessStats {
+	c := record.access.Load()
+	if c == nil {
+		return RecordAccessStats{}
+	}
+	return RecordAccessStats{
+		Reads:      c.reads.Load(),
+		Writes:     c.writes.Load(),
+		LastAccess: c.lastAccess.Load(),
+	}
+}
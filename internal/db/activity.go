@@ -0,0 +1,97 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ActiveTransaction describes a transaction that has begun but not yet concluded.
+type ActiveTransaction struct {
+	// ID is the transaction's identifier.
+	ID uint64
+	// Started is when the transaction began.
+	Started time.Time
+	// PendingWrites is the number of distinct records that the transaction proposes to insert,
+	// update, or delete.
+	PendingWrites int
+}
+
+// activeTransactions tracks the transactions that have begun but not yet concluded.
+type activeTransactions struct {
+	byID sync.Map // transactionID -> *shardedStoreTransaction
+}
+
+func (a *activeTransactions) add(tx *shardedStoreTransaction) {
+	a.byID.Store(tx.id, tx)
+}
+
+func (a *activeTransactions) remove(id transactionID) {
+	a.byID.Delete(id)
+}
+
+// ActiveTransactions describes the transactions begun via WithinTransaction that have not yet
+// concluded, sorted by ID.
+func (s *ShardedStore) ActiveTransactions() []ActiveTransaction {
+	var active []ActiveTransaction
+	s.activeTransactions.byID.Range(func(_, v any) bool {
+		tx := v.(*shardedStoreTransaction)
+		active = append(active, ActiveTransaction{
+			ID:            uint64(tx.id),
+			Started:       tx.started,
+			PendingWrites: int(tx.pendingWriteCount.Load()),
+		})
+		return true
+	})
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].ID < active[j].ID
+	})
+	return active
+}
+
+// AbortTransaction forcibly aborts the active transaction with the given ID, such as one that has
+// run for too long, and reports whether such a transaction was active. The aborted transaction is
+// doomed: its Context is canceled, its subsequent operations fail with ErrTransactionAborted, and
+// it rolls back its changes once its function returns, whereupon WithinTransaction returns
+// ErrTransactionAborted even if the function asked to commit.
+//
+// TODO(seh): Release the transaction's placeholder versions immediately rather than waiting for
+// its function to return, which requires synchronizing with the transaction's own goroutine.
+func (s *ShardedStore) AbortTransaction(id uint64) bool {
+	tx := s.activeTransaction(transactionID(id))
+	if tx == nil {
+		return false
+	}
+	tx.doom()
+	return true
+}
+
+// activeTransaction returns the active transaction with the given ID, or nil if there is none.
+func (s *ShardedStore) activeTransaction(id transactionID) *shardedStoreTransaction {
+	v, ok := s.activeTransactions.byID.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*shardedStoreTransaction)
+}
+
+// doom marks the transaction as aborted and cancels its Context.
+func (t *shardedStoreTransaction) doom() {
+	t.doomWith(transactionAbortedError(t.id))
+}
+
+// doomWith marks the transaction as aborted with the given error, unless it was already, and
+// cancels its Context.
+func (t *shardedStoreTransaction) doomWith(err error) {
+	if t.doomed.CompareAndSwap(nil, &err) {
+		t.abort(err)
+	}
+}
+
+// aborted returns the error with which the transaction was forcibly aborted, if any.
+func (t *shardedStoreTransaction) aborted() error {
+	if err := t.doomed.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// commitAssertion is a condition on a record that must still hold when a transaction commits.
+type commitAssertion struct {
+	key Key
+	// value is the value that the record must have, unless absent is true or version is set.
+	value  Value
+	absent bool
+	// version, if not noSuchTransaction, is the ID of the transaction that must have committed
+	// the record's current version.
+	version transactionID
+}
+
+// committedVersionAsOf returns the newest committed version of the given record visible to the
+// transaction with the given ID, ignoring pending versions, or nil if the record didn't exist
+// then.
+func committedVersionAsOf(record *versionedRecord, id transactionID) *recordVersion {
+	for r := record.newest.Load(); r != nil; r = r.next.Load() {
+		validAsOf := r.validAsOfTransactionID()
+		if validAsOf == noSuchTransaction || validAsOf > id {
+			continue
+		}
+		if validBefore := r.validBeforeTransactionID(); validBefore != noSuchTransaction && validBefore <= id {
+			return nil
+		}
+		return r
+	}
+	return nil
+}
+
+// holds reports whether the record with the given committed version, or nil if the record doesn't
+// exist, satisfies the assertion, returning an error if it doesn't.
+func (s *ShardedStore) holds(a *commitAssertion, r *recordVersion) error {
+	switch {
+	case a.absent:
+		if r != nil {
+			return assertionFailedError{key: string(a.key), reason: "record exists"}
+		}
+	case r == nil:
+		return assertionFailedError{key: string(a.key), reason: "record does not exist"}
+	case a.version != noSuchTransaction:
+		if r.validAsOfTransactionID() != a.version {
+			return assertionFailedError{key: string(a.key), reason: "record has a different version"}
+		}
+	default:
+		v, err := s.openValue(a.key, r.value)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(v, a.value) {
+			return assertionFailedError{key: string(a.key), reason: "record has a different value"}
+		}
+	}
+	return nil
+}
+
+// assert registers the given assertion, first confirming that it holds as of when this
+// transaction began.
+func (t *shardedStoreTransaction) assert(ctx context.Context, a commitAssertion) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	if t.readOnly {
+		// Read-only transactions never commit, so nothing would check the assertion later.
+		return readOnlyTransactionError(a.key)
+	}
+	rm, record, ok := t.recordFor(ctx, a.key)
+	if rm == nil {
+		return ctx.Err()
+	}
+	var r *recordVersion
+	if ok {
+		r = committedVersionAsOf(record, t.id)
+	}
+	if err := t.store.holds(&a, r); err != nil {
+		return err
+	}
+	t.assertions = append(t.assertions, a)
+	return nil
+}
+
+func (t *shardedStoreTransaction) AssertAbsent(ctx context.Context, k Key) error {
+	return t.assert(ctx, commitAssertion{
+		key:    append(Key(nil), k...),
+		absent: true,
+	})
+}
+
+func (t *shardedStoreTransaction) AssertValue(ctx context.Context, k Key, v Value) error {
+	var owned Value
+	owned.CopyFrom(v)
+	return t.assert(ctx, commitAssertion{
+		key:   append(Key(nil), k...),
+		value: owned,
+	})
+}
+
+func (t *shardedStoreTransaction) AssertVersion(ctx context.Context, k Key, version uint64) error {
+	if transactionID(version) == noSuchTransaction {
+		return assertionFailedError{key: string(k), reason: "no record has version zero"}
+	}
+	return t.assert(ctx, commitAssertion{
+		key:     append(Key(nil), k...),
+		version: transactionID(version),
+	})
+}
+
+// checkAssertions confirms that the assertions registered within this transaction still hold
+// against the latest committed state of their records, acquiring the records' locks so that no
+// other transaction can write to them until this one concludes.
+func (t *shardedStoreTransaction) checkAssertions(ctx context.Context) error {
+	for i := range t.assertions {
+		a := &t.assertions[i]
+		acquired, holder, _ := t.store.recordLocksFor(a.key).tryAcquire(a.key, t.id)
+		if !acquired {
+			return t.conflict(a.key, holder, "another transaction holds the lock for an asserted record")
+		}
+		t.lockedKeys = append(t.lockedKeys, a.key)
+		rm, record, ok := t.recordFor(ctx, a.key)
+		if rm == nil {
+			return ctx.Err()
+		}
+		var latest *recordVersion
+		if ok {
+		versions:
+			for r := record.newest.Load(); r != nil; r = r.next.Load() {
+				switch validAsOf := r.validAsOfTransactionID(); {
+				case validAsOf != noSuchTransaction:
+					if r.validBeforeTransactionID() == noSuchTransaction {
+						latest = r
+					}
+					break versions
+				case r.proposedBy != t.id:
+					// Another transaction is writing to the record, and may yet commit.
+					return t.conflict(a.key, r.proposedBy, "another transaction is writing an asserted record")
+				}
+			}
+		}
+		if err := t.store.holds(a, latest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *shardedStoreTransaction) UpdateIfUnchangedSince(ctx context.Context, k Key, v Value, since uint64) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return interruptedError(ctx, k)
+	}
+	if ok {
+		for r := record.newest.Load(); r != nil; r = r.next.Load() {
+			changed := r.validAsOfTransactionID()
+			if changed == noSuchTransaction || changed > t.id {
+				continue
+			}
+			if validBefore := r.validBeforeTransactionID(); validBefore != noSuchTransaction && validBefore <= t.id {
+				// The record was deleted since this version took effect.
+				changed = validBefore
+			}
+			if changed > transactionID(since) {
+				return t.conflict(k, changed, fmt.Sprintf("record changed since transaction %d", since))
+			}
+			break
+		}
+	}
+	return t.Update(ctx, k, v)
+}
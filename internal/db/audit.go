@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// AuditOperation identifies the kind of action described by an AuditEntry.
+type AuditOperation uint8
+
+const (
+	// AuditInsert describes a call to Transaction.Insert.
+	AuditInsert AuditOperation = iota + 1
+	// AuditUpdate describes a call to Transaction.Update.
+	AuditUpdate
+	// AuditUpsert describes a call to Transaction.Upsert.
+	AuditUpsert
+	// AuditDelete describes a call to Transaction.Delete.
+	AuditDelete
+	// AuditCommit describes the conclusion of a transaction that attempted at least one mutation,
+	// where the transaction-consuming function requested committing its changes.
+	AuditCommit
+	// AuditAbort describes the conclusion of a transaction that attempted at least one mutation,
+	// where the transaction-consuming function declined to commit its changes.
+	AuditAbort
+	// AuditAddToSet describes a call to Transaction.AddToSet.
+	AuditAddToSet
+	// AuditRemoveFromSet describes a call to Transaction.RemoveFromSet.
+	AuditRemoveFromSet
+	// AuditPushLeft describes a call to Transaction.PushLeft.
+	AuditPushLeft
+	// AuditPushRight describes a call to Transaction.PushRight.
+	AuditPushRight
+	// AuditPopLeft describes a call to Transaction.PopLeft.
+	AuditPopLeft
+	// AuditPopRight describes a call to Transaction.PopRight.
+	AuditPopRight
+	// AuditAppendToOutbox describes a call to Transaction.AppendToOutbox.
+	AuditAppendToOutbox
+)
+
+func (o AuditOperation) String() string {
+	switch o {
+	case AuditInsert:
+		return "insert"
+	case AuditUpdate:
+		return "update"
+	case AuditUpsert:
+		return "upsert"
+	case AuditDelete:
+		return "delete"
+	case AuditCommit:
+		return "commit"
+	case AuditAbort:
+		return "abort"
+	case AuditAddToSet:
+		return "add-to-set"
+	case AuditRemoveFromSet:
+		return "remove-from-set"
+	case AuditPushLeft:
+		return "push-left"
+	case AuditPushRight:
+		return "push-right"
+	case AuditPopLeft:
+		return "pop-left"
+	case AuditPopRight:
+		return "pop-right"
+	case AuditAppendToOutbox:
+		return "append-to-outbox"
+	default:
+		return "unknown"
+	}
+}
+
+// AuditEntry describes an attempt to mutate the database within a transaction, or the conclusion
+// of such a transaction.
+type AuditEntry struct {
+	// Time is when the attempt concluded.
+	Time time.Time
+	// Identity is the identity of the party on whose behalf the transaction ran, as supplied via
+	// ContextWithIdentity, or empty if unknown.
+	Identity string
+	// TransactionID identifies the transaction within which the attempt occurred.
+	TransactionID uint64
+	// Operation is the kind of attempt.
+	Operation AuditOperation
+	// Key is the key of the target record, the name of the outbox for the AuditAppendToOutbox
+	// operation, or nil for the AuditCommit and AuditAbort operations.
+	Key Key
+	// Value is the proposed record value, the set member for the AuditAddToSet and
+	// AuditRemoveFromSet operations, the list element for the AuditPushLeft and AuditPushRight
+	// operations, or the event for the AuditAppendToOutbox operation. It is nil for the other
+	// operations, or when the store redacts values.
+	Value Value
+	// Err is the error with which the attempt failed, or nil if it succeeded.
+	Err error
+}
+
+// An Auditor receives descriptions of every attempt to mutate the database. Its Audit method must
+// be safe for concurrent use, and must not retain the entry's Key or Value beyond the call.
+type Auditor interface {
+	Audit(AuditEntry)
+}
+
+// WithAuditor establishes an Auditor that receives descriptions of every attempt to mutate the
+// database, and of the conclusion of every transaction that makes such an attempt. If
+// redactValues is true, these descriptions omit the proposed record values.
+func WithAuditor(a Auditor, redactValues bool) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if a == nil {
+			return errors.New("auditor must be non-nil")
+		}
+		o.auditor = a
+		o.redactAuditedValues = redactValues
+		return nil
+	}
+}
+
+type identityContextKey struct{}
+
+// ContextWithIdentity returns a Context carrying the identity of the party on whose behalf
+// transactions governed by that Context run, for inclusion in each AuditEntry.
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity supplied via ContextWithIdentity, if any.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(string)
+	return identity, ok
+}
+
+func (t *shardedStoreTransaction) audit(ctx context.Context, op AuditOperation, k Key, v Value, err error) {
+	if t.journal != nil && op != AuditCommit && op != AuditAbort {
+		if err != nil {
+			t.journalf(JournalWrite, k, noSuchTransaction, "%s failed: %v", op, err)
+		} else {
+			t.journalf(JournalWrite, k, noSuchTransaction, "%s", op)
+		}
+	}
+	a := t.store.auditor
+	if a == nil {
+		return
+	}
+	t.audited = true
+	if t.store.redactAuditedValues {
+		v = nil
+	}
+	identity, _ := IdentityFromContext(ctx)
+	a.Audit(AuditEntry{
+		Time:          t.store.clock.Now(),
+		Identity:      identity,
+		TransactionID: uint64(t.id),
+		Operation:     op,
+		Key:           k,
+		Value:         v,
+		Err:           err,
+	})
+}
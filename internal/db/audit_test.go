@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type recordingAuditor struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (a *recordingAuditor) Audit(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+}
+
+func TestAuditInsertCommit(t *testing.T) {
+	var auditor recordingAuditor
+	store, err := MakeShardedStore(WithAuditor(&auditor, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ContextWithIdentity(context.Background(), "tester")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("k1"), Value("v1")); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(auditor.entries); want != got {
+		t.Fatalf("audit entry count: want %d, got %d", want, got)
+	}
+	for i, op := range []AuditOperation{AuditInsert, AuditCommit} {
+		e := auditor.entries[i]
+		if want, got := op, e.Operation; want != got {
+			t.Errorf("audit entry %d operation: want %s, got %s", i, want, got)
+		}
+		if want, got := "tester", e.Identity; want != got {
+			t.Errorf("audit entry %d identity: want %q, got %q", i, want, got)
+		}
+		if e.Value != nil {
+			t.Errorf("audit entry %d value: want redacted, got %q", i, e.Value)
+		}
+	}
+}
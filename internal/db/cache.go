@@ -0,0 +1,149 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A ReadMissHandler loads the value for a record with the given key from another system when the
+// database holds no record for that key, reporting whether the other system has such a record.
+type ReadMissHandler func(ctx context.Context, k Key) (v Value, found bool, err error)
+
+// Mutation describes a change to a record committed within a transaction.
+type Mutation struct {
+	// Key is the key of the changed record.
+	Key Key
+	// Value is the record's new value, or nil if the record was deleted.
+	Value Value
+	// Deleted indicates whether the transaction deleted the record.
+	Deleted bool
+}
+
+// A WritePropagator applies the changes that a transaction is about to commit to another system.
+// If it returns a non-nil error, the transaction rolls back its changes instead of committing
+// them.
+type WritePropagator func(ctx context.Context, mutations []Mutation) error
+
+// WithReadMissHandler establishes a function with which to load records from another system when
+// the database holds no record for a requested key, allowing the database to act as a read-through
+// cache in front of that system. When the function finds such a record, the database stores it
+// as if committed just as the reading transaction began.
+func WithReadMissHandler(h ReadMissHandler) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if h == nil {
+			return errors.New("read miss handler must be non-nil")
+		}
+		o.readMissHandler = h
+		return nil
+	}
+}
+
+// WithWritePropagator establishes a function with which to apply each transaction's changes to
+// another system before committing them, allowing the database to act as a write-through cache in
+// front of that system.
+func WithWritePropagator(p WritePropagator) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if p == nil {
+			return errors.New("write propagator must be non-nil")
+		}
+		o.writePropagator = p
+		return nil
+	}
+}
+
+// loadOnMiss consults the store's ReadMissHandler, if any, for a record with the given key that
+// the database lacks, storing any such record found as committed as of this transaction.
+func (t *shardedStoreTransaction) loadOnMiss(ctx context.Context, k Key) (Value, error) {
+	h := t.store.readMissHandler
+	if h == nil || isReservedKey(k) {
+		// The other system knows nothing of the records with reserved keys.
+		return nil, recordDoesNotExistError(k)
+	}
+	v, found, err := h(ctx, k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load record with key %q: %w", k, err)
+	}
+	if !found {
+		return nil, recordDoesNotExistError(k)
+	}
+	rm, next := t.store.lockRecordMapsFor(ctx, k)
+	if rm == nil {
+		return nil, interruptedError(ctx, k)
+	}
+	if _, ok := rm.recordsByKey[string(k)]; !ok {
+		// Unless someone else got in and added this record already, store it as committed.
+		var loadedVersion recordVersion
+		t.store.sealValueInto(&loadedVersion.value, k, v)
+		loadedVersion.validAsOfTransaction.Store(uint64(t.id))
+		var loadedRecord versionedRecord
+		loadedRecord.newest.Store(&loadedVersion)
+		loadedRecord.newestCommitted.Store(&loadedVersion)
+		t.store.addRecordTo(rm, next, k, &loadedRecord)
+		t.store.noteRecordUse(k, &loadedVersion)
+	}
+	unlockRecordMaps(rm, next)
+	t.store.evictExcessRecords()
+	return v, nil
+}
+
+// pendingMutations describes the changes this transaction proposes to commit, sorted by key.
+func (t *shardedStoreTransaction) pendingMutations(ctx context.Context) ([]Mutation, error) {
+	mutations := make([]Mutation, 0, len(t.pendingWrites))
+	for key := range t.pendingWrites {
+		k := Key(key)
+		if isReservedKey(k) {
+			// TODO(seh): Describe changes to structured records, such as sets, to the
+			// WritePropagator.
+			continue
+		}
+		rm, record, ok := t.recordFor(ctx, k)
+		if rm == nil {
+			return nil, interruptedError(ctx, k)
+		}
+		if !ok {
+			continue
+		}
+		r := record.newest.Load()
+		if r == nil || r.validAsOfTransactionID() != noSuchTransaction {
+			continue
+		}
+		m := Mutation{Key: k}
+		if r.validBeforeTransactionID() != noSuchTransaction {
+			m.Deleted = true
+		} else {
+			v, err := t.store.openValue(k, r.value)
+			if err != nil {
+				return nil, err
+			}
+			m.Value = v
+		}
+		mutations = append(mutations, m)
+	}
+	sort.Slice(mutations, func(i, j int) bool {
+		return bytes.Compare(mutations[i].Key, mutations[j].Key) < 0
+	})
+	return mutations, nil
+}
+
+// propagateWrites applies this transaction's proposed changes to another system via the store's
+// WritePropagator, if any.
+func (t *shardedStoreTransaction) propagateWrites(ctx context.Context) error {
+	p := t.store.writePropagator
+	if p == nil || len(t.pendingWrites) == 0 {
+		return nil
+	}
+	mutations, err := t.pendingMutations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(mutations) == 0 {
+		return nil
+	}
+	if err := p(ctx, mutations); err != nil {
+		return fmt.Errorf("failed to propagate writes from transaction with ID %d: %w", t.id, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CancellationPolicy governs whether a transaction commits its changes when the Context governing
+// it is done by the time it asks to commit them.
+type CancellationPolicy uint8
+
+const (
+	// FinishCommitting directs the store to commit the transaction's changes regardless of its
+	// Context. Only the steps preceding finalization that consult the Context, such as
+	// propagating writes (see WithWritePropagator), may still fail due to it.
+	FinishCommitting CancellationPolicy = iota
+	// AbortCancelled directs the store to roll back the transaction's changes, failing with
+	// ErrTransactionCancelled, if its Context is done when it asks to commit them or before the
+	// store begins finalizing them.
+	AbortCancelled
+	// FinishWithinGracePeriod directs the store to keep committing the transaction's changes for
+	// up to the store's cancellation grace period (see WithCancellationGracePeriod) after its
+	// Context is done, rolling them back and failing with ErrTransactionCancelled if the period
+	// elapses before the store begins finalizing them.
+	FinishWithinGracePeriod
+)
+
+const defaultCancellationGracePeriod = time.Second
+
+// WithCancellationPolicy establishes whether a transaction commits its changes when the Context
+// governing it is done by the time it asks to commit them. The default policy is
+// FinishCommitting. Under any policy, once the store begins finalizing a transaction's changes,
+// it finishes doing so regardless of the Context, lest it leave some of them pending.
+func WithCancellationPolicy(p CancellationPolicy) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		switch p {
+		case FinishCommitting, AbortCancelled, FinishWithinGracePeriod:
+			o.cancellationPolicy = p
+			return nil
+		default:
+			return errors.New("unrecognized cancellation policy")
+		}
+	}
+}
+
+// WithCancellationGracePeriod establishes the positive duration for which a transaction may keep
+// committing its changes after the Context governing it is done, per the store's cancellation
+// policy (see WithCancellationPolicy). The default is one second.
+func WithCancellationGracePeriod(d time.Duration) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if d <= 0 {
+			return errors.New("cancellation grace period must be positive")
+		}
+		o.cancellationGracePeriod = d
+		return nil
+	}
+}
+
+// commitContext returns the Context governing the steps that precede finalizing the changes of a
+// transaction governed by the given Context, per the store's cancellation policy, along with a
+// function that releases its resources.
+func (s *ShardedStore) commitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cancellationPolicy != FinishWithinGracePeriod {
+		return ctx, func() {}
+	}
+	commitCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	var mu sync.Mutex
+	var grace Timer
+	released := false
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !released {
+			grace = s.clock.AfterFunc(s.cancellationGracePeriod, cancel)
+		}
+	})
+	return commitCtx, func() {
+		stop()
+		mu.Lock()
+		released = true
+		if grace != nil {
+			// Don't leave the timer running for the rest of the grace period.
+			grace.Stop()
+		}
+		mu.Unlock()
+		cancel()
+	}
+}
+
+// cancellation returns the error with which to fail the transaction rather than commit its
+// changes, if the store's cancellation policy precludes committing them now that the given
+// Context, as returned by commitContext for the given governing Context, is done.
+func (t *shardedStoreTransaction) cancellation(commitCtx, ctx context.Context) error {
+	if t.store.cancellationPolicy == FinishCommitting || commitCtx.Err() == nil {
+		return nil
+	}
+	return &transactionCancelledError{id: t.id, cause: context.Cause(ctx)}
+}
@@ -0,0 +1,60 @@
+package db
+
+import "context"
+
+// lastChangeOf returns the ID of the transaction that most recently inserted, updated, or deleted
+// the record with the given key as of when this transaction began, or zero if no transaction has
+// yet done so.
+func (t *shardedStoreTransaction) lastChangeOf(ctx context.Context, k Key) (transactionID, error) {
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return noSuchTransaction, ctx.Err()
+	}
+	if !ok {
+		return noSuchTransaction, nil
+	}
+	for r := record.newest.Load(); r != nil; r = r.next.Load() {
+		validAsOf := r.validAsOfTransactionID()
+		if validAsOf == noSuchTransaction || validAsOf > t.id {
+			// Skip versions pending within other transactions or committed after this one began.
+			continue
+		}
+		if validBefore := r.validBeforeTransactionID(); validBefore != noSuchTransaction && validBefore <= t.id {
+			// No newer version took effect by then, so this version's end marks a change too.
+			return validBefore, nil
+		}
+		return validAsOf, nil
+	}
+	return noSuchTransaction, nil
+}
+
+// WaitForRecordChange blocks until a transaction with an ID greater than the given one has
+// inserted, updated, or deleted the record with the given key, returning the ID of the
+// transaction that most recently did so. If such a change already occurred, it returns
+// immediately. Otherwise it waits until the given Context is done, in which case it returns the
+// Context's error. Supplying the version of a record reported by Transaction.GetVersioned thus
+// waits for the record to change from that version, suiting clients that poll for changes.
+func (s *ShardedStore) WaitForRecordChange(ctx context.Context, k Key, since uint64) (uint64, error) {
+	for {
+		// Note how many transactions have committed before inspecting the record, so that we don't
+		// miss a change committed in the meantime. Transactions may commit in a different order
+		// than their IDs (see transactionState.claimNextAfter), so a change may bear an ID lower
+		// than that of the newest committed transaction.
+		commits := s.txState.commits.Load()
+		var changed transactionID
+		if err := s.withinSnapshot(ctx, func(ctx context.Context, tx *shardedStoreTransaction) error {
+			var err error
+			changed, err = tx.lastChangeOf(ctx, k)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+		if uint64(changed) > since {
+			return uint64(changed), nil
+		}
+		// TODO(seh): Wake only for commits that touch this record, rather than for every commit.
+		if err := s.txState.awaitCommitsBeyond(ctx, commits); err != nil {
+			return 0, err
+		}
+	}
+}
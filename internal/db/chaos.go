@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// FaultInjection describes the faults that a store injects deliberately into its transactions, so
+// that callers can confirm that they cope with slow operations and failed transactions, such as
+// by retrying them. It's meant only for testing.
+type FaultInjection struct {
+	// MaxLatency is the longest delay to impose before each attempt to read or write a record,
+	// choosing each delay uniformly at random between zero and this duration.
+	MaxLatency time.Duration
+	// LockFailureRate is the fraction of attempts to write or lock a record (see
+	// Transaction.LockForUpdate) that fail with ErrTransactionInConflict, as though another
+	// transaction held the record's lock.
+	LockFailureRate float64
+	// CommitAbortRate is the fraction of attempts to commit a transaction that instead roll it
+	// back, failing with ErrTransactionAborted, as though an administrator had aborted it.
+	CommitAbortRate float64
+}
+
+// WithFaultInjection directs the store to inject the given faults into its transactions. The
+// latency must be nonnegative, and each rate must be between zero and one.
+func WithFaultInjection(f FaultInjection) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if f.MaxLatency < 0 {
+			return errors.New("injected latency must be nonnegative")
+		}
+		if f.LockFailureRate < 0 || f.LockFailureRate > 1 {
+			return errors.New("injected lock failure rate must be between zero and one")
+		}
+		if f.CommitAbortRate < 0 || f.CommitAbortRate > 1 {
+			return errors.New("injected commit abort rate must be between zero and one")
+		}
+		o.faults = &f
+		return nil
+	}
+}
+
+// delay waits for a random duration up to the configured maximum latency, or until the given
+// Context is done.
+func (f *FaultInjection) delay(ctx context.Context) {
+	if f == nil || f.MaxLatency == 0 {
+		return
+	}
+	t := time.NewTimer(rand.N(f.MaxLatency))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// failsLock reports whether to fail an attempt to write or lock a record.
+func (f *FaultInjection) failsLock() bool {
+	return f != nil && f.LockFailureRate > 0 && rand.Float64() < f.LockFailureRate
+}
+
+// abortsCommit reports whether to roll back a transaction that would otherwise commit.
+func (f *FaultInjection) abortsCommit() bool {
+	return f != nil && f.CommitAbortRate > 0 && rand.Float64() < f.CommitAbortRate
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// ConsistencyAnomaly describes a record version that violates the invariants governing a record's
+// history of versions, indicating a defect in the store.
+type ConsistencyAnomaly struct {
+	// Key is the key of the record with the offending version.
+	Key Key
+	// Depth is the position of the offending version in the record's history, counting from zero
+	// for the newest version.
+	Depth int
+	// Description explains which invariant the version violates.
+	Description string
+}
+
+func (a ConsistencyAnomaly) String() string {
+	return fmt.Sprintf("record with key %q, version at depth %d: %s", a.Key, a.Depth, a.Description)
+}
+
+// checkVersions inspects the given record's history of versions, calling the given function for
+// each anomaly found. Only the newest version may still be pending, and each committed version
+// must become valid no later than it ceases to be valid, and must cease to be valid no later
+// than its successor becomes valid.
+//
+// Since committing transactions close the validity window of a superseded version before marking
+// its successor as valid, and neither value changes once set, inspecting each version's successor
+// first tolerates transactions committing concurrently.
+func (s *ShardedStore) checkVersions(record *versionedRecord, report func(depth int, format string, a ...any)) {
+	var successorValidAsOf transactionID
+	depth := 0
+	for r := record.newest.Load(); r != nil; r, depth = r.next.Load(), depth+1 {
+		validAsOf := r.validAsOfTransactionID()
+		if validAsOf == noSuchTransaction {
+			if depth > 0 {
+				report(depth, "pending version lies beneath a newer version")
+			}
+			// The pending version's predecessor may be in the midst of being superseded.
+			successorValidAsOf = noSuchTransaction
+			continue
+		}
+		validBefore := r.validBeforeTransactionID()
+		// Transactions claim their IDs before committing, so this must follow reading the version's.
+		latest := transactionID(s.txState.latestID.Load())
+		switch {
+		case validAsOf > latest:
+			report(depth, "version is valid as of transaction %d, which hasn't begun yet", validAsOf)
+		case validBefore != noSuchTransaction && validBefore < validAsOf:
+			report(depth, "version ceases to be valid as of transaction %d, before it becomes valid as of transaction %d", validBefore, validAsOf)
+		}
+		if successorValidAsOf != noSuchTransaction {
+			switch {
+			case validBefore == noSuchTransaction:
+				report(depth, "superseded version remains valid, despite a successor valid as of transaction %d", successorValidAsOf)
+			case validBefore > successorValidAsOf:
+				report(depth, "version remains valid until transaction %d, overlapping its successor valid as of transaction %d", validBefore, successorValidAsOf)
+			case validAsOf >= successorValidAsOf:
+				report(depth, "version becomes valid as of transaction %d, no earlier than its successor", validAsOf)
+			}
+		}
+		successorValidAsOf = validAsOf
+	}
+}
+
+// CheckConsistency inspects the history of versions of every record in the store, reporting the
+// versions that violate the invariants governing their order and validity periods, including
+// pending versions or deletion markers found anywhere but at the head of a record's history. Any
+// such anomaly indicates a defect in the store; the store counts them among its statistics (see
+// StoreStats.ConsistencyAnomalies).
+//
+// CheckConsistency runs concurrently with transactions, holding each shard's lock only long
+// enough to collect the shard's records. Records that move between shards during resharding (see
+// ShardedStore.Resharding) may be inspected twice or not at all.
+//
+// If the given Context is done before CheckConsistency has visited all the shards, it returns the
+// Context's error along with the anomalies found so far.
+func (s *ShardedStore) CheckConsistency(ctx context.Context) ([]ConsistencyAnomaly, error) {
+	var anomalies []ConsistencyAnomaly
+	type keyedRecord struct {
+		key    Key
+		record *versionedRecord
+	}
+	var records []keyedRecord
+	for i := range s.recordMaps {
+		rm := &s.recordMaps[i]
+		if !rm.lock.TryRLockUntil(ctx) {
+			return anomalies, ctx.Err()
+		}
+		records = records[:0]
+		for k, record := range rm.recordsByKey {
+			records = append(records, keyedRecord{Key(k), record})
+		}
+		rm.lock.RUnlock()
+		for _, r := range records {
+			s.checkVersions(r.record, func(depth int, format string, a ...any) {
+				anomalies = append(anomalies, ConsistencyAnomaly{
+					Key:         r.key,
+					Depth:       depth,
+					Description: fmt.Sprintf(format, a...),
+				})
+				s.consistencyAnomalies.Add(1)
+			})
+		}
+	}
+	return anomalies, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// Clock tells the time and schedules functions to run once some time elapses, on behalf of the
+// store's time-based features: leases (see ShardedStore.GrantLease), prepared transactions' time
+// limits (see ShardedStore.PrepareTransaction), the trash's retention period (see
+// WithTrashRetention), per-key write rates (see WithPerKeyWriteRate), the limit on waiting for
+// conflicting transactions (see WithMaxConflictWait), the finalization watchdog (see
+// WithFinalizationWatchdog), resharding's wait for scans of the former shards to conclude (see
+// ShardedStore.Resharding), and the times recorded for transactions, audit entries, and journal
+// entries. Tests may substitute a Clock that they advance at will (see WithClock).
+//
+// Injected faults (see WithFaultInjection) delay operations by the system's real time regardless.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc arranges to call the given function once the given duration elapses, returning a
+	// Timer that can cancel or postpone the call, as time.AfterFunc does.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer represents a function call scheduled by a Clock.
+type Timer interface {
+	// Stop prevents the call from occurring, reporting whether it did so, or false if the call
+	// already occurred or was already stopped.
+	Stop() bool
+	// Reset arranges for the call to occur once the given duration elapses from now, reporting
+	// whether the call was still pending.
+	Reset(d time.Duration) bool
+}
+
+// systemClock is the Clock based on the system's real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// after returns a channel that closes once the given duration elapses by the store's clock, along
+// with a function that stops the underlying timer.
+func (s *ShardedStore) after(d time.Duration) (<-chan struct{}, func() bool) {
+	elapsed := make(chan struct{})
+	t := s.clock.AfterFunc(d, func() { close(elapsed) })
+	return elapsed, t.Stop
+}
+
+// WithClock establishes the Clock by which the store tells time, in place of the system's real
+// time.
+func WithClock(c Clock) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if c == nil {
+			return errors.New("clock must be non-nil")
+		}
+		o.clock = c
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// CommittedTransaction describes a transaction that committed changes to the store.
+type CommittedTransaction struct {
+	// ID identifies the transaction, as reported by Transaction.Info.
+	ID uint64
+	// Keys are the keys of the records that the transaction inserted, updated, or deleted, in
+	// ascending order. Callers must not modify them.
+	Keys []Key
+}
+
+// commitNotice is an entry in the commitFeed, filled in and linked to its successor once a
+// transaction commits.
+type commitNotice struct {
+	tx   CommittedTransaction
+	next *commitNotice
+	// published is closed once tx and next are available.
+	published chan struct{}
+}
+
+// commitFeed relays descriptions of committed transactions to any number of observers, none of
+// whom can delay the committing transactions.
+//
+// TODO(seh): Bound how far behind the newest commit a slow observer may fall, since the feed
+// retains every notice that some observer has yet to consume.
+type commitFeed struct {
+	observers atomic.Int32
+	mu        sync.Mutex
+	pending   *commitNotice // NB: Initialized lazily
+}
+
+// awaitingNotice returns the entry that the next committed transaction will fill in.
+func (f *commitFeed) awaitingNotice() *commitNotice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		f.pending = &commitNotice{published: make(chan struct{})}
+	}
+	return f.pending
+}
+
+// publish notes that the given transaction committed changes to the records with the given keys,
+// if any observers are watching.
+func (f *commitFeed) publish(id transactionID, keys func() []Key) {
+	if f.observers.Load() == 0 {
+		return
+	}
+	tx := CommittedTransaction{
+		ID:   uint64(id),
+		Keys: keys(),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.pending
+	if n == nil {
+		// No observer has yet begun waiting.
+		return
+	}
+	n.tx = tx
+	n.next = &commitNotice{published: make(chan struct{})}
+	f.pending = n.next
+	close(n.published)
+}
+
+// committedKeys returns the keys of the records to which this transaction committed changes, in
+// ascending order, omitting reserved keys.
+func (t *shardedStoreTransaction) committedKeys() []Key {
+	keys := make([]Key, 0, len(t.pendingWrites))
+	for k := range t.pendingWrites {
+		if isReservedKey(Key(k)) {
+			continue
+		}
+		keys = append(keys, Key(k))
+	}
+	slices.SortFunc(keys, func(a, b Key) int {
+		return bytes.Compare(a, b)
+	})
+	return keys
+}
+
+// relay supplies the description of each committed transaction to the given function, starting
+// with the one that fills in the given notice, until the function returns false or the given
+// Context is done.
+func (f *commitFeed) relay(ctx context.Context, n *commitNotice, yield func(CommittedTransaction) bool) {
+	for {
+		select {
+		case <-n.published:
+		case <-ctx.Done():
+			return
+		}
+		if !yield(n.tx) {
+			return
+		}
+		n = n.next
+	}
+}
+
+// CommittedTransactions returns a sequence describing each transaction that commits changes to the
+// store once iteration begins, in the order that they commit, which may differ from the order of
+// their IDs. Unlike WaitForRecordChange, this reveals every key that each transaction changed,
+// allowing callers to invalidate caches or replicate changes elsewhere. The sequence ends once the
+// given Context is done.
+//
+// Observing the sequence never delays committing transactions, but the store retains descriptions
+// of committed transactions until every observer has consumed them.
+func (s *ShardedStore) CommittedTransactions(ctx context.Context) iter.Seq[CommittedTransaction] {
+	f := &s.commitFeed
+	return func(yield func(CommittedTransaction) bool) {
+		n := f.awaitingNotice()
+		f.observers.Add(1)
+		defer f.observers.Add(-1)
+		f.relay(ctx, n, yield)
+	}
+}
+
+// WatchCommittedTransactions is like CommittedTransactions, but its sequence describes each
+// transaction that commits changes once WatchCommittedTransactions returns, rather than once
+// iteration begins. This allows a caller to take a snapshot of the store after it starts watching,
+// such as via an export, certain that the sequence covers every change that the snapshot misses.
+//
+// The store retains descriptions of committed transactions from the time WatchCommittedTransactions
+// returns until the sequence's iteration ends or the given Context is done, so callers that don't
+// iterate the sequence must arrange for that Context to end. The sequence may be iterated only once.
+func (s *ShardedStore) WatchCommittedTransactions(ctx context.Context) iter.Seq[CommittedTransaction] {
+	f := &s.commitFeed
+	n := f.awaitingNotice()
+	f.observers.Add(1)
+	var stopWatching sync.Once
+	release := func() {
+		stopWatching.Do(func() { f.observers.Add(-1) })
+	}
+	stop := context.AfterFunc(ctx, release)
+	return func(yield func(CommittedTransaction) bool) {
+		defer release()
+		defer stop()
+		f.relay(ctx, n, yield)
+	}
+}
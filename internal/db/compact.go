@@ -0,0 +1,40 @@
+package db
+
+import (
+	"context"
+)
+
+// shardCompactionRatio is the fraction of a shard's peak number of records below which
+// CompactShards will rebuild its map.
+const shardCompactionRatio = 0.5
+
+// CompactShards rebuilds the map of records for each shard that holds substantially fewer records
+// than it once did, reclaiming the memory that the map retained for its former entries, and
+// reports the number of shards it rebuilt. It acquires each shard's lock in turn, blocking other
+// callers from accessing that shard while rebuilding it.
+//
+// If the given Context is done before CompactShards has visited all the shards, it returns the
+// Context's error along with the number of shards rebuilt so far.
+//
+// TODO(seh): Since we don't yet "vacuum" deleted records, the shards' maps don't yet shed any
+// entries for compaction to reclaim.
+func (s *ShardedStore) CompactShards(ctx context.Context) (int, error) {
+	var rebuilt int
+	for i := range s.recordMaps {
+		rm := &s.recordMaps[i]
+		if !rm.lock.TryLockUntil(ctx) {
+			return rebuilt, ctx.Err()
+		}
+		if n := len(rm.recordsByKey); float64(n) < shardCompactionRatio*float64(rm.peakRecords) {
+			m := make(map[string]*versionedRecord, n)
+			for k, record := range rm.recordsByKey {
+				m[k] = record
+			}
+			rm.recordsByKey = m
+			rm.peakRecords = n
+			rebuilt++
+		}
+		rm.lock.Unlock()
+	}
+	return rebuilt, nil
+}
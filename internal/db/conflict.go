@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ConflictPolicy governs how a transaction proceeds when it attempts to write a record that
+// another active transaction is already writing or holds locked.
+type ConflictPolicy uint8
+
+const (
+	// PreemptConflicting directs the transaction that outranks the other, by priority or by age
+	// (see ContextWithTransactionPriority), to forcibly abort the other, while the attempt to
+	// write fails immediately with ErrTransactionInConflict. When the store allows more than one
+	// attempt per transaction (see WithMaxTransactionAttempts), the next attempt waits for the
+	// preempted transaction to roll back its changes.
+	PreemptConflicting ConflictPolicy = iota
+	// FirstWriterWins directs the store to fail the attempt to write immediately with
+	// ErrTransactionInConflict, leaving the other transaction undisturbed.
+	FirstWriterWins
+	// WoundWait directs the transaction that outranks the other to forcibly abort the other and
+	// wait for it to roll back its changes, and directs the outranked transaction to wait for the
+	// other to conclude, after which either tries to write the record again. Waiting lasts no
+	// longer than the store's maximum conflict wait (see WithMaxConflictWait), after which the
+	// attempt fails with ErrTransactionInConflict.
+	WoundWait
+	// WaitDie directs the transaction that outranks the other to wait for the other to conclude,
+	// after which it tries to write the record again, and directs the outranked transaction to fail
+	// the attempt immediately with ErrTransactionInConflict. Waiting lasts no longer than the
+	// store's maximum conflict wait (see WithMaxConflictWait).
+	WaitDie
+)
+
+const defaultMaxConflictWait = 100 * time.Millisecond
+
+// WithConflictPolicy establishes how a transaction proceeds when it attempts to write a record
+// that another active transaction is already writing or holds locked. The default policy is
+// PreemptConflicting. Policies that wait for the other transaction suit workloads in which
+// failing immediately would provoke excessive retries.
+func WithConflictPolicy(p ConflictPolicy) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		switch p {
+		case PreemptConflicting, FirstWriterWins, WoundWait, WaitDie:
+			o.conflictPolicy = p
+			return nil
+		default:
+			return errors.New("unrecognized conflict policy")
+		}
+	}
+}
+
+// WithMaxConflictWait establishes the positive duration for which an attempt to write a record may
+// wait for a conflicting transaction to conclude, per the store's conflict policy (see
+// WithConflictPolicy). The default is 100 milliseconds.
+func WithMaxConflictWait(d time.Duration) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if d <= 0 {
+			return errors.New("maximum conflict wait must be positive")
+		}
+		o.maxConflictWait = d
+		return nil
+	}
+}
+
+// contend returns the error with which to fail an attempt to write the record with the given key
+// that conflicts with the transaction with the given ID, first preempting that transaction or
+// arranging to wait for it to conclude, per the store's conflict policy.
+func (t *shardedStoreTransaction) contend(k Key, id transactionID) error {
+	decision := "giving up"
+	switch t.store.conflictPolicy {
+	case PreemptConflicting:
+		if concluded := t.preempt(k, id); concluded != nil {
+			t.lineage.yieldTo = concluded
+			decision = "preempted it"
+		}
+	case WoundWait:
+		if concluded := t.preempt(k, id); concluded != nil {
+			t.awaiting = concluded
+			decision = "preempted it, awaiting its conclusion"
+		} else if other := t.store.activeTransaction(id); other != nil && other != t {
+			t.awaiting = other.concluded
+			decision = "awaiting its conclusion"
+		}
+	case WaitDie:
+		if other := t.store.activeTransaction(id); other != nil && other != t && t.lineage != nil && t.outranks(other) {
+			t.awaiting = other.concluded
+			decision = "awaiting its conclusion"
+		}
+	}
+	t.journalf(JournalConflict, k, id, "conflicts with transaction %d; %s", id, decision)
+	return transactionInConflictError(k)
+}
+
+// resolvingConflicts calls the given function to write a record, calling it again each time it
+// fails due to a conflict with another transaction for which the store's conflict policy directs
+// this transaction to wait, once that transaction concludes.
+func (t *shardedStoreTransaction) resolvingConflicts(ctx context.Context, write func() error) error {
+	var deadline <-chan struct{}
+	for {
+		t.awaiting = nil
+		err := write()
+		awaiting := t.awaiting
+		t.awaiting = nil
+		if awaiting == nil || !errors.Is(err, ErrTransactionInConflict) {
+			return err
+		}
+		if deadline == nil {
+			elapsed, stop := t.store.after(t.store.maxConflictWait)
+			defer stop()
+			deadline = elapsed
+		}
+		select {
+		case <-awaiting:
+		case <-deadline:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+		if abortErr := t.aborted(); abortErr != nil {
+			return abortErr
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// WithMaxVersionsPerRecord directs the store to retain no more than the given positive number of
+// versions of each record once no transaction can still observe the older versions, bounding how
+// far readers must walk through a frequently written record's history. Each transaction that
+// writes a record consolidates its history upon committing, discarding the versions beyond the
+// limit that are no longer visible to any active transaction or pinned snapshot (see
+// ShardedStore.PinSnapshot), and retaining any that still are. By default, the store retains
+// every version.
+func WithMaxVersionsPerRecord(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("maximum versions per record must be positive")
+		}
+		o.maxVersionsPerRecord = n
+		return nil
+	}
+}
+
+// versionObservers tracks the transactions and snapshots that may still observe superseded record
+// versions, so that the store can tell which versions it may discard.
+type versionObservers struct {
+	byID sync.Map // transactionID -> struct{}
+	// horizon is the greatest transaction ID as of which the store has sought to discard versions.
+	// Observers that claim an earlier ID must claim a later one, since they may have gone
+	// unnoticed.
+	horizon atomic.Uint64
+}
+
+// beginObserving claims an ID greater than the given one for a new transaction or snapshot,
+// registering it as observing the record versions visible as of that ID if the store may discard
+// versions. The caller must call endObserving once it no longer observes those versions.
+func (s *ShardedStore) beginObserving(after transactionID) transactionID {
+	if s.maxVersionsPerRecord == 0 {
+		return s.txState.claimNextAfter(after)
+	}
+	o := &s.versionObservers
+	for {
+		id := s.txState.claimNextAfter(max(after, transactionID(o.horizon.Load())))
+		o.byID.Store(id, struct{}{})
+		// Either this load observes the horizon advancing, or the search for the oldest observer
+		// observes this one (see observationHorizon).
+		if id >= transactionID(o.horizon.Load()) {
+			return id
+		}
+		o.byID.Delete(id)
+		s.txState.recordFinished(id)
+	}
+}
+
+// endObserving notes that the transaction or snapshot with the given ID, as returned by
+// beginObserving, no longer observes record versions.
+func (s *ShardedStore) endObserving(id transactionID) {
+	if s.maxVersionsPerRecord > 0 {
+		s.versionObservers.byID.Delete(id)
+	}
+}
+
+// observationHorizon returns the ID of the oldest transaction that may still observe record
+// versions, such that no observer can see a version that ceased to be valid before it.
+func (s *ShardedStore) observationHorizon() transactionID {
+	o := &s.versionObservers
+	// Transactions claim IDs greater than that of every transaction that committed changes before
+	// they began (see transactionState.claimNextAfter).
+	horizon := transactionID(s.txState.latestCommittedID.Load())
+	for {
+		prior := o.horizon.Load()
+		if transactionID(prior) >= horizon || o.horizon.CompareAndSwap(prior, uint64(horizon)) {
+			break
+		}
+	}
+	o.byID.Range(func(k, _ any) bool {
+		horizon = min(horizon, k.(transactionID))
+		return true
+	})
+	return horizon
+}
+
+// consolidateVersions discards the versions of the given record beyond the store's limit that no
+// observer as of the given horizon can still see. Readers walking the record's history
+// concurrently may still reach the discarded versions, but they would skip them anyway.
+func (s *ShardedStore) consolidateVersions(record *versionedRecord, horizon transactionID) {
+	depth := 1
+	for r := record.newest.Load(); r != nil; r, depth = r.next.Load(), depth+1 {
+		if depth < s.maxVersionsPerRecord {
+			continue
+		}
+		older := r.next.Load()
+		if older == nil {
+			return
+		}
+		if older.validAsOfTransactionID() == noSuchTransaction {
+			continue
+		}
+		// Since each version ceases to be valid no later than its successor becomes valid, no
+		// version older than this one remains visible either.
+		if validBefore := older.validBeforeTransactionID(); validBefore != noSuchTransaction && validBefore < horizon {
+			if !r.next.CompareAndSwap(older, nil) {
+				return
+			}
+			var discarded uint64
+			for ; older != nil; older = older.next.Load() {
+				discarded++
+			}
+			s.consolidatedVersions.Add(discarded)
+			return
+		}
+	}
+}
+
+// consolidateWrittenVersions consolidates the histories of the given records, which a committing
+// transaction wrote, if the store limits the number of versions per record.
+func (s *ShardedStore) consolidateWrittenVersions(records []*versionedRecord) {
+	if s.maxVersionsPerRecord == 0 {
+		return
+	}
+	var horizon transactionID
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		depth := 0
+		for r := record.newest.Load(); r != nil && depth <= s.maxVersionsPerRecord; r = r.next.Load() {
+			depth++
+		}
+		if depth <= s.maxVersionsPerRecord {
+			continue
+		}
+		if horizon == noSuchTransaction {
+			horizon = s.observationHorizon()
+		}
+		s.consolidateVersions(record, horizon)
+	}
+}
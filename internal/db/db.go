@@ -1,5 +1,7 @@
 package db
 
+import "context"
+
 type (
 	// Key is the type of the primary record identifier used in the database.
 	//
@@ -30,3 +32,14 @@ func (v *Value) CopyFrom(o Value) int {
 func (v Value) CopyInto(o *Value) int {
 	return copyInto(o, v)
 }
+
+// Database is the part of a ShardedStore's behavior on which its clients, such as the server's
+// HTTP handlers, rely, allowing tests to substitute a double for the store (see package dbtest).
+type Database interface {
+	WithinTransaction(context.Context, func(context.Context, Transaction) (commit bool, err error)) error
+	WaitForCommittedTransaction(ctx context.Context, id uint64) error
+	WaitForRecordChange(ctx context.Context, k Key, since uint64) (uint64, error)
+	PinSnapshot(ctx context.Context) (*Snapshot, error)
+}
+
+var _ Database = (*ShardedStore)(nil)
@@ -0,0 +1,104 @@
+package dbtest
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// FakeClock is a db.Clock whose time passes only when a test advances it.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ db.Clock = (*FakeClock)(nil)
+
+// NewFakeClock creates a FakeClock whose time begins at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) db.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, f: f}
+	c.schedule(t, d)
+	return t
+}
+
+// schedule arranges to fire the given timer once the given duration elapses. The caller must hold
+// the lock.
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = c.now.Add(d)
+	c.timers = append(c.timers, t)
+}
+
+// unschedule cancels firing the given timer, reporting whether it was still pending. The caller
+// must hold the lock.
+func (c *FakeClock) unschedule(t *fakeTimer) bool {
+	i := slices.Index(c.timers, t)
+	if i < 0 {
+		return false
+	}
+	c.timers = slices.Delete(c.timers, i, i+1)
+	return true
+}
+
+// Advance moves the clock's time forward by the given duration, calling the functions of the
+// timers that fall due along the way in the order of their deadlines. Unlike time.AfterFunc, it
+// calls them synchronously, so that their effects are observable once Advance returns.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	until := c.now.Add(d)
+	for {
+		i := -1
+		for j, t := range c.timers {
+			if !t.deadline.After(until) && (i < 0 || t.deadline.Before(c.timers[i].deadline)) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		t := c.timers[i]
+		c.timers = slices.Delete(c.timers, i, i+1)
+		if t.deadline.After(c.now) {
+			c.now = t.deadline
+		}
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = until
+	c.mu.Unlock()
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	f        func()
+	deadline time.Time
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	pending := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return pending
+}
@@ -0,0 +1,300 @@
+// Package dbtest provides facilities for testing code that uses the database.
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"sync"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// Operation identifies a kind of database operation into which a Fake may inject faults.
+type Operation uint8
+
+const (
+	// AnyOperation matches every kind of operation.
+	AnyOperation Operation = iota
+	// BeginTransaction is the start of each transaction attempt, before the Fake calls the
+	// transaction-consuming function.
+	BeginTransaction
+	// Commit is the end of each transaction attempt whose function asks to commit its changes,
+	// before the Fake commits them.
+	Commit
+	// Read is each call to a transaction's Get, GetVersioned, GetRecord, or GetValueRef method.
+	Read
+	// Write is each call to a transaction's Insert, Update, Upsert, UpdateIfUnchangedSince, or
+	// Delete method, or their variants accepting metadata or value references.
+	Write
+	// PinSnapshot is each call to the Fake's PinSnapshot method.
+	PinSnapshot
+	// Scan is each record that a transaction's Scan method is about to yield. Should an affected
+	// scan fail, it stops yielding records and the enclosing WithinTransaction call returns its
+	// error, as when an error arises during a scan of the Fake's store.
+	Scan
+)
+
+// Fault describes how a Fake misbehaves when performing matching operations.
+type Fault struct {
+	// Operation is the kind of operation that the fault affects.
+	Operation Operation
+	// Key, if not nil, restricts the fault to reads and writes of the record with this key.
+	Key db.Key
+	// Delay is how long each affected operation waits before proceeding, unless its Context is
+	// done first, in which case it fails with the Context's error.
+	Delay time.Duration
+	// Err, if not nil, is the error with which each affected operation fails after any delay.
+	// Inject db.ErrTransactionInConflict to simulate conflicts between transactions, which the
+	// Fake retries as its store would (see db.WithMaxTransactionAttempts).
+	Err error
+	// Times is the number of operations that the fault affects, after which the Fake discards
+	// it, or zero to affect every matching operation.
+	Times int
+}
+
+func (f *Fault) matches(op Operation, k db.Key) bool {
+	if f.Operation != AnyOperation && f.Operation != op {
+		return false
+	}
+	return f.Key == nil || (k != nil && bytes.Equal(f.Key, k))
+}
+
+// Fake is an in-memory database for testing code that uses a db.Database, such as the server's
+// HTTP handlers, into whose operations tests may inject errors, conflicts, and latency. It keeps
+// its records in a real db.ShardedStore, which tests may populate and inspect directly.
+type Fake struct {
+	store  *db.ShardedStore
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+var _ db.Database = (*Fake)(nil)
+
+// NewFake creates an empty Fake whose store accepts the given options.
+func NewFake(opts ...db.ShardedStoreOption) (*Fake, error) {
+	store, err := db.MakeShardedStore(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Fake{store: store}, nil
+}
+
+// Store returns the store holding the Fake's records, whose operations are free of faults.
+func (f *Fake) Store() *db.ShardedStore {
+	return f.store
+}
+
+// Inject arranges for the Fake to misbehave as the given fault describes. When several faults
+// match an operation, the one injected first prevails.
+func (f *Fake) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Reset discards all the faults injected so far.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// perform applies the first fault matching the given operation on the record with the given key,
+// if any, returning the error with which the operation should fail.
+func (f *Fake) perform(ctx context.Context, op Operation, k db.Key) error {
+	f.mu.Lock()
+	var fault Fault
+	matched := false
+	for i, candidate := range f.faults {
+		if !candidate.matches(op, k) {
+			continue
+		}
+		fault, matched = *candidate, true
+		if candidate.Times > 0 {
+			if candidate.Times--; candidate.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+		break
+	}
+	f.mu.Unlock()
+	if !matched {
+		return nil
+	}
+	if fault.Delay > 0 {
+		t := time.NewTimer(fault.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fault.Err
+}
+
+func (f *Fake) WithinTransaction(ctx context.Context, fn func(context.Context, db.Transaction) (commit bool, err error)) error {
+	return f.store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		if err := f.perform(ctx, BeginTransaction, nil); err != nil {
+			return false, err
+		}
+		ftx := &fakeTransaction{Transaction: tx, fake: f}
+		commit, err := fn(db.ContextWithTransaction(ctx, ftx), ftx)
+		if ftx.scanErr != nil {
+			return false, ftx.scanErr
+		}
+		if commit && err == nil {
+			if err := f.perform(ctx, Commit, nil); err != nil {
+				return false, err
+			}
+		}
+		return commit, err
+	})
+}
+
+func (f *Fake) WaitForCommittedTransaction(ctx context.Context, id uint64) error {
+	return f.store.WaitForCommittedTransaction(ctx, id)
+}
+
+func (f *Fake) WaitForRecordChange(ctx context.Context, k db.Key, since uint64) (uint64, error) {
+	return f.store.WaitForRecordChange(ctx, k, since)
+}
+
+func (f *Fake) PinSnapshot(ctx context.Context) (*db.Snapshot, error) {
+	if err := f.perform(ctx, PinSnapshot, nil); err != nil {
+		return nil, err
+	}
+	return f.store.PinSnapshot(ctx)
+}
+
+// fakeTransaction injects its Fake's faults into the reads and writes of a transaction against
+// the Fake's store.
+type fakeTransaction struct {
+	db.Transaction
+	fake *Fake
+	// scanErr is the first error with which a scan failed, precluding committing the transaction.
+	scanErr error
+}
+
+func (t *fakeTransaction) Get(ctx context.Context, k db.Key) (db.Value, error) {
+	if err := t.fake.perform(ctx, Read, k); err != nil {
+		return nil, err
+	}
+	return t.Transaction.Get(ctx, k)
+}
+
+func (t *fakeTransaction) GetVersioned(ctx context.Context, k db.Key) (db.Value, uint64, error) {
+	if err := t.fake.perform(ctx, Read, k); err != nil {
+		return nil, 0, err
+	}
+	return t.Transaction.GetVersioned(ctx, k)
+}
+
+func (t *fakeTransaction) GetRecord(ctx context.Context, k db.Key) (db.Record, error) {
+	if err := t.fake.perform(ctx, Read, k); err != nil {
+		return db.Record{}, err
+	}
+	return t.Transaction.GetRecord(ctx, k)
+}
+
+func (t *fakeTransaction) GetValueRef(ctx context.Context, k db.Key) (db.ValueRef, uint64, error) {
+	if err := t.fake.perform(ctx, Read, k); err != nil {
+		return db.ValueRef{}, 0, err
+	}
+	return t.Transaction.GetValueRef(ctx, k)
+}
+
+func (t *fakeTransaction) Insert(ctx context.Context, k db.Key, v db.Value) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.Insert(ctx, k, v)
+}
+
+func (t *fakeTransaction) Update(ctx context.Context, k db.Key, v db.Value) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.Update(ctx, k, v)
+}
+
+func (t *fakeTransaction) Upsert(ctx context.Context, k db.Key, v db.Value) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.Upsert(ctx, k, v)
+}
+
+func (t *fakeTransaction) UpdateIfUnchangedSince(ctx context.Context, k db.Key, v db.Value, since uint64) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.UpdateIfUnchangedSince(ctx, k, v, since)
+}
+
+func (t *fakeTransaction) InsertWithMetadata(ctx context.Context, k db.Key, v db.Value, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.InsertWithMetadata(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) UpdateWithMetadata(ctx context.Context, k db.Key, v db.Value, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.UpdateWithMetadata(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) UpsertWithMetadata(ctx context.Context, k db.Key, v db.Value, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.UpsertWithMetadata(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) InsertValueRef(ctx context.Context, k db.Key, v db.ValueRef, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.InsertValueRef(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) UpdateValueRef(ctx context.Context, k db.Key, v db.ValueRef, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.UpdateValueRef(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) UpsertValueRef(ctx context.Context, k db.Key, v db.ValueRef, m db.Metadata) error {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return err
+	}
+	return t.Transaction.UpsertValueRef(ctx, k, v, m)
+}
+
+func (t *fakeTransaction) Delete(ctx context.Context, k db.Key) (bool, error) {
+	if err := t.fake.perform(ctx, Write, k); err != nil {
+		return false, err
+	}
+	return t.Transaction.Delete(ctx, k)
+}
+
+func (t *fakeTransaction) Scan(ctx context.Context, prefix db.Key) iter.Seq2[db.Key, db.Value] {
+	return func(yield func(db.Key, db.Value) bool) {
+		for k, v := range t.Transaction.Scan(ctx, prefix) {
+			if err := t.fake.perform(ctx, Scan, k); err != nil {
+				if t.scanErr == nil {
+					t.scanErr = err
+				}
+				return
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+func TestFakeInjectsFaults(t *testing.T) {
+	ctx := context.Background()
+	fake, err := NewFake(db.WithMaxTransactionAttempts(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert := func(k, v string) error {
+		return fake.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+			err := tx.Upsert(ctx, db.Key(k), db.Value(v))
+			return err == nil, err
+		})
+	}
+	get := func(ctx context.Context, k string) (db.Value, error) {
+		var v db.Value
+		err := fake.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+			var err error
+			v, err = tx.Get(ctx, db.Key(k))
+			return false, err
+		})
+		return v, err
+	}
+	if err := upsert("k", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	errInjected := errors.New("injected")
+	fake.Inject(Fault{Operation: Read, Key: db.Key("k"), Err: errInjected, Times: 1})
+	if _, err := get(ctx, "other"); !errors.Is(err, db.ErrRecordDoesNotExist) {
+		t.Errorf("want record does not exist reading other record, got %v", err)
+	}
+	if _, err := get(ctx, "k"); !errors.Is(err, errInjected) {
+		t.Errorf("want injected error, got %v", err)
+	}
+	if v, err := get(ctx, "k"); err != nil || string(v) != "a" {
+		t.Errorf("want value %q once fault is spent, got %q, %v", "a", v, err)
+	}
+
+	// The store retries a transaction failing with a conflict.
+	fake.Inject(Fault{Operation: Write, Err: db.ErrTransactionInConflict, Times: 1})
+	if err := upsert("k", "b"); err != nil {
+		t.Errorf("want conflict overcome by retrying, got %v", err)
+	}
+
+	fake.Inject(Fault{Operation: Commit, Err: errInjected, Times: 1})
+	if err := upsert("k", "c"); !errors.Is(err, errInjected) {
+		t.Errorf("want injected error committing, got %v", err)
+	}
+	if v, err := get(ctx, "k"); err != nil || string(v) != "b" {
+		t.Errorf("want value %q after failed commit, got %q, %v", "b", v, err)
+	}
+
+	// A failing scan stops yielding records, and the transaction can no longer commit.
+	if err := upsert("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	fake.Inject(Fault{Operation: Scan, Key: db.Key("other"), Err: errInjected, Times: 1})
+	var scanned []string
+	err = fake.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		for k := range tx.Scan(ctx, nil) {
+			scanned = append(scanned, string(k))
+		}
+		return true, tx.Upsert(ctx, db.Key("k"), db.Value("d"))
+	})
+	if !errors.Is(err, errInjected) {
+		t.Errorf("want injected error scanning, got %v", err)
+	}
+	if slices.Contains(scanned, "other") {
+		t.Errorf("want scan stopped before yielding failed record, got keys %q", scanned)
+	}
+	if v, err := get(ctx, "k"); err != nil || string(v) != "b" {
+		t.Errorf("want value %q after failed scan, got %q, %v", "b", v, err)
+	}
+
+	fake.Inject(Fault{Operation: BeginTransaction, Delay: time.Hour})
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := get(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded while delayed, got %v", err)
+	}
+	fake.Reset()
+	if v, err := get(context.Background(), "k"); err != nil || string(v) != "b" {
+		t.Errorf("want value %q after reset, got %q, %v", "b", v, err)
+	}
+}
@@ -0,0 +1,61 @@
+package dbtest
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// TestStore is a store for use in tests, along with the Clock by which it tells time.
+type TestStore struct {
+	*db.ShardedStore
+	// Clock governs the store's time-based features, such as leases, whose time passes only when
+	// the test advances it.
+	Clock *FakeClock
+}
+
+// testEpoch is the time at which the Clock of each TestStore begins.
+var testEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// deterministicShardProjection assigns keys to shards identically in every process, unlike the
+// store's default projection, which seeds its hash function randomly.
+func deterministicShardProjection(k db.Key) uint64 {
+	h := fnv.New64a()
+	h.Write(k)
+	return h.Sum64()
+}
+
+// NewTestStore creates an empty store whose behavior is reproducible from one test run to the
+// next: it assigns keys to shards deterministically, concludes its bookkeeping for each committed
+// transaction before WithinTransaction returns, and tells time by a FakeClock beginning at a fixed
+// time. The given options apply after those, such that they may override them. NewTestStore fails
+// the test if it can't create the store, and, once the test concludes, fails the test if the
+// store's records violate the invariants governing their history of versions (see
+// db.ShardedStore.CheckConsistency).
+func NewTestStore(t testing.TB, opts ...db.ShardedStoreOption) *TestStore {
+	t.Helper()
+	clock := NewFakeClock(testEpoch)
+	store, err := db.MakeShardedStore(append([]db.ShardedStoreOption{
+		db.WithKeyShardProjection(deterministicShardProjection),
+		db.WithClock(clock),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create test store: %v", err)
+	}
+	t.Cleanup(func() {
+		anomalies, err := store.CheckConsistency(context.Background())
+		if err != nil {
+			t.Errorf("failed to check test store's consistency: %v", err)
+		}
+		for _, a := range anomalies {
+			t.Errorf("test store is inconsistent: %s", a)
+		}
+	})
+	return &TestStore{
+		ShardedStore: store,
+		Clock:        clock,
+	}
+}
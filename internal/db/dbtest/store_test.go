@@ -0,0 +1,95 @@
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"sehlabs.com/db/internal/db"
+)
+
+func TestTestStoreLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestStore(t)
+	if want, got := testEpoch, store.Clock.Now(); !want.Equal(got) {
+		t.Errorf("clock time: want %v, got %v", want, got)
+	}
+	id, err := store.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		if err := tx.Insert(ctx, db.Key("k"), db.Value("v")); err != nil {
+			return false, err
+		}
+		return true, tx.AttachToLease(ctx, db.Key("k"), id)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exists := func() bool {
+		t.Helper()
+		var exists bool
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+			_, err := tx.Get(ctx, db.Key("k"))
+			exists = err == nil
+			if errors.Is(err, db.ErrRecordDoesNotExist) {
+				err = nil
+			}
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+	store.Clock.Advance(45 * time.Second)
+	if err := store.KeepLeaseAlive(id); err != nil {
+		t.Fatal(err)
+	}
+	store.Clock.Advance(45 * time.Second)
+	if !exists() {
+		t.Fatal("record attached to lease kept alive expired")
+	}
+	store.Clock.Advance(15 * time.Second)
+	if exists() {
+		t.Error("record attached to expired lease remains")
+	}
+	if err := store.KeepLeaseAlive(id); !errors.Is(err, db.ErrLeaseNotFound) {
+		t.Errorf("want lease not found keeping expired lease alive, got %v", err)
+	}
+}
+
+func TestTestStoreTrashRetention(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestStore(t, db.WithTrashRetention(time.Hour))
+	for _, f := range []func(context.Context, db.Transaction) error{
+		func(ctx context.Context, tx db.Transaction) error {
+			return tx.Insert(ctx, db.Key("k"), db.Value("v"))
+		},
+		func(ctx context.Context, tx db.Transaction) error {
+			_, err := tx.Delete(ctx, db.Key("k"))
+			return err
+		},
+	} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+			return true, f(ctx, tx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trashed := store.TrashedRecords()
+	if len(trashed) != 1 {
+		t.Fatalf("want one deleted record in trash, got %d", len(trashed))
+	}
+	if want, got := testEpoch, trashed[0].DeletedAt; !want.Equal(got) {
+		t.Errorf("deletion time: want %v, got %v", want, got)
+	}
+	store.Clock.Advance(time.Hour - time.Second)
+	if n := len(store.TrashedRecords()); n != 1 {
+		t.Errorf("want deleted record in trash before retention period elapses, got %d records", n)
+	}
+	store.Clock.Advance(2 * time.Second)
+	if n := len(store.TrashedRecords()); n != 0 {
+		t.Errorf("want trash emptied after retention period, got %d records", n)
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+)
+
+// A ValueDecoder derives a representation of a record's value that is expensive to compute, such
+// as by decompressing or parsing the value. It must not retain or modify the given Key or Value.
+type ValueDecoder func(k Key, v Value) (any, error)
+
+// WithDecodedValueCache establishes a function with which Transaction.GetDecoded derives a
+// representation of each record's value, along with the positive number of such derived values to
+// retain in a least-recently-used cache, keyed by each record's key and committed version. Reading
+// the same version of a record again then reuses its derived value rather than decoding the value
+// again. Committing a new version of a record evicts any derived value cached for that record.
+//
+// Callers must treat the derived values as immutable, since transactions reading the same record
+// version share them.
+func WithDecodedValueCache(decode ValueDecoder, capacity int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if decode == nil {
+			return errors.New("value decoder must be non-nil")
+		}
+		if capacity < 1 {
+			return errors.New("decoded value cache capacity must be positive")
+		}
+		o.valueDecoder = decode
+		o.decodedValueCapacity = capacity
+		return nil
+	}
+}
+
+// errNoValueDecoder is the error returned by Transaction.GetDecoded when the store lacks a
+// ValueDecoder.
+var errNoValueDecoder = errors.New("store has no value decoder")
+
+type decodedValue struct {
+	key     string
+	version uint64
+	value   any
+}
+
+// decodedValueCache retains the values derived from the most recently read record versions, at
+// most one version per record.
+type decodedValueCache struct {
+	decode   ValueDecoder
+	capacity int
+	mu       sync.Mutex
+	byKey    map[string]*list.Element // Element values are *decodedValue.
+	recency  list.List                // Most recently used at the front.
+}
+
+func newDecodedValueCache(decode ValueDecoder, capacity int) *decodedValueCache {
+	return &decodedValueCache{
+		decode:   decode,
+		capacity: capacity,
+		byKey:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (c *decodedValueCache) get(k Key, version uint64) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.byKey[string(k)]
+	if !ok {
+		return nil, false
+	}
+	if d := e.Value.(*decodedValue); d.version == version {
+		c.recency.MoveToFront(e)
+		return d.value, true
+	}
+	return nil, false
+}
+
+func (c *decodedValueCache) put(k Key, version uint64, v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byKey[string(k)]; ok {
+		d := e.Value.(*decodedValue)
+		// Favor the newest version, which more transactions are likely to read.
+		if d.version < version {
+			d.version = version
+			d.value = v
+		}
+		c.recency.MoveToFront(e)
+		return
+	}
+	if c.recency.Len() >= c.capacity {
+		oldest := c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*decodedValue).key)
+	}
+	d := &decodedValue{key: string(k), version: version, value: v}
+	c.byKey[d.key] = c.recency.PushFront(d)
+}
+
+func (c *decodedValueCache) invalidate(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byKey[k]; ok {
+		c.recency.Remove(e)
+		delete(c.byKey, k)
+	}
+}
+
+// invalidateDecodedValues evicts any values derived from the records to which this transaction
+// just committed changes.
+func (t *shardedStoreTransaction) invalidateDecodedValues() {
+	c := t.store.decodedValues
+	if c == nil {
+		return
+	}
+	for k := range t.pendingWrites {
+		c.invalidate(k)
+	}
+}
+
+func (t *shardedStoreTransaction) GetDecoded(ctx context.Context, k Key) (any, error) {
+	c := t.store.decodedValues
+	if c == nil {
+		return nil, errNoValueDecoder
+	}
+	v, version, err := t.GetVersioned(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		// Don't cache values that this transaction proposed but hasn't yet committed.
+		return c.decode(k, v)
+	}
+	if d, ok := c.get(k, version); ok {
+		return d, nil
+	}
+	d, err := c.decode(k, v)
+	if err != nil {
+		return nil, err
+	}
+	c.put(k, version, d)
+	return d, nil
+}
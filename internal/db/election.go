@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+)
+
+// lockRecordKey returns the reserved key of the record identifying the holder of the named lock.
+func lockRecordKey(name string) Key {
+	return reservedKeyFor(namedLockKeyKind, Key(name), nil)
+}
+
+// AcquireLock attempts to acquire the named lock on behalf of the given holder, reporting whether
+// the holder now holds the lock, along with the lock's current holder. Acquiring a lock that the
+// holder already holds succeeds, attaching the lock to the given lease instead.
+//
+// The lock remains held until either the holder releases it (see ReleaseLock) or the given lease
+// expires or is revoked (see GrantLease), so that a holder that fails can't retain the lock
+// indefinitely. Contending for a lock with a well-known name also serves to elect a leader among
+// a set of candidates, with the lock's holder being the leader.
+//
+// If no such lease exists, AcquireLock returns ErrLeaseNotFound.
+func (s *ShardedStore) AcquireLock(ctx context.Context, name, holder string, leaseID uint64) (bool, string, error) {
+	if len(name) == 0 {
+		return false, "", errors.New("lock name must be nonempty")
+	}
+	if len(holder) == 0 {
+		return false, "", errors.New("lock holder must be nonempty")
+	}
+	k := lockRecordKey(name)
+	var acquired bool
+	currentHolder := holder
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		v, ok, err := t.readReserved(ctx, k)
+		if err != nil {
+			return false, err
+		}
+		if ok && string(v) != holder {
+			currentHolder = string(v)
+			return false, nil
+		}
+		if !ok {
+			if err := t.writeReserved(ctx, k, Value(holder)); err != nil {
+				return false, err
+			}
+		}
+		if err := t.AttachToLease(ctx, k, leaseID); err != nil {
+			return false, err
+		}
+		acquired = true
+		return true, nil
+	})
+	if err != nil {
+		return false, "", err
+	}
+	return acquired, currentHolder, nil
+}
+
+// ReleaseLock releases the named lock if the given holder holds it, reporting whether it did so.
+func (s *ShardedStore) ReleaseLock(ctx context.Context, name, holder string) (bool, error) {
+	k := lockRecordKey(name)
+	var released bool
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		v, ok, err := t.readReserved(ctx, k)
+		if err != nil || !ok || string(v) != holder {
+			return false, err
+		}
+		if err := t.writeReserved(ctx, k, nil); err != nil {
+			return false, err
+		}
+		released = true
+		return true, nil
+	})
+	return released, err
+}
+
+// LockHolder reports the current holder of the named lock, if any.
+func (s *ShardedStore) LockHolder(ctx context.Context, name string) (string, bool, error) {
+	var holder string
+	var held bool
+	err := s.withinSnapshot(ctx, func(ctx context.Context, tx *shardedStoreTransaction) error {
+		v, ok, err := tx.readReserved(ctx, lockRecordKey(name))
+		holder, held = string(v), ok
+		return err
+	})
+	return holder, held, err
+}
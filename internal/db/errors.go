@@ -1,10 +1,22 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
 
+// KeyOfError returns the key of the record to which the given error pertains, such as the key of
+// the record that already exists for an error matching ErrRecordExists, reporting whether the
+// error pertains to any particular record.
+func KeyOfError(err error) (Key, bool) {
+	var ke interface{ recordKey() string }
+	if !errors.As(err, &ke) {
+		return nil, false
+	}
+	return Key(ke.recordKey()), true
+}
+
 // ErrRecordExists is the error returned for attempts to insert a new record into the database
 // when a record the given key already exists. This may be wrapped in another error, and should
 // normally be tested using errors.Is(err, ErrRecordExists).
@@ -12,6 +24,10 @@ var ErrRecordExists = errors.New("record exists")
 
 type recordExistsError string
 
+func (e recordExistsError) recordKey() string {
+	return string(e)
+}
+
 func (e recordExistsError) Error() string {
 	return fmt.Sprintf("record with key %q exists", string(e))
 }
@@ -31,6 +47,10 @@ var ErrRecordDoesNotExist = errors.New("record does not exist")
 
 type recordDoesNotExistError string
 
+func (e recordDoesNotExistError) recordKey() string {
+	return string(e)
+}
+
 func (e recordDoesNotExistError) Error() string {
 	return fmt.Sprintf("record with key %q does not exist", string(e))
 }
@@ -51,6 +71,10 @@ var ErrTransactionInConflict = errors.New("write attempt conflicts with another
 
 type transactionInConflictError string
 
+func (e transactionInConflictError) recordKey() string {
+	return string(e)
+}
+
 func (e transactionInConflictError) Error() string {
 	return fmt.Sprintf("attempt to write record with key %q conflicts with another transaction", string(e))
 }
@@ -62,3 +86,429 @@ func (e transactionInConflictError) Is(err error) bool {
 	downcasted, ok := err.(*transactionInConflictError)
 	return ok && *downcasted == e
 }
+
+// ErrInvalidKey is the error returned for attempts to write a record in the database with a key
+// that fails validation by a KeyValidator. This may be wrapped in another error, and should
+// normally be tested using errors.Is(err, ErrInvalidKey).
+var ErrInvalidKey = errors.New("invalid key")
+
+type invalidKeyError struct {
+	key string
+	err error
+}
+
+func (e *invalidKeyError) recordKey() string {
+	return e.key
+}
+
+func (e *invalidKeyError) Error() string {
+	return fmt.Sprintf("key %q is invalid: %v", e.key, e.err)
+}
+
+func (e *invalidKeyError) Is(err error) bool {
+	return err == ErrInvalidKey
+}
+
+func (e *invalidKeyError) Unwrap() error {
+	return e.err
+}
+
+// ErrInvalidValue is the error returned for attempts to write a record in the database with a
+// value that fails validation by a ValueValidator. This may be wrapped in another error, and should
+// normally be tested using errors.Is(err, ErrInvalidValue).
+var ErrInvalidValue = errors.New("invalid value")
+
+type invalidValueError struct {
+	key string
+	err error
+}
+
+func (e *invalidValueError) recordKey() string {
+	return e.key
+}
+
+func (e *invalidValueError) Error() string {
+	return fmt.Sprintf("value for key %q is invalid: %v", e.key, e.err)
+}
+
+func (e *invalidValueError) Is(err error) bool {
+	return err == ErrInvalidValue
+}
+
+func (e *invalidValueError) Unwrap() error {
+	return e.err
+}
+
+// ErrStoreFailed is the error returned for attempts to use a store that has suffered a failure
+// from which it can't recover safely. This may be wrapped in another error, and should normally be
+// tested using errors.Is(err, ErrStoreFailed).
+var ErrStoreFailed = errors.New("store failed")
+
+type storeFailedError struct {
+	err error
+}
+
+func (e *storeFailedError) Error() string {
+	return fmt.Sprintf("store failed: %v", e.err)
+}
+
+func (e *storeFailedError) Is(err error) bool {
+	return err == ErrStoreFailed
+}
+
+func (e *storeFailedError) Unwrap() error {
+	return e.err
+}
+
+// ErrProcedureNotFound is the error returned for attempts to call a stored procedure that was
+// never registered. This may be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrProcedureNotFound).
+var ErrProcedureNotFound = errors.New("procedure not found")
+
+type procedureNotFoundError string
+
+func (e procedureNotFoundError) Error() string {
+	return fmt.Sprintf("procedure %q not found", string(e))
+}
+
+func (e procedureNotFoundError) Is(err error) bool {
+	if err == ErrProcedureNotFound {
+		return true
+	}
+	downcasted, ok := err.(*procedureNotFoundError)
+	return ok && *downcasted == e
+}
+
+// ErrTransactionTooLarge is the error returned for attempts to write more distinct records within
+// a single transaction than the store allows (see WithMaxPendingWritesPerTransaction). It also
+// matches ErrQuotaExceeded. This may be wrapped in another error, and should normally be tested
+// using errors.Is(err, ErrTransactionTooLarge).
+var ErrTransactionTooLarge = errors.New("transaction too large")
+
+type transactionTooLargeError struct {
+	key   string
+	limit int
+}
+
+func (e *transactionTooLargeError) recordKey() string {
+	return e.key
+}
+
+func (e *transactionTooLargeError) Error() string {
+	return fmt.Sprintf("attempt to write record with key %q exceeds limit of %d records written per transaction", e.key, e.limit)
+}
+
+func (e *transactionTooLargeError) Is(err error) bool {
+	return err == ErrTransactionTooLarge || err == ErrQuotaExceeded
+}
+
+// ErrTransactionAborted is the error returned for a transaction that an administrator forcibly
+// aborted (see ShardedStore.AbortTransaction). This may be wrapped in another error, and should
+// normally be tested using errors.Is(err, ErrTransactionAborted).
+var ErrTransactionAborted = errors.New("transaction aborted")
+
+type transactionAbortedError uint64
+
+func (e transactionAbortedError) Error() string {
+	return fmt.Sprintf("transaction with ID %d was aborted", uint64(e))
+}
+
+func (e transactionAbortedError) Is(err error) bool {
+	return err == ErrTransactionAborted
+}
+
+// ErrLeaseNotFound is the error returned for attempts to use a lease that either never existed
+// or has since expired or been revoked (see ShardedStore.GrantLease). This may be wrapped in
+// another error, and should normally be tested using errors.Is(err, ErrLeaseNotFound).
+var ErrLeaseNotFound = errors.New("lease not found")
+
+type leaseNotFoundError uint64
+
+func (e leaseNotFoundError) Error() string {
+	return fmt.Sprintf("lease with ID %d not found", uint64(e))
+}
+
+func (e leaseNotFoundError) Is(err error) bool {
+	return err == ErrLeaseNotFound
+}
+
+// ErrMessageNotLeased is the error returned for attempts to acknowledge or release a queue message
+// under a lease that no longer holds it, whether because the lease expired, freeing the message
+// for other consumers, or because the message was already acknowledged or released (see
+// ShardedStore.Dequeue). This may be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrMessageNotLeased).
+var ErrMessageNotLeased = errors.New("queue message not leased")
+
+type messageNotLeasedError struct {
+	queue   string
+	id      uint64
+	leaseID uint64
+}
+
+func (e messageNotLeasedError) Error() string {
+	return fmt.Sprintf("message %d in queue %q not leased under lease with ID %d", e.id, e.queue, e.leaseID)
+}
+
+func (e messageNotLeasedError) Is(err error) bool {
+	return err == ErrMessageNotLeased
+}
+
+// ErrReshardingInProgress is the error returned for attempts to migrate a store's records between
+// shards while another such migration is already underway (see ShardedStore.Resharding).
+var ErrReshardingInProgress = errors.New("resharding in progress")
+
+// ErrPreparedTransactionExists is the error returned for attempts to prepare a transaction with
+// the same ID as another transaction that awaits a decision (see ShardedStore.PrepareTransaction).
+// This may be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrPreparedTransactionExists).
+var ErrPreparedTransactionExists = errors.New("prepared transaction exists")
+
+type preparedTransactionExistsError string
+
+func (e preparedTransactionExistsError) Error() string {
+	return fmt.Sprintf("transaction with ID %q is already prepared", string(e))
+}
+
+func (e preparedTransactionExistsError) Is(err error) bool {
+	return err == ErrPreparedTransactionExists
+}
+
+// ErrPreparedTransactionNotFound is the error returned for attempts to commit or abort a prepared
+// transaction that either never existed or has since been decided or expired (see
+// ShardedStore.CommitPrepared). This may be wrapped in another error, and should normally be
+// tested using errors.Is(err, ErrPreparedTransactionNotFound).
+var ErrPreparedTransactionNotFound = errors.New("prepared transaction not found")
+
+type preparedTransactionNotFoundError string
+
+func (e preparedTransactionNotFoundError) Error() string {
+	return fmt.Sprintf("no transaction with ID %q is prepared", string(e))
+}
+
+func (e preparedTransactionNotFoundError) Is(err error) bool {
+	return err == ErrPreparedTransactionNotFound
+}
+
+// ErrRecordNotInTrash is the error returned for attempts to restore a deleted record that the
+// store no longer retains in its trash (see Transaction.Undelete). This may be wrapped in another
+// error, and should normally be tested using errors.Is(err, ErrRecordNotInTrash).
+var ErrRecordNotInTrash = errors.New("record not in trash")
+
+type recordNotInTrashError string
+
+func (e recordNotInTrashError) recordKey() string {
+	return string(e)
+}
+
+func (e recordNotInTrashError) Error() string {
+	return fmt.Sprintf("record with key %q is not in trash", string(e))
+}
+
+func (e recordNotInTrashError) Is(err error) bool {
+	return err == ErrRecordNotInTrash
+}
+
+// ErrWriteRateExceeded is the error returned for attempts to write a record more often than the
+// store allows (see WithPerKeyWriteRate). It also matches ErrQuotaExceeded. This may be wrapped in
+// another error, and should normally be tested using errors.Is(err, ErrWriteRateExceeded).
+var ErrWriteRateExceeded = errors.New("write rate exceeded")
+
+type writeRateExceededError string
+
+func (e writeRateExceededError) recordKey() string {
+	return string(e)
+}
+
+func (e writeRateExceededError) Error() string {
+	return fmt.Sprintf("attempt to write record with key %q exceeds per-key write rate", string(e))
+}
+
+func (e writeRateExceededError) Is(err error) bool {
+	return err == ErrWriteRateExceeded || err == ErrQuotaExceeded
+}
+
+// ErrReadOnlyTransaction is the error returned for attempts to write a record within a
+// transaction that may only read records, such as one run at a pinned snapshot (see
+// ShardedStore.PinSnapshot) or within a read-only store (see ShardedStore.SetReadOnly). This may
+// be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrReadOnlyTransaction).
+var ErrReadOnlyTransaction = errors.New("transaction is read-only")
+
+type readOnlyTransactionError string
+
+func (e readOnlyTransactionError) recordKey() string {
+	return string(e)
+}
+
+func (e readOnlyTransactionError) Error() string {
+	return fmt.Sprintf("attempt to write record with key %q within read-only transaction", string(e))
+}
+
+func (e readOnlyTransactionError) Is(err error) bool {
+	return err == ErrReadOnlyTransaction
+}
+
+// ErrAssertionFailed is the error returned when a condition on a record that a transaction
+// asserted (see Transaction.AssertAbsent, Transaction.AssertValue, and Transaction.AssertVersion)
+// doesn't hold, either when asserted or when the transaction is about to commit. This may be
+// wrapped in another error, and should normally be tested using errors.Is(err, ErrAssertionFailed).
+var ErrAssertionFailed = errors.New("assertion failed")
+
+type assertionFailedError struct {
+	key    string
+	reason string
+}
+
+func (e assertionFailedError) recordKey() string {
+	return e.key
+}
+
+func (e assertionFailedError) Error() string {
+	return fmt.Sprintf("assertion about record with key %q failed: %s", e.key, e.reason)
+}
+
+func (e assertionFailedError) Is(err error) bool {
+	return err == ErrAssertionFailed
+}
+
+// ErrNamespaceExists is the error returned for attempts to create a namespace with the same name
+// as one that exists already (see Transaction.CreateNamespace). This may be wrapped in another
+// error, and should normally be tested using errors.Is(err, ErrNamespaceExists).
+var ErrNamespaceExists = errors.New("namespace exists")
+
+type namespaceExistsError string
+
+func (e namespaceExistsError) Error() string {
+	return fmt.Sprintf("namespace %q exists", string(e))
+}
+
+func (e namespaceExistsError) Is(err error) bool {
+	return err == ErrNamespaceExists
+}
+
+// ErrNamespaceNotFound is the error returned for attempts to use a namespace that doesn't exist
+// (see Transaction.Namespace). This may be wrapped in another error, and should normally be
+// tested using errors.Is(err, ErrNamespaceNotFound).
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+type namespaceNotFoundError string
+
+func (e namespaceNotFoundError) Error() string {
+	return fmt.Sprintf("namespace %q not found", string(e))
+}
+
+func (e namespaceNotFoundError) Is(err error) bool {
+	return err == ErrNamespaceNotFound
+}
+
+// ErrTransactionCancelled is the error returned for a transaction that asked to commit its changes
+// after the Context governing it was done, and that the store rolled back instead, per its
+// cancellation policy (see WithCancellationPolicy). It wraps the Context's cause. This may be
+// wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrTransactionCancelled).
+var ErrTransactionCancelled = errors.New("transaction cancelled")
+
+type transactionCancelledError struct {
+	id    transactionID
+	cause error
+}
+
+func (e *transactionCancelledError) Error() string {
+	return fmt.Sprintf("transaction with ID %d was cancelled before committing: %v", e.id, e.cause)
+}
+
+func (e *transactionCancelledError) Is(err error) bool {
+	return err == ErrTransactionCancelled
+}
+
+func (e *transactionCancelledError) Unwrap() error {
+	return e.cause
+}
+
+// ErrRollback is the error that a function supplied to WithinTransaction may return to roll back
+// the transaction's proposed changes without failing, whereupon WithinTransaction returns nil,
+// sparing callers from distinguishing declining to commit from genuine failures. The function may
+// also wrap it in another error.
+var ErrRollback = errors.New("roll back transaction")
+
+// ErrQuotaExceeded is the error returned for attempts to use more of the store's resources than
+// it allows, whether by writing a record too often (ErrWriteRateExceeded), writing too many
+// records within one transaction (ErrTransactionTooLarge), or writing too large a value
+// (ErrValueTooLarge). Errors matching it also match one of those more specific errors. This may be
+// wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrQuotaExceeded).
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrValueTooLarge is the error returned for attempts to write a record with a value larger than
+// the store allows (see WithMaxValueSize). It also matches ErrQuotaExceeded. This may be wrapped
+// in another error, and should normally be tested using errors.Is(err, ErrValueTooLarge).
+var ErrValueTooLarge = errors.New("value too large")
+
+type valueTooLargeError struct {
+	key   string
+	size  int
+	limit int
+}
+
+func (e *valueTooLargeError) recordKey() string {
+	return e.key
+}
+
+func (e *valueTooLargeError) Error() string {
+	return fmt.Sprintf("value of %d bytes for key %q exceeds limit of %d bytes", e.size, e.key, e.limit)
+}
+
+func (e *valueTooLargeError) Is(err error) bool {
+	return err == ErrValueTooLarge || err == ErrQuotaExceeded
+}
+
+// ErrTimeout is the error returned for attempts to read or write a record that didn't complete
+// before the deadline of the Context governing them passed. It wraps context.DeadlineExceeded.
+// This may be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrTimeout).
+var ErrTimeout = errors.New("operation timed out")
+
+// ErrCancelled is the error returned for attempts to read or write a record that didn't complete
+// before the Context governing them was cancelled. It wraps context.Canceled. Unlike
+// ErrTransactionCancelled, it doesn't imply that the store rolled back a transaction that asked
+// to commit its changes. This may be wrapped in another error, and should normally be tested
+// using errors.Is(err, ErrCancelled).
+var ErrCancelled = errors.New("operation cancelled")
+
+type operationInterruptedError struct {
+	key string
+	err error
+}
+
+// interruptedError returns the error with which to fail an operation on the record with the given
+// key because the given Context is done.
+func interruptedError(ctx context.Context, k Key) error {
+	return &operationInterruptedError{key: string(k), err: ctx.Err()}
+}
+
+func (e *operationInterruptedError) recordKey() string {
+	return e.key
+}
+
+func (e *operationInterruptedError) Error() string {
+	return fmt.Sprintf("operation on record with key %q was interrupted: %v", e.key, e.err)
+}
+
+func (e *operationInterruptedError) Is(err error) bool {
+	switch err {
+	case ErrTimeout:
+		return errors.Is(e.err, context.DeadlineExceeded)
+	case ErrCancelled:
+		return errors.Is(e.err, context.Canceled)
+	default:
+		return false
+	}
+}
+
+func (e *operationInterruptedError) Unwrap() error {
+	return e.err
+}
+
+// ErrStoreClosed is the error returned for attempts to use a store after closing it (see
+// ShardedStore.Close).
+var ErrStoreClosed = errors.New("store closed")
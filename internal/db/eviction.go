@@ -0,0 +1,224 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// EvictionPolicy governs which committed records a store established with WithEviction evicts
+// once it holds more records than its limits allow.
+type EvictionPolicy uint8
+
+const (
+	// LRU directs the store to evict the records that transactions read or wrote least recently.
+	LRU EvictionPolicy = iota
+)
+
+// EvictionLimits bound how much a store established with WithEviction holds before evicting
+// records. A zero limit imposes no bound.
+type EvictionLimits struct {
+	// MaxRecords is the number of records beyond which the store evicts records.
+	MaxRecords int
+	// MaxBytes is the approximate combined size of the records' keys and values beyond which the
+	// store evicts records.
+	MaxBytes int64
+}
+
+// WithEviction directs the store to evict committed records per the given policy once it holds
+// more records than the given limits allow, at least one of which must be positive, turning the
+// store into a transactional cache with bounded memory. Pairing this option with
+// WithReadMissHandler reloads evicted records from another system upon demand.
+//
+// The store tracks the order in which transactions read and write records via Get, GetVersioned,
+// GetRecord, and committed writes, not counting scans, and evicts records once a transaction
+// commits or loads records beyond the limits. It never evicts records with changes pending in
+// active transactions, records locked via Transaction.LockForUpdate, or the records with which
+// it represents sets, lists, locks, and sequences. An evicted record vanishes for every
+// transaction, including those that began before the eviction and could otherwise still observe
+// it, and attempts to write the record that race with its eviction fail with
+// ErrTransactionInConflict. Tracking costs acquiring a store-wide lock upon each access.
+func WithEviction(p EvictionPolicy, limits EvictionLimits) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if p != LRU {
+			return errors.New("unrecognized eviction policy")
+		}
+		if limits.MaxRecords < 0 || limits.MaxBytes < 0 {
+			return errors.New("eviction limits must be nonnegative")
+		}
+		if limits.MaxRecords == 0 && limits.MaxBytes == 0 {
+			return errors.New("at least one eviction limit must be positive")
+		}
+		o.evictionLimits = &limits
+		return nil
+	}
+}
+
+type evictionEntry struct {
+	key  string
+	size int64
+}
+
+// evictionTracker orders the store's records by when transactions last used them, most recently
+// used first.
+type evictionTracker struct {
+	limits  EvictionLimits
+	mu      sync.Mutex
+	order   list.List
+	byKey   map[string]*list.Element
+	bytes   int64
+	evicted atomic.Uint64
+}
+
+func newEvictionTracker(limits EvictionLimits) *evictionTracker {
+	return &evictionTracker{
+		limits: limits,
+		byKey:  make(map[string]*list.Element),
+	}
+}
+
+// use notes that a transaction used the record with the given key, of the given approximate size.
+func (et *evictionTracker) use(k Key, size int64) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if e, ok := et.byKey[string(k)]; ok {
+		entry := e.Value.(*evictionEntry)
+		et.bytes += size - entry.size
+		entry.size = size
+		et.order.MoveToFront(e)
+		return
+	}
+	et.byKey[string(k)] = et.order.PushFront(&evictionEntry{key: string(k), size: size})
+	et.bytes += size
+}
+
+// overLimit reports whether the tracked records exceed the limits. The caller must hold the lock.
+func (et *evictionTracker) overLimit() bool {
+	return (et.limits.MaxRecords > 0 && et.order.Len() > et.limits.MaxRecords) ||
+		(et.limits.MaxBytes > 0 && et.bytes > et.limits.MaxBytes)
+}
+
+// popLeastRecent stops tracking the least recently used record if the tracked records exceed the
+// limits, returning its key and size.
+func (et *evictionTracker) popLeastRecent() (*evictionEntry, bool) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if !et.overLimit() {
+		return nil, false
+	}
+	e := et.order.Back()
+	entry := et.order.Remove(e).(*evictionEntry)
+	delete(et.byKey, entry.key)
+	et.bytes -= entry.size
+	return entry, true
+}
+
+// recordSize approximates the memory that the record with the given key occupies, counting only
+// the given version's value.
+func recordSize(k Key, r *recordVersion) int64 {
+	return int64(len(k) + len(r.value))
+}
+
+// noteRecordUse notes that a transaction used the given version of the record with the given key,
+// if the store evicts records.
+func (s *ShardedStore) noteRecordUse(k Key, r *recordVersion) {
+	if s.eviction == nil || isReservedKey(k) {
+		return
+	}
+	s.eviction.use(k, recordSize(k, r))
+}
+
+// noteCommittedUses notes that this transaction used the records to which it committed changes,
+// if the store evicts records.
+func (t *shardedStoreTransaction) noteCommittedUses() {
+	if t.store.eviction == nil {
+		return
+	}
+	for k := range t.pendingWrites {
+		if isReservedKey(Key(k)) {
+			continue
+		}
+		// Like transaction finalization, wait indefinitely to acquire the shard's lock.
+		rm := t.store.readLockRecordMapFor(context.Background(), Key(k))
+		if rm == nil {
+			continue
+		}
+		record := rm.recordsByKey[k]
+		rm.lock.RUnlock()
+		if record == nil {
+			continue
+		}
+		if r := record.newest.Load(); r != nil {
+			t.store.eviction.use(Key(k), recordSize(Key(k), r))
+		}
+	}
+}
+
+// evictExcessRecords evicts the least recently used records until the store no longer exceeds its
+// eviction limits, if any, skipping those that it may not evict.
+func (s *ShardedStore) evictExcessRecords() {
+	et := s.eviction
+	if et == nil {
+		return
+	}
+	et.mu.Lock()
+	candidates := et.order.Len()
+	et.mu.Unlock()
+	// Bound the effort, lest records that remain ineligible for eviction keep returning.
+	for ; candidates > 0; candidates-- {
+		entry, ok := et.popLeastRecent()
+		if !ok {
+			return
+		}
+		if !s.evictRecord(Key(entry.key)) {
+			et.use(Key(entry.key), entry.size)
+		}
+	}
+}
+
+// evictRecord removes the record with the given key from the store if no transaction is writing
+// it or holds it locked, reporting whether the record is no longer eligible for tracking: either
+// it's gone, or a transaction is writing it and will track it again upon committing.
+func (s *ShardedStore) evictRecord(k Key) bool {
+	if _, ok := s.recordLocksFor(k).heldByOtherThan(k, noSuchTransaction); ok {
+		return false
+	}
+	rm, next := s.lockRecordMapsFor(context.Background(), k)
+	if rm == nil {
+		return false
+	}
+	defer unlockRecordMaps(rm, next)
+	record, ok := rm.recordsByKey[string(k)]
+	if !ok {
+		return true
+	}
+	r := record.newest.Load()
+	if r == nil || r.validAsOfTransactionID() == noSuchTransaction {
+		return true
+	}
+	// Preclude transactions that already hold the record from writing to it after it leaves the
+	// store by proposing a version on behalf of no transaction, which they'll treat as a
+	// conflict, while transactions reading the record skip it as they would any other
+	// transaction's pending version.
+	marker := new(recordVersion)
+	marker.next.Store(r)
+	if !record.newest.CompareAndSwap(r, marker) {
+		return true
+	}
+	delete(rm.recordsByKey, string(k))
+	if next != nil {
+		delete(next.recordsByKey, string(k))
+	}
+	s.eviction.evicted.Add(1)
+	return true
+}
+
+// evictedRecords returns the number of records the store has evicted.
+func (s *ShardedStore) evictedRecords() uint64 {
+	if s.eviction == nil {
+		return 0
+	}
+	return s.eviction.evicted.Load()
+}
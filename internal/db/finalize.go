@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// WithAsynchronousFinalization directs the store to conclude committing each transaction in the
+// background once the transaction's changes are visible to later transactions, so that
+// WithinTransaction returns sooner, especially for transactions that write many records. The
+// background work includes collapsing the tombstones that deletions leave behind, moving deleted
+// records into the trash (see WithTrashRetention), discarding superseded versions (see
+// WithMaxVersionsPerRecord), notifying observers of committed transactions (see
+// ShardedStore.CommittedTransactions), and evicting records (see WithEviction). Callers that need
+// that work to be done before they proceed may call ShardedStore.WaitForFinalize.
+func WithAsynchronousFinalization() ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		o.asynchronousFinalization = true
+		return nil
+	}
+}
+
+// backgroundFinalizer concludes committing transactions in the order in which they committed,
+// running a goroutine only while it has work queued.
+type backgroundFinalizer struct {
+	mu       sync.Mutex
+	queue    []func()
+	running  bool
+	queued   uint64
+	finished uint64
+	// progressed is closed upon finishing the next queued job, if any callers are waiting for
+	// that.
+	progressed chan struct{}
+}
+
+// enqueue arranges to call the given function after all those queued before it.
+func (f *backgroundFinalizer) enqueue(job func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, job)
+	f.queued++
+	if !f.running {
+		f.running = true
+		go f.run()
+	}
+}
+
+func (f *backgroundFinalizer) run() {
+	f.mu.Lock()
+	for len(f.queue) > 0 {
+		job := f.queue[0]
+		f.queue[0] = nil
+		f.queue = f.queue[1:]
+		f.mu.Unlock()
+		job()
+		f.mu.Lock()
+		f.finished++
+		if f.progressed != nil {
+			close(f.progressed)
+			f.progressed = nil
+		}
+	}
+	f.queue = nil
+	f.running = false
+	f.mu.Unlock()
+}
+
+// await blocks until the finalizer has finished all the jobs queued before now, or the given
+// Context is done.
+func (f *backgroundFinalizer) await(ctx context.Context) error {
+	f.mu.Lock()
+	target := f.queued
+	for f.finished < target {
+		if f.progressed == nil {
+			f.progressed = make(chan struct{})
+		}
+		progressed := f.progressed
+		f.mu.Unlock()
+		select {
+		case <-progressed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// WaitForFinalize blocks until the store has concluded committing every transaction that
+// committed changes before now, or the given Context is done, in which case it returns the
+// Context's error. Unless the store finalizes transactions asynchronously (see
+// WithAsynchronousFinalization), it returns immediately.
+func (s *ShardedStore) WaitForFinalize(ctx context.Context) error {
+	if s.finalizer == nil {
+		return nil
+	}
+	return s.finalizer.await(ctx)
+}
+
+// concludeCommit performs the bookkeeping that follows this transaction committing its changes,
+// collapsing the given tombstones that it left at the head of their records' histories and
+// consolidating the histories of the given records that it wrote.
+func (t *shardedStoreTransaction) concludeCommit(tombstones map[*versionedRecord]*recordVersion, written []*versionedRecord) {
+	s := t.store
+	for record, tombstone := range tombstones {
+		// If another transaction has since proposed a version atop the tombstone, leave it in place,
+		// as it's harmless.
+		if record.newest.CompareAndSwap(tombstone, tombstone.next.Load()) {
+			s.discardValue(&tombstone.value)
+		}
+	}
+	if s.trashRetention > 0 {
+		t.noteTrashedRecords()
+	}
+	s.consolidateWrittenVersions(written)
+	s.commitFeed.publish(t.id, t.committedKeys)
+	t.noteCommittedUses()
+	s.evictExcessRecords()
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+)
+
+// DefaultKeySeparator is the separator between segments of hierarchical keys used unless
+// overridden via the WithKeySeparator option.
+const DefaultKeySeparator = "/"
+
+// WithKeySeparator establishes the nonempty separator between segments of hierarchical keys,
+// governing how Transaction.ListChildren interprets key paths.
+func WithKeySeparator(sep string) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if len(sep) == 0 {
+			return errors.New("key separator must be nonempty")
+		}
+		o.keySeparator = sep
+		return nil
+	}
+}
+
+// KeyPathEntry describes an immediate child of a path within the key hierarchy.
+type KeyPathEntry struct {
+	// Key is the full path of the child.
+	Key Key
+	// IsRecord indicates whether a record exists with exactly this key.
+	IsRecord bool
+	// HasChildren indicates whether any records exist with keys beneath this path.
+	HasChildren bool
+}
+
+func (t *shardedStoreTransaction) ListChildren(ctx context.Context, path Key) ([]KeyPathEntry, error) {
+	return t.ListChildrenAfter(ctx, path, nil, 0)
+}
+
+func (t *shardedStoreTransaction) ListChildrenAfter(ctx context.Context, path, after Key, limit int) ([]KeyPathEntry, error) {
+	if limit < 0 {
+		return nil, errors.New("child listing limit must be nonnegative")
+	}
+	sep := []byte(t.store.keySeparator)
+	prefix := path
+	if len(path) > 0 {
+		prefix = make(Key, 0, len(path)+len(sep))
+		prefix = append(prefix, bytes.TrimSuffix(path, sep)...)
+		prefix = append(prefix, sep...)
+	}
+	// Retain only the children that could belong in the listing, sorted by key, so that a limited
+	// listing needn't collect and sort every child.
+	var entries []KeyPathEntry
+	if err := t.forEachVisibleRecord(ctx, prefix, func(k Key, _ *recordVersion) error {
+		remainder := k[len(prefix):]
+		if len(remainder) == 0 {
+			// This record's key is the path itself with a trailing separator.
+			return nil
+		}
+		child, _, hasChildren := bytes.Cut(remainder, sep)
+		childKey := k[:len(prefix)+len(child)]
+		if after != nil && bytes.Compare(childKey, after) <= 0 {
+			return nil
+		}
+		i, found := slices.BinarySearchFunc(entries, childKey, func(e KeyPathEntry, k Key) int {
+			return bytes.Compare(e.Key, k)
+		})
+		if !found {
+			if limit > 0 && i == limit {
+				// This child sorts after all those that fill the listing already.
+				return nil
+			}
+			entries = slices.Insert(entries, i, KeyPathEntry{Key: bytes.Clone(childKey)})
+			if limit > 0 && len(entries) > limit {
+				entries = entries[:limit]
+			}
+		}
+		if hasChildren {
+			entries[i].HasChildren = true
+		} else {
+			entries[i].IsRecord = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []KeyPathEntry{}
+	}
+	return entries, nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// conflictTrackerCapacity is the number of distinct keys for which a conflictTracker maintains
+// counts at any time.
+const conflictTrackerCapacity = 128
+
+// WithConflictTracking directs the store to track which record keys most frequently cause
+// transactions to fail with ErrTransactionInConflict, sampling one of every given positive number
+// of such conflicts, for reporting via HotConflictKeys. A sampling rate of 1 records every
+// conflict; larger rates reduce the cost of tracking under heavy contention at the expense of
+// precision.
+func WithConflictTracking(sampleRate int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if sampleRate < 1 {
+			return errors.New("conflict sampling rate must be positive")
+		}
+		o.conflictSampleRate = sampleRate
+		return nil
+	}
+}
+
+// KeyConflicts estimates how many times transactions conflicted over the record with a given key.
+type KeyConflicts struct {
+	// Key is the record key over which transactions conflicted.
+	Key Key
+	// Conflicts estimates the number of conflicts, extrapolated from those sampled.
+	Conflicts uint64
+}
+
+// conflictTracker counts the sampled conflicts per key using the "Space-Saving" algorithm, which
+// retains the most frequent keys within a fixed number of counters, overestimating the count for
+// keys that displace others.
+type conflictTracker struct {
+	sampleRate  uint64
+	observed    atomic.Uint64
+	mu          sync.Mutex
+	countsByKey map[string]uint64
+}
+
+func newConflictTracker(sampleRate int) *conflictTracker {
+	return &conflictTracker{
+		sampleRate:  uint64(sampleRate),
+		countsByKey: make(map[string]uint64, conflictTrackerCapacity),
+	}
+}
+
+func (c *conflictTracker) observe(k string) {
+	if c.observed.Add(1)%c.sampleRate != 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.countsByKey[k]; ok || len(c.countsByKey) < conflictTrackerCapacity {
+		c.countsByKey[k] = n + 1
+		return
+	}
+	var minKey string
+	var minCount uint64
+	for key, n := range c.countsByKey {
+		if len(minKey) == 0 || n < minCount {
+			minKey, minCount = key, n
+		}
+	}
+	delete(c.countsByKey, minKey)
+	c.countsByKey[k] = minCount + 1
+}
+
+func (c *conflictTracker) top(n int) []KeyConflicts {
+	c.mu.Lock()
+	hot := make([]KeyConflicts, 0, len(c.countsByKey))
+	for k, count := range c.countsByKey {
+		hot = append(hot, KeyConflicts{Key: Key(k), Conflicts: count * c.sampleRate})
+	}
+	c.mu.Unlock()
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Conflicts != hot[j].Conflicts {
+			return hot[i].Conflicts > hot[j].Conflicts
+		}
+		return string(hot[i].Key) < string(hot[j].Key)
+	})
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+// noteConflict records the key over which the given error indicates a transaction conflicted, if
+// any.
+func (s *ShardedStore) noteConflict(err error) {
+	if s.conflicts == nil || err == nil {
+		return
+	}
+	var conflictErr transactionInConflictError
+	if errors.As(err, &conflictErr) {
+		s.conflicts.observe(string(conflictErr))
+	}
+}
+
+// HotConflictKeys returns up to the given number of record keys over which transactions have most
+// frequently conflicted, in descending order of their estimated conflict counts. It returns
+// nothing unless the store tracks conflicts (see WithConflictTracking).
+func (s *ShardedStore) HotConflictKeys(n int) []KeyConflicts {
+	if s.conflicts == nil || n < 1 {
+		return nil
+	}
+	return s.conflicts.top(n)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"errors"
+	"sync"
+)
+
+// WithValueInterning directs the store to share one backing buffer among all the record versions
+// holding identical values, reducing memory consumption for workloads that store the same values
+// under many keys, such as feature flags replicated across thousands of keys. Interning costs a
+// lookup in a store-wide table for each value proposed.
+//
+// Value interning is incompatible with value sealing (see WithValueSealing), since sealing yields
+// a distinct stored value even for identical proposed values.
+func WithValueInterning() ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		o.internValues = true
+		return nil
+	}
+}
+
+type internedValue struct {
+	value Value
+	// refs is the number of record versions sharing this value.
+	refs int
+}
+
+// valueInterner tracks the values shared among record versions, retaining each value for as long
+// as any record version refers to it.
+//
+// TODO(seh): Since we don't yet "vacuum" superseded record versions, values only ever become
+// unreferenced when their versions are discarded before being committed.
+type valueInterner struct {
+	mu      sync.Mutex
+	byValue map[string]*internedValue
+}
+
+func newValueInterner() *valueInterner {
+	return &valueInterner{byValue: make(map[string]*internedValue)}
+}
+
+// intern returns a value equal to the given one, backed by a buffer shared with every other
+// record version holding the same value. Callers must not modify the returned value, and must
+// call release once they no longer refer to it.
+func (i *valueInterner) intern(v Value) Value {
+	if len(v) == 0 {
+		return Value{}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if iv, ok := i.byValue[string(v)]; ok {
+		iv.refs++
+		return iv.value
+	}
+	var owned Value
+	owned.CopyFrom(v)
+	i.byValue[string(owned)] = &internedValue{value: owned, refs: 1}
+	return owned
+}
+
+// release drops one reference to the given value obtained from intern, forgetting the value once
+// no record versions refer to it.
+func (i *valueInterner) release(v Value) {
+	if len(v) == 0 {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	iv, ok := i.byValue[string(v)]
+	if !ok {
+		return
+	}
+	if iv.refs--; iv.refs == 0 {
+		delete(i.byValue, string(v))
+	}
+}
+
+// discardValue relinquishes the value held by a record version that the store is discarding.
+func (s *ShardedStore) discardValue(v *Value) {
+	if s.valueInterner == nil {
+		return
+	}
+	s.valueInterner.release(*v)
+	*v = nil
+}
+
+var errInterningSealedValues = errors.New("value interning is incompatible with value sealing")
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// JournalEvent identifies the kind of event described by a JournalEntry.
+type JournalEvent uint8
+
+const (
+	// JournalAttemptBegan describes the start of an attempt to complete a transaction.
+	JournalAttemptBegan JournalEvent = iota + 1
+	// JournalRead describes retrieving a record.
+	JournalRead
+	// JournalVersionVisited describes inspecting a version of a record while looking for the one
+	// visible within the transaction.
+	JournalVersionVisited
+	// JournalWrite describes an attempt to mutate a record, as would an AuditEntry.
+	JournalWrite
+	// JournalConflict describes detecting or resolving a conflict with another transaction.
+	JournalConflict
+	// JournalAttemptConcluded describes committing or rolling back an attempt's changes.
+	JournalAttemptConcluded
+)
+
+func (e JournalEvent) String() string {
+	switch e {
+	case JournalAttemptBegan:
+		return "attempt-began"
+	case JournalRead:
+		return "read"
+	case JournalVersionVisited:
+		return "version-visited"
+	case JournalWrite:
+		return "write"
+	case JournalConflict:
+		return "conflict"
+	case JournalAttemptConcluded:
+		return "attempt-concluded"
+	default:
+		return "unknown"
+	}
+}
+
+// JournalEntry describes an event within an attempt to complete a transaction.
+type JournalEntry struct {
+	// Time is when the event occurred.
+	Time time.Time
+	// TransactionID identifies the attempt within which the event occurred.
+	TransactionID uint64
+	// Event is the kind of event.
+	Event JournalEvent
+	// Key is the key of the record involved, or nil if none was.
+	Key Key
+	// Version is the ID of the transaction that committed or proposed the record version involved,
+	// or zero if none was.
+	Version uint64
+	// Detail explains the event.
+	Detail string
+}
+
+func (e JournalEntry) String() string {
+	s := fmt.Sprintf("%s tx=%d %s", e.Time.Format(time.RFC3339Nano), e.TransactionID, e.Event)
+	if e.Key != nil {
+		s += fmt.Sprintf(" key=%q", e.Key)
+	}
+	if e.Version != 0 {
+		s += fmt.Sprintf(" version=%d", e.Version)
+	}
+	if len(e.Detail) > 0 {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
+// TransactionJournal records the events within every attempt to complete a transaction: the
+// operations it performed, the record versions it inspected, and how it detected and resolved
+// conflicts with other transactions. Consulting it after a transaction fails, such as with
+// ErrTransactionInConflict, explains why. Journaling slows transactions, so callers should
+// request it only while debugging.
+type TransactionJournal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+}
+
+// Entries returns the events recorded so far, in the order that they occurred.
+func (j *TransactionJournal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+func (j *TransactionJournal) add(e JournalEntry) {
+	j.mu.Lock()
+	j.entries = append(j.entries, e)
+	j.mu.Unlock()
+}
+
+type transactionJournalContextKey struct{}
+
+// ContextWithTransactionJournal returns a Context requesting that transactions begun via
+// WithinTransaction with that Context record their events in the returned TransactionJournal.
+func ContextWithTransactionJournal(ctx context.Context) (context.Context, *TransactionJournal) {
+	j := new(TransactionJournal)
+	return context.WithValue(ctx, transactionJournalContextKey{}, j), j
+}
+
+// TransactionJournalFromContext returns the TransactionJournal supplied via
+// ContextWithTransactionJournal, if any.
+func TransactionJournalFromContext(ctx context.Context) (*TransactionJournal, bool) {
+	j, ok := ctx.Value(transactionJournalContextKey{}).(*TransactionJournal)
+	return j, ok
+}
+
+// journalf records an event within this transaction, if its caller requested a journal.
+func (t *shardedStoreTransaction) journalf(event JournalEvent, k Key, version transactionID, format string, args ...any) {
+	if t.journal == nil {
+		return
+	}
+	t.journal.add(JournalEntry{
+		Time:          t.store.clock.Now(),
+		TransactionID: uint64(t.id),
+		Event:         event,
+		Key:           append(Key(nil), k...),
+		Version:       uint64(version),
+		Detail:        fmt.Sprintf(format, args...),
+	})
+}
+
+// journalVersionVisited records that this transaction inspected the given version of the record
+// with the given key.
+func (t *shardedStoreTransaction) journalVersionVisited(k Key, r *recordVersion) {
+	validAsOf := r.validAsOfTransactionID()
+	if validAsOf == noSuchTransaction {
+		t.journalf(JournalVersionVisited, k, r.proposedBy, "pending, proposed by transaction %d", r.proposedBy)
+		return
+	}
+	if validBefore := r.validBeforeTransactionID(); validBefore != noSuchTransaction {
+		t.journalf(JournalVersionVisited, k, validAsOf, "valid before transaction %d", validBefore)
+		return
+	}
+	t.journalf(JournalVersionVisited, k, validAsOf, "current")
+}
+
+// conflict returns the error with which to fail an attempt to write the record with the given key
+// that conflicts with the record version that the transaction with the given ID committed,
+// journaling the given reason for the conflict. Later attempts of the transaction claim IDs
+// greater than the given one, so as to observe that version.
+func (t *shardedStoreTransaction) conflict(k Key, version transactionID, reason string) error {
+	t.journalf(JournalConflict, k, version, "%s", reason)
+	if t.lineage != nil {
+		t.lineage.conflictedWith = max(t.lineage.conflictedWith, version)
+	}
+	return transactionInConflictError(k)
+}
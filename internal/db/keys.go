@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// A KeyValidator inspects a key proposed for a record to be written to the database, returning a
+// non-nil error if the key is not acceptable.
+type KeyValidator func(Key) error
+
+// WithKeyValidator establishes a function with which to validate the key for each record to be
+// inserted, updated, or upserted, so that deployments can enforce their own naming rules. Supplying
+// this option more than once requires that keys satisfy all the given validators, consulted in
+// the order supplied.
+//
+// Attempts to write records with keys that fail validation fail with ErrInvalidKey.
+func WithKeyValidator(v KeyValidator) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if v == nil {
+			return errors.New("key validator must be non-nil")
+		}
+		o.keyValidators = append(o.keyValidators, v)
+		return nil
+	}
+}
+
+// KeyMustBeUTF8 is a KeyValidator that rejects keys that are not valid UTF-8-encoded text.
+func KeyMustBeUTF8(k Key) error {
+	if !utf8.Valid(k) {
+		return errors.New("key must be valid UTF-8")
+	}
+	return nil
+}
+
+// KeyMustNotContain returns a KeyValidator that rejects keys containing any of the given
+// characters.
+func KeyMustNotContain(chars string) KeyValidator {
+	return func(k Key) error {
+		if i := bytes.IndexAny(k, chars); i >= 0 {
+			r, _ := utf8.DecodeRune(k[i:])
+			return fmt.Errorf("key must not contain character %q", r)
+		}
+		return nil
+	}
+}
+
+// KeyMaxDepth returns a KeyValidator that rejects keys with more than the given positive number
+// of segments delimited by the given separator.
+func KeyMaxDepth(separator string, n int) KeyValidator {
+	sep := []byte(separator)
+	return func(k Key) error {
+		if depth := bytes.Count(k, sep) + 1; depth > n {
+			return fmt.Errorf("key has depth %d, exceeding maximum of %d", depth, n)
+		}
+		return nil
+	}
+}
+
+// reservedKeyPrefix starts the keys of the records with which the store represents structured
+// records, such as the members of sets, keeping them apart from the keys that callers choose.
+const reservedKeyPrefix = 0
+
+// reservedKeyKind distinguishes the kinds of records stored under reserved keys.
+type reservedKeyKind byte
+
+const (
+	setMemberKeyKind        reservedKeyKind = 's'
+	listKeyKind             reservedKeyKind = 'l'
+	namedLockKeyKind        reservedKeyKind = 'k'
+	sequenceKeyKind         reservedKeyKind = 'q'
+	namespaceKeyKind        reservedKeyKind = 'n'
+	namespacedRecordKeyKind reservedKeyKind = 'r'
+	outboxKeyKind           reservedKeyKind = 'o'
+	queueKeyKind            reservedKeyKind = 'm'
+	topicKeyKind            reservedKeyKind = 'p'
+)
+
+// errReservedKey indicates that a caller attempted to write a record with a reserved key.
+var errReservedKey = errors.New("keys starting with a NUL byte are reserved")
+
+func isReservedKey(k Key) bool {
+	return len(k) > 0 && k[0] == reservedKeyPrefix
+}
+
+// reservedKeyFor returns a reserved key of the given kind pertaining to the record with the given
+// key, followed by the given suffix. All the reserved keys of a given kind for a given record share
+// a prefix: the key returned for an empty suffix.
+func reservedKeyFor(kind reservedKeyKind, k Key, suffix []byte) Key {
+	rk := make(Key, 0, 2+binary.MaxVarintLen64+len(k)+len(suffix))
+	rk = append(rk, reservedKeyPrefix, byte(kind))
+	// Encode the key's length so that no key's reserved keys are a prefix of another's.
+	rk = binary.AppendUvarint(rk, uint64(len(k)))
+	rk = append(rk, k...)
+	return append(rk, suffix...)
+}
+
+func (s *ShardedStore) validateKey(k Key) error {
+	if isReservedKey(k) {
+		return &invalidKeyError{key: string(k), err: errReservedKey}
+	}
+	for _, v := range s.keyValidators {
+		if err := v(k); err != nil {
+			return &invalidKeyError{key: string(k), err: err}
+		}
+	}
+	return nil
+}
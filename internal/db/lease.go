@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// leaseExpiryAttempts is the number of times to attempt deleting the records attached to an
+// expired lease when the deletion conflicts with other transactions.
+const leaseExpiryAttempts = 10
+
+type lease struct {
+	ttl   time.Duration
+	timer Timer
+	keys  map[string]struct{}
+}
+
+// leaseTable tracks the store's leases and the records attached to them.
+type leaseTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	byID   map[uint64]*lease
+	byKey  map[string]uint64
+}
+
+// remove forgets the lease with the given ID, returning the keys of the records attached to it,
+// or false if no such lease exists. The caller must hold the lock.
+func (lt *leaseTable) remove(id uint64) ([]Key, bool) {
+	l, ok := lt.byID[id]
+	if !ok {
+		return nil, false
+	}
+	l.timer.Stop()
+	delete(lt.byID, id)
+	keys := make([]Key, 0, len(l.keys))
+	for k := range l.keys {
+		delete(lt.byKey, k)
+		keys = append(keys, Key(k))
+	}
+	return keys, true
+}
+
+// GrantLease creates a lease that expires after the given positive duration unless kept alive
+// (see KeepLeaseAlive), returning the lease's ID. When a lease expires or is revoked, the store
+// deletes the records attached to it (see Transaction.AttachToLease) within a single transaction,
+// which suits registering ephemeral records such as those for service discovery or distributed
+// locks.
+func (s *ShardedStore) GrantLease(ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, errors.New("lease duration must be positive")
+	}
+	lt := &s.leases
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if lt.byID == nil {
+		lt.byID = make(map[uint64]*lease)
+		lt.byKey = make(map[string]uint64)
+	}
+	lt.nextID++
+	id := lt.nextID
+	lt.byID[id] = &lease{
+		ttl:   ttl,
+		timer: s.clock.AfterFunc(ttl, func() { s.expireLease(id) }),
+		keys:  make(map[string]struct{}),
+	}
+	return id, nil
+}
+
+// KeepLeaseAlive postpones the expiry of the lease with the given ID until its full duration
+// elapses again.
+//
+// If no such lease exists, KeepLeaseAlive returns ErrLeaseNotFound.
+func (s *ShardedStore) KeepLeaseAlive(id uint64) error {
+	lt := &s.leases
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l, ok := lt.byID[id]
+	if !ok || !l.timer.Stop() {
+		// If stopping the timer fails, the lease is already expiring.
+		return leaseNotFoundError(id)
+	}
+	l.timer.Reset(l.ttl)
+	return nil
+}
+
+// RevokeLease ends the lease with the given ID immediately, deleting the records attached to it.
+//
+// If no such lease exists, RevokeLease returns ErrLeaseNotFound.
+func (s *ShardedStore) RevokeLease(ctx context.Context, id uint64) error {
+	lt := &s.leases
+	lt.mu.Lock()
+	keys, ok := lt.remove(id)
+	lt.mu.Unlock()
+	if !ok {
+		return leaseNotFoundError(id)
+	}
+	return s.deleteLeasedRecords(ctx, keys)
+}
+
+func (s *ShardedStore) expireLease(id uint64) {
+	lt := &s.leases
+	lt.mu.Lock()
+	keys, ok := lt.remove(id)
+	lt.mu.Unlock()
+	if ok {
+		// TODO(seh): Report failure to delete the records, such as via a callback supplied as a
+		// store option.
+		s.deleteLeasedRecords(context.Background(), keys)
+	}
+}
+
+func (s *ShardedStore) deleteLeasedRecords(ctx context.Context, keys []Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			for _, k := range keys {
+				if _, err := tx.Delete(ctx, k); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		})
+		if attempt >= leaseExpiryAttempts || !errors.Is(err, ErrTransactionInConflict) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (t *shardedStoreTransaction) AttachToLease(ctx context.Context, k Key, leaseID uint64) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	if t.readOnly {
+		return readOnlyTransactionError(k)
+	}
+	lt := &t.store.leases
+	lt.mu.Lock()
+	_, ok := lt.byID[leaseID]
+	lt.mu.Unlock()
+	if !ok {
+		return leaseNotFoundError(leaseID)
+	}
+	if t.leaseAttachments == nil {
+		t.leaseAttachments = make(map[string]uint64, 1)
+	}
+	t.leaseAttachments[string(k)] = leaseID
+	return nil
+}
+
+// attachLeases attaches records to the leases requested within this transaction, as it's about to
+// commit. If any of the leases no longer exists, it attaches none of the records.
+func (t *shardedStoreTransaction) attachLeases() error {
+	if len(t.leaseAttachments) == 0 {
+		return nil
+	}
+	lt := &t.store.leases
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for _, id := range t.leaseAttachments {
+		if _, ok := lt.byID[id]; !ok {
+			return leaseNotFoundError(id)
+		}
+	}
+	for k, id := range t.leaseAttachments {
+		if previous, ok := lt.byKey[k]; ok {
+			delete(lt.byID[previous].keys, k)
+		}
+		lt.byID[id].keys[k] = struct{}{}
+		lt.byKey[k] = id
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// listChunkCapacity is the greatest number of elements stored together in each of a list's
+// chunks. Pushing or popping an element rewrites only the chunk at that end of the list, along
+// with the list's bounds.
+const listChunkCapacity = 64
+
+// listBounds locates a list's elements, which occupy the positions from first up to but not
+// including end. Pushing elements on the left decreases first, possibly below zero.
+type listBounds struct {
+	first, end int64
+}
+
+func (b listBounds) isEmpty() bool {
+	return b.first == b.end
+}
+
+// listBoundsKey returns the reserved key of the record storing the bounds of the list stored under
+// the given key.
+func listBoundsKey(k Key) Key {
+	return reservedKeyFor(listKeyKind, k, nil)
+}
+
+// listChunkKey returns the reserved key of the record storing the given chunk of the list stored
+// under the given key.
+func listChunkKey(k Key, chunk int64) Key {
+	var suffix [8]byte
+	// Flip the sign bit so that the chunks' keys sort in the same order as their indices.
+	binary.BigEndian.PutUint64(suffix[:], uint64(chunk)^1<<63)
+	return reservedKeyFor(listKeyKind, k, suffix[:])
+}
+
+// listChunkFor returns the index of the chunk holding the element at the given position.
+func listChunkFor(position int64) int64 {
+	chunk := position / listChunkCapacity
+	if position%listChunkCapacity < 0 {
+		chunk--
+	}
+	return chunk
+}
+
+// readReserved retrieves the value of the record with the given reserved key that is visible
+// within this transaction, reporting whether such a record exists.
+func (t *shardedStoreTransaction) readReserved(ctx context.Context, k Key) (Value, bool, error) {
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return nil, false, ctx.Err()
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	r := t.visibleVersionOf(k, record)
+	if r == nil {
+		return nil, false, nil
+	}
+	v, err := t.store.openValue(k, r.value)
+	return v, err == nil, err
+}
+
+// writeReserved stores the given value in the record with the given reserved key, or deletes the
+// record if the value is nil.
+func (t *shardedStoreTransaction) writeReserved(ctx context.Context, k Key, v Value) error {
+	if t.readOnly {
+		return readOnlyTransactionError(k)
+	}
+	if err := t.checkPendingWriteLimit(k); err != nil {
+		return err
+	}
+	if v == nil {
+		_, err := t.delete(ctx, k)
+		return err
+	}
+	return t.upsert(ctx, k, borrowValueRef(v), nil)
+}
+
+func (t *shardedStoreTransaction) readListBounds(ctx context.Context, k Key) (listBounds, error) {
+	v, ok, err := t.readReserved(ctx, listBoundsKey(k))
+	if err != nil || !ok {
+		return listBounds{}, err
+	}
+	first, n := binary.Varint(v)
+	end, m := binary.Varint(v[max(n, 0):])
+	if n <= 0 || m <= 0 {
+		return listBounds{}, errors.New("list bounds are malformed")
+	}
+	return listBounds{first, end}, nil
+}
+
+func (t *shardedStoreTransaction) writeListBounds(ctx context.Context, k Key, b listBounds) error {
+	if b.isEmpty() {
+		return t.writeReserved(ctx, listBoundsKey(k), nil)
+	}
+	v := make(Value, 0, 2*binary.MaxVarintLen64)
+	v = binary.AppendVarint(v, b.first)
+	v = binary.AppendVarint(v, b.end)
+	return t.writeReserved(ctx, listBoundsKey(k), v)
+}
+
+// readListChunk retrieves the elements stored in the given chunk of the list stored under the
+// given key, in order. The elements alias the stored value, so callers must not retain them.
+func (t *shardedStoreTransaction) readListChunk(ctx context.Context, k Key, chunk int64) ([]Value, error) {
+	v, ok, err := t.readReserved(ctx, listChunkKey(k, chunk))
+	if err != nil || !ok {
+		return nil, err
+	}
+	var elements []Value
+	for len(v) > 0 {
+		n, size := binary.Uvarint(v)
+		if size <= 0 || uint64(len(v)-size) < n {
+			return nil, errors.New("list chunk is malformed")
+		}
+		elements = append(elements, v[size:size+int(n)])
+		v = v[size+int(n):]
+	}
+	return elements, nil
+}
+
+func (t *shardedStoreTransaction) writeListChunk(ctx context.Context, k Key, chunk int64, elements []Value) error {
+	if len(elements) == 0 {
+		return t.writeReserved(ctx, listChunkKey(k, chunk), nil)
+	}
+	var v Value
+	for _, e := range elements {
+		v = binary.AppendUvarint(v, uint64(len(e)))
+		v = append(v, e...)
+	}
+	return t.writeReserved(ctx, listChunkKey(k, chunk), v)
+}
+
+// checkListWrite returns an error if this transaction may not change the list with the given key.
+func (t *shardedStoreTransaction) checkListWrite(k Key) error {
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		err = t.checkRecordLock(k)
+	}
+	return err
+}
+
+func (t *shardedStoreTransaction) push(ctx context.Context, k Key, v Value, left bool) error {
+	b, err := t.readListBounds(ctx, k)
+	if err != nil {
+		return err
+	}
+	var position int64
+	if left {
+		b.first--
+		position = b.first
+	} else {
+		position = b.end
+		b.end++
+	}
+	chunk := listChunkFor(position)
+	elements, err := t.readListChunk(ctx, k, chunk)
+	if err != nil {
+		return err
+	}
+	if left {
+		elements = append([]Value{v}, elements...)
+	} else {
+		elements = append(elements, v)
+	}
+	if err := t.writeListChunk(ctx, k, chunk, elements); err != nil {
+		return err
+	}
+	return t.writeListBounds(ctx, k, b)
+}
+
+func (t *shardedStoreTransaction) pop(ctx context.Context, k Key, left bool) (Value, error) {
+	b, err := t.readListBounds(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if b.isEmpty() {
+		return nil, recordDoesNotExistError(k)
+	}
+	var position int64
+	if left {
+		position = b.first
+		b.first++
+	} else {
+		b.end--
+		position = b.end
+	}
+	chunk := listChunkFor(position)
+	elements, err := t.readListChunk(ctx, k, chunk)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, errors.New("list chunk is missing")
+	}
+	var popped Value
+	if left {
+		popped.CopyFrom(elements[0])
+		elements = elements[1:]
+	} else {
+		popped.CopyFrom(elements[len(elements)-1])
+		elements = elements[:len(elements)-1]
+	}
+	if err := t.writeListChunk(ctx, k, chunk, elements); err != nil {
+		return nil, err
+	}
+	if err := t.writeListBounds(ctx, k, b); err != nil {
+		return nil, err
+	}
+	return popped, nil
+}
+
+func (t *shardedStoreTransaction) PushLeft(ctx context.Context, k Key, v Value) error {
+	err := t.checkListWrite(k)
+	if err == nil {
+		err = t.push(ctx, k, v, true)
+	}
+	t.audit(ctx, AuditPushLeft, k, v, err)
+	return err
+}
+
+func (t *shardedStoreTransaction) PushRight(ctx context.Context, k Key, v Value) error {
+	err := t.checkListWrite(k)
+	if err == nil {
+		err = t.push(ctx, k, v, false)
+	}
+	t.audit(ctx, AuditPushRight, k, v, err)
+	return err
+}
+
+func (t *shardedStoreTransaction) PopLeft(ctx context.Context, k Key) (Value, error) {
+	err := t.checkListWrite(k)
+	var v Value
+	if err == nil {
+		v, err = t.pop(ctx, k, true)
+	}
+	t.audit(ctx, AuditPopLeft, k, nil, err)
+	return v, err
+}
+
+func (t *shardedStoreTransaction) PopRight(ctx context.Context, k Key) (Value, error) {
+	err := t.checkListWrite(k)
+	var v Value
+	if err == nil {
+		v, err = t.pop(ctx, k, false)
+	}
+	t.audit(ctx, AuditPopRight, k, nil, err)
+	return v, err
+}
+
+func (t *shardedStoreTransaction) ListLength(ctx context.Context, k Key) (int, error) {
+	if err := t.aborted(); err != nil {
+		return 0, err
+	}
+	t.reads++
+	b, err := t.readListBounds(ctx, k)
+	return int(b.end - b.first), err
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"maps"
+)
+
+// Metadata describes a record's value, such as how to interpret it. Each version of a record
+// carries its own metadata, written along with its value.
+//
+// The store does not seal metadata, even when it seals values (see WithValueSealing).
+type Metadata struct {
+	// ContentType is the media type of the record's value, if known.
+	ContentType string
+	// Tags are arbitrary name-value pairs that the record's writer chose to associate with the
+	// value.
+	Tags map[string]string
+}
+
+func (m Metadata) isZero() bool {
+	return len(m.ContentType) == 0 && len(m.Tags) == 0
+}
+
+// stored returns the representation of this metadata to store in a record version, isolated
+// from the caller's subsequent changes, or nil if there is no metadata to store.
+func (m Metadata) stored() *Metadata {
+	if m.isZero() {
+		return nil
+	}
+	return &Metadata{
+		ContentType: m.ContentType,
+		Tags:        maps.Clone(m.Tags),
+	}
+}
+
+// metadataAreEqual reports whether the two metadata stored in record versions are equal.
+func metadataAreEqual(a, b *Metadata) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ContentType == b.ContentType && maps.Equal(a.Tags, b.Tags)
+}
+
+// Record is a version of a record as observed by a transaction.
+type Record struct {
+	// Value is the record's value.
+	Value Value
+	// Metadata describes the record's value.
+	Metadata Metadata
+	// Version is the ID of the transaction that committed this version of the record, or zero if
+	// the observing transaction proposed it (see Transaction.GetVersioned).
+	Version uint64
+	// Access describes how transactions have used the record, if the store tracks that (see
+	// WithRecordAccessStats).
+	Access RecordAccessStats
+}
+
+func (t *shardedStoreTransaction) GetRecord(ctx context.Context, k Key) (Record, error) {
+	if err := t.aborted(); err != nil {
+		return Record{}, err
+	}
+	t.reads++
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return Record{}, interruptedError(ctx, k)
+	}
+	if !ok {
+		v, err := t.loadOnMiss(ctx, k)
+		if err != nil {
+			return Record{}, err
+		}
+		return Record{Value: v, Version: uint64(t.id)}, nil
+	}
+	r := t.visibleVersionOf(k, record)
+	if r == nil {
+		return Record{}, recordDoesNotExistError(k)
+	}
+	v, err := t.store.openValue(k, r.value)
+	if err != nil {
+		return Record{}, err
+	}
+	t.store.noteRecordAccess(record, t.id, false)
+	t.store.noteRecordUse(k, r)
+	rec := Record{
+		Value:   v,
+		Version: uint64(r.validAsOfTransactionID()),
+		Access:  accessStatsOf(record),
+	}
+	if m := r.metadata; m != nil {
+		rec.Metadata = Metadata{
+			ContentType: m.ContentType,
+			Tags:        maps.Clone(m.Tags),
+		}
+	}
+	return rec, nil
+}
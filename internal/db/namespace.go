@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// namespaceKey returns the reserved key of the record marking the existence of the namespace with
+// the given name. All such keys share a prefix: the key returned for an empty name.
+func namespaceKey(name string) Key {
+	return reservedKeyFor(namespaceKeyKind, nil, []byte(name))
+}
+
+// namespacedKey returns the reserved key of the record with the given key within the namespace
+// with the given name. All the keys of a namespace's records share a prefix: the key returned for
+// an empty key.
+func namespacedKey(name string, k Key) Key {
+	return reservedKeyFor(namespacedRecordKeyKind, Key(name), k)
+}
+
+// errEmptyNamespaceName indicates that a caller attempted to create a namespace without a name.
+var errEmptyNamespaceName = errors.New("namespace name must be nonempty")
+
+// namespaceExists reports whether the namespace with the given name exists from this
+// transaction's perspective.
+func (t *shardedStoreTransaction) namespaceExists(ctx context.Context, name string) (bool, error) {
+	k := namespaceKey(name)
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return false, ctx.Err()
+	}
+	return ok && t.visibleVersionOf(k, record) != nil, nil
+}
+
+func (t *shardedStoreTransaction) CreateNamespace(ctx context.Context, name string) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		return errEmptyNamespaceName
+	}
+	k := namespaceKey(name)
+	err := t.guardedWrite(ctx, k, func() error {
+		return t.insert(ctx, k, ValueRef{}, nil)
+	})
+	if errors.Is(err, ErrRecordExists) {
+		return namespaceExistsError(name)
+	}
+	return err
+}
+
+func (t *shardedStoreTransaction) DeleteNamespace(ctx context.Context, name string) (int, error) {
+	if err := t.aborted(); err != nil {
+		return 0, err
+	}
+	exists, err := t.namespaceExists(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, namespaceNotFoundError(name)
+	}
+	deleted, err := t.DeleteWhere(ctx, namespacedKey(name, nil), func(Key, Value) bool {
+		return true
+	})
+	if err != nil {
+		return deleted, err
+	}
+	k := namespaceKey(name)
+	return deleted, t.guardedWrite(ctx, k, func() error {
+		_, err := t.delete(ctx, k)
+		return err
+	})
+}
+
+func (t *shardedStoreTransaction) Namespaces(ctx context.Context) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		prefix := namespaceKey("")
+		err := t.forEachVisibleRecord(ctx, prefix, func(k Key, _ *recordVersion) error {
+			if !yield(string(k[len(prefix):])) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			t.deferError(err)
+		}
+	}
+}
+
+func (t *shardedStoreTransaction) Namespace(ctx context.Context, name string) (*NamespaceTransaction, error) {
+	if err := t.aborted(); err != nil {
+		return nil, err
+	}
+	exists, err := t.namespaceExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, namespaceNotFoundError(name)
+	}
+	return &NamespaceTransaction{
+		tx:     t,
+		name:   name,
+		prefix: namespacedKey(name, nil),
+		meter:  t.store.namespaceMeters.meterFor(name),
+	}, nil
+}
+
+// CloneNamespace creates a namespace with the name dst holding a copy of each record within the
+// existing namespace with the name src, along with its metadata, observing the source namespace as
+// of a single point in time, such as to duplicate a tenant for a staging environment. It returns
+// the number of records copied, failing with ErrNamespaceNotFound if the source namespace doesn't
+// exist or ErrNamespaceExists if the destination namespace does. Since it copies the records within
+// one transaction, cloning a namespace holding more records than the store permits a transaction to
+// write fails (see WithMaxPendingWritesPerTransaction).
+func (s *ShardedStore) CloneNamespace(ctx context.Context, src, dst string) (int, error) {
+	var cloned int
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		cloned = 0
+		exists, err := t.namespaceExists(ctx, src)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, namespaceNotFoundError(src)
+		}
+		if err := t.CreateNamespace(ctx, dst); err != nil {
+			return false, err
+		}
+		type clonedRecord struct {
+			k Key
+			v Value
+			m *Metadata
+		}
+		var records []clonedRecord
+		prefix := namespacedKey(src, nil)
+		if err := t.forEachVisibleRecord(ctx, prefix, func(k Key, r *recordVersion) error {
+			v, err := s.openValue(k, r.value)
+			if err != nil {
+				return err
+			}
+			records = append(records, clonedRecord{k: k[len(prefix):], v: v, m: r.metadata})
+			return nil
+		}); err != nil {
+			return false, err
+		}
+		for _, r := range records {
+			k := namespacedKey(dst, r.k)
+			err := t.guardedWrite(ctx, k, func() error {
+				return t.insert(ctx, k, borrowValueRef(r.v), r.m)
+			})
+			t.audit(ctx, AuditInsert, k, r.v, err)
+			if err != nil {
+				return false, err
+			}
+			cloned++
+		}
+		return true, nil
+	})
+	return cloned, err
+}
+
+// NamespaceTransaction allows observing and mutating the records within a namespace as part of a
+// transaction (see Transaction.Namespace). Its records occupy a key space apart from that of
+// ordinary records and of other namespaces, such that records in different namespaces may share a
+// key, so that several tenants can share a store without prefixing their keys themselves. Writes
+// within a namespace are subject to the same validation, limits, and conflicts as writes to
+// ordinary records.
+//
+// Since a transaction writing records within a namespace doesn't conflict with one deleting the
+// namespace, records written concurrently with the namespace's deletion may outlive it, and then
+// reappear within a later namespace of the same name.
+type NamespaceTransaction struct {
+	tx     *shardedStoreTransaction
+	name   string
+	prefix Key
+	meter  *namespaceMeter
+}
+
+// Name returns the name of the namespace.
+func (n *NamespaceTransaction) Name() string {
+	return n.name
+}
+
+func (n *NamespaceTransaction) key(k Key) Key {
+	nk := make(Key, 0, len(n.prefix)+len(k))
+	return append(append(nk, n.prefix...), k...)
+}
+
+// Get retrieves an existing record within the namespace, like Transaction.Get.
+func (n *NamespaceTransaction) Get(ctx context.Context, k Key) (Value, error) {
+	v, err := n.tx.Get(ctx, n.key(k))
+	if err == nil {
+		n.meter.noteRead(k, v)
+	}
+	return v, err
+}
+
+// GetRecord retrieves an existing record within the namespace along with its version and
+// metadata, like Transaction.GetRecord.
+func (n *NamespaceTransaction) GetRecord(ctx context.Context, k Key) (Record, error) {
+	r, err := n.tx.GetRecord(ctx, n.key(k))
+	if err == nil {
+		n.meter.noteRead(k, r.Value)
+	}
+	return r, err
+}
+
+// write validates the given key and value, then calls the given function to write the record with that key
+// within the namespace, auditing the attempt as the given operation.
+func (n *NamespaceTransaction) write(ctx context.Context, op AuditOperation, k Key, v Value, m Metadata, write func(context.Context, Key, ValueRef, *Metadata) error) error {
+	t := n.tx
+	nk := n.key(k)
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		err = t.store.validateValue(k, v)
+	}
+	if err == nil {
+		err = t.guardedWrite(ctx, nk, func() error {
+			return write(ctx, nk, borrowValueRef(v), m.stored())
+		})
+	}
+	t.audit(ctx, op, nk, v, err)
+	if err == nil {
+		n.meter.noteWrite(k, v)
+	}
+	return err
+}
+
+// Insert adds a new record within the namespace, like Transaction.Insert.
+func (n *NamespaceTransaction) Insert(ctx context.Context, k Key, v Value) error {
+	return n.InsertWithMetadata(ctx, k, v, Metadata{})
+}
+
+// Update modifies an existing record within the namespace, like Transaction.Update.
+func (n *NamespaceTransaction) Update(ctx context.Context, k Key, v Value) error {
+	return n.UpdateWithMetadata(ctx, k, v, Metadata{})
+}
+
+// Upsert ensures that a record exists within the namespace storing the given value, like
+// Transaction.Upsert.
+func (n *NamespaceTransaction) Upsert(ctx context.Context, k Key, v Value) error {
+	return n.UpsertWithMetadata(ctx, k, v, Metadata{})
+}
+
+// InsertWithMetadata is like Insert, but stores the given metadata along with the value.
+func (n *NamespaceTransaction) InsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return n.write(ctx, AuditInsert, k, v, m, n.tx.insert)
+}
+
+// UpdateWithMetadata is like Update, but stores the given metadata along with the value.
+func (n *NamespaceTransaction) UpdateWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return n.write(ctx, AuditUpdate, k, v, m, n.tx.update)
+}
+
+// UpsertWithMetadata is like Upsert, but stores the given metadata along with the value.
+func (n *NamespaceTransaction) UpsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return n.write(ctx, AuditUpsert, k, v, m, n.tx.upsert)
+}
+
+// Delete ensures that no record exists within the namespace for the given key, like
+// Transaction.Delete.
+func (n *NamespaceTransaction) Delete(ctx context.Context, k Key) (bool, error) {
+	deleted, err := n.tx.Delete(ctx, n.key(k))
+	if deleted {
+		n.meter.deletes.Add(1)
+	}
+	return deleted, err
+}
+
+// Scan yields each record within the namespace with a key starting with the given prefix, like
+// Transaction.Scan, supplying the records' keys without the namespace's prefix.
+func (n *NamespaceTransaction) Scan(ctx context.Context, prefix Key) iter.Seq2[Key, Value] {
+	return func(yield func(Key, Value) bool) {
+		for k, v := range n.tx.Scan(ctx, n.key(prefix)) {
+			k = k[len(n.prefix):]
+			n.meter.noteRead(k, v)
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"maps"
+)
+
+// pendingVersionState captures the state of a pending record version proposed by a transaction,
+// so that it can be restored later.
+type pendingVersionState struct {
+	version     *recordVersion
+	value       Value
+	metadata    *Metadata
+	validBefore transactionID
+}
+
+// savepoint captures the changes that a transaction had proposed at some point, so that it can
+// later discard the changes proposed since then.
+type savepoint struct {
+	pending          map[string]pendingVersionState
+	leaseAttachments map[string]uint64
+	deferredErr      error
+	assertions       int
+}
+
+func (t *shardedStoreTransaction) makeSavepoint(ctx context.Context) (*savepoint, error) {
+	sp := savepoint{
+		pending:          make(map[string]pendingVersionState, len(t.pendingWrites)),
+		leaseAttachments: maps.Clone(t.leaseAttachments),
+		deferredErr:      t.deferredErr,
+		assertions:       len(t.assertions),
+	}
+	for key := range t.pendingWrites {
+		_, record, ok := t.recordFor(ctx, Key(key))
+		if !ok {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		r := record.newest.Load()
+		if r == nil || r.validAsOfTransactionID() != noSuchTransaction {
+			continue
+		}
+		state := pendingVersionState{
+			version:     r,
+			metadata:    r.metadata,
+			validBefore: r.validBeforeTransactionID(),
+		}
+		// We may update the pending version's value in place later, so we must copy it.
+		state.value.CopyFrom(r.value)
+		sp.pending[key] = state
+	}
+	return &sp, nil
+}
+
+// rollBackTo discards the changes proposed since the given savepoint was made.
+func (t *shardedStoreTransaction) rollBackTo(sp *savepoint) {
+	for key := range t.pendingWrites {
+		// As when finalizing a transaction, we don't want to give up this effort due to the
+		// governing Context having been canceled.
+		records := t.recordsForFinalizing(shardKeys{shard: t.store.shardFor(Key(key)), keys: []Key{Key(key)}})
+		record := records[0]
+		if record == nil {
+			continue
+		}
+		if state, ok := sp.pending[key]; ok {
+			r := state.version
+			t.store.discardValue(&r.value)
+			if i := t.store.valueInterner; i != nil {
+				r.value = i.intern(state.value)
+			} else {
+				r.value = state.value
+			}
+			r.valueShared = false
+			r.metadata = state.metadata
+			r.validBeforeTransaction.Store(uint64(state.validBefore))
+			continue
+		}
+		for newest := record.newest.Load(); newest != nil && newest.validAsOfTransactionID() == noSuchTransaction; newest = record.newest.Load() {
+			if record.newest.CompareAndSwap(newest, newest.next.Load()) {
+				t.store.discardValue(&newest.value)
+				break
+			}
+		}
+		delete(t.pendingWrites, key)
+	}
+	t.pendingWriteCount.Store(int32(len(t.pendingWrites)))
+	t.leaseAttachments = sp.leaseAttachments
+	t.deferredErr = sp.deferredErr
+	t.assertions = t.assertions[:sp.assertions]
+}
+
+func (t *shardedStoreTransaction) WithinNested(ctx context.Context, f func(context.Context, Transaction) (commit bool, err error)) error {
+	if f == nil {
+		return errors.New("transaction-consuming function must be non-nil")
+	}
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	sp, err := t.makeSavepoint(ctx)
+	if err != nil {
+		return err
+	}
+	commit, err := f(ctx, t)
+	if !commit {
+		t.rollBackTo(sp)
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// The suffixes of the reserved keys of an outbox's records.
+const (
+	outboxHeadSuffix  = 'h'
+	outboxTailSuffix  = 't'
+	outboxEntrySuffix = 'e'
+)
+
+// errEmptyOutboxName indicates that a caller attempted to use an outbox without a name.
+var errEmptyOutboxName = errors.New("outbox name must be nonempty")
+
+// outboxHeadKey returns the reserved key of the record storing the sequence number of the oldest
+// unacknowledged entry in the named outbox. Only consumers acknowledging entries write to this
+// record, so that they don't conflict with transactions appending entries.
+func outboxHeadKey(name string) Key {
+	return reservedKeyFor(outboxKeyKind, Key(name), []byte{outboxHeadSuffix})
+}
+
+// outboxTailKey returns the reserved key of the record storing the sequence number to assign to
+// the next entry appended to the named outbox.
+func outboxTailKey(name string) Key {
+	return reservedKeyFor(outboxKeyKind, Key(name), []byte{outboxTailSuffix})
+}
+
+// outboxEntryKey returns the reserved key of the record storing the entry with the given sequence
+// number in the named outbox.
+func outboxEntryKey(name string, sequence uint64) Key {
+	suffix := make([]byte, 1, 9)
+	suffix[0] = outboxEntrySuffix
+	return reservedKeyFor(outboxKeyKind, Key(name), binary.BigEndian.AppendUint64(suffix, sequence))
+}
+
+// readOutboxPosition retrieves the sequence number stored in the record with the given reserved
+// key, which is one if no such record exists.
+func (t *shardedStoreTransaction) readOutboxPosition(ctx context.Context, k Key) (uint64, error) {
+	v, ok, err := t.readReserved(ctx, k)
+	if err != nil || !ok {
+		return 1, err
+	}
+	if len(v) != 8 {
+		return 0, errors.New("outbox position is malformed")
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func (t *shardedStoreTransaction) writeOutboxPosition(ctx context.Context, k Key, sequence uint64) error {
+	return t.writeReserved(ctx, k, binary.BigEndian.AppendUint64(nil, sequence))
+}
+
+func (t *shardedStoreTransaction) appendToOutbox(ctx context.Context, name string, event Value) (uint64, error) {
+	tail := outboxTailKey(name)
+	sequence, err := t.readOutboxPosition(ctx, tail)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.writeReserved(ctx, outboxEntryKey(name, sequence), event); err != nil {
+		return 0, err
+	}
+	return sequence, t.writeOutboxPosition(ctx, tail, sequence+1)
+}
+
+func (t *shardedStoreTransaction) AppendToOutbox(ctx context.Context, outbox string, event Value) (uint64, error) {
+	if err := t.aborted(); err != nil {
+		return 0, err
+	}
+	if len(outbox) == 0 {
+		return 0, errEmptyOutboxName
+	}
+	k := Key(outbox)
+	var sequence uint64
+	err := t.store.validateValue(k, event)
+	if err == nil {
+		if event == nil {
+			// Distinguish an empty event from the absence of an entry.
+			event = Value{}
+		}
+		sequence, err = t.appendToOutbox(ctx, outbox, event)
+	}
+	t.audit(ctx, AuditAppendToOutbox, k, event, err)
+	return sequence, err
+}
+
+// OutboxEntry is an event appended to an outbox (see Transaction.AppendToOutbox).
+type OutboxEntry struct {
+	// Sequence is the entry's position within the outbox, which starts at one and increases by one
+	// with each entry appended.
+	Sequence uint64
+	Event    Value
+}
+
+// ReadOutbox retrieves up to the given positive number of the oldest entries in the named outbox
+// that no consumer has yet acknowledged (see AcknowledgeOutbox), in the order in which the
+// transactions that appended them committed. It returns no entries if the outbox is empty or
+// doesn't exist.
+//
+// Reading entries doesn't remove them, so a consumer that fails to publish the events it read may
+// read them again. Consumers should acknowledge each entry only after publishing it, and so should
+// tolerate publishing an entry more than once.
+func (s *ShardedStore) ReadOutbox(ctx context.Context, outbox string, limit int) ([]OutboxEntry, error) {
+	if len(outbox) == 0 {
+		return nil, errEmptyOutboxName
+	}
+	if limit < 1 {
+		return nil, errors.New("outbox read limit must be positive")
+	}
+	var entries []OutboxEntry
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		entries = nil
+		head, err := t.readOutboxPosition(ctx, outboxHeadKey(outbox))
+		if err != nil {
+			return false, err
+		}
+		tail, err := t.readOutboxPosition(ctx, outboxTailKey(outbox))
+		if err != nil {
+			return false, err
+		}
+		for sequence := head; sequence < tail && len(entries) < limit; sequence++ {
+			v, ok, err := t.readReserved(ctx, outboxEntryKey(outbox, sequence))
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, errors.New("outbox entry is missing")
+			}
+			var event Value
+			event.CopyFrom(v)
+			entries = append(entries, OutboxEntry{Sequence: sequence, Event: event})
+		}
+		return false, nil
+	})
+	return entries, err
+}
+
+// AcknowledgeOutbox removes the entries in the named outbox with sequence numbers up to and
+// including the given one, such as once a consumer has published the events that it read via
+// ReadOutbox, returning the number of entries removed. Acknowledging entries that were already
+// acknowledged, or that have yet to be appended, has no effect.
+//
+// Since it removes the entries within one transaction, acknowledging more entries at once than the
+// store permits a transaction to write fails (see WithMaxPendingWritesPerTransaction). Concurrent
+// calls for the same outbox conflict with each other, but not with transactions appending entries.
+func (s *ShardedStore) AcknowledgeOutbox(ctx context.Context, outbox string, through uint64) (int, error) {
+	if len(outbox) == 0 {
+		return 0, errEmptyOutboxName
+	}
+	var acknowledged int
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		acknowledged = 0
+		headKey := outboxHeadKey(outbox)
+		head, err := t.readOutboxPosition(ctx, headKey)
+		if err != nil {
+			return false, err
+		}
+		tail, err := t.readOutboxPosition(ctx, outboxTailKey(outbox))
+		if err != nil {
+			return false, err
+		}
+		end := min(through, tail-1) + 1
+		if end <= head {
+			return false, nil
+		}
+		for sequence := head; sequence < end; sequence++ {
+			if err := t.writeReserved(ctx, outboxEntryKey(outbox, sequence), nil); err != nil {
+				return false, err
+			}
+			acknowledged++
+		}
+		return true, t.writeOutboxPosition(ctx, headKey, end)
+	})
+	return acknowledged, err
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"iter"
+)
+
+// Preload stores the records yielded by the given sequence as if committed together by a single
+// transaction, bypassing the per-record bookkeeping of proposing and then finalizing changes. It's
+// meant for loading initial data into a store—such as at startup or for test fixtures—before
+// other callers begin using it. Transactions running concurrently with Preload may observe only
+// some of the loaded records.
+//
+// Preload neither audits the records it stores nor propagates them through the store's
+// WritePropagator.
+//
+// If the store already contains a record for one of the yielded keys, Preload stops and returns
+// ErrRecordExists, retaining the records it stored before then. Similarly, if one of the yielded
+// keys fails validation, Preload stops and returns ErrInvalidKey, and if one of the yielded values
+// fails validation, it returns ErrInvalidValue. If the store is read-only (see
+// ShardedStore.SetReadOnly), Preload returns ErrReadOnlyTransaction without storing any records.
+func (s *ShardedStore) Preload(ctx context.Context, seq iter.Seq2[Key, Value]) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+	id := s.txState.claimNext()
+	defer s.txState.recordFinished(id)
+	var loaded bool
+	defer func() {
+		if loaded {
+			s.txState.recordCommitted(id)
+		}
+	}()
+	for k, v := range seq {
+		if s.readOnly.Load() {
+			return readOnlyTransactionError(k)
+		}
+		if err := s.validateKey(k); err != nil {
+			return err
+		}
+		if err := s.validateValue(k, v); err != nil {
+			return err
+		}
+		rm, next := s.lockRecordMapsFor(ctx, k)
+		if rm == nil {
+			return ctx.Err()
+		}
+		if _, ok := rm.recordsByKey[string(k)]; ok {
+			unlockRecordMaps(rm, next)
+			return recordExistsError(k)
+		}
+		version := newRecordVersion(nil)
+		s.sealValueInto(&version.value, k, v)
+		version.validAsOfTransaction.Store(uint64(id))
+		var record versionedRecord
+		record.newest.Store(version)
+		record.newestCommitted.Store(version)
+		s.addRecordTo(rm, next, k, &record)
+		unlockRecordMaps(rm, next)
+		s.noteRecordUse(k, version)
+		loaded = true
+	}
+	s.evictExcessRecords()
+	return nil
+}
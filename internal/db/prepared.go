@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errPreparedTransactionAborted = errors.New("prepared transaction was aborted")
+	errPreparedTransactionExpired = errors.New("prepared transaction expired awaiting a decision")
+)
+
+type preparedTransaction struct {
+	// decision conveys whether to commit the transaction.
+	decision chan bool
+	// finished conveys the outcome of the transaction.
+	finished chan error
+	// txID is the transaction's ID, set before the transaction is prepared.
+	txID transactionID
+}
+
+// preparedTransactionTable tracks the transactions awaiting a decision, by the IDs that their
+// coordinators assigned to them.
+type preparedTransactionTable struct {
+	mu   sync.Mutex
+	byID map[string]*preparedTransaction
+}
+
+// claim removes the transaction with the given ID, reporting whether it was present, so that only
+// one party may decide its fate.
+func (pt *preparedTransactionTable) claim(id string) (*preparedTransaction, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	p, ok := pt.byID[id]
+	if ok {
+		delete(pt.byID, id)
+	}
+	return p, ok
+}
+
+// await waits for a decision about the transaction with the given ID, abandoning the transaction
+// if the given Context is done first, returning the values with which to conclude it.
+func (pt *preparedTransactionTable) await(ctx context.Context, id string, p *preparedTransaction) (bool, error) {
+	select {
+	case commit := <-p.decision:
+		if !commit {
+			return false, errPreparedTransactionAborted
+		}
+		return true, nil
+	case <-ctx.Done():
+		if _, ok := pt.claim(id); ok {
+			return false, errPreparedTransactionExpired
+		}
+		// Someone claimed the transaction just now, and will deliver a decision promptly.
+		if commit := <-p.decision; commit {
+			return true, nil
+		}
+		return false, errPreparedTransactionAborted
+	}
+}
+
+// PrepareTransaction calls the given function with a new transaction as the first phase of a
+// two-phase commit coordinated by another party, identifying the transaction by the given ID,
+// which must be unique among the transactions prepared in this store awaiting a decision. If the
+// function succeeds, rather than committing the transaction's proposed changes, the store holds
+// the transaction open, precluding other transactions from writing the same records, until a
+// call to CommitPrepared or AbortPrepared decides its fate, returning the transaction's ID. If no
+// such decision arrives within the given positive duration, the store aborts the transaction on
+// its own. If the function fails, or the given Context is done before the function returns,
+// PrepareTransaction rolls back the transaction and returns the error, including ErrRollback.
+//
+// If a transaction with the given ID is already prepared, PrepareTransaction returns
+// ErrPreparedTransactionExists.
+func (s *ShardedStore) PrepareTransaction(ctx context.Context, id string, ttl time.Duration, f func(context.Context, Transaction) error) (uint64, error) {
+	if f == nil {
+		return 0, errors.New("transaction-consuming function must be non-nil")
+	}
+	if ttl <= 0 {
+		return 0, errors.New("prepared transaction duration must be positive")
+	}
+	p := preparedTransaction{
+		decision: make(chan bool, 1),
+		finished: make(chan error, 1),
+	}
+	pt := &s.preparedTransactions
+	pt.mu.Lock()
+	if _, ok := pt.byID[id]; ok {
+		pt.mu.Unlock()
+		return 0, preparedTransactionExistsError(id)
+	}
+	if pt.byID == nil {
+		pt.byID = make(map[string]*preparedTransaction)
+	}
+	// TODO(seh): Record prepared transactions durably once the store persists its records, so
+	// that they survive a restart still awaiting their coordinators' decisions.
+	pt.byID[id] = &p
+	pt.mu.Unlock()
+	prepared := make(chan struct{})
+	go func() {
+		// The transaction outlives this call, lasting until it expires, but until it's prepared,
+		// it's subject to the caller's Context as well.
+		ttlCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+		defer cancel(nil)
+		expiry := s.clock.AfterFunc(ttl, func() { cancel(errPreparedTransactionExpired) })
+		defer expiry.Stop()
+		detach := context.AfterFunc(ctx, func() { cancel(nil) })
+		p.finished <- s.WithinTransaction(ttlCtx, func(txCtx context.Context, tx Transaction) (bool, error) {
+			if err := f(txCtx, tx); err != nil {
+				return false, err
+			}
+			// Once prepared, the transaction must remain able to commit if its coordinator so
+			// decides, no matter which other transactions conflict with it.
+			if t := tx.(*shardedStoreTransaction); !t.shieldFromPreemption() {
+				return false, t.aborted()
+			}
+			if !detach() {
+				return false, ctx.Err()
+			}
+			p.txID = transactionID(tx.ID())
+			close(prepared)
+			return pt.await(txCtx, id, &p)
+		})
+	}()
+	select {
+	case <-prepared:
+		return uint64(p.txID), nil
+	case err := <-p.finished:
+		pt.claim(id)
+		if err == nil {
+			// The function rolled back the transaction via ErrRollback.
+			err = ErrRollback
+		}
+		return 0, err
+	}
+}
+
+// CommitPrepared commits the changes proposed within the transaction with the given ID that was
+// prepared earlier (see PrepareTransaction), returning the transaction's ID. Committing may still
+// fail if, for instance, a lease to which the transaction attached records expired in the
+// meantime, or an administrator forcibly aborted the transaction (see AbortTransaction).
+//
+// If no transaction with the given ID awaits a decision, whether because it was never prepared,
+// or because it was since aborted or expired, CommitPrepared returns
+// ErrPreparedTransactionNotFound.
+func (s *ShardedStore) CommitPrepared(id string) (uint64, error) {
+	p, ok := s.preparedTransactions.claim(id)
+	if !ok {
+		return 0, preparedTransactionNotFoundError(id)
+	}
+	p.decision <- true
+	if err := <-p.finished; err != nil {
+		return 0, err
+	}
+	return uint64(p.txID), nil
+}
+
+// AbortPrepared rolls back the changes proposed within the transaction with the given ID that was
+// prepared earlier (see PrepareTransaction).
+//
+// If no transaction with the given ID awaits a decision, AbortPrepared returns
+// ErrPreparedTransactionNotFound.
+func (s *ShardedStore) AbortPrepared(id string) error {
+	p, ok := s.preparedTransactions.claim(id)
+	if !ok {
+		return preparedTransactionNotFoundError(id)
+	}
+	p.decision <- false
+	<-p.finished
+	return nil
+}
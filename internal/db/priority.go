@@ -0,0 +1,81 @@
+package db
+
+import "context"
+
+type transactionPriorityContextKey struct{}
+
+// ContextWithTransactionPriority returns a Context carrying the given priority for transactions
+// begun via WithinTransaction with that Context. When two transactions conflict over a record,
+// the one with the higher priority prevails, or, given equal priorities, the one that began
+// first, counting from its first attempt (see WithMaxTransactionAttempts). The prevailing
+// transaction forcibly aborts the other with ErrTransactionInConflict, and, if it too fails with
+// that error, waits for the other to roll back its changes before trying again. This keeps long
+// transactions from starving behind streams of short ones. Without such a Context, transactions
+// run at priority zero.
+func ContextWithTransactionPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, transactionPriorityContextKey{}, priority)
+}
+
+// TransactionPriorityFromContext returns the priority supplied via ContextWithTransactionPriority,
+// if any.
+func TransactionPriorityFromContext(ctx context.Context) (int, bool) {
+	priority, ok := ctx.Value(transactionPriorityContextKey{}).(int)
+	return priority, ok
+}
+
+// transactionLineage describes the successive attempts to complete a transaction.
+type transactionLineage struct {
+	priority int
+	// seniority is the ID of the transaction's first attempt, which later attempts retain so that
+	// they don't lose out to transactions begun since then.
+	seniority transactionID
+	// conflictedWith is the greatest ID of a transaction whose committed changes conflicted with
+	// an earlier attempt, which later attempts must follow.
+	conflictedWith transactionID
+	// yieldTo, if not nil, closes once the transaction that the latest attempt preempted, or
+	// that preempted it, concludes, after which it's worth making another attempt.
+	yieldTo <-chan struct{}
+	// done closes once the last attempt concludes.
+	done chan struct{}
+}
+
+const (
+	// preemptible indicates that another transaction may forcibly abort this one.
+	preemptible uint32 = iota
+	// preempted indicates that another transaction forcibly aborted this one.
+	preempted
+	// unpreemptible indicates that this transaction committed to concluding as it sees fit, such
+	// as upon being prepared.
+	unpreemptible
+)
+
+// outranks reports whether this transaction prevails over the other in a conflict.
+func (t *shardedStoreTransaction) outranks(other *shardedStoreTransaction) bool {
+	if t.lineage.priority != other.lineage.priority {
+		return t.lineage.priority > other.lineage.priority
+	}
+	return t.lineage.seniority < other.lineage.seniority
+}
+
+// preempt forcibly aborts the active transaction with the given ID if this transaction outranks
+// it in their conflict over the record with the given key, returning a channel that closes once
+// that transaction concludes, or nil if this transaction didn't preempt it.
+func (t *shardedStoreTransaction) preempt(k Key, id transactionID) <-chan struct{} {
+	if t.lineage == nil || id == noSuchTransaction || id == t.id {
+		return nil
+	}
+	other := t.store.activeTransaction(id)
+	if other == nil || !t.outranks(other) || !other.preemption.CompareAndSwap(preemptible, preempted) {
+		return nil
+	}
+	other.preemptedBy.Store(t.lineage)
+	other.journalf(JournalConflict, k, t.id, "preempted by transaction %d", t.id)
+	other.doomWith(transactionInConflictError(k))
+	return other.concluded
+}
+
+// shieldFromPreemption precludes other transactions from preempting this one, reporting whether
+// it did so before any other transaction preempted it.
+func (t *shardedStoreTransaction) shieldFromPreemption() bool {
+	return t.preemption.CompareAndSwap(preemptible, unpreemptible) || t.preemption.Load() == unpreemptible
+}
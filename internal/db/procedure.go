@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A Procedure is a named operation registered with a store by the embedding application, which
+// callers can invoke by name within a transaction. It receives the caller's arguments by name,
+// and returns a result to report to the caller. Returning a non-nil error rolls back the
+// transaction's changes.
+type Procedure func(ctx context.Context, tx Transaction, args map[string]string) (result any, err error)
+
+type procedureRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]Procedure
+}
+
+// RegisterProcedure makes the given procedure available for calling by the given name via
+// CallProcedure, failing if a procedure is already registered with that name.
+func (s *ShardedStore) RegisterProcedure(name string, p Procedure) error {
+	if len(name) == 0 {
+		return errors.New("procedure name must be nonempty")
+	}
+	if p == nil {
+		return errors.New("procedure must be non-nil")
+	}
+	r := &s.procedures
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[name]; ok {
+		return fmt.Errorf("procedure %q is already registered", name)
+	}
+	if r.byName == nil {
+		r.byName = make(map[string]Procedure)
+	}
+	r.byName[name] = p
+	return nil
+}
+
+// CallProcedure calls the procedure registered with the given name within a transaction,
+// committing the changes proposed within that transaction only if the procedure returns a nil
+// error. If no such procedure is registered, it fails with ErrProcedureNotFound.
+func (s *ShardedStore) CallProcedure(ctx context.Context, name string, args map[string]string) (any, error) {
+	r := &s.procedures
+	r.mu.RLock()
+	p, ok := r.byName[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, procedureNotFoundError(name)
+	}
+	var result any
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var err error
+		result, err = p(ctx, tx, args)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
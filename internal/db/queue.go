@@ -0,0 +1,286 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// retryingTransactionAttempts is the number of times to attempt each queue or topic operation
+// when it conflicts with other transactions, such as those of other producers or consumers using
+// the same queue or topic.
+const retryingTransactionAttempts = 10
+
+// The suffixes of the reserved keys of a queue's records.
+const (
+	queueHeadSuffix    = 'h'
+	queueTailSuffix    = 't'
+	queueMessageSuffix = 'm'
+	queueClaimSuffix   = 'c'
+)
+
+// errEmptyQueueName indicates that a caller attempted to use a queue without a name.
+var errEmptyQueueName = errors.New("queue name must be nonempty")
+
+// queueHeadKey returns the reserved key of the record storing the ID of the oldest message in the
+// named queue that may remain unacknowledged.
+func queueHeadKey(name string) Key {
+	return reservedKeyFor(queueKeyKind, Key(name), []byte{queueHeadSuffix})
+}
+
+// queueTailKey returns the reserved key of the record storing the ID to assign to the next message
+// enqueued in the named queue.
+func queueTailKey(name string) Key {
+	return reservedKeyFor(queueKeyKind, Key(name), []byte{queueTailSuffix})
+}
+
+func queueMessageRecordKey(name string, suffix byte, id uint64) Key {
+	return reservedKeyFor(queueKeyKind, Key(name), binary.BigEndian.AppendUint64([]byte{suffix}, id))
+}
+
+// queueMessageKey returns the reserved key of the record storing the body of the message with the
+// given ID in the named queue.
+func queueMessageKey(name string, id uint64) Key {
+	return queueMessageRecordKey(name, queueMessageSuffix, id)
+}
+
+// queueClaimKey returns the reserved key of the record identifying the lease under which a
+// consumer holds the message with the given ID in the named queue. The record is attached to that
+// lease, so that the message becomes visible again once the lease expires.
+func queueClaimKey(name string, id uint64) Key {
+	return queueMessageRecordKey(name, queueClaimSuffix, id)
+}
+
+// readQueuePosition retrieves the message ID stored in the record with the given reserved key,
+// which is one if no such record exists.
+func (t *shardedStoreTransaction) readQueuePosition(ctx context.Context, k Key) (uint64, error) {
+	v, ok, err := t.readReserved(ctx, k)
+	if err != nil || !ok {
+		return 1, err
+	}
+	if len(v) != 8 {
+		return 0, errors.New("queue position is malformed")
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func (t *shardedStoreTransaction) writeQueuePosition(ctx context.Context, k Key, id uint64) error {
+	return t.writeReserved(ctx, k, binary.BigEndian.AppendUint64(nil, id))
+}
+
+// readQueueClaim retrieves the ID of the lease under which a consumer holds the message with the
+// given ID in the named queue, reporting whether any consumer holds it.
+func (t *shardedStoreTransaction) readQueueClaim(ctx context.Context, name string, id uint64) (uint64, bool, error) {
+	v, ok, err := t.readReserved(ctx, queueClaimKey(name, id))
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if len(v) != 8 {
+		return 0, false, errors.New("queue message claim is malformed")
+	}
+	return binary.BigEndian.Uint64(v), true, nil
+}
+
+// withinRetryingTransaction calls the given function within a transaction, like
+// WithinTransaction, attempting the transaction again if it conflicts with another one.
+func (s *ShardedStore) withinRetryingTransaction(ctx context.Context, f func(context.Context, *shardedStoreTransaction) (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return f(ctx, tx.(*shardedStoreTransaction))
+		})
+		if attempt >= retryingTransactionAttempts || !errors.Is(err, ErrTransactionInConflict) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// QueueMessage is a message that a consumer dequeued from a queue (see ShardedStore.Dequeue).
+type QueueMessage struct {
+	// ID identifies the message within its queue. Each queue assigns IDs starting at one,
+	// increasing by one with each message enqueued.
+	ID   uint64
+	Body Value
+	// LeaseID identifies the lease under which the consumer holds the message, which the consumer
+	// must supply to acknowledge or release the message.
+	LeaseID uint64
+}
+
+// Enqueue appends a message with the given body to the named queue, creating the queue if need
+// be, and returns the message's ID. Queues occupy their own key space, apart from ordinary records
+// and from sets, lists, and outboxes, so that applications can keep a small durable queue next to
+// their other records.
+//
+// If the body fails validation, Enqueue returns ErrInvalidValue or ErrValueTooLarge.
+func (s *ShardedStore) Enqueue(ctx context.Context, queue string, body Value) (uint64, error) {
+	if len(queue) == 0 {
+		return 0, errEmptyQueueName
+	}
+	if err := s.validateValue(Key(queue), body); err != nil {
+		return 0, err
+	}
+	if body == nil {
+		// Distinguish an empty body from the absence of a message.
+		body = Value{}
+	}
+	var id uint64
+	err := s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+		tail := queueTailKey(queue)
+		var err error
+		if id, err = t.readQueuePosition(ctx, tail); err != nil {
+			return false, err
+		}
+		if err := t.writeReserved(ctx, queueMessageKey(queue, id), body); err != nil {
+			return false, err
+		}
+		return true, t.writeQueuePosition(ctx, tail, id+1)
+	})
+	return id, err
+}
+
+// Dequeue leases the oldest message in the named queue that no other consumer holds, hiding it
+// from other consumers for the given positive visibility timeout, and reports whether there was
+// such a message. The store grants a lease with the visibility timeout as its duration (see
+// GrantLease); the consumer may extend its hold on the message by keeping that lease alive (see
+// KeepLeaseAlive).
+//
+// Once done with the message, the consumer should acknowledge it (see AcknowledgeMessage) to
+// remove it from the queue, or release it (see ReleaseMessage) to make it available to other
+// consumers at once. If the lease expires first, the message becomes available again, so that
+// another consumer may dequeue it in turn, which makes delivery at least once: consumers should
+// tolerate processing a message more than once.
+//
+// Dequeue visits the messages in the queue in order, so a long run of messages held by other
+// consumers at the front of the queue makes dequeuing slower.
+func (s *ShardedStore) Dequeue(ctx context.Context, queue string, visibilityTimeout time.Duration) (QueueMessage, bool, error) {
+	if len(queue) == 0 {
+		return QueueMessage{}, false, errEmptyQueueName
+	}
+	if visibilityTimeout <= 0 {
+		return QueueMessage{}, false, errors.New("visibility timeout must be positive")
+	}
+	leaseID, err := s.GrantLease(visibilityTimeout)
+	if err != nil {
+		return QueueMessage{}, false, err
+	}
+	var m QueueMessage
+	var found bool
+	err = s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+		found = false
+		head, err := t.readQueuePosition(ctx, queueHeadKey(queue))
+		if err != nil {
+			return false, err
+		}
+		tail, err := t.readQueuePosition(ctx, queueTailKey(queue))
+		if err != nil {
+			return false, err
+		}
+		for id := head; id < tail; id++ {
+			body, ok, err := t.readReserved(ctx, queueMessageKey(queue, id))
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				// A consumer acknowledged the message out of order.
+				continue
+			}
+			if _, claimed, err := t.readQueueClaim(ctx, queue, id); err != nil {
+				return false, err
+			} else if claimed {
+				continue
+			}
+			claim := queueClaimKey(queue, id)
+			if err := t.writeReserved(ctx, claim, binary.BigEndian.AppendUint64(nil, leaseID)); err != nil {
+				return false, err
+			}
+			if err := t.AttachToLease(ctx, claim, leaseID); err != nil {
+				return false, err
+			}
+			m = QueueMessage{ID: id, LeaseID: leaseID}
+			m.Body.CopyFrom(body)
+			found = true
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil || !found {
+		// The lease has no records attached to it, so revoking it merely spares its timer.
+		s.RevokeLease(context.WithoutCancel(ctx), leaseID)
+		return QueueMessage{}, false, err
+	}
+	return m, true, nil
+}
+
+// settleMessage deletes the claim on the message with the given ID in the named queue held under
+// the given lease, along with the message itself if remove is true, then revokes the lease.
+func (s *ShardedStore) settleMessage(ctx context.Context, queue string, id, leaseID uint64, remove bool) error {
+	if len(queue) == 0 {
+		return errEmptyQueueName
+	}
+	err := s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+		holder, claimed, err := t.readQueueClaim(ctx, queue, id)
+		if err != nil {
+			return false, err
+		}
+		if !claimed || holder != leaseID {
+			return false, messageNotLeasedError{queue: queue, id: id, leaseID: leaseID}
+		}
+		if err := t.writeReserved(ctx, queueClaimKey(queue, id), nil); err != nil {
+			return false, err
+		}
+		if !remove {
+			return true, nil
+		}
+		if err := t.writeReserved(ctx, queueMessageKey(queue, id), nil); err != nil {
+			return false, err
+		}
+		headKey := queueHeadKey(queue)
+		head, err := t.readQueuePosition(ctx, headKey)
+		if err != nil {
+			return false, err
+		}
+		if id != head {
+			return true, nil
+		}
+		// Skip past the messages that consumers acknowledged out of order.
+		tail, err := t.readQueuePosition(ctx, queueTailKey(queue))
+		if err != nil {
+			return false, err
+		}
+		for head++; head < tail; head++ {
+			if _, ok, err := t.readReserved(ctx, queueMessageKey(queue, head)); err != nil {
+				return false, err
+			} else if ok {
+				break
+			}
+		}
+		return true, t.writeQueuePosition(ctx, headKey, head)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.RevokeLease(ctx, leaseID); err != nil && !errors.Is(err, ErrLeaseNotFound) {
+		return err
+	}
+	return nil
+}
+
+// AcknowledgeMessage removes the message with the given ID from the named queue, once the
+// consumer that dequeued it under the lease with the given ID has processed it, and revokes the
+// lease.
+//
+// If the consumer no longer holds the message under that lease, such as because the lease
+// expired, AcknowledgeMessage returns ErrMessageNotLeased.
+func (s *ShardedStore) AcknowledgeMessage(ctx context.Context, queue string, id, leaseID uint64) error {
+	return s.settleMessage(ctx, queue, id, leaseID, true)
+}
+
+// ReleaseMessage makes the message with the given ID in the named queue available again to
+// consumers at once, such as when the consumer that dequeued it under the lease with the given ID
+// fails to process it, and revokes the lease.
+//
+// If the consumer no longer holds the message under that lease, such as because the lease
+// expired, ReleaseMessage returns ErrMessageNotLeased.
+func (s *ShardedStore) ReleaseMessage(ctx context.Context, queue string, id, leaseID uint64) error {
+	return s.settleMessage(ctx, queue, id, leaseID, false)
+}
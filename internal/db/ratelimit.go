@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// WriteRateLimitPolicy governs how the store treats attempts to write a record more often than
+// the rate established by WithPerKeyWriteRate allows.
+type WriteRateLimitPolicy uint8
+
+const (
+	// RejectExcessWrites directs the store to fail such attempts immediately with
+	// ErrWriteRateExceeded.
+	RejectExcessWrites WriteRateLimitPolicy = iota
+	// DelayExcessWrites directs the store to delay such attempts until the rate allows them, or
+	// until the governing Context is done.
+	DelayExcessWrites
+)
+
+// WithPerKeyWriteRate limits how often transactions may attempt to write each record via
+// Transaction.Insert, Update, Upsert, Delete, and their variants, allowing the given positive
+// number of writes per second to each record on average, along with bursts of up to the given
+// positive number of writes. This protects the store from hot keys whose version histories
+// would otherwise grow faster than the store can reclaim their old versions. Whether excess
+// writes fail or wait depends on the policy established by WithWriteRateLimitPolicy. By
+// default, the store doesn't limit the rate of writes.
+func WithPerKeyWriteRate(r float64, burst int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if r <= 0 {
+			return errors.New("per-key write rate must be positive")
+		}
+		if burst < 1 {
+			return errors.New("per-key write burst must be positive")
+		}
+		o.writeRate = r
+		o.writeBurst = burst
+		return nil
+	}
+}
+
+// WithWriteRateLimitPolicy establishes how the store treats attempts to write a record more often
+// than the rate established by WithPerKeyWriteRate allows. The default policy is
+// RejectExcessWrites.
+func WithWriteRateLimitPolicy(p WriteRateLimitPolicy) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		switch p {
+		case RejectExcessWrites, DelayExcessWrites:
+			o.writeRateLimitPolicy = p
+			return nil
+		default:
+			return errors.New("unrecognized write rate limit policy")
+		}
+	}
+}
+
+// writeTokenBucket holds the writes allowed for a record, replenished at the store's write rate
+// up to its burst size.
+type writeTokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// writeRateTable tracks the writes allowed for the records within a shard.
+type writeRateTable struct {
+	mu    sync.Mutex
+	byKey map[string]*writeTokenBucket // NB: Initialized lazily
+	swept time.Time
+}
+
+// take consumes one write allowed for the record with the given key at the given rate and burst
+// size, returning zero if it did so, or otherwise how long until the next write is allowed.
+func (wt *writeRateTable) take(k Key, rate float64, burst int, now time.Time) time.Duration {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	if now.Sub(wt.swept) >= refill {
+		// Forget the buckets that would be full by now, since they'd start anew that way anyway.
+		for key, b := range wt.byKey {
+			if now.Sub(b.updated) >= refill {
+				delete(wt.byKey, key)
+			}
+		}
+		wt.swept = now
+	}
+	b, ok := wt.byKey[string(k)]
+	if !ok {
+		if wt.byKey == nil {
+			wt.byKey = make(map[string]*writeTokenBucket)
+		}
+		b = &writeTokenBucket{tokens: float64(burst)}
+		wt.byKey[string(k)] = b
+	} else {
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// writeRatesFor returns the table tracking the writes allowed for the record with the given key,
+// which, like the record's lock, stays put while the store migrates records between shards.
+func (s *ShardedStore) writeRatesFor(k Key) *writeRateTable {
+	return &s.recordMaps[s.keyCardinalityHash(k)%shardDegree].writeRates
+}
+
+// checkWriteRate returns an error if writing the record with the given key now would exceed the
+// store's per-key write rate, first waiting for the rate to allow the write if the store's policy
+// calls for that.
+func (t *shardedStoreTransaction) checkWriteRate(ctx context.Context, k Key) error {
+	s := t.store
+	if s.writeRate == 0 {
+		return nil
+	}
+	wt := s.writeRatesFor(k)
+	for {
+		wait := wt.take(k, s.writeRate, s.writeBurst, s.clock.Now())
+		if wait == 0 {
+			return nil
+		}
+		if s.writeRateLimitPolicy == RejectExcessWrites {
+			return writeRateExceededError(k)
+		}
+		elapsed, stop := s.after(wait)
+		select {
+		case <-elapsed:
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		}
+	}
+}
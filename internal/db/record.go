@@ -1,16 +1,65 @@
 package db
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type recordVersion struct {
 	value                  Value
-	next                   *recordVersion
+	metadata               *Metadata // NB: Never modified in place once stored, so safe to share.
+	next                   atomic.Pointer[recordVersion]
 	validAsOfTransaction   atomic.Uint64
 	validBeforeTransaction atomic.Uint64
+	// proposedBy is the ID of the transaction that proposed this version, for identifying the
+	// transaction with which another conflicts while this version is pending.
+	proposedBy transactionID
+	// valueShared indicates that the value's buffer may be shared with a ValueRef, so that the
+	// store must neither modify it in place nor reuse it.
+	valueShared bool
 	// TODO(seh): Do we need to indicate whether this version is still formative, being worked on by
 	// a writer in a transaction.
 }
 
+// recordVersionPool holds record versions available for reuse, along with their value buffers.
+var recordVersionPool = sync.Pool{
+	New: func() any {
+		return new(recordVersion)
+	},
+}
+
+// newRecordVersion returns a record version preceding the given next version, possibly reusing
+// one released by releaseUnpublishedRecordVersion, in which case its value buffer retains its
+// capacity for reuse.
+func newRecordVersion(next *recordVersion) *recordVersion {
+	v := recordVersionPool.Get().(*recordVersion)
+	v.next.Store(next)
+	return v
+}
+
+// releaseUnpublishedRecordVersion makes the given record version available for reuse. Callers must
+// ensure that the version was never reachable from a versionedRecord, such that no other goroutine
+// could still be inspecting it, and that its value buffer is not shared with any other version.
+//
+// TODO(seh): Once we have a "vacuum" procedure that can determine when no transaction can still
+// observe a superseded record version, release those versions here too.
+func (s *ShardedStore) releaseUnpublishedRecordVersion(v *recordVersion) {
+	if s.valueInterner != nil {
+		s.discardValue(&v.value)
+	} else if v.valueShared {
+		v.value = nil
+		v.valueShared = false
+	} else {
+		v.value = v.value[:0]
+	}
+	v.metadata = nil
+	v.next.Store(nil)
+	v.proposedBy = noSuchTransaction
+	v.validAsOfTransaction.Store(uint64(noSuchTransaction))
+	v.validBeforeTransaction.Store(uint64(noSuchTransaction))
+	recordVersionPool.Put(v)
+}
+
 func (v *recordVersion) validAsOfTransactionID() transactionID {
 	return transactionID(v.validAsOfTransaction.Load())
 }
@@ -21,5 +70,25 @@ func (v *recordVersion) validBeforeTransactionID() transactionID {
 
 type versionedRecord struct {
 	newest atomic.Pointer[recordVersion]
+	// newestCommitted is the newest committed version among the record's versions, if any, from
+	// which readers that aren't writing the record may begin walking its history, skipping over
+	// the pending versions proposed by other transactions.
+	newestCommitted atomic.Pointer[recordVersion]
+	// access counts the record's reads and writes, if the store tracks record access.
+	access atomic.Pointer[recordAccessCounters]
 	// TODO(seh): What else do we need here?
 }
+
+// noteCommitted notes that the given version of the record committed, unless a newer version
+// committed already.
+func (r *versionedRecord) noteCommitted(v *recordVersion) {
+	for {
+		current := r.newestCommitted.Load()
+		if current != nil && current.validAsOfTransactionID() >= v.validAsOfTransactionID() {
+			return
+		}
+		if r.newestCommitted.CompareAndSwap(current, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// RecordLockPolicy governs how Transaction.LockForUpdate behaves when another transaction already
+// holds the requested lock.
+type RecordLockPolicy uint8
+
+const (
+	// WaitForRecordLock directs Transaction.LockForUpdate to wait until either the other
+	// transaction releases the lock or the governing Context is done.
+	WaitForRecordLock RecordLockPolicy = iota
+	// FailFastOnRecordLock directs Transaction.LockForUpdate to fail immediately with
+	// ErrTransactionInConflict.
+	FailFastOnRecordLock
+)
+
+// WithRecordLockPolicy establishes how Transaction.LockForUpdate behaves when another transaction
+// already holds the requested lock. The default policy is WaitForRecordLock.
+func WithRecordLockPolicy(p RecordLockPolicy) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		switch p {
+		case WaitForRecordLock, FailFastOnRecordLock:
+			o.recordLockPolicy = p
+			return nil
+		default:
+			return errors.New("unrecognized record lock policy")
+		}
+	}
+}
+
+type recordLock struct {
+	holder   transactionID
+	released chan struct{}
+}
+
+// recordLockTable tracks the exclusive intents that transactions hold on records within a shard.
+type recordLockTable struct {
+	// held counts the locks in the table, allowing writers to skip inspecting the table when no
+	// transactions hold any locks.
+	held  atomic.Int32
+	mu    sync.Mutex
+	byKey map[string]*recordLock // NB: Initialized lazily
+}
+
+// tryAcquire attempts to acquire the lock for the given key on behalf of the given transaction,
+// returning true if the transaction now holds the lock, or otherwise the ID of the holding
+// transaction and a channel that will close when that transaction releases the lock.
+func (lt *recordLockTable) tryAcquire(k Key, id transactionID) (bool, transactionID, <-chan struct{}) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l, ok := lt.byKey[string(k)]; ok {
+		if l.holder == id {
+			return true, id, nil
+		}
+		return false, l.holder, l.released
+	}
+	if lt.byKey == nil {
+		lt.byKey = make(map[string]*recordLock)
+	}
+	lt.byKey[string(k)] = &recordLock{
+		holder:   id,
+		released: make(chan struct{}),
+	}
+	lt.held.Add(1)
+	return true, id, nil
+}
+
+func (lt *recordLockTable) release(k Key, id transactionID) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l, ok := lt.byKey[string(k)]; ok && l.holder == id {
+		delete(lt.byKey, string(k))
+		lt.held.Add(-1)
+		close(l.released)
+	}
+}
+
+// heldByOtherThan returns the ID of the transaction other than the given one that holds the lock
+// for the given key, reporting whether there is such a transaction.
+func (lt *recordLockTable) heldByOtherThan(k Key, id transactionID) (transactionID, bool) {
+	if lt.held.Load() == 0 {
+		return noSuchTransaction, false
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l, ok := lt.byKey[string(k)]
+	if !ok || l.holder == id {
+		return noSuchTransaction, false
+	}
+	return l.holder, true
+}
+
+// recordLocksFor returns the table tracking the lock for the given key. Since the table's shard
+// derives from a hash independent of the store's key shard projection, locks stay put while the
+// store migrates records between shards (see ShardedStore.Resharding).
+func (s *ShardedStore) recordLocksFor(k Key) *recordLockTable {
+	return &s.recordMaps[s.keyCardinalityHash(k)%shardDegree].recordLocks
+}
+
+func (t *shardedStoreTransaction) LockForUpdate(ctx context.Context, k Key) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	if t.readOnly {
+		return readOnlyTransactionError(k)
+	}
+	if t.store.faults.failsLock() {
+		return t.conflict(k, noSuchTransaction, "injected fault failed acquiring the record lock")
+	}
+	locks := t.store.recordLocksFor(k)
+	for {
+		acquired, holder, released := locks.tryAcquire(k, t.id)
+		if acquired {
+			break
+		}
+		if t.store.recordLockPolicy == FailFastOnRecordLock {
+			return t.contend(k, holder)
+		}
+		// If this transaction outranks the holder, the holder releases the lock upon rolling back.
+		t.preempt(k, holder)
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	t.lockedKeys = append(t.lockedKeys, k)
+	// Since this transaction observes the database as it was when the transaction began, if
+	// another transaction committed a change to this record since then, or is still proposing
+	// one, this transaction can't write to the record, even though it holds the lock now.
+	if _, record, ok := t.recordFor(ctx, k); ok {
+		if r := record.newest.Load(); r != nil {
+			switch validAsOf := r.validAsOfTransactionID(); {
+			case validAsOf == noSuchTransaction && !t.hasPendingWriteAgainst(k):
+				return t.contend(k, r.proposedBy)
+			case validAsOf > t.id:
+				return t.conflict(k, validAsOf, "a later transaction committed a newer version")
+			}
+		}
+	}
+	return nil
+}
+
+// checkRecordLock returns an error if another transaction holds the lock for the given key, or if
+// this transaction may not write records at all.
+func (t *shardedStoreTransaction) checkRecordLock(k Key) error {
+	if t.readOnly {
+		return readOnlyTransactionError(k)
+	}
+	if t.store.faults.failsLock() {
+		return t.conflict(k, noSuchTransaction, "injected fault failed acquiring the record lock")
+	}
+	if holder, ok := t.store.recordLocksFor(k).heldByOtherThan(k, t.id); ok {
+		return t.contend(k, holder)
+	}
+	return nil
+}
+
+func (t *shardedStoreTransaction) releaseRecordLocks() {
+	for _, k := range t.lockedKeys {
+		t.store.recordLocksFor(k).release(k, t.id)
+	}
+	t.lockedKeys = nil
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// shardAssignment determines the shard in which the store keeps the record for each key.
+type shardAssignment struct {
+	projection KeyShardProjection
+	// next, if non-nil, is the projection under which the store is migrating its records to other
+	// shards. Until the migration concludes, the store continues to look up each record in the
+	// shard to which projection assigns it, but also keeps the record in the shard to which next
+	// assigns it, once it has copied the record there.
+	next KeyShardProjection
+	// settling indicates that the store has concluded a migration, but the shards may still hold
+	// records that belong in other shards under projection.
+	settling bool
+	// scans counts the scans in progress that rely on this assignment to determine which records
+	// belong in the shards they visit.
+	scans atomic.Int64
+}
+
+func (a *shardAssignment) shardFor(k Key) int {
+	return int(a.projection(k) % shardDegree)
+}
+
+// nextShardFor returns the shard to which the store is migrating the record with the given key,
+// which resides in the given shard now, or false if the record is not moving.
+func (a *shardAssignment) nextShardFor(k Key, current int) (int, bool) {
+	if a.next == nil {
+		return 0, false
+	}
+	if next := int(a.next(k) % shardDegree); next != current {
+		return next, true
+	}
+	return 0, false
+}
+
+// mixed reports whether the shards may hold records that belong in other shards.
+func (a *shardAssignment) mixed() bool {
+	return a.next != nil || a.settling
+}
+
+// pinShardAssignment returns the store's current shard assignment, precluding the store from
+// removing records from the shards in which that assignment places them until the caller
+// decrements the assignment's scan count.
+func (s *ShardedStore) pinShardAssignment() *shardAssignment {
+	for {
+		a := s.shards.Load()
+		a.scans.Add(1)
+		if s.shards.Load() == a {
+			return a
+		}
+		a.scans.Add(-1)
+	}
+}
+
+// readLockRecordMapFor acquires the read lock on the map in which to look up the record with the
+// given key, returning that map, or nil if the given Context is done first.
+func (s *ShardedStore) readLockRecordMapFor(ctx context.Context, k Key) *recordMap {
+	for {
+		a := s.shards.Load()
+		rm := &s.recordMaps[a.shardFor(k)]
+		if !rm.lock.TryRLockUntil(ctx) {
+			return nil
+		}
+		if s.shards.Load() == a {
+			return rm
+		}
+		// The store began or concluded a migration in the meantime.
+		rm.lock.RUnlock()
+	}
+}
+
+// lockRecordMapsFor acquires the write lock on the map in which to look up the record with the
+// given key, along with the map, if any, to which the store is migrating that record, returning
+// both maps, or nil maps if the given Context is done first. Callers adding a record must add it
+// to both maps (see addRecordTo).
+func (s *ShardedStore) lockRecordMapsFor(ctx context.Context, k Key) (rm, next *recordMap) {
+	for {
+		a := s.shards.Load()
+		i := a.shardFor(k)
+		j, moving := a.nextShardFor(k, i)
+		rm, next = &s.recordMaps[i], nil
+		if moving {
+			next = &s.recordMaps[j]
+		}
+		// Acquire the locks in the order of the shards' positions, to avoid deadlock with the
+		// migration and other callers acquiring two such locks.
+		first, second := rm, next
+		if moving && j < i {
+			first, second = next, rm
+		}
+		if !first.lock.TryLockUntil(ctx) {
+			return nil, nil
+		}
+		if second != nil && !second.lock.TryLockUntil(ctx) {
+			first.lock.Unlock()
+			return nil, nil
+		}
+		if s.shards.Load() == a {
+			return rm, next
+		}
+		// The store began or concluded a migration in the meantime.
+		unlockRecordMaps(rm, next)
+	}
+}
+
+func unlockRecordMaps(rm, next *recordMap) {
+	if next != nil {
+		next.lock.Unlock()
+	}
+	rm.lock.Unlock()
+}
+
+// addRecordTo stores the given record for the given key in the maps acquired by
+// lockRecordMapsFor.
+func (s *ShardedStore) addRecordTo(rm, next *recordMap, k Key, record *versionedRecord) {
+	h := s.keyCardinalityHash(k)
+	rm.addRecord(k, record, h)
+	if next != nil {
+		next.addRecord(k, record, h)
+	}
+}
+
+// Resharding migrates the store's records to the shards to which the given projection function
+// assigns their keys, replacing the projection established by WithKeyShardProjection, such as to
+// correct a skewed distribution of keys across the shards. Other callers may continue to read and
+// write records while the migration proceeds, visiting one shard at a time to copy its records to
+// their new shards. Until the migration concludes, the store looks up each record in its old
+// shard, while also keeping it in its new shard. Having copied all the records, the store switches
+// to the new projection and, once any scans that began beforehand have concluded, removes the
+// records from their old shards.
+//
+// The same constraints apply to the given projection as for WithKeyShardProjection. Only one
+// migration may proceed at a time; Resharding returns ErrReshardingInProgress if another is
+// already underway. If the given Context is done before Resharding has copied all the records, it
+// abandons the migration, retaining the previous projection, and returns the Context's error.
+func (s *ShardedStore) Resharding(ctx context.Context, p KeyShardProjection) error {
+	if p == nil {
+		return errors.New("key shard projection must be non-nil")
+	}
+	if !s.resharding.CompareAndSwap(false, true) {
+		return ErrReshardingInProgress
+	}
+	defer s.resharding.Store(false)
+	previous := s.shards.Load()
+	migrating := &shardAssignment{
+		projection: previous.projection,
+		next:       p,
+	}
+	s.shards.Store(migrating)
+	err := s.copyRecordsToNextShards(ctx, migrating)
+	settled := p
+	if err != nil {
+		settled = previous.projection
+	}
+	settling := &shardAssignment{
+		projection: settled,
+		settling:   true,
+	}
+	s.shards.Store(settling)
+	// Scans that began before now may still visit records in the shards from which they're about
+	// to disappear.
+	s.awaitScans(previous)
+	s.awaitScans(migrating)
+	s.removeMisplacedRecords(settling)
+	s.shards.Store(&shardAssignment{projection: settled})
+	return err
+}
+
+// awaitScans waits until no scans rely on the given shard assignment, polling by the store's clock.
+func (s *ShardedStore) awaitScans(a *shardAssignment) {
+	// TODO(seh): Consider having the last such scan signal its conclusion instead of polling.
+	for a.scans.Load() > 0 {
+		elapsed, _ := s.after(time.Millisecond)
+		<-elapsed
+	}
+}
+
+// copyRecordsToNextShards copies the records in each shard to the shard to which the given
+// assignment's next projection assigns them, if different.
+func (s *ShardedStore) copyRecordsToNextShards(ctx context.Context, a *shardAssignment) error {
+	for i := range s.recordMaps {
+		rm := &s.recordMaps[i]
+		if !rm.lock.TryRLockUntil(ctx) {
+			return ctx.Err()
+		}
+		moving := make(map[int][]keyedRecord)
+		for k, record := range rm.recordsByKey {
+			if j, ok := a.nextShardFor(Key(k), i); ok {
+				moving[j] = append(moving[j], keyedRecord{Key(k), record})
+			}
+		}
+		rm.lock.RUnlock()
+		// Any records added to this shard since now are also in their next shards already.
+		shards := make([]int, 0, len(moving))
+		for j := range moving {
+			shards = append(shards, j)
+		}
+		sort.Ints(shards)
+		for _, j := range shards {
+			next := &s.recordMaps[j]
+			if !next.lock.TryLockUntil(ctx) {
+				return ctx.Err()
+			}
+			for _, kr := range moving[j] {
+				if _, ok := next.recordsByKey[string(kr.key)]; !ok {
+					next.addRecord(kr.key, kr.record, s.keyCardinalityHash(kr.key))
+				}
+			}
+			next.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+// removeMisplacedRecords removes from each shard the records that the given assignment places in
+// other shards, and rebuilds the shard's key cardinality sketch from the records that remain.
+// Like transaction finalization, it waits indefinitely to acquire each shard's lock, so as not to
+// leave records in shards in which they don't belong.
+func (s *ShardedStore) removeMisplacedRecords(a *shardAssignment) {
+	for i := range s.recordMaps {
+		rm := &s.recordMaps[i]
+		rm.lock.Lock()
+		var sketch keyCardinalitySketch
+		for k := range rm.recordsByKey {
+			if a.shardFor(Key(k)) != i {
+				delete(rm.recordsByKey, k)
+				continue
+			}
+			sketch.add(s.keyCardinalityHash(Key(k)))
+		}
+		rm.keyCardinality = sketch
+		rm.lock.Unlock()
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ringNode is a virtual node on a ConsistentHashRing, owning the key hashes after the preceding
+// node's position up to and including its own.
+type ringNode struct {
+	position uint64
+	shard    int
+}
+
+// A ConsistentHashRing assigns keys to shards by consistent hashing. It places a number of virtual
+// nodes for each shard at pseudorandom positions on a ring of 64-bit hash values, and assigns each
+// key to the shard owning the first virtual node at or after the key's hash, wrapping around past
+// the greatest position. Changing the number of shards then moves only the keys falling between
+// the virtual nodes added or removed and their predecessors, about 1/n of the keys for n shards,
+// which keeps ShardedStore.Resharding from copying more records than necessary.
+//
+// Unlike the store's default projection, the ring hashes keys the same way in every process, so
+// that separate processes can agree on which shard owns a given key, such as when splitting the
+// shards across processes.
+type ConsistentHashRing struct {
+	nodes  []ringNode
+	shards int
+}
+
+// NewConsistentHashRing creates a ConsistentHashRing that distributes keys among the given
+// positive number of shards—the first that many of the store's shards—placing the given positive
+// number of virtual nodes on the ring for each shard. More virtual nodes yield a more even
+// distribution of keys, at the cost of more memory and slightly slower lookups.
+func NewConsistentHashRing(shards, virtualNodes int) (*ConsistentHashRing, error) {
+	if shards < 1 || shards > shardDegree {
+		return nil, fmt.Errorf("number of shards must be between 1 and %d", shardDegree)
+	}
+	if virtualNodes < 1 {
+		return nil, errors.New("number of virtual nodes per shard must be positive")
+	}
+	r := ConsistentHashRing{
+		nodes:  make([]ringNode, 0, shards*virtualNodes),
+		shards: shards,
+	}
+	var label [16]byte
+	for shard := range shards {
+		binary.BigEndian.PutUint64(label[:], uint64(shard))
+		for i := range virtualNodes {
+			binary.BigEndian.PutUint64(label[8:], uint64(i))
+			r.nodes = append(r.nodes, ringNode{
+				position: ringHash(label[:]),
+				shard:    shard,
+			})
+		}
+	}
+	sort.Slice(r.nodes, func(i, j int) bool {
+		a, b := r.nodes[i], r.nodes[j]
+		if a.position != b.position {
+			return a.position < b.position
+		}
+		return a.shard < b.shard
+	})
+	return &r, nil
+}
+
+// ringHash computes the 64-bit FNV-1a hash of the given bytes, mixing the result so that similar
+// inputs land far apart on the ring.
+func ringHash(b []byte) uint64 {
+	const (
+		offsetBasis = 14695981039346656037
+		prime       = 1099511628211
+	)
+	h := uint64(offsetBasis)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= prime
+	}
+	// Apply the finalizer from SplitMix64.
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// KeyHash returns the position on the ring of the given key.
+func (r *ConsistentHashRing) KeyHash(k Key) uint64 {
+	return ringHash(k)
+}
+
+// Project returns the shard to which the ring assigns the given key. It satisfies the
+// KeyShardProjection type, for use with WithKeyShardProjection and ShardedStore.Resharding.
+func (r *ConsistentHashRing) Project(k Key) uint64 {
+	h := ringHash(k)
+	i := sort.Search(len(r.nodes), func(i int) bool {
+		return r.nodes[i].position >= h
+	})
+	if i == len(r.nodes) {
+		i = 0
+	}
+	return uint64(r.nodes[i].shard)
+}
+
+// HashRange is an inclusive range of key hashes on a ConsistentHashRing.
+type HashRange struct {
+	First uint64
+	Last  uint64
+}
+
+// ShardOwnership describes the portion of the space of key hashes that a ConsistentHashRing
+// assigns to a shard.
+type ShardOwnership struct {
+	Shard int
+	// Ranges are the disjoint ranges of key hashes that the ring assigns to the shard, in
+	// ascending order.
+	Ranges []HashRange
+	// Share is the fraction of the space of key hashes that the ring assigns to the shard.
+	Share float64
+}
+
+// Ownership describes the ranges of key hashes that the ring assigns to each of its shards,
+// ordered by shard.
+func (r *ConsistentHashRing) Ownership() []ShardOwnership {
+	owners := make([]ShardOwnership, r.shards)
+	for i := range owners {
+		owners[i].Shard = i
+	}
+	claim := func(shard int, first, last uint64) {
+		o := &owners[shard]
+		if n := len(o.Ranges); n > 0 && o.Ranges[n-1].Last+1 == first {
+			// Coalesce with the adjacent preceding range.
+			o.Ranges[n-1].Last = last
+		} else {
+			o.Ranges = append(o.Ranges, HashRange{first, last})
+		}
+		o.Share += (float64(last-first) + 1) / math.Exp2(64)
+	}
+	last := r.nodes[len(r.nodes)-1]
+	// The first node also owns the hashes beyond the last node, wrapping around to zero.
+	claim(r.nodes[0].shard, 0, r.nodes[0].position)
+	for i := 1; i < len(r.nodes); i++ {
+		if prev, node := r.nodes[i-1], r.nodes[i]; node.position > prev.position {
+			claim(node.shard, prev.position+1, node.position)
+		}
+	}
+	if last.position < math.MaxUint64 {
+		claim(r.nodes[0].shard, last.position+1, math.MaxUint64)
+	}
+	return owners
+}
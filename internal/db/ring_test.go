@@ -0,0 +1,76 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestConsistentHashRing(t *testing.T) {
+	if _, err := NewConsistentHashRing(0, 10); err == nil {
+		t.Error("want error creating ring with no shards")
+	}
+	if _, err := NewConsistentHashRing(shardDegree+1, 10); err == nil {
+		t.Error("want error creating ring with more shards than the store has")
+	}
+	if _, err := NewConsistentHashRing(8, 0); err == nil {
+		t.Error("want error creating ring with no virtual nodes")
+	}
+	const shards = 8
+	ring, err := NewConsistentHashRing(shards, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := ring.Ownership()
+	if len(owners) != shards {
+		t.Fatalf("want ownership for %d shards, got %d", shards, len(owners))
+	}
+	var total float64
+	for _, o := range owners {
+		if o.Share < 0.5/shards || o.Share > 2.0/shards {
+			t.Errorf("shard %d: want share near %v, got %v", o.Shard, 1.0/shards, o.Share)
+		}
+		total += o.Share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("want shares summing to one, got %v", total)
+	}
+	owns := func(o ShardOwnership, h uint64) bool {
+		for _, r := range o.Ranges {
+			if r.First <= h && h <= r.Last {
+				return true
+			}
+		}
+		return false
+	}
+	const keys = 10_000
+	for i := range keys {
+		k := Key(fmt.Sprintf("key-%d", i))
+		shard := ring.Project(k)
+		if shard >= shards {
+			t.Fatalf("key %q: want shard below %d, got %d", k, shards, shard)
+		}
+		if !owns(owners[shard], ring.KeyHash(k)) {
+			t.Fatalf("key %q: shard %d doesn't own its hash", k, shard)
+		}
+	}
+
+	// Adding a shard moves only the keys that the new shard takes over.
+	grown, err := NewConsistentHashRing(shards+1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moved int
+	for i := range keys {
+		k := Key(fmt.Sprintf("key-%d", i))
+		if before, after := ring.Project(k), grown.Project(k); before != after {
+			if after != shards {
+				t.Fatalf("key %q: moved from shard %d to existing shard %d", k, before, after)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > keys/4 {
+		t.Errorf("want about %d keys moved, got %d", keys/(shards+1), moved)
+	}
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"iter"
+)
+
+type keyedRecord struct {
+	key    Key
+	record *versionedRecord
+}
+
+// recordsWithPrefix collects the records in the given shard with keys starting with the given
+// prefix, holding the shard's lock only long enough to copy the matching entries. Unless the
+// prefix is itself reserved, it omits the records with reserved keys. While the store is migrating
+// records between shards, it also omits the records that the given assignment places in other
+// shards.
+func (s *ShardedStore) recordsWithPrefix(ctx context.Context, shard int, a *shardAssignment, prefix Key) ([]keyedRecord, error) {
+	includeReserved := isReservedKey(prefix)
+	rm := &s.recordMaps[shard]
+	if !rm.lock.TryRLockUntil(ctx) {
+		return nil, ctx.Err()
+	}
+	mixed := s.shards.Load().mixed()
+	var records []keyedRecord
+	for k, record := range rm.recordsByKey {
+		if bytes.HasPrefix([]byte(k), prefix) && (includeReserved || !isReservedKey(Key(k))) &&
+			(!mixed || a.shardFor(Key(k)) == shard) {
+			records = append(records, keyedRecord{Key(k), record})
+		}
+	}
+	rm.lock.RUnlock()
+	return records, nil
+}
+
+// forEachVisibleRecord calls the given function for each record with a key starting with the given
+// prefix that exists from this transaction's perspective, supplying the visible version of the
+// record. It visits the shards one at a time, and visits records in no particular order.
+//
+// If the function returns a non-nil error, forEachVisibleRecord stops and returns that error.
+func (t *shardedStoreTransaction) forEachVisibleRecord(ctx context.Context, prefix Key, f func(Key, *recordVersion) error) error {
+	a := t.store.pinShardAssignment()
+	defer a.scans.Add(-1)
+	for i := range t.store.recordMaps {
+		records, err := t.store.recordsWithPrefix(ctx, i, a, prefix)
+		if err != nil {
+			return err
+		}
+		for _, kr := range records {
+			if r := t.visibleVersionOf(kr.key, kr.record); r != nil {
+				if err := f(kr.key, r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// withinSnapshot calls the given function with a new transaction that observes the database as
+// it is now, for use only in reading records, concluding the transaction afterward.
+func (s *ShardedStore) withinSnapshot(ctx context.Context, f func(context.Context, *shardedStoreTransaction) error) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+	tx := shardedStoreTransaction{
+		store:   s,
+		id:      s.beginObserving(noSuchTransaction),
+		started: s.clock.Now(),
+	}
+	defer s.txState.recordFinished(tx.id)
+	defer s.endObserving(tx.id)
+	return f(ctx, &tx)
+}
+
+// ForEach calls the given function for each record in the database, observing all the records as
+// of a single point in time, as if within a transaction that makes no changes. It visits the
+// shards one at a time, and visits records in no particular order, without blocking writers for
+// the whole pass.
+//
+// The function must not retain or modify the supplied Key or Value beyond the call. If the
+// function returns a non-nil error, ForEach stops and returns that error.
+func (s *ShardedStore) ForEach(ctx context.Context, f func(Key, Value) error) error {
+	if f == nil {
+		return errors.New("record-consuming function must be non-nil")
+	}
+	return s.withinSnapshot(ctx, func(ctx context.Context, tx *shardedStoreTransaction) error {
+		return tx.forEachVisibleRecord(ctx, nil, func(k Key, r *recordVersion) error {
+			v, err := s.openValue(k, r.value)
+			if err != nil {
+				return err
+			}
+			return f(k, v)
+		})
+	})
+}
+
+// deferError notes an error that precludes committing this transaction, retaining only the first
+// such error.
+func (t *shardedStoreTransaction) deferError(err error) {
+	if t.deferredErr == nil {
+		t.deferredErr = err
+	}
+}
+
+// errStopScan signals that the consumer of a sequence stopped consuming records early.
+var errStopScan = errors.New("scan stopped")
+
+func (t *shardedStoreTransaction) Scan(ctx context.Context, prefix Key) iter.Seq2[Key, Value] {
+	return func(yield func(Key, Value) bool) {
+		err := t.forEachVisibleRecord(ctx, prefix, func(k Key, r *recordVersion) error {
+			v, err := t.store.openValue(k, r.value)
+			if err != nil {
+				return err
+			}
+			if !yield(k, v) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			t.deferError(err)
+		}
+	}
+}
+
+func (t *shardedStoreTransaction) DeleteWhere(ctx context.Context, prefix Key, f func(Key, Value) bool) (int, error) {
+	if f == nil {
+		return 0, errors.New("record-matching function must be non-nil")
+	}
+	if err := t.aborted(); err != nil {
+		return 0, err
+	}
+	a := t.store.pinShardAssignment()
+	defer a.scans.Add(-1)
+	var deleted int
+	var matches []Key
+	for i := range t.store.recordMaps {
+		records, err := t.store.recordsWithPrefix(ctx, i, a, prefix)
+		if err != nil {
+			return deleted, err
+		}
+		matches = matches[:0]
+		for _, kr := range records {
+			r := t.visibleVersionOf(kr.key, kr.record)
+			if r == nil {
+				continue
+			}
+			v, err := t.store.openValue(kr.key, r.value)
+			if err != nil {
+				return deleted, err
+			}
+			if f(kr.key, v) {
+				matches = append(matches, kr.key)
+			}
+		}
+		// Delete the shard's matching records together once done examining them, before
+		// collecting the next shard's records.
+		for _, k := range matches {
+			ok, err := t.Delete(ctx, k)
+			if err != nil {
+				return deleted, err
+			}
+			if ok {
+				deleted++
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// HistoricalVersion is a committed version of a record, as yielded by Transaction.Versions.
+type HistoricalVersion struct {
+	// Value is the record's value as of this version.
+	Value Value
+	// ValidAsOf is the ID of the transaction that committed this version (see
+	// Transaction.GetVersioned).
+	ValidAsOf uint64
+	// ValidBefore is the ID of the transaction that superseded this version, whether by replacing
+	// or deleting the record, or zero if the version remained current as of the observing
+	// transaction.
+	ValidBefore uint64
+}
+
+func (t *shardedStoreTransaction) History(ctx context.Context, k Key) iter.Seq2[uint64, Value] {
+	return func(yield func(uint64, Value) bool) {
+		for v := range t.Versions(ctx, k) {
+			if !yield(v.ValidAsOf, v.Value) {
+				return
+			}
+		}
+	}
+}
+
+func (t *shardedStoreTransaction) Versions(ctx context.Context, k Key) iter.Seq[HistoricalVersion] {
+	return func(yield func(HistoricalVersion) bool) {
+		rm, record, ok := t.recordFor(ctx, k)
+		if rm == nil {
+			t.deferError(ctx.Err())
+			return
+		}
+		if !ok {
+			return
+		}
+		for r := record.newest.Load(); r != nil; r = r.next.Load() {
+			validAsOf := r.validAsOfTransactionID()
+			if validAsOf == noSuchTransaction || validAsOf > t.id {
+				continue
+			}
+			validBefore := r.validBeforeTransactionID()
+			if validBefore != noSuchTransaction && validBefore <= validAsOf {
+				// This version marks a deletion.
+				continue
+			}
+			if validBefore > t.id {
+				validBefore = noSuchTransaction
+			}
+			v, err := t.store.openValue(k, r.value)
+			if err != nil {
+				t.deferError(err)
+				return
+			}
+			if !yield(HistoricalVersion{Value: v, ValidAsOf: uint64(validAsOf), ValidBefore: uint64(validBefore)}) {
+				return
+			}
+		}
+	}
+}
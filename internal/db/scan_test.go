@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListChildren(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for _, k := range []string{"a", "a/b", "a/b/c", "a/d", "e/f"} {
+			if err := tx.Insert(ctx, Key(k), Value("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []KeyPathEntry
+	}{
+		{"", []KeyPathEntry{{Key("a"), true, true}, {Key("e"), false, true}}},
+		{"a", []KeyPathEntry{{Key("a/b"), true, true}, {Key("a/d"), true, false}}},
+		{"a/", []KeyPathEntry{{Key("a/b"), true, true}, {Key("a/d"), true, false}}},
+		{"a/b/c", []KeyPathEntry{}},
+	}
+	for _, test := range tests {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			entries, err := tx.ListChildren(ctx, Key(test.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := len(test.want), len(entries); want != got {
+				t.Fatalf("path %q: child count: want %d, got %d", test.path, want, got)
+			}
+			for i, want := range test.want {
+				got := entries[i]
+				if string(want.Key) != string(got.Key) || want.IsRecord != got.IsRecord || want.HasChildren != got.HasChildren {
+					t.Errorf("path %q: child %d: want %+v, got %+v", test.path, i, want, got)
+				}
+			}
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListChildrenAfter(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for _, k := range []string{"p/e", "p/a/x", "p/c", "p/b", "p/d/y", "p/d", "p/a/z", "q"} {
+			if err := tx.Insert(ctx, Key(k), Value("v")); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		after string
+		limit int
+		want  []KeyPathEntry
+	}{
+		{"", 2, []KeyPathEntry{{Key("p/a"), false, true}, {Key("p/b"), true, false}}},
+		{"p/b", 2, []KeyPathEntry{{Key("p/c"), true, false}, {Key("p/d"), true, true}}},
+		{"p/c", 0, []KeyPathEntry{{Key("p/d"), true, true}, {Key("p/e"), true, false}}},
+		{"p/d", 5, []KeyPathEntry{{Key("p/e"), true, false}}},
+		{"p/e", 1, []KeyPathEntry{}},
+	}
+	for _, test := range tests {
+		var after Key
+		if len(test.after) > 0 {
+			after = Key(test.after)
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			entries, err := tx.ListChildrenAfter(ctx, Key("p"), after, test.limit)
+			if err != nil {
+				return false, err
+			}
+			if !slices.EqualFunc(entries, test.want, func(a, b KeyPathEntry) bool {
+				return string(a.Key) == string(b.Key) && a.IsRecord == b.IsRecord && a.HasChildren == b.HasChildren
+			}) {
+				t.Errorf("after %q, limit %d: want %+v, got %+v", test.after, test.limit, test.want, entries)
+			}
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for k, v := range want {
+			if err := tx.Insert(ctx, Key(k), Value(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := tx.Delete(ctx, Key("c")); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "c")
+	got := make(map[string]string)
+	if err := store.ForEach(ctx, func(k Key, v Value) error {
+		got[string(k)] = string(v)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != len(got) {
+		t.Fatalf("records: want %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("record %q: want %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for _, k := range []string{"a/1", "a/2", "a/3", "b/1"} {
+			if err := tx.Insert(ctx, Key(k), Value("v"+k)); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		got := make(map[string]string)
+		for k, v := range tx.Scan(ctx, Key("a/")) {
+			got[string(k)] = string(v)
+		}
+		if want, got := 3, len(got); want != got {
+			t.Errorf("scanned records: want %d, got %d", want, got)
+		}
+		if want, got := "va/2", got["a/2"]; want != got {
+			t.Errorf("scanned value: want %q, got %q", want, got)
+		}
+		var visited int
+		for range tx.Scan(ctx, nil) {
+			if visited++; visited == 2 {
+				break
+			}
+		}
+		if want, got := 2, visited; want != got {
+			t.Errorf("records visited before stopping: want %d, got %d", want, got)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// A scan interrupted by its Context precludes committing.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for range tx.Scan(canceled, nil) {
+		}
+		return true, tx.Insert(ctx, Key("c/1"), Value("v"))
+	}); err != context.Canceled {
+		t.Fatalf("want context canceled error, got %v", err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("c/1"))
+}
+
+func TestHistory(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, f := range []func(context.Context, Transaction) error{
+		func(ctx context.Context, tx Transaction) error { return tx.Insert(ctx, Key("k"), Value("1")) },
+		func(ctx context.Context, tx Transaction) error { return tx.Update(ctx, Key("k"), Value("2")) },
+		func(ctx context.Context, tx Transaction) error { _, err := tx.Delete(ctx, Key("k")); return err },
+		func(ctx context.Context, tx Transaction) error { return tx.Insert(ctx, Key("k"), Value("3")) },
+	} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, f(ctx, tx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var values []string
+		var lastVersion uint64
+		for version, v := range tx.History(ctx, Key("k")) {
+			if lastVersion != 0 && version >= lastVersion {
+				t.Errorf("version %d does not precede version %d", version, lastVersion)
+			}
+			lastVersion = version
+			values = append(values, string(v))
+		}
+		if want, got := "3,2,1", strings.Join(values, ","); want != got {
+			t.Errorf("history: want %q, got %q", want, got)
+		}
+		versions := slices.Collect(tx.Versions(ctx, Key("k")))
+		if len(versions) != 3 {
+			t.Fatalf("want 3 versions, got %d", len(versions))
+		}
+		if versions[0].ValidBefore != 0 {
+			t.Errorf("want newest version to remain valid, got valid before %d", versions[0].ValidBefore)
+		}
+		// Deleting the record ended the second version's validity before the third version began.
+		if vb := versions[1].ValidBefore; vb <= versions[1].ValidAsOf || vb >= versions[0].ValidAsOf {
+			t.Errorf("want second version to become invalid between %d and %d, got %d", versions[1].ValidAsOf, versions[0].ValidAsOf, vb)
+		}
+		if vb := versions[2].ValidBefore; vb != versions[1].ValidAsOf {
+			t.Errorf("want oldest version to become invalid as of %d, got %d", versions[1].ValidAsOf, vb)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// WithValueSealing establishes a key with which to encrypt record values while the database holds
+// them in memory, decrypting them only while serving a read. The key must be 16, 24, or 32 bytes
+// long, selecting AES-128, AES-192, or AES-256, respectively.
+//
+// Sealing values protects them against exposure through inspection of the process's memory, such
+// as in heap dumps, at the expense of encrypting each proposed value and decrypting each value
+// read.
+func WithValueSealing(key []byte) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("invalid value sealing key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("invalid value sealing key: %w", err)
+		}
+		o.valueSealer = aead
+		return nil
+	}
+}
+
+// sealValueInto stores the given value for the record with the given key into the destination,
+// encrypting it if the store seals its values.
+func (s *ShardedStore) sealValueInto(dst *Value, k Key, v Value) {
+	if i := s.valueInterner; i != nil {
+		// Never write into a buffer that other record versions may share.
+		i.release(*dst)
+		*dst = i.intern(v)
+		return
+	}
+	aead := s.valueSealer
+	if aead == nil {
+		dst.CopyFrom(v)
+		return
+	}
+	nonceSize := aead.NonceSize()
+	sealed := make([]byte, nonceSize, nonceSize+len(v)+aead.Overhead())
+	if _, err := rand.Read(sealed); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce for sealing value: %v", err))
+	}
+	// Bind the sealed value to its record's key, so that it can't be transplanted successfully
+	// into another record.
+	*dst = aead.Seal(sealed, sealed, v, k)
+}
+
+// openValue returns the value stored for the record with the given key, decrypting it if the
+// store seals its values.
+func (s *ShardedStore) openValue(k Key, v Value) (Value, error) {
+	aead := s.valueSealer
+	if aead == nil {
+		return v, nil
+	}
+	nonceSize := aead.NonceSize()
+	if len(v) < nonceSize {
+		return nil, errors.New("sealed value is too short")
+	}
+	opened, err := aead.Open(nil, v[:nonceSize], v[nonceSize:], k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed value for record with key %q: %w", k, err)
+	}
+	return opened, nil
+}
+
+// valuesAreEqual reports whether the two values stored for the record with the given key are
+// equal, comparing their decrypted content if the store seals its values.
+func (s *ShardedStore) valuesAreEqual(k Key, a, b Value) bool {
+	if s.valueSealer == nil {
+		return bytes.Equal(a, b)
+	}
+	openedA, err := s.openValue(k, a)
+	if err != nil {
+		return false
+	}
+	openedB, err := s.openValue(k, b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(openedA, openedB)
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSealedValues(t *testing.T) {
+	store, err := MakeShardedStore(WithValueSealing(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("k1")
+	value := Value("secret")
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, key, value)
+	record := store.recordMapFor(key).recordsByKey[string(key)]
+	if stored := record.newest.Load().value; bytes.Contains(stored, value) {
+		t.Errorf("stored value: want sealed, got %q", stored)
+	}
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+)
+
+// defaultSequenceBatchSize is the number of values that NextSequence reserves at once unless
+// overridden via WithSequenceBatchSize.
+const defaultSequenceBatchSize = 100
+
+// WithSequenceBatchSize establishes the positive number of values that ShardedStore.NextSequence
+// reserves at once for each sequence, committing a transaction only when it exhausts a batch. A
+// larger batch size makes NextSequence cheaper on average, at the expense of skipping more of the
+// reserved values that the store never hands out. The default is 100.
+func WithSequenceBatchSize(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("sequence batch size must be positive")
+		}
+		o.sequenceBatchSize = uint64(n)
+		return nil
+	}
+}
+
+// sequenceBatch holds the values reserved for a sequence that have yet to be handed out, from next
+// up to but not including end.
+type sequenceBatch struct {
+	mu        sync.Mutex
+	next, end uint64
+}
+
+// sequenceTable tracks the reserved batch of values for each sequence.
+type sequenceTable struct {
+	mu     sync.Mutex
+	byName map[string]*sequenceBatch
+}
+
+func (st *sequenceTable) batchFor(name string) *sequenceBatch {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.byName == nil {
+		st.byName = make(map[string]*sequenceBatch)
+	}
+	b, ok := st.byName[name]
+	if !ok {
+		b = &sequenceBatch{}
+		st.byName[name] = b
+	}
+	return b
+}
+
+// sequenceRecordKey returns the reserved key of the record storing the greatest value reserved so
+// far for the named sequence.
+func sequenceRecordKey(name string) Key {
+	return reservedKeyFor(sequenceKeyKind, Key(name), nil)
+}
+
+// NextSequence returns the next value from the named sequence, which starts at one and increases
+// monotonically with each call, never repeating a value. Sequences suit generating unique
+// identifiers.
+//
+// The store reserves values in batches (see WithSequenceBatchSize), recording the greatest
+// reserved value in a transaction so that concurrent callers never receive the same value.
+// Consecutive values are not necessarily contiguous.
+func (s *ShardedStore) NextSequence(ctx context.Context, name string) (uint64, error) {
+	if len(name) == 0 {
+		return 0, errors.New("sequence name must be nonempty")
+	}
+	b := s.sequences.batchFor(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next == b.end {
+		first, err := s.reserveSequenceBatch(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		b.next, b.end = first, first+s.sequenceBatchSize
+	}
+	v := b.next
+	b.next++
+	return v, nil
+}
+
+// reserveSequenceBatch reserves the next batch of values for the named sequence, returning the
+// first value in the batch.
+func (s *ShardedStore) reserveSequenceBatch(ctx context.Context, name string) (uint64, error) {
+	k := sequenceRecordKey(name)
+	var first uint64
+	err := s.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		t := tx.(*shardedStoreTransaction)
+		v, ok, err := t.readReserved(ctx, k)
+		if err != nil {
+			return false, err
+		}
+		var reserved uint64
+		if ok {
+			if len(v) != 8 {
+				return false, errors.New("sequence record is malformed")
+			}
+			reserved = binary.BigEndian.Uint64(v)
+		}
+		// Leave room for the end of the batch, one past its last value.
+		if reserved >= math.MaxUint64-s.sequenceBatchSize {
+			return false, errors.New("sequence is exhausted")
+		}
+		first = reserved + 1
+		return true, t.writeReserved(ctx, k, binary.BigEndian.AppendUint64(nil, reserved+s.sequenceBatchSize))
+	})
+	return first, err
+}
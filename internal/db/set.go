@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// setMemberKey returns the reserved key of the record representing the given member of the set
+// stored under the given key. Representing each member as its own record allows transactions to
+// add and remove distinct members of the same set without conflicting.
+func setMemberKey(k Key, member Value) Key {
+	return reservedKeyFor(setMemberKeyKind, k, member)
+}
+
+// checkSetWrite returns an error if this transaction may not change the membership of the set with
+// the given key, where the member's record has the given key.
+func (t *shardedStoreTransaction) checkSetWrite(k, memberKey Key) error {
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		// Locking the set's key for update excludes other transactions from changing its
+		// membership.
+		err = t.checkRecordLock(k)
+	}
+	if err == nil {
+		err = t.checkPendingWriteLimit(memberKey)
+	}
+	return err
+}
+
+func (t *shardedStoreTransaction) AddToSet(ctx context.Context, k Key, member Value) (bool, error) {
+	memberKey := setMemberKey(k, member)
+	err := t.checkSetWrite(k, memberKey)
+	var added bool
+	if err == nil {
+		err = t.insert(ctx, memberKey, ValueRef{}, nil)
+		if err == nil {
+			added = true
+		} else if errors.Is(err, ErrRecordExists) {
+			err = nil
+		}
+	}
+	t.audit(ctx, AuditAddToSet, k, member, err)
+	return added, err
+}
+
+func (t *shardedStoreTransaction) RemoveFromSet(ctx context.Context, k Key, member Value) (bool, error) {
+	memberKey := setMemberKey(k, member)
+	err := t.checkSetWrite(k, memberKey)
+	var removed bool
+	if err == nil {
+		removed, err = t.delete(ctx, memberKey)
+	}
+	t.audit(ctx, AuditRemoveFromSet, k, member, err)
+	return removed, err
+}
+
+func (t *shardedStoreTransaction) SetContains(ctx context.Context, k Key, member Value) (bool, error) {
+	if err := t.aborted(); err != nil {
+		return false, err
+	}
+	t.reads++
+	memberKey := setMemberKey(k, member)
+	rm, record, ok := t.recordFor(ctx, memberKey)
+	if rm == nil {
+		return false, interruptedError(ctx, k)
+	}
+	return ok && t.visibleVersionOf(memberKey, record) != nil, nil
+}
+
+func (t *shardedStoreTransaction) SetMembers(ctx context.Context, k Key) iter.Seq[Value] {
+	return func(yield func(Value) bool) {
+		prefix := setMemberKey(k, nil)
+		err := t.forEachVisibleRecord(ctx, prefix, func(memberKey Key, _ *recordVersion) error {
+			if !yield(Value(memberKey[len(prefix):])) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			t.deferError(err)
+		}
+	}
+}
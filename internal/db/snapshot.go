@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// errSnapshotClosed is the error returned for attempts to read from a snapshot after closing it.
+var errSnapshotClosed = errors.New("snapshot is closed")
+
+// Snapshot pins the database as it was at a point in time, so that several read-only transactions
+// begun at different times can observe the same records, such as when paginating through a scan
+// across several requests. Until closed, a Snapshot keeps the store from reclaiming the record
+// versions that it observes.
+type Snapshot struct {
+	store  *ShardedStore
+	id     transactionID
+	closed atomic.Bool
+}
+
+// PinSnapshot pins the database as it is now, returning a Snapshot with which to read it that
+// way later. The caller must close the Snapshot once it no longer needs it.
+//
+// TODO(seh): Consider expiring snapshots that callers neglect to close, since they keep the store
+// from consolidating record versions (see WithMaxVersionsPerRecord).
+func (s *ShardedStore) PinSnapshot(ctx context.Context) (*Snapshot, error) {
+	if err := s.failure(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		store: s,
+		id:    s.beginObserving(noSuchTransaction),
+	}, nil
+}
+
+// ID returns the ID of the transaction as of which the snapshot observes the database.
+func (s *Snapshot) ID() uint64 {
+	return uint64(s.id)
+}
+
+// WithinTransaction calls the given function with a new transaction that observes the database as
+// of the snapshot. The transaction may only read records; attempts to write records within it
+// fail with ErrReadOnlyTransaction. The function's Context carries the transaction too (see
+// TransactionFromContext). As with ShardedStore.WithinTransaction, the function may return
+// ErrRollback to conclude the transaction without failing.
+func (s *Snapshot) WithinTransaction(ctx context.Context, f func(context.Context, Transaction) error) error {
+	if f == nil {
+		return errors.New("transaction-consuming function must be non-nil")
+	}
+	if s.closed.Load() {
+		return errSnapshotClosed
+	}
+	if err := s.store.failure(); err != nil {
+		return err
+	}
+	txCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	tx := shardedStoreTransaction{
+		store:    s.store,
+		id:       s.id,
+		started:  s.store.clock.Now(),
+		abort:    cancel,
+		readOnly: true,
+	}
+	tx.journal, _ = TransactionJournalFromContext(ctx)
+	err := f(ContextWithTransaction(txCtx, &tx), &tx)
+	if abortErr := tx.aborted(); abortErr != nil {
+		err = abortErr
+	} else if errors.Is(err, ErrRollback) {
+		return nil
+	}
+	if err == nil {
+		err = tx.deferredErr
+	}
+	return err
+}
+
+// Close unpins the snapshot, allowing the store to reclaim the record versions that only it could
+// still observe. Closing a snapshot more than once has no further effect.
+func (s *Snapshot) Close() error {
+	if s.closed.CompareAndSwap(false, true) {
+		s.store.endObserving(s.id)
+		s.store.txState.recordFinished(s.id)
+	}
+	return nil
+}
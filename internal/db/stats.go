@@ -0,0 +1,181 @@
+package db
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+)
+
+// keyCardinalityPrecision is the number of hash bits used to select a register in each shard's
+// HyperLogLog sketch, yielding 2^keyCardinalityPrecision registers per shard.
+const keyCardinalityPrecision = 8
+
+// keyCardinalitySketch is a HyperLogLog sketch estimating the number of distinct keys added to a
+// shard. Since the shards partition the key space, summing the estimates across all shards
+// estimates the number of distinct keys in the whole store.
+//
+// Callers must hold the owning shard's lock for writing when adding keys, and for reading when
+// estimating the count.
+type keyCardinalitySketch struct {
+	registers [1 << keyCardinalityPrecision]uint8
+}
+
+func (s *keyCardinalitySketch) add(h uint64) {
+	i := h >> (64 - keyCardinalityPrecision)
+	// Guard against counting more leading zeros than there are remaining bits.
+	rest := h<<keyCardinalityPrecision | 1<<(keyCardinalityPrecision-1)
+	if rank := uint8(bits.LeadingZeros64(rest) + 1); rank > s.registers[i] {
+		s.registers[i] = rank
+	}
+}
+
+func (s *keyCardinalitySketch) estimate() float64 {
+	const m = float64(len(s.registers))
+	var sum float64
+	var zeros int
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+func (s *ShardedStore) keyCardinalityHash(k Key) uint64 {
+	return maphash.Bytes(s.keyCardinalitySeed, k)
+}
+
+// StoreStats summarizes the content of a ShardedStore.
+type StoreStats struct {
+	// ApproximateKeyCount estimates the number of distinct keys for which the store holds
+	// records, including records that have since been deleted but not yet reclaimed.
+	ApproximateKeyCount uint64
+	// TransactionAttempts is the distribution of the number of attempts that each committed
+	// transaction needed (see WithMaxTransactionAttempts).
+	TransactionAttempts Histogram
+	// Shards summarizes how the store's records are distributed among its shards.
+	Shards ShardStats
+	// EvictedRecords is the number of records that the store has evicted to stay within its
+	// limits (see WithEviction).
+	EvictedRecords uint64
+	// ConsistencyAnomalies is the number of record versions that ShardedStore.CheckConsistency has
+	// found violating the invariants governing their records' histories, which should remain zero.
+	ConsistencyAnomalies uint64
+	// ConsolidatedVersions is the number of superseded record versions that the store has
+	// discarded to stay within its limit on versions per record (see WithMaxVersionsPerRecord).
+	ConsolidatedVersions uint64
+}
+
+// ShardStats summarizes the records held by a ShardedStore's shards.
+type ShardStats struct {
+	// Records is the number of records held across all shards, including records that have since
+	// been deleted but not yet reclaimed.
+	Records int
+	// MinRecords is the number of records held by the shard with the fewest records.
+	MinRecords int
+	// MaxRecords is the number of records held by the shard with the most records.
+	MaxRecords int
+	// LoadFactor is the ratio of the number of records held to the greatest number held since the
+	// shards' maps were last rebuilt (see CompactShards), approximating how much of the maps'
+	// capacity is in use.
+	LoadFactor float64
+}
+
+// Stats summarizes the store's current content, using approximations where exact answers would
+// be too expensive to compute.
+func (s *ShardedStore) Stats() StoreStats {
+	var keys float64
+	shards := ShardStats{
+		MinRecords: math.MaxInt,
+	}
+	var peakRecords int
+	for i := range s.recordMaps {
+		rm := &s.recordMaps[i]
+		rm.lock.RLock()
+		keys += rm.keyCardinality.estimate()
+		n := len(rm.recordsByKey)
+		peakRecords += rm.peakRecords
+		rm.lock.RUnlock()
+		shards.Records += n
+		shards.MinRecords = min(shards.MinRecords, n)
+		shards.MaxRecords = max(shards.MaxRecords, n)
+	}
+	shards.LoadFactor = 1
+	if peakRecords > 0 {
+		shards.LoadFactor = float64(shards.Records) / float64(peakRecords)
+	}
+	return StoreStats{
+		ApproximateKeyCount:  uint64(math.Round(keys)),
+		TransactionAttempts:  s.transactionAttempts.snapshot(),
+		Shards:               shards,
+		EvictedRecords:       s.evictedRecords(),
+		ConsistencyAnomalies: s.consistencyAnomalies.Load(),
+		ConsolidatedVersions: s.consolidatedVersions.Load(),
+	}
+}
+
+// transactionAttemptBounds are the inclusive upper bounds of the buckets in the histogram of
+// attempts needed per committed transaction, beyond which lies an unbounded bucket.
+var transactionAttemptBounds = [...]uint64{1, 2, 3, 4, 6, 8, 12, 16}
+
+type attemptHistogram struct {
+	counts [len(transactionAttemptBounds) + 1]atomic.Uint64
+	sum    atomic.Uint64
+}
+
+func (h *attemptHistogram) observe(attempts uint64) {
+	i := sort.Search(len(transactionAttemptBounds), func(i int) bool {
+		return attempts <= transactionAttemptBounds[i]
+	})
+	h.counts[i].Add(1)
+	h.sum.Add(attempts)
+}
+
+// HistogramBucket counts the observations no greater than its upper bound.
+type HistogramBucket struct {
+	// UpperBound is the inclusive upper bound of observations counted in this bucket, or
+	// math.MaxUint64 for the final, unbounded bucket.
+	UpperBound uint64
+	// CumulativeCount is the number of observations no greater than UpperBound.
+	CumulativeCount uint64
+}
+
+// Histogram summarizes the distribution of a set of observations.
+type Histogram struct {
+	// Buckets are the cumulative counts of observations, in increasing order of upper bound.
+	Buckets []HistogramBucket
+	// Count is the total number of observations.
+	Count uint64
+	// Sum is the sum of all observations.
+	Sum uint64
+}
+
+func (h *attemptHistogram) snapshot() Histogram {
+	buckets := make([]HistogramBucket, len(h.counts))
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		bound := uint64(math.MaxUint64)
+		if i < len(transactionAttemptBounds) {
+			bound = transactionAttemptBounds[i]
+		}
+		buckets[i] = HistogramBucket{
+			UpperBound:      bound,
+			CumulativeCount: cumulative,
+		}
+	}
+	return Histogram{
+		Buckets: buckets,
+		Count:   cumulative,
+		Sum:     h.sum.Load(),
+	}
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestApproximateKeyCount(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := uint64(0), store.Stats().ApproximateKeyCount; want != got {
+		t.Errorf("approximate key count of empty store: want %d, got %d", want, got)
+	}
+	const n = 20000
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for i := 0; i < n; i++ {
+			if err := tx.Insert(ctx, Key(fmt.Sprintf("k%d", i)), Value("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := store.Stats().ApproximateKeyCount
+	if got < n*95/100 || got > n*105/100 {
+		t.Errorf("approximate key count: want within 5%% of %d, got %d", n, got)
+	}
+}
+
+func TestTransactionAttemptHistogram(t *testing.T) {
+	store, err := MakeShardedStore(WithMaxTransactionAttempts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var attempts int
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		attempts++
+		if attempts < 2 {
+			return false, transactionInConflictError("k1")
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, attempts; want != got {
+		t.Errorf("attempts: want %d, got %d", want, got)
+	}
+	h := store.Stats().TransactionAttempts
+	if want, got := uint64(1), h.Count; want != got {
+		t.Errorf("committed transaction count: want %d, got %d", want, got)
+	}
+	if want, got := uint64(2), h.Sum; want != got {
+		t.Errorf("attempt sum: want %d, got %d", want, got)
+	}
+	if want, got := uint64(0), h.Buckets[0].CumulativeCount; want != got {
+		t.Errorf("transactions needing one attempt: want %d, got %d", want, got)
+	}
+	if want, got := uint64(1), h.Buckets[1].CumulativeCount; want != got {
+		t.Errorf("transactions needing at most two attempts: want %d, got %d", want, got)
+	}
+}
+
+func TestCompactShards(t *testing.T) {
+	store, err := MakeShardedStore(WithKeyShardProjection(func(Key) uint64 {
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Preload(ctx, func(yield func(Key, Value) bool) {
+		for i := 0; i < 10; i++ {
+			if !yield(Key(fmt.Sprintf("k%d", i)), Value("v")) {
+				return
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt, err := store.CompactShards(ctx); err != nil {
+		t.Fatal(err)
+	} else if want, got := 0, rebuilt; want != got {
+		t.Errorf("shards rebuilt while full: want %d, got %d", want, got)
+	}
+	// Simulate reclaiming most of the records.
+	rm := &store.recordMaps[0]
+	for i := 0; i < 8; i++ {
+		delete(rm.recordsByKey, fmt.Sprintf("k%d", i))
+	}
+	stats := store.Stats().Shards
+	if want, got := 2, stats.Records; want != got {
+		t.Errorf("records: want %d, got %d", want, got)
+	}
+	if want, got := 0.2, stats.LoadFactor; want != got {
+		t.Errorf("load factor: want %v, got %v", want, got)
+	}
+	if rebuilt, err := store.CompactShards(ctx); err != nil {
+		t.Fatal(err)
+	} else if want, got := 1, rebuilt; want != got {
+		t.Errorf("shards rebuilt: want %d, got %d", want, got)
+	}
+	if want, got := 1.0, store.Stats().Shards.LoadFactor; want != got {
+		t.Errorf("load factor after compaction: want %v, got %v", want, got)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k9"), Value("v"))
+}
+
+func TestHotConflictKeys(t *testing.T) {
+	store, err := MakeShardedStore(WithConflictTracking(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	conflictOver := func(k Key) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Upsert(ctx, k, Value("a")); err != nil {
+				return false, err
+			}
+			err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				err := tx.Upsert(ctx, k, Value("b"))
+				return err == nil, err
+			})
+			if !errors.Is(err, ErrTransactionInConflict) {
+				t.Fatalf("want conflict error, got %v", err)
+			}
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		conflictOver(Key("hot"))
+	}
+	conflictOver(Key("cold"))
+	hot := store.HotConflictKeys(1)
+	if want, got := 1, len(hot); want != got {
+		t.Fatalf("hot keys: want %d, got %d", want, got)
+	}
+	if want, got := "hot", string(hot[0].Key); want != got {
+		t.Errorf("hottest key: want %q, got %q", want, got)
+	}
+	if want, got := uint64(3), hot[0].Conflicts; want != got {
+		t.Errorf("conflicts: want %d, got %d", want, got)
+	}
+	if want, got := 2, len(store.HotConflictKeys(10)); want != got {
+		t.Errorf("all hot keys: want %d, got %d", want, got)
+	}
+}
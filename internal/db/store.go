@@ -3,9 +3,14 @@ package db
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"hash/maphash"
+	"iter"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // A KeyShardProjection is a projection function from a given database key to an opaque value with
@@ -15,6 +20,39 @@ type KeyShardProjection func(Key) uint64
 type shardedStoreOptions struct {
 	initialRecordMapCapacity int
 	keyShardProjection       KeyShardProjection
+	auditor                  Auditor
+	redactAuditedValues      bool
+	valueSealer              cipher.AEAD
+	internValues             bool
+	keyValidators            []KeyValidator
+	valueValidators          []prefixedValueValidator
+	maxValueSize             int
+	keySeparator             string
+	recordLockPolicy         RecordLockPolicy
+	finalizationWatchdog     *finalizationWatchdog
+	readMissHandler          ReadMissHandler
+	writePropagator          WritePropagator
+	maxTransactionAttempts   int
+	maxPendingWrites         int
+	conflictSampleRate       int
+	valueDecoder             ValueDecoder
+	decodedValueCapacity     int
+	sequenceBatchSize        uint64
+	topicRetention           uint64
+	faults                   *FaultInjection
+	trashRetention           time.Duration
+	writeRate                float64
+	writeBurst               int
+	writeRateLimitPolicy     WriteRateLimitPolicy
+	conflictPolicy           ConflictPolicy
+	maxConflictWait          time.Duration
+	trackRecordAccess        bool
+	evictionLimits           *EvictionLimits
+	maxVersionsPerRecord     int
+	asynchronousFinalization bool
+	cancellationPolicy       CancellationPolicy
+	cancellationGracePeriod  time.Duration
+	clock                    Clock
 }
 
 // ShardedStoreOption is a potential customization of a ShardedStore's behavior.
@@ -32,6 +70,34 @@ func WithInitialRecordMapCapacity(n int) ShardedStoreOption {
 	}
 }
 
+// WithMaxTransactionAttempts establishes the positive number of times that
+// ShardedStore.WithinTransaction will call its transaction-consuming function when it fails due to
+// conflicts with other transactions. The default is one, making no further attempts.
+func WithMaxTransactionAttempts(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("maximum transaction attempts must be positive")
+		}
+		o.maxTransactionAttempts = n
+		return nil
+	}
+}
+
+// WithMaxPendingWritesPerTransaction establishes the positive number of distinct records that a
+// single transaction may insert, update, or delete, so that an excessively large transaction fails
+// fast instead of delaying other transactions while finalizing its changes. Attempts to write
+// more records than this fail with ErrTransactionTooLarge. By default, transactions may write any
+// number of records.
+func WithMaxPendingWritesPerTransaction(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("maximum pending writes per transaction must be positive")
+		}
+		o.maxPendingWrites = n
+		return nil
+	}
+}
+
 // WithKeyShardProjection establishes a projection function from a given database key to an opaque
 // value with which to assign the key to a storage shard.
 //
@@ -48,8 +114,24 @@ func WithKeyShardProjection(p KeyShardProjection) ShardedStoreOption {
 }
 
 type recordMap struct {
-	lock         rwMutex
-	recordsByKey map[string]*versionedRecord
+	lock           rwMutex
+	recordsByKey   map[string]*versionedRecord
+	recordLocks    recordLockTable
+	writeRates     writeRateTable
+	keyCardinality keyCardinalitySketch
+	// peakRecords is the greatest number of entries that recordsByKey has held since it was last
+	// rebuilt, approximating the capacity of its buckets.
+	peakRecords int
+}
+
+// addRecord stores the given record for the given key, whose hash for estimating key cardinality
+// is as given. The caller must hold the write lock.
+func (rm *recordMap) addRecord(k Key, record *versionedRecord, cardinalityHash uint64) {
+	rm.recordsByKey[string(k)] = record
+	rm.keyCardinality.add(cardinalityHash)
+	if n := len(rm.recordsByKey); n > rm.peakRecords {
+		rm.peakRecords = n
+	}
 }
 
 // TODO(seh): Consider accepting this as a parameter, though we then can't fix the array size, and
@@ -59,10 +141,69 @@ const shardDegree = 512
 // ShardedStore is a database that stores records in a set of maps relating each key to a history of
 // versions. All reading and mutation of the database occurs within transactions that allow readers
 // to observe a consistent snapshot while writers propose and commit transactions concurrently.
+//
+// TODO(seh): The store keeps its records only in memory. Once it appends committed transactions to
+// a write-ahead log, split that log into segments, rotating to a new segment once the current one
+// reaches a size limit, and after writing a snapshot of the records, remove the segments that
+// precede it, reporting the space the segments occupy among the store's statistics, so that the
+// log doesn't grow without bound.
+//
+// TODO(seh): Likewise, once the store persists its records, store a CRC-32C checksum with each
+// log entry and snapshot record, verifying them when loading the records, and either failing or
+// skipping corrupt records as configured, and offer an offline integrity check via dbctl.
 type ShardedStore struct {
-	keyShardProjection KeyShardProjection
-	txState            transactionState
-	recordMaps         [shardDegree]recordMap
+	shards                  atomic.Pointer[shardAssignment]
+	resharding              atomic.Bool
+	auditor                 Auditor
+	redactAuditedValues     bool
+	valueSealer             cipher.AEAD
+	valueInterner           *valueInterner
+	keyValidators           []KeyValidator
+	valueValidators         []prefixedValueValidator
+	maxValueSize            int
+	keySeparator            string
+	recordLockPolicy        RecordLockPolicy
+	watchdog                *finalizationWatchdog
+	finalizer               *backgroundFinalizer
+	cancellationPolicy      CancellationPolicy
+	cancellationGracePeriod time.Duration
+	clock                   Clock
+	readMissHandler         ReadMissHandler
+	writePropagator         WritePropagator
+	faults                  *FaultInjection
+	maxTransactionAttempts  int
+	maxPendingWrites        int
+	maxVersionsPerRecord    int
+	versionObservers        versionObservers
+	consolidatedVersions    atomic.Uint64
+	transactionAttempts     attemptHistogram
+	conflicts               *conflictTracker
+	decodedValues           *decodedValueCache
+	procedures              procedureRegistry
+	activeTransactions      activeTransactions
+	leases                  leaseTable
+	trashRetention          time.Duration
+	trash                   trashTable
+	writeRate               float64
+	writeBurst              int
+	writeRateLimitPolicy    WriteRateLimitPolicy
+	conflictPolicy          ConflictPolicy
+	maxConflictWait         time.Duration
+	trackRecordAccess       bool
+	readOnly                atomic.Bool
+	eviction                *evictionTracker
+	namespaceMeters         namespaceMeters
+	consistencyAnomalies    atomic.Uint64
+	preparedTransactions    preparedTransactionTable
+	commitFeed              commitFeed
+	sequences               sequenceTable
+	sequenceBatchSize       uint64
+	topicRetention          uint64
+	failed                  atomic.Pointer[storeFailedError]
+	closed                  atomic.Bool
+	keyCardinalitySeed      maphash.Seed
+	txState                 transactionState
+	recordMaps              [shardDegree]recordMap
 }
 
 // MakeShardedStore creates an empty ShardedStore ready to accept records.
@@ -74,14 +215,67 @@ func MakeShardedStore(opts ...ShardedStoreOption) (*ShardedStore, error) {
 			return maphash.Bytes(seed, k)
 		},
 		initialRecordMapCapacity: 50,
+		keySeparator:             DefaultKeySeparator,
+		maxTransactionAttempts:   1,
+		sequenceBatchSize:        defaultSequenceBatchSize,
+		topicRetention:           defaultTopicRetention,
+		maxConflictWait:          defaultMaxConflictWait,
+		cancellationGracePeriod:  defaultCancellationGracePeriod,
+		clock:                    systemClock{},
 	}
 	for _, o := range opts {
 		if err := o(&options); err != nil {
 			return nil, err
 		}
 	}
+	if options.internValues && options.valueSealer != nil {
+		return nil, errInterningSealedValues
+	}
 	s := ShardedStore{
-		keyShardProjection: options.keyShardProjection,
+		auditor:                 options.auditor,
+		redactAuditedValues:     options.redactAuditedValues,
+		valueSealer:             options.valueSealer,
+		keyValidators:           options.keyValidators,
+		valueValidators:         options.valueValidators,
+		maxValueSize:            options.maxValueSize,
+		keySeparator:            options.keySeparator,
+		recordLockPolicy:        options.recordLockPolicy,
+		watchdog:                options.finalizationWatchdog,
+		clock:                   options.clock,
+		cancellationPolicy:      options.cancellationPolicy,
+		cancellationGracePeriod: options.cancellationGracePeriod,
+		readMissHandler:         options.readMissHandler,
+		writePropagator:         options.writePropagator,
+		faults:                  options.faults,
+		trashRetention:          options.trashRetention,
+		writeRate:               options.writeRate,
+		writeBurst:              options.writeBurst,
+		writeRateLimitPolicy:    options.writeRateLimitPolicy,
+		conflictPolicy:          options.conflictPolicy,
+		maxConflictWait:         options.maxConflictWait,
+		trackRecordAccess:       options.trackRecordAccess,
+		maxTransactionAttempts:  options.maxTransactionAttempts,
+		maxPendingWrites:        options.maxPendingWrites,
+		maxVersionsPerRecord:    options.maxVersionsPerRecord,
+		sequenceBatchSize:       options.sequenceBatchSize,
+		topicRetention:          options.topicRetention,
+		keyCardinalitySeed:      maphash.MakeSeed(),
+	}
+	s.shards.Store(&shardAssignment{projection: options.keyShardProjection})
+	if options.internValues {
+		s.valueInterner = newValueInterner()
+	}
+	if options.evictionLimits != nil {
+		s.eviction = newEvictionTracker(*options.evictionLimits)
+	}
+	if options.asynchronousFinalization {
+		s.finalizer = new(backgroundFinalizer)
+	}
+	if options.conflictSampleRate > 0 {
+		s.conflicts = newConflictTracker(options.conflictSampleRate)
+	}
+	if options.valueDecoder != nil {
+		s.decodedValues = newDecodedValueCache(options.valueDecoder, options.decodedValueCapacity)
 	}
 	for i := range s.recordMaps {
 		s.recordMaps[i].lock = makeLock()
@@ -91,7 +285,78 @@ func MakeShardedStore(opts ...ShardedStoreOption) (*ShardedStore, error) {
 }
 
 func (s *ShardedStore) recordMapFor(k Key) *recordMap {
-	return &s.recordMaps[s.keyShardProjection(k)%shardDegree]
+	return &s.recordMaps[s.shardFor(k)]
+}
+
+func (s *ShardedStore) shardFor(k Key) int {
+	return s.shards.Load().shardFor(k)
+}
+
+// shardKeys is a set of keys that fall into the same shard.
+type shardKeys struct {
+	shard int
+	keys  []Key
+}
+
+// SortKeysByShard sorts the given keys in place such that keys falling into the same storage shard
+// are adjacent, and sorted in ascending order within each shard. Processing keys in this order
+// allows visiting each shard only once, which can reduce contention for the shards' locks when
+// applying many mutations together, such as within a batch.
+func (s *ShardedStore) SortKeysByShard(keys []Key) {
+	s.groupKeysByShard(keys)
+}
+
+// groupKeysByShard sorts the given keys like SortKeysByShard, and returns the groups of adjacent
+// keys falling into each shard.
+func (s *ShardedStore) groupKeysByShard(keys []Key) []shardKeys {
+	if len(keys) == 0 {
+		return nil
+	}
+	shards := make([]int, len(keys))
+	for i, k := range keys {
+		shards[i] = s.shardFor(k)
+	}
+	sort.Sort(keysByShard{keys: keys, shards: shards})
+	var groups []shardKeys
+	start := 0
+	for i := 1; i <= len(keys); i++ {
+		if i == len(keys) || shards[i] != shards[start] {
+			groups = append(groups, shardKeys{shard: shards[start], keys: keys[start:i]})
+			start = i
+		}
+	}
+	return groups
+}
+
+type keysByShard struct {
+	keys   []Key
+	shards []int
+}
+
+func (k keysByShard) Len() int {
+	return len(k.keys)
+}
+
+func (k keysByShard) Less(i, j int) bool {
+	if k.shards[i] != k.shards[j] {
+		return k.shards[i] < k.shards[j]
+	}
+	return bytes.Compare(k.keys[i], k.keys[j]) < 0
+}
+
+func (k keysByShard) Swap(i, j int) {
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+	k.shards[i], k.shards[j] = k.shards[j], k.shards[i]
+}
+
+// pendingWritesByShard returns the keys of the records to which this transaction proposes
+// changes, grouped by shard.
+func (t *shardedStoreTransaction) pendingWritesByShard() []shardKeys {
+	keys := make([]Key, 0, len(t.pendingWrites))
+	for k := range t.pendingWrites {
+		keys = append(keys, Key(k))
+	}
+	return t.store.groupKeysByShard(keys)
 }
 
 // shardedStoreTransaction represents the database starting at a point in time, isolated both from
@@ -100,11 +365,47 @@ type shardedStoreTransaction struct {
 	store         *ShardedStore
 	id            transactionID
 	pendingWrites map[string]struct{} // NB: Initilized lazily
+	audited       bool
+	lockedKeys    []Key
+	started       time.Time
+	reads         int
+	// readOnly indicates that the transaction may only read records, such as one run at a pinned
+	// snapshot or within a read-only store.
+	readOnly bool
+	// pendingWriteCount mirrors the size of pendingWrites for observation by other goroutines.
+	pendingWriteCount atomic.Int32
+	// abort cancels the transaction's Context, for forcibly aborting the transaction.
+	abort context.CancelCauseFunc
+	// doomed holds the error with which the transaction was forcibly aborted, if any, precluding
+	// further operations.
+	doomed atomic.Pointer[error]
+	// lineage describes the attempts to complete the transaction of which this is the latest.
+	lineage *transactionLineage
+	// preemption indicates whether another transaction may forcibly abort this one.
+	preemption atomic.Uint32
+	// preemptedBy describes the transaction that preempted this one, if any.
+	preemptedBy atomic.Pointer[transactionLineage]
+	// awaiting, if not nil, closes once the transaction with which the latest attempt to write a
+	// record conflicted concludes, if the store's conflict policy calls for waiting for it.
+	awaiting <-chan struct{}
+	// concluded closes once the transaction has committed or rolled back its changes.
+	concluded chan struct{}
+	// leaseAttachments relates the keys of records to the IDs of the leases to which to attach
+	// them upon committing.
+	leaseAttachments map[string]uint64
+	// deferredErr is an error that arose where it couldn't be returned to the caller, such as
+	// while yielding records from a sequence, precluding committing the transaction.
+	deferredErr error
+	// journal, if not nil, records the transaction's events for debugging.
+	journal *TransactionJournal
+	// assertions are the conditions on records that must still hold when the transaction commits.
+	assertions []commitAssertion
 }
 
 func (t *shardedStoreTransaction) recordFor(ctx context.Context, k Key) (*recordMap, *versionedRecord, bool) {
-	rm := t.store.recordMapFor(k)
-	if !rm.lock.TryRLockUntil(ctx) {
+	t.store.faults.delay(ctx)
+	rm := t.store.readLockRecordMapFor(ctx, k)
+	if rm == nil {
 		return nil, nil, false
 	}
 	record, ok := rm.recordsByKey[string(k)]
@@ -121,6 +422,17 @@ func (t *shardedStoreTransaction) notePendingWriteAgainst(k Key) {
 		t.pendingWrites = make(map[string]struct{}, 3)
 	}
 	t.pendingWrites[string(k)] = struct{}{}
+	t.pendingWriteCount.Store(int32(len(t.pendingWrites)))
+}
+
+// checkPendingWriteLimit returns an error if writing to the record with the given key would exceed
+// the store's limit on the number of records written per transaction.
+func (t *shardedStoreTransaction) checkPendingWriteLimit(k Key) error {
+	limit := t.store.maxPendingWrites
+	if limit == 0 || len(t.pendingWrites) < limit || t.hasPendingWriteAgainst(k) {
+		return nil
+	}
+	return &transactionTooLargeError{key: string(k), limit: limit}
 }
 
 func (t *shardedStoreTransaction) hasPendingWriteAgainst(k Key) bool {
@@ -128,17 +440,24 @@ func (t *shardedStoreTransaction) hasPendingWriteAgainst(k Key) bool {
 	return ok
 }
 
-func (t *shardedStoreTransaction) Get(ctx context.Context, k Key) (Value, error) {
-	rm, record, ok := t.recordFor(ctx, k)
-	if rm == nil {
-		return nil, ctx.Err()
-	}
-	if !ok {
-		return nil, recordDoesNotExistError(k)
-	}
+// visibleVersionOf returns the version of the given record with the given key that is visible
+// within this transaction, or nil if the record does not exist from this transaction's
+// perspective.
+func (t *shardedStoreTransaction) visibleVersionOf(k Key, record *versionedRecord) *recordVersion {
 	// Record already exists, even if it's only a tombstone.
-walkBackwards:
-	for r := record.newest.Load(); r != nil; r = r.next {
+	r := record.newest.Load()
+	if r != nil && r.validAsOfTransactionID() == noSuchTransaction && !t.hasPendingWriteAgainst(k) {
+		// Skip over the versions that other transactions are proposing, unless a transaction is in
+		// the midst of superseding the newest committed version, in which case its successor may
+		// lie among them.
+		if committed := record.newestCommitted.Load(); committed != nil && committed.validBeforeTransactionID() == noSuchTransaction {
+			r = committed
+		}
+	}
+	for ; r != nil; r = r.next.Load() {
+		if t.journal != nil {
+			t.journalVersionVisited(k, r)
+		}
 		switch validAsOf := r.validAsOfTransactionID(); {
 		case validAsOf == noSuchTransaction:
 			if !t.hasPendingWriteAgainst(k) {
@@ -149,46 +468,114 @@ walkBackwards:
 			switch validBefore := r.validBeforeTransactionID(); {
 			case validBefore == noSuchTransaction:
 				// We're writing a new value, which we'll observe here.
-				return r.value, nil
+				return r
 			case validBefore <= t.id:
 				// We're deleting this record.
-				break walkBackwards
+				return nil
 			}
 		case validAsOf <= t.id:
 			if validBefore := r.validBeforeTransactionID(); validBefore == noSuchTransaction || validBefore > t.id {
-				return r.value, nil
+				return r
 			}
-			break walkBackwards
+			return nil
 		}
 	}
+	return nil
+}
+
+func (t *shardedStoreTransaction) ID() uint64 {
+	return uint64(t.id)
+}
+
+func (t *shardedStoreTransaction) Info() TransactionInfo {
+	return TransactionInfo{
+		ID:            uint64(t.id),
+		Started:       t.started,
+		PendingWrites: len(t.pendingWrites),
+		RecordReads:   t.reads,
+	}
+}
+
+func (t *shardedStoreTransaction) Get(ctx context.Context, k Key) (Value, error) {
+	if err := t.aborted(); err != nil {
+		return nil, err
+	}
+	t.reads++
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return nil, interruptedError(ctx, k)
+	}
+	if !ok {
+		t.journalf(JournalRead, k, noSuchTransaction, "record absent from store")
+		return t.loadOnMiss(ctx, k)
+	}
+	if r := t.visibleVersionOf(k, record); r != nil {
+		t.journalf(JournalRead, k, r.validAsOfTransactionID(), "found visible version")
+		t.store.noteRecordAccess(record, t.id, false)
+		t.store.noteRecordUse(k, r)
+		return t.store.openValue(k, r.value)
+	}
+	t.journalf(JournalRead, k, noSuchTransaction, "no visible version")
 	return nil, recordDoesNotExistError(k)
 }
 
-func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) error {
+func (t *shardedStoreTransaction) GetVersioned(ctx context.Context, k Key) (Value, uint64, error) {
+	if err := t.aborted(); err != nil {
+		return nil, 0, err
+	}
+	t.reads++
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return nil, 0, interruptedError(ctx, k)
+	}
+	if !ok {
+		t.journalf(JournalRead, k, noSuchTransaction, "record absent from store")
+		v, err := t.loadOnMiss(ctx, k)
+		if err != nil {
+			return nil, 0, err
+		}
+		return v, uint64(t.id), nil
+	}
+	if r := t.visibleVersionOf(k, record); r != nil {
+		t.journalf(JournalRead, k, r.validAsOfTransactionID(), "found visible version")
+		t.store.noteRecordAccess(record, t.id, false)
+		t.store.noteRecordUse(k, r)
+		v, err := t.store.openValue(k, r.value)
+		if err != nil {
+			return nil, 0, err
+		}
+		return v, uint64(r.validAsOfTransactionID()), nil
+	}
+	t.journalf(JournalRead, k, noSuchTransaction, "no visible version")
+	return nil, 0, recordDoesNotExistError(k)
+}
+
+func (t *shardedStoreTransaction) insert(ctx context.Context, k Key, v ValueRef, m *Metadata) error {
 	rm, record, ok := t.recordFor(ctx, k)
 	if rm == nil {
-		return ctx.Err()
+		return interruptedError(ctx, k)
 	}
 	useExistingRecord := func(record *versionedRecord) error {
 		tryInsertPlaceholderVersion := func(expectedNewest *recordVersion) error {
-			proposedVersion := recordVersion{
-				next: expectedNewest,
-			}
-			proposedVersion.value.CopyFrom(v)
-			if !record.newest.CompareAndSwap(expectedNewest, &proposedVersion) {
+			proposedVersion := newRecordVersion(expectedNewest)
+			t.store.proposeValue(proposedVersion, k, v)
+			proposedVersion.metadata = m
+			proposedVersion.proposedBy = t.id
+			if !record.newest.CompareAndSwap(expectedNewest, proposedVersion) {
+				t.store.releaseUnpublishedRecordVersion(proposedVersion)
 				// Someone else stored a new version before us.
-				return transactionInConflictError(k)
+				return t.conflict(k, noSuchTransaction, "another transaction proposed a version first")
 			}
 			t.notePendingWriteAgainst(k)
 			return nil
 		}
 		var sawNewerVersion bool
-		for r := record.newest.Load(); r != nil; r = r.next {
+		for r := record.newest.Load(); r != nil; r = r.next.Load() {
 			switch validAsOf := r.validAsOfTransactionID(); {
 			case validAsOf == noSuchTransaction:
 				if !t.hasPendingWriteAgainst(k) {
 					// A different transaction is trying to write to this record.
-					return transactionInConflictError(k)
+					return t.contend(k, r.proposedBy)
 				}
 				switch validBefore := r.validBeforeTransactionID(); {
 				case validBefore == noSuchTransaction:
@@ -196,7 +583,8 @@ func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) er
 					return recordExistsError(k)
 				case validBefore == t.id:
 					// It looks like we deleted this record during this transaction.
-					r.value.CopyFrom(v)
+					t.store.proposeValue(r, k, v)
+					r.metadata = m
 					r.validBeforeTransaction.Store(uint64(noSuchTransaction))
 					return nil
 				default:
@@ -221,7 +609,7 @@ func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) er
 					if sawNewerVersion {
 						// Even though the record didn't exist at this version, we can't proceed
 						// with inserting it because newer versions already exist.
-						return transactionInConflictError(k)
+						return t.conflict(k, validBefore, "a later transaction recreated the deleted record")
 					}
 					return tryInsertPlaceholderVersion(r)
 				default:
@@ -232,7 +620,7 @@ func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) er
 			}
 		}
 		if sawNewerVersion {
-			return transactionInConflictError(k)
+			return t.conflict(k, noSuchTransaction, "a later transaction created the record")
 		}
 		// Try to insert a placeholder record, but only if there are no other versions available now.
 		return tryInsertPlaceholderVersion(nil)
@@ -242,28 +630,31 @@ func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) er
 		return useExistingRecord(record)
 	}
 	// Slow path: record does not exist.
-	if !rm.lock.TryLockUntil(ctx) {
-		return ctx.Err()
+	rm, next := t.store.lockRecordMapsFor(ctx, k)
+	if rm == nil {
+		return interruptedError(ctx, k)
 	}
 	// It's possible that someone else got in and added this record already.
 	if record, ok := rm.recordsByKey[string(k)]; ok {
-		rm.lock.Unlock()
+		unlockRecordMaps(rm, next)
 		return useExistingRecord(record)
 	}
-	var proposedVersion recordVersion
-	proposedVersion.value.CopyFrom(v)
+	proposedVersion := newRecordVersion(nil)
+	t.store.proposeValue(proposedVersion, k, v)
+	proposedVersion.metadata = m
+	proposedVersion.proposedBy = t.id
 	var proposedRecord versionedRecord
-	proposedRecord.newest.Store(&proposedVersion)
-	rm.recordsByKey[string(k)] = &proposedRecord
-	rm.lock.Unlock()
+	proposedRecord.newest.Store(proposedVersion)
+	t.store.addRecordTo(rm, next, k, &proposedRecord)
+	unlockRecordMaps(rm, next)
 	t.notePendingWriteAgainst(k)
 	return nil
 }
 
-func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) error {
+func (t *shardedStoreTransaction) update(ctx context.Context, k Key, v ValueRef, m *Metadata) error {
 	rm, record, ok := t.recordFor(ctx, k)
 	if rm == nil {
-		return ctx.Err()
+		return interruptedError(ctx, k)
 	}
 	if !ok {
 		return recordDoesNotExistError(k)
@@ -276,12 +667,13 @@ func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) er
 	case validAsOf == noSuchTransaction:
 		if !t.hasPendingWriteAgainst(k) {
 			// A different transaction is trying to write to this record.
-			return transactionInConflictError(k)
+			return t.contend(k, r.proposedBy)
 		}
 		switch validBefore := r.validBeforeTransactionID(); {
 		case validBefore == noSuchTransaction:
 			// Update the previously proposed value in place.
-			r.value.CopyFrom(v)
+			t.store.proposeValue(r, k, v)
+			r.metadata = m
 			return nil
 		case validBefore <= t.id:
 			// Someone else already deleted the record by marking it as a tombstone.
@@ -294,14 +686,15 @@ func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) er
 		}
 	case validAsOf <= t.id:
 		proposeUpdate := func() bool {
-			proposedNewest := recordVersion{
-				next: r,
-			}
-			proposedNewest.value.CopyFrom(v)
-			if record.newest.CompareAndSwap(r, &proposedNewest) {
+			proposedNewest := newRecordVersion(r)
+			t.store.proposeValue(proposedNewest, k, v)
+			proposedNewest.metadata = m
+			proposedNewest.proposedBy = t.id
+			if record.newest.CompareAndSwap(r, proposedNewest) {
 				t.notePendingWriteAgainst(k)
 				return true
 			}
+			t.store.releaseUnpublishedRecordVersion(proposedNewest)
 			return false
 		}
 		for {
@@ -311,7 +704,7 @@ func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) er
 					return nil
 				}
 				// Someone else added a newer version.
-				return transactionInConflictError(k)
+				return t.conflict(k, validAsOf, "another transaction proposed a version first")
 			case validBefore <= t.id:
 				// Someone else deleted the record by marking it as a tombstone.
 				return recordDoesNotExistError(k)
@@ -320,27 +713,27 @@ func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) er
 				// that intervening transactions have observed this version being valid and made
 				// decisions based upon that finding, we can't just pull back the validity
 				// horizon here.
-				return transactionInConflictError(k)
+				return t.conflict(k, validBefore, "a later transaction deleted or replaced the visible version")
 			}
 		}
 	default:
 		// NB: We don't walk backward through versions to try to find one that covers our
 		// transaction. If we do, and we find one, we allow an update when subsequent
 		// transactions have changed this record, violating the "snapshot" isolation protocol.
-		return transactionInConflictError(k)
+		return t.conflict(k, validAsOf, "a later transaction committed a newer version")
 	}
 }
 
-func (t *shardedStoreTransaction) Upsert(ctx context.Context, k Key, v Value) error {
+func (t *shardedStoreTransaction) upsert(ctx context.Context, k Key, v ValueRef, m *Metadata) error {
 	// TODO(seh): The proper implementation requires a blend between the Insert and Update
 	// methods. Perhaps try first to update, but if the record does not exist yet, try to insert it.
 	for {
-		err := t.Update(ctx, k, v)
+		err := t.update(ctx, k, v, m)
 		if err == nil {
 			return nil
 		}
 		if errors.Is(err, ErrRecordDoesNotExist) {
-			err = t.Insert(ctx, k, v)
+			err = t.insert(ctx, k, v, m)
 			if err == nil {
 				return nil
 			}
@@ -352,39 +745,39 @@ func (t *shardedStoreTransaction) Upsert(ctx context.Context, k Key, v Value) er
 	}
 }
 
-func (t *shardedStoreTransaction) Delete(ctx context.Context, k Key) (error, bool) {
+func (t *shardedStoreTransaction) delete(ctx context.Context, k Key) (bool, error) {
 	rm, record, ok := t.recordFor(ctx, k)
 	if rm == nil {
-		return ctx.Err(), false
+		return false, interruptedError(ctx, k)
 	}
 	if !ok {
-		return nil, false
+		return false, nil
 	}
 	r := record.newest.Load()
 	if r == nil {
-		return nil, false
+		return false, nil
 	}
 	switch validAsOf := r.validAsOfTransactionID(); {
 	case validAsOf == noSuchTransaction:
 		if !t.hasPendingWriteAgainst(k) {
 			// A different transaction is trying to write to this record.
-			return transactionInConflictError(k), false
+			return false, t.contend(k, r.proposedBy)
 		}
 		for {
 			switch validBefore := r.validBeforeTransactionID(); {
 			case validBefore == noSuchTransaction:
 				if r.validBeforeTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(t.id)) {
-					return nil, true
+					return true, nil
 				}
 				// Someone else changed the validity horizon. We'll try again.
 			case validBefore <= t.id:
 				// Someone else already deleted the record by marking it as a tombstone.
-				return nil, false
+				return false, nil
 			default:
 				// For some reason, the pending record version would be valid for ours and maybe
 				// even for later transactions, even though our transaction is supposedly
 				// working on this record. Preclude further interference by giving up.
-				return fmt.Errorf("transaction with ID %d found pending record version for %q with later validity period ending with transaction %d", t.id, k, validBefore), false
+				return false, fmt.Errorf("transaction with ID %d found pending record version for %q with later validity period ending with transaction %d", t.id, k, validBefore)
 			}
 		}
 	case validAsOf <= t.id:
@@ -396,32 +789,140 @@ func (t *shardedStoreTransaction) Delete(ctx context.Context, k Key) (error, boo
 				// reading this record to observe this deletion yet. Insert a placeholder
 				// version here instead that we'll resolve later when committing.
 				proposedNewest := recordVersion{
-					value: r.value,
-					next:  r,
+					proposedBy: t.id,
 				}
+				proposedNewest.next.Store(r)
 				proposedNewest.validBeforeTransaction.Store(uint64(t.id))
 				if record.newest.CompareAndSwap(r, &proposedNewest) {
 					t.notePendingWriteAgainst(k)
-					return nil, true
+					return true, nil
 				}
 				// Someone else added a newer version.
-				return transactionInConflictError(k), false
+				return false, t.conflict(k, validAsOf, "another transaction proposed a version first")
 			case validBefore <= t.id:
 				// Someone else already deleted the record by marking it as a tombstone.
-				return nil, false
+				return false, nil
 			default:
 				// A later transaction deleted or invalidated this version. Since it's possible
 				// that intervening transactions have observed this version being valid and made
 				// decisions based upon that finding, we can't just pull back the validity
 				// horizon here.
-				return transactionInConflictError(k), false
+				return false, t.conflict(k, validBefore, "a later transaction deleted or replaced the visible version")
 			}
 		}
 	default:
 		// A later transaction changed this record, but we should not inspect the record's state
 		// further here.
-		return transactionInConflictError(k), false
+		return false, t.conflict(k, validAsOf, "a later transaction committed a newer version")
+	}
+}
+
+func (t *shardedStoreTransaction) Insert(ctx context.Context, k Key, v Value) error {
+	return t.InsertWithMetadata(ctx, k, v, Metadata{})
+}
+
+func (t *shardedStoreTransaction) InsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return t.insertWithMetadata(ctx, k, borrowValueRef(v), m)
+}
+
+func (t *shardedStoreTransaction) insertWithMetadata(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		err = t.store.validateValue(k, v.v)
+	}
+	if err == nil {
+		err = t.guardedWrite(ctx, k, func() error {
+			return t.insert(ctx, k, v, m.stored())
+		})
+	}
+	t.audit(ctx, AuditInsert, k, v.v, err)
+	return err
+}
+
+func (t *shardedStoreTransaction) Update(ctx context.Context, k Key, v Value) error {
+	return t.UpdateWithMetadata(ctx, k, v, Metadata{})
+}
+
+func (t *shardedStoreTransaction) UpdateWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return t.updateWithMetadata(ctx, k, borrowValueRef(v), m)
+}
+
+func (t *shardedStoreTransaction) updateWithMetadata(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		err = t.store.validateValue(k, v.v)
+	}
+	if err == nil {
+		err = t.guardedWrite(ctx, k, func() error {
+			return t.update(ctx, k, v, m.stored())
+		})
 	}
+	t.audit(ctx, AuditUpdate, k, v.v, err)
+	return err
+}
+
+func (t *shardedStoreTransaction) Upsert(ctx context.Context, k Key, v Value) error {
+	return t.UpsertWithMetadata(ctx, k, v, Metadata{})
+}
+
+func (t *shardedStoreTransaction) UpsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error {
+	return t.upsertWithMetadata(ctx, k, borrowValueRef(v), m)
+}
+
+func (t *shardedStoreTransaction) upsertWithMetadata(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	err := t.aborted()
+	if err == nil {
+		err = t.store.validateKey(k)
+	}
+	if err == nil {
+		err = t.store.validateValue(k, v.v)
+	}
+	if err == nil {
+		err = t.guardedWrite(ctx, k, func() error {
+			return t.upsert(ctx, k, v, m.stored())
+		})
+	}
+	t.audit(ctx, AuditUpsert, k, v.v, err)
+	return err
+}
+
+func (t *shardedStoreTransaction) Delete(ctx context.Context, k Key) (bool, error) {
+	err := t.aborted()
+	var deleted bool
+	if err == nil {
+		err = t.guardedWrite(ctx, k, func() error {
+			var err error
+			deleted, err = t.delete(ctx, k)
+			return err
+		})
+	}
+	t.audit(ctx, AuditDelete, k, nil, err)
+	return deleted, err
+}
+
+// guardedWrite calls the given function to write the record with the given key once the record's
+// write rate, the transaction's limit on pending writes, and any lock on the record allow it,
+// calling the function again as the store's conflict policy directs.
+func (t *shardedStoreTransaction) guardedWrite(ctx context.Context, k Key, write func() error) error {
+	err := t.checkWriteRate(ctx, k)
+	if err == nil {
+		err = t.checkPendingWriteLimit(k)
+	}
+	if err == nil {
+		err = t.resolvingConflicts(ctx, func() error {
+			if err := t.checkRecordLock(k); err != nil {
+				return err
+			}
+			return write()
+		})
+	}
+	return err
 }
 
 // Transaction allows observing and mutating the database tentatively, such that it's possible to
@@ -433,119 +934,596 @@ type Transaction interface {
 	// If the database does not contain a record with the given key. Get returns
 	// ErrRecordDoesNotExist.
 	Get(ctx context.Context, k Key) (Value, error)
+	// GetVersioned is like Get, but also reports the version of the record it retrieves: the ID
+	// of the transaction that committed that version, or zero if this transaction proposed the
+	// record's current value.
+	GetVersioned(ctx context.Context, k Key) (Value, uint64, error)
+	// GetRecord is like GetVersioned, but also retrieves the metadata stored along with the
+	// record's value (see InsertWithMetadata).
+	GetRecord(ctx context.Context, k Key) (Record, error)
+	// GetDecoded is like Get, but returns the representation of the record's value derived by the
+	// store's ValueDecoder, reusing the representation derived previously for the same committed
+	// version of the record if the store's cache still retains it (see WithDecodedValueCache).
+	//
+	// If the store lacks a ValueDecoder, GetDecoded returns an error.
+	GetDecoded(ctx context.Context, k Key) (any, error)
+	// GetValueRef is like GetVersioned, but returns an immutable reference to the record's value
+	// that remains valid beyond the transaction. It shares the buffer of a committed value rather
+	// than copying it, copying only a value that this transaction proposed.
+	GetValueRef(ctx context.Context, k Key) (ValueRef, uint64, error)
 	// Insert adds a new record to the database for the given key, storing the given value.
 	//
 	// If the database already contains a record for the given key, Insert returns ErrRecordExists.
+	// If the key fails validation, Insert returns ErrInvalidKey, and if the value fails validation,
+	// it returns ErrInvalidValue.
 	Insert(ctx context.Context, k Key, v Value) error
 	// Update modifies an existing record in the database with the given key to store the given
 	// value.
 	//
 	// If the database does not contain a record with the given key. Update returns
-	// ErrRecordDoesNotExist.
+	// ErrRecordDoesNotExist. If the key fails validation, Update returns ErrInvalidKey, and if the
+	// value fails validation, it returns ErrInvalidValue.
 	Update(ctx context.Context, k Key, v Value) error
+	// UpdateIfUnchangedSince is like Update, but only modifies the record if no transaction
+	// committed a change to it—whether by inserting, updating, or deleting it—after the
+	// transaction with the given ID, such as the version that a caller observed earlier via a
+	// replica or cache (see GetVersioned). It thus lets such a caller write back a value that it
+	// derived from the one it observed without overwriting intervening changes.
+	//
+	// If the record changed since then, UpdateIfUnchangedSince returns ErrTransactionInConflict.
+	UpdateIfUnchangedSince(ctx context.Context, k Key, v Value, since uint64) error
 	// Upsert ensures that a record exists in the database for the given key storing the given
 	// value.
 	//
 	// If no record for the given key already exists, Upsert behaves like Insert. Conversely, if a
-	// record for the given key already exists, Upsert behaves like Update.
+	// record for the given key already exists, Upsert behaves like Update. If the key fails
+	// validation, Upsert returns ErrInvalidKey, and if the value fails validation, it returns
+	// ErrInvalidValue.
 	Upsert(ctx context.Context, k Key, v Value) error
+	// InsertWithMetadata is like Insert, but stores the given metadata along with the value. The
+	// Insert, Update, and Upsert methods store values without metadata.
+	InsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error
+	// UpdateWithMetadata is like Update, but stores the given metadata along with the value,
+	// replacing any metadata stored with the record's previous value.
+	UpdateWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error
+	// UpsertWithMetadata is like Upsert, but stores the given metadata along with the value,
+	// replacing any metadata stored with the record's previous value.
+	UpsertWithMetadata(ctx context.Context, k Key, v Value, m Metadata) error
+	// InsertValueRef is like InsertWithMetadata, but stores the referenced value without copying
+	// it, sharing its buffer with readers, unless the store seals or interns its values (see
+	// WithValueSealing and WithValueInterning).
+	InsertValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error
+	// UpdateValueRef is like UpdateWithMetadata, but stores the referenced value without copying
+	// it, as with InsertValueRef.
+	UpdateValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error
+	// UpsertValueRef is like UpsertWithMetadata, but stores the referenced value without copying
+	// it, as with InsertValueRef.
+	UpsertValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error
 	// Delete ensures that no record exists in the database for the given key, removing an existing
 	// record if need be.
 	//
 	// Delete returns true if it removed an existing record, or false if either no such record
 	// existed or an error arose.
-	Delete(ctx context.Context, k Key) (error, bool)
+	Delete(ctx context.Context, k Key) (bool, error)
+	// Undelete restores the record with the given key that a committed transaction deleted, if
+	// the record remains in the store's trash (see WithTrashRetention), inserting the value and
+	// metadata that the record held before its deletion.
+	//
+	// If the record is not in the trash, whether because the store doesn't retain deleted
+	// records, the record was never deleted, or the retention period has since elapsed, Undelete
+	// returns ErrRecordNotInTrash. If the record was deleted after this transaction began,
+	// Undelete returns ErrTransactionInConflict.
+	Undelete(ctx context.Context, k Key) error
+	// AddToSet ensures that the set stored under the given key contains the given member,
+	// creating the set if need be. Each member of a set is stored separately, so that
+	// transactions adding or removing distinct members of the same set don't conflict with each
+	// other. Sets occupy a key space apart from that of ordinary records, such that a set and an
+	// ordinary record may share a key.
+	//
+	// AddToSet returns true if it added the member, or false if either the set already contained
+	// the member or an error arose. If the key fails validation, AddToSet returns ErrInvalidKey.
+	AddToSet(ctx context.Context, k Key, member Value) (bool, error)
+	// RemoveFromSet ensures that the set stored under the given key does not contain the given
+	// member.
+	//
+	// RemoveFromSet returns true if it removed the member, or false if either the set did not
+	// contain the member or an error arose.
+	RemoveFromSet(ctx context.Context, k Key, member Value) (bool, error)
+	// SetContains reports whether the set stored under the given key contains the given member.
+	SetContains(ctx context.Context, k Key, member Value) (bool, error)
+	// SetMembers yields the members of the set stored under the given key, in no particular
+	// order. The caller must not retain or modify the yielded Value beyond each iteration. As
+	// with Scan, errors that arise while visiting the members preclude committing the
+	// transaction.
+	SetMembers(ctx context.Context, k Key) iter.Seq[Value]
+	// PushLeft adds the given element to the beginning of the list stored under the given key,
+	// creating the list if need be. Lists store their elements in chunks, so that pushing or
+	// popping an element rewrites only the chunk at that end of the list rather than the whole
+	// list. Like sets, lists occupy their own key space (see AddToSet).
+	//
+	// Since each push or pop changes the list's bounds, transactions changing the same list
+	// conflict with each other. If the key fails validation, PushLeft returns ErrInvalidKey.
+	PushLeft(ctx context.Context, k Key, v Value) error
+	// PushRight adds the given element to the end of the list stored under the given key, like
+	// PushLeft.
+	PushRight(ctx context.Context, k Key, v Value) error
+	// PopLeft removes and returns the first element of the list stored under the given key.
+	//
+	// If the list is empty, PopLeft returns ErrRecordDoesNotExist.
+	PopLeft(ctx context.Context, k Key) (Value, error)
+	// PopRight removes and returns the last element of the list stored under the given key, like
+	// PopLeft.
+	PopRight(ctx context.Context, k Key) (Value, error)
+	// ListLength returns the number of elements in the list stored under the given key, which is
+	// zero if no such list exists.
+	ListLength(ctx context.Context, k Key) (int, error)
+	// AppendToOutbox appends the given event to the named outbox, returning the entry's sequence
+	// number, so that the event becomes available to consumers (see ShardedStore.ReadOutbox) if
+	// and only if this transaction commits along with the rest of its changes. This lets
+	// applications publish events reliably about the changes they make, without a separate
+	// message broker that could disagree with the database about what happened. Outboxes occupy
+	// their own key space (see AddToSet), and come into being upon their first entry.
+	//
+	// Since each append advances the outbox's sequence, transactions appending to the same outbox
+	// conflict with each other, which ensures that consumers observe the entries in the order in
+	// which their transactions committed, with no gaps.
+	AppendToOutbox(ctx context.Context, outbox string, event Value) (uint64, error)
+	// ListChildren retrieves the immediate children of the given path within the key hierarchy,
+	// treating keys as paths with segments delimited by the store's key separator (see
+	// WithKeySeparator), sorted by key. An empty path denotes the root of the hierarchy.
+	ListChildren(ctx context.Context, path Key) ([]KeyPathEntry, error)
+	// ListChildrenAfter is like ListChildren, but retrieves only the children with keys that sort
+	// after the given key, if not nil, and at most the given number of them, or all of them if the
+	// limit is zero, such as to resume a paginated listing where its previous page ended. Since
+	// the store keeps no ordered index of keys, it still visits every record beneath the path, but
+	// retains only the children that it returns.
+	ListChildrenAfter(ctx context.Context, path, after Key, limit int) ([]KeyPathEntry, error)
+	// CreateNamespace creates a namespace with the given nonempty name, within which to keep
+	// records apart from ordinary records and those of other namespaces (see Namespace).
+	//
+	// If such a namespace exists already, CreateNamespace returns ErrNamespaceExists.
+	CreateNamespace(ctx context.Context, name string) error
+	// DeleteNamespace deletes the namespace with the given name along with all its records,
+	// returning the number of records deleted.
+	//
+	// If no such namespace exists, DeleteNamespace returns ErrNamespaceNotFound.
+	DeleteNamespace(ctx context.Context, name string) (int, error)
+	// Namespaces yields the names of the namespaces that exist from this transaction's
+	// perspective, in no particular order. As with Scan, errors that arise while visiting the
+	// namespaces preclude committing the transaction.
+	Namespaces(ctx context.Context) iter.Seq[string]
+	// Namespace returns a view of the records within the namespace with the given name, through
+	// which to read and write them as part of this transaction.
+	//
+	// If no such namespace exists, Namespace returns ErrNamespaceNotFound.
+	Namespace(ctx context.Context, name string) (*NamespaceTransaction, error)
+	// WithinNested calls the given function with a nested transaction that shares this
+	// transaction's view of the database, retaining the changes proposed within the nested
+	// transaction if the function returns true, or discarding only those changes otherwise. This
+	// allows attempting speculative work without abandoning the changes this transaction proposed
+	// earlier. Record locks acquired within the nested transaction (see LockForUpdate) remain held
+	// until this transaction concludes either way.
+	//
+	// WithinNested returns the error returned by the given function.
+	WithinNested(ctx context.Context, f func(context.Context, Transaction) (commit bool, err error)) error
+	// Scan yields each record with a key starting with the given prefix that exists from this
+	// transaction's perspective, in no particular order, visiting the shards one at a time. It
+	// holds no locks while the caller consumes each record, so the caller may stop consuming
+	// records early at no cost to other transactions. The caller must not retain or modify the
+	// yielded Key or Value beyond each iteration.
+	//
+	// If an error arises during the scan, such as the governing Context being done, Scan stops
+	// yielding records, and the transaction can no longer commit: the enclosing WithinTransaction
+	// call rolls back the transaction and returns that error.
+	Scan(ctx context.Context, prefix Key) iter.Seq2[Key, Value]
+	// DeleteWhere deletes each record with a key starting with the given prefix that exists from
+	// this transaction's perspective and for which the given function returns true, returning the
+	// number of records deleted. Like Scan, it visits the shards one at a time, deleting each
+	// shard's matching records together before moving on to the next shard. The function must not
+	// retain or modify the supplied Key or Value beyond the call.
+	//
+	// If deleting a record fails, such as due to a conflict with another transaction, DeleteWhere
+	// stops and returns that error along with the number of records deleted so far.
+	DeleteWhere(ctx context.Context, prefix Key, f func(Key, Value) bool) (int, error)
+	// History yields the committed versions of the record with the given key that took effect no
+	// later than this transaction began, from newest to oldest, along with the ID of the
+	// transaction that committed each version (see GetVersioned). It skips versions that mark the
+	// record's deletion. As with Scan, errors that arise while walking the history preclude
+	// committing the transaction.
+	History(ctx context.Context, k Key) iter.Seq2[uint64, Value]
+	// Versions yields the same versions as History, along with the period for which each version
+	// was valid: from the ID of the transaction that committed it until the ID of the transaction
+	// that superseded it, if any, no later than this transaction began.
+	Versions(ctx context.Context, k Key) iter.Seq[HistoricalVersion]
+	// LockForUpdate acquires an exclusive intent to write to the record with the given key,
+	// whether or not such a record exists yet, holding it until the transaction concludes. While
+	// this transaction holds the lock, attempts by other transactions to write to the record fail
+	// with ErrTransactionInConflict.
+	//
+	// If another transaction holds the lock already, LockForUpdate either waits for it to be
+	// released or fails with ErrTransactionInConflict, per the store's RecordLockPolicy. Even
+	// after acquiring the lock, if another transaction committed a change to the record after
+	// this transaction began, LockForUpdate fails with ErrTransactionInConflict, since this
+	// transaction could not write to the record anyway; callers should then try again in a new
+	// transaction.
+	LockForUpdate(ctx context.Context, k Key) error
+	// AssertAbsent requires that no record with the given key exist when this transaction
+	// commits, much as if it had read the record and found it absent, without demanding that no
+	// other transaction write the record in the meantime. It fails with ErrAssertionFailed if the
+	// record existed when this transaction began. When the transaction is about to commit, it
+	// checks the assertion again against the latest committed state, acquiring the record's lock
+	// (see LockForUpdate) to preclude other transactions from writing the record until it
+	// commits; if the assertion no longer holds, the transaction fails with ErrAssertionFailed
+	// rather than committing, or with ErrTransactionInConflict if another transaction is still
+	// writing the record.
+	AssertAbsent(ctx context.Context, k Key) error
+	// AssertValue requires that the record with the given key exist with the given value when this
+	// transaction commits, checking the assertion both now and at commit time like AssertAbsent.
+	AssertValue(ctx context.Context, k Key, v Value) error
+	// AssertVersion requires that the record with the given key exist with the given version (see
+	// GetVersioned) when this transaction commits, checking the assertion both now and at commit
+	// time like AssertAbsent. Unlike AssertValue, it fails if another transaction rewrote the
+	// record in the meantime, even if it restored the value that the record had.
+	AssertVersion(ctx context.Context, k Key, version uint64) error
+	// AttachToLease attaches the record with the given key to the lease with the given ID (see
+	// ShardedStore.GrantLease) once this transaction commits, such that the store deletes the
+	// record when the lease expires or is revoked. A record remains attached to a lease until the
+	// lease ends or the record is attached to another lease, even if the record is deleted and
+	// written again in the meantime.
+	//
+	// If no such lease exists, either now or when the transaction is about to commit,
+	// AttachToLease returns ErrLeaseNotFound.
+	AttachToLease(ctx context.Context, k Key, leaseID uint64) error
+	// ID returns the transaction's identifier, which is also the version that its committed
+	// changes will bear (see GetVersioned). Later transactions have greater IDs.
+	ID() uint64
+	// Info reports the transaction's progress so far, so that callers can log and bound the size
+	// of their transactions.
+	Info() TransactionInfo
+}
+
+// TransactionInfo describes a transaction's progress.
+type TransactionInfo struct {
+	// ID is the transaction's identifier.
+	ID uint64
+	// Started is when the transaction began.
+	Started time.Time
+	// PendingWrites is the number of distinct records that the transaction proposes to insert,
+	// update, or delete.
+	PendingWrites int
+	// RecordReads is the number of times the transaction retrieved a record via Get or
+	// GetVersioned, including repeated retrievals of the same record.
+	RecordReads int
 }
 
 var _ Transaction = (*shardedStoreTransaction)(nil)
 
+// SetReadOnly establishes whether the store refuses to write records. While the store is read-only,
+// every transaction that begins may only read records, as if run at a pinned snapshot, and
+// ShardedStore.Preload fails, such that the store suits serving as a replica, or preserving the
+// database's state during a maintenance window or forensic investigation. Transactions already
+// underway when the store becomes read-only remain free to write records.
+func (s *ShardedStore) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// Close closes the store, such that later attempts to use it, such as by beginning transactions or
+// pinning snapshots, fail with ErrStoreClosed, and then waits for the store to conclude committing
+// every transaction that committed changes before now (see ShardedStore.WaitForFinalize), or for
+// the given Context to be done, in which case it returns the Context's error. Transactions already
+// underway remain free to complete. Closing a store more than once has no further effect.
+func (s *ShardedStore) Close(ctx context.Context) error {
+	s.closed.Store(true)
+	return s.WaitForFinalize(ctx)
+}
+
+// ReadOnly reports whether the store refuses to write records (see ShardedStore.SetReadOnly).
+func (s *ShardedStore) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// LatestCommittedTransaction returns the greatest ID of any transaction that committed changes to
+// the store, or zero if no transaction has done so yet. Transactions that run concurrently may
+// commit in a different order than their IDs, so a transaction with a lower ID may still commit
+// changes later, though every transaction that begins afterward bears a greater ID.
+func (s *ShardedStore) LatestCommittedTransaction() uint64 {
+	return s.txState.latestCommittedID.Load()
+}
+
+// WaitForCommittedTransaction blocks until a transaction with at least the given ID has committed
+// changes to the store, or the given Context is done, in which case it returns the Context's
+// error. Once replicas exist, this will allow a follower to delay serving a read until it has
+// applied the changes that a client already observed elsewhere.
+func (s *ShardedStore) WaitForCommittedTransaction(ctx context.Context, id uint64) error {
+	return s.txState.awaitCommitted(ctx, transactionID(id))
+}
+
+// WithinTransaction calls the given function with a new transaction, committing the changes
+// proposed within that transaction if the function returns true, or rolling them back otherwise.
+// The function's Context carries the transaction too (see TransactionFromContext). If the function
+// returns ErrRollback, WithinTransaction rolls back the changes and returns nil.
+//
+// If the store allows more than one attempt per transaction (see WithMaxTransactionAttempts) and
+// the function declines to commit, returning an error that indicates a conflict with another
+// transaction (ErrTransactionInConflict), WithinTransaction calls the function again with another
+// new transaction, until either it no longer encounters such a conflict, it exhausts the allowed
+// attempts, or the given Context is done.
 func (s *ShardedStore) WithinTransaction(ctx context.Context, f func(context.Context, Transaction) (commit bool, err error)) error {
 	if f == nil {
 		return errors.New("transaction-consuming function must be non-nil")
 	}
+	lineage := transactionLineage{
+		done: make(chan struct{}),
+	}
+	defer close(lineage.done)
+	if priority, ok := TransactionPriorityFromContext(ctx); ok {
+		lineage.priority = priority
+	}
+	for attempt := 1; ; attempt++ {
+		committed, err := s.attemptTransaction(ctx, f, &lineage)
+		if errors.Is(err, ErrRollback) {
+			return nil
+		}
+		s.noteConflict(err)
+		if committed {
+			if err == nil {
+				s.transactionAttempts.observe(uint64(attempt))
+			}
+			return err
+		}
+		if attempt >= s.maxTransactionAttempts || !errors.Is(err, ErrTransactionInConflict) || ctx.Err() != nil {
+			return err
+		}
+		if yieldTo := lineage.yieldTo; yieldTo != nil {
+			// Let the transaction that this attempt preempted roll back its changes first, or
+			// let the transaction that preempted this attempt finish.
+			lineage.yieldTo = nil
+			select {
+			case <-yieldTo:
+			case <-ctx.Done():
+				return err
+			}
+		}
+	}
+}
+
+// attemptTransaction calls the given function with a new transaction, committing or rolling back
+// its proposed changes, and reporting whether it committed them. The given lineage describes the
+// earlier attempts to complete the same transaction, if any.
+func (s *ShardedStore) attemptTransaction(ctx context.Context, f func(context.Context, Transaction) (commit bool, err error), lineage *transactionLineage) (bool, error) {
+	if err := s.failure(); err != nil {
+		return false, err
+	}
+	txCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 	tx := shardedStoreTransaction{
-		store: s,
-		id:    s.txState.claimNext(),
+		store:     s,
+		id:        s.beginObserving(lineage.conflictedWith),
+		started:   s.clock.Now(),
+		abort:     cancel,
+		lineage:   lineage,
+		concluded: make(chan struct{}),
+		readOnly:  s.readOnly.Load(),
+	}
+	if lineage.seniority == noSuchTransaction {
+		lineage.seniority = tx.id
+	}
+	if j, ok := TransactionJournalFromContext(ctx); ok {
+		tx.journal = j
+		tx.journalf(JournalAttemptBegan, nil, noSuchTransaction, "priority %d, seniority %d", lineage.priority, lineage.seniority)
 	}
 	defer s.txState.recordFinished(tx.id)
+	defer s.endObserving(tx.id)
+	s.activeTransactions.add(&tx)
+	defer s.activeTransactions.remove(tx.id)
+	defer close(tx.concluded)
+	defer tx.releaseRecordLocks()
 	// TODO(seh): Consider recovering from panics here and rolling back the transaction.
-	commit, err := f(ctx, &tx)
+	commit, err := f(ContextWithTransaction(txCtx, &tx), &tx)
+	if errors.Is(err, ErrRollback) {
+		commit = false
+	}
+	if abortErr := tx.aborted(); abortErr != nil {
+		commit = false
+		err = abortErr
+		if p := tx.preemptedBy.Load(); p != nil {
+			lineage.yieldTo = p.done
+		}
+	}
+	if tx.deferredErr != nil {
+		commit = false
+		if err == nil {
+			err = tx.deferredErr
+		}
+	}
+	if commit && s.faults.abortsCommit() {
+		commit = false
+		if err == nil {
+			err = transactionAbortedError(tx.id)
+		}
+	}
+	commitCtx, committing := ctx, commit
+	if committing {
+		var cancelCommit context.CancelFunc
+		commitCtx, cancelCommit = s.commitContext(ctx)
+		defer cancelCommit()
+		if cerr := tx.cancellation(commitCtx, ctx); cerr != nil {
+			commit = false
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+	if commit {
+		if aerr := tx.checkAssertions(commitCtx); aerr != nil {
+			commit = false
+			if err == nil {
+				err = aerr
+			}
+		}
+	}
+	if commit {
+		if lerr := tx.attachLeases(); lerr != nil {
+			commit = false
+			if err == nil {
+				err = lerr
+			}
+		}
+	}
+	if commit {
+		if perr := tx.propagateWrites(commitCtx); perr != nil {
+			commit = false
+			if err == nil {
+				err = perr
+			}
+		}
+	}
+	if committing {
+		if cerr := tx.cancellation(commitCtx, ctx); cerr != nil && (commit || errors.Is(err, commitCtx.Err())) {
+			// Either the steps preceding finalization succeeded, or they failed only because the
+			// Context was done.
+			commit = false
+			err = cerr
+		}
+	}
+	if tx.audited {
+		op := AuditAbort
+		if commit {
+			op = AuditCommit
+		}
+		defer tx.audit(ctx, op, nil, nil, err)
+	}
 	// In order to avoid leaving the database in an inconsistent state, we don't want to give up
-	// this effort due to the governing Context having been canceled.
-	ctxFinalize := context.Background()
+	// this effort due to the governing Context having been canceled, regardless of the store's
+	// cancellation policy.
 	if commit {
-	pendingWrites:
-		for key := range tx.pendingWrites {
-			_, record, ok := tx.recordFor(ctxFinalize, Key(key))
-			if !ok {
-				continue
+		var written []*versionedRecord
+		// If finalizing asynchronously, we leave the tombstones marking records that we deleted
+		// in place until then.
+		var tombstones map[*versionedRecord]*recordVersion
+		for _, group := range tx.pendingWritesByShard() {
+			records := tx.recordsForFinalizing(group)
+			if s.maxVersionsPerRecord > 0 {
+				written = append(written, records...)
 			}
-		inspectNewest:
-			for newest := record.newest.Load(); newest != nil &&
-				newest.validAsOfTransactionID() == noSuchTransaction; newest = record.newest.Load() {
-				if prev := newest.next; prev != nil {
-					type proposedMutation uint8
-					const (
-						insertRecord proposedMutation = iota
-						updateRecord
-						deleteRecord
-					)
-					proposal := deleteRecord
-					if newest.validBeforeTransactionID() == noSuchTransaction {
-						if prev.validBeforeTransactionID() == noSuchTransaction {
-							proposal = updateRecord
-						} else {
-							proposal = insertRecord
-						}
-					}
-					switch proposal {
-					case insertRecord:
-						// We won't touch the preceding record version, which must have represented
-						// deletion.
-					case updateRecord:
-						// Avoid creating a new record version for a would-be update that doesn't
-						// change the record's value.
-						if bytes.Equal(newest.value, prev.value) {
-							if record.newest.CompareAndSwap(newest, prev) {
-								continue pendingWrites
+		pendingWrites:
+			for i, key := range group.keys {
+				record := records[i]
+				if record == nil {
+					continue
+				}
+				s.noteRecordAccess(record, tx.id, true)
+			inspectNewest:
+				for newest := record.newest.Load(); newest != nil &&
+					newest.validAsOfTransactionID() == noSuchTransaction; newest = record.newest.Load() {
+					if prev := newest.next.Load(); prev != nil {
+						type proposedMutation uint8
+						const (
+							insertRecord proposedMutation = iota
+							updateRecord
+							deleteRecord
+						)
+						proposal := deleteRecord
+						if newest.validBeforeTransactionID() == noSuchTransaction {
+							if prev.validBeforeTransactionID() == noSuchTransaction {
+								proposal = updateRecord
 							} else {
-								continue inspectNewest
+								proposal = insertRecord
 							}
-						} else if !prev.validBeforeTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) {
-							continue inspectNewest
 						}
-					case deleteRecord:
-						// If the newest pending record version has its "before transaction" value set
-						// indicating deletion, and the preceding committed record version does not have
-						// that value set, attempt to collapse the pending record version into the
-						// previous record version by copying down the "before transaction value".
-						if prev.validBeforeTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) &&
-							record.newest.CompareAndSwap(newest, prev) {
-							continue pendingWrites
+						switch proposal {
+						case insertRecord:
+							// We won't touch the preceding record version, which must have represented
+							// deletion.
+						case updateRecord:
+							// Avoid creating a new record version for a would-be update that doesn't
+							// change the record's value.
+							if tx.store.valuesAreEqual(key, newest.value, prev.value) && metadataAreEqual(newest.metadata, prev.metadata) {
+								if record.newest.CompareAndSwap(newest, prev) {
+									s.discardValue(&newest.value)
+									continue pendingWrites
+								} else {
+									continue inspectNewest
+								}
+							} else if !prev.validBeforeTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) {
+								continue inspectNewest
+							}
+						case deleteRecord:
+							// If the newest pending record version has its "before transaction" value set
+							// indicating deletion, and the preceding committed record version does not have
+							// that value set, attempt to collapse the pending record version into the
+							// previous record version by copying down the "before transaction value".
+							if prev.validBeforeTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) {
+								if s.finalizer != nil {
+									if tombstones == nil {
+										tombstones = make(map[*versionedRecord]*recordVersion)
+									}
+									tombstones[record] = newest
+								} else if record.newest.CompareAndSwap(newest, prev) {
+									s.discardValue(&newest.value)
+									continue pendingWrites
+								}
+							}
 						}
 					}
-				}
-				if newest.validAsOfTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) {
-					break
+					if newest.validAsOfTransaction.CompareAndSwap(uint64(noSuchTransaction), uint64(tx.id)) {
+						record.noteCommitted(newest)
+						break
+					}
 				}
 			}
 		}
-	} else {
-		for key := range tx.pendingWrites {
-			_, record, ok := tx.recordFor(ctxFinalize, Key(key))
-			if !ok {
-				continue
+		tx.invalidateDecodedValues()
+		if f := s.finalizer; f != nil && len(tx.pendingWrites) > 0 {
+			s.txState.recordCommitted(tx.id)
+			f.enqueue(func() {
+				tx.concludeCommit(tombstones, written)
+			})
+		} else {
+			if s.trashRetention > 0 {
+				tx.noteTrashedRecords()
+			}
+			if len(tx.pendingWrites) > 0 {
+				s.txState.recordCommitted(tx.id)
+				s.consolidateWrittenVersions(written)
+				s.commitFeed.publish(tx.id, tx.committedKeys)
+				tx.noteCommittedUses()
+				s.evictExcessRecords()
 			}
-			for newest := record.newest.Load(); newest != nil && newest.validAsOfTransactionID() == noSuchTransaction; newest = record.newest.Load() {
-				// No other writers should be contending with us here, but defend against the
-				// possibility until we're more sure that this won't occur.
-				if record.newest.CompareAndSwap(newest, newest.next) {
-					break
+		}
+	} else {
+		for _, group := range tx.pendingWritesByShard() {
+			for _, record := range tx.recordsForFinalizing(group) {
+				if record == nil {
+					continue
+				}
+				for newest := record.newest.Load(); newest != nil && newest.validAsOfTransactionID() == noSuchTransaction; newest = record.newest.Load() {
+					// No other writers should be contending with us here, but defend against the
+					// possibility until we're more sure that this won't occur.
+					if record.newest.CompareAndSwap(newest, newest.next.Load()) {
+						s.discardValue(&newest.value)
+						break
+					}
 				}
 			}
 		}
 	}
-	return err
+	if err == nil {
+		// If finalizing this transaction's changes had to be abandoned, report the failure. Closing
+		// the store in the meantime doesn't undo having committed them, though.
+		if failed := s.failed.Load(); failed != nil {
+			err = failed
+		}
+	}
+	switch {
+	case commit:
+		tx.journalf(JournalAttemptConcluded, nil, noSuchTransaction, "committed")
+	case err != nil:
+		tx.journalf(JournalAttemptConcluded, nil, noSuchTransaction, "rolled back: %v", err)
+	default:
+		tx.journalf(JournalAttemptConcluded, nil, noSuchTransaction, "rolled back as requested")
+	}
+	return commit, err
 }
 
 // TODO(seh): Implement "vacuum" garbage collector procedure, running either periodically or upon
@@ -4,7 +4,14 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func confirmRecordIsAbsent(ctx context.Context, t *testing.T, store *ShardedStore, key Key) {
@@ -146,7 +153,7 @@ func TestInsertDeleteInsertGetAbortGet(t *testing.T) {
 		if err := tx.Insert(ctx, key, value); err != nil {
 			t.Fatal(err)
 		}
-		err, deleted := tx.Delete(ctx, key)
+		deleted, err := tx.Delete(ctx, key)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -241,3 +248,3481 @@ func TestInsertUpdateGetUpdateGetAbortGet(t *testing.T) {
 	// Now confirm that the changes were not committed, and are not visible to subsequent transactions.
 	confirmRecordIsAbsent(ctx, t, store, key)
 }
+
+func TestInsertInvalidKey(t *testing.T) {
+	store, err := MakeShardedStore(
+		WithKeyValidator(KeyMustBeUTF8),
+		WithKeyValidator(KeyMaxDepth("/", 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("a/b/c"), Value("v1")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("inserting too deep a key: want ErrInvalidKey, got %v", err)
+		}
+		if err := tx.Insert(ctx, Key("\xff"), Value("v1")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("inserting non-UTF-8 key: want ErrInvalidKey, got %v", err)
+		}
+		if err := tx.Insert(ctx, Key("a/b"), Value("v1")); err != nil {
+			t.Error(err)
+		}
+		return false, nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteInvalidValue(t *testing.T) {
+	store, err := MakeShardedStore(WithValueValidator(Key("json/"), ValueMustBeJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("json/a"), Value("{")); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("inserting malformed JSON: want ErrInvalidValue, got %v", err)
+		}
+		if err := tx.Upsert(ctx, Key("json/a"), Value(`{"a": 1}`)); err != nil {
+			t.Error(err)
+		}
+		if err := tx.Update(ctx, Key("json/a"), Value("not JSON")); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("updating with malformed JSON: want ErrInvalidValue, got %v", err)
+		}
+		if err := tx.Insert(ctx, Key("text/a"), Value("not JSON")); err != nil {
+			t.Error(err)
+		}
+		return false, nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockForUpdate(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("k1")
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.LockForUpdate(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Insert(ctx, key, Value("v2")); !errors.Is(err, ErrTransactionInConflict) {
+				t.Errorf("inserting locked record: want ErrTransactionInConflict, got %v", err)
+			}
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			if err := tx.LockForUpdate(ctx, key); !errors.Is(err, context.Canceled) {
+				t.Errorf("locking locked record: want context.Canceled, got %v", err)
+			}
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Insert(ctx, key, Value("v1")); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The lock is released once the transaction concludes.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.LockForUpdate(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		return true, tx.Update(ctx, key, Value("v3"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, key, Value("v3"))
+}
+
+func TestFinalizationWatchdogAbandonsStalledCommit(t *testing.T) {
+	stalls := make(chan FinalizationStall, 1)
+	store, err := MakeShardedStore(WithFinalizationWatchdog(10*time.Millisecond,
+		func(stall FinalizationStall) { stalls <- stall },
+		true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("k1")
+	rm := store.recordMapFor(key)
+	ctx := context.Background()
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, key, Value("v1")); err != nil {
+			t.Fatal(err)
+		}
+		// Wedge the shard's lock, so that finalizing the insertion can't proceed.
+		rm.lock.Lock()
+		return true, nil
+	})
+	rm.lock.Unlock()
+	if !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("committing: want ErrStoreFailed, got %v", err)
+	}
+	select {
+	case stall := <-stalls:
+		if want, got := string(key), string(stall.Key); want != got {
+			t.Errorf("stalled key: want %q, got %q", want, got)
+		}
+	default:
+		t.Error("watchdog did not report stall")
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return false, nil
+	}); !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("using failed store: want ErrStoreFailed, got %v", err)
+	}
+}
+
+func TestReadThroughAndWriteThrough(t *testing.T) {
+	backing := map[string]string{"k1": "v1"}
+	store, err := MakeShardedStore(
+		WithReadMissHandler(func(ctx context.Context, k Key) (Value, bool, error) {
+			v, ok := backing[string(k)]
+			return Value(v), ok, nil
+		}),
+		WithWritePropagator(func(ctx context.Context, mutations []Mutation) error {
+			for _, m := range mutations {
+				if string(m.Key) == "rejected" {
+					return errors.New("rejected")
+				}
+				if m.Deleted {
+					delete(backing, string(m.Key))
+				} else {
+					backing[string(m.Key)] = string(m.Value)
+				}
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("v1"))
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Update(ctx, Key("k1"), Value("v2")); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "v2", backing["k1"]; want != got {
+		t.Errorf("propagated value: want %q, got %q", want, got)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("rejected"), Value("v")); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil
+	}); err == nil {
+		t.Error("committing rejected write: want error, got nil")
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("rejected"))
+}
+
+func TestGetVersioned(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("k1")
+	ctx := context.Background()
+	var insertedVersion uint64
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, key, Value("v1")); err != nil {
+			t.Fatal(err)
+		}
+		_, version, err := tx.GetVersioned(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := uint64(0), version; want != got {
+			t.Errorf("pending version: want %d, got %d", want, got)
+		}
+		insertedVersion = uint64(tx.(*shardedStoreTransaction).id)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, version, err := tx.GetVersioned(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := insertedVersion, version; want != got {
+			t.Errorf("committed version: want %d, got %d", want, got)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallProcedure(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := store.CallProcedure(ctx, "claim", nil); !errors.Is(err, ErrProcedureNotFound) {
+		t.Fatalf("want procedure not found error, got %v", err)
+	}
+	if err := store.RegisterProcedure("claim", func(ctx context.Context, tx Transaction, args map[string]string) (any, error) {
+		if err := tx.Insert(ctx, Key(args["key"]), Value(args["owner"])); err != nil {
+			return nil, err
+		}
+		return args["owner"], nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RegisterProcedure("claim", func(context.Context, Transaction, map[string]string) (any, error) {
+		return nil, nil
+	}); err == nil {
+		t.Fatal("registered procedure twice under the same name")
+	}
+	result, err := store.CallProcedure(ctx, "claim", map[string]string{"key": "k1", "owner": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "a", result; want != got {
+		t.Errorf("result: want %q, got %v", want, got)
+	}
+	if _, err := store.CallProcedure(ctx, "claim", map[string]string{"key": "k1", "owner": "b"}); !errors.Is(err, ErrRecordExists) {
+		t.Fatalf("want record exists error, got %v", err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("a"))
+}
+
+func TestLatestCommittedTransaction(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if want, got := uint64(0), store.LatestCommittedTransaction(); want != got {
+		t.Errorf("latest committed transaction before writing: want %d, got %d", want, got)
+	}
+	var writerID uint64
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		writerID = tx.ID()
+		return true, tx.Insert(ctx, Key("k1"), Value("a"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Transactions that commit no changes don't advance the latest committed ID.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Get(ctx, Key("k1"))
+		return true, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := writerID, store.LatestCommittedTransaction(); want != got {
+		t.Errorf("latest committed transaction: want %d, got %d", want, got)
+	}
+}
+
+func TestWaitForCommittedTransaction(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	{
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if err := store.WaitForCommittedTransaction(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want deadline exceeded error, got %v", err)
+		}
+	}
+	waited := make(chan error)
+	go func() {
+		waited <- store.WaitForCommittedTransaction(ctx, 1)
+	}()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, Key("k1"), Value("a"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionInfo(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before := time.Now()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if _, err := tx.Get(ctx, Key("k1")); !errors.Is(err, ErrRecordDoesNotExist) {
+			return false, err
+		}
+		for _, k := range []string{"k1", "k2", "k1"} {
+			if err := tx.Upsert(ctx, Key(k), Value("a")); err != nil {
+				return false, err
+			}
+		}
+		info := tx.Info()
+		if want, got := tx.ID(), info.ID; want != got {
+			t.Errorf("ID: want %d, got %d", want, got)
+		}
+		if info.Started.Before(before) {
+			t.Errorf("start time %v precedes %v", info.Started, before)
+		}
+		if want, got := 2, info.PendingWrites; want != got {
+			t.Errorf("pending writes: want %d, got %d", want, got)
+		}
+		if want, got := 1, info.RecordReads; want != got {
+			t.Errorf("record reads: want %d, got %d", want, got)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxPendingWritesPerTransaction(t *testing.T) {
+	store, err := MakeShardedStore(WithMaxPendingWritesPerTransaction(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("k1"), Value("a")); err != nil {
+			return false, err
+		}
+		if err := tx.Insert(ctx, Key("k2"), Value("a")); err != nil {
+			return false, err
+		}
+		// Writing again to a record already written doesn't count against the limit.
+		if err := tx.Update(ctx, Key("k1"), Value("b")); err != nil {
+			return false, err
+		}
+		if err := tx.Insert(ctx, Key("k3"), Value("a")); !errors.Is(err, ErrTransactionTooLarge) {
+			t.Errorf("want transaction too large error, got %v", err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("b"))
+	confirmRecordIsAbsent(ctx, t, store, Key("k3"))
+}
+
+func TestSortKeysByShard(t *testing.T) {
+	store, err := MakeShardedStore(WithKeyShardProjection(func(k Key) uint64 {
+		return uint64(len(k))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []Key{Key("bb"), Key("c"), Key("aa"), Key("a"), Key("ccc")}
+	store.SortKeysByShard(keys)
+	want := []Key{Key("a"), Key("c"), Key("aa"), Key("bb"), Key("ccc")}
+	for i := range want {
+		if !bytes.Equal(want[i], keys[i]) {
+			t.Fatalf("sorted keys: want %q, got %q", want, keys)
+		}
+	}
+}
+
+// BenchmarkContendedUpdates measures many goroutines trying to update the same few records at
+// once, such that most attempts lose the race to propose a new record version. Run it with the
+// "-benchmem" flag to observe the allocation rate that reusing those losing versions avoids.
+func BenchmarkContendedUpdates(b *testing.B) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := []Key{Key("k1"), Key("k2"), Key("k3"), Key("k4")}
+	for _, k := range keys {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Insert(ctx, k, Value("initial"))
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	value := bytes.Repeat([]byte{'v'}, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := keys[i%len(keys)]
+			store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				err := tx.Update(ctx, k, value)
+				return err == nil, err
+			})
+		}
+	})
+}
+
+// BenchmarkUncontendedCommits measures many goroutines committing changes to distinct records at
+// once, such that claiming transaction IDs is among the few points at which they interact.
+func BenchmarkUncontendedCommits(b *testing.B) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	var goroutines atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		k := Key(fmt.Sprintf("k%d", goroutines.Add(1)))
+		for pb.Next() {
+			if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				return true, tx.Upsert(ctx, k, Value("v"))
+			}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkClaimTransactionIDs compares claiming transaction IDs in batches against advancing a
+// single counter for each ID.
+func BenchmarkClaimTransactionIDs(b *testing.B) {
+	b.Run("batched", func(b *testing.B) {
+		var s transactionState
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s.claimNext()
+			}
+		})
+	})
+	b.Run("single counter", func(b *testing.B) {
+		var s transactionState
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s.latestID.Add(1)
+			}
+		})
+	})
+}
+
+// BenchmarkReadsOfContendedRecord measures many goroutines reading a record while others keep
+// proposing new versions of it, such that readers find pending versions atop its history.
+func BenchmarkReadsOfContendedRecord(b *testing.B) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	k := Key("k")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, k, Value("initial"))
+	}); err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var writers sync.WaitGroup
+	for range 4 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for ctx.Err() == nil {
+				store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+					err := tx.Update(ctx, k, Value("updated"))
+					return err == nil, err
+				})
+			}
+		}()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				_, err := tx.Get(ctx, k)
+				return false, err
+			})
+		}
+	})
+	b.StopTimer()
+	cancel()
+	writers.Wait()
+}
+
+// TestReadsSkipPendingVersions confirms that reading a record while another transaction proposes
+// a new version of it observes the newest committed version, and that committing the proposed
+// version makes it the newest committed version.
+func TestReadsSkipPendingVersions(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, k, Value("a"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	record := store.recordMapFor(k).recordsByKey[string(k)]
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, writer Transaction) (bool, error) {
+		if err := writer.Update(ctx, k, Value("b")); err != nil {
+			return false, err
+		}
+		if record.newestCommitted.Load() == record.newest.Load() {
+			t.Error("pending version is cached as the newest committed version")
+		}
+		confirmRecordIsPresent(ctx, t, store, k, Value("a"))
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if record.newestCommitted.Load() != record.newest.Load() {
+		t.Error("committed version isn't cached as the newest committed version")
+	}
+	confirmRecordIsPresent(ctx, t, store, k, Value("b"))
+}
+
+// TestTransactionIDsFollowCommits confirms that a transaction claims an ID greater than that of
+// every transaction that committed changes before it began, even while other goroutines claim
+// IDs in batches concurrently.
+func TestTransactionIDsFollowCommits(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := make(chan uint64)
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				var id uint64
+				if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+					id = tx.ID()
+					return true, tx.Upsert(ctx, Key(fmt.Sprintf("k%d-%d", i, j)), Value("v"))
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+				committed <- id
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(committed)
+	}()
+	for id := range committed {
+		store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if tx.ID() <= id {
+				t.Errorf("transaction began with ID %d after transaction %d committed", tx.ID(), id)
+			}
+			return false, nil
+		})
+	}
+}
+
+func TestValueInterning(t *testing.T) {
+	if _, err := MakeShardedStore(WithValueInterning(), WithValueSealing(make([]byte, 16))); err == nil {
+		t.Fatal("combined value interning with value sealing")
+	}
+	store, err := MakeShardedStore(WithValueInterning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	refsTo := func(v string) int {
+		t.Helper()
+		if iv, ok := store.valueInterner.byValue[v]; ok {
+			return iv.refs
+		}
+		return 0
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for _, k := range []string{"k1", "k2", "k3"} {
+			if err := tx.Insert(ctx, Key(k), Value("on")); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, refsTo("on"); want != got {
+		t.Errorf("references to interned value: want %d, got %d", want, got)
+	}
+	// Rolling back a proposed change relinquishes its value.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return false, tx.Update(ctx, Key("k1"), Value("off"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, refsTo("off"); want != got {
+		t.Errorf("references to rolled back value: want %d, got %d", want, got)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("on"))
+	confirmRecordIsPresent(ctx, t, store, Key("k3"), Value("on"))
+}
+
+func TestPreload(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	fixtures := func(yield func(Key, Value) bool) {
+		for _, k := range []string{"k1", "k2", "k3"} {
+			if !yield(Key(k), Value("v"+k)) {
+				return
+			}
+		}
+	}
+	if err := store.Preload(ctx, fixtures); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k2"), Value("vk2"))
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Update(ctx, Key("k1"), Value("changed"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("changed"))
+	if err := store.Preload(ctx, fixtures); !errors.Is(err, ErrRecordExists) {
+		t.Fatalf("want record exists error, got %v", err)
+	}
+}
+
+func TestTransactionFromContext(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, ok := TransactionFromContext(ctx); ok {
+		t.Fatal("found transaction in empty Context")
+	}
+	// Nested code joins the enclosing transaction via its Context.
+	claim := func(ctx context.Context, k Key) error {
+		tx, ok := TransactionFromContext(ctx)
+		if !ok {
+			return errors.New("no enclosing transaction")
+		}
+		return tx.Insert(ctx, k, Value("claimed"))
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := claim(ctx, Key("k1")); err != nil {
+			return false, err
+		}
+		confirmRecordIsPresentIn(ctx, t, tx, Key("k1"), Value("claimed"))
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k1"))
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+}
+
+func TestWithinNested(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, Key("k0"), Value("a"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	errSpeculationFailed := errors.New("speculation failed")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("k1"), Value("a")); err != nil {
+			return false, err
+		}
+		if err := tx.WithinNested(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Update(ctx, Key("k1"), Value("b")); err != nil {
+				return false, err
+			}
+			if _, err := tx.Delete(ctx, Key("k0")); err != nil {
+				return false, err
+			}
+			if err := tx.Insert(ctx, Key("k2"), Value("b")); err != nil {
+				return false, err
+			}
+			return false, errSpeculationFailed
+		}); !errors.Is(err, errSpeculationFailed) {
+			t.Errorf("want speculation failed error, got %v", err)
+		}
+		confirmRecordIsPresentIn(ctx, t, tx, Key("k0"), Value("a"))
+		confirmRecordIsPresentIn(ctx, t, tx, Key("k1"), Value("a"))
+		if _, err := tx.Get(ctx, Key("k2")); !errors.Is(err, ErrRecordDoesNotExist) {
+			t.Errorf("want record does not exist error, got %v", err)
+		}
+		if err := tx.WithinNested(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Insert(ctx, Key("k3"), Value("c"))
+		}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k0"), Value("a"))
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("a"))
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+	confirmRecordIsPresent(ctx, t, store, Key("k3"), Value("c"))
+}
+
+func TestAbortTransaction(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	proposed := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Insert(ctx, Key("k1"), Value("a")); err != nil {
+				return false, err
+			}
+			close(proposed)
+			<-ctx.Done()
+			// Operations fail even when they don't observe the transaction's Context.
+			if err := tx.Insert(context.Background(), Key("k2"), Value("b")); !errors.Is(err, ErrTransactionAborted) {
+				t.Errorf("insert after abort: want transaction aborted error, got %v", err)
+			}
+			if _, err := tx.Get(context.Background(), Key("k1")); !errors.Is(err, ErrTransactionAborted) {
+				t.Errorf("get after abort: want transaction aborted error, got %v", err)
+			}
+			// Even asking to commit, an aborted transaction rolls back.
+			return true, nil
+		})
+	}()
+	<-proposed
+	active := store.ActiveTransactions()
+	if want, got := 1, len(active); want != got {
+		t.Fatalf("active transactions: want %d, got %d", want, got)
+	}
+	if want, got := 1, active[0].PendingWrites; want != got {
+		t.Errorf("pending writes: want %d, got %d", want, got)
+	}
+	if store.AbortTransaction(active[0].ID + 1) {
+		t.Error("aborted a transaction that isn't active")
+	}
+	if !store.AbortTransaction(active[0].ID) {
+		t.Fatal("failed to abort active transaction")
+	}
+	if err := <-finished; !errors.Is(err, ErrTransactionAborted) {
+		t.Fatalf("want transaction aborted error, got %v", err)
+	}
+	if want, got := 0, len(store.ActiveTransactions()); want != got {
+		t.Errorf("active transactions after abort: want %d, got %d", want, got)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k1"))
+}
+
+func TestGetDecoded(t *testing.T) {
+	var decodings int
+	store, err := MakeShardedStore(WithDecodedValueCache(func(k Key, v Value) (any, error) {
+		decodings++
+		return len(v), nil
+	}, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	k := Key("k1")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, k, Value("abc"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	getDecoded := func() any {
+		t.Helper()
+		var d any
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			var err error
+			d, err = tx.GetDecoded(ctx, k)
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for i := 0; i < 2; i++ {
+		if want, got := 3, getDecoded(); want != got {
+			t.Errorf("decoded value: want %v, got %v", want, got)
+		}
+	}
+	if want, got := 1, decodings; want != got {
+		t.Errorf("decodings of cached version: want %d, got %d", want, got)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Update(ctx, k, Value("abcde"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 5, getDecoded(); want != got {
+		t.Errorf("decoded value after update: want %v, got %v", want, got)
+	}
+	if want, got := 2, decodings; want != got {
+		t.Errorf("decodings after update: want %d, got %d", want, got)
+	}
+
+	store, err = MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.GetDecoded(ctx, k)
+		return false, err
+	}); err == nil {
+		t.Error("decoded a value without a decoder")
+	}
+}
+
+func TestRecordMetadata(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	k := Key("k1")
+	write := func(f func(context.Context, Transaction) error) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			err := f(ctx, tx)
+			return err == nil, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getRecord := func() Record {
+		t.Helper()
+		var rec Record
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			var err error
+			rec, err = tx.GetRecord(ctx, k)
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	tags := map[string]string{"owner": "alice"}
+	write(func(ctx context.Context, tx Transaction) error {
+		return tx.InsertWithMetadata(ctx, k, Value(`{}`), Metadata{ContentType: "application/json", Tags: tags})
+	})
+	// Changing the caller's tags must not affect the stored metadata.
+	tags["owner"] = "bob"
+	rec := getRecord()
+	if want, got := "application/json", rec.Metadata.ContentType; want != got {
+		t.Errorf("content type: want %q, got %q", want, got)
+	}
+	if want, got := "alice", rec.Metadata.Tags["owner"]; want != got {
+		t.Errorf("owner tag: want %q, got %q", want, got)
+	}
+	firstVersion := rec.Version
+
+	// Changing only the metadata still yields a new version.
+	write(func(ctx context.Context, tx Transaction) error {
+		return tx.UpdateWithMetadata(ctx, k, Value(`{}`), Metadata{ContentType: "text/plain"})
+	})
+	rec = getRecord()
+	if want, got := "text/plain", rec.Metadata.ContentType; want != got {
+		t.Errorf("content type after update: want %q, got %q", want, got)
+	}
+	if rec.Version == firstVersion {
+		t.Error("changing metadata did not yield a new version")
+	}
+	if got := rec.Metadata.Tags; len(got) != 0 {
+		t.Errorf("tags after update: want none, got %v", got)
+	}
+
+	// Discarding a nested transaction restores the metadata proposed earlier.
+	write(func(ctx context.Context, tx Transaction) error {
+		if err := tx.UpsertWithMetadata(ctx, k, Value(`[]`), Metadata{ContentType: "application/json"}); err != nil {
+			return err
+		}
+		return tx.WithinNested(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return false, tx.Update(ctx, k, Value(`x`))
+		})
+	})
+	rec = getRecord()
+	if want, got := "application/json", rec.Metadata.ContentType; want != got {
+		t.Errorf("content type after nested rollback: want %q, got %q", want, got)
+	}
+
+	// Writing without metadata clears it.
+	write(func(ctx context.Context, tx Transaction) error {
+		return tx.Update(ctx, k, Value(`x`))
+	})
+	if got := getRecord().Metadata; !got.isZero() {
+		t.Errorf("metadata after plain update: want none, got %+v", got)
+	}
+}
+
+func TestSets(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	k := Key("s")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if added, err := tx.AddToSet(ctx, k, Value("a")); err != nil || !added {
+			return false, fmt.Errorf("adding a: added %t, err %v", added, err)
+		}
+		// Another transaction can add a different member to the same set without conflict.
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.AddToSet(ctx, k, Value("b"))
+			return err == nil, err
+		}); err != nil {
+			return false, err
+		}
+		// ... but not the same member.
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.AddToSet(ctx, k, Value("a"))
+			return err == nil, err
+		}); !errors.Is(err, ErrTransactionInConflict) {
+			return false, fmt.Errorf("want conflict adding same member, got %v", err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if added, err := tx.AddToSet(ctx, k, Value("a")); err != nil || added {
+			return false, fmt.Errorf("re-adding a: added %t, err %v", added, err)
+		}
+		if removed, err := tx.RemoveFromSet(ctx, k, Value("b")); err != nil || !removed {
+			return false, fmt.Errorf("removing b: removed %t, err %v", removed, err)
+		}
+		if contains, err := tx.SetContains(ctx, k, Value("b")); err != nil || contains {
+			return false, fmt.Errorf("contains b after removal: %t, err %v", contains, err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var members []string
+		for m := range tx.SetMembers(ctx, k) {
+			members = append(members, string(m))
+		}
+		if want, got := "a", strings.Join(members, ","); want != got {
+			t.Errorf("members: want %q, got %q", want, got)
+		}
+		if contains, err := tx.SetContains(ctx, Key("s2"), Value("a")); err != nil || contains {
+			t.Errorf("other set contains a: %t, err %v", contains, err)
+		}
+		for k := range tx.Scan(ctx, nil) {
+			t.Errorf("scan yielded set member record with key %q", k)
+		}
+		if err := tx.Insert(ctx, setMemberKey(k, Value("c")), nil); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("want invalid key error writing reserved key, got %v", err)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLists(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	k := Key("q")
+	// Span several chunks in both directions.
+	const n = 3 * listChunkCapacity
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for i := 0; i < n; i++ {
+			if err := tx.PushRight(ctx, k, Value(fmt.Sprint(i))); err != nil {
+				return false, err
+			}
+			if err := tx.PushLeft(ctx, k, Value(fmt.Sprint(-i-1))); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		length, err := tx.ListLength(ctx, k)
+		if err != nil {
+			return false, err
+		}
+		if want, got := 2*n, length; want != got {
+			t.Errorf("length: want %d, got %d", want, got)
+		}
+		for i := n; i > 0; i-- {
+			v, err := tx.PopLeft(ctx, k)
+			if err != nil {
+				return false, err
+			}
+			if want, got := fmt.Sprint(-i), string(v); want != got {
+				t.Fatalf("popped left: want %q, got %q", want, got)
+			}
+		}
+		for i := n - 1; i >= 0; i-- {
+			v, err := tx.PopRight(ctx, k)
+			if err != nil {
+				return false, err
+			}
+			if want, got := fmt.Sprint(i), string(v); want != got {
+				t.Fatalf("popped right: want %q, got %q", want, got)
+			}
+		}
+		if _, err := tx.PopLeft(ctx, k); !errors.Is(err, ErrRecordDoesNotExist) {
+			t.Errorf("want record does not exist popping empty list, got %v", err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Once emptied, the list leaves no records behind.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		prefix := listBoundsKey(k)
+		return false, tx.(*shardedStoreTransaction).forEachVisibleRecord(ctx, prefix, func(k Key, _ *recordVersion) error {
+			return fmt.Errorf("found list record with key %q", k)
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	insertLeased := func(k Key, leaseID uint64) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Insert(ctx, k, Value("a")); err != nil {
+				return false, err
+			}
+			if err := tx.AttachToLease(ctx, k, leaseID); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+	}
+	revoked, err := store.GrantLease(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertLeased(Key("k1"), revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.KeepLeaseAlive(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeLease(ctx, revoked); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k1"))
+	if err := store.KeepLeaseAlive(revoked); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("want lease not found keeping revoked lease alive, got %v", err)
+	}
+	if err := insertLeased(Key("k2"), revoked); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("want lease not found attaching to revoked lease, got %v", err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+
+	expiring, err := store.GrantLease(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertLeased(Key("k3"), expiring); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		var exists bool
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.Get(ctx, Key("k3"))
+			exists = err == nil
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("record attached to expired lease still exists")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNamedLocks(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	leaseA, err := store.GrantLease(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaseB, err := store.GrantLease(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acquired, holder, err := store.AcquireLock(ctx, "leader", "a", leaseA); err != nil || !acquired || holder != "a" {
+		t.Fatalf("a acquiring: acquired %t, holder %q, err %v", acquired, holder, err)
+	}
+	if acquired, holder, err := store.AcquireLock(ctx, "leader", "b", leaseB); err != nil || acquired || holder != "a" {
+		t.Fatalf("b acquiring held lock: acquired %t, holder %q, err %v", acquired, holder, err)
+	}
+	if released, err := store.ReleaseLock(ctx, "leader", "b"); err != nil || released {
+		t.Fatalf("b releasing lock it doesn't hold: released %t, err %v", released, err)
+	}
+	// Losing the holder's lease releases the lock.
+	if err := store.RevokeLease(ctx, leaseA); err != nil {
+		t.Fatal(err)
+	}
+	if _, held, err := store.LockHolder(ctx, "leader"); err != nil || held {
+		t.Fatalf("lock after revoking lease: held %t, err %v", held, err)
+	}
+	if acquired, _, err := store.AcquireLock(ctx, "leader", "b", leaseB); err != nil || !acquired {
+		t.Fatalf("b acquiring released lock: acquired %t, err %v", acquired, err)
+	}
+	if holder, held, err := store.LockHolder(ctx, "leader"); err != nil || !held || holder != "b" {
+		t.Fatalf("lock holder: holder %q, held %t, err %v", holder, held, err)
+	}
+	if released, err := store.ReleaseLock(ctx, "leader", "b"); err != nil || !released {
+		t.Fatalf("b releasing lock: released %t, err %v", released, err)
+	}
+	if _, _, err := store.AcquireLock(ctx, "leader", "c", leaseA); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("want lease not found acquiring with revoked lease, got %v", err)
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	store, err := MakeShardedStore(WithSequenceBatchSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for want := uint64(1); want <= 7; want++ {
+		if got, err := store.NextSequence(ctx, "orders"); err != nil || got != want {
+			t.Fatalf("orders: want %d, got %d, err %v", want, got, err)
+		}
+	}
+	if got, err := store.NextSequence(ctx, "invoices"); err != nil || got != 1 {
+		t.Fatalf("invoices: want 1, got %d, err %v", got, err)
+	}
+	// Concurrent callers never receive the same value.
+	const callers, calls = 8, 50
+	values := make(chan uint64, callers*calls)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range calls {
+				v, err := store.NextSequence(ctx, "orders")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				values <- v
+			}
+		}()
+	}
+	wg.Wait()
+	close(values)
+	seen := make(map[uint64]bool, callers*calls)
+	for v := range values {
+		if v <= 7 || seen[v] {
+			t.Fatalf("sequence value %d repeated", v)
+		}
+		seen[v] = true
+	}
+	if _, err := store.NextSequence(ctx, ""); err == nil {
+		t.Error("want error for empty sequence name")
+	}
+}
+
+func TestWaitForRecordChange(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := Key("k")
+	write := func(f func(context.Context, Transaction) error) uint64 {
+		t.Helper()
+		var id uint64
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			id = tx.ID()
+			return true, f(ctx, tx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	inserted := write(func(ctx context.Context, tx Transaction) error {
+		return tx.Insert(ctx, key, Value("a"))
+	})
+	if changed, err := store.WaitForRecordChange(ctx, key, 0); err != nil || changed != inserted {
+		t.Fatalf("want change by transaction %d, got %d, err %v", inserted, changed, err)
+	}
+	// Changes to other records don't satisfy the wait.
+	write(func(ctx context.Context, tx Transaction) error {
+		return tx.Insert(ctx, Key("other"), Value("b"))
+	})
+	shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := store.WaitForRecordChange(shortCtx, key, inserted); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded waiting for unchanged record, got %v", err)
+	}
+	for _, change := range []func(context.Context, Transaction) error{
+		func(ctx context.Context, tx Transaction) error { return tx.Update(ctx, key, Value("c")) },
+		func(ctx context.Context, tx Transaction) error { _, err := tx.Delete(ctx, key); return err },
+	} {
+		type result struct {
+			changed uint64
+			err     error
+		}
+		results := make(chan result, 1)
+		since := store.LatestCommittedTransaction()
+		go func() {
+			changed, err := store.WaitForRecordChange(ctx, key, since)
+			results <- result{changed, err}
+		}()
+		changed := write(change)
+		select {
+		case r := <-results:
+			if r.err != nil || r.changed != changed {
+				t.Fatalf("want change by transaction %d, got %d, err %v", changed, r.changed, r.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for record change")
+		}
+	}
+}
+
+// TestWaitForRecordChangeCommittedOutOfOrder confirms that waiting for a record to change observes
+// a change by a transaction that commits after another transaction with a greater ID committed.
+func TestWaitForRecordChangeCommittedOutOfOrder(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := Key("k")
+	began := make(chan uint64)
+	proceed := make(chan struct{})
+	committed := make(chan error)
+	go func() {
+		committed <- store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			began <- tx.ID()
+			<-proceed
+			return true, tx.Insert(ctx, key, Value("a"))
+		})
+	}()
+	earlier := <-began
+	// Commit changes to another record until a transaction with a greater ID commits.
+	for i := 0; store.LatestCommittedTransaction() <= earlier; i++ {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, Key("other"), Value(fmt.Sprint(i)))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type result struct {
+		changed uint64
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		changed, err := store.WaitForRecordChange(ctx, key, 0)
+		results <- result{changed, err}
+	}()
+	// Let the waiter begin waiting for the next commit.
+	w := &store.txState.commitWaiters
+	for waiting := false; !waiting; {
+		time.Sleep(time.Millisecond)
+		w.mu.Lock()
+		waiting = w.committed != nil
+		w.mu.Unlock()
+	}
+	close(proceed)
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-results:
+		if r.err != nil || r.changed != earlier {
+			t.Fatalf("want change by transaction %d, got %d, err %v", earlier, r.changed, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record change")
+	}
+}
+
+// TestTailersObserveConcurrentCommits confirms that callers following the store's changes observe
+// every transaction that commits while many goroutines commit changes concurrently, even though
+// those transactions may commit in a different order than their IDs.
+func TestTailersObserveConcurrentCommits(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const writers, writes = 8, 50
+	feed := store.WatchCommittedTransactions(ctx)
+	fed := make(chan map[uint64]bool)
+	go func() {
+		seen := make(map[uint64]bool)
+		for tx := range feed {
+			seen[tx.ID] = true
+			if len(seen) == writers*writes {
+				break
+			}
+		}
+		fed <- seen
+	}()
+	// Follow the first writer's record until it bears that writer's final value.
+	tailed := Key("k0")
+	followed := make(chan error)
+	go func() {
+		var since uint64
+		for {
+			changed, err := store.WaitForRecordChange(ctx, tailed, since)
+			if err != nil {
+				followed <- err
+				return
+			}
+			since = changed
+			var v Value
+			if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				var err error
+				v, _, err = tx.GetVersioned(ctx, tailed)
+				return false, err
+			}); err != nil {
+				followed <- err
+				return
+			}
+			if string(v) == "last" {
+				followed <- nil
+				return
+			}
+		}
+	}()
+	var mu sync.Mutex
+	committed := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := Key(fmt.Sprintf("k%d", i))
+			for j := range writes {
+				v := Value(fmt.Sprint(j))
+				if j == writes-1 {
+					v = Value("last")
+				}
+				var id uint64
+				if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+					id = tx.ID()
+					return true, tx.Upsert(ctx, k, v)
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				committed[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := <-followed; err != nil {
+		t.Fatalf("following record %q: %v", tailed, err)
+	}
+	seen := <-fed
+	for id := range committed {
+		if !seen[id] {
+			t.Errorf("feed omitted committed transaction %d", id)
+		}
+	}
+}
+
+func TestResharding(t *testing.T) {
+	// Start with every record in the same shard.
+	store, err := MakeShardedStore(WithKeyShardProjection(func(Key) uint64 { return 0 }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const initial = 500
+	want := make(map[string]string)
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for i := range initial {
+			k, v := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+			if err := tx.Insert(ctx, Key(k), Value(v)); err != nil {
+				return false, err
+			}
+			want[k] = v
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	countRecords := func() int {
+		t.Helper()
+		var n int
+		if err := store.ForEach(ctx, func(k Key, v Value) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	spread := func(k Key) uint64 {
+		var h uint64
+		for _, b := range k {
+			h = h*31 + uint64(b)
+		}
+		return h
+	}
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := store.Resharding(canceledCtx, spread); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want cancellation, got %v", err)
+	}
+	if stats := store.Stats(); stats.Shards.MaxRecords != initial {
+		t.Errorf("abandoned resharding: want %d records in one shard, got at most %d", initial, stats.Shards.MaxRecords)
+	}
+
+	store.resharding.Store(true)
+	if err := store.Resharding(ctx, spread); !errors.Is(err, ErrReshardingInProgress) {
+		t.Errorf("want resharding in progress, got %v", err)
+	}
+	store.resharding.Store(false)
+
+	// Read, write, and scan records while the migration proceeds.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	var mu sync.Mutex
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k, v := fmt.Sprintf("n%d", i), fmt.Sprintf("w%d", i)
+			updated := fmt.Sprintf("k%d", i%initial)
+			if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				if err := tx.Insert(ctx, Key(k), Value(v)); err != nil {
+					return false, err
+				}
+				return true, tx.Update(ctx, Key(updated), Value(v))
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			want[k], want[updated] = v, v
+			mu.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			seen := make(map[string]struct{})
+			if err := store.ForEach(ctx, func(k Key, v Value) error {
+				if _, ok := seen[string(k)]; ok {
+					return fmt.Errorf("visited record with key %q twice", k)
+				}
+				seen[string(k)] = struct{}{}
+				return nil
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+			if len(seen) < initial {
+				t.Errorf("scan: want at least %d records, got %d", initial, len(seen))
+				return
+			}
+		}
+	}()
+	err = store.Resharding(ctx, spread)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range want {
+		confirmRecordIsPresent(ctx, t, store, Key(k), Value(v))
+	}
+	if n := countRecords(); n != len(want) {
+		t.Errorf("want %d records, got %d", len(want), n)
+	}
+	stats := store.Stats()
+	if stats.Shards.Records != len(want) {
+		t.Errorf("want %d records held across the shards, got %d", len(want), stats.Shards.Records)
+	}
+	if stats.Shards.MaxRecords >= len(want)/2 {
+		t.Errorf("want records spread across shards, got %d in one shard", stats.Shards.MaxRecords)
+	}
+}
+
+func TestPreparedTransactions(t *testing.T) {
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	prepareInsert := func(id string, k Key, ttl time.Duration) (uint64, error) {
+		return store.PrepareTransaction(ctx, id, ttl, func(ctx context.Context, tx Transaction) error {
+			return tx.Insert(ctx, k, Value("a"))
+		})
+	}
+	preparedID, err := prepareInsert("committed", Key("k1"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepareInsert("committed", Key("k2"), time.Hour); !errors.Is(err, ErrPreparedTransactionExists) {
+		t.Errorf("want prepared transaction exists preparing with same ID, got %v", err)
+	}
+	// The prepared transaction's changes remain invisible, but preclude conflicting writes.
+	confirmRecordIsAbsent(ctx, t, store, Key("k1"))
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, Key("k1"), Value("b"))
+	}); !errors.Is(err, ErrTransactionInConflict) {
+		t.Errorf("want transaction in conflict writing prepared record, got %v", err)
+	}
+	committedID, err := store.CommitPrepared("committed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committedID != preparedID {
+		t.Errorf("want committed transaction ID %d, got %d", preparedID, committedID)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k1"), Value("a"))
+	if _, err := store.CommitPrepared("committed"); !errors.Is(err, ErrPreparedTransactionNotFound) {
+		t.Errorf("want prepared transaction not found committing twice, got %v", err)
+	}
+
+	if _, err := prepareInsert("aborted", Key("k2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AbortPrepared("aborted"); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+	if err := store.AbortPrepared("aborted"); !errors.Is(err, ErrPreparedTransactionNotFound) {
+		t.Errorf("want prepared transaction not found aborting twice, got %v", err)
+	}
+
+	if _, err := prepareInsert("failed", Key("k1"), time.Hour); !errors.Is(err, ErrRecordExists) {
+		t.Errorf("want record exists preparing insertion of existing record, got %v", err)
+	}
+	if _, err := store.CommitPrepared("failed"); !errors.Is(err, ErrPreparedTransactionNotFound) {
+		t.Errorf("want prepared transaction not found committing failed preparation, got %v", err)
+	}
+
+	if _, err := prepareInsert("expired", Key("k3"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Once the prepared transaction expires, it no longer precludes conflicting writes.
+	for deadline := time.Now().Add(time.Second); ; {
+		err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Insert(ctx, Key("k3"), Value("b"))
+		})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrTransactionInConflict) {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prepared transaction did not expire")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := store.CommitPrepared("expired"); !errors.Is(err, ErrPreparedTransactionNotFound) {
+		t.Errorf("want prepared transaction not found committing expired transaction, got %v", err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k3"), Value("b"))
+}
+
+func TestFaultInjection(t *testing.T) {
+	for _, f := range []FaultInjection{
+		{MaxLatency: -time.Second},
+		{LockFailureRate: 1.5},
+		{CommitAbortRate: -0.5},
+	} {
+		if _, err := MakeShardedStore(WithFaultInjection(f)); err == nil {
+			t.Errorf("want error for fault injection %+v", f)
+		}
+	}
+	ctx := context.Background()
+	insert := func(store *ShardedStore) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Insert(ctx, Key("k"), Value("a"))
+		})
+	}
+	store, err := MakeShardedStore(WithFaultInjection(FaultInjection{LockFailureRate: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(store); !errors.Is(err, ErrTransactionInConflict) {
+		t.Errorf("want transaction in conflict with injected lock failure, got %v", err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k"))
+
+	store, err = MakeShardedStore(WithFaultInjection(FaultInjection{CommitAbortRate: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(store); !errors.Is(err, ErrTransactionAborted) {
+		t.Errorf("want transaction aborted with injected commit abort, got %v", err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k"))
+
+	const latency = 20 * time.Millisecond
+	store, err = MakeShardedStore(WithFaultInjection(FaultInjection{MaxLatency: latency}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(store); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("k"), Value("a"))
+	// Injected latency yields to the governing Context.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	start := time.Now()
+	for range 10 {
+		store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.Get(ctx, Key("k"))
+			return false, err
+		})
+	}
+	if elapsed := time.Since(start); elapsed >= 10*latency {
+		t.Errorf("want canceled reads to skip injected latency, took %v", elapsed)
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	ctx := context.Background()
+	deleteRecord := func(store *ShardedStore, k Key) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.Delete(ctx, k)
+			return err == nil, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertRecord := func(store *ShardedStore, k Key, v Value) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Insert(ctx, k, v)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	undelete := func(store *ShardedStore, k Key) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			err := tx.Undelete(ctx, k)
+			return err == nil, err
+		})
+	}
+
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertRecord(store, Key("k"), Value("a"))
+	deleteRecord(store, Key("k"))
+	if err := undelete(store, Key("k")); !errors.Is(err, ErrRecordNotInTrash) {
+		t.Errorf("want record not in trash without trash retention, got %v", err)
+	}
+
+	const retention = 50 * time.Millisecond
+	store, err = MakeShardedStore(WithTrashRetention(retention))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.InsertWithMetadata(ctx, Key("k1"), Value("a"), Metadata{ContentType: "text/plain"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	insertRecord(store, Key("k2"), Value("b"))
+	deleteRecord(store, Key("k1"))
+	deleteRecord(store, Key("k2"))
+	if trashed := store.TrashedRecords(); len(trashed) != 2 || string(trashed[0].Key) != "k1" || string(trashed[1].Key) != "k2" {
+		t.Fatalf("want both deleted records in trash, got %+v", trashed)
+	}
+	if err := undelete(store, Key("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		r, err := tx.GetRecord(ctx, Key("k1"))
+		if err != nil {
+			return false, err
+		}
+		if string(r.Value) != "a" || r.Metadata.ContentType != "text/plain" {
+			t.Errorf("want restored value and metadata, got %+v", r)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := undelete(store, Key("k1")); !errors.Is(err, ErrRecordNotInTrash) {
+		t.Errorf("want record not in trash undeleting restored record, got %v", err)
+	}
+	if trashed := store.TrashedRecords(); len(trashed) != 1 || string(trashed[0].Key) != "k2" {
+		t.Fatalf("want only unrestored record in trash, got %+v", trashed)
+	}
+	// Hold the record's shard locked so that restoring the record must wait.
+	rm := store.recordMapFor(Key("k2"))
+	rm.lock.Lock()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = store.WithinTransaction(timeoutCtx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return false, tx.Undelete(ctx, Key("k2"))
+	})
+	rm.lock.Unlock()
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want timeout error wrapping deadline exceeded, got %v", err)
+	}
+	if k, ok := KeyOfError(err); !ok || string(k) != "k2" {
+		t.Errorf("want error to identify key %q, got %q (%t)", "k2", k, ok)
+	}
+	time.Sleep(retention)
+	if trashed := store.TrashedRecords(); len(trashed) != 0 {
+		t.Errorf("want trash emptied after retention period, got %+v", trashed)
+	}
+	if err := undelete(store, Key("k2")); !errors.Is(err, ErrRecordNotInTrash) {
+		t.Errorf("want record not in trash after retention period, got %v", err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k2"))
+}
+
+func TestPerKeyWriteRate(t *testing.T) {
+	ctx := context.Background()
+	upsert := func(ctx context.Context, store *ShardedStore, k Key) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, k, Value("a"))
+		})
+	}
+	// Replenish writes slowly enough that the test won't notice.
+	store, err := MakeShardedStore(WithPerKeyWriteRate(0.01, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := upsert(ctx, store, Key("hot")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := upsert(ctx, store, Key("hot")); !errors.Is(err, ErrWriteRateExceeded) {
+		t.Errorf("want write rate exceeded beyond burst, got %v", err)
+	}
+	if err := upsert(ctx, store, Key("cold")); err != nil {
+		t.Errorf("want writes to other keys unaffected, got %v", err)
+	}
+
+	store, err = MakeShardedStore(WithPerKeyWriteRate(100, 1), WithWriteRateLimitPolicy(DelayExcessWrites))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for range 3 {
+		if err := upsert(ctx, store, Key("hot")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("want excess writes delayed, took only %v", elapsed)
+	}
+	store, err = MakeShardedStore(WithPerKeyWriteRate(0.01, 1), WithWriteRateLimitPolicy(DelayExcessWrites))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upsert(ctx, store, Key("hot")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := upsert(ctx, store, Key("hot")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded delaying excess write, got %v", err)
+	}
+}
+
+func TestPinSnapshot(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert := func(v string) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, Key("k"), Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upsert("old")
+	snapshot, err := store.PinSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	upsert("new")
+	for range 2 {
+		if err := snapshot.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+			v, err := tx.Get(ctx, Key("k"))
+			if err != nil {
+				return err
+			}
+			if string(v) != "old" {
+				t.Errorf("want value %q at snapshot, got %q", "old", v)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := snapshot.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		return tx.Upsert(ctx, Key("k"), Value("newer"))
+	}); !errors.Is(err, ErrReadOnlyTransaction) {
+		t.Errorf("want read-only transaction writing at snapshot, got %v", err)
+	}
+	if err := snapshot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.WithinTransaction(ctx, func(context.Context, Transaction) error {
+		return nil
+	}); err == nil {
+		t.Error("want error using closed snapshot")
+	}
+}
+
+func TestTransactionPriority(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithMaxTransactionAttempts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	proposed := make(chan struct{})
+	var attempts int
+	lowErr := make(chan error, 1)
+	go func() {
+		lowErr <- store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			attempts++
+			if err := tx.Upsert(ctx, k, Value("low")); err != nil {
+				return false, err
+			}
+			if attempts == 1 {
+				close(proposed)
+				// Hold the proposed write open until preempted.
+				<-ctx.Done()
+				return false, ctx.Err()
+			}
+			return true, nil
+		})
+	}()
+	<-proposed
+	// Though this transaction began later, its priority lets it preempt the other.
+	if err := store.WithinTransaction(ContextWithTransactionPriority(ctx, 1), func(ctx context.Context, tx Transaction) (bool, error) {
+		err := tx.Upsert(ctx, k, Value("high"))
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("want higher-priority transaction to prevail, got %v", err)
+	}
+	if err := <-lowErr; err != nil {
+		t.Fatalf("want preempted transaction to succeed upon retrying, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("want preempted transaction to make 2 attempts, made %d", attempts)
+	}
+
+	// Given equal priorities, the transaction that began first prevails.
+	store, err = MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, older Transaction) (bool, error) {
+		if err := older.Upsert(ctx, k, Value("older")); err != nil {
+			return false, err
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, younger Transaction) (bool, error) {
+			err := younger.Upsert(ctx, k, Value("younger"))
+			return err == nil, err
+		}); !errors.Is(err, ErrTransactionInConflict) {
+			t.Errorf("want younger transaction in conflict, got %v", err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("want older transaction to prevail, got %v", err)
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+	k := Key("k")
+	upsert := func(ctx context.Context, tx Transaction, v string) (bool, error) {
+		err := tx.Upsert(ctx, k, Value(v))
+		return err == nil, err
+	}
+	// proposeInYounger begins a transaction younger than the caller's that proposes writing the
+	// record, then concludes as directed by the given function, reporting its outcome.
+	proposeInYounger := func(store *ShardedStore, conclude func(context.Context) (bool, error)) <-chan error {
+		proposed := make(chan struct{})
+		outcome := make(chan error, 1)
+		go func() {
+			outcome <- store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				if _, err := upsert(ctx, tx, "younger"); err != nil {
+					close(proposed)
+					return false, err
+				}
+				close(proposed)
+				return conclude(ctx)
+			})
+		}()
+		<-proposed
+		return outcome
+	}
+	awaitPreemption := func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+
+	t.Run("first writer wins", func(t *testing.T) {
+		store, err := MakeShardedStore(WithConflictPolicy(FirstWriterWins))
+		if err != nil {
+			t.Fatal(err)
+		}
+		release := make(chan struct{})
+		var younger <-chan error
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			younger = proposeInYounger(store, func(context.Context) (bool, error) {
+				<-release
+				return true, nil
+			})
+			return upsert(ctx, tx, "older")
+		}); !errors.Is(err, ErrTransactionInConflict) {
+			t.Errorf("want older transaction in conflict, got %v", err)
+		}
+		close(release)
+		if err := <-younger; err != nil {
+			t.Errorf("want younger transaction undisturbed, got %v", err)
+		}
+	})
+	t.Run("wound-wait", func(t *testing.T) {
+		store, err := MakeShardedStore(WithConflictPolicy(WoundWait), WithMaxConflictWait(5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var younger <-chan error
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			younger = proposeInYounger(store, awaitPreemption)
+			return upsert(ctx, tx, "older")
+		}); err != nil {
+			t.Errorf("want older transaction to wound younger one, got %v", err)
+		}
+		if err := <-younger; !errors.Is(err, ErrTransactionInConflict) {
+			t.Errorf("want younger transaction wounded, got %v", err)
+		}
+		// An outranked transaction waits for the other to conclude.
+		younger = nil
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if _, err := upsert(ctx, tx, "older"); err != nil {
+				return false, err
+			}
+			proposed := make(chan struct{})
+			outcome := make(chan error, 1)
+			go func() {
+				outcome <- store.WithinTransaction(context.Background(), func(ctx context.Context, tx Transaction) (bool, error) {
+					close(proposed)
+					return upsert(ctx, tx, "younger")
+				})
+			}()
+			<-proposed
+			younger = outcome
+			time.Sleep(10 * time.Millisecond)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-younger; err != nil {
+			t.Errorf("want younger transaction to wait for older one, got %v", err)
+		}
+	})
+	t.Run("wait-die", func(t *testing.T) {
+		store, err := MakeShardedStore(WithConflictPolicy(WaitDie), WithMaxConflictWait(5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var younger <-chan error
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			younger = proposeInYounger(store, func(context.Context) (bool, error) {
+				time.Sleep(10 * time.Millisecond)
+				return false, nil
+			})
+			return upsert(ctx, tx, "older")
+		}); err != nil {
+			t.Errorf("want older transaction to wait for younger one, got %v", err)
+		}
+		if err := <-younger; err != nil {
+			t.Fatal(err)
+		}
+		// An outranked transaction fails immediately.
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if _, err := upsert(ctx, tx, "older"); err != nil {
+				return false, err
+			}
+			younger := proposeInYounger(store, awaitPreemption)
+			if err := <-younger; !errors.Is(err, ErrTransactionInConflict) {
+				t.Errorf("want younger transaction to die, got %v", err)
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestValueRef(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	adopted := Value("first")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.UpsertValueRef(ctx, k, AdoptValueRef(adopted), Metadata{}); err != nil {
+			return false, err
+		}
+		// Revising the proposed value must not write into the adopted buffer.
+		if err := tx.Upsert(ctx, k, Value("other")); err != nil {
+			return false, err
+		}
+		return true, tx.UpsertValueRef(ctx, k, AdoptValueRef(adopted), Metadata{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(adopted) != "first" {
+		t.Errorf("want adopted value intact, got %q", adopted)
+	}
+	var ref ValueRef
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var err error
+		ref, _, err = tx.GetValueRef(ctx, k)
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	borrowed := Value("second")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Upsert(ctx, k, borrowed)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The store copied the borrowed value, leaving the caller free to modify it.
+	copy(borrowed, "xxxxxx")
+	if !ref.Equal(Value("first")) {
+		t.Errorf("want reference to remain valid beyond its transaction, got %q", ref)
+	}
+	var v Value
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		ref, _, err := tx.GetValueRef(ctx, k)
+		v.CopyFromRef(ref)
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "second" {
+		t.Errorf("want value %q, got %q", "second", v)
+	}
+}
+
+func TestCommittedTransactions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := make(chan CommittedTransaction)
+	go func() {
+		defer close(observed)
+		for tx := range store.CommittedTransactions(ctx) {
+			observed <- tx
+		}
+	}()
+	for store.commitFeed.observers.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var writerID uint64
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		writerID = tx.Info().ID
+		for _, k := range []string{"b", "a"} {
+			if err := tx.Insert(ctx, Key(k), Value("v")); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Neither read-only nor abandoned transactions commit changes.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Get(ctx, Key("a"))
+		return true, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Delete(ctx, Key("a"))
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Delete(ctx, Key("b"))
+		return err == nil, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		keys  []string
+		newer bool
+	}{
+		{keys: []string{"a", "b"}},
+		{keys: []string{"b"}, newer: true},
+	} {
+		tx := <-observed
+		if want.newer {
+			if tx.ID <= writerID {
+				t.Errorf("commit %d: want ID greater than %d, got %d", i, writerID, tx.ID)
+			}
+		} else if tx.ID != writerID {
+			t.Errorf("commit %d: want ID %d, got %d", i, writerID, tx.ID)
+		}
+		if got := fmt.Sprintf("%q", tx.Keys); got != fmt.Sprintf("%q", want.keys) {
+			t.Errorf("commit %d: want keys %q, got %s", i, want.keys, got)
+		}
+	}
+	cancel()
+	if _, ok := <-observed; ok {
+		t.Error("want sequence to end once its Context is done")
+	}
+}
+
+func TestWatchCommittedTransactions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched := store.WatchCommittedTransactions(ctx)
+	// Changes committed before iteration begins still appear in the sequence.
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, Key("a"), Value("v"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for tx := range watched {
+		if got := fmt.Sprintf("%q", tx.Keys); got != `["a"]` {
+			t.Errorf("want keys [\"a\"], got %s", got)
+		}
+		break
+	}
+	if n := store.commitFeed.observers.Load(); n != 0 {
+		t.Errorf("want no observers once iteration ends, got %d", n)
+	}
+	// Abandoning a sequence without iterating it stops watching once its Context is done.
+	abandonedCtx, abandon := context.WithCancel(ctx)
+	store.WatchCommittedTransactions(abandonedCtx)
+	if n := store.commitFeed.observers.Load(); n != 1 {
+		t.Fatalf("want one observer, got %d", n)
+	}
+	abandon()
+	for deadline := time.Now().Add(time.Second); store.commitFeed.observers.Load() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("want no observers once the Context is done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTransactionJournal(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, k, Value("v1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	journalCtx, journal := ContextWithTransactionJournal(ctx)
+	var laterID uint64
+	err = store.WithinTransaction(journalCtx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if _, err := tx.Get(ctx, k); err != nil {
+			return false, err
+		}
+		// Journaling applies only to transactions begun with the journal's Context.
+		if err := store.WithinTransaction(context.Background(), func(ctx context.Context, tx Transaction) (bool, error) {
+			laterID = tx.Info().ID
+			return true, tx.Update(ctx, k, Value("v2"))
+		}); err != nil {
+			return false, err
+		}
+		err := tx.Update(ctx, k, Value("v3"))
+		return err == nil, err
+	})
+	if !errors.Is(err, ErrTransactionInConflict) {
+		t.Fatalf("want conflict, got %v", err)
+	}
+	var events []JournalEvent
+	var conflict JournalEntry
+	for _, e := range journal.Entries() {
+		events = append(events, e.Event)
+		if e.Event == JournalConflict {
+			conflict = e
+		}
+	}
+	want := []JournalEvent{
+		JournalAttemptBegan,
+		JournalVersionVisited,
+		JournalRead,
+		JournalConflict,
+		JournalWrite,
+		JournalAttemptConcluded,
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("want events %v, got %v", want, events)
+	}
+	if !bytes.Equal(conflict.Key, k) || conflict.Version != laterID {
+		t.Errorf("want conflict over %q with version %d, got %v", k, laterID, conflict)
+	}
+}
+
+func TestCommitAssertions(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert := func(k, v string) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, Key(k), Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upsert("present", "v1")
+	upsert("versioned", "v")
+	var versioned uint64
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var err error
+		_, versioned, err = tx.GetVersioned(ctx, Key("versioned"))
+		return false, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("fails immediately", func(t *testing.T) {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.AssertAbsent(ctx, Key("present"))
+		}); !errors.Is(err, ErrAssertionFailed) {
+			t.Errorf("want assertion failure, got %v", err)
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.AssertValue(ctx, Key("present"), Value("v2"))
+		}); !errors.Is(err, ErrAssertionFailed) {
+			t.Errorf("want assertion failure, got %v", err)
+		}
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.AssertVersion(ctx, Key("versioned"), versioned+1)
+		}); !errors.Is(err, ErrAssertionFailed) {
+			t.Errorf("want assertion failure, got %v", err)
+		}
+	})
+	t.Run("holds at commit", func(t *testing.T) {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.AssertAbsent(ctx, Key("absent")); err != nil {
+				return false, err
+			}
+			if err := tx.AssertValue(ctx, Key("present"), Value("v1")); err != nil {
+				return false, err
+			}
+			if err := tx.AssertVersion(ctx, Key("versioned"), versioned); err != nil {
+				return false, err
+			}
+			return true, tx.Insert(ctx, Key("guarded"), Value("x"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("fails at commit", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			assert func(context.Context, Transaction) error
+			change func()
+		}{
+			{
+				name:   "absent",
+				assert: func(ctx context.Context, tx Transaction) error { return tx.AssertAbsent(ctx, Key("new")) },
+				change: func() { upsert("new", "v") },
+			},
+			{
+				name: "value",
+				assert: func(ctx context.Context, tx Transaction) error {
+					return tx.AssertValue(ctx, Key("present"), Value("v1"))
+				},
+				change: func() { upsert("present", "v2") },
+			},
+			{
+				name: "version",
+				assert: func(ctx context.Context, tx Transaction) error {
+					return tx.AssertVersion(ctx, Key("versioned"), versioned)
+				},
+				// Restoring the record's value doesn't restore its version.
+				change: func() {
+					upsert("versioned", "w")
+					upsert("versioned", "v")
+				},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				k := Key("guarded-" + tc.name)
+				if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+					if err := tc.assert(ctx, tx); err != nil {
+						return false, err
+					}
+					tc.change()
+					return true, tx.Insert(ctx, k, Value("x"))
+				}); !errors.Is(err, ErrAssertionFailed) {
+					t.Fatalf("want assertion failure, got %v", err)
+				}
+				confirmRecordIsAbsent(ctx, t, store, k)
+			})
+		}
+	})
+	t.Run("discarded with nested transaction", func(t *testing.T) {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.WithinNested(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				return false, tx.AssertAbsent(ctx, Key("later"))
+			}); err != nil {
+				return false, err
+			}
+			upsert("later", "v")
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDeleteWhere(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for i := range 100 {
+			v := "fresh"
+			if i%3 == 0 {
+				v = "stale"
+			}
+			if err := tx.Insert(ctx, Key(fmt.Sprintf("a/%d", i)), Value(v)); err != nil {
+				return false, err
+			}
+		}
+		return true, tx.Insert(ctx, Key("b/0"), Value("stale"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var deleted int
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		var err error
+		deleted, err = tx.DeleteWhere(ctx, Key("a/"), func(k Key, v Value) bool {
+			return string(v) == "stale"
+		})
+		return err == nil, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := 34; deleted != want {
+		t.Errorf("want %d records deleted, got %d", want, deleted)
+	}
+	remaining := make(map[string]int)
+	if err := store.ForEach(ctx, func(k Key, v Value) error {
+		remaining[string(v)]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "map[fresh:66 stale:1]", fmt.Sprint(remaining); want != got {
+		t.Errorf("want remaining records %s, got %s", want, got)
+	}
+}
+
+func TestRecordAccessStats(t *testing.T) {
+	ctx := context.Background()
+	for _, tracked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tracked=%t", tracked), func(t *testing.T) {
+			var opts []ShardedStoreOption
+			if tracked {
+				opts = append(opts, WithRecordAccessStats())
+			}
+			store, err := MakeShardedStore(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k := Key("k")
+			for _, v := range []string{"v1", "v2"} {
+				if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+					return true, tx.Upsert(ctx, k, Value(v))
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Writes that the transaction doesn't commit don't count.
+			if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				return false, tx.Upsert(ctx, k, Value("v3"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			var stats RecordAccessStats
+			var readerID uint64
+			if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				readerID = tx.ID()
+				if _, err := tx.Get(ctx, k); err != nil {
+					return false, err
+				}
+				r, err := tx.GetRecord(ctx, k)
+				stats = r.Access
+				return false, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			var want RecordAccessStats
+			if tracked {
+				want = RecordAccessStats{Reads: 2, Writes: 2, LastAccess: readerID}
+			}
+			if stats != want {
+				t.Errorf("want stats %+v, got %+v", want, stats)
+			}
+		})
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithEviction(LRU, EvictionLimits{MaxRecords: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert := func(k string) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, Key(k), Value("v-"+k))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	present := func(k string) bool {
+		t.Helper()
+		var found bool
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			_, err := tx.Get(ctx, Key(k))
+			if errors.Is(err, ErrRecordDoesNotExist) {
+				return false, nil
+			}
+			found = err == nil
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	upsert("a")
+	upsert("b")
+	// Reading "a" makes "b" the least recently used record.
+	if !present("a") {
+		t.Fatal(`want record "a" present`)
+	}
+	upsert("c")
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := present(k); got != want {
+			t.Errorf("record %q present: want %t, got %t", k, want, got)
+		}
+	}
+	if want, got := uint64(1), store.Stats().EvictedRecords; got != want {
+		t.Errorf("evicted records: want %d, got %d", want, got)
+	}
+
+	// Records that a transaction holds locked stay put.
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.LockForUpdate(ctx, Key("c")); err != nil {
+				return false, err
+			}
+			close(locked)
+			<-release
+			return false, nil
+		})
+	}()
+	<-locked
+	upsert("a")
+	upsert("d")
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]bool{"a": false, "c": true, "d": true} {
+		if got := present(k); got != want {
+			t.Errorf("record %q present: want %t, got %t", k, want, got)
+		}
+	}
+
+	if _, err := MakeShardedStore(WithEviction(LRU, EvictionLimits{})); err == nil {
+		t.Error("want error for eviction without limits")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if _, err := tx.Namespace(ctx, "a"); !errors.Is(err, ErrNamespaceNotFound) {
+			t.Errorf("want namespace not found error, got %v", err)
+		}
+		for _, name := range []string{"a", "b"} {
+			if err := tx.CreateNamespace(ctx, name); err != nil {
+				return false, err
+			}
+			ns, err := tx.Namespace(ctx, name)
+			if err != nil {
+				return false, err
+			}
+			if err := ns.Insert(ctx, k, Value("v-"+name)); err != nil {
+				return false, err
+			}
+		}
+		if err := tx.CreateNamespace(ctx, "a"); !errors.Is(err, ErrNamespaceExists) {
+			t.Errorf("want namespace exists error, got %v", err)
+		}
+		return true, tx.Insert(ctx, k, Value("v"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if want, got := "[a b]", fmt.Sprint(slices.Sorted(tx.Namespaces(ctx))); want != got {
+			t.Errorf("want namespaces %s, got %s", want, got)
+		}
+		if v, err := tx.Get(ctx, k); err != nil || string(v) != "v" {
+			t.Errorf("want value %q, got %q (error %v)", "v", v, err)
+		}
+		ns, err := tx.Namespace(ctx, "a")
+		if err != nil {
+			return false, err
+		}
+		if v, err := ns.Get(ctx, k); err != nil || string(v) != "v-a" {
+			t.Errorf("want value %q, got %q (error %v)", "v-a", v, err)
+		}
+		for sk := range ns.Scan(ctx, nil) {
+			if string(sk) != string(k) {
+				t.Errorf("want scanned key %q, got %q", k, sk)
+			}
+		}
+		deleted, err := tx.DeleteNamespace(ctx, "a")
+		if err != nil {
+			return false, err
+		}
+		if deleted != 1 {
+			t.Errorf("want 1 record deleted, got %d", deleted)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if want, got := "[b]", fmt.Sprint(slices.Collect(tx.Namespaces(ctx))); want != got {
+			t.Errorf("want namespaces %s, got %s", want, got)
+		}
+		ns, err := tx.Namespace(ctx, "b")
+		if err != nil {
+			return false, err
+		}
+		if v, err := ns.Get(ctx, k); err != nil || string(v) != "v-b" {
+			t.Errorf("want value %q, got %q (error %v)", "v-b", v, err)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		for _, name := range []string{"b", "a"} {
+			if err := tx.CreateNamespace(ctx, name); err != nil {
+				return false, err
+			}
+		}
+		ns, err := tx.Namespace(ctx, "a")
+		if err != nil {
+			return false, err
+		}
+		for _, k := range []string{"k1", "k2"} {
+			if err := ns.Insert(ctx, Key(k), Value("value")); err != nil {
+				return false, err
+			}
+		}
+		if _, err := ns.Get(ctx, Key("k1")); err != nil {
+			return false, err
+		}
+		if _, err := ns.Get(ctx, Key("absent")); !errors.Is(err, ErrRecordDoesNotExist) {
+			return false, err
+		}
+		if _, err := ns.Delete(ctx, Key("k2")); err != nil {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.NamespaceUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NamespaceUsage{
+		{Name: "a", Reads: 1, Writes: 2, Deletes: 1, BytesRead: 7, BytesWritten: 14, Records: 1, BytesStored: 7},
+		{Name: "b"},
+	}
+	if !slices.Equal(want, usage) {
+		t.Errorf("want usage %+v, got %+v", want, usage)
+	}
+}
+
+func TestCloneNamespace(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.CreateNamespace(ctx, "prod"); err != nil {
+			return false, err
+		}
+		ns, err := tx.Namespace(ctx, "prod")
+		if err != nil {
+			return false, err
+		}
+		if err := ns.InsertWithMetadata(ctx, Key("a"), Value("1"), Metadata{ContentType: "text/plain"}); err != nil {
+			return false, err
+		}
+		return true, ns.Insert(ctx, Key("b"), Value("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cloned, err := store.CloneNamespace(ctx, "prod", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloned != 2 {
+		t.Errorf("want 2 records cloned, got %d", cloned)
+	}
+	if _, err := store.CloneNamespace(ctx, "prod", "staging"); !errors.Is(err, ErrNamespaceExists) {
+		t.Errorf("want namespace exists error, got %v", err)
+	}
+	if _, err := store.CloneNamespace(ctx, "absent", "other"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Errorf("want namespace not found error, got %v", err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		ns, err := tx.Namespace(ctx, "staging")
+		if err != nil {
+			return false, err
+		}
+		r, err := ns.GetRecord(ctx, Key("a"))
+		if err != nil {
+			return false, err
+		}
+		if string(r.Value) != "1" || r.Metadata.ContentType != "text/plain" {
+			t.Errorf("want value %q with content type %q, got %q with %q", "1", "text/plain", r.Value, r.Metadata.ContentType)
+		}
+		// Changes to the clone leave the original intact.
+		if err := ns.Update(ctx, Key("b"), Value("3")); err != nil {
+			return false, err
+		}
+		prod, err := tx.Namespace(ctx, "prod")
+		if err != nil {
+			return false, err
+		}
+		if v, err := prod.Get(ctx, Key("b")); err != nil || string(v) != "2" {
+			t.Errorf("want value %q, got %q (error %v)", "2", v, err)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Insert(ctx, Key("k"), Value("v"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetReadOnly(true)
+	if !store.ReadOnly() {
+		t.Fatal("want read-only store")
+	}
+	for _, write := range []func(context.Context, Transaction) error{
+		func(ctx context.Context, tx Transaction) error {
+			return tx.Insert(ctx, Key("other"), Value("v"))
+		},
+		func(ctx context.Context, tx Transaction) error {
+			return tx.Update(ctx, Key("k"), Value("w"))
+		},
+		func(ctx context.Context, tx Transaction) error {
+			_, err := tx.Delete(ctx, Key("k"))
+			return err
+		},
+	} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, write(ctx, tx)
+		}); !errors.Is(err, ErrReadOnlyTransaction) {
+			t.Errorf("want read-only transaction error, got %v", err)
+		}
+	}
+	if _, err := store.NextSequence(ctx, "s"); !errors.Is(err, ErrReadOnlyTransaction) {
+		t.Errorf("want read-only transaction error drawing from sequence, got %v", err)
+	}
+	if err := store.Preload(ctx, func(yield func(Key, Value) bool) {
+		yield(Key("p"), Value("v"))
+	}); !errors.Is(err, ErrReadOnlyTransaction) {
+		t.Errorf("want read-only transaction error preloading, got %v", err)
+	}
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if v, err := tx.Get(ctx, Key("k")); err != nil || string(v) != "v" {
+			t.Errorf("want value %q, got %q (error %v)", "v", v, err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetReadOnly(false)
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return true, tx.Update(ctx, Key("k"), Value("w"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []func(context.Context, Transaction) error{
+		func(ctx context.Context, tx Transaction) error {
+			if err := tx.Insert(ctx, Key("a"), Value("1")); err != nil {
+				return err
+			}
+			return tx.Insert(ctx, Key("b"), Value("1"))
+		},
+		func(ctx context.Context, tx Transaction) error {
+			return tx.Update(ctx, Key("a"), Value("2"))
+		},
+		func(ctx context.Context, tx Transaction) error {
+			_, err := tx.Delete(ctx, Key("b"))
+			return err
+		},
+		func(ctx context.Context, tx Transaction) error {
+			return tx.Insert(ctx, Key("b"), Value("3"))
+		},
+	} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, f(ctx, tx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	anomalies, err := store.CheckConsistency(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies) != 0 {
+		t.Fatalf("want no anomalies, got %v", anomalies)
+	}
+	// Reopen the superseded version of one record, as though a commit had failed to close it.
+	record := store.recordMapFor(Key("a")).recordsByKey["a"]
+	record.newest.Load().next.Load().validBeforeTransaction.Store(uint64(noSuchTransaction))
+	if anomalies, err = store.CheckConsistency(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies) != 1 || string(anomalies[0].Key) != "a" || anomalies[0].Depth != 1 {
+		t.Fatalf("want one anomaly for the older version of record %q, got %v", "a", anomalies)
+	}
+	if n := store.Stats().ConsistencyAnomalies; n != 1 {
+		t.Errorf("want 1 anomaly counted, got %d", n)
+	}
+}
+
+func TestMaxVersionsPerRecord(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithMaxVersionsPerRecord(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert := func(v string) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, tx.Upsert(ctx, Key("k"), Value(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := func() int {
+		var n int
+		for r := store.recordMapFor(Key("k")).recordsByKey["k"].newest.Load(); r != nil; r = r.next.Load() {
+			n++
+		}
+		return n
+	}
+	for i := range 5 {
+		upsert(fmt.Sprint(i))
+	}
+	if n := versions(); n != 2 {
+		t.Errorf("want 2 versions retained, got %d", n)
+	}
+	snapshot, err := store.PinSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	for i := range 5 {
+		upsert(fmt.Sprint(5 + i))
+	}
+	if err := snapshot.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		v, err := tx.Get(ctx, Key("k"))
+		if err != nil {
+			return err
+		}
+		if string(v) != "4" {
+			t.Errorf("want value %q at snapshot, got %q", "4", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+	upsert("10")
+	if n := versions(); n != 2 {
+		t.Errorf("want 2 versions retained after closing snapshot, got %d", n)
+	}
+	if n := store.Stats().ConsolidatedVersions; n != 9 {
+		t.Errorf("want 9 versions consolidated, got %d", n)
+	}
+}
+
+func TestAsynchronousFinalization(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithAsynchronousFinalization(), WithTrashRetention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(f func(context.Context, Transaction) error) {
+		t.Helper()
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			return true, f(ctx, tx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 10 {
+		k := Key(fmt.Sprintf("k%d", i))
+		write(func(ctx context.Context, tx Transaction) error {
+			return tx.Insert(ctx, k, Value("v"))
+		})
+		write(func(ctx context.Context, tx Transaction) error {
+			_, err := tx.Delete(ctx, k)
+			return err
+		})
+		// The deletion is visible even before the store concludes committing it.
+		confirmRecordIsAbsent(ctx, t, store, k)
+	}
+	if err := store.WaitForFinalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if trashed := store.TrashedRecords(); len(trashed) != 10 {
+		t.Errorf("want 10 deleted records in trash, got %d", len(trashed))
+	}
+	for i := range 10 {
+		k := fmt.Sprintf("k%d", i)
+		newest := store.recordMapFor(Key(k)).recordsByKey[k].newest.Load()
+		if newest.validAsOfTransactionID() == newest.validBeforeTransactionID() {
+			t.Errorf("tombstone for record with key %q remains after finalizing", k)
+		}
+	}
+	write(func(ctx context.Context, tx Transaction) error {
+		return tx.Undelete(ctx, Key("k0"))
+	})
+	confirmRecordIsPresent(ctx, t, store, Key("k0"), Value("v"))
+}
+
+func TestCancellationPolicy(t *testing.T) {
+	// propagate waits for a while for the Context governing the transaction's commit to be done.
+	propagate := WithWritePropagator(func(ctx context.Context, mutations []Mutation) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	})
+	for _, test := range []struct {
+		name       string
+		opts       []ShardedStoreOption
+		wantCommit bool
+	}{
+		{"finish committing", []ShardedStoreOption{WithCancellationPolicy(FinishCommitting)}, true},
+		{"abort cancelled", []ShardedStoreOption{WithCancellationPolicy(AbortCancelled)}, false},
+		{"finish within long grace period", []ShardedStoreOption{WithCancellationPolicy(FinishWithinGracePeriod), WithCancellationGracePeriod(time.Hour), propagate}, true},
+		{"finish within short grace period", []ShardedStoreOption{WithCancellationPolicy(FinishWithinGracePeriod), WithCancellationGracePeriod(time.Millisecond), propagate}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := MakeShardedStore(test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			err = store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+				if err := tx.Insert(ctx, Key("k"), Value("v")); err != nil {
+					return false, err
+				}
+				cancel()
+				return true, nil
+			})
+			if test.wantCommit {
+				if err != nil {
+					t.Fatal(err)
+				}
+				confirmRecordIsPresent(context.Background(), t, store, Key("k"), Value("v"))
+				return
+			}
+			if !errors.Is(err, ErrTransactionCancelled) || !errors.Is(err, context.Canceled) {
+				t.Errorf("want transaction cancelled error wrapping context cancellation, got %v", err)
+			}
+			confirmRecordIsAbsent(context.Background(), t, store, Key("k"))
+		})
+	}
+}
+
+// gracePeriodClock is a Clock that counts its pending timers scheduled for a particular duration.
+type gracePeriodClock struct {
+	systemClock
+	period  time.Duration
+	pending atomic.Int32
+}
+
+type countedTimer struct {
+	Timer
+	clock *gracePeriodClock
+}
+
+func (t *countedTimer) Stop() bool {
+	stopped := t.Timer.Stop()
+	if stopped {
+		t.clock.pending.Add(-1)
+	}
+	return stopped
+}
+
+func (c *gracePeriodClock) AfterFunc(d time.Duration, f func()) Timer {
+	if d != c.period {
+		return c.systemClock.AfterFunc(d, f)
+	}
+	c.pending.Add(1)
+	return &countedTimer{
+		Timer: c.systemClock.AfterFunc(d, func() {
+			c.pending.Add(-1)
+			f()
+		}),
+		clock: c,
+	}
+}
+
+func TestCancellationGracePeriodTimerStopsOnceCommitted(t *testing.T) {
+	clock := &gracePeriodClock{period: time.Hour}
+	store, err := MakeShardedStore(
+		WithClock(clock),
+		WithCancellationPolicy(FinishWithinGracePeriod),
+		WithCancellationGracePeriod(clock.period),
+		// Delay committing until the grace period begins.
+		WithWritePropagator(func(context.Context, []Mutation) error {
+			for clock.pending.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		if err := tx.Insert(ctx, Key("k"), Value("v")); err != nil {
+			return false, err
+		}
+		cancel()
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := clock.pending.Load(); n != 0 {
+		t.Errorf("want no grace period timers pending once the transaction commits, got %d", n)
+	}
+}
+
+func TestRollbackError(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, commit := range []bool{false, true} {
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Insert(ctx, Key("k"), Value("v")); err != nil {
+				return false, err
+			}
+			return commit, fmt.Errorf("changed my mind: %w", ErrRollback)
+		}); err != nil {
+			t.Errorf("want no error rolling back (commit: %t), got %v", commit, err)
+		}
+		confirmRecordIsAbsent(ctx, t, store, Key("k"))
+	}
+	snapshot, err := store.PinSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if err := snapshot.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		return ErrRollback
+	}); err != nil {
+		t.Errorf("want no error rolling back snapshot transaction, got %v", err)
+	}
+	if _, err := store.PrepareTransaction(ctx, "p", time.Minute, func(ctx context.Context, tx Transaction) error {
+		return ErrRollback
+	}); !errors.Is(err, ErrRollback) {
+		t.Errorf("want rollback error preparing transaction, got %v", err)
+	}
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithMaxValueSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmKey := func(t *testing.T, err error, want string) {
+		t.Helper()
+		if k, ok := KeyOfError(err); !ok || string(k) != want {
+			t.Errorf("want error pertaining to key %q, got %q (%t) for %v", want, k, ok, err)
+		}
+	}
+
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		err := tx.Insert(ctx, Key("big"), Value("too large"))
+		return err == nil, err
+	})
+	if !errors.Is(err, ErrValueTooLarge) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want value too large error counting as exceeding a quota, got %v", err)
+	}
+	confirmKey(t, err, "big")
+
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Get(ctx, Key("absent"))
+		return false, err
+	})
+	confirmKey(t, err, "absent")
+
+	// Hold the record's shard locked so that reading the record must wait.
+	rm := store.recordMapFor(Key("k"))
+	rm.lock.Lock()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = store.WithinTransaction(timeoutCtx, func(ctx context.Context, tx Transaction) (bool, error) {
+		_, err := tx.Get(ctx, Key("k"))
+		return false, err
+	})
+	rm.lock.Unlock()
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCancelled) {
+		t.Errorf("want timeout error wrapping deadline exceeded, got %v", err)
+	}
+	confirmKey(t, err, "k")
+	if _, ok := KeyOfError(errors.New("unrelated")); ok {
+		t.Error("want no key for unrelated error")
+	}
+
+	if err := store.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return false, nil
+	})
+	if !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("want store closed error, got %v", err)
+	}
+}
+
+func TestUpdateIfUnchangedSince(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithMaxTransactionAttempts(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key("k")
+	write := func(f func(context.Context, Transaction) error) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			err := f(ctx, tx)
+			return err == nil, err
+		})
+	}
+	version := func() uint64 {
+		var version uint64
+		if err := store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			var err error
+			_, version, err = tx.GetVersioned(ctx, k)
+			return false, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+	updateIfUnchangedSince := func(v string, since uint64) error {
+		return write(func(ctx context.Context, tx Transaction) error {
+			return tx.UpdateIfUnchangedSince(ctx, k, Value(v), since)
+		})
+	}
+	if err := updateIfUnchangedSince("a", 0); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Errorf("want record does not exist, got %v", err)
+	}
+	if err := write(func(ctx context.Context, tx Transaction) error {
+		return tx.Insert(ctx, k, Value("a"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	observed := version()
+	if err := write(func(ctx context.Context, tx Transaction) error {
+		return tx.Update(ctx, k, Value("b"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateIfUnchangedSince("c", observed); !errors.Is(err, ErrTransactionInConflict) {
+		t.Errorf("want conflict updating record changed since observed version, got %v", err)
+	}
+	confirmRecordIsPresent(ctx, t, store, k, Value("b"))
+	observed = version()
+	if err := updateIfUnchangedSince("c", observed); err != nil {
+		t.Errorf("want no error updating record unchanged since observed version, got %v", err)
+	}
+	confirmRecordIsPresent(ctx, t, store, k, Value("c"))
+
+	// Deleting the record counts as changing it.
+	observed = version()
+	if err := write(func(ctx context.Context, tx Transaction) error {
+		_, err := tx.Delete(ctx, k)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateIfUnchangedSince("d", observed); !errors.Is(err, ErrTransactionInConflict) {
+		t.Errorf("want conflict updating record deleted since observed version, got %v", err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithMaxTransactionAttempts(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const outbox = "events"
+	appendEvent := func(k, event string, commit bool) error {
+		return store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+			if err := tx.Upsert(ctx, Key(k), Value(event)); err != nil {
+				return false, err
+			}
+			_, err := tx.AppendToOutbox(ctx, outbox, Value(event))
+			return commit, err
+		})
+	}
+	read := func(limit int) []string {
+		entries, err := store.ReadOutbox(ctx, outbox, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for i, e := range entries {
+			if i > 0 && e.Sequence != entries[i-1].Sequence+1 {
+				t.Errorf("want consecutive sequence numbers, got %d after %d", e.Sequence, entries[i-1].Sequence)
+			}
+			events = append(events, string(e.Event))
+		}
+		return events
+	}
+	if events := read(10); len(events) != 0 {
+		t.Errorf("want no events in absent outbox, got %q", events)
+	}
+	for i, event := range []string{"a", "b", "c"} {
+		if err := appendEvent(fmt.Sprintf("k%d", i), event, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendEvent("k", "rolled-back", false); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsAbsent(ctx, t, store, Key("k"))
+	if events := read(10); !slices.Equal(events, []string{"a", "b", "c"}) {
+		t.Errorf("want events %q, got %q", []string{"a", "b", "c"}, events)
+	}
+	if events := read(2); !slices.Equal(events, []string{"a", "b"}) {
+		t.Errorf("want events %q within limit, got %q", []string{"a", "b"}, events)
+	}
+
+	if n, err := store.AcknowledgeOutbox(ctx, outbox, 2); err != nil || n != 2 {
+		t.Errorf("want 2 entries acknowledged, got %d, %v", n, err)
+	}
+	if n, err := store.AcknowledgeOutbox(ctx, outbox, 1); err != nil || n != 0 {
+		t.Errorf("want no entries acknowledged again, got %d, %v", n, err)
+	}
+	if events := read(10); !slices.Equal(events, []string{"c"}) {
+		t.Errorf("want events %q after acknowledgment, got %q", []string{"c"}, events)
+	}
+
+	// Concurrent appends take consecutive sequence numbers.
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := appendEvent(fmt.Sprintf("c%d", i), "e", true); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if events := read(100); len(events) != 21 {
+		t.Errorf("want 21 events after concurrent appends, got %d", len(events))
+	}
+	if n, err := store.AcknowledgeOutbox(ctx, outbox, math.MaxUint64); err != nil || n != 21 {
+		t.Errorf("want 21 entries acknowledged, got %d, %v", n, err)
+	}
+	if events := read(10); len(events) != 0 {
+		t.Errorf("want no events once all acknowledged, got %q", events)
+	}
+}
+
+func TestQueues(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const queue = "jobs"
+	for _, body := range []string{"a", "b", "c"} {
+		if _, err := store.Enqueue(ctx, queue, Value(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dequeue := func(timeout time.Duration, want string) QueueMessage {
+		t.Helper()
+		m, ok, err := store.Dequeue(ctx, queue, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || string(m.Body) != want {
+			t.Fatalf("want message %q, got %q (found: %t)", want, m.Body, ok)
+		}
+		return m
+	}
+	a := dequeue(time.Hour, "a")
+	b := dequeue(time.Hour, "b")
+	if err := store.AcknowledgeMessage(ctx, queue, b.ID, a.LeaseID); !errors.Is(err, ErrMessageNotLeased) {
+		t.Errorf("want message not leased acknowledging under another lease, got %v", err)
+	}
+	if err := store.AcknowledgeMessage(ctx, queue, b.ID, b.LeaseID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AcknowledgeMessage(ctx, queue, b.ID, b.LeaseID); !errors.Is(err, ErrMessageNotLeased) {
+		t.Errorf("want message not leased acknowledging twice, got %v", err)
+	}
+	if err := store.ReleaseMessage(ctx, queue, a.ID, a.LeaseID); err != nil {
+		t.Fatal(err)
+	}
+	a = dequeue(time.Hour, "a")
+	if err := store.AcknowledgeMessage(ctx, queue, a.ID, a.LeaseID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message whose lease expires becomes available again.
+	c := dequeue(10*time.Millisecond, "c")
+	for deadline := time.Now().Add(time.Second); ; {
+		m, ok, err := store.Dequeue(ctx, queue, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if m.ID != c.ID {
+				t.Fatalf("want message %d redelivered, got %d", c.ID, m.ID)
+			}
+			if err := store.AcknowledgeMessage(ctx, queue, c.ID, c.LeaseID); !errors.Is(err, ErrMessageNotLeased) {
+				t.Errorf("want message not leased acknowledging under expired lease, got %v", err)
+			}
+			c = m
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message leased under expired lease still hidden")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := store.AcknowledgeMessage(ctx, queue, c.ID, c.LeaseID); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok, err := store.Dequeue(ctx, queue, time.Hour); err != nil || ok {
+		t.Errorf("want no message from empty queue, got %q (found: %t), %v", m.Body, ok, err)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	ctx := context.Background()
+	store, err := MakeShardedStore(WithTopicRetention(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topic = "news"
+	publish := func(bodies ...string) {
+		t.Helper()
+		for _, body := range bodies {
+			if _, err := store.Publish(ctx, topic, Value(body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	receive := func(subscriber string, limit int) []string {
+		t.Helper()
+		messages, err := store.ReceiveFromTopic(ctx, topic, subscriber, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for _, m := range messages {
+			bodies = append(bodies, string(m.Body))
+		}
+		return bodies
+	}
+	publish("a", "b")
+	if got := receive("s1", 1); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("want %q, got %q", []string{"a"}, got)
+	}
+	// Each subscriber receives every message.
+	if got := receive("s2", 10); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("want %q, got %q", []string{"a", "b"}, got)
+	}
+	if got := receive("s1", 10); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("want %q, got %q", []string{"b"}, got)
+	}
+
+	// A subscriber waits for the next message.
+	received := make(chan []string)
+	go func() {
+		messages, err := store.ReceiveFromTopic(ctx, topic, "s1", 10)
+		if err != nil {
+			t.Error(err)
+		}
+		var bodies []string
+		for _, m := range messages {
+			bodies = append(bodies, string(m.Body))
+		}
+		received <- bodies
+	}()
+	select {
+	case got := <-received:
+		t.Fatalf("want subscriber to wait, got %q", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+	publish("c")
+	if got := <-received; !slices.Equal(got, []string{"c"}) {
+		t.Errorf("want %q after waiting, got %q", []string{"c"}, got)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.ReceiveFromTopic(timeoutCtx, topic, "s1", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded with no messages, got %v", err)
+	}
+
+	// A subscriber that falls behind the topic's retention skips the discarded messages.
+	publish("d", "e", "f")
+	if got := receive("s2", 10); !slices.Equal(got, []string{"d", "e", "f"}) {
+		t.Errorf("want %q, got %q", []string{"d", "e", "f"}, got)
+	}
+	if err := store.Unsubscribe(ctx, topic, "s2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive("s2", 10); !slices.Equal(got, []string{"d", "e", "f"}) {
+		t.Errorf("want %q after unsubscribing, got %q", []string{"d", "e", "f"}, got)
+	}
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// defaultTopicRetention is the number of messages that each topic retains unless overridden via
+// WithTopicRetention.
+const defaultTopicRetention = 1000
+
+// WithTopicRetention establishes the positive number of the most recent messages that each topic
+// retains for its subscribers (see ShardedStore.Publish). Publishing a message to a topic that
+// retains this many messages already discards the oldest of them, so that a subscriber that falls
+// further behind misses those it had yet to receive. The default is 1,000.
+func WithTopicRetention(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("topic retention must be positive")
+		}
+		o.topicRetention = uint64(n)
+		return nil
+	}
+}
+
+// The suffixes of the reserved keys of a topic's records.
+const (
+	topicHeadSuffix       = 'h'
+	topicTailSuffix       = 't'
+	topicMessageSuffix    = 'm'
+	topicSubscriberSuffix = 's'
+)
+
+// errEmptyTopicName indicates that a caller attempted to use a topic without a name.
+var errEmptyTopicName = errors.New("topic name must be nonempty")
+
+// errEmptySubscriberName indicates that a caller attempted to subscribe to a topic without a name.
+var errEmptySubscriberName = errors.New("subscriber name must be nonempty")
+
+// topicHeadKey returns the reserved key of the record storing the sequence number of the oldest
+// message that the named topic retains.
+func topicHeadKey(name string) Key {
+	return reservedKeyFor(topicKeyKind, Key(name), []byte{topicHeadSuffix})
+}
+
+// topicTailKey returns the reserved key of the record storing the sequence number to assign to the
+// next message published to the named topic. Subscribers watch this record for changes to learn of
+// new messages.
+func topicTailKey(name string) Key {
+	return reservedKeyFor(topicKeyKind, Key(name), []byte{topicTailSuffix})
+}
+
+// topicMessageKey returns the reserved key of the record storing the message with the given
+// sequence number in the named topic.
+func topicMessageKey(name string, sequence uint64) Key {
+	return reservedKeyFor(topicKeyKind, Key(name), binary.BigEndian.AppendUint64([]byte{topicMessageSuffix}, sequence))
+}
+
+// topicSubscriberKey returns the reserved key of the record storing the sequence number of the
+// next message in the named topic to deliver to the named subscriber. Only that subscriber writes
+// to this record, so that subscribers conflict neither with each other nor with publishers.
+func topicSubscriberKey(name, subscriber string) Key {
+	return reservedKeyFor(topicKeyKind, Key(name), append([]byte{topicSubscriberSuffix}, subscriber...))
+}
+
+// readTopicPosition retrieves the sequence number stored in the record with the given reserved
+// key, reporting whether such a record exists. The sequence number is one if not.
+func (t *shardedStoreTransaction) readTopicPosition(ctx context.Context, k Key) (uint64, bool, error) {
+	v, ok, err := t.readReserved(ctx, k)
+	if err != nil || !ok {
+		return 1, false, err
+	}
+	if len(v) != 8 {
+		return 0, false, errors.New("topic position is malformed")
+	}
+	return binary.BigEndian.Uint64(v), true, nil
+}
+
+func (t *shardedStoreTransaction) writeTopicPosition(ctx context.Context, k Key, sequence uint64) error {
+	return t.writeReserved(ctx, k, binary.BigEndian.AppendUint64(nil, sequence))
+}
+
+// TopicMessage is a message published to a topic (see ShardedStore.Publish).
+type TopicMessage struct {
+	// Sequence is the message's position within its topic, which starts at one and increases by
+	// one with each message published.
+	Sequence uint64
+	Body     Value
+}
+
+// Publish appends a message with the given body to the named topic, creating the topic if need be,
+// and returns the message's sequence number, so that each of the topic's subscribers receives the
+// message in turn (see ReceiveFromTopic). Like queues, topics occupy their own key space. Each
+// topic retains only its most recent messages (see WithTopicRetention).
+//
+// Since each message advances the topic's sequence, publishers to the same topic conflict with
+// each other, ensuring that subscribers receive the messages in the order in which they were
+// published, which suits low volumes of notifications rather than heavy streams of events.
+//
+// If the body fails validation, Publish returns ErrInvalidValue or ErrValueTooLarge.
+func (s *ShardedStore) Publish(ctx context.Context, topic string, body Value) (uint64, error) {
+	if len(topic) == 0 {
+		return 0, errEmptyTopicName
+	}
+	if err := s.validateValue(Key(topic), body); err != nil {
+		return 0, err
+	}
+	if body == nil {
+		// Distinguish an empty body from the absence of a message.
+		body = Value{}
+	}
+	var sequence uint64
+	err := s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+		tailKey := topicTailKey(topic)
+		var err error
+		if sequence, _, err = t.readTopicPosition(ctx, tailKey); err != nil {
+			return false, err
+		}
+		if err := t.writeReserved(ctx, topicMessageKey(topic, sequence), body); err != nil {
+			return false, err
+		}
+		tail := sequence + 1
+		if err := t.writeTopicPosition(ctx, tailKey, tail); err != nil {
+			return false, err
+		}
+		headKey := topicHeadKey(topic)
+		head, _, err := t.readTopicPosition(ctx, headKey)
+		if err != nil {
+			return false, err
+		}
+		if tail-head <= s.topicRetention {
+			return true, nil
+		}
+		for ; tail-head > s.topicRetention; head++ {
+			if err := t.writeReserved(ctx, topicMessageKey(topic, head), nil); err != nil {
+				return false, err
+			}
+		}
+		return true, t.writeTopicPosition(ctx, headKey, head)
+	})
+	return sequence, err
+}
+
+// ReceiveFromTopic retrieves up to the given positive number of the messages published to the
+// named topic that the named subscriber has yet to receive, in the order in which they were
+// published, waiting until at least one such message is available or the given Context is done.
+// The store tracks each subscriber's position within each topic, advancing it past the messages
+// that ReceiveFromTopic returns, so that every subscriber receives each message once. A subscriber
+// first receiving from a topic starts with the oldest message that the topic retains; one that
+// falls behind the topic's retention skips the messages discarded in the meantime.
+//
+// ReceiveFromTopic waits for messages by watching the topic for changes (see
+// WaitForRecordChange), so a subscriber can consume a topic by calling it repeatedly.
+func (s *ShardedStore) ReceiveFromTopic(ctx context.Context, topic, subscriber string, limit int) ([]TopicMessage, error) {
+	if len(topic) == 0 {
+		return nil, errEmptyTopicName
+	}
+	if len(subscriber) == 0 {
+		return nil, errEmptySubscriberName
+	}
+	if limit < 1 {
+		return nil, errors.New("topic receive limit must be positive")
+	}
+	tailKey := topicTailKey(topic)
+	for {
+		var messages []TopicMessage
+		var published transactionID
+		err := s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+			messages = nil
+			head, _, err := t.readTopicPosition(ctx, topicHeadKey(topic))
+			if err != nil {
+				return false, err
+			}
+			tail, _, err := t.readTopicPosition(ctx, tailKey)
+			if err != nil {
+				return false, err
+			}
+			subscriberKey := topicSubscriberKey(topic, subscriber)
+			next, ok, err := t.readTopicPosition(ctx, subscriberKey)
+			if err != nil {
+				return false, err
+			}
+			if !ok || next < head {
+				next = head
+			}
+			if next >= tail {
+				// Note when the latest message was published, so as to wait for the next one.
+				published, err = t.lastChangeOf(ctx, tailKey)
+				return false, err
+			}
+			for ; next < tail && len(messages) < limit; next++ {
+				v, ok, err := t.readReserved(ctx, topicMessageKey(topic, next))
+				if err != nil {
+					return false, err
+				}
+				if !ok {
+					return false, errors.New("topic message is missing")
+				}
+				m := TopicMessage{Sequence: next}
+				m.Body.CopyFrom(v)
+				messages = append(messages, m)
+			}
+			return true, t.writeTopicPosition(ctx, subscriberKey, next)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			return messages, nil
+		}
+		if _, err := s.WaitForRecordChange(ctx, tailKey, uint64(published)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Unsubscribe forgets the named subscriber's position within the named topic (see
+// ReceiveFromTopic), so that the subscriber would start anew with the oldest message that the
+// topic retains were it to receive from the topic again.
+func (s *ShardedStore) Unsubscribe(ctx context.Context, topic, subscriber string) error {
+	if len(topic) == 0 {
+		return errEmptyTopicName
+	}
+	if len(subscriber) == 0 {
+		return errEmptySubscriberName
+	}
+	return s.withinRetryingTransaction(ctx, func(ctx context.Context, t *shardedStoreTransaction) (bool, error) {
+		return true, t.writeReserved(ctx, topicSubscriberKey(topic, subscriber), nil)
+	})
+}
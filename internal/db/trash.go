@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WithTrashRetention directs the store to retain each deleted record in its trash for the given
+// positive duration, during which a later transaction may restore it (see Transaction.Undelete),
+// protecting against accidental deletion. By default, the store doesn't track deleted records.
+func WithTrashRetention(d time.Duration) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if d <= 0 {
+			return errors.New("trash retention duration must be positive")
+		}
+		o.trashRetention = d
+		return nil
+	}
+}
+
+type trashedRecord struct {
+	deletedBy transactionID
+	deletedAt time.Time
+}
+
+type trashEntry struct {
+	key string
+	trashedRecord
+}
+
+// trashTable tracks the records deleted recently enough to restore.
+type trashTable struct {
+	mu    sync.Mutex
+	byKey map[string]trashedRecord // NB: Initialized lazily
+	// queue holds the table's entries in the order in which they were deleted, along with
+	// entries since superseded in byKey, so that expiring them visits only the oldest ones.
+	queue []trashEntry
+}
+
+// expire removes the entries for records deleted before the given time. The caller must hold the
+// lock.
+func (tt *trashTable) expire(before time.Time) {
+	var i int
+	for ; i < len(tt.queue) && tt.queue[i].deletedAt.Before(before); i++ {
+		e := tt.queue[i]
+		if tt.byKey[e.key] == e.trashedRecord {
+			delete(tt.byKey, e.key)
+		}
+	}
+	if i > 0 {
+		tt.queue = append(tt.queue[:0], tt.queue[i:]...)
+	}
+}
+
+// lookup returns the entry for the record with the given key, if it's in the trash, expiring those
+// deleted longer than the given retention period before the given time.
+func (tt *trashTable) lookup(k Key, now time.Time, retention time.Duration) (trashedRecord, bool) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.expire(now.Add(-retention))
+	tr, ok := tt.byKey[string(k)]
+	return tr, ok
+}
+
+// trashedVersionOf returns the newest committed version of the given record if the transaction
+// with the given ID deleted it, or nil otherwise.
+func trashedVersionOf(record *versionedRecord, deletedBy transactionID) *recordVersion {
+	for r := record.newest.Load(); r != nil; r = r.next.Load() {
+		validAsOf := r.validAsOfTransactionID()
+		if validAsOf == noSuchTransaction {
+			// Another transaction is proposing to write this record.
+			continue
+		}
+		if r.validBeforeTransactionID() != deletedBy {
+			return nil
+		}
+		if validAsOf == deletedBy {
+			// This is a tombstone for a record that the same transaction inserted or updated
+			// before deleting it. Any value worth restoring lies in the version preceding it.
+			if prev := r.next.Load(); prev != nil && prev.validBeforeTransactionID() == deletedBy {
+				return prev
+			}
+			return nil
+		}
+		return r
+	}
+	return nil
+}
+
+// noteTrashedRecords moves the records that this transaction deleted upon committing into the
+// store's trash, and removes from the trash those that it wrote anew.
+func (t *shardedStoreTransaction) noteTrashedRecords() {
+	if len(t.pendingWrites) == 0 {
+		return
+	}
+	tt := &t.store.trash
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	// Take the time only now, so that the queue remains ordered by deletion time.
+	now := t.store.clock.Now()
+	tt.expire(now.Add(-t.store.trashRetention))
+	for k := range t.pendingWrites {
+		if isReservedKey(Key(k)) {
+			continue
+		}
+		var trashed bool
+		// Like transaction finalization, wait indefinitely to acquire the shard's lock.
+		if rm := t.store.readLockRecordMapFor(context.Background(), Key(k)); rm != nil {
+			record := rm.recordsByKey[k]
+			rm.lock.RUnlock()
+			trashed = record != nil && trashedVersionOf(record, t.id) != nil
+		}
+		if !trashed {
+			delete(tt.byKey, k)
+			continue
+		}
+		if tt.byKey == nil {
+			tt.byKey = make(map[string]trashedRecord)
+		}
+		tr := trashedRecord{
+			deletedBy: t.id,
+			deletedAt: now,
+		}
+		tt.byKey[k] = tr
+		tt.queue = append(tt.queue, trashEntry{k, tr})
+	}
+}
+
+func (t *shardedStoreTransaction) Undelete(ctx context.Context, k Key) error {
+	if err := t.aborted(); err != nil {
+		return err
+	}
+	if t.store.trashRetention == 0 {
+		return recordNotInTrashError(k)
+	}
+	tr, ok := t.store.trash.lookup(k, t.store.clock.Now(), t.store.trashRetention)
+	if !ok {
+		return recordNotInTrashError(k)
+	}
+	if tr.deletedBy > t.id {
+		// The record still exists from this transaction's perspective.
+		return transactionInConflictError(k)
+	}
+	rm, record, ok := t.recordFor(ctx, k)
+	if rm == nil {
+		return interruptedError(ctx, k)
+	}
+	var r *recordVersion
+	if ok {
+		r = trashedVersionOf(record, tr.deletedBy)
+	}
+	if r == nil {
+		return recordNotInTrashError(k)
+	}
+	v, err := t.store.openValue(k, r.value)
+	if err != nil {
+		return err
+	}
+	var m Metadata
+	if r.metadata != nil {
+		m = *r.metadata
+	}
+	return t.InsertWithMetadata(ctx, k, v, m)
+}
+
+// TrashedRecord describes a deleted record that a transaction may still restore (see
+// Transaction.Undelete).
+type TrashedRecord struct {
+	Key Key
+	// DeletedBy is the ID of the transaction that deleted the record.
+	DeletedBy uint64
+	// DeletedAt is when that transaction committed.
+	DeletedAt time.Time
+}
+
+// TrashedRecords describes the records in the store's trash, ordered by key. It returns no records
+// unless the store retains deleted records (see WithTrashRetention).
+//
+// TODO(seh): Once we "vacuum" deleted records, spare those still in the trash.
+func (s *ShardedStore) TrashedRecords() []TrashedRecord {
+	if s.trashRetention == 0 {
+		return nil
+	}
+	tt := &s.trash
+	tt.mu.Lock()
+	tt.expire(s.clock.Now().Add(-s.trashRetention))
+	trashed := make([]TrashedRecord, 0, len(tt.byKey))
+	for k, tr := range tt.byKey {
+		trashed = append(trashed, TrashedRecord{
+			Key:       Key(k),
+			DeletedBy: uint64(tr.deletedBy),
+			DeletedAt: tr.deletedAt,
+		})
+	}
+	tt.mu.Unlock()
+	sort.Slice(trashed, func(i, j int) bool {
+		return string(trashed[i].Key) < string(trashed[j].Key)
+	})
+	return trashed
+}
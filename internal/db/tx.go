@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"sync"
 	"sync/atomic"
 )
 
@@ -12,17 +14,61 @@ const (
 	guardAgainstOverflow               = true
 )
 
+// transactionIDBatchSize is the number of consecutive transaction IDs that a transactionState
+// claims from its counter at once, handing them out to transactions beginning on the same
+// processor so that they don't all contend to advance the counter.
+const transactionIDBatchSize = 64
+
 type transactionState struct {
-	latestID         atomic.Uint64
-	oldestFinishedID atomic.Uint64
+	// latestID is the greatest transaction ID claimed so far, including those claimed in batches
+	// but not yet handed out.
+	latestID          atomic.Uint64
+	oldestFinishedID  atomic.Uint64
+	latestCommittedID atomic.Uint64
+	// commits is the number of transactions that have committed changes. Since transactions may
+	// commit in a different order than their IDs, a commit need not advance latestCommittedID,
+	// so callers awaiting any further commit watch this count instead.
+	commits atomic.Uint64
+	// idBatches holds *transactionIDBatch values with IDs yet to hand out.
+	idBatches     sync.Pool
+	commitWaiters struct {
+		mu sync.Mutex
+		// committed is closed upon the next transaction committing changes, if any callers are
+		// waiting for that.
+		committed chan struct{}
+	}
+}
+
+// transactionIDBatch is a range of consecutive transaction IDs claimed at once.
+type transactionIDBatch struct {
+	next, last transactionID
 }
 
 func (s *transactionState) claimNext() transactionID {
-	next := transactionID(s.latestID.Add(1))
-	if guardAgainstOverflow && next == noSuchTransaction {
-		// TODO(seh): Consider a better way to handle this situation.
-		panic("database transaction ID sequence overflowed")
+	return s.claimNextAfter(noSuchTransaction)
+}
+
+// claimNextAfter claims an ID greater than the given one, and greater than that of every
+// transaction that committed changes before now, such that a transaction bearing the ID observes
+// all of those changes. Transactions that begin concurrently may claim IDs in a different order
+// than they began, as they may draw from different batches.
+func (s *transactionState) claimNextAfter(floor transactionID) transactionID {
+	floor = max(floor, transactionID(s.latestCommittedID.Load()))
+	b, _ := s.idBatches.Get().(*transactionIDBatch)
+	if b == nil {
+		b = new(transactionIDBatch)
 	}
+	if b.next <= floor || b.next > b.last {
+		last := transactionID(s.latestID.Add(transactionIDBatchSize))
+		if guardAgainstOverflow && last < transactionIDBatchSize {
+			// TODO(seh): Consider a better way to handle this situation.
+			panic("database transaction ID sequence overflowed")
+		}
+		b.next, b.last = last-transactionIDBatchSize+1, last
+	}
+	next := b.next
+	b.next++
+	s.idBatches.Put(b)
 	return next
 }
 
@@ -44,3 +90,62 @@ func (s *transactionState) recordFinished(id transactionID) bool {
 		}
 	}
 }
+
+// recordCommitted notes that the transaction with the given ID committed changes, advancing the
+// latest committed ID if it's newer than any seen so far, and waking any callers awaiting a
+// commit either way.
+func (s *transactionState) recordCommitted(id transactionID) {
+	for {
+		latest := s.latestCommittedID.Load()
+		if transactionID(latest) >= id || s.latestCommittedID.CompareAndSwap(latest, uint64(id)) {
+			break
+		}
+	}
+	w := &s.commitWaiters
+	w.mu.Lock()
+	s.commits.Add(1)
+	if w.committed != nil {
+		close(w.committed)
+		w.committed = nil
+	}
+	w.mu.Unlock()
+}
+
+// awaitCommitted blocks until a transaction with at least the given ID has committed changes, or
+// the given Context is done.
+func (s *transactionState) awaitCommitted(ctx context.Context, id transactionID) error {
+	return s.awaitCommit(ctx, func() bool {
+		return transactionID(s.latestCommittedID.Load()) >= id
+	})
+}
+
+// awaitCommitsBeyond blocks until more than the given number of transactions have committed
+// changes, regardless of their IDs, or the given Context is done.
+func (s *transactionState) awaitCommitsBeyond(ctx context.Context, n uint64) error {
+	return s.awaitCommit(ctx, func() bool {
+		return s.commits.Load() > n
+	})
+}
+
+// awaitCommit blocks until the given condition holds, checking it anew each time a transaction
+// commits changes, or until the given Context is done.
+func (s *transactionState) awaitCommit(ctx context.Context, satisfied func() bool) error {
+	w := &s.commitWaiters
+	for {
+		w.mu.Lock()
+		if satisfied() {
+			w.mu.Unlock()
+			return nil
+		}
+		if w.committed == nil {
+			w.committed = make(chan struct{})
+		}
+		committed := w.committed
+		w.mu.Unlock()
+		select {
+		case <-committed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package db
+
+import "context"
+
+type transactionContextKey struct{}
+
+// ContextWithTransaction returns a Context carrying the given transaction, so that code called
+// with that Context can join the transaction without it being passed explicitly. WithinTransaction
+// supplies such a Context to its transaction-consuming function.
+func ContextWithTransaction(ctx context.Context, tx Transaction) context.Context {
+	return context.WithValue(ctx, transactionContextKey{}, tx)
+}
+
+// TransactionFromContext returns the transaction supplied via ContextWithTransaction, if any.
+//
+// Callers must not use the returned transaction after the function to which WithinTransaction
+// supplied it returns.
+func TransactionFromContext(ctx context.Context) (Transaction, bool) {
+	tx, ok := ctx.Value(transactionContextKey{}).(Transaction)
+	return tx, ok
+}
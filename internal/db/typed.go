@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// A Codec converts values of a particular type to and from the byte vectors that the database
+// stores.
+type Codec[T any] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// StringCodec is a Codec that stores strings as their UTF-8-encoded bytes.
+type StringCodec struct{}
+
+var _ Codec[string] = StringCodec{}
+
+func (StringCodec) Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// JSONCodec is a Codec that stores values encoded as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// TypedStore wraps a ShardedStore, converting keys and values of particular types through the
+// given codecs, so that callers can work with their own types rather than byte vectors.
+type TypedStore[K comparable, V any] struct {
+	store      *ShardedStore
+	keyCodec   Codec[K]
+	valueCodec Codec[V]
+}
+
+// MakeTypedStore creates a TypedStore that reads and writes records in the given store, converting
+// their keys and values with the given codecs.
+func MakeTypedStore[K comparable, V any](store *ShardedStore, keyCodec Codec[K], valueCodec Codec[V]) (*TypedStore[K, V], error) {
+	if store == nil {
+		return nil, errors.New("store must be non-nil")
+	}
+	if keyCodec == nil {
+		return nil, errors.New("key codec must be non-nil")
+	}
+	if valueCodec == nil {
+		return nil, errors.New("value codec must be non-nil")
+	}
+	return &TypedStore[K, V]{
+		store:      store,
+		keyCodec:   keyCodec,
+		valueCodec: valueCodec,
+	}, nil
+}
+
+// WithinTransaction is like ShardedStore.WithinTransaction, but supplies the given function with
+// a TypedTransaction.
+func (s *TypedStore[K, V]) WithinTransaction(ctx context.Context, f func(context.Context, *TypedTransaction[K, V]) (commit bool, err error)) error {
+	if f == nil {
+		return errors.New("transaction-consuming function must be non-nil")
+	}
+	return s.store.WithinTransaction(ctx, func(ctx context.Context, tx Transaction) (bool, error) {
+		return f(ctx, &TypedTransaction[K, V]{
+			tx:    tx,
+			store: s,
+		})
+	})
+}
+
+// TypedTransaction is a Transaction that converts keys and values of particular types through its
+// TypedStore's codecs. Its methods behave like their counterparts in Transaction, but may also
+// fail if the codecs can't convert a key or value.
+type TypedTransaction[K comparable, V any] struct {
+	tx    Transaction
+	store *TypedStore[K, V]
+}
+
+// Untyped returns the underlying Transaction.
+func (t *TypedTransaction[K, V]) Untyped() Transaction {
+	return t.tx
+}
+
+func (t *TypedTransaction[K, V]) Get(ctx context.Context, k K) (V, error) {
+	var zero V
+	key, err := t.store.keyCodec.Encode(k)
+	if err != nil {
+		return zero, err
+	}
+	v, err := t.tx.Get(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+	return t.store.valueCodec.Decode(v)
+}
+
+func (t *TypedTransaction[K, V]) encode(k K, v V) (Key, Value, error) {
+	key, err := t.store.keyCodec.Encode(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := t.store.valueCodec.Encode(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+func (t *TypedTransaction[K, V]) Insert(ctx context.Context, k K, v V) error {
+	key, value, err := t.encode(k, v)
+	if err != nil {
+		return err
+	}
+	return t.tx.Insert(ctx, key, value)
+}
+
+func (t *TypedTransaction[K, V]) Update(ctx context.Context, k K, v V) error {
+	key, value, err := t.encode(k, v)
+	if err != nil {
+		return err
+	}
+	return t.tx.Update(ctx, key, value)
+}
+
+func (t *TypedTransaction[K, V]) Upsert(ctx context.Context, k K, v V) error {
+	key, value, err := t.encode(k, v)
+	if err != nil {
+		return err
+	}
+	return t.tx.Upsert(ctx, key, value)
+}
+
+func (t *TypedTransaction[K, V]) Delete(ctx context.Context, k K) (bool, error) {
+	key, err := t.store.keyCodec.Encode(k)
+	if err != nil {
+		return false, err
+	}
+	return t.tx.Delete(ctx, key)
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTypedStore(t *testing.T) {
+	type account struct {
+		Owner   string
+		Balance int
+	}
+	store, err := MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := MakeTypedStore[string, account](store, StringCodec{}, JSONCodec[account]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := accounts.WithinTransaction(ctx, func(ctx context.Context, tx *TypedTransaction[string, account]) (bool, error) {
+		return true, tx.Insert(ctx, "a1", account{Owner: "ann", Balance: 10})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.WithinTransaction(ctx, func(ctx context.Context, tx *TypedTransaction[string, account]) (bool, error) {
+		a, err := tx.Get(ctx, "a1")
+		if err != nil {
+			return false, err
+		}
+		a.Balance -= 3
+		return true, tx.Update(ctx, "a1", a)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	confirmRecordIsPresent(ctx, t, store, Key("a1"), Value(`{"Owner":"ann","Balance":7}`))
+	if err := accounts.WithinTransaction(ctx, func(ctx context.Context, tx *TypedTransaction[string, account]) (bool, error) {
+		_, err := tx.Get(ctx, "a2")
+		return false, err
+	}); !errors.Is(err, ErrRecordDoesNotExist) {
+		t.Fatalf("want record does not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// NamespaceUsage meters how transactions have used a namespace, such as to charge the tenant that
+// owns it in a shared deployment.
+type NamespaceUsage struct {
+	// Name is the name of the namespace.
+	Name string
+	// Reads is the number of records that transactions retrieved from the namespace, whether
+	// individually or by scanning.
+	Reads uint64
+	// Writes is the number of records that transactions inserted, updated, or upserted within the
+	// namespace.
+	Writes uint64
+	// Deletes is the number of records that transactions deleted from the namespace.
+	Deletes uint64
+	// BytesRead is the combined size of the keys and values of the records that transactions
+	// retrieved from the namespace.
+	BytesRead uint64
+	// BytesWritten is the combined size of the keys and values of the records that transactions
+	// wrote within the namespace.
+	BytesWritten uint64
+	// Records is the number of records that the namespace holds.
+	Records int
+	// BytesStored is the combined size of the keys and stored values of the records that the
+	// namespace holds.
+	BytesStored int64
+}
+
+// namespaceMeter accumulates the counters of a NamespaceUsage.
+type namespaceMeter struct {
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+	deletes      atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+// namespaceMeters holds the meter for each namespace that transactions have used.
+type namespaceMeters struct {
+	byName sync.Map // string -> *namespaceMeter
+}
+
+func (m *namespaceMeters) meterFor(name string) *namespaceMeter {
+	if nm, ok := m.byName.Load(name); ok {
+		return nm.(*namespaceMeter)
+	}
+	nm, _ := m.byName.LoadOrStore(name, &namespaceMeter{})
+	return nm.(*namespaceMeter)
+}
+
+func (nm *namespaceMeter) noteRead(k Key, v Value) {
+	nm.reads.Add(1)
+	nm.bytesRead.Add(uint64(len(k) + len(v)))
+}
+
+func (nm *namespaceMeter) noteWrite(k Key, v Value) {
+	nm.writes.Add(1)
+	nm.bytesWritten.Add(uint64(len(k) + len(v)))
+}
+
+// NamespaceUsage meters each namespace that exists or that transactions have used since the store
+// was created, sorted by name. It counts operations that succeeded, whether or not their
+// transactions committed, and retains the counters for a namespace after its deletion, continuing
+// them should a namespace of the same name arise again. It measures the records that each
+// namespace holds as of a single point in time.
+func (s *ShardedStore) NamespaceUsage(ctx context.Context) ([]NamespaceUsage, error) {
+	usage := make(map[string]*NamespaceUsage)
+	s.namespaceMeters.byName.Range(func(name, nm any) bool {
+		m := nm.(*namespaceMeter)
+		usage[name.(string)] = &NamespaceUsage{
+			Name:         name.(string),
+			Reads:        m.reads.Load(),
+			Writes:       m.writes.Load(),
+			Deletes:      m.deletes.Load(),
+			BytesRead:    m.bytesRead.Load(),
+			BytesWritten: m.bytesWritten.Load(),
+		}
+		return true
+	})
+	if err := s.withinSnapshot(ctx, func(ctx context.Context, tx *shardedStoreTransaction) error {
+		names := slices.Collect(tx.Namespaces(ctx))
+		if tx.deferredErr != nil {
+			return tx.deferredErr
+		}
+		for _, name := range names {
+			u, ok := usage[name]
+			if !ok {
+				u = &NamespaceUsage{Name: name}
+				usage[name] = u
+			}
+			prefix := namespacedKey(name, nil)
+			if err := tx.forEachVisibleRecord(ctx, prefix, func(k Key, r *recordVersion) error {
+				u.Records++
+				u.BytesStored += int64(len(k) - len(prefix) + len(r.value))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	result := make([]NamespaceUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	slices.SortFunc(result, func(a, b NamespaceUsage) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// A ValueValidator inspects a value proposed for a record to be written to the database with the
+// given key, returning a non-nil error if the value is not acceptable.
+type ValueValidator func(Key, Value) error
+
+type prefixedValueValidator struct {
+	prefix    Key
+	validator ValueValidator
+}
+
+// WithValueValidator establishes a function with which to validate the value for each record to
+// be inserted, updated, or upserted with a key starting with the given prefix, so that deployments
+// can reject malformed values at the store's boundary rather than leaving them to confuse the
+// programs that read them later. An empty prefix subjects every record to validation. Supplying
+// this option more than once requires that values satisfy all the validators whose prefixes match
+// their keys, consulted in the order supplied. Within a namespace, the prefixes match the keys that
+// callers choose for the namespace's records.
+//
+// Attempts to write records with values that fail validation fail with ErrInvalidValue.
+func WithValueValidator(prefix Key, v ValueValidator) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if v == nil {
+			return errors.New("value validator must be non-nil")
+		}
+		o.valueValidators = append(o.valueValidators, prefixedValueValidator{
+			prefix:    bytes.Clone(prefix),
+			validator: v,
+		})
+		return nil
+	}
+}
+
+// WithMaxValueSize establishes the positive number of bytes that the value of each record written
+// to the store may not exceed. Attempts to write records with larger values fail with
+// ErrValueTooLarge. By default, values may be of any size.
+func WithMaxValueSize(n int) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if n < 1 {
+			return errors.New("maximum value size must be positive")
+		}
+		o.maxValueSize = n
+		return nil
+	}
+}
+
+// ValueMustBeJSON is a ValueValidator that rejects values that are not well-formed JSON documents.
+func ValueMustBeJSON(_ Key, v Value) error {
+	if !json.Valid(v) {
+		return errors.New("value must be a well-formed JSON document")
+	}
+	return nil
+}
+
+func (s *ShardedStore) validateValue(k Key, v Value) error {
+	if s.maxValueSize > 0 && len(v) > s.maxValueSize {
+		return &valueTooLargeError{key: string(k), size: len(v), limit: s.maxValueSize}
+	}
+	for _, pv := range s.valueValidators {
+		if !bytes.HasPrefix(k, pv.prefix) {
+			continue
+		}
+		if err := pv.validator(k, v); err != nil {
+			return &invalidValueError{key: string(k), err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// ValueRef is an immutable reference to a record's value, which the store can share among record
+// versions and readers without copying it. Unlike a Value, a ValueRef remains valid beyond the
+// transaction in which it was retrieved.
+type ValueRef struct {
+	v Value
+	// borrowed indicates that the referenced buffer belongs to a caller that may still modify it,
+	// so that the store must copy it rather than share it.
+	borrowed bool
+}
+
+// NewValueRef returns a reference to a copy of the given value, leaving the caller free to modify
+// the value afterward.
+func NewValueRef(v Value) ValueRef {
+	var owned Value
+	owned.CopyFrom(v)
+	return ValueRef{v: owned}
+}
+
+// AdoptValueRef returns a reference to the given value without copying it. The caller must not
+// modify the value afterward, since the store and its readers may share its buffer.
+func AdoptValueRef(v Value) ValueRef {
+	return ValueRef{v: v}
+}
+
+// borrowValueRef returns a reference to the given value that the store must copy before storing.
+func borrowValueRef(v Value) ValueRef {
+	return ValueRef{v: v, borrowed: true}
+}
+
+// Len returns the length of the referenced value in bytes.
+func (r ValueRef) Len() int {
+	return len(r.v)
+}
+
+// String returns the referenced value's content as a string.
+func (r ValueRef) String() string {
+	return string(r.v)
+}
+
+// Equal reports whether the referenced value has the same content as the given value.
+func (r ValueRef) Equal(v Value) bool {
+	return bytes.Equal(r.v, v)
+}
+
+// AppendTo appends the referenced value's content to the given byte slice, returning the extended
+// slice.
+func (r ValueRef) AppendTo(dst []byte) []byte {
+	return append(dst, r.v...)
+}
+
+// WriteTo writes the referenced value's content to the given writer.
+func (r ValueRef) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.v)
+	return int64(n), err
+}
+
+// CopyInto copies the referenced value's content into the given value, which must not be nil,
+// like Value.CopyInto.
+func (r ValueRef) CopyInto(o *Value) int {
+	return copyInto(o, r.v)
+}
+
+// CopyFromRef copies the content of the value to which the given reference refers into this value,
+// like CopyFrom.
+func (v *Value) CopyFromRef(r ValueRef) int {
+	return copyInto(v, r.v)
+}
+
+// proposeValue stores the given value for the record with the given key into the given record
+// version, sharing the value's buffer rather than copying it if the reference permits that and the
+// store neither seals nor interns its values.
+func (s *ShardedStore) proposeValue(r *recordVersion, k Key, v ValueRef) {
+	if r.valueShared {
+		// Never write into a buffer that a ValueRef may share.
+		r.value = nil
+		r.valueShared = false
+	}
+	if v.borrowed || s.valueSealer != nil || s.valueInterner != nil {
+		s.sealValueInto(&r.value, k, v.v)
+		return
+	}
+	r.value = v.v
+	r.valueShared = true
+}
+
+func (t *shardedStoreTransaction) GetValueRef(ctx context.Context, k Key) (ValueRef, uint64, error) {
+	v, version, err := t.GetVersioned(ctx, k)
+	if err != nil {
+		return ValueRef{}, 0, err
+	}
+	switch id := transactionID(version); {
+	case t.store.valueSealer != nil:
+		// Opening the sealed value yielded a buffer of its own.
+		return ValueRef{v: v}, version, nil
+	case id != noSuchTransaction && id < t.id:
+		// The store never modifies committed record versions' values in place.
+		return ValueRef{v: v}, version, nil
+	default:
+		// This transaction proposed or loaded the value, and may modify it in place later.
+		return NewValueRef(v), version, nil
+	}
+}
+
+func (t *shardedStoreTransaction) InsertValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	return t.insertWithMetadata(ctx, k, v, m)
+}
+
+func (t *shardedStoreTransaction) UpdateValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	return t.updateWithMetadata(ctx, k, v, m)
+}
+
+func (t *shardedStoreTransaction) UpsertValueRef(ctx context.Context, k Key, v ValueRef, m Metadata) error {
+	return t.upsertWithMetadata(ctx, k, v, m)
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FinalizationStall describes a transaction whose commit or rollback has waited longer than
+// expected to acquire the lock for a shard while finalizing its changes to a record.
+type FinalizationStall struct {
+	// TransactionID identifies the stalled transaction.
+	TransactionID uint64
+	// Shard is the index of the shard whose lock the transaction is waiting to acquire.
+	Shard int
+	// Key is the key of the record the transaction is trying to finalize.
+	Key Key
+	// Waited is how long the transaction had waited when the stall was detected.
+	Waited time.Duration
+	// Abandoned indicates whether the store gave up waiting, failing the store as a result.
+	Abandoned bool
+}
+
+type finalizationWatchdog struct {
+	threshold time.Duration
+	report    func(FinalizationStall)
+	abandon   bool
+}
+
+// WithFinalizationWatchdog establishes a watchdog that detects when finalizing a transaction's
+// changes has waited longer than the given positive threshold to acquire a shard's lock, reporting
+// each such stall to the given function. Since finalization does not honor the transaction's
+// governing Context, a wedged shard lock would otherwise stall committing transactions silently
+// forever.
+//
+// If abandon is true, the watchdog also directs the stalled transaction to give up waiting. Since
+// doing so may leave the database in an inconsistent state, the store then fails, such that all
+// subsequent attempts to use it fail with ErrStoreFailed.
+func WithFinalizationWatchdog(threshold time.Duration, report func(FinalizationStall), abandon bool) ShardedStoreOption {
+	return func(o *shardedStoreOptions) error {
+		if threshold <= 0 {
+			return errors.New("finalization watchdog threshold must be positive")
+		}
+		if report == nil {
+			return errors.New("finalization stall reporting function must be non-nil")
+		}
+		o.finalizationWatchdog = &finalizationWatchdog{
+			threshold: threshold,
+			report:    report,
+			abandon:   abandon,
+		}
+		return nil
+	}
+}
+
+// failure returns the error with which the store failed, if any, or ErrStoreClosed if the store
+// is closed.
+func (s *ShardedStore) failure() error {
+	if err := s.failed.Load(); err != nil {
+		return err
+	}
+	if s.closed.Load() {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+func (s *ShardedStore) fail(err error) {
+	s.failed.CompareAndSwap(nil, &storeFailedError{err: err})
+}
+
+// recordsForFinalizing looks up the records with the given keys within their shard, acquiring
+// the shard's lock only once, and returning nil for each key with no such record. Unlike
+// recordFor, it waits indefinitely to acquire the shard's lock, unless the store's finalization
+// watchdog intervenes, in which case it returns no records.
+func (t *shardedStoreTransaction) recordsForFinalizing(group shardKeys) []*versionedRecord {
+	ctx := context.Background()
+	if w := t.store.watchdog; w != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		clock := t.store.clock
+		start := clock.Now()
+		k := group.keys[0]
+		timer := clock.AfterFunc(w.threshold, func() {
+			w.report(FinalizationStall{
+				TransactionID: uint64(t.id),
+				Shard:         group.shard,
+				Key:           k,
+				Waited:        clock.Now().Sub(start),
+				Abandoned:     w.abandon,
+			})
+			if w.abandon {
+				t.store.fail(fmt.Errorf("transaction with ID %d abandoned finalizing record with key %q after waiting on shard %d", t.id, k, group.shard))
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+	rm := &t.store.recordMaps[group.shard]
+	records := make([]*versionedRecord, len(group.keys))
+	if !rm.lock.TryRLockUntil(ctx) {
+		return records
+	}
+	for i, k := range group.keys {
+		records[i] = rm.recordsByKey[string(k)]
+	}
+	rm.lock.RUnlock()
+	for i, k := range group.keys {
+		if records[i] != nil {
+			continue
+		}
+		// The store may have migrated the record to another shard since grouping these keys.
+		if rm := t.store.readLockRecordMapFor(ctx, k); rm != nil {
+			records[i] = rm.recordsByKey[string(k)]
+			rm.lock.RUnlock()
+		}
+	}
+	return records
+}
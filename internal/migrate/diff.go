@@ -0,0 +1,139 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// A RecordSource supplies each of a set of records to the given RecordConsumer, such as by reading
+// them from a file, returning the first error that either reading or the consumer reports.
+type RecordSource func(RecordConsumer) error
+
+// DifferenceKind identifies how a record differs between two sets of records.
+type DifferenceKind uint8
+
+const (
+	// Added describes a record present only in the later set.
+	Added DifferenceKind = iota + 1
+	// Removed describes a record present only in the earlier set.
+	Removed
+	// Changed describes a record present in both sets with different values.
+	Changed
+)
+
+func (k DifferenceKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	default:
+		return "unknown"
+	}
+}
+
+// Difference describes a record that differs between two sets of records.
+type Difference struct {
+	Key  []byte
+	Kind DifferenceKind
+}
+
+// Comparison describes how two sets of records differ (see CompareRecords).
+type Comparison struct {
+	// Differences are the records that differ between the sets, sorted by key.
+	Differences []Difference
+	// Unchanged is the number of records present in both sets with the same value.
+	Unchanged int
+}
+
+// CompareRecords reports which records were added, removed, or changed between the earlier set of
+// records and the later one, such as to confirm that a backup or a migration preserved a store's
+// content. It compares only the records' keys and values, as versions differ between stores
+// holding the same records. It retains a digest of each record in the earlier set while reading
+// the later one, so that the sets needn't be sorted.
+//
+// If either set contains more than one record with the same key, CompareRecords returns an error.
+func CompareRecords(earlier, later RecordSource) (Comparison, error) {
+	digests := make(map[string][sha256.Size]byte)
+	if err := earlier(func(key, value []byte) error {
+		if _, ok := digests[string(key)]; ok {
+			return fmt.Errorf("earlier set has more than one record with key %q", key)
+		}
+		digests[string(key)] = sha256.Sum256(value)
+		return nil
+	}); err != nil {
+		return Comparison{}, err
+	}
+	var c Comparison
+	seen := make(map[string]struct{}, len(digests))
+	if err := later(func(key, value []byte) error {
+		if _, ok := seen[string(key)]; ok {
+			return fmt.Errorf("later set has more than one record with key %q", key)
+		}
+		seen[string(key)] = struct{}{}
+		digest, ok := digests[string(key)]
+		switch {
+		case !ok:
+			c.Differences = append(c.Differences, Difference{Key: bytes.Clone(key), Kind: Added})
+		case digest != sha256.Sum256(value):
+			c.Differences = append(c.Differences, Difference{Key: bytes.Clone(key), Kind: Changed})
+		default:
+			c.Unchanged++
+		}
+		return nil
+	}); err != nil {
+		return Comparison{}, err
+	}
+	for k := range digests {
+		if _, ok := seen[k]; !ok {
+			c.Differences = append(c.Differences, Difference{Key: []byte(k), Kind: Removed})
+		}
+	}
+	slices.SortFunc(c.Differences, func(a, b Difference) int {
+		return bytes.Compare(a.Key, b.Key)
+	})
+	return c, nil
+}
+
+// exportCSVHeader is the header row of the CSV dumps that the server writes.
+var exportCSVHeader = []string{"key", "version", "content_type", "value"}
+
+// ReadExportCSV reads the records from a CSV dump written by this database's server (see the
+// "/admin/export" administrative request), supplying each record's key and value to the given
+// RecordConsumer, so that dumps can serve as snapshots of a store's content.
+func ReadExportCSV(r io.Reader, consume RecordConsumer) (Summary, error) {
+	var summary Summary
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(exportCSVHeader)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("CSV dump lacks a header row")
+		}
+		return summary, err
+	}
+	if !slices.Equal(header, exportCSVHeader) {
+		return summary, fmt.Errorf("CSV dump has unexpected header row %q", header)
+	}
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if err := consume([]byte(row[0]), []byte(row[3])); err != nil {
+			return summary, err
+		}
+		summary.Records++
+	}
+}
@@ -0,0 +1,272 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+)
+
+// etcd stores its snapshots as bbolt database files, holding each revision of each key within
+// the "key" bucket, keyed by the revision.
+
+const (
+	boltMagic          = 0xED0CDAED
+	boltPageHeaderSize = 16
+	boltElementSize    = 16
+	// boltMetaSize is the size of the fields of a meta page preceding its checksum.
+	boltMetaSize = 56
+	// boltMinPageSize is the smallest page size that bbolt uses, within which the meta pages fit.
+	boltMinPageSize = 1024
+
+	boltBranchPageFlag = 0x01
+	boltLeafPageFlag   = 0x02
+	boltMetaPageFlag   = 0x04
+	boltBucketLeafFlag = 0x01
+)
+
+// etcdKeyBucket is the name of the bbolt bucket in which etcd stores its keys' revisions.
+const etcdKeyBucket = "key"
+
+// etcdRevisionKeyLength is the length of the bbolt key identifying a revision: a main revision, a
+// separator, and a sub-revision. A trailing marker follows for revisions that delete a key.
+const etcdRevisionKeyLength = 17
+
+type boltFile struct {
+	r        io.ReaderAt
+	pageSize int
+}
+
+// slice returns n bytes of b starting at the given offset, or an error if b is too short.
+func slice(b []byte, offset, n int) ([]byte, error) {
+	if offset < 0 || n < 0 || offset > len(b) || len(b)-offset < n {
+		return nil, errors.New("bbolt page is truncated")
+	}
+	return b[offset : offset+n], nil
+}
+
+func (f *boltFile) page(id uint64) ([]byte, error) {
+	p := make([]byte, f.pageSize)
+	if _, err := f.r.ReadAt(p, int64(id)*int64(f.pageSize)); err != nil {
+		return nil, fmt.Errorf("failed to read bbolt page %d: %w", id, err)
+	}
+	if overflow := binary.LittleEndian.Uint32(p[12:]); overflow > 0 {
+		// TODO(seh): Bound this by the file's size.
+		p = slices.Grow(p, int(overflow)*f.pageSize)[:(1+int(overflow))*f.pageSize]
+		if _, err := f.r.ReadAt(p[f.pageSize:], int64(id+1)*int64(f.pageSize)); err != nil {
+			return nil, fmt.Errorf("failed to read overflow of bbolt page %d: %w", id, err)
+		}
+	}
+	return p, nil
+}
+
+type boltMeta struct {
+	pageSize int
+	root     uint64
+	txID     uint64
+}
+
+// readBoltMeta interprets the meta page at the given offset, returning false if it's not valid.
+func readBoltMeta(r io.ReaderAt, offset int64) (boltMeta, bool) {
+	p := make([]byte, boltPageHeaderSize+boltMetaSize+8)
+	if _, err := r.ReadAt(p, offset); err != nil {
+		return boltMeta{}, false
+	}
+	if binary.LittleEndian.Uint16(p[8:])&boltMetaPageFlag == 0 {
+		return boltMeta{}, false
+	}
+	m := p[boltPageHeaderSize:]
+	if binary.LittleEndian.Uint32(m) != boltMagic {
+		return boltMeta{}, false
+	}
+	h := fnv.New64a()
+	h.Write(m[:boltMetaSize])
+	if h.Sum64() != binary.LittleEndian.Uint64(m[boltMetaSize:]) {
+		return boltMeta{}, false
+	}
+	return boltMeta{
+		pageSize: int(binary.LittleEndian.Uint32(m[8:])),
+		root:     binary.LittleEndian.Uint64(m[16:]),
+		txID:     binary.LittleEndian.Uint64(m[48:]),
+	}, true
+}
+
+// forEachInPage calls the given function for each entry in the leaves of the tree rooted at the
+// given page, in key order, supplying the entry's flags.
+func (f *boltFile) forEachInPage(p []byte, depth int, fn func(k, v []byte, flags uint32) error) error {
+	if depth > 64 {
+		return errors.New("bbolt tree is too deep")
+	}
+	header, err := slice(p, 0, boltPageHeaderSize)
+	if err != nil {
+		return err
+	}
+	flags, count := binary.LittleEndian.Uint16(header[8:]), int(binary.LittleEndian.Uint16(header[10:]))
+	for i := range count {
+		offset := boltPageHeaderSize + i*boltElementSize
+		e, err := slice(p, offset, boltElementSize)
+		if err != nil {
+			return err
+		}
+		switch {
+		case flags&boltBranchPageFlag != 0:
+			child, err := f.page(binary.LittleEndian.Uint64(e[8:]))
+			if err != nil {
+				return err
+			}
+			if err := f.forEachInPage(child, depth+1, fn); err != nil {
+				return err
+			}
+		case flags&boltLeafPageFlag != 0:
+			pos := int(binary.LittleEndian.Uint32(e[4:]))
+			kSize := int(binary.LittleEndian.Uint32(e[8:]))
+			vSize := int(binary.LittleEndian.Uint32(e[12:]))
+			kv, err := slice(p, offset+pos, kSize+vSize)
+			if err != nil {
+				return err
+			}
+			if err := fn(kv[:kSize], kv[kSize:], binary.LittleEndian.Uint32(e)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected bbolt page flags %#x", flags)
+		}
+	}
+	return nil
+}
+
+// forEachInBucket calls the given function for each entry in the bucket with the given value.
+func (f *boltFile) forEachInBucket(bucket []byte, fn func(k, v []byte, flags uint32) error) error {
+	if len(bucket) < 16 {
+		return errors.New("bbolt bucket is truncated")
+	}
+	root := binary.LittleEndian.Uint64(bucket)
+	if root == 0 {
+		// The bucket's single page follows inline.
+		return f.forEachInPage(bucket[16:], 0, fn)
+	}
+	p, err := f.page(root)
+	if err != nil {
+		return err
+	}
+	return f.forEachInPage(p, 0, fn)
+}
+
+// decodeEtcdKeyValue extracts the key and value from an etcd mvccpb.KeyValue message encoded as
+// a protocol buffer.
+func decodeEtcdKeyValue(b []byte) (key, value []byte, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("protocol buffer field tag is malformed")
+		}
+		b = b[n:]
+		switch field, wireType := tag>>3, tag&7; wireType {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return nil, nil, errors.New("protocol buffer varint is malformed")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, nil, errors.New("protocol buffer fixed64 is truncated")
+			}
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, nil, errors.New("protocol buffer length-delimited field is malformed")
+			}
+			content := b[n : n+int(length)]
+			switch field {
+			case 1:
+				key = content
+			case 5:
+				value = content
+			}
+			b = b[n+int(length):]
+		case 5:
+			if len(b) < 4 {
+				return nil, nil, errors.New("protocol buffer fixed32 is truncated")
+			}
+			b = b[4:]
+		default:
+			return nil, nil, fmt.Errorf("unsupported protocol buffer wire type %d", wireType)
+		}
+	}
+	return key, value, nil
+}
+
+// ReadEtcdSnapshot reads an etcd snapshot file, such as one written by "etcdctl snapshot save",
+// supplying each key's value as of the snapshot's latest revision to the given function, in key
+// order. Since etcd stores every revision of each key that has yet to be compacted away, it
+// replays those revisions to determine the keys' latest values, retaining those values in memory
+// before supplying them.
+func ReadEtcdSnapshot(r io.ReaderAt, consume RecordConsumer) (Summary, error) {
+	var summary Summary
+	var meta boltMeta
+	var found bool
+	// The two meta pages alternate, the newer of them being current, unless it's corrupt.
+	if m, ok := readBoltMeta(r, 0); ok {
+		meta, found = m, true
+	}
+	if found && meta.pageSize >= boltMinPageSize {
+		if m, ok := readBoltMeta(r, int64(meta.pageSize)); ok && m.txID > meta.txID {
+			meta = m
+		}
+	}
+	if !found || meta.pageSize < boltMinPageSize {
+		return summary, errors.New("file is not an etcd snapshot in bbolt format")
+	}
+	f := boltFile{r, meta.pageSize}
+	root, err := f.page(meta.root)
+	if err != nil {
+		return summary, err
+	}
+	var keyBucket []byte
+	if err := f.forEachInPage(root, 0, func(k, v []byte, flags uint32) error {
+		if flags&boltBucketLeafFlag != 0 && string(k) == etcdKeyBucket {
+			keyBucket = bytes.Clone(v)
+		}
+		return nil
+	}); err != nil {
+		return summary, err
+	}
+	if keyBucket == nil {
+		return summary, fmt.Errorf("snapshot lacks bucket %q", etcdKeyBucket)
+	}
+	latest := make(map[string][]byte)
+	if err := f.forEachInBucket(keyBucket, func(revision, kv []byte, _ uint32) error {
+		if len(revision) < etcdRevisionKeyLength {
+			return fmt.Errorf("revision key %x is malformed", revision)
+		}
+		key, value, err := decodeEtcdKeyValue(kv)
+		if err != nil {
+			return fmt.Errorf("revision %x is malformed: %w", revision, err)
+		}
+		if len(revision) > etcdRevisionKeyLength {
+			// This revision deleted the key.
+			delete(latest, string(key))
+		} else {
+			latest[string(key)] = bytes.Clone(value)
+		}
+		return nil
+	}); err != nil {
+		return summary, err
+	}
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if err := consume([]byte(k), latest[k]); err != nil {
+			return summary, err
+		}
+		summary.Records++
+	}
+	return summary, nil
+}
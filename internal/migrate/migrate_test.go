@@ -0,0 +1,239 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func collectRecords(records map[string]string) RecordConsumer {
+	return func(key, value []byte) error {
+		records[string(key)] = string(value)
+		return nil
+	}
+}
+
+func appendRDBString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+func TestReadRedisRDB(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := []byte("REDIS0011")
+	b = append(b, rdbOpAux)
+	b = appendRDBString(b, "redis-ver")
+	b = appendRDBString(b, "7.2.0")
+	b = append(b, rdbOpSelectDB, 0, rdbOpResizeDB, 5, 1)
+	// A plain string.
+	b = append(b, rdbTypeString)
+	b = appendRDBString(b, "plain")
+	b = appendRDBString(b, "hello")
+	// An integer stored in two bytes.
+	b = append(b, rdbTypeString)
+	b = appendRDBString(b, "count")
+	b = append(b, 0xC1, 0x39, 0x30)
+	// A string compressed with LZF: a literal "ab" followed by a reference repeating it.
+	b = append(b, rdbTypeString)
+	b = appendRDBString(b, "compressed")
+	b = append(b, 0xC3, 5, 6, 0x01, 'a', 'b', 0x40, 0x01)
+	// A string that already expired.
+	b = append(b, rdbOpExpireTimeMS)
+	b = binary.LittleEndian.AppendUint64(b, uint64(now.Add(-time.Minute).UnixMilli()))
+	b = append(b, rdbTypeString)
+	b = appendRDBString(b, "expired")
+	b = appendRDBString(b, "gone")
+	// A string that expires later.
+	b = append(b, rdbOpExpireTime)
+	b = binary.LittleEndian.AppendUint32(b, uint32(now.Add(time.Hour).Unix()))
+	b = append(b, rdbTypeString)
+	b = appendRDBString(b, "expiring")
+	b = appendRDBString(b, "soon")
+	// A list, which has no representation as a record.
+	b = append(b, rdbTypeList)
+	b = appendRDBString(b, "list")
+	b = append(b, 2)
+	b = appendRDBString(b, "x")
+	b = appendRDBString(b, "y")
+	// A string in another logical database.
+	b = append(b, rdbOpSelectDB, 1, rdbTypeString)
+	b = appendRDBString(b, "elsewhere")
+	b = appendRDBString(b, "ignored")
+	b = append(b, rdbOpEOF)
+	b = append(b, make([]byte, 8)...)
+
+	records := make(map[string]string)
+	summary, err := ReadRedisRDB(bytes.NewReader(b), 0, now, collectRecords(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"plain":      "hello",
+		"count":      "12345",
+		"compressed": "ababab",
+		"expiring":   "soon",
+	}
+	if !reflect.DeepEqual(want, records) {
+		t.Errorf("records: want %v, got %v", want, records)
+	}
+	if want, got := (Summary{Records: 4, Skipped: 2}), summary; want != got {
+		t.Errorf("summary: want %+v, got %+v", want, got)
+	}
+
+	if _, err := ReadRedisRDB(bytes.NewReader(b[:len(b)-20]), 0, now, collectRecords(records)); err == nil {
+		t.Error("want error reading truncated file")
+	}
+	if _, err := ReadRedisRDB(bytes.NewReader([]byte("NOTREDIS1")), 0, now, collectRecords(records)); err == nil {
+		t.Error("want error reading file in another format")
+	}
+}
+
+const testBoltPageSize = 4096
+
+// boltEntry is an entry in a bbolt leaf page.
+type boltEntry struct {
+	key, value []byte
+	flags      uint32
+}
+
+func makeBoltLeafPage(id uint64, entries []boltEntry) []byte {
+	p := make([]byte, boltPageHeaderSize+len(entries)*boltElementSize, testBoltPageSize)
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], boltLeafPageFlag)
+	binary.LittleEndian.PutUint16(p[10:], uint16(len(entries)))
+	for i, e := range entries {
+		offset := boltPageHeaderSize + i*boltElementSize
+		binary.LittleEndian.PutUint32(p[offset:], e.flags)
+		binary.LittleEndian.PutUint32(p[offset+4:], uint32(len(p)-offset))
+		binary.LittleEndian.PutUint32(p[offset+8:], uint32(len(e.key)))
+		binary.LittleEndian.PutUint32(p[offset+12:], uint32(len(e.value)))
+		p = append(p, e.key...)
+		p = append(p, e.value...)
+	}
+	return p[:testBoltPageSize]
+}
+
+func makeBoltMetaPage(id, root, txID uint64) []byte {
+	p := make([]byte, testBoltPageSize)
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], boltMetaPageFlag)
+	m := p[boltPageHeaderSize:]
+	binary.LittleEndian.PutUint32(m, boltMagic)
+	binary.LittleEndian.PutUint32(m[4:], 2)
+	binary.LittleEndian.PutUint32(m[8:], testBoltPageSize)
+	binary.LittleEndian.PutUint64(m[16:], root)
+	binary.LittleEndian.PutUint64(m[48:], txID)
+	h := fnv.New64a()
+	h.Write(m[:boltMetaSize])
+	binary.LittleEndian.PutUint64(m[boltMetaSize:], h.Sum64())
+	return p
+}
+
+func etcdRevision(main uint64, tombstone bool) []byte {
+	b := binary.BigEndian.AppendUint64(nil, main)
+	b = append(b, '_')
+	b = binary.BigEndian.AppendUint64(b, 0)
+	if tombstone {
+		b = append(b, 't')
+	}
+	return b
+}
+
+func etcdKeyValue(key, value string) []byte {
+	var b []byte
+	b = append(b, 1<<3|2, byte(len(key)))
+	b = append(b, key...)
+	// Include a varint field that the reader must skip.
+	b = append(b, 2<<3|0, 7)
+	if len(value) > 0 {
+		b = append(b, 5<<3|2, byte(len(value)))
+		b = append(b, value...)
+	}
+	return b
+}
+
+func TestReadEtcdSnapshot(t *testing.T) {
+	keyBucket := make([]byte, 16)
+	binary.LittleEndian.PutUint64(keyBucket, 3)
+	var file []byte
+	// The second meta page is newer, but corrupt, so the reader must fall back to the first.
+	file = append(file, makeBoltMetaPage(0, 2, 4)...)
+	corrupt := makeBoltMetaPage(1, 2, 5)
+	corrupt[boltPageHeaderSize+16]++
+	file = append(file, corrupt...)
+	file = append(file, makeBoltLeafPage(2, []boltEntry{
+		{key: []byte(etcdKeyBucket), value: keyBucket, flags: boltBucketLeafFlag},
+	})...)
+	file = append(file, makeBoltLeafPage(3, []boltEntry{
+		{key: etcdRevision(2, false), value: etcdKeyValue("/a", "1")},
+		{key: etcdRevision(3, false), value: etcdKeyValue("/b", "2")},
+		{key: etcdRevision(4, false), value: etcdKeyValue("/a", "3")},
+		{key: etcdRevision(5, true), value: etcdKeyValue("/b", "")},
+		{key: etcdRevision(6, false), value: etcdKeyValue("/c", "4")},
+	})...)
+
+	records := make(map[string]string)
+	summary, err := ReadEtcdSnapshot(bytes.NewReader(file), collectRecords(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/a": "3",
+		"/c": "4",
+	}
+	if !reflect.DeepEqual(want, records) {
+		t.Errorf("records: want %v, got %v", want, records)
+	}
+	if want, got := (Summary{Records: 2}), summary; want != got {
+		t.Errorf("summary: want %+v, got %+v", want, got)
+	}
+
+	if _, err := ReadEtcdSnapshot(bytes.NewReader(make([]byte, testBoltPageSize)), collectRecords(records)); err == nil {
+		t.Error("want error reading file in another format")
+	}
+}
+
+func TestCompareRecords(t *testing.T) {
+	exportSource := func(dump string) RecordSource {
+		return func(consume RecordConsumer) error {
+			_, err := ReadExportCSV(strings.NewReader(dump), consume)
+			return err
+		}
+	}
+	earlier := exportSource("key,version,content_type,value\n" +
+		"kept,1,,same\n" +
+		"changed,2,,before\n" +
+		"removed,3,,gone\n" +
+		"\"multi\nline\",4,text/plain,\"a,b\"\n")
+	later := exportSource("key,version,content_type,value\n" +
+		"changed,7,,after\n" +
+		"added,8,,new\n" +
+		"\"multi\nline\",9,text/plain,\"a,b\"\n" +
+		"kept,5,,same\n")
+	c, err := CompareRecords(earlier, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Comparison{
+		Differences: []Difference{
+			{Key: []byte("added"), Kind: Added},
+			{Key: []byte("changed"), Kind: Changed},
+			{Key: []byte("removed"), Kind: Removed},
+		},
+		Unchanged: 2,
+	}
+	if !reflect.DeepEqual(want, c) {
+		t.Errorf("want %+v, got %+v", want, c)
+	}
+
+	if _, err := CompareRecords(exportSource("key,value\n"), later); err == nil {
+		t.Error("want error reading dump with unexpected header")
+	}
+	if _, err := CompareRecords(earlier, exportSource("key,version,content_type,value\nk,1,,a\nk,2,,b\n")); err == nil {
+		t.Error("want error reading dump with duplicate keys")
+	}
+}
@@ -0,0 +1,427 @@
+// Package migrate reads the records stored by other key-value databases, easing migration of
+// their content into this one.
+package migrate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// A RecordConsumer accepts a record read from another database. It must not retain the key or
+// value beyond the call.
+type RecordConsumer func(key, value []byte) error
+
+// Summary counts the entries that an importer encountered.
+type Summary struct {
+	// Records is the number of records supplied to the RecordConsumer.
+	Records int
+	// Skipped is the number of entries that the importer could not represent as records, such as
+	// those with structured values, or that had already expired.
+	Skipped int
+}
+
+// maxRDBStringLength is the length of the longest string that Redis can store.
+const maxRDBStringLength = 512 << 20
+
+// Redis RDB opcodes that precede something other than a key and value.
+const (
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMS = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+)
+
+// Redis RDB value types.
+const (
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+)
+
+// Redis RDB encodings for lengths and strings.
+const (
+	rdbLengthEncoding32Bit = 0x80
+	rdbLengthEncoding64Bit = 0x81
+	rdbStringEncodingLZF   = 3
+)
+
+type rdbReader struct {
+	r *bufio.Reader
+}
+
+func (rr *rdbReader) readByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+func (rr *rdbReader) readFull(n uint64) ([]byte, error) {
+	if n > maxRDBStringLength {
+		return nil, fmt.Errorf("length %d exceeds maximum of %d", n, maxRDBStringLength)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (rr *rdbReader) discard(n int) error {
+	_, err := rr.r.Discard(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readLength reads a length, reporting whether it instead identifies a special encoding for a
+// string.
+func (rr *rdbReader) readLength() (n uint64, special bool, err error) {
+	b, err := rr.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rr.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 2:
+		var width uint64
+		switch b {
+		case rdbLengthEncoding32Bit:
+			width = 4
+		case rdbLengthEncoding64Bit:
+			width = 8
+		default:
+			return 0, false, fmt.Errorf("unrecognized length encoding %#x", b)
+		}
+		buf, err := rr.readFull(width)
+		if err != nil {
+			return 0, false, err
+		}
+		if width == 4 {
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (rr *rdbReader) readPlainLength() (uint64, error) {
+	n, special, err := rr.readLength()
+	if err == nil && special {
+		err = errors.New("expected a length but found a string encoding")
+	}
+	return n, err
+}
+
+func (rr *rdbReader) readString() ([]byte, error) {
+	n, special, err := rr.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !special {
+		return rr.readFull(n)
+	}
+	switch n {
+	case 0, 1, 2:
+		// The string holds an integer stored in 1, 2, or 4 bytes.
+		buf, err := rr.readFull(1 << n)
+		if err != nil {
+			return nil, err
+		}
+		var i int64
+		switch n {
+		case 0:
+			i = int64(int8(buf[0]))
+		case 1:
+			i = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case 2:
+			i = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
+		return strconv.AppendInt(nil, i, 10), nil
+	case rdbStringEncodingLZF:
+		compressedLength, err := rr.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		length, err := rr.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		if length > maxRDBStringLength {
+			return nil, fmt.Errorf("length %d exceeds maximum of %d", length, maxRDBStringLength)
+		}
+		compressed, err := rr.readFull(compressedLength)
+		if err != nil {
+			return nil, err
+		}
+		return decompressLZF(compressed, int(length))
+	default:
+		return nil, fmt.Errorf("unrecognized string encoding %d", n)
+	}
+}
+
+// decompressLZF decompresses the given data compressed with the LZF algorithm, which must yield
+// the given number of bytes.
+func decompressLZF(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Copy a run of literal bytes.
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, errors.New("LZF literal run exceeds input")
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+		// Copy a run of bytes from earlier in the output.
+		run := ctrl >> 5
+		if run == 7 {
+			if i >= len(in) {
+				return nil, errors.New("LZF back reference is truncated")
+			}
+			run += int(in[i])
+			i++
+		}
+		run += 2
+		if i >= len(in) {
+			return nil, errors.New("LZF back reference is truncated")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("LZF back reference precedes output")
+		}
+		// The run may overlap the bytes that it appends, so copy one byte at a time.
+		for j := range run {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, fmt.Errorf("LZF data decompressed to %d bytes rather than %d", len(out), length)
+	}
+	return out, nil
+}
+
+func (rr *rdbReader) skipStrings(n uint64) error {
+	for range n {
+		if _, err := rr.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipValue reads past a value of the given type that can't be represented as a record.
+func (rr *rdbReader) skipValue(valueType byte) error {
+	switch valueType {
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		// These encode the whole collection in a single string.
+		return rr.skipStrings(1)
+	}
+	n, err := rr.readPlainLength()
+	if err != nil {
+		return err
+	}
+	switch valueType {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return rr.skipStrings(n)
+	case rdbTypeHash:
+		return rr.skipStrings(2 * n)
+	case rdbTypeZSet:
+		for range n {
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+			// Scores are stored as text preceded by a one-byte length, with a few lengths
+			// reserved to indicate special values.
+			length, err := rr.readByte()
+			if err != nil {
+				return err
+			}
+			if length < 253 {
+				if err := rr.discard(int(length)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeZSet2:
+		for range n {
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+			if err := rr.discard(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeListQuicklist2:
+		for range n {
+			if _, err := rr.readPlainLength(); err != nil {
+				return err
+			}
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported value type %d", valueType)
+	}
+}
+
+// ReadRedisRDB reads a Redis RDB file, supplying each key with a string value in the given
+// logical database to the given function. It skips keys with structured values (such as lists,
+// sets, and hashes), keys in other logical databases, and keys that expired before the given time,
+// but fails upon encountering values it can't parse, such as streams and those of Redis modules.
+// It reads the file sequentially, without retaining the records it supplies.
+func ReadRedisRDB(r io.Reader, database int, now time.Time, consume RecordConsumer) (Summary, error) {
+	var summary Summary
+	rr := rdbReader{bufio.NewReader(r)}
+	header, err := rr.readFull(9)
+	if err != nil {
+		return summary, fmt.Errorf("failed to read RDB header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return summary, errors.New("file is not in Redis RDB format")
+	}
+	if _, err := strconv.Atoi(string(header[5:])); err != nil {
+		return summary, fmt.Errorf("RDB header has invalid version %q", header[5:])
+	}
+	currentDatabase := 0
+	var expiresAt time.Time
+	for {
+		op, err := rr.readByte()
+		if err != nil {
+			return summary, err
+		}
+		switch op {
+		case rdbOpEOF:
+			// Ignore the checksum that follows.
+			return summary, nil
+		case rdbOpSelectDB:
+			n, err := rr.readPlainLength()
+			if err != nil {
+				return summary, err
+			}
+			if n > math.MaxInt32 {
+				return summary, fmt.Errorf("database number %d is out of range", n)
+			}
+			currentDatabase = int(n)
+		case rdbOpExpireTime:
+			buf, err := rr.readFull(4)
+			if err != nil {
+				return summary, err
+			}
+			expiresAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+		case rdbOpExpireTimeMS:
+			buf, err := rr.readFull(8)
+			if err != nil {
+				return summary, err
+			}
+			expiresAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+		case rdbOpResizeDB:
+			for range 2 {
+				if _, err := rr.readPlainLength(); err != nil {
+					return summary, err
+				}
+			}
+		case rdbOpSlotInfo:
+			for range 3 {
+				if _, err := rr.readPlainLength(); err != nil {
+					return summary, err
+				}
+			}
+		case rdbOpAux:
+			if err := rr.skipStrings(2); err != nil {
+				return summary, err
+			}
+		case rdbOpFunction2:
+			if err := rr.skipStrings(1); err != nil {
+				return summary, err
+			}
+		case rdbOpFreq:
+			if err := rr.discard(1); err != nil {
+				return summary, err
+			}
+		case rdbOpIdle:
+			if _, err := rr.readPlainLength(); err != nil {
+				return summary, err
+			}
+		case rdbOpModuleAux:
+			return summary, errors.New("RDB files with Redis module data are not supported")
+		default:
+			key, err := rr.readString()
+			if err != nil {
+				return summary, fmt.Errorf("failed to read key: %w", err)
+			}
+			expired := !expiresAt.IsZero() && !expiresAt.After(now)
+			expiresAt = time.Time{}
+			if op != rdbTypeString {
+				if err := rr.skipValue(op); err != nil {
+					return summary, fmt.Errorf("failed to read value for key %q: %w", key, err)
+				}
+				if currentDatabase == database {
+					summary.Skipped++
+				}
+				continue
+			}
+			value, err := rr.readString()
+			if err != nil {
+				return summary, fmt.Errorf("failed to read value for key %q: %w", key, err)
+			}
+			if currentDatabase != database {
+				continue
+			}
+			if expired {
+				summary.Skipped++
+				continue
+			}
+			if err := consume(key, value); err != nil {
+				return summary, err
+			}
+			summary.Records++
+		}
+	}
+}
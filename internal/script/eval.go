@@ -0,0 +1,454 @@
+// Package script runs small programs within a transaction on the server, sparing clients the
+// round trips of multi-step read-modify-write logic.
+//
+// Scripts use a minimal S-expression dialect rather than an embedded general-purpose language
+// such as Lua or Starlark. The database depends on no third-party packages besides its flag
+// parser, and the dialect needs none. It offers only what a transaction needs: a few special
+// forms, integer and string arithmetic, and the record operations. It has no loops, closures, or
+// user-defined functions, so a script's cost is bounded by its step quota, which the interpreter
+// counts per evaluated expression. The interpreter also checks for cancellation before each call
+// to a function, and it reports failures by byte offset within the source text.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"sehlabs.com/db/internal/db"
+)
+
+// ErrStepLimitExceeded is the error returned when a script evaluates more expressions than its
+// allowed quota. This may be wrapped in another error, and should normally be tested using
+// errors.Is(err, ErrStepLimitExceeded).
+var ErrStepLimitExceeded = errors.New("script exceeded its step limit")
+
+// AbortError is the error returned when a script requests aborting its transaction.
+type AbortError struct {
+	// Message is the reason the script supplied for aborting.
+	Message string
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("script aborted: %s", e.Message)
+}
+
+// RuntimeError describes a failure while evaluating a script.
+type RuntimeError struct {
+	// Offset is the byte offset within the source text of the expression being evaluated.
+	Offset int
+	// Err is the underlying failure.
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+type environment struct {
+	vars   map[string]interface{}
+	parent *environment
+}
+
+func (e *environment) lookup(name string) (interface{}, bool) {
+	for ; e != nil; e = e.parent {
+		if v, ok := e.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type interpreter struct {
+	ctx      context.Context
+	tx       db.Transaction
+	args     map[string]string
+	steps    int
+	maxSteps int
+}
+
+// Run evaluates the program's expressions in order within the given transaction, returning the
+// value of the last expression—which is nil, a bool, an int64, or a string—along with the number
+// of steps evaluated. It fails with ErrStepLimitExceeded if evaluating the program would take more
+// than the given positive number of steps.
+//
+// The script can read the given arguments by name via the "arg" function.
+func (p *Program) Run(ctx context.Context, tx db.Transaction, args map[string]string, maxSteps int) (interface{}, int, error) {
+	in := interpreter{
+		ctx:      ctx,
+		tx:       tx,
+		args:     args,
+		maxSteps: maxSteps,
+	}
+	var result interface{}
+	global := &environment{}
+	for _, form := range p.forms {
+		var err error
+		result, err = in.eval(form, global)
+		if err != nil {
+			return nil, in.steps, err
+		}
+	}
+	return result, in.steps, nil
+}
+
+func isTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func (in *interpreter) eval(n node, env *environment) (interface{}, error) {
+	in.steps++
+	if in.steps > in.maxSteps {
+		return nil, ErrStepLimitExceeded
+	}
+	switch n := n.(type) {
+	case int64:
+		return n, nil
+	case stringLiteral:
+		return string(n), nil
+	case symbol:
+		switch n {
+		case "nil":
+			return nil, nil
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		if v, ok := env.lookup(string(n)); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("undefined name %q", n)
+	case *list:
+		v, err := in.evalList(n, env)
+		if err != nil {
+			var rErr *RuntimeError
+			var aErr *AbortError
+			if errors.Is(err, ErrStepLimitExceeded) || errors.As(err, &rErr) || errors.As(err, &aErr) {
+				return nil, err
+			}
+			return nil, &RuntimeError{Offset: n.pos, Err: err}
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unexpected node of type %T", n)
+	}
+}
+
+func (in *interpreter) evalList(l *list, env *environment) (interface{}, error) {
+	if len(l.nodes) == 0 {
+		return nil, errors.New("cannot evaluate empty list")
+	}
+	head, ok := l.nodes[0].(symbol)
+	if !ok {
+		return nil, errors.New("first element of list must be a name")
+	}
+	operands := l.nodes[1:]
+	// Special forms don't evaluate all their operands up front.
+	switch head {
+	case "do":
+		return in.evalSequence(operands, env)
+	case "let":
+		if len(operands) < 1 {
+			return nil, errors.New("let requires a list of bindings")
+		}
+		bindings, ok := operands[0].(*list)
+		if !ok {
+			return nil, errors.New("let requires a list of bindings")
+		}
+		scope := &environment{vars: make(map[string]interface{}, len(bindings.nodes)), parent: env}
+		for _, b := range bindings.nodes {
+			pair, ok := b.(*list)
+			if !ok || len(pair.nodes) != 2 {
+				return nil, errors.New("each let binding must be a list of a name and an expression")
+			}
+			name, ok := pair.nodes[0].(symbol)
+			if !ok {
+				return nil, errors.New("each let binding must start with a name")
+			}
+			v, err := in.eval(pair.nodes[1], scope)
+			if err != nil {
+				return nil, err
+			}
+			scope.vars[string(name)] = v
+		}
+		return in.evalSequence(operands[1:], scope)
+	case "if":
+		if len(operands) < 2 || len(operands) > 3 {
+			return nil, errors.New("if requires a condition, a consequent, and an optional alternative")
+		}
+		c, err := in.eval(operands[0], env)
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(c) {
+			return in.eval(operands[1], env)
+		}
+		if len(operands) == 3 {
+			return in.eval(operands[2], env)
+		}
+		return nil, nil
+	case "and":
+		var v interface{} = true
+		for _, o := range operands {
+			var err error
+			if v, err = in.eval(o, env); err != nil {
+				return nil, err
+			}
+			if !isTruthy(v) {
+				return v, nil
+			}
+		}
+		return v, nil
+	case "or":
+		var v interface{}
+		for _, o := range operands {
+			var err error
+			if v, err = in.eval(o, env); err != nil {
+				return nil, err
+			}
+			if isTruthy(v) {
+				return v, nil
+			}
+		}
+		return v, nil
+	}
+	f, ok := builtins[string(head)]
+	if !ok {
+		return nil, fmt.Errorf("undefined function %q", head)
+	}
+	if f.arity >= 0 && len(operands) != f.arity {
+		return nil, fmt.Errorf("function %q requires %d arguments, but got %d", head, f.arity, len(operands))
+	}
+	args := make([]interface{}, len(operands))
+	for i, o := range operands {
+		v, err := in.eval(o, env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if err := in.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.call(in, args)
+}
+
+func (in *interpreter) evalSequence(nodes []node, env *environment) (interface{}, error) {
+	var v interface{}
+	for _, n := range nodes {
+		var err error
+		if v, err = in.eval(n, env); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+type builtin struct {
+	// arity is the required number of arguments, or -1 if the function is variadic.
+	arity int
+	call  func(*interpreter, []interface{}) (interface{}, error)
+}
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"not": {1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			return !isTruthy(args[0]), nil
+		}},
+		"=": {2, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			return args[0] == args[1], nil
+		}},
+		"<":  {2, compareInts(func(a, b int64) bool { return a < b })},
+		"<=": {2, compareInts(func(a, b int64) bool { return a <= b })},
+		">":  {2, compareInts(func(a, b int64) bool { return a > b })},
+		">=": {2, compareInts(func(a, b int64) bool { return a >= b })},
+		"+": {-1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			var sum int64
+			for _, a := range args {
+				n, err := toInt(a)
+				if err != nil {
+					return nil, err
+				}
+				sum += n
+			}
+			return sum, nil
+		}},
+		"-": {2, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			a, err := toInt(args[0])
+			if err != nil {
+				return nil, err
+			}
+			b, err := toInt(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return a - b, nil
+		}},
+		"concat": {-1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			var s string
+			for _, a := range args {
+				s += toString(a)
+			}
+			return s, nil
+		}},
+		"str": {1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			return toString(args[0]), nil
+		}},
+		"int": {1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			if s, ok := args[0].(string); ok {
+				n, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("cannot convert %q to int", s)
+				}
+				return n, nil
+			}
+			return toInt(args[0])
+		}},
+		"len": {1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("len requires a string, but got %s", describe(args[0]))
+			}
+			return int64(len(s)), nil
+		}},
+		"arg": {1, func(in *interpreter, args []interface{}) (interface{}, error) {
+			name, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("arg requires a string, but got %s", describe(args[0]))
+			}
+			if v, ok := in.args[name]; ok {
+				return v, nil
+			}
+			return nil, nil
+		}},
+		"abort": {1, func(_ *interpreter, args []interface{}) (interface{}, error) {
+			return nil, &AbortError{Message: toString(args[0])}
+		}},
+		"get": {1, func(in *interpreter, args []interface{}) (interface{}, error) {
+			k, err := toKey(args[0])
+			if err != nil {
+				return nil, err
+			}
+			v, err := in.tx.Get(in.ctx, k)
+			if errors.Is(err, db.ErrRecordDoesNotExist) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return string(v), nil
+		}},
+		"exists": {1, func(in *interpreter, args []interface{}) (interface{}, error) {
+			k, err := toKey(args[0])
+			if err != nil {
+				return nil, err
+			}
+			_, err = in.tx.Get(in.ctx, k)
+			if errors.Is(err, db.ErrRecordDoesNotExist) {
+				return false, nil
+			}
+			return err == nil, err
+		}},
+		"insert": {2, mutate(db.Transaction.Insert)},
+		"update": {2, mutate(db.Transaction.Update)},
+		"upsert": {2, mutate(db.Transaction.Upsert)},
+		"delete": {1, func(in *interpreter, args []interface{}) (interface{}, error) {
+			k, err := toKey(args[0])
+			if err != nil {
+				return nil, err
+			}
+			deleted, err := in.tx.Delete(in.ctx, k)
+			if err != nil {
+				return nil, err
+			}
+			return deleted, nil
+		}},
+	}
+}
+
+func compareInts(cmp func(a, b int64) bool) func(*interpreter, []interface{}) (interface{}, error) {
+	return func(_ *interpreter, args []interface{}) (interface{}, error) {
+		a, err := toInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return cmp(a, b), nil
+	}
+}
+
+func mutate(f func(db.Transaction, context.Context, db.Key, db.Value) error) func(*interpreter, []interface{}) (interface{}, error) {
+	return func(in *interpreter, args []interface{}) (interface{}, error) {
+		k, err := toKey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := f(in.tx, in.ctx, k, db.Value(toString(args[1]))); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+}
+
+func toInt(v interface{}) (int64, error) {
+	if n, ok := v.(int64); ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected int, but got %s", describe(v))
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toKey(v interface{}) (db.Key, error) {
+	s, ok := v.(string)
+	if !ok || len(s) == 0 {
+		return nil, fmt.Errorf("record key must be a nonempty string, but got %s", describe(v))
+	}
+	return db.Key(s), nil
+}
@@ -0,0 +1,141 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node is an element of a parsed program: an int64, a stringLiteral, a symbol, or a list of nodes.
+type node interface{}
+
+type symbol string
+
+type stringLiteral string
+
+type list struct {
+	pos   int
+	nodes []node
+}
+
+// SyntaxError describes a failure to parse a script's source text.
+type SyntaxError struct {
+	// Offset is the byte offset within the source text at which the problem arose.
+	Offset int
+	// Message describes the problem.
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.Offset, e.Message)
+}
+
+type parser struct {
+	source string
+	pos    int
+}
+
+func (p *parser) skipSpaceAndComments() {
+	for p.pos < len(p.source) {
+		switch c := p.source[p.pos]; {
+		case c == ';':
+			if i := strings.IndexByte(p.source[p.pos:], '\n'); i >= 0 {
+				p.pos += i + 1
+			} else {
+				p.pos = len(p.source)
+			}
+		case unicode.IsSpace(rune(c)):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) fail(format string, a ...interface{}) error {
+	return &SyntaxError{Offset: p.pos, Message: fmt.Sprintf(format, a...)}
+}
+
+// parseNode parses the next node, assuming that the parser is not at the end of the source text.
+func (p *parser) parseNode() (node, error) {
+	switch c := p.source[p.pos]; c {
+	case '(':
+		l := list{pos: p.pos}
+		p.pos++
+		for {
+			p.skipSpaceAndComments()
+			if p.pos == len(p.source) {
+				return nil, p.fail("unterminated list starting at offset %d", l.pos)
+			}
+			if p.source[p.pos] == ')' {
+				p.pos++
+				return &l, nil
+			}
+			n, err := p.parseNode()
+			if err != nil {
+				return nil, err
+			}
+			l.nodes = append(l.nodes, n)
+		}
+	case ')':
+		return nil, p.fail("unexpected closing parenthesis")
+	case '"':
+		start := p.pos
+		for i := start + 1; i < len(p.source); i++ {
+			switch p.source[i] {
+			case '\\':
+				i++
+			case '"':
+				s, err := strconv.Unquote(p.source[start : i+1])
+				if err != nil {
+					return nil, p.fail("invalid string literal: %v", err)
+				}
+				p.pos = i + 1
+				return stringLiteral(s), nil
+			}
+		}
+		return nil, p.fail("unterminated string literal")
+	default:
+		start := p.pos
+		for p.pos < len(p.source) {
+			c := p.source[p.pos]
+			if c == '(' || c == ')' || c == '"' || c == ';' || unicode.IsSpace(rune(c)) {
+				break
+			}
+			p.pos++
+		}
+		atom := p.source[start:p.pos]
+		if n, err := strconv.ParseInt(atom, 10, 64); err == nil {
+			return n, nil
+		}
+		return symbol(atom), nil
+	}
+}
+
+// Program is a parsed script, ready to run.
+type Program struct {
+	forms []node
+}
+
+// Parse parses the given source text as a script, consisting of a sequence of expressions
+// written as S-expressions.
+func Parse(source string) (*Program, error) {
+	p := parser{source: source}
+	var prog Program
+	for {
+		p.skipSpaceAndComments()
+		if p.pos == len(p.source) {
+			break
+		}
+		n, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		prog.forms = append(prog.forms, n)
+	}
+	if len(prog.forms) == 0 {
+		return nil, &SyntaxError{Message: "script is empty"}
+	}
+	return &prog, nil
+}
@@ -0,0 +1,272 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"sehlabs.com/db/internal/db"
+)
+
+func runScript(ctx context.Context, t *testing.T, store *db.ShardedStore, source string, args map[string]string, maxSteps int) (interface{}, error) {
+	t.Helper()
+	program, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result interface{}
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		var err error
+		result, _, err = program.Run(ctx, tx, args, maxSteps)
+		return err == nil, err
+	})
+	return result, err
+}
+
+func TestTransfer(t *testing.T) {
+	store, err := db.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := runScript(ctx, t, store, `(insert "a" "10") (insert "b" "5")`, nil, 100); err != nil {
+		t.Fatal(err)
+	}
+	const transfer = `
+; Move an amount from one balance to another, refusing to overdraw.
+(let ((amount (int (arg "amount")))
+      (from (int (get "a"))))
+  (if (< from amount)
+      (abort "insufficient funds"))
+  (update "a" (- from amount))
+  (update "b" (+ (int (get "b")) amount))
+  (get "b"))`
+	result, err := runScript(ctx, t, store, transfer, map[string]string{"amount": "7"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "12", result; want != got {
+		t.Errorf("result: want %q, got %v", want, got)
+	}
+	_, err = runScript(ctx, t, store, transfer, map[string]string{"amount": "7"}, 100)
+	var abortErr *AbortError
+	if !errors.As(err, &abortErr) {
+		t.Fatalf("want abort error, got %v", err)
+	}
+	if _, err := runScript(ctx, t, store, transfer, map[string]string{"amount": "1"}, 5); !errors.Is(err, ErrStepLimitExceeded) {
+		t.Fatalf("want step limit error, got %v", err)
+	}
+	result, err = runScript(ctx, t, store, `(concat (get "a") "," (get "b"))`, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "3,12", result; want != got {
+		t.Errorf("balances: want %q, got %v", want, got)
+	}
+}
+
+func TestParseRejectsMalformedSource(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		source     string
+		wantOffset int
+	}{
+		{name: "empty", source: "", wantOffset: 0},
+		{name: "only comments", source: "  ; nothing here\n", wantOffset: 0},
+		{name: "unterminated list", source: `(+ 1 2`, wantOffset: 6},
+		{name: "unterminated nested list", source: `(do (get "a")`, wantOffset: 13},
+		{name: "unexpected closing parenthesis", source: `(get "a"))`, wantOffset: 9},
+		{name: "unterminated string", source: `(get "a)`, wantOffset: 5},
+		{name: "invalid escape", source: `(get "\q")`, wantOffset: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.source)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("want syntax error, got %v", err)
+			}
+			if want, got := tc.wantOffset, syntaxErr.Offset; want != got {
+				t.Errorf("offset: want %d, got %d (%v)", want, got, err)
+			}
+		})
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	store, err := db.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		source string
+		// wantMessage is a fragment of the expected error's message.
+		wantMessage string
+		// wantOffset is the expected offset of the runtime error, or -1 if the error is not a
+		// runtime error.
+		wantOffset int
+	}{
+		{name: "undefined name", source: `x`, wantMessage: `undefined name "x"`, wantOffset: -1},
+		{name: "undefined name in call", source: `(+ 1 x)`, wantMessage: `undefined name "x"`, wantOffset: 0},
+		{name: "undefined function", source: `(do (frob 1))`, wantMessage: `undefined function "frob"`, wantOffset: 4},
+		{name: "wrong number of arguments", source: `(not 1 2)`, wantMessage: `requires 1 arguments, but got 2`, wantOffset: 0},
+		{name: "empty list", source: `()`, wantMessage: "empty list", wantOffset: 0},
+		{name: "non-name in function position", source: `(1 2)`, wantMessage: "must be a name", wantOffset: 0},
+		{name: "adding a string", source: `(+ 1 "2")`, wantMessage: "expected int, but got string", wantOffset: 0},
+		{name: "comparing nil", source: `(< (arg "missing") 1)`, wantMessage: "expected int, but got nil", wantOffset: 0},
+		{name: "length of an int", source: `(len 5)`, wantMessage: "len requires a string, but got int", wantOffset: 0},
+		{name: "unparseable int", source: `(int "five")`, wantMessage: `cannot convert "five" to int`, wantOffset: 0},
+		{name: "non-string key", source: `(get true)`, wantMessage: "record key must be a nonempty string, but got bool", wantOffset: 0},
+		{name: "empty key", source: `(insert "" "v")`, wantMessage: "record key must be a nonempty string", wantOffset: 0},
+		{name: "malformed if", source: `(if true)`, wantMessage: "if requires a condition", wantOffset: 0},
+		{name: "malformed let", source: `(let x x)`, wantMessage: "let requires a list of bindings", wantOffset: 0},
+		{name: "malformed let binding", source: `(let ((x)) x)`, wantMessage: "each let binding must be a list", wantOffset: 0},
+		{name: "non-name let binding", source: `(let ((1 2)) 1)`, wantMessage: "each let binding must start with a name", wantOffset: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runScript(ctx, t, store, tc.source, nil, 100)
+			if err == nil {
+				t.Fatal("want error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.wantMessage) {
+				t.Errorf("want error mentioning %q, got %v", tc.wantMessage, err)
+			}
+			var runtimeErr *RuntimeError
+			switch isRuntimeErr := errors.As(err, &runtimeErr); {
+			case tc.wantOffset < 0 && isRuntimeErr:
+				t.Errorf("want error other than a runtime error, got %v", err)
+			case tc.wantOffset >= 0 && !isRuntimeErr:
+				t.Errorf("want runtime error, got %v", err)
+			case isRuntimeErr && runtimeErr.Offset != tc.wantOffset:
+				t.Errorf("offset: want %d, got %d", tc.wantOffset, runtimeErr.Offset)
+			}
+		})
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	store, err := db.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// Evaluating the list, the name, and each operand takes one step apiece.
+	const source = `(+ 1 2)`
+	program, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.WithinTransaction(ctx, func(ctx context.Context, tx db.Transaction) (bool, error) {
+		result, steps, err := program.Run(ctx, tx, nil, 3)
+		if err != nil {
+			return false, err
+		}
+		if want, got := int64(3), result; want != got {
+			t.Errorf("result: want %d, got %v", want, got)
+		}
+		if want, got := 3, steps; want != got {
+			t.Errorf("steps: want %d, got %d", want, got)
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		source   string
+		maxSteps int
+	}{
+		{name: "one step short", source: source, maxSteps: 2},
+		{name: "deep within nested forms", source: `(let ((x 1)) (if (= x 1) (do (+ x (+ x (+ x x))))))`, maxSteps: 10},
+		{name: "in a later expression", source: `(insert "k" "v") (get "k")`, maxSteps: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runScript(ctx, t, store, tc.source, nil, tc.maxSteps)
+			if !errors.Is(err, ErrStepLimitExceeded) {
+				t.Fatalf("want step limit error, got %v", err)
+			}
+			var runtimeErr *RuntimeError
+			if errors.As(err, &runtimeErr) {
+				t.Errorf("want step limit error not wrapped as a runtime error, got %v", err)
+			}
+		})
+	}
+	// The script's transaction rolls back, discarding its earlier writes.
+	result, err := runScript(ctx, t, store, `(exists "k")`, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != false {
+		t.Errorf("want record written before exceeding the step limit to be absent, got %v", result)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	store, err := db.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	_, err = runScript(ctx, t, store, `(insert "k" "v") (if (exists "k") (abort (concat "found " 1)) "unreachable")`, nil, 100)
+	var abortErr *AbortError
+	if !errors.As(err, &abortErr) {
+		t.Fatalf("want abort error, got %v", err)
+	}
+	if want, got := "found 1", abortErr.Message; want != got {
+		t.Errorf("message: want %q, got %q", want, got)
+	}
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		t.Errorf("want abort error not wrapped as a runtime error, got %v", err)
+	}
+	result, err := runScript(ctx, t, store, `(exists "k")`, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != false {
+		t.Errorf("want record written before aborting to be absent, got %v", result)
+	}
+}
+
+func TestLetScoping(t *testing.T) {
+	store, err := db.MakeShardedStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		source string
+		want   interface{}
+	}{
+		{name: "inner scope sees outer bindings", source: `(let ((x 1)) (let ((y 2)) (+ x y)))`, want: int64(3)},
+		{name: "later bindings see earlier ones", source: `(let ((x 1) (y (+ x 1))) y)`, want: int64(2)},
+		{name: "inner binding shadows outer", source: `(let ((x 1)) (let ((x 2)) x))`, want: int64(2)},
+		{name: "shadowing ends with inner scope", source: `(let ((x 1)) (concat (let ((x 2)) x) x))`, want: "21"},
+		{name: "rebinding within one scope", source: `(let ((x 1) (x (+ x 1))) x)`, want: int64(2)},
+		{name: "empty bindings", source: `(let () "body")`, want: "body"},
+		{name: "empty body", source: `(let ((x 1)))`, want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := runScript(ctx, t, store, tc.source, nil, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tc.want {
+				t.Errorf("want %#v, got %#v", tc.want, result)
+			}
+		})
+	}
+	for _, source := range []string{
+		`(let ((x 1)) x) x`,
+		`(do (let ((x 1)) x) x)`,
+		`(let ((x y) (y 1)) x)`,
+	} {
+		if _, err := runScript(ctx, t, store, source, nil, 100); err == nil || !strings.Contains(err.Error(), "undefined name") {
+			t.Errorf("%s: want undefined name error, got %v", source, err)
+		}
+	}
+}